@@ -0,0 +1,201 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#include "AuditLog.hpp"
+
+#include <stdio.h>
+#include <string.h>
+
+#include <chrono>
+#include <deque>
+
+#include "../node/Constants.hpp"
+#include "../osdep/OSUtils.hpp"
+
+#include "Webhooks.hpp"
+
+namespace ZeroTier {
+
+// Drop fields that are secret or change on every save
+static void _auditRedact(nlohmann::json &o)
+{
+	if (!o.is_object())
+		return;
+	o.erase("revision");
+	o.erase("lastAuthorizedCredential"); // may be a token that authorizes others
+	Webhooks::redactSecrets(o);
+}
+
+// Reduce a full network or member object to the fields worth listing
+static nlohmann::json _auditSummary(const nlohmann::json &o)
+{
+	if ((o.is_object())&&(o.count("objtype"))) {
+		static const char *const keys[4] = { "name","private","authorized","ipAssignments" };
+		nlohmann::json s(nlohmann::json::object());
+		for(unsigned int i=0;i<4;++i) {
+			nlohmann::json::const_iterator k(o.find(keys[i]));
+			if (k != o.end())
+				s[keys[i]] = *k;
+		}
+		return s;
+	}
+	nlohmann::json s(o);
+	_auditRedact(s);
+	return s;
+}
+
+AuditLog::AuditLog(const std::string &ztPath) :
+	_path(ztPath + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_AUDIT_LOG_FILENAME),
+	_run(true)
+{
+	_thread = std::thread([this]() {
+		for(;;) {
+			{
+				std::unique_lock<std::mutex> l(_pending_l);
+				if (_run)
+					_wake.wait_for(l,std::chrono::milliseconds(1000));
+				if (!_run)
+					break;
+			}
+			std::lock_guard<std::mutex> l(_file_l);
+			_write();
+		}
+	});
+}
+
+AuditLog::~AuditLog()
+{
+	{
+		std::lock_guard<std::mutex> l(_pending_l);
+		_run = false;
+	}
+	_wake.notify_all();
+	if (_thread.joinable())
+		_thread.join();
+	std::lock_guard<std::mutex> l(_file_l);
+	_write();
+}
+
+void AuditLog::record(const std::string &actor,const char *op,uint64_t networkId,uint64_t memberId,const nlohmann::json &before,const nlohmann::json &after)
+{
+	char tmp[64];
+	nlohmann::json e;
+	e["time"] = OSUtils::now();
+	e["actor"] = actor;
+	e["op"] = op;
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)networkId);
+	e["networkId"] = tmp;
+	if (memberId) {
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)memberId);
+		e["memberId"] = tmp;
+	}
+
+	const bool hasBefore = ((before.is_object())&&(!before.empty()));
+	const bool hasAfter = ((after.is_object())&&(!after.empty()));
+	if ((hasBefore)&&(hasAfter)) {
+		// Only the fields that changed, with null for ones that were added or removed
+		nlohmann::json b(before),a(after),cb(nlohmann::json::object()),ca(nlohmann::json::object());
+		_auditRedact(b);
+		_auditRedact(a);
+		for(nlohmann::json::const_iterator i(b.begin());i!=b.end();++i) {
+			nlohmann::json::const_iterator j(a.find(i.key()));
+			if ((j == a.end())||(*j != i.value())) {
+				cb[i.key()] = i.value();
+				ca[i.key()] = (j == a.end()) ? nlohmann::json() : *j;
+			}
+		}
+		for(nlohmann::json::const_iterator j(a.begin());j!=a.end();++j) {
+			if (!b.count(j.key())) {
+				cb[j.key()] = nlohmann::json();
+				ca[j.key()] = j.value();
+			}
+		}
+		e["before"] = cb;
+		e["after"] = ca;
+	} else {
+		e["before"] = (hasBefore) ? _auditSummary(before) : nlohmann::json();
+		e["after"] = (hasAfter) ? _auditSummary(after) : nlohmann::json();
+	}
+
+	const std::string line(OSUtils::jsonDump(e,-1));
+	std::lock_guard<std::mutex> l(_pending_l);
+	_pending.push_back(line);
+}
+
+nlohmann::json AuditLog::query(uint64_t networkId,int64_t since)
+{
+	char nwids[24];
+	OSUtils::ztsnprintf(nwids,sizeof(nwids),"%.16llx",(unsigned long long)networkId);
+
+	std::lock_guard<std::mutex> l(_file_l);
+	_write();
+
+	std::deque<nlohmann::json> found;
+	const std::string paths[2] = { _path + ".1",_path };
+	for(unsigned int p=0;p<2;++p) {
+		std::string d;
+		if (!OSUtils::readFile(paths[p].c_str(),d))
+			continue;
+		std::string::size_type s = 0;
+		while (s < d.length()) {
+			std::string::size_type eol = d.find('\n',s);
+			if (eol == std::string::npos)
+				eol = d.length();
+			try {
+				nlohmann::json e(OSUtils::jsonParse(d.substr(s,eol - s)));
+				if ( (e.is_object()) && ((!networkId)||(OSUtils::jsonString(e["networkId"],"") == nwids)) && ((int64_t)OSUtils::jsonInt(e["time"],0ULL) > since) ) {
+					found.push_back(e);
+					if (found.size() > ZT_CONTROLLER_AUDIT_LOG_QUERY_MAX)
+						found.pop_front();
+				}
+			} catch ( ... ) {} // skip partly written or damaged lines
+			s = eol + 1;
+		}
+	}
+
+	nlohmann::json r(nlohmann::json::array());
+	for(std::deque<nlohmann::json>::iterator e(found.begin());e!=found.end();++e)
+		r.push_back(*e);
+	return r;
+}
+
+// Caller must hold _file_l
+void AuditLog::_write()
+{
+	std::vector<std::string> lines;
+	{
+		std::lock_guard<std::mutex> l(_pending_l);
+		lines.swap(_pending);
+	}
+	if (lines.empty())
+		return;
+
+	FILE *f = fopen(_path.c_str(),"a");
+	if (!f) {
+		fprintf(stderr,"WARNING: unable to write controller audit log %s, %lu entries lost" ZT_EOL_S,_path.c_str(),(unsigned long)lines.size());
+		return;
+	}
+	for(std::vector<std::string>::iterator i(lines.begin());i!=lines.end();++i)
+		fprintf(f,"%s\n",i->c_str());
+	const long size = ftell(f);
+	fclose(f);
+	OSUtils::lockDownFile(_path.c_str(),false);
+
+	if (size > ZT_CONTROLLER_AUDIT_LOG_MAX_SIZE) {
+		const std::string rotated(_path + ".1");
+		OSUtils::rm(rotated.c_str());
+		OSUtils::rename(_path.c_str(),rotated.c_str());
+	}
+}
+
+} // namespace ZeroTier
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#ifndef ZT_CONTROLLER_AUDITLOG_HPP
+#define ZT_CONTROLLER_AUDITLOG_HPP
+
+#include <stdint.h>
+
+#include <string>
+#include <vector>
+#include <thread>
+#include <mutex>
+#include <condition_variable>
+
+#include "../ext/json/json.hpp"
+
+// Audit log, one JSON object per line, in the ZeroTier home path
+#define ZT_CONTROLLER_AUDIT_LOG_FILENAME "controller-audit.log"
+
+// Past this size the log is moved to <name>.1, replacing the previous one
+#define ZT_CONTROLLER_AUDIT_LOG_MAX_SIZE 16777216
+
+// Most entries returned by one query, the newest are kept
+#define ZT_CONTROLLER_AUDIT_LOG_QUERY_MAX 10000
+
+namespace ZeroTier {
+
+/**
+ * Append-only record of changes to controller networks and members
+ *
+ * Entries are queued in memory and written by a background thread about
+ * once a second, so recording never waits on the disk. Anything still
+ * queued is written when the log is destroyed.
+ */
+class AuditLog
+{
+public:
+	AuditLog(const std::string &ztPath);
+	~AuditLog();
+
+	/**
+	 * Queue an entry
+	 *
+	 * Full network or member objects are reduced to the fields that changed,
+	 * or to a short summary when one side is null. Other objects are recorded
+	 * as given. Secrets are never recorded.
+	 *
+	 * @param actor Who made the change, e.g. authtoken, token:<ID>, or controller
+	 * @param op Operation, e.g. member-authorize
+	 * @param networkId Network changed
+	 * @param memberId Member changed or 0 if none
+	 * @param before Object before the change or null if it was created
+	 * @param after Object after the change or null if it was deleted
+	 */
+	void record(const std::string &actor,const char *op,uint64_t networkId,uint64_t memberId,const nlohmann::json &before,const nlohmann::json &after);
+
+	/**
+	 * @param networkId Network to list entries for or 0 for all
+	 * @param since Only list entries newer than this time in ms since epoch
+	 * @return Entries in the order they were recorded
+	 */
+	nlohmann::json query(uint64_t networkId,int64_t since);
+
+private:
+	void _write();
+
+	std::string _path;
+	std::vector<std::string> _pending;
+	std::mutex _pending_l;
+	std::mutex _file_l;
+	std::condition_variable _wake;
+	bool _run;
+	std::thread _thread;
+};
+
+} // namespace ZeroTier
+
+#endif
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#include "ControllerStats.hpp"
+
+#include <stdio.h>
+
+#include <chrono>
+
+#include "../node/Constants.hpp"
+#include "../node/Utils.hpp"
+#include "../osdep/OSUtils.hpp"
+
+namespace ZeroTier {
+
+ControllerStats::ControllerStats(const std::string &ztPath) :
+	_path(ztPath + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_STATS_FILENAME),
+	_since(OSUtils::now()),
+	_dirty(false),
+	_run(true)
+{
+	_load();
+	_thread = std::thread([this]() {
+		for(;;) {
+			{
+				std::unique_lock<std::mutex> l(_networks_l);
+				if (_run)
+					_wake.wait_for(l,std::chrono::milliseconds(ZT_CONTROLLER_STATS_SAVE_PERIOD));
+				if (!_run)
+					break;
+			}
+			_save();
+		}
+	});
+}
+
+ControllerStats::~ControllerStats()
+{
+	{
+		std::lock_guard<std::mutex> l(_networks_l);
+		_run = false;
+	}
+	_wake.notify_all();
+	if (_thread.joinable())
+		_thread.join();
+	_save();
+}
+
+void ControllerStats::request(uint64_t networkId,uint64_t memberId,int64_t now)
+{
+	std::lock_guard<std::mutex> l(_networks_l);
+	_networks[networkId].lastRequest[memberId] = now;
+	_dirty = true;
+}
+
+void ControllerStats::configServed(uint64_t networkId)
+{
+	std::lock_guard<std::mutex> l(_networks_l);
+	++_networks[networkId].configRequests;
+	_dirty = true;
+}
+
+void ControllerStats::newMember(uint64_t networkId)
+{
+	std::lock_guard<std::mutex> l(_networks_l);
+	++_networks[networkId].newMembers;
+	_dirty = true;
+}
+
+void ControllerStats::authorization(uint64_t networkId,bool authorized)
+{
+	std::lock_guard<std::mutex> l(_networks_l);
+	_Network &n = _networks[networkId];
+	++((authorized) ? n.authorizations : n.deauthorizations);
+	_dirty = true;
+}
+
+void ControllerStats::erase(uint64_t networkId)
+{
+	std::lock_guard<std::mutex> l(_networks_l);
+	if (_networks.erase(networkId))
+		_dirty = true;
+}
+
+nlohmann::json ControllerStats::get(uint64_t networkId,int64_t now)
+{
+	std::lock_guard<std::mutex> l(_networks_l);
+	std::map< uint64_t,_Network >::const_iterator n(_networks.find(networkId));
+	nlohmann::json r(_counters((n != _networks.end()) ? n->second : _Network(),now));
+	r["since"] = _since;
+	return r;
+}
+
+nlohmann::json ControllerStats::all(int64_t now)
+{
+	char tmp[24];
+	nlohmann::json r(nlohmann::json::object());
+	std::lock_guard<std::mutex> l(_networks_l);
+	for(std::map< uint64_t,_Network >::const_iterator n(_networks.begin());n!=_networks.end();++n) {
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)n->first);
+		r[tmp] = _counters(n->second,now);
+	}
+	return r;
+}
+
+nlohmann::json ControllerStats::_counters(const _Network &n,int64_t now)
+{
+	unsigned long activeShort = 0,activeLong = 0;
+	for(std::map< uint64_t,int64_t >::const_iterator m(n.lastRequest.begin());m!=n.lastRequest.end();++m) {
+		const int64_t age = now - m->second;
+		if (age < ZT_CONTROLLER_STATS_ACTIVE_SHORT)
+			++activeShort;
+		if (age < ZT_CONTROLLER_STATS_ACTIVE_LONG)
+			++activeLong;
+	}
+	nlohmann::json r;
+	r["configRequests"] = n.configRequests;
+	r["newMembers"] = n.newMembers;
+	r["authorizations"] = n.authorizations;
+	r["deauthorizations"] = n.deauthorizations;
+	r["activeMembers5m"] = activeShort;
+	r["activeMembers60m"] = activeLong;
+	return r;
+}
+
+void ControllerStats::_load()
+{
+	std::string d;
+	if (!OSUtils::readFile(_path.c_str(),d))
+		return;
+	try {
+		nlohmann::json s(OSUtils::jsonParse(d));
+		_since = (int64_t)OSUtils::jsonInt(s["since"],(uint64_t)_since);
+		nlohmann::json &networks = s["networks"];
+		if (!networks.is_object())
+			return;
+		for(nlohmann::json::iterator i(networks.begin());i!=networks.end();++i) {
+			nlohmann::json &c = i.value();
+			_Network &n = _networks[Utils::hexStrToU64(i.key().c_str())];
+			n.configRequests = OSUtils::jsonInt(c["configRequests"],0ULL);
+			n.newMembers = OSUtils::jsonInt(c["newMembers"],0ULL);
+			n.authorizations = OSUtils::jsonInt(c["authorizations"],0ULL);
+			n.deauthorizations = OSUtils::jsonInt(c["deauthorizations"],0ULL);
+			nlohmann::json &lr = c["lastRequest"];
+			if (lr.is_object()) {
+				for(nlohmann::json::iterator m(lr.begin());m!=lr.end();++m)
+					n.lastRequest[Utils::hexStrToU64(m.key().c_str())] = (int64_t)OSUtils::jsonInt(m.value(),0ULL);
+			}
+		}
+	} catch ( ... ) {
+		fprintf(stderr,"WARNING: unable to read controller statistics from %s, starting from zero" ZT_EOL_S,_path.c_str());
+		_networks.clear();
+	}
+}
+
+void ControllerStats::_save()
+{
+	char tmp[24];
+	nlohmann::json networks(nlohmann::json::object());
+	{
+		std::lock_guard<std::mutex> l(_networks_l);
+		if (!_dirty)
+			return;
+		_dirty = false;
+
+		// Members last seen before the longest active period no longer count for anything
+		const int64_t now = OSUtils::now();
+		for(std::map< uint64_t,_Network >::iterator n(_networks.begin());n!=_networks.end();++n) {
+			nlohmann::json lr(nlohmann::json::object());
+			for(std::map< uint64_t,int64_t >::iterator m(n->second.lastRequest.begin());m!=n->second.lastRequest.end();) {
+				if ((now - m->second) >= ZT_CONTROLLER_STATS_ACTIVE_LONG) {
+					n->second.lastRequest.erase(m++);
+				} else {
+					OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)m->first);
+					lr[tmp] = m->second;
+					++m;
+				}
+			}
+			nlohmann::json c;
+			c["configRequests"] = n->second.configRequests;
+			c["newMembers"] = n->second.newMembers;
+			c["authorizations"] = n->second.authorizations;
+			c["deauthorizations"] = n->second.deauthorizations;
+			c["lastRequest"] = lr;
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)n->first);
+			networks[tmp] = c;
+		}
+	}
+
+	nlohmann::json s;
+	s["since"] = _since;
+	s["networks"] = networks;
+	const std::string d(OSUtils::jsonDump(s,-1));
+
+	// Written beside the snapshot and renamed over it so a crash never leaves half a file
+	std::lock_guard<std::mutex> l(_file_l);
+	const std::string tmpPath(_path + ".tmp");
+	if (!OSUtils::writeFile(tmpPath.c_str(),d)) {
+		fprintf(stderr,"WARNING: unable to write controller statistics to %s" ZT_EOL_S,tmpPath.c_str());
+		std::lock_guard<std::mutex> nl(_networks_l);
+		_dirty = true;
+		return;
+	}
+	OSUtils::lockDownFile(tmpPath.c_str(),false);
+	OSUtils::rename(tmpPath.c_str(),_path.c_str());
+}
+
+} // namespace ZeroTier
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#ifndef ZT_CONTROLLER_CONTROLLERSTATS_HPP
+#define ZT_CONTROLLER_CONTROLLERSTATS_HPP
+
+#include <stdint.h>
+
+#include <string>
+#include <map>
+#include <thread>
+#include <mutex>
+#include <condition_variable>
+
+#include "../ext/json/json.hpp"
+
+// Counter snapshot in the ZeroTier home path
+#define ZT_CONTROLLER_STATS_FILENAME "controller-stats.json"
+
+// How often counters are saved if they have changed
+#define ZT_CONTROLLER_STATS_SAVE_PERIOD 60000
+
+// Members that requested config within these periods count as active
+#define ZT_CONTROLLER_STATS_ACTIVE_SHORT 300000
+#define ZT_CONTROLLER_STATS_ACTIVE_LONG 3600000
+
+namespace ZeroTier {
+
+/**
+ * Per-network counters kept by the controller
+ *
+ * Counters are kept in memory and saved by a background thread about once
+ * a minute, and again when destroyed, so they carry over restarts. Times
+ * are parameters so that activity can be checked against any clock.
+ */
+class ControllerStats
+{
+public:
+	ControllerStats(const std::string &ztPath);
+	~ControllerStats();
+
+	/**
+	 * Note a config request from a member, counting it as active
+	 *
+	 * @param networkId Network requested
+	 * @param memberId Member that requested it
+	 * @param now Current time in ms since epoch
+	 */
+	void request(uint64_t networkId,uint64_t memberId,int64_t now);
+
+	/**
+	 * Count a config sent in reply to a request
+	 */
+	void configServed(uint64_t networkId);
+
+	/**
+	 * Count a member seen for the first time
+	 */
+	void newMember(uint64_t networkId);
+
+	/**
+	 * Count a member authorized or deauthorized
+	 *
+	 * @param networkId Network
+	 * @param authorized True if authorized, false if deauthorized
+	 */
+	void authorization(uint64_t networkId,bool authorized);
+
+	/**
+	 * Forget a deleted network
+	 */
+	void erase(uint64_t networkId);
+
+	/**
+	 * @param networkId Network to get counters for
+	 * @param now Current time in ms since epoch
+	 * @return Counters, all zero for a network with no activity
+	 */
+	nlohmann::json get(uint64_t networkId,int64_t now);
+
+	/**
+	 * @param now Current time in ms since epoch
+	 * @return Counters for every network with any, keyed by network ID
+	 */
+	nlohmann::json all(int64_t now);
+
+private:
+	struct _Network
+	{
+		_Network() : configRequests(0),newMembers(0),authorizations(0),deauthorizations(0) {}
+		uint64_t configRequests;
+		uint64_t newMembers;
+		uint64_t authorizations;
+		uint64_t deauthorizations;
+		std::map< uint64_t,int64_t > lastRequest; // member ID -> time
+	};
+
+	static nlohmann::json _counters(const _Network &n,int64_t now);
+	void _load();
+	void _save();
+
+	std::string _path;
+	int64_t _since;
+	std::map< uint64_t,_Network > _networks;
+	bool _dirty;
+	std::mutex _networks_l;
+	std::mutex _file_l;
+	std::condition_variable _wake;
+	bool _run;
+	std::thread _thread;
+};
+
+} // namespace ZeroTier
+
+#endif
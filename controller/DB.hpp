@@ -100,6 +100,14 @@ public:
 		}
 	}
 
+	/**
+	 * Save a network or member record
+	 *
+	 * A record that fails to write is still changed in memory, so the controller keeps
+	 * working with it, but backends that write synchronously then return false.
+	 *
+	 * @return True if the record changed and was written
+	 */
 	virtual bool save(nlohmann::json &record,bool notifyListeners) = 0;
 
 	virtual void eraseNetwork(const uint64_t networkId) = 0;
@@ -154,6 +154,22 @@ bool DBMirrorSet::isReady()
 }
 
 bool DBMirrorSet::save(nlohmann::json &record,bool notifyListeners)
+{
+	std::lock_guard<std::mutex> sl(_save_l);
+	return _save(record,notifyListeners);
+}
+
+bool DBMirrorSet::updateMember(const uint64_t networkId,const uint64_t memberId,const std::function<bool(nlohmann::json &member)> &update)
+{
+	std::lock_guard<std::mutex> sl(_save_l);
+	nlohmann::json network,member;
+	if ((!get(networkId,network,memberId,member))||(!update(member)))
+		return false;
+	_save(member,true);
+	return true;
+}
+
+bool DBMirrorSet::_save(nlohmann::json &record,bool notifyListeners)
 {
 	std::vector< std::shared_ptr<DB> > dbs;
 	{
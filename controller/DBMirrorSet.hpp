@@ -21,6 +21,7 @@
 #include <mutex>
 #include <set>
 #include <thread>
+#include <functional>
 
 namespace ZeroTier {
 
@@ -42,6 +43,13 @@ public:
 	bool waitForReady();
 	bool isReady();
 	bool save(nlohmann::json &record,bool notifyListeners);
+
+	/**
+	 * Read a member again and save it if update changes it, with other saves held off in between
+	 *
+	 * @return True if update returned true and the member was saved
+	 */
+	bool updateMember(const uint64_t networkId,const uint64_t memberId,const std::function<bool(nlohmann::json &member)> &update);
 	void eraseNetwork(const uint64_t networkId);
 	void eraseMember(const uint64_t networkId,const uint64_t memberId);
 	void nodeIsOnline(const uint64_t networkId,const uint64_t memberId,const InetAddress &physicalAddress);
@@ -59,11 +67,14 @@ public:
 	}
 
 private:
+	bool _save(nlohmann::json &record,bool notifyListeners);
+
 	DB::ChangeListener *const _listener;
 	std::atomic_bool _running;
 	std::thread _syncCheckerThread;
 	std::vector< std::shared_ptr< DB > > _dbs;
 	mutable std::mutex _dbs_l;
+	std::mutex _save_l;
 };
 
 } // namespace ZeroTier
@@ -35,6 +35,7 @@
 #include "EmbeddedNetworkController.hpp"
 #include "LFDB.hpp"
 #include "FileDB.hpp"
+#include "SQLiteDB.hpp"
 #ifdef ZT_CONTROLLER_USE_LIBPQ
 #include "PostgreSQL.hpp"
 #endif
@@ -56,6 +57,37 @@ using json = nlohmann::json;
 // Global maximum size of arrays in JSON objects
 #define ZT_CONTROLLER_MAX_ARRAY_SIZE 16384
 
+// Cache lifetime of /controller/stats and the window within which members count as active
+#define ZT_CONTROLLER_STATS_CACHE_TTL 30000
+#define ZT_CONTROLLER_STATS_ACTIVE_PERIOD 300000
+
+// How often to check for member authorizations that have expired
+#define ZT_CONTROLLER_AUTH_EXPIRY_CHECK_PERIOD 30000
+
+// Access control list entries per network and ether types per entry
+#define ZT_CONTROLLER_MAX_ACL_ENTRIES 128
+#define ZT_CONTROLLER_MAX_ACL_ETHERTYPES 8
+
+// Page sizes for paginated listings, unpaginated listings larger than the max are deprecated
+#define ZT_CONTROLLER_DEFAULT_PAGE_SIZE 100
+#define ZT_CONTROLLER_MAX_PAGE_SIZE 1000
+
+// Group join tokens: prefix, and default and maximum lifetimes in milliseconds
+#define ZT_CONTROLLER_GROUP_TOKEN_PREFIX "group:"
+#define ZT_CONTROLLER_GROUP_TOKEN_DEFAULT_TTL 86400000LL
+#define ZT_CONTROLLER_GROUP_TOKEN_MAX_TTL 31536000000LL
+
+// External authorization hooks: request timeout, default and maximum decision cache
+// lifetimes, and how long an unreachable hook is left alone before it is tried again
+#define ZT_CONTROLLER_AUTH_HOOK_TIMEOUT 5000
+#define ZT_CONTROLLER_AUTH_HOOK_DEFAULT_TTL 300000LL
+#define ZT_CONTROLLER_AUTH_HOOK_MAX_TTL 86400000LL
+#define ZT_CONTROLLER_AUTH_HOOK_ERROR_TTL 30000LL
+
+// Longest allowed SSO provider URL and client ID
+#define ZT_CONTROLLER_SSO_MAX_PROVIDER_LENGTH 1024
+#define ZT_CONTROLLER_SSO_MAX_CLIENT_ID_LENGTH 256
+
 namespace ZeroTier {
 
 namespace {
@@ -454,6 +486,520 @@ static bool _parseRule(json &r,ZT_VirtualNetworkRule &rule)
 	return false;
 }
 
+// Format a millisecond timestamp as a UTC calendar day (YYYY-MM-DD) without relying on non-reentrant gmtime()
+static std::string _utcDay(const int64_t ms)
+{
+	int64_t z = ((ms >= 0) ? (ms / 86400000LL) : ((ms - 86399999LL) / 86400000LL)) + 719468;
+	const int64_t era = ((z >= 0) ? z : (z - 146096)) / 146097;
+	const int64_t doe = z - (era * 146097);
+	const int64_t yoe = (doe - (doe / 1460) + (doe / 36524) - (doe / 146096)) / 365;
+	const int64_t doy = doe - ((365 * yoe) + (yoe / 4) - (yoe / 100));
+	const int64_t mp = ((5 * doy) + 2) / 153;
+	const int64_t d = doy - (((153 * mp) + 2) / 5) + 1;
+	const int64_t m = (mp < 10) ? (mp + 3) : (mp - 9);
+	const int64_t y = yoe + (era * 400) + ((m <= 2) ? 1 : 0);
+	char tmp[32];
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.4d-%.2d-%.2d",(int)y,(int)m,(int)d);
+	return std::string(tmp);
+}
+
+// Tag and capability names follow the rules language's identifier syntax so scripts and the API agree
+static bool _validRulesName(const std::string &name)
+{
+	if ((name.empty())||(name.length() > 64)||((name[0] >= '0')&&(name[0] <= '9')))
+		return false;
+	return (name.find_first_not_of("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") == std::string::npos);
+}
+
+// Group tokens let a node authorize itself into a role when it joins. The format is
+//   group:<network ID>:<role>:<expires>:<nonce>:<signature>
+// where role is "member" or the name of one of the network's capabilities, expires
+// is a timestamp in milliseconds, and signature is the controller identity's
+// signature (in hex) over everything before the last colon.
+static std::string _groupTokenBody(const uint64_t nwid,const std::string &role,const int64_t expires,const uint64_t nonce)
+{
+	char tmp[128];
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx:",(unsigned long long)nwid);
+	std::string body(ZT_CONTROLLER_GROUP_TOKEN_PREFIX);
+	body.append(tmp);
+	body.append(role);
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),":%lld:%.16llx",(long long)expires,(unsigned long long)nonce);
+	body.append(tmp);
+	return body;
+}
+
+// Check a group token's network, expiry, and signature, returning its role and nonce if it is valid
+static bool _verifyGroupToken(const Identity &signer,const uint64_t nwid,const int64_t now,const std::string &token,std::string &role,std::string &nonce)
+{
+	const std::size_t sigAt = token.find_last_of(':');
+	if ((token.compare(0,strlen(ZT_CONTROLLER_GROUP_TOKEN_PREFIX),ZT_CONTROLLER_GROUP_TOKEN_PREFIX) != 0)||(sigAt == std::string::npos)||(sigAt <= strlen(ZT_CONTROLLER_GROUP_TOKEN_PREFIX)))
+		return false;
+	const std::vector<std::string> f(OSUtils::split(token.substr(strlen(ZT_CONTROLLER_GROUP_TOKEN_PREFIX),sigAt - strlen(ZT_CONTROLLER_GROUP_TOKEN_PREFIX)).c_str(),":","",""));
+	if ((f.size() != 4)||(f[0].length() != 16)||(Utils::hexStrToU64(f[0].c_str()) != nwid)||(!_validRulesName(f[1]))||(f[2].find_first_not_of("0123456789") != std::string::npos)||(f[3].length() != 16))
+		return false;
+	if ((int64_t)Utils::strToU64(f[2].c_str()) <= now)
+		return false;
+	const std::string sigh(token.substr(sigAt + 1));
+	uint8_t sig[ZT_C25519_SIGNATURE_LEN];
+	if ((sigh.length() != (ZT_C25519_SIGNATURE_LEN * 2))||(Utils::unhex(sigh.c_str(),sig,sizeof(sig)) != sizeof(sig)))
+		return false;
+	if (!signer.verify(token.data(),(unsigned int)sigAt,sig,sizeof(sig)))
+		return false;
+	role = f[1];
+	nonce = f[3];
+	return true;
+}
+
+// Find a network capability by its name, returning its ID or -1 if there is none
+static int64_t _capabilityIdByName(json &network,const std::string &name)
+{
+	json &caps = network["capabilities"];
+	if (caps.is_array()) {
+		for(unsigned long i=0;i<caps.size();++i) {
+			if ((caps[i].is_object())&&(OSUtils::jsonString(caps[i]["name"],"") == name))
+				return (int64_t)OSUtils::jsonInt(caps[i]["id"],0ULL);
+		}
+	}
+	return -1;
+}
+
+// Deauthorize a member if its authorization has an expiry that has passed, returning true if it did
+static bool _expireAuthorization(json &member,const int64_t now)
+{
+	const int64_t authExpiry = (int64_t)OSUtils::jsonInt(member["authExpiry"],0ULL);
+	if ((!OSUtils::jsonBool(member["authorized"],false))||(authExpiry <= 0)||(now < authExpiry))
+		return false;
+	member["authorized"] = false;
+	member["lastDeauthorizedTime"] = now;
+	member["lastDeauthorizedReason"] = "expired";
+	return true;
+}
+
+// Who made an API request, as set by the service from the token it was made with
+static std::string _auditActor(const std::map<std::string,std::string> &headers)
+{
+	std::map<std::string,std::string>::const_iterator a(headers.find("x-zt1-actor"));
+	return ((a != headers.end())&&(!a->second.empty())) ? a->second : std::string("api");
+}
+
+// Audit operation for a member change, named for any change in authorization
+static const char *_auditMemberOp(const json &before,const json &after)
+{
+	const bool wasAuthorized = ((before.is_object())&&(before.count("authorized"))&&(OSUtils::jsonBool(before["authorized"],false)));
+	if (wasAuthorized != OSUtils::jsonBool(after["authorized"],false))
+		return (wasAuthorized) ? "member-deauthorize" : "member-authorize";
+	return ((before.is_object())&&(!before.empty())) ? "member-update" : "member-create";
+}
+
+// Check an SSO provider URL from the API, returning an empty string or an error
+static std::string _validateSsoProvider(const std::string &url)
+{
+	if (url.empty())
+		return std::string(); // clears it
+	const std::string::size_type hostStart = (url.compare(0,8,"https://") == 0) ? 8 : ((url.compare(0,7,"http://") == 0) ? 7 : 0);
+	if (!hostStart)
+		return "ssoProvider must be an http:// or https:// URL";
+	if (url.length() > ZT_CONTROLLER_SSO_MAX_PROVIDER_LENGTH)
+		return "ssoProvider is too long";
+	for(std::string::size_type i=0;i<url.length();++i) {
+		if ((url[i] <= 32)||(url[i] >= 127))
+			return "ssoProvider must not contain spaces or control characters";
+	}
+	std::string host(url.substr(hostStart,url.find_first_of("/?#",hostStart) - hostStart));
+	if (host.find('@') != std::string::npos)
+		return "ssoProvider must not contain a user name or password";
+	const std::string::size_type portStart = host.rfind(':');
+	if ((portStart != std::string::npos)&&(host.find(']',portStart) == std::string::npos)) {
+		const std::string port(host.substr(portStart + 1));
+		if ((port.empty())||(port.length() > 5)||(port.find_first_not_of("0123456789") != std::string::npos)||(atoi(port.c_str()) < 1)||(atoi(port.c_str()) > 65535))
+			return "ssoProvider has an invalid port";
+		host.erase(portStart);
+	}
+	if ((host.empty())||(host == "[]"))
+		return "ssoProvider has no host";
+	return std::string();
+}
+
+// Check and normalize a network's authHook object from the API, returning an empty string or an error
+static std::string _validateAuthHook(const json &hook,json &out)
+{
+	out = json::object();
+	if ((hook.is_null())||((hook.is_object())&&(hook.empty())))
+		return std::string();
+	if (!hook.is_object())
+		return "authHook must be an object with a url and optional secret, ttl, and failMode";
+	json h(hook);
+	std::string host,path;
+	unsigned int port;
+	const std::string url(OSUtils::jsonString(h["url"],""));
+	if (url.empty())
+		return std::string();
+	if (url.substr(0,8) == "https://")
+		return std::string("https:// authHook URLs are not supported, use a local http:// relay: ") + url;
+	if (!Webhooks::parseUrl(url,host,port,path))
+		return std::string("invalid authHook URL (only http:// URLs are supported): ") + url;
+	const std::string secret(OSUtils::jsonString(h["secret"],""));
+	if (secret.length() > ZT_CONTROLLER_WEBHOOK_MAX_SECRET_LENGTH)
+		return "authHook secret is too long";
+	const int64_t ttl = (int64_t)OSUtils::jsonInt(h["ttl"],(uint64_t)ZT_CONTROLLER_AUTH_HOOK_DEFAULT_TTL);
+	if ((ttl < 0)||(ttl > ZT_CONTROLLER_AUTH_HOOK_MAX_TTL))
+		return "authHook ttl must be between 0 and 86400000 milliseconds";
+	const std::string failMode(OSUtils::jsonString(h["failMode"],"closed"));
+	if ((failMode != "closed")&&(failMode != "open"))
+		return "authHook failMode must be \"closed\" or \"open\"";
+	out["url"] = url;
+	out["secret"] = secret;
+	out["ttl"] = ttl;
+	out["failMode"] = failMode;
+	return std::string();
+}
+
+// Parse an ACL source or destination, returning "any", a 10-digit ZeroTier address, an IP/bits, or "" if invalid
+static std::string _aclEndpoint(const std::string &p)
+{
+	if ((p.empty())||(p == "any"))
+		return std::string("any");
+	if ((p.length() == 10)&&(p.find_first_not_of("0123456789abcdefABCDEF") == std::string::npos)) {
+		char tmp[16];
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)Utils::hexStrToU64(p.c_str()));
+		return std::string(tmp);
+	}
+	InetAddress a(p.c_str());
+	if ((a.ss_family != AF_INET)&&(a.ss_family != AF_INET6))
+		return std::string();
+	if (p.find('/') == std::string::npos)
+		a.setPort((a.ss_family == AF_INET) ? 32 : 128);
+	else if (!a.netmaskBitsValid())
+		return std::string();
+	char tmp[64];
+	return std::string(a.toString(tmp));
+}
+
+// Check and normalize a network's acl array from the API, giving entries without one the next free ID,
+// and returning an empty string or an error
+static std::string _validateAcl(const json &acl,json &out)
+{
+	out = json::array();
+	if (acl.is_null())
+		return std::string();
+	if (!acl.is_array())
+		return "acl must be an array of objects with an action and optional id, source, destination, and etherTypes";
+	if (acl.size() > ZT_CONTROLLER_MAX_ACL_ENTRIES)
+		return "too many acl entries";
+
+	std::set<uint64_t> ids;
+	uint64_t nextId = 1;
+	for(unsigned long i=0;i<acl.size();++i) {
+		if ((acl[i].is_object())&&(acl[i]["id"].is_number())) {
+			const uint64_t id = OSUtils::jsonInt(acl[i]["id"],0ULL);
+			if ((id == 0)||(id > 0xffffffffULL))
+				return "acl entry IDs must be from 1 to 4294967295";
+			if (!ids.insert(id).second)
+				return "duplicate acl entry ID " + std::to_string((unsigned long long)id);
+			if (id >= nextId)
+				nextId = id + 1;
+		}
+	}
+
+	for(unsigned long i=0;i<acl.size();++i) {
+		if (!acl[i].is_object())
+			return "acl must be an array of objects with an action and optional id, source, destination, and etherTypes";
+		json e(acl[i]);
+		json ne;
+		ne["id"] = (e["id"].is_number()) ? OSUtils::jsonInt(e["id"],0ULL) : nextId++;
+		const std::string action(OSUtils::jsonString(e["action"],""));
+		if ((action != "accept")&&(action != "drop"))
+			return "acl entry action must be \"accept\" or \"drop\"";
+		ne["action"] = action;
+		const char *ends[2] = { "source","destination" };
+		for(int k=0;k<2;++k) {
+			const std::string p(OSUtils::jsonString(e[ends[k]],"any"));
+			const std::string np(_aclEndpoint(p));
+			if (np.empty())
+				return std::string("acl entry ") + ends[k] + " must be any, a 10-digit ZeroTier address, or an IP address or CIDR: " + p;
+			ne[ends[k]] = np;
+		}
+		json &ets = e["etherTypes"];
+		json nets = json::array();
+		if (!ets.is_null()) {
+			if ((!ets.is_array())||(ets.size() > ZT_CONTROLLER_MAX_ACL_ETHERTYPES))
+				return "acl entry etherTypes must be an array of up to 8 ether types";
+			for(unsigned long j=0;j<ets.size();++j) {
+				uint64_t et = 0x10000;
+				if (ets[j].is_number()) {
+					et = OSUtils::jsonInt(ets[j],0x10000ULL);
+				} else if (ets[j].is_string()) {
+					const std::string ets2(ets[j].get<std::string>());
+					if ((ets2.length() > 2)&&(ets2.length() <= 6)&&(ets2[0] == '0')&&((ets2[1] == 'x')||(ets2[1] == 'X'))&&(ets2.find_first_not_of("0123456789abcdefABCDEF",2) == std::string::npos))
+						et = Utils::hexStrToU64(ets2.c_str() + 2);
+				}
+				if (et > 0xffff)
+					return "acl entry etherTypes must be numbers from 0 to 65535 or hex strings like \"0x0800\"";
+				nets.push_back(et);
+			}
+		}
+		ne["etherTypes"] = nets;
+		out.push_back(ne);
+	}
+	return std::string();
+}
+
+// Flow rules for one ACL entry: any of its ether types, and its source, and its destination, then its action
+static json _aclRules(json &entry)
+{
+	json rules = json::array();
+	json &ets = entry["etherTypes"];
+	if (ets.is_array()) {
+		for(unsigned long i=0;i<ets.size();++i) {
+			json r;
+			r["type"] = "MATCH_ETHERTYPE";
+			r["not"] = false;
+			r["or"] = (i > 0);
+			r["etherType"] = ets[i];
+			rules.push_back(r);
+		}
+	}
+	for(int k=0;k<2;++k) {
+		const std::string p(OSUtils::jsonString(entry[(k == 0) ? "source" : "destination"],"any"));
+		if (p == "any")
+			continue;
+		json r;
+		r["not"] = false;
+		r["or"] = false;
+		if (p.find_first_of(".:") == std::string::npos) {
+			r["type"] = (k == 0) ? "MATCH_SOURCE_ZEROTIER_ADDRESS" : "MATCH_DEST_ZEROTIER_ADDRESS";
+			r["zt"] = p;
+		} else if (p.find(':') == std::string::npos) {
+			r["type"] = (k == 0) ? "MATCH_IPV4_SOURCE" : "MATCH_IPV4_DEST";
+			r["ip"] = p;
+		} else {
+			r["type"] = (k == 0) ? "MATCH_IPV6_SOURCE" : "MATCH_IPV6_DEST";
+			r["ip"] = p;
+		}
+		rules.push_back(r);
+	}
+	json a;
+	a["type"] = (OSUtils::jsonString(entry["action"],"") == "accept") ? "ACTION_ACCEPT" : "ACTION_DROP";
+	a["not"] = false;
+	a["or"] = false;
+	rules.push_back(a);
+	return rules;
+}
+
+// Ask a network's authHook whether a member may join, returning 1 to allow, 0 to deny, or -1 if
+// the hook could not be reached or gave no usable answer (in which case err says why)
+static int _callAuthHook(const json &hook,const char *nwids,json &member,std::string &err)
+{
+	json rq;
+	rq["networkId"] = nwids;
+	rq["memberAddress"] = OSUtils::jsonString(member["address"],"");
+	rq["identity"] = OSUtils::jsonString(member["identity"],"");
+	rq["name"] = OSUtils::jsonString(member["name"],"");
+
+	std::map<std::string,std::string> headers;
+	std::string responseBody;
+	headers["X-ZeroTier-Event"] = "member-authorization";
+	const unsigned int scode = Webhooks::post(OSUtils::jsonString(hook["url"],""),OSUtils::jsonString(hook["secret"],""),OSUtils::jsonDump(rq,-1),headers,ZT_CONTROLLER_AUTH_HOOK_TIMEOUT,responseBody);
+	if (scode == 0) {
+		err = responseBody;
+		return -1;
+	}
+	if ((scode < 200)||(scode > 299)) {
+		err = std::string("HTTP ") + std::to_string(scode);
+		return -1;
+	}
+	try {
+		const json verdict(OSUtils::jsonParse(responseBody));
+		if ((verdict.is_object())&&(verdict.count("authorized"))&&(verdict["authorized"].is_boolean()))
+			return (verdict["authorized"].get<bool>()) ? 1 : 0;
+	} catch ( ... ) {}
+	err = "response is not a JSON object with a boolean \"authorized\" field";
+	return -1;
+}
+
+// Whether a network's rules, or any of its capabilities' rules, match on a tag ID
+static bool _rulesUseTag(json &network,const uint64_t id)
+{
+	std::vector<json *> ruleLists;
+	ruleLists.push_back(&(network["rules"]));
+	json &caps = network["capabilities"];
+	for(unsigned long i=0;i<caps.size();++i) {
+		if (caps[i].is_object())
+			ruleLists.push_back(&(caps[i]["rules"]));
+	}
+	for(std::vector<json *>::const_iterator rl(ruleLists.begin());rl!=ruleLists.end();++rl) {
+		json &rules = **rl;
+		for(unsigned long i=0;i<rules.size();++i) {
+			if ((rules[i].is_object())&&(OSUtils::jsonString(rules[i]["type"],"").compare(0,9,"MATCH_TAG") == 0)&&(OSUtils::jsonInt(rules[i]["id"],0ULL) == id))
+				return true;
+		}
+	}
+	return false;
+}
+
+// Check that a rule list from an import parses completely, since import must not silently drop entries
+static bool _validImportRules(json &rules)
+{
+	if (rules.is_null())
+		return true;
+	if ((!rules.is_array())||(rules.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE))
+		return false;
+	for(unsigned long i=0;i<rules.size();++i) {
+		ZT_VirtualNetworkRule ztr;
+		if ((!rules[i].is_object())||(!_parseRule(rules[i],ztr)))
+			return false;
+	}
+	return true;
+}
+
+// Validate a copy of an exported network object, returning an empty string or the first problem found
+static std::string _validateImportNetwork(json network)
+{
+	if (!network.is_object())
+		return "network is not an object";
+	if ((network.count("name"))&&(!network["name"].is_string()))
+		return "network name is not a string";
+	if (!_validImportRules(network["rules"]))
+		return "network rules are invalid";
+
+	json &caps = network["capabilities"];
+	if (!caps.is_null()) {
+		if (!caps.is_array())
+			return "network capabilities are not an array";
+		for(unsigned long i=0;i<caps.size();++i) {
+			if ((!caps[i].is_object())||(!caps[i]["id"].is_number())||(!_validImportRules(caps[i]["rules"])))
+				return "network capability " + std::to_string(i) + " is invalid";
+		}
+	}
+
+	json &tags = network["tags"];
+	if (!tags.is_null()) {
+		if (!tags.is_array())
+			return "network tags are not an array";
+		for(unsigned long i=0;i<tags.size();++i) {
+			if ((!tags[i].is_object())||(!tags[i]["id"].is_number()))
+				return "network tag " + std::to_string(i) + " is invalid";
+		}
+	}
+
+	json &routes = network["routes"];
+	if (!routes.is_null()) {
+		if ((!routes.is_array())||(routes.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE))
+			return "network routes are not an array";
+		for(unsigned long i=0;i<routes.size();++i) {
+			json &rt = routes[i];
+			const InetAddress t(OSUtils::jsonString(rt["target"],"").c_str());
+			if ( (!rt.is_object()) || ((t.ss_family != AF_INET)&&(t.ss_family != AF_INET6)) || (!t.netmaskBitsValid()) )
+				return "network route " + std::to_string(i) + " has an invalid target";
+			if (!rt["via"].is_null()) {
+				InetAddress v;
+				if ((!v.fromString(OSUtils::jsonString(rt["via"],"").c_str()))||(v.ss_family != t.ss_family))
+					return "network route " + std::to_string(i) + " has an invalid via";
+			}
+		}
+	}
+
+	json acl;
+	const std::string aclErr(_validateAcl(network["acl"],acl));
+	if (!aclErr.empty())
+		return "network " + aclErr;
+
+	json &pools = network["ipAssignmentPools"];
+	if (!pools.is_null()) {
+		if ((!pools.is_array())||(pools.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE))
+			return "network ipAssignmentPools are not an array";
+		for(unsigned long i=0;i<pools.size();++i) {
+			const InetAddress f(OSUtils::jsonString(pools[i]["ipRangeStart"],"").c_str());
+			const InetAddress t(OSUtils::jsonString(pools[i]["ipRangeEnd"],"").c_str());
+			if ( ((f.ss_family != AF_INET)&&(f.ss_family != AF_INET6)) || (f.ss_family != t.ss_family) )
+				return "network IP assignment pool " + std::to_string(i) + " is invalid";
+		}
+	}
+
+	json hooks;
+	std::string hookErr(Webhooks::validate(network["webhooks"],hooks));
+	if (hookErr.empty())
+		hookErr = _validateAuthHook(network["authHook"],hooks);
+	if (!hookErr.empty())
+		return "network " + hookErr;
+
+	return std::string();
+}
+
+// Normalize an imported or restored network's webhooks and authHook. Exports leave out hook secrets,
+// so each hook without one keeps the secret of the current hook with the same URL. Hooks marked as
+// having had a secret that none is found for are listed in lostSecrets, as they will sign with an
+// empty key until their secret is set again.
+static void _importHooks(json &network,json current,std::vector<std::string> &lostSecrets)
+{
+	auto lost = [&lostSecrets](const json &h) {
+		if ((h.is_object())&&(!h.count("secret"))&&(OSUtils::jsonBool(h.value("secretSet",json()),false)))
+			lostSecrets.push_back(OSUtils::jsonString(h.value("url",json()),""));
+	};
+	if (network.count("webhooks")) {
+		json hooks;
+		if (current.is_object())
+			Webhooks::keepSecrets(network["webhooks"],current["webhooks"]);
+		if (network["webhooks"].is_array()) {
+			for(unsigned long i=0;i<network["webhooks"].size();++i)
+				lost(network["webhooks"][i]);
+		}
+		Webhooks::validate(network["webhooks"],hooks);
+		network["webhooks"] = hooks;
+	}
+	if (network.count("authHook")) {
+		json hook;
+		if (current.is_object())
+			Webhooks::keepSecrets(network["authHook"],current["authHook"]);
+		lost(network["authHook"]);
+		_validateAuthHook(network["authHook"],hook);
+		network["authHook"] = hook;
+	}
+}
+
+// Validate a copy of an exported member object, returning an empty string or the first problem found
+static std::string _validateImportMember(json member)
+{
+	if (!member.is_object())
+		return "member is not an object";
+	const std::string id(OSUtils::jsonString(member["id"],""));
+	if ((id.length() != 10)||(id.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)||(Address(Utils::hexStrToU64(id.c_str())).isReserved()))
+		return "member has an invalid address: " + id;
+
+	json &ipa = member["ipAssignments"];
+	if (!ipa.is_null()) {
+		if ((!ipa.is_array())||(ipa.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE))
+			return "member " + id + " ipAssignments is not an array";
+		for(unsigned long i=0;i<ipa.size();++i) {
+			InetAddress ip;
+			if ((!ipa[i].is_string())||(!ip.fromString(ipa[i].get<std::string>().c_str()))||((ip.ss_family != AF_INET)&&(ip.ss_family != AF_INET6)))
+				return "member " + id + " has an invalid IP assignment";
+		}
+	}
+
+	json &tags = member["tags"];
+	if (!tags.is_null()) {
+		if ((!tags.is_array())||(tags.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE))
+			return "member " + id + " tags is not an array";
+		for(unsigned long i=0;i<tags.size();++i) {
+			if ((!tags[i].is_array())||(tags[i].size() != 2)||(!tags[i][0].is_number())||(!tags[i][1].is_number()))
+				return "member " + id + " has an invalid tag";
+		}
+	}
+
+	json &caps = member["capabilities"];
+	if (!caps.is_null()) {
+		if ((!caps.is_array())||(caps.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE))
+			return "member " + id + " capabilities is not an array";
+		for(unsigned long i=0;i<caps.size();++i) {
+			if (!caps[i].is_number())
+				return "member " + id + " has an invalid capability";
+		}
+	}
+
+	return std::string();
+}
+
 } // anonymous namespace
 
 EmbeddedNetworkController::EmbeddedNetworkController(Node *node,const char *ztPath,const char *dbPath, int listenPort, RedisConfig *rc) :
@@ -464,16 +1010,26 @@ EmbeddedNetworkController::EmbeddedNetworkController(Node *node,const char *ztPa
 	_path(dbPath),
 	_sender((NetworkController::Sender *)0),
 	_db(this),
-	_rc(rc)
+	_statsComputedAt(0),
+	_rc(rc),
+	_webhooks(ztPath),
+	_audit(ztPath),
+	_counters(ztPath),
+	_maxNetworks(0),
+	_maxMembersPerNetwork(0),
+	_running(true)
 {
 }
 
 EmbeddedNetworkController::~EmbeddedNetworkController()
 {
 	std::lock_guard<std::mutex> l(_threads_l);
+	_running = false;
 	_queue.stop();
 	for(auto t=_threads.begin();t!=_threads.end();++t)
 		t->join();
+	if (_authExpiryThread.joinable())
+		_authExpiryThread.join();
 }
 
 void EmbeddedNetworkController::init(const Identity &signingId,Sender *sender)
@@ -483,25 +1039,47 @@ void EmbeddedNetworkController::init(const Identity &signingId,Sender *sender)
 	_sender = sender;
 	_signingIdAddressString = signingId.address().toString(tmp);
 
+	std::string lfJSON;
+	nlohmann::json lfConfig;
+	OSUtils::readFile((_ztPath + ZT_PATH_SEPARATOR_S "local.conf").c_str(),lfJSON);
+	if (lfJSON.length() > 0)
+		lfConfig = OSUtils::jsonParse(lfJSON);
+	const bool useSqlite = ((lfConfig.is_object())&&(lfConfig["settings"].is_object())&&(lfConfig["settings"]["controllerDb"].is_object())&&(OSUtils::jsonString(lfConfig["settings"]["controllerDb"]["type"],"") == "sqlite"));
+
 #ifdef ZT_CONTROLLER_USE_LIBPQ
 	if ((_path.length() > 9)&&(_path.substr(0,9) == "postgres:")) {
 		_db.addDB(std::shared_ptr<DB>(new PostgreSQL(_signingId,_path.substr(9).c_str(), _listenPort, _rc)));
 	} else {
 #endif
+#ifdef ZT_CONTROLLER_USE_SQLITE
+		if (useSqlite) {
+			std::shared_ptr<SQLiteDB> sqlite(new SQLiteDB(_path.c_str()));
+			if (!sqlite->isReady())
+				fprintf(stderr,"ERROR: controller SQLite database is not available (%s); no networks can be loaded or saved until this is fixed and the service is restarted" ZT_EOL_S,sqlite->error().c_str());
+			_db.addDB(sqlite);
+		} else {
+			_db.addDB(std::shared_ptr<DB>(new FileDB(_path.c_str())));
+		}
+#else
+		if (useSqlite)
+			fprintf(stderr,"WARNING: controllerDb type \"sqlite\" in local.conf is not supported by this build, using files in %s" ZT_EOL_S,_path.c_str());
 		_db.addDB(std::shared_ptr<DB>(new FileDB(_path.c_str())));
+#endif
 #ifdef ZT_CONTROLLER_USE_LIBPQ
 	}
 #endif
 
-	std::string lfJSON;
-	OSUtils::readFile((_ztPath + ZT_PATH_SEPARATOR_S "local.conf").c_str(),lfJSON);
-	if (lfJSON.length() > 0) {
-		nlohmann::json lfConfig(OSUtils::jsonParse(lfJSON));
+	if (lfConfig.is_object()) {
 		nlohmann::json &settings = lfConfig["settings"];
 		if (settings.is_object()) {
+			if (settings.count("controllerWebhooks"))
+				_webhooks.setGlobalHooks(settings["controllerWebhooks"]);
+			_maxNetworks = OSUtils::jsonInt(settings["controllerMaxNetworks"],0ULL);
+			_maxMembersPerNetwork = OSUtils::jsonInt(settings["controllerMaxMembersPerNetwork"],0ULL);
+
 			nlohmann::json &controllerDb = settings["controllerDb"];
 			if (controllerDb.is_object()) {
-				std::string type = controllerDb["type"];
+				std::string type = OSUtils::jsonString(controllerDb["type"],"");
 				if (type == "lf") {
 					std::string lfOwner = controllerDb["owner"];
 					std::string lfHost = controllerDb["host"];
@@ -524,6 +1102,21 @@ void EmbeddedNetworkController::init(const Identity &signingId,Sender *sender)
 	}
 
 	_db.waitForReady();
+
+	_authExpiryThread = std::thread([this]() {
+		for(;;) {
+			for(int i=0;i<(ZT_CONTROLLER_AUTH_EXPIRY_CHECK_PERIOD / 500);++i) {
+				if (!_running)
+					return;
+				std::this_thread::sleep_for(std::chrono::milliseconds(500));
+			}
+			try {
+				expireAuthorizations(OSUtils::now());
+			} catch ( ... ) {
+				fprintf(stderr,"ERROR: exception in controller authorization expiry check" ZT_EOL_S);
+			}
+		}
+	});
 }
 
 void EmbeddedNetworkController::request(
@@ -546,6 +1139,45 @@ void EmbeddedNetworkController::request(
 	_queue.post(qe);
 }
 
+// Keep in step with the handlers below and doc/openapi.json, which selftest checks against this
+const char *const *EmbeddedNetworkController::controlPlaneRoutes()
+{
+	static const char *const routes[] = {
+		"GET /controller",
+		"GET /controller/stats",
+		"GET /controller/backup",
+		"POST /controller/restore",
+		"GET /controller/event",
+		"GET /controller/audit",
+		"GET /controller/network",
+		"GET /controller/network/{networkId}",
+		"POST /controller/network/{networkId}",
+		"DELETE /controller/network/{networkId}",
+		"GET /controller/network/{networkId}/summary",
+		"GET /controller/network/{networkId}/stats",
+		"GET /controller/network/{networkId}/export",
+		"POST /controller/network/{networkId}/import",
+		"POST /controller/network/{networkId}/token",
+		"GET /controller/network/{networkId}/event",
+		"GET /controller/network/{networkId}/routes",
+		"POST /controller/network/{networkId}/routes",
+		"DELETE /controller/network/{networkId}/routes/{target}",
+		"GET /controller/network/{networkId}/acl",
+		"POST /controller/network/{networkId}/acl",
+		"DELETE /controller/network/{networkId}/acl",
+		"DELETE /controller/network/{networkId}/acl/{id}",
+		"GET /controller/network/{networkId}/member",
+		"POST /controller/network/{networkId}/member/batch-authorize",
+		"POST /controller/network/{networkId}/member/batch-deauthorize",
+		"POST /controller/network/{networkId}/member/batch-delete",
+		"GET /controller/network/{networkId}/member/{address}",
+		"POST /controller/network/{networkId}/member/{address}",
+		"DELETE /controller/network/{networkId}/member/{address}",
+		(const char *)0
+	};
+	return routes;
+}
+
 unsigned int EmbeddedNetworkController::handleControlPlaneHttpGET(
 	const std::vector<std::string> &path,
 	const std::map<std::string,std::string> &urlArgs,
@@ -573,9 +1205,66 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpGET(
 						json member;
 						if (!_db.get(nwid,network,address,member))
 							return 404;
+						_authHookStatus(nwid,network,member,OSUtils::now());
 						responseBody = OSUtils::jsonDump(member);
 						responseContentType = "application/json";
 
+					} else if ((urlArgs.count("authorized"))||(urlArgs.count("online"))||(urlArgs.count("nameContains"))||(urlArgs.count("limit"))||(urlArgs.count("offset"))) {
+						// List full member objects matching filters, with last config request time from member status
+
+						std::map<std::string,std::string>::const_iterator a;
+						int authorizedFilter = -1;
+						if ((a = urlArgs.find("authorized")) != urlArgs.end())
+							authorizedFilter = ((a->second == "1")||(a->second == "true")) ? 1 : 0;
+						int64_t onlineWithin = 0;
+						if ((a = urlArgs.find("online")) != urlArgs.end())
+							onlineWithin = (int64_t)((a->second.length() > 0) ? Utils::strToULong(a->second.c_str()) : 5) * 60000;
+						std::string nameContains;
+						if ((a = urlArgs.find("nameContains")) != urlArgs.end())
+							nameContains = a->second;
+						const unsigned long offset = ((a = urlArgs.find("offset")) != urlArgs.end()) ? Utils::strToULong(a->second.c_str()) : 0;
+						const unsigned long limit = ((a = urlArgs.find("limit")) != urlArgs.end()) ? Utils::strToULong(a->second.c_str()) : 0;
+
+						std::vector<json> members;
+						_db.get(nwid,network,members);
+						std::sort(members.begin(),members.end(),[](const json &x,const json &y) {
+							return (OSUtils::jsonString(x["id"],"") < OSUtils::jsonString(y["id"],""));
+						});
+
+						const int64_t now = OSUtils::now();
+						unsigned long matched = 0;
+						json data = json::array();
+						for(auto member=members.begin();member!=members.end();++member) {
+							if ((authorizedFilter >= 0)&&(OSUtils::jsonBool((*member)["authorized"],false) != (authorizedFilter == 1)))
+								continue;
+							if ((nameContains.length() > 0)&&(OSUtils::jsonString((*member)["name"],"").find(nameContains) == std::string::npos))
+								continue;
+
+							int64_t lastRequestTime = 0;
+							{
+								std::lock_guard<std::mutex> l(_memberStatus_l);
+								auto ms = _memberStatus.find(_MemberStatusKey(nwid,Utils::hexStrToU64(OSUtils::jsonString((*member)["id"],"0").c_str())));
+								if (ms != _memberStatus.end())
+									lastRequestTime = (int64_t)ms->second.lastRequestTime;
+							}
+							if ((onlineWithin > 0)&&((lastRequestTime <= 0)||((now - lastRequestTime) >= onlineWithin)))
+								continue;
+
+							if ((matched++ >= offset)&&((limit == 0)||(data.size() < limit))) {
+								(*member)["lastRequestTime"] = lastRequestTime;
+								_authHookStatus(nwid,network,*member,now);
+								data.push_back(*member);
+							}
+						}
+
+						json r;
+						r["data"] = data;
+						r["offset"] = offset;
+						r["limit"] = limit;
+						r["totalItems"] = matched;
+						responseBody = OSUtils::jsonDump(r);
+						responseContentType = "application/json";
+
 					} else {
 						// List members and their revisions
 
@@ -597,11 +1286,93 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpGET(
 					}
 					return 200;
 
+				} else if ((path.size() == 3)&&(path[2] == "summary")) {
+					// Member counts, where active means the member has requested config recently
+
+					unsigned long totalMemberCount = 0,authorizedMemberCount = 0,activeMemberCount = 0;
+					std::vector<json> members;
+					if (_db.get(nwid,network,members)) {
+						const int64_t now = OSUtils::now();
+						std::lock_guard<std::mutex> l(_memberStatus_l);
+						for(auto member=members.begin();member!=members.end();++member) {
+							++totalMemberCount;
+							if (OSUtils::jsonBool((*member)["authorized"],false))
+								++authorizedMemberCount;
+							auto ms = _memberStatus.find(_MemberStatusKey(nwid,Utils::hexStrToU64(OSUtils::jsonString((*member)["id"],"0").c_str())));
+							if ((ms != _memberStatus.end())&&(ms->second.online(now)))
+								++activeMemberCount;
+						}
+					}
+
+					json r;
+					r["id"] = network["id"];
+					r["totalMemberCount"] = totalMemberCount;
+					r["authorizedMemberCount"] = authorizedMemberCount;
+					r["activeMemberCount"] = activeMemberCount;
+					r["memberLimit"] = _memberLimit(network);
+					responseBody = OSUtils::jsonDump(r);
+					responseContentType = "application/json";
+					return 200;
+
+				} else if ((path.size() == 3)&&(path[2] == "stats")) {
+					// Counters for this network, see ControllerStats
+
+					json r(_counters.get(nwid,OSUtils::now()));
+					r["id"] = network["id"];
+					responseBody = OSUtils::jsonDump(r);
+					responseContentType = "application/json";
+					return 200;
+
+				} else if ((path.size() == 3)&&(path[2] == "export")) {
+					// Network and all member records as one document for import on another controller
+
+					std::vector<json> members;
+					_db.get(nwid,network,members);
+					std::sort(members.begin(),members.end(),[](const json &x,const json &y) {
+						return (OSUtils::jsonString(x["id"],"") < OSUtils::jsonString(y["id"],""));
+					});
+
+					json r;
+					r["formatVersion"] = 1;
+					r["controller"] = _signingIdAddressString;
+					r["exportTime"] = OSUtils::now();
+					r["network"] = network;
+					r["members"] = members;
+					Webhooks::redactSecrets(r["network"]);
+					responseBody = OSUtils::jsonDump(r);
+					responseContentType = "application/json";
+					return 200;
+
+				} else if ((path.size() == 3)&&(path[2] == "event")) {
+					// Recent events for this network, see Webhooks
+
+					auto since = urlArgs.find("since");
+					responseBody = OSUtils::jsonDump(_webhooks.events(nwid,(since != urlArgs.end()) ? (int64_t)Utils::strToU64(since->second.c_str()) : 0));
+					responseContentType = "application/json";
+					return 200;
+
+				} else if ((path.size() == 3)&&(path[2] == "routes")) {
+					// List managed routes
+
+					json &routes = network["routes"];
+					responseBody = OSUtils::jsonDump(routes.is_array() ? routes : json::array());
+					responseContentType = "application/json";
+					return 200;
+
+				} else if ((path.size() == 3)&&(path[2] == "acl")) {
+					// List access control entries
+
+					json &acl = network["acl"];
+					responseBody = OSUtils::jsonDump(acl.is_array() ? acl : json::array());
+					responseContentType = "application/json";
+					return 200;
+
 				} // else 404
 
 			} else {
 				// Get network
 
+				Webhooks::redactSecrets(network);
 				responseBody = OSUtils::jsonDump(network);
 				responseContentType = "application/json";
 				return 200;
@@ -613,6 +1384,47 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpGET(
 			std::set<uint64_t> networkIds;
 			_db.networks(networkIds);
 			char tmp[64];
+
+			std::map<std::string,std::string>::const_iterator pageArg(urlArgs.find("page"));
+			std::map<std::string,std::string>::const_iterator pageSizeArg(urlArgs.find("pageSize"));
+			if ((pageArg != urlArgs.end())||(pageSizeArg != urlArgs.end())) {
+				// Paginated listing, pages are numbered from 1
+				const unsigned long page = (pageArg != urlArgs.end()) ? Utils::strToULong(pageArg->second.c_str()) : 1;
+				const unsigned long pageSize = (pageSizeArg != urlArgs.end()) ? Utils::strToULong(pageSizeArg->second.c_str()) : ZT_CONTROLLER_DEFAULT_PAGE_SIZE;
+				if ((page == 0)||(pageSize == 0)||(pageSize > ZT_CONTROLLER_MAX_PAGE_SIZE)) {
+					OSUtils::ztsnprintf(tmp,sizeof(tmp),"{ \"message\": \"page must be at least 1 and pageSize 1-%d\" }",ZT_CONTROLLER_MAX_PAGE_SIZE);
+					responseBody = tmp;
+					responseContentType = "application/json";
+					return 400;
+				}
+
+				// Compare page numbers rather than offsets so that a huge page can't wrap (page - 1) * pageSize
+				const unsigned long totalItems = (unsigned long)networkIds.size();
+				const unsigned long totalPages = (totalItems + pageSize - 1) / pageSize;
+				json data = json::array();
+				if (page <= totalPages) {
+					std::set<uint64_t>::const_iterator i(networkIds.begin());
+					std::advance(i,(page - 1) * pageSize);
+					for(;(i!=networkIds.end())&&(data.size() < pageSize);++i) {
+						OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)*i);
+						data.push_back(tmp);
+					}
+				}
+
+				json r;
+				r["data"] = data;
+				r["page"] = page;
+				r["pageSize"] = pageSize;
+				r["totalPages"] = totalPages;
+				r["totalItems"] = totalItems;
+				responseBody = OSUtils::jsonDump(r);
+				responseContentType = "application/json";
+				return 200;
+			}
+
+			if (networkIds.size() > ZT_CONTROLLER_MAX_PAGE_SIZE)
+				fprintf(stderr,"WARNING: listing %lu networks without pagination is deprecated, use /controller/network?page=N&pageSize=N" ZT_EOL_S,(unsigned long)networkIds.size());
+
 			responseBody = "[";
 			responseBody.reserve((networkIds.size() + 1) * 24);
 			for(std::set<uint64_t>::const_iterator i(networkIds.begin());i!=networkIds.end();++i) {
@@ -628,12 +1440,132 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpGET(
 
 		} // else 404
 
+	} else if ((path.size() == 1)&&(path[0] == "event")) {
+		// Recent events for all networks
+
+		auto since = urlArgs.find("since");
+		responseBody = OSUtils::jsonDump(_webhooks.events(0,(since != urlArgs.end()) ? (int64_t)Utils::strToU64(since->second.c_str()) : 0));
+		responseContentType = "application/json";
+		return 200;
+
+	} else if ((path.size() == 1)&&(path[0] == "audit")) {
+		// Audit log, optionally for one network, see AuditLog
+
+		auto network = urlArgs.find("network");
+		auto since = urlArgs.find("since");
+		responseBody = OSUtils::jsonDump(_audit.query((network != urlArgs.end()) ? Utils::hexStrToU64(network->second.c_str()) : 0,(since != urlArgs.end()) ? (int64_t)Utils::strToU64(since->second.c_str()) : 0));
+		responseContentType = "application/json";
+		return 200;
+
+	} else if ((path.size() == 1)&&(path[0] == "stats")) {
+		// Aggregate statistics, recomputed at most every ZT_CONTROLLER_STATS_CACHE_TTL, and live per-network counters
+
+		const int64_t now = OSUtils::now();
+		std::lock_guard<std::mutex> sl(_stats_l);
+		if ((now - _statsComputedAt) >= ZT_CONTROLLER_STATS_CACHE_TTL) {
+			std::set<uint64_t> networkIds;
+			_db.networks(networkIds);
+
+			unsigned long totalMembers = 0,authorizedMembers = 0,activeMembers = 0;
+			std::vector< std::pair<unsigned long,std::string> > bySize;
+			std::map<std::string,unsigned long> createdByDay;
+			for(std::set<uint64_t>::const_iterator nwid(networkIds.begin());nwid!=networkIds.end();++nwid) {
+				json network;
+				std::vector<json> members;
+				if (!_db.get(*nwid,network,members))
+					continue;
+				totalMembers += (unsigned long)members.size();
+				{
+					std::lock_guard<std::mutex> l(_memberStatus_l);
+					for(auto member=members.begin();member!=members.end();++member) {
+						if (OSUtils::jsonBool((*member)["authorized"],false))
+							++authorizedMembers;
+						auto ms = _memberStatus.find(_MemberStatusKey(*nwid,Utils::hexStrToU64(OSUtils::jsonString((*member)["id"],"0").c_str())));
+						if ((ms != _memberStatus.end())&&((now - (int64_t)ms->second.lastRequestTime) < ZT_CONTROLLER_STATS_ACTIVE_PERIOD))
+							++activeMembers;
+					}
+				}
+				bySize.push_back(std::pair<unsigned long,std::string>((unsigned long)members.size(),OSUtils::jsonString(network["id"],"")));
+				const int64_t ct = (int64_t)OSUtils::jsonInt(network["creationTime"],0ULL);
+				if (ct > 0)
+					++createdByDay[_utcDay(ct)];
+			}
+
+			std::stable_sort(bySize.begin(),bySize.end(),[](const std::pair<unsigned long,std::string> &a,const std::pair<unsigned long,std::string> &b) {
+				return (a.first > b.first);
+			});
+			json largest = json::array();
+			for(unsigned long i=0;(i<bySize.size())&&(i<5);++i) {
+				json n;
+				n["id"] = bySize[i].second;
+				n["memberCount"] = bySize[i].first;
+				largest.push_back(n);
+			}
+			json histogram = json::object();
+			for(std::map<std::string,unsigned long>::const_iterator d(createdByDay.begin());d!=createdByDay.end();++d)
+				histogram[d->first] = d->second;
+
+			json st;
+			st["networkCount"] = (unsigned long)networkIds.size();
+			st["memberCount"] = totalMembers;
+			st["authorizedMemberCount"] = authorizedMembers;
+			st["activeMemberCount"] = activeMembers;
+			st["largestNetworks"] = largest;
+			st["networksCreatedByDay"] = histogram;
+			st["computedAt"] = now;
+			_statsCache = st;
+			_statsComputedAt = now;
+		}
+		json st(_statsCache);
+		st["networks"] = _counters.all(now);
+		responseBody = OSUtils::jsonDump(st);
+		responseContentType = "application/json";
+		return 200;
+
+	} else if ((path.size() == 1)&&(path[0] == "backup")) {
+		// Every network and its members, for restore onto this controller. Each network is copied
+		// together with its members under the database's lock for it, so none is caught half-changed.
+		// Unlike exports, backups keep hook secrets so a restore onto an empty controller can still
+		// sign deliveries. Tokens scoped to controller:read are refused this request.
+
+		std::set<uint64_t> networkIds;
+		_db.networks(networkIds);
+		json networks = json::array();
+		unsigned long memberCount = 0;
+		for(std::set<uint64_t>::const_iterator nwid(networkIds.begin());nwid!=networkIds.end();++nwid) {
+			json network;
+			std::vector<json> members;
+			if (!_db.get(*nwid,network,members))
+				continue;
+			std::sort(members.begin(),members.end(),[](const json &x,const json &y) {
+				return (OSUtils::jsonString(x["id"],"") < OSUtils::jsonString(y["id"],""));
+			});
+			memberCount += (unsigned long)members.size();
+			json n;
+			n["network"] = network;
+			n["members"] = members;
+			networks.push_back(n);
+		}
+
+		char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+		json r;
+		r["formatVersion"] = 1;
+		r["controller"] = _signingIdAddressString;
+		r["controllerIdentity"] = _signingId.toString(false,idtmp);
+		r["backupTime"] = OSUtils::now();
+		r["networkCount"] = (unsigned long)networks.size();
+		r["memberCount"] = memberCount;
+		r["networks"] = networks;
+		responseBody = OSUtils::jsonDump(r,-1);
+		responseContentType = "application/json";
+		return 200;
+
 	} else {
 		// Controller status
 
 		char tmp[4096];
 		const bool dbOk = _db.isReady();
-		OSUtils::ztsnprintf(tmp,sizeof(tmp),"{\n\t\"controller\": true,\n\t\"apiVersion\": %d,\n\t\"clock\": %llu,\n\t\"databaseReady\": %s\n}\n",ZT_NETCONF_CONTROLLER_API_VERSION,(unsigned long long)OSUtils::now(),dbOk ? "true" : "false");
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"{\n\t\"controller\": true,\n\t\"apiVersion\": %d,\n\t\"clock\": %llu,\n\t\"databaseReady\": %s,\n\t\"maxNetworks\": %llu,\n\t\"maxMembersPerNetwork\": %llu\n}\n",ZT_NETCONF_CONTROLLER_API_VERSION,(unsigned long long)OSUtils::now(),dbOk ? "true" : "false",(unsigned long long)_maxNetworks,(unsigned long long)_maxMembersPerNetwork);
 		responseBody = tmp;
 		responseContentType = "application/json";
 		return dbOk ? 200 : 503;
@@ -654,10 +1586,17 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 	if (path.empty())
 		return 404;
 
+	// Batch member operations take a bare array of addresses, everything else takes an object
+	const bool batch = ((path.size() == 4)&&(path[0] == "network")&&(path[2] == "member")&&(path[3].substr(0,6) == "batch-"));
+
 	json b;
 	try {
 		b = OSUtils::jsonParse(body);
-		if (!b.is_object()) {
+		if ((batch)&&(!b.is_array())) {
+			responseBody = "{ \"message\": \"body is not a JSON array of member addresses\" }";
+			responseContentType = "application/json";
+			return 400;
+		} else if ((!batch)&&(!b.is_object())) {
 			responseBody = "{ \"message\": \"body is not a JSON object\" }";
 			responseContentType = "application/json";
 			return 400;
@@ -678,16 +1617,102 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 
 			if (path.size() >= 3) {
 
-				if ((path.size() == 4)&&(path[2] == "member")&&(path[3].length() == 10)) {
+				if (batch) {
+					// Best effort batch: each address succeeds or fails on its own
+
+					const bool authorize = (path[3] == "batch-authorize");
+					const bool deauthorize = (path[3] == "batch-deauthorize");
+					const bool erase = (path[3] == "batch-delete");
+					if ((!authorize)&&(!deauthorize)&&(!erase))
+						return 404;
+					if (b.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE) {
+						responseBody = "{ \"message\": \"too many addresses in batch\" }";
+						responseContentType = "application/json";
+						return 400;
+					}
+
+					json network;
+					if (!_db.get(nwid,network))
+						return 404;
+
+					json results = json::object();
+					for(unsigned long i=0;i<b.size();++i) {
+						const std::string as(OSUtils::jsonString(b[i],""));
+						json r;
+						if ((as.length() != 10)||(as.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)) {
+							r["success"] = false;
+							r["error"] = "invalid address";
+							results[as] = r;
+							continue;
+						}
+						const uint64_t address = Utils::hexStrToU64(as.c_str());
+						char addrs[24];
+						OSUtils::ztsnprintf(addrs,sizeof(addrs),"%.10llx",(unsigned long long)address);
+
+						json member;
+						const bool exists = _db.get(nwid,network,address,member);
+						const json before((exists) ? member : json());
+						if (erase) {
+							if (exists) {
+								_db.eraseMember(nwid,address);
+								_audit.record(_auditActor(headers),"member-delete",nwid,address,before,json());
+								_webhooks.event("member-deleted",nwid,network["webhooks"],"member",before);
+								std::lock_guard<std::mutex> l(_memberStatus_l);
+								_memberStatus.erase(_MemberStatusKey(nwid,address));
+								r["success"] = true;
+							} else {
+								r["success"] = false;
+								r["error"] = "not a member";
+							}
+						} else if ((deauthorize)&&(!exists)) {
+							r["success"] = false;
+							r["error"] = "not a member";
+						} else {
+							DB::initMember(member);
+							if (authorize != OSUtils::jsonBool(member["authorized"],false)) {
+								member["authorized"] = authorize;
+								member[((authorize) ? "lastAuthorizedTime" : "lastDeauthorizedTime")] = now;
+								if (authorize) {
+									member["lastAuthorizedCredentialType"] = "api";
+									member.erase("authRefusedReason");
+									member.erase("authRefusedTime");
+									member["lastAuthorizedCredential"] = json();
+									member["authExpiry"] = 0;
+								} else {
+									member["lastDeauthorizedReason"] = "api";
+								}
+								member["id"] = addrs;
+								member["address"] = addrs; // legacy
+								member["nwid"] = nwids;
+								DB::cleanMember(member);
+								_db.save(member,true);
+								_audit.record(_auditActor(headers),_auditMemberOp(before,member),nwid,address,before,member);
+								_counters.authorization(nwid,authorize);
+								_webhooks.event((authorize) ? "member-authorized" : "member-deauthorized",nwid,network["webhooks"],"member",member);
+							}
+							r["success"] = true;
+						}
+						results[addrs] = r;
+					}
+
+					json res;
+					res["results"] = results;
+					responseBody = OSUtils::jsonDump(res);
+					responseContentType = "application/json";
+					return 200;
+				} else if ((path.size() == 4)&&(path[2] == "member")&&(path[3].length() == 10)) {
 					uint64_t address = Utils::hexStrToU64(path[3].c_str());
 					char addrs[24];
 					OSUtils::ztsnprintf(addrs,sizeof(addrs),"%.10llx",(unsigned long long)address);
 
 					json member,network;
-					_db.get(nwid,network,address,member);
+					const json before((_db.get(nwid,network,address,member)) ? member : json());
 					DB::initMember(member);
+					const bool wasAuthorized = OSUtils::jsonBool(member["authorized"],false);
 
 					try {
+						if (b.count("name")) member["name"] = OSUtils::jsonString(b["name"],"");
+						if (b.count("description")) member["description"] = OSUtils::jsonString(b["description"],"");
 						if (b.count("activeBridge")) member["activeBridge"] = OSUtils::jsonBool(b["activeBridge"],false);
 						if (b.count("noAutoAssignIps")) member["noAutoAssignIps"] = OSUtils::jsonBool(b["noAutoAssignIps"],false);
 
@@ -708,11 +1733,40 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 								member[((newAuth) ? "lastAuthorizedTime" : "lastDeauthorizedTime")] = now;
 								if (newAuth) {
 									member["lastAuthorizedCredentialType"] = "api";
+									member.erase("authRefusedReason");
+									member.erase("authRefusedTime");
 									member["lastAuthorizedCredential"] = json();
+									member["authExpiry"] = 0; // re-authorizing never inherits an old expiry
+								} else {
+									member["lastDeauthorizedReason"] = "api";
 								}
 							}
 						}
 
+						// Time in ms since epoch when authorization lapses, or 0 for never
+						if (b.count("authExpiry")) member["authExpiry"] = OSUtils::jsonInt(b["authExpiry"],0ULL);
+
+						// Set by the SSO provider's integration once the member has signed in. On a network
+						// with ssoEnabled this also authorizes the member.
+						if (b.count("ssoAuthenticated")) {
+							if (OSUtils::jsonBool(b["ssoAuthenticated"],false)) {
+								member["ssoAuthenticatedTime"] = now;
+								if (OSUtils::jsonString(member["authRefusedReason"],"") == "sso") {
+									member.erase("authRefusedReason");
+									member.erase("authRefusedTime");
+								}
+								if ((OSUtils::jsonBool(network["ssoEnabled"],false))&&(!OSUtils::jsonBool(member["authorized"],false))) {
+									member["authorized"] = true;
+									member["lastAuthorizedTime"] = now;
+									member["lastAuthorizedCredentialType"] = "sso";
+									member["lastAuthorizedCredential"] = json();
+									member["authExpiry"] = 0;
+								}
+							} else {
+								member["ssoAuthenticatedTime"] = 0;
+							}
+						}
+
 						if (b.count("ipAssignments")) {
 							json &ipa = b["ipAssignments"];
 							if (ipa.is_array()) {
@@ -740,6 +1794,34 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 									if ((tag.is_array())&&(tag.size() == 2))
 										mtags[OSUtils::jsonInt(tag[0],0ULL) & 0xffffffffULL] = OSUtils::jsonInt(tag[1],0ULL) & 0xffffffffULL;
 								}
+								// Tags must be declared by the network or used by its rules, and values must fall within
+								// the declared range if any
+								json &tagDefs = network["tags"];
+								for(std::map<uint64_t,uint64_t>::iterator t(mtags.begin());t!=mtags.end();++t) {
+									json *td = (json *)0;
+									for(unsigned long i=0;i<tagDefs.size();++i) {
+										if (OSUtils::jsonInt(tagDefs[i]["id"],0ULL) == t->first) {
+											td = &(tagDefs[i]);
+											break;
+										}
+									}
+									char tmp[256];
+									if (!td) {
+										if (_rulesUseTag(network,t->first))
+											continue;
+										OSUtils::ztsnprintf(tmp,sizeof(tmp),"{ \"message\": \"tag %llu is not declared or used by this network's rules\" }",(unsigned long long)t->first);
+										responseBody = tmp;
+										responseContentType = "application/json";
+										return 400;
+									}
+									if (((*td)["min"].is_number())&&((*td)["max"].is_number())&&((t->second < OSUtils::jsonInt((*td)["min"],0ULL))||(t->second > OSUtils::jsonInt((*td)["max"],0ULL)))) {
+										OSUtils::ztsnprintf(tmp,sizeof(tmp),"{ \"message\": \"tag %llu value %llu is outside its declared range %llu-%llu\" }",(unsigned long long)t->first,(unsigned long long)t->second,(unsigned long long)OSUtils::jsonInt((*td)["min"],0ULL),(unsigned long long)OSUtils::jsonInt((*td)["max"],0ULL));
+										responseBody = tmp;
+										responseContentType = "application/json";
+										return 400;
+									}
+								}
+
 								json mtagsa = json::array();
 								for(std::map<uint64_t,uint64_t>::iterator t(mtags.begin());t!=mtags.end();++t) {
 									json ta = json::array();
@@ -764,6 +1846,21 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 								}
 								std::sort(mcaps.begin(),mcaps.end());
 								mcaps.erase(std::unique(mcaps.begin(),mcaps.end()),mcaps.end());
+
+								// Capabilities must be declared by the network
+								json &capDefs = network["capabilities"];
+								for(unsigned long i=0;i<mcaps.size();++i) {
+									bool declared = false;
+									for(unsigned long k=0;((!declared)&&(k<capDefs.size()));++k)
+										declared = (OSUtils::jsonInt(capDefs[k]["id"],0ULL) == OSUtils::jsonInt(mcaps[i],0ULL));
+									if (!declared) {
+										char tmp[128];
+										OSUtils::ztsnprintf(tmp,sizeof(tmp),"{ \"message\": \"capability %llu is not declared by this network\" }",(unsigned long long)OSUtils::jsonInt(mcaps[i],0ULL));
+										responseBody = tmp;
+										responseContentType = "application/json";
+										return 400;
+									}
+								}
 								member["capabilities"] = mcaps;
 							}
 						}
@@ -779,9 +1876,251 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 
 					DB::cleanMember(member);
 					_db.save(member,true);
+					_audit.record(_auditActor(headers),_auditMemberOp(before,member),nwid,address,before,member);
+					if (OSUtils::jsonBool(member["authorized"],false) != wasAuthorized) {
+						_counters.authorization(nwid,!wasAuthorized);
+						_webhooks.event((wasAuthorized) ? "member-deauthorized" : "member-authorized",nwid,network["webhooks"],"member",member);
+					}
 					responseBody = OSUtils::jsonDump(member);
 					responseContentType = "application/json";
 
+					return 200;
+				} else if ((path.size() == 3)&&(path[2] == "import")) {
+					// Recreate an exported network and its members. Everything is validated before
+					// anything is written, so a bad document leaves the database untouched, and if
+					// any record then fails to save, those already saved are erased again.
+					const uint64_t controllerAddress = _signingId.address().toInt();
+					if (path[1].substr(10) == "______") {
+						nwid = _nextNetworkId(controllerAddress);
+						if (!nwid) {
+							responseBody = "{ \"message\": \"no unused network IDs left for this controller address\" }";
+							responseContentType = "application/json";
+							return 503;
+						}
+						OSUtils::ztsnprintf(nwids,sizeof(nwids),"%.16llx",(unsigned long long)nwid);
+					} else if ((nwid >> 24) != controllerAddress) {
+						responseBody = "{ \"message\": \"network ID does not belong to this controller, import with a new ID instead\" }";
+						responseContentType = "application/json";
+						return 400;
+					}
+
+					json existing;
+					if (_db.get(nwid,existing)) {
+						responseBody = "{ \"message\": \"network already exists\" }";
+						responseContentType = "application/json";
+						return 409;
+					}
+					if (_networkLimitReached()) {
+						responseBody = "{ \"message\": \"this controller has reached its network limit (controllerMaxNetworks)\" }";
+						responseContentType = "application/json";
+						return 403;
+					}
+
+					json network(b["network"]);
+					json &members = b["members"];
+					std::string err(_validateImportNetwork(network));
+					if ((err.empty())&&((!members.is_array())||(members.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE)))
+						err = "members is not an array";
+					std::set<uint64_t> seen;
+					for(unsigned long i=0;((err.empty())&&(i<members.size()));++i) {
+						err = _validateImportMember(members[i]);
+						if ((err.empty())&&(!seen.insert(Utils::hexStrToU64(OSUtils::jsonString(members[i]["id"],"").c_str())).second))
+							err = "duplicate member " + OSUtils::jsonString(members[i]["id"],"");
+					}
+					if (!err.empty()) {
+						json e;
+						e["message"] = err;
+						responseBody = OSUtils::jsonDump(e);
+						responseContentType = "application/json";
+						return 400;
+					}
+
+					network["id"] = nwids;
+					network["nwid"] = nwids; // legacy
+					std::vector<std::string> lostSecrets;
+					_importHooks(network,json(),lostSecrets);
+					DB::initNetwork(network);
+					DB::cleanNetwork(network);
+					std::string failed;
+					if (!_db.save(network,true))
+						failed = std::string("network ") + nwids;
+
+					std::vector<uint64_t> saved;
+					for(unsigned long i=0;((failed.empty())&&(i<members.size()));++i) {
+						json member(members[i]);
+						const uint64_t address = Utils::hexStrToU64(OSUtils::jsonString(member["id"],"").c_str());
+						char addrs[24];
+						OSUtils::ztsnprintf(addrs,sizeof(addrs),"%.10llx",(unsigned long long)address);
+						member["id"] = addrs;
+						member["address"] = addrs; // legacy
+						member["nwid"] = nwids;
+						DB::initMember(member);
+						DB::cleanMember(member);
+						if (_db.save(member,true))
+							saved.push_back(address);
+						else failed = std::string("member ") + addrs;
+					}
+					if (!failed.empty()) {
+						for(std::vector<uint64_t>::const_iterator m(saved.begin());m!=saved.end();++m)
+							_db.eraseMember(nwid,*m);
+						_db.eraseNetwork(nwid);
+						json e;
+						e["message"] = "unable to save " + failed + ", nothing was imported";
+						responseBody = OSUtils::jsonDump(e);
+						responseContentType = "application/json";
+						return 500;
+					}
+					_webhooks.event("network-created",nwid,network["webhooks"],"network",network);
+
+					json imported;
+					imported["name"] = network["name"];
+					imported["private"] = network["private"];
+					imported["memberCount"] = members.size();
+					_audit.record(_auditActor(headers),"network-import",nwid,0,json(),imported);
+
+					json r;
+					r["id"] = nwids;
+					r["memberCount"] = members.size();
+					r["warnings"] = json::array();
+					for(std::vector<std::string>::const_iterator u(lostSecrets.begin());u!=lostSecrets.end();++u)
+						r["warnings"].push_back("hook " + *u + " had a secret that is not in the document; set it again or its requests will be signed with an empty key");
+					responseBody = OSUtils::jsonDump(r);
+					responseContentType = "application/json";
+					return 200;
+				} else if ((path.size() == 3)&&(path[2] == "token")) {
+					// Mint a group token that authorizes whoever presents it into a role
+
+					json network;
+					if (!_db.get(nwid,network))
+						return 404;
+
+					const std::string role(OSUtils::jsonString(b["role"],"member"));
+					if ((!_validRulesName(role))||((role != "member")&&(_capabilityIdByName(network,role) < 0))) {
+						responseBody = "{ \"message\": \"role must be member or the name of one of this network's capabilities\" }";
+						responseContentType = "application/json";
+						return 400;
+					}
+					int64_t ttl = ZT_CONTROLLER_GROUP_TOKEN_DEFAULT_TTL;
+					if (b.count("ttl")) {
+						if ((!b["ttl"].is_number_integer())||(b["ttl"].get<int64_t>() <= 0)||(b["ttl"].get<int64_t>() > ZT_CONTROLLER_GROUP_TOKEN_MAX_TTL)) {
+							responseBody = "{ \"message\": \"ttl must be a positive number of milliseconds, at most one year\" }";
+							responseContentType = "application/json";
+							return 400;
+						}
+						ttl = b["ttl"].get<int64_t>();
+					}
+
+					uint64_t nonce = 0;
+					Utils::getSecureRandom(&nonce,sizeof(nonce));
+					const int64_t expires = now + ttl;
+					std::string token(_groupTokenBody(nwid,role,expires,nonce));
+					const C25519::Signature sig(_signingId.sign(token.data(),(unsigned int)token.length()));
+					char sigh[(ZT_C25519_SIGNATURE_LEN * 2) + 1];
+					token.push_back(':');
+					token.append(Utils::hex(sig.data,ZT_C25519_SIGNATURE_LEN,sigh));
+
+					json minted; // the token itself is not recorded
+					minted["role"] = role;
+					minted["expires"] = expires;
+					_audit.record(_auditActor(headers),"network-token-create",nwid,0,json(),minted);
+
+					json r;
+					r["token"] = token;
+					r["network"] = nwids;
+					r["role"] = role;
+					r["expires"] = expires;
+					responseBody = OSUtils::jsonDump(r);
+					responseContentType = "application/json";
+					return 200;
+
+				} else if ((path.size() == 3)&&(path[2] == "routes")) {
+					// Add or replace a managed route
+
+					json network;
+					if (!_db.get(nwid,network))
+						return 404;
+					const json before(network);
+					DB::initNetwork(network);
+
+					const std::string targetStr(OSUtils::jsonString(b["target"],""));
+					InetAddress t(targetStr.c_str());
+					InetAddress v;
+					if (b["via"].is_string())
+						v.fromString(b["via"].get<std::string>().c_str());
+					if ( ((t.ss_family != AF_INET)&&(t.ss_family != AF_INET6)) || (targetStr.find('/') == std::string::npos) || (!t.netmaskBitsValid()) ) {
+						responseBody = "{ \"message\": \"target must be an IPv4 or IPv6 CIDR\" }";
+						responseContentType = "application/json";
+						return 400;
+					}
+					if ((v)&&(v.ss_family != t.ss_family)) {
+						responseBody = "{ \"message\": \"via must be in the same address family as target\" }";
+						responseContentType = "application/json";
+						return 400;
+					}
+
+					char tmp2[64];
+					const std::string target(t.toString(tmp2));
+					json route;
+					route["target"] = target;
+					if (v)
+						route["via"] = v.toIpString(tmp2);
+					else route["via"] = json();
+
+					json &rts = network["routes"];
+					json nrts = json::array();
+					for(unsigned long i=0;i<rts.size();++i) {
+						if (OSUtils::jsonString(rts[i]["target"],"") != target)
+							nrts.push_back(rts[i]);
+					}
+					if (nrts.size() >= ZT_CONTROLLER_MAX_ARRAY_SIZE) {
+						responseBody = "{ \"message\": \"too many routes\" }";
+						responseContentType = "application/json";
+						return 400;
+					}
+					nrts.push_back(route);
+					network["routes"] = nrts;
+
+					DB::cleanNetwork(network);
+					_db.save(network,true);
+					_audit.record(_auditActor(headers),"network-update",nwid,0,before,network);
+
+					responseBody = OSUtils::jsonDump(nrts);
+					responseContentType = "application/json";
+					return 200;
+
+				} else if ((path.size() == 3)&&(path[2] == "acl")) {
+					// Add an access control entry after the existing ones
+
+					json network;
+					if (!_db.get(nwid,network))
+						return 404;
+					const json before(network);
+					DB::initNetwork(network);
+
+					json acl(network["acl"]);
+					if (!acl.is_array())
+						acl = json::array();
+					json entry(b);
+					if (entry.is_object())
+						entry.erase("id");
+					acl.push_back(entry);
+					json nacl;
+					const std::string err(_validateAcl(acl,nacl));
+					if (!err.empty()) {
+						json e;
+						e["message"] = err;
+						responseBody = OSUtils::jsonDump(e);
+						responseContentType = "application/json";
+						return 400;
+					}
+					network["acl"] = nacl;
+
+					DB::cleanNetwork(network);
+					_db.save(network,true);
+					_audit.record(_auditActor(headers),"network-update",nwid,0,before,network);
+
+					responseBody = OSUtils::jsonDump(nacl);
+					responseContentType = "application/json";
 					return 200;
 				} // else 404
 
@@ -790,25 +2129,23 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 
 				// Magic ID ending with ______ picks a random unused network ID
 				if (path[1].substr(10) == "______") {
-					nwid = 0;
-					uint64_t nwidPrefix = (Utils::hexStrToU64(path[1].substr(0,10).c_str()) << 24) & 0xffffffffff000000ULL;
-					uint64_t nwidPostfix = 0;
-					for(unsigned long k=0;k<100000;++k) { // sanity limit on trials
-						Utils::getSecureRandom(&nwidPostfix,sizeof(nwidPostfix));
-						uint64_t tryNwid = nwidPrefix | (nwidPostfix & 0xffffffULL);
-						if ((tryNwid & 0xffffffULL) == 0ULL) tryNwid |= 1ULL;
-						if (!_db.hasNetwork(tryNwid)) {
-							nwid = tryNwid;
-							break;
-						}
-					}
-					if (!nwid)
+					nwid = _nextNetworkId(Utils::hexStrToU64(path[1].substr(0,10).c_str()));
+					if (!nwid) {
+						responseBody = "{ \"message\": \"no unused network IDs left for this controller address\" }";
+						responseContentType = "application/json";
 						return 503;
+					}
 				}
 				OSUtils::ztsnprintf(nwids,sizeof(nwids),"%.16llx",(unsigned long long)nwid);
 
 				json network;
-				_db.get(nwid,network);
+				const bool created = (!_db.get(nwid,network));
+				const json before((created) ? json() : network);
+				if ((created)&&(_networkLimitReached())) {
+					responseBody = "{ \"message\": \"this controller has reached its network limit (controllerMaxNetworks)\" }";
+					responseContentType = "application/json";
+					return 403;
+				}
 				DB::initNetwork(network);
 
 				try {
@@ -816,6 +2153,7 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 					if (b.count("private")) network["private"] = OSUtils::jsonBool(b["private"],true);
 					if (b.count("enableBroadcast")) network["enableBroadcast"] = OSUtils::jsonBool(b["enableBroadcast"],false);
 					if (b.count("multicastLimit")) network["multicastLimit"] = OSUtils::jsonInt(b["multicastLimit"],32ULL);
+					if (b.count("memberLimit")) network["memberLimit"] = OSUtils::jsonInt(b["memberLimit"],0ULL);
 					if (b.count("mtu")) network["mtu"] = std::max(std::min((unsigned int)OSUtils::jsonInt(b["mtu"],ZT_DEFAULT_MTU),(unsigned int)ZT_MAX_MTU),(unsigned int)ZT_MIN_MTU);
 
 					if (b.count("remoteTraceTarget")) {
@@ -944,6 +2282,12 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 						}
 					}
 
+					if (b.count("rulesSource")) {
+						json &rulesSource = b["rulesSource"];
+						if (rulesSource.is_string())
+							network["rulesSource"] = rulesSource;
+					}
+
 					if (b.count("authTokens")) {
 						json &authTokens = b["authTokens"];
 						if (authTokens.is_object()) {
@@ -962,6 +2306,7 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 						json &capabilities = b["capabilities"];
 						if (capabilities.is_array()) {
 							std::map< uint64_t,json > ncaps;
+							std::set<std::string> names;
 							for(unsigned long i=0;i<capabilities.size();++i) {
 								json &cap = capabilities[i];
 								if (cap.is_object()) {
@@ -970,6 +2315,11 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 									ncap["id"] = capId;
 									ncap["default"] = OSUtils::jsonBool(cap["default"],false);
 
+									// Optional name, for tools that grant capabilities by name
+									const std::string name(OSUtils::jsonString(cap["name"],""));
+									if ((_validRulesName(name))&&(names.insert(name).second))
+										ncap["name"] = name;
+
 									json &rules = cap["rules"];
 									json nrules = json::array();
 									if (rules.is_array()) {
@@ -1005,6 +2355,7 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 						json &tags = b["tags"];
 						if (tags.is_array()) {
 							std::map< uint64_t,json > ntags;
+							std::set<std::string> names;
 							for(unsigned long i=0;i<tags.size();++i) {
 								json &tag = tags[i];
 								if (tag.is_object()) {
@@ -1015,6 +2366,19 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 									if (dfl.is_null())
 										ntag["default"] = dfl;
 									else ntag["default"] = OSUtils::jsonInt(dfl,0ULL);
+
+									// Optional name and value range, for tools that set member tags by name
+									const std::string name(OSUtils::jsonString(tag["name"],""));
+									if ((_validRulesName(name))&&(names.insert(name).second))
+										ntag["name"] = name;
+									if ((tag["min"].is_number())&&(tag["max"].is_number())) {
+										const uint64_t tmin = OSUtils::jsonInt(tag["min"],0ULL) & 0xffffffffULL;
+										const uint64_t tmax = OSUtils::jsonInt(tag["max"],0ULL) & 0xffffffffULL;
+										if (tmin <= tmax) {
+											ntag["min"] = tmin;
+											ntag["max"] = tmax;
+										}
+									}
 									ntags[tagId] = ntag;
 								}
 							}
@@ -1034,19 +2398,116 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 						if (dns.is_object()) {
 							json nd;
 
-							nd["domain"] = dns["domain"];
+							const std::string domain(OSUtils::jsonString(dns["domain"],""));
+							if (domain.length() >= sizeof(((ZT_VirtualNetworkDNS *)0)->domain)) {
+								responseBody = "{ \"message\": \"dns domain is too long\" }";
+								responseContentType = "application/json";
+								return 400;
+							}
+							nd["domain"] = domain;
 
+							json ns = json::array();
 							json &srv = dns["servers"];
 							if (srv.is_array()) {
-								json ns = json::array();
+								if (srv.size() > ZT_MAX_DNS_SERVERS) {
+									responseBody = "{ \"message\": \"too many dns servers\" }";
+									responseContentType = "application/json";
+									return 400;
+								}
 								for(unsigned int i=0;i<srv.size();++i) {
-									ns.push_back(srv[i]);
+									const InetAddress sa(OSUtils::jsonString(srv[i],"").c_str());
+									if ((sa.ss_family != AF_INET)&&(sa.ss_family != AF_INET6)) {
+										responseBody = "{ \"message\": \"dns servers must be IPv4 or IPv6 addresses\" }";
+										responseContentType = "application/json";
+										return 400;
+									}
+									char tmp2[64];
+									ns.push_back(sa.toIpString(tmp2));
 								}
-								nd["servers"] = ns;
 							}
+							nd["servers"] = ns;
+
+							// An empty domain with no servers clears the setting
+							if ((domain.empty())&&(ns.empty()))
+								network["dns"] = json::array();
+							else network["dns"] = nd;
+						} else if ((dns.is_null())||(dns.is_array())) {
+							network["dns"] = json::array();
+						}
+					}
+
+					if (b.count("webhooks")) {
+						json hooks;
+						Webhooks::keepSecrets(b["webhooks"],network["webhooks"]);
+						const std::string err(Webhooks::validate(b["webhooks"],hooks));
+						if (!err.empty()) {
+							json e;
+							e["message"] = err;
+							responseBody = OSUtils::jsonDump(e);
+							responseContentType = "application/json";
+							return 400;
+						}
+						network["webhooks"] = hooks;
+					}
+
+					if (b.count("acl")) {
+						json acl;
+						const std::string err(_validateAcl(b["acl"],acl));
+						if (!err.empty()) {
+							json e;
+							e["message"] = err;
+							responseBody = OSUtils::jsonDump(e);
+							responseContentType = "application/json";
+							return 400;
+						}
+						network["acl"] = acl;
+					}
 
-							network["dns"] = nd;
+					if (b.count("authHook")) {
+						json hook;
+						Webhooks::keepSecrets(b["authHook"],network["authHook"]);
+						const std::string err(_validateAuthHook(b["authHook"],hook));
+						if (!err.empty()) {
+							json e;
+							e["message"] = err;
+							responseBody = OSUtils::jsonDump(e);
+							responseContentType = "application/json";
+							return 400;
 						}
+						network["authHook"] = hook;
+					}
+
+					// The controller only stores the provider and client ID, for the provider's integration
+					// and for clients. Whether members must complete SSO is enforced in _request().
+					if (b.count("ssoEnabled")) network["ssoEnabled"] = OSUtils::jsonBool(b["ssoEnabled"],false);
+					if (b.count("ssoProvider")) {
+						const std::string provider(OSUtils::jsonString(b["ssoProvider"],""));
+						const std::string err(_validateSsoProvider(provider));
+						if (!err.empty()) {
+							json e;
+							e["message"] = err;
+							responseBody = OSUtils::jsonDump(e);
+							responseContentType = "application/json";
+							return 400;
+						}
+						network["ssoProvider"] = provider;
+					}
+					if (b.count("ssoClientID")) {
+						const std::string clientId(OSUtils::jsonString(b["ssoClientID"],""));
+						bool valid = (clientId.length() <= ZT_CONTROLLER_SSO_MAX_CLIENT_ID_LENGTH);
+						for(std::string::size_type i=0;((valid)&&(i<clientId.length()));++i)
+							valid = ((clientId[i] > 32)&&(clientId[i] < 127));
+						if (!valid) {
+							responseBody = "{ \"message\": \"ssoClientID must be at most 256 printable characters without spaces\" }";
+							responseContentType = "application/json";
+							return 400;
+						}
+						network["ssoClientID"] = clientId;
+					}
+					if ((OSUtils::jsonBool(network["ssoEnabled"],false))&&((OSUtils::jsonString(network["ssoProvider"],"").empty())||(OSUtils::jsonString(network["ssoClientID"],"").empty()))) {
+						responseBody = "{ \"message\": \"ssoEnabled requires ssoProvider and ssoClientID\" }";
+						responseContentType = "application/json";
+						return 400;
 					}
 
 				} catch ( ... ) {
@@ -1060,7 +2521,11 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 
 				DB::cleanNetwork(network);
 				_db.save(network,true);
+				_audit.record(_auditActor(headers),(created) ? "network-create" : "network-update",nwid,0,before,network);
+				if (created)
+					_webhooks.event("network-created",nwid,network["webhooks"],"network",network);
 
+				Webhooks::redactSecrets(network);
 				responseBody = OSUtils::jsonDump(network);
 				responseContentType = "application/json";
 				return 200;
@@ -1068,6 +2533,139 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpPOST(
 
 		} // else 404
 
+	} else if ((path.size() == 1)&&(path[0] == "restore")) {
+		// Recreate every network and member in a backup of this controller. Everything is validated
+		// before anything is written. Unless forced, only a controller with no networks is restored.
+
+		char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+		const std::string controllerIdentity(_signingId.toString(false,idtmp));
+		std::string err;
+		if (OSUtils::jsonInt(b["formatVersion"],0ULL) != 1ULL)
+			err = "not a controller backup, or made by a newer version";
+		else if ((OSUtils::jsonString(b["controller"],"") != _signingIdAddressString)||(OSUtils::jsonString(b["controllerIdentity"],controllerIdentity.c_str()) != controllerIdentity))
+			err = "backup is of controller " + OSUtils::jsonString(b["controller"],"?") + ", not this one (" + _signingIdAddressString + ")";
+		else if ((!b["networks"].is_array())||(b["networks"].size() > ZT_CONTROLLER_MAX_ARRAY_SIZE))
+			err = "networks is not an array";
+
+		json &networks = b["networks"];
+		std::set<uint64_t> restoring;
+		unsigned long memberCount = 0;
+		for(unsigned long i=0;((err.empty())&&(i<networks.size()));++i) {
+			json &network = networks[i]["network"];
+			json &members = networks[i]["members"];
+			const std::string id(OSUtils::jsonString(network["id"],""));
+			const uint64_t nwid = Utils::hexStrToU64(id.c_str());
+			if ((id.length() != 16)||(id.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)||((nwid >> 24) != _signingId.address().toInt()))
+				err = "network " + id + " does not belong to this controller";
+			else if (!restoring.insert(nwid).second)
+				err = "duplicate network " + id;
+			if (err.empty())
+				err = _validateImportNetwork(network);
+			if ((err.empty())&&((!members.is_array())||(members.size() > ZT_CONTROLLER_MAX_ARRAY_SIZE)))
+				err = "members of network " + id + " is not an array";
+			std::set<uint64_t> seen;
+			for(unsigned long k=0;((err.empty())&&(k<members.size()));++k) {
+				err = _validateImportMember(members[k]);
+				if ((err.empty())&&(!seen.insert(Utils::hexStrToU64(OSUtils::jsonString(members[k]["id"],"").c_str())).second))
+					err = "duplicate member " + OSUtils::jsonString(members[k]["id"],"") + " in network " + id;
+			}
+			if (err.empty())
+				memberCount += (unsigned long)members.size();
+		}
+		if (!err.empty()) {
+			json e;
+			e["message"] = err;
+			responseBody = OSUtils::jsonDump(e);
+			responseContentType = "application/json";
+			return 400;
+		}
+
+		std::set<uint64_t> existing;
+		_db.networks(existing);
+		const bool force = (urlArgs.count("force") > 0);
+		if ((!existing.empty())&&(!force)) {
+			responseBody = "{ \"message\": \"this controller already has networks, restore with force to replace those in the backup\" }";
+			responseContentType = "application/json";
+			return 409;
+		}
+		unsigned long added = 0;
+		for(std::set<uint64_t>::const_iterator nwid(restoring.begin());nwid!=restoring.end();++nwid) {
+			if (!existing.count(*nwid))
+				++added;
+		}
+		if ((_maxNetworks)&&((uint64_t)(existing.size() + added) > _maxNetworks)) {
+			responseBody = "{ \"message\": \"restoring would exceed this controller's network limit (controllerMaxNetworks)\" }";
+			responseContentType = "application/json";
+			return 403;
+		}
+
+		// Saving bumps a changed record's revision, so each is saved one below its backed up revision
+		unsigned long replaced = 0;
+		json warnings = json::array();
+		for(unsigned long i=0;i<networks.size();++i) {
+			json network(networks[i]["network"]);
+			json &members = networks[i]["members"];
+			const uint64_t nwid = Utils::hexStrToU64(OSUtils::jsonString(network["id"],"").c_str());
+			char nwids[24];
+			OSUtils::ztsnprintf(nwids,sizeof(nwids),"%.16llx",(unsigned long long)nwid);
+
+			std::set<uint64_t> keep;
+			for(unsigned long k=0;k<members.size();++k)
+				keep.insert(Utils::hexStrToU64(OSUtils::jsonString(members[k]["id"],"").c_str()));
+			json current;
+			if (existing.count(nwid)) {
+				++replaced;
+				std::vector<json> currentMembers;
+				_db.get(nwid,current,currentMembers);
+				for(std::vector<json>::iterator m(currentMembers.begin());m!=currentMembers.end();++m) {
+					const uint64_t mid = Utils::hexStrToU64(OSUtils::jsonString((*m)["id"],"").c_str());
+					if (!keep.count(mid))
+						_db.eraseMember(nwid,mid);
+				}
+			}
+
+			network["id"] = nwids;
+			network["nwid"] = nwids; // legacy
+			std::vector<std::string> lostSecrets;
+			_importHooks(network,current,lostSecrets);
+			for(std::vector<std::string>::const_iterator u(lostSecrets.begin());u!=lostSecrets.end();++u)
+				warnings.push_back(std::string("network ") + nwids + " hook " + *u + " had a secret that is not in the backup; set it again or its requests will be signed with an empty key");
+			DB::initNetwork(network);
+			DB::cleanNetwork(network);
+			uint64_t rev = OSUtils::jsonInt(network["revision"],0ULL);
+			network["revision"] = (rev > 0) ? (rev - 1) : 0ULL;
+			_db.save(network,true);
+
+			for(unsigned long k=0;k<members.size();++k) {
+				json member(members[k]);
+				char addrs[24];
+				OSUtils::ztsnprintf(addrs,sizeof(addrs),"%.10llx",(unsigned long long)Utils::hexStrToU64(OSUtils::jsonString(member["id"],"").c_str()));
+				member["id"] = addrs;
+				member["address"] = addrs; // legacy
+				member["nwid"] = nwids;
+				DB::initMember(member);
+				DB::cleanMember(member);
+				rev = OSUtils::jsonInt(member["revision"],0ULL);
+				member["revision"] = (rev > 0) ? (rev - 1) : 0ULL;
+				_db.save(member,true);
+			}
+
+			json restored;
+			restored["name"] = network["name"];
+			restored["memberCount"] = members.size();
+			restored["backupTime"] = b["backupTime"];
+			_audit.record(_auditActor(headers),"network-restore",nwid,0,json(),restored);
+		}
+
+		json r;
+		r["networkCount"] = (unsigned long)networks.size();
+		r["memberCount"] = memberCount;
+		r["replacedNetworkCount"] = replaced;
+		r["warnings"] = warnings;
+		responseBody = OSUtils::jsonDump(r);
+		responseContentType = "application/json";
+		return 200;
+
 	}
 
 	return 404;
@@ -1102,9 +2700,76 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpDELETE(
 
 					if (!member.size())
 						return 404;
+					_audit.record(_auditActor(headers),"member-delete",nwid,address,member,json());
+					_webhooks.event("member-deleted",nwid,network["webhooks"],"member",member);
 					responseBody = OSUtils::jsonDump(member);
 					responseContentType = "application/json";
 					return 200;
+				} else if ((path.size() == 4)&&(path[2] == "routes")) {
+					// Route targets can't contain a slash in a path element, so accept 10.0.0.0_24 or 10.0.0.0%2F24
+					std::string target(path[3]);
+					std::string::size_type enc = target.find("%2");
+					if ((enc != std::string::npos)&&(enc + 2 < target.length())&&((target[enc + 2] == 'F')||(target[enc + 2] == 'f')))
+						target.replace(enc,3,"/");
+					else std::replace(target.begin(),target.end(),'_','/');
+					const InetAddress t(target.c_str());
+					char tmp2[64];
+					if ((t.ss_family != AF_INET)&&(t.ss_family != AF_INET6))
+						return 404;
+					t.toString(tmp2);
+
+					json network;
+					if (!_db.get(nwid,network))
+						return 404;
+					const json before(network);
+					json &rts = network["routes"];
+					if (!rts.is_array())
+						return 404;
+					json nrts = json::array();
+					for(unsigned long i=0;i<rts.size();++i) {
+						if (OSUtils::jsonString(rts[i]["target"],"") != tmp2)
+							nrts.push_back(rts[i]);
+					}
+					if (nrts.size() == rts.size())
+						return 404;
+					network["routes"] = nrts;
+
+					DB::cleanNetwork(network);
+					_db.save(network,true);
+					_audit.record(_auditActor(headers),"network-update",nwid,0,before,network);
+
+					responseBody = OSUtils::jsonDump(nrts);
+					responseContentType = "application/json";
+					return 200;
+				} else if (((path.size() == 3)||(path.size() == 4))&&(path[2] == "acl")) {
+					// Remove one access control entry by ID, or all of them
+
+					json network;
+					if (!_db.get(nwid,network))
+						return 404;
+					const json before(network);
+					json &acl = network["acl"];
+					json nacl = json::array();
+					if (path.size() == 4) {
+						if (!acl.is_array())
+							return 404;
+						const uint64_t id = Utils::strToU64(path[3].c_str());
+						for(unsigned long i=0;i<acl.size();++i) {
+							if (OSUtils::jsonInt(acl[i]["id"],0ULL) != id)
+								nacl.push_back(acl[i]);
+						}
+						if (nacl.size() == acl.size())
+							return 404;
+					}
+					network["acl"] = nacl;
+
+					DB::cleanNetwork(network);
+					_db.save(network,true);
+					_audit.record(_auditActor(headers),"network-update",nwid,0,before,network);
+
+					responseBody = OSUtils::jsonDump(nacl);
+					responseContentType = "application/json";
+					return 200;
 				}
 			} else {
 				json network;
@@ -1122,6 +2787,10 @@ unsigned int EmbeddedNetworkController::handleControlPlaneHttpDELETE(
 
 				if (!network.size())
 					return 404;
+				_counters.erase(nwid);
+				_audit.record(_auditActor(headers),"network-delete",nwid,0,network,json());
+				_webhooks.event("network-deleted",nwid,network["webhooks"],"network",network);
+				Webhooks::redactSecrets(network);
 				responseBody = OSUtils::jsonDump(network);
 				responseContentType = "application/json";
 				return 200;
@@ -1284,10 +2953,24 @@ void EmbeddedNetworkController::_request(
 		member["address"] = addrs;
 		member["nwid"] = nwids;
 	}
+	if (requestPacketId)
+		_counters.request(nwid,identity.address().toInt(),now);
+	if (newMember) {
+		_counters.newMember(nwid);
+		_webhooks.event("member-first-seen",nwid,network["webhooks"],"member",member);
+	}
+
+	// An expired authorization lapses here even if the periodic check has not caught it yet
+	if (_expireAuthorization(member,now)) {
+		_auditExpired(nwid,identity.address().toInt());
+		_counters.authorization(nwid,false);
+		_webhooks.event("member-deauthorized",nwid,network["webhooks"],"member",member);
+	}
 
 	// Determine whether and how member is authorized
 	bool authorized = false;
 	bool autoAuthorized = false;
+	bool hookAdmitted = false; // by the authHook, for this request only
 	json autoAuthCredentialType,autoAuthCredential;
 	if (OSUtils::jsonBool(member["authorized"],false)) {
 		authorized = true;
@@ -1311,16 +2994,115 @@ void EmbeddedNetworkController::_request(
 						autoAuthCredential = presentedToken;
 					}
 				}
+			} else if ((requestPacketId)&&(OSUtils::jsonInt(member["lastDeauthorizedTime"],0ULL) == 0)) {
+				// Group tokens are only honored in requests from the node itself, not config
+				// pushes, and never for a member that has been deauthorized, so that sticks
+				std::string role,nonce;
+				if (_verifyGroupToken(_signingId,nwid,now,std::string(presentedAuth),role,nonce)) {
+					// A role other than "member" grants the capability of that name, if it still exists
+					const int64_t capId = (role == "member") ? 0 : _capabilityIdByName(network,role);
+					if (capId >= 0) {
+						if (role != "member") {
+							json &mcaps = member["capabilities"];
+							bool have = false;
+							for(unsigned long i=0;i<mcaps.size();++i) {
+								if (OSUtils::jsonInt(mcaps[i],0ULL) == (uint64_t)capId)
+									have = true;
+							}
+							if (!have)
+								mcaps.push_back(capId);
+						}
+						authorized = true;
+						autoAuthorized = true;
+						autoAuthCredentialType = "group";
+						autoAuthCredential = role + ":" + nonce;
+					}
+				}
 			}
 		}
+		// Otherwise ask the network's external authorization hook, if it has one. Like group
+		// tokens it is only consulted for requests from the node itself and never overrides
+		// a deauthorization. Its answers are kept only in memory until they lapse and are
+		// never saved as an authorization, so a member it admits is asked about again once
+		// its answer expires, and config pushes in the meantime honor the cached answer.
+		const json &hook = network["authHook"];
+		if ((!authorized)&&(hook.is_object())&&(!OSUtils::jsonString(hook["url"],"").empty())&&(OSUtils::jsonInt(member["lastDeauthorizedTime"],0ULL) == 0)) {
+			const bool failOpen = (OSUtils::jsonString(hook["failMode"],"closed") == "open");
+			int verdict = -2;
+			{
+				std::lock_guard<std::mutex> l(_memberStatus_l);
+				const _MemberStatus &ms = _memberStatus[_MemberStatusKey(nwid,identity.address().toInt())];
+				if (now < ms.authHookExpires)
+					verdict = ms.authHookVerdict;
+			}
+			if ((verdict == -2)&&(requestPacketId)) {
+				std::string err;
+				verdict = _callAuthHook(hook,nwids,member,err);
+				if (verdict < 0)
+					fprintf(stderr,"WARNING: controller authHook for network %s failed for member %s: %s" ZT_EOL_S,nwids,OSUtils::jsonString(member["address"],"").c_str(),err.c_str());
+				std::lock_guard<std::mutex> l(_memberStatus_l);
+				_MemberStatus &ms = _memberStatus[_MemberStatusKey(nwid,identity.address().toInt())];
+				ms.authHookVerdict = verdict;
+				ms.authHookExpires = now + ((verdict < 0) ? ZT_CONTROLLER_AUTH_HOOK_ERROR_TTL : (int64_t)OSUtils::jsonInt(hook["ttl"],(uint64_t)ZT_CONTROLLER_AUTH_HOOK_DEFAULT_TTL));
+			}
+			if ((verdict > 0)||((verdict == -1)&&(failOpen))) {
+				// Members the hook admits count toward the member limit like authorized ones
+				const uint64_t memberLimit = _memberLimit(network);
+				if ((memberLimit)&&(((uint64_t)ns.authorizedMemberCount + _hookAdmittedCount(nwid,identity.address().toInt(),failOpen,now)) >= memberLimit)) {
+					member["authRefusedReason"] = "memberLimit";
+					member["authRefusedTime"] = now;
+				} else {
+					authorized = true;
+					hookAdmitted = true;
+				}
+			}
+		}
+	}
+
+	// A network that requires SSO admits only members that have completed it, however else
+	// they are or would be authorized. Its provider's integration marks them through the API.
+	if ((authorized)&&(OSUtils::jsonBool(network["ssoEnabled"],false))&&(OSUtils::jsonInt(member["ssoAuthenticatedTime"],0ULL) == 0)) {
+		authorized = false;
+		autoAuthorized = false;
+		hookAdmitted = false;
+		member["authRefusedReason"] = "sso";
+		member["authRefusedTime"] = now;
+	} else if ((authorized)&&(OSUtils::jsonString(member["authRefusedReason"],"") == "sso")) {
+		member.erase("authRefusedReason");
+		member.erase("authRefusedTime");
+	}
+
+	// Automatic authorization stops at the network's member limit. Members already authorized
+	// stay so if the limit is lowered, and admins can still authorize members by hand.
+	if ((autoAuthorized)&&(authorized)) {
+		const uint64_t memberLimit = _memberLimit(network);
+		if ((memberLimit)&&((uint64_t)ns.authorizedMemberCount >= memberLimit)) {
+			authorized = false;
+			autoAuthorized = false;
+			member["authRefusedReason"] = "memberLimit";
+			member["authRefusedTime"] = now;
+		}
 	}
 
 	// If we auto-authorized, update member record
 	if ((autoAuthorized)&&(authorized)) {
+		member.erase("authRefusedReason");
+		member.erase("authRefusedTime");
 		member["authorized"] = true;
 		member["lastAuthorizedTime"] = now;
 		member["lastAuthorizedCredentialType"] = autoAuthCredentialType;
 		member["lastAuthorizedCredential"] = autoAuthCredential;
+		member["authExpiry"] = 0;
+		json before,after;
+		before["authorized"] = false;
+		after["authorized"] = true;
+		after["lastAuthorizedCredentialType"] = autoAuthCredentialType;
+		_audit.record("controller","member-authorize",nwid,identity.address().toInt(),before,after);
+		_counters.authorization(nwid,true);
+		_webhooks.event("member-authorized",nwid,network["webhooks"],"member",member);
+	} else if (hookAdmitted) {
+		member.erase("authRefusedReason");
+		member.erase("authRefusedTime");
 	}
 
 	if (authorized) {
@@ -1422,6 +3204,20 @@ void EmbeddedNetworkController::_request(
 		nc->ruleCount = 1;
 		nc->rules[0].t = ZT_NETWORK_RULE_ACTION_ACCEPT;
 	} else {
+		// Access control entries come first so they take precedence over the network's own rules
+		json &acl = network["acl"];
+		if (acl.is_array()) {
+			for(unsigned long i=0;i<acl.size();++i) {
+				json ar(_aclRules(acl[i]));
+				if ((nc->ruleCount + ar.size()) > ZT_MAX_NETWORK_RULES)
+					break;
+				for(unsigned long j=0;j<ar.size();++j) {
+					if (_parseRule(ar[j],nc->rules[nc->ruleCount]))
+						++nc->ruleCount;
+				}
+			}
+		}
+
 		if (rules.is_array()) {
 			for(unsigned long i=0;i<rules.size();++i) {
 				if (nc->ruleCount >= ZT_MAX_NETWORK_RULES)
@@ -1709,7 +3505,7 @@ void EmbeddedNetworkController::_request(
 	
 	if(dns.is_object()) {
 		std::string domain = OSUtils::jsonString(dns["domain"],"");
-		memcpy(nc->dns.domain, domain.c_str(), domain.size());
+		Utils::scopy(nc->dns.domain,sizeof(nc->dns.domain),domain.c_str());
 		json &addrArray = dns["servers"];
 		if (addrArray.is_array()) {
 			for(unsigned int j = 0; j < addrArray.size() && j < ZT_MAX_DNS_SERVERS; ++j) {
@@ -1740,9 +3536,71 @@ void EmbeddedNetworkController::_request(
 
 	DB::cleanMember(member);
 	_db.save(member,true);
+	if (requestPacketId)
+		_counters.configServed(nwid);
 	_sender->ncSendConfig(nwid,requestPacketId,identity.address(),*(nc.get()),metaData.getUI(ZT_NETWORKCONFIG_REQUEST_METADATA_KEY_VERSION,0) < 6);
 }
 
+bool EmbeddedNetworkController::_networkLimitReached()
+{
+	if (!_maxNetworks)
+		return false;
+	std::set<uint64_t> networkIds;
+	_db.networks(networkIds);
+	return ((uint64_t)networkIds.size() >= _maxNetworks);
+}
+
+unsigned long EmbeddedNetworkController::_hookAdmittedCount(const uint64_t nwid,const uint64_t memberId,const bool failOpen,const int64_t now)
+{
+	unsigned long n = 0;
+	std::lock_guard<std::mutex> l(_memberStatus_l);
+	for(auto ms=_memberStatus.begin();ms!=_memberStatus.end();++ms) {
+		if ((ms->first.networkId == nwid)&&(ms->first.nodeId != memberId)&&(now < ms->second.authHookExpires)&&((ms->second.authHookVerdict > 0)||((ms->second.authHookVerdict == -1)&&(failOpen))))
+			++n;
+	}
+	return n;
+}
+
+void EmbeddedNetworkController::_authHookStatus(const uint64_t nwid,json &network,json &member,const int64_t now)
+{
+	int verdict = -2;
+	int64_t expires = 0;
+	{
+		std::lock_guard<std::mutex> l(_memberStatus_l);
+		auto ms = _memberStatus.find(_MemberStatusKey(nwid,Utils::hexStrToU64(OSUtils::jsonString(member["id"],"0").c_str())));
+		if ((ms != _memberStatus.end())&&(now < ms->second.authHookExpires)) {
+			verdict = ms->second.authHookVerdict;
+			expires = ms->second.authHookExpires;
+		}
+	}
+	if (verdict == -2)
+		return;
+	member["authHookResult"] = (verdict > 0) ? "allow" : ((verdict == 0) ? "deny" : "error");
+	member["authHookExpires"] = expires;
+	member["authHookAdmitted"] = ((verdict > 0)||((verdict == -1)&&(OSUtils::jsonString(network["authHook"]["failMode"],"closed") == "open")));
+}
+
+uint64_t EmbeddedNetworkController::_nextNetworkId(const uint64_t controllerAddress)
+{
+	// Try random suffixes first, then fall back to a scan so a nearly full namespace still yields a free ID
+	const uint64_t nwidPrefix = (controllerAddress << 24) & 0xffffffffff000000ULL;
+	uint64_t nwidPostfix = 0;
+	for(unsigned long k=0;k<100000;++k) { // sanity limit on trials
+		Utils::getSecureRandom(&nwidPostfix,sizeof(nwidPostfix));
+		uint64_t tryNwid = nwidPrefix | (nwidPostfix & 0xffffffULL);
+		if ((tryNwid & 0xffffffULL) == 0ULL) tryNwid |= 1ULL;
+		if (!_db.hasNetwork(tryNwid))
+			return tryNwid;
+	}
+	std::set<uint64_t> networkIds;
+	_db.networks(networkIds);
+	for(uint64_t k=1;k<=0xffffffULL;++k) {
+		if (!networkIds.count(nwidPrefix | k))
+			return nwidPrefix | k;
+	}
+	return 0;
+}
+
 void EmbeddedNetworkController::_startThreads()
 {
 	std::lock_guard<std::mutex> l(_threads_l);
@@ -1770,4 +3628,47 @@ void EmbeddedNetworkController::_startThreads()
 	}
 }
 
+unsigned long EmbeddedNetworkController::expireAuthorizations(const int64_t now)
+{
+	unsigned long expired = 0;
+	std::set<uint64_t> networkIds;
+	_db.networks(networkIds);
+	for(std::set<uint64_t>::const_iterator nwid(networkIds.begin());nwid!=networkIds.end();++nwid) {
+		json network;
+		std::vector<json> members;
+		if (!_db.get(*nwid,network,members))
+			continue;
+		for(auto member=members.begin();member!=members.end();++member) {
+			if (!_expireAuthorization(*member,now))
+				continue;
+			// The listed copy may be stale, so the member is checked again as it is now before saving
+			const uint64_t memberId = Utils::hexStrToU64(OSUtils::jsonString((*member)["id"],"0").c_str());
+			json saved;
+			const bool changed = _db.updateMember(*nwid,memberId,[&saved,now](json &current) {
+				if (!_expireAuthorization(current,now))
+					return false;
+				DB::cleanMember(current);
+				saved = current;
+				return true;
+			});
+			if (changed) {
+				_auditExpired(*nwid,memberId);
+				_counters.authorization(*nwid,false);
+				_webhooks.event("member-deauthorized",*nwid,network["webhooks"],"member",saved);
+				++expired;
+			}
+		}
+	}
+	return expired;
+}
+
+void EmbeddedNetworkController::_auditExpired(const uint64_t nwid,const uint64_t memberId)
+{
+	json before,after;
+	before["authorized"] = true;
+	after["authorized"] = false;
+	after["lastDeauthorizedReason"] = "expired";
+	_audit.record("controller","member-deauthorize",nwid,memberId,before,after);
+}
+
 } // namespace ZeroTier
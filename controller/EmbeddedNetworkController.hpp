@@ -39,6 +39,9 @@
 
 #include "DB.hpp"
 #include "DBMirrorSet.hpp"
+#include "Webhooks.hpp"
+#include "AuditLog.hpp"
+#include "ControllerStats.hpp"
 
 namespace ZeroTier {
 
@@ -64,6 +67,12 @@ public:
 		const Identity &identity,
 		const Dictionary<ZT_NETWORKCONFIG_METADATA_DICT_CAPACITY> &metaData);
 
+	/**
+	 * @return Routes the handleControlPlaneHttp methods serve under /controller, as "GET /controller/network/{networkId}"
+	 *   and so on with parameters named as in doc/openapi.json, ending with NULL
+	 */
+	static const char *const *controlPlaneRoutes();
+
 	unsigned int handleControlPlaneHttpGET(
 		const std::vector<std::string> &path,
 		const std::map<std::string,std::string> &urlArgs,
@@ -92,10 +101,54 @@ public:
 	virtual void onNetworkMemberUpdate(const void *db,uint64_t networkId,uint64_t memberId,const nlohmann::json &member);
 	virtual void onNetworkMemberDeauthorize(const void *db,uint64_t networkId,uint64_t memberId);
 
+	/**
+	 * @return Per-network counters keyed by network ID, see ControllerStats
+	 */
+	inline nlohmann::json networkCounters() { return _counters.all(OSUtils::now()); }
+
+	/**
+	 * Deauthorize every member whose authorization expired before now
+	 *
+	 * This runs periodically on _authExpiryThread. The current time is a parameter
+	 * so that expiry can be checked against any clock. Each member is read again and
+	 * saved under the database's save lock, so a change made since it was listed wins.
+	 *
+	 * @param now Current time in ms since epoch
+	 * @return Number of members deauthorized
+	 */
+	unsigned long expireAuthorizations(const int64_t now);
+
 private:
 	void _request(uint64_t nwid,const InetAddress &fromAddr,uint64_t requestPacketId,const Identity &identity,const Dictionary<ZT_NETWORKCONFIG_METADATA_DICT_CAPACITY> &metaData);
 	void _startThreads();
 
+	/**
+	 * @return Other members of a network admitted by its authHook's cached answers
+	 */
+	unsigned long _hookAdmittedCount(const uint64_t nwid,const uint64_t memberId,const bool failOpen,const int64_t now);
+
+	/**
+	 * Add a member's cached authHook answer, if any, to a member object for the API
+	 */
+	void _authHookStatus(const uint64_t nwid,nlohmann::json &network,nlohmann::json &member,const int64_t now);
+
+	void _auditExpired(const uint64_t nwid,const uint64_t memberId);
+	uint64_t _nextNetworkId(const uint64_t controllerAddress);
+
+	/**
+	 * @return Most authorized members a network may have via automatic authorization, or 0 for no limit
+	 */
+	inline uint64_t _memberLimit(nlohmann::json &network) const
+	{
+		const uint64_t l = OSUtils::jsonInt(network["memberLimit"],0ULL);
+		return (l) ? l : _maxMembersPerNetwork;
+	}
+
+	/**
+	 * @return True if creating another network would exceed controllerMaxNetworks
+	 */
+	bool _networkLimitReached();
+
 	struct _RQEntry
 	{
 		uint64_t nwid;
@@ -117,9 +170,11 @@ private:
 	};
 	struct _MemberStatus
 	{
-		_MemberStatus() : lastRequestTime(0),vMajor(-1),vMinor(-1),vRev(-1),vProto(-1) {}
+		_MemberStatus() : lastRequestTime(0),vMajor(-1),vMinor(-1),vRev(-1),vProto(-1),authHookExpires(0),authHookVerdict(0) {}
 		uint64_t lastRequestTime;
 		int vMajor,vMinor,vRev,vProto;
+		int64_t authHookExpires; // cached authHook decision and when it lapses
+		int authHookVerdict;
 		Dictionary<ZT_NETWORKCONFIG_METADATA_DICT_CAPACITY> lastRequestMetaData;
 		Identity identity;
 		inline bool online(const int64_t now) const { return ((now - lastRequestTime) < (ZT_NETWORK_AUTOCONF_DELAY * 2)); }
@@ -150,7 +205,22 @@ private:
 	std::unordered_map< _MemberStatusKey,_MemberStatus,_MemberStatusHash > _memberStatus;
 	std::mutex _memberStatus_l;
 
+	nlohmann::json _statsCache;
+	int64_t _statsComputedAt;
+	std::mutex _stats_l;
+
 	RedisConfig *_rc;
+
+	Webhooks _webhooks;
+	AuditLog _audit;
+	ControllerStats _counters;
+
+	// Quotas from local.conf, 0 for none
+	uint64_t _maxNetworks;
+	uint64_t _maxMembersPerNetwork;
+
+	std::thread _authExpiryThread;
+	std::atomic_bool _running;
 };
 
 } // namespace ZeroTier
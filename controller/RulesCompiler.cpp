@@ -0,0 +1,625 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include <map>
+#include <set>
+#include <algorithm>
+
+#include "RulesCompiler.hpp"
+
+#include "../node/Constants.hpp"
+#include "../node/Utils.hpp"
+#include "../node/Address.hpp"
+#include "../node/MAC.hpp"
+#include "../node/InetAddress.hpp"
+#include "../osdep/OSUtils.hpp"
+
+namespace ZeroTier {
+
+// A word of a rules script and where it starts, line 0 for words given without a script
+struct _RulesToken
+{
+	std::string s;
+	unsigned int line;
+	unsigned int column;
+};
+
+// A tag's ID and the values its enum and flag names stand for
+struct _RulesTag
+{
+	uint64_t id;
+	std::map<std::string,uint64_t> values;
+};
+
+typedef std::map<std::string,_RulesTag> _RulesTags;
+
+// Shorthand names, the same as rule-compiler/rule-compiler.js
+static const struct { const char *name; uint64_t value; } _ETHERTYPES[] = {
+	{ "ipv4",0x0800 },{ "arp",0x0806 },{ "wol",0x0842 },{ "rarp",0x8035 },{ "ipv6",0x86dd },
+	{ "atalk",0x809b },{ "aarp",0x80f3 },{ "ipx_a",0x8137 },{ "ipx_b",0x8138 },{ (const char *)0,0 }
+};
+static const struct { const char *name; uint64_t value; } _IP_PROTOCOLS[] = {
+	{ "icmp",0x01 },{ "icmp4",0x01 },{ "icmpv4",0x01 },{ "igmp",0x02 },{ "ipip",0x04 },{ "tcp",0x06 },
+	{ "egp",0x08 },{ "igp",0x09 },{ "udp",0x11 },{ "rdp",0x1b },{ "esp",0x32 },{ "ah",0x33 },
+	{ "icmp6",0x3a },{ "icmpv6",0x3a },{ "l2tp",0x73 },{ "sctp",0x84 },{ "udplite",0x88 },{ (const char *)0,0 }
+};
+static const struct { const char *name; unsigned int bit; } _CHARACTERISTICS[] = {
+	{ "inbound",63 },{ "multicast",62 },{ "broadcast",61 },{ "ipauth",60 },{ "macauth",59 },
+	{ "tcp_fin",0 },{ "tcp_syn",1 },{ "tcp_rst",2 },{ "tcp_psh",3 },{ "tcp_ack",4 },{ "tcp_urg",5 },
+	{ "tcp_ece",6 },{ "tcp_cwr",7 },{ "tcp_ns",8 },{ "tcp_rs2",9 },{ "tcp_rs1",10 },{ "tcp_rs0",11 },
+	{ (const char *)0,0 }
+};
+
+// Matches and how many values each takes, and the API type each becomes
+static const struct { const char *name; unsigned int values; const char *type; } _MATCHES[] = {
+	{ "ztsrc",1,"MATCH_SOURCE_ZEROTIER_ADDRESS" },{ "ztdest",1,"MATCH_DEST_ZEROTIER_ADDRESS" },
+	{ "vlan",1,"MATCH_VLAN_ID" },{ "vlanpcp",1,"MATCH_VLAN_PCP" },{ "vlandei",1,"MATCH_VLAN_DEI" },
+	{ "ethertype",1,"MATCH_ETHERTYPE" },{ "macsrc",1,"MATCH_MAC_SOURCE" },{ "macdest",1,"MATCH_MAC_DEST" },
+	{ "ipsrc",1,(const char *)0 },{ "ipdest",1,(const char *)0 },{ "iptos",2,"MATCH_IP_TOS" },
+	{ "ipprotocol",1,"MATCH_IP_PROTOCOL" },{ "icmp",2,"MATCH_ICMP" },{ "sport",1,"MATCH_IP_SOURCE_PORT_RANGE" },
+	{ "dport",1,"MATCH_IP_DEST_PORT_RANGE" },{ "chr",1,"MATCH_CHARACTERISTICS" },{ "framesize",1,"MATCH_FRAME_SIZE_RANGE" },
+	{ "random",1,"MATCH_RANDOM" },{ "tand",2,"MATCH_TAGS_BITWISE_AND" },{ "tor",2,"MATCH_TAGS_BITWISE_OR" },
+	{ "txor",2,"MATCH_TAGS_BITWISE_XOR" },{ "tdiff",2,"MATCH_TAGS_DIFFERENCE" },{ "teq",2,"MATCH_TAGS_EQUAL" },
+	{ "tseq",2,"MATCH_TAG_SENDER" },{ "treq",2,"MATCH_TAG_RECEIVER" },{ (const char *)0,0,(const char *)0 }
+};
+
+static std::string _lower(const std::string &s)
+{
+	std::string l(s);
+	std::transform(l.begin(),l.end(),l.begin(),::tolower);
+	return l;
+}
+
+static bool _fail(const _RulesToken &at,const std::string &problem,std::string &err)
+{
+	if (at.line > 0) {
+		char tmp[64];
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"line %u, column %u: ",at.line,at.column);
+		err = tmp + problem;
+	} else err = problem;
+	return false;
+}
+
+// A decimal or 0x hex number no larger than max
+static bool _number(const std::string &s,const uint64_t max,uint64_t &v)
+{
+	const bool hex = ((s.length() > 2)&&(s[0] == '0')&&((s[1] == 'x')||(s[1] == 'X')));
+	const std::string digits((hex) ? s.substr(2) : s);
+	if ((digits.empty())||(digits.length() > ((hex) ? 16 : 20))||(digits.find_first_not_of((hex) ? "0123456789abcdefABCDEF" : "0123456789") != std::string::npos))
+		return false;
+	v = strtoull(digits.c_str(),(char **)0,(hex) ? 16 : 10);
+	return (v <= max);
+}
+
+// A number or a range of them such as 8000-8100, no larger than max
+static bool _range(const std::string &s,const uint64_t max,uint64_t &start,uint64_t &end)
+{
+	const std::size_t dash = s.find('-');
+	if (!_number(s.substr(0,dash),max,start))
+		return false;
+	if (dash == std::string::npos) {
+		end = start;
+		return true;
+	}
+	return ((_number(s.substr(dash + 1),max,end))&&(end >= start));
+}
+
+static bool _ztAddress(const std::string &s)
+{
+	return ((s.length() == ZT_ADDRESS_LENGTH_HEX)&&(s.find_first_not_of("0123456789abcdefABCDEF") == std::string::npos));
+}
+
+static bool _isAction(const std::string &w)
+{
+	return ((w == "accept")||(w == "drop")||(w == "break")||(w == "tee")||(w == "watch")||(w == "redirect"));
+}
+
+static long _match(const std::string &w)
+{
+	for(long i=0;_MATCHES[i].name;++i) {
+		if (w == _MATCHES[i].name)
+			return i;
+	}
+	return -1;
+}
+
+// Tag, capability, enum and flag names follow the controller's rules for names and may not be keywords
+static bool _validName(const std::string &name)
+{
+	if ((name.empty())||(name.length() > 64)||((name[0] >= '0')&&(name[0] <= '9')))
+		return false;
+	if (name.find_first_not_of("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != std::string::npos)
+		return false;
+	const std::string l(_lower(name));
+	return ((!_isAction(l))&&(_match(l) < 0)&&(l != "tag")&&(l != "cap")&&(l != "macro")&&(l != "include")&&(l != "default")&&(l != "and")&&(l != "or")&&(l != "not"));
+}
+
+static bool _endOfRule(const std::vector<_RulesToken> &t,const unsigned long i)
+{
+	return ((i >= t.size())||(t[i].s == ";"));
+}
+
+/**
+ * Compile the rule starting at t[i], leaving i just past its ;
+ */
+static bool _rule(const std::vector<_RulesToken> &t,unsigned long &i,const _RulesTags &tags,const uint64_t nwid,nlohmann::json &entries,std::string &err)
+{
+	char tmp[128];
+	const _RulesToken &at = t[i];
+	const std::string a(_lower(at.s));
+	nlohmann::json action;
+	++i;
+	if ((a == "accept")||(a == "drop")||(a == "break")) {
+		action["type"] = (a == "accept") ? "ACTION_ACCEPT" : ((a == "drop") ? "ACTION_DROP" : "ACTION_BREAK");
+	} else if ((a == "tee")||(a == "watch")||(a == "redirect")) {
+		uint64_t length = 0;
+		if (a != "redirect") {
+			if (_endOfRule(t,i))
+				return _fail(at,a + " needs a length of 0 to 65535 and a 10-digit ZeroTier address",err);
+			if (!_number(t[i].s,0xffff,length))
+				return _fail(t[i],"invalid length " + t[i].s + ": expected 0 to 65535",err);
+			++i;
+		}
+		if (_endOfRule(t,i))
+			return _fail(at,a + " needs a 10-digit ZeroTier address",err);
+		if (!_ztAddress(t[i].s))
+			return _fail(t[i],"invalid address " + t[i].s + ": expected a 10-digit ZeroTier address",err);
+		action["type"] = (a == "tee") ? "ACTION_TEE" : ((a == "watch") ? "ACTION_WATCH" : "ACTION_REDIRECT");
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)Utils::hexStrToU64(t[i].s.c_str()));
+		action["address"] = tmp;
+		action["flags"] = 0;
+		if (a != "redirect")
+			action["length"] = length;
+		++i;
+	} else {
+		return _fail(at,"unknown action " + at.s + ": expected accept, drop, break, tee, watch, or redirect",err);
+	}
+
+	while (!_endOfRule(t,i)) {
+		bool orMatch = false,notMatch = false;
+		if (_lower(t[i].s) == "and") {
+			++i;
+		} else if (_lower(t[i].s) == "or") {
+			orMatch = true;
+			++i;
+		}
+		if ((!_endOfRule(t,i))&&(_lower(t[i].s) == "not")) {
+			notMatch = true;
+			++i;
+		}
+		if (_endOfRule(t,i))
+			return _fail(t[i - 1],"missing match after " + t[i - 1].s,err);
+
+		const _RulesToken &mt = t[i];
+		const std::string k(_lower(mt.s));
+		const long mi = _match(k);
+		if (mi < 0)
+			return _fail(mt,"unknown match " + mt.s,err);
+		++i;
+		const _RulesToken *v[2] = { (const _RulesToken *)0,(const _RulesToken *)0 };
+		for(unsigned int n=0;n<_MATCHES[mi].values;++n) {
+			if (_endOfRule(t,i))
+				return _fail(mt,std::string("missing value for ") + _MATCHES[mi].name,err);
+			v[n] = &(t[i++]);
+		}
+		const std::string &v0 = v[0]->s;
+
+		nlohmann::json m;
+		m["type"] = (_MATCHES[mi].type) ? _MATCHES[mi].type : "";
+		m["not"] = notMatch;
+		m["or"] = orMatch;
+		uint64_t n = 0,n2 = 0;
+		if ((k == "ztsrc")||(k == "ztdest")) {
+			if (!_ztAddress(v0))
+				return _fail(*v[0],k + " needs a 10-digit ZeroTier address",err);
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)Utils::hexStrToU64(v0.c_str()));
+			m["zt"] = tmp;
+		} else if ((k == "vlan")||(k == "vlanpcp")||(k == "vlandei")) {
+			if (!_number(v0,(k == "vlan") ? 4095 : ((k == "vlanpcp") ? 7 : 1),n))
+				return _fail(*v[0],"invalid " + k + " " + v0,err);
+			m[(k == "vlan") ? "vlanId" : ((k == "vlanpcp") ? "vlanPcp" : "vlanDei")] = n;
+		} else if (k == "ethertype") {
+			bool found = false;
+			for(unsigned int e=0;_ETHERTYPES[e].name;++e) {
+				if (_lower(v0) == _ETHERTYPES[e].name) {
+					n = _ETHERTYPES[e].value;
+					found = true;
+				}
+			}
+			if ((!found)&&(!_number(v0,0xffff,n)))
+				return _fail(*v[0],"ethertype needs ipv4, arp, ipv6, another known name, or a number such as 0x86dd",err);
+			m["etherType"] = n;
+		} else if ((k == "macsrc")||(k == "macdest")) {
+			if (_ztAddress(v0)) {
+				m["mac"] = MAC(Address(Utils::hexStrToU64(v0.c_str())),nwid).toString(tmp);
+			} else {
+				uint64_t mac = 0;
+				unsigned int digits = 0;
+				for(std::string::const_iterator c(v0.begin());c!=v0.end();++c) {
+					const char l = (char)tolower(*c);
+					if ((l >= '0')&&(l <= '9'))
+						mac = (mac << 4) | (uint64_t)(l - '0');
+					else if ((l >= 'a')&&(l <= 'f'))
+						mac = (mac << 4) | (uint64_t)(l - 'a' + 10);
+					else if ((l != ':')&&(l != '-'))
+						digits = 99;
+					else continue;
+					++digits;
+				}
+				if (digits != 12)
+					return _fail(*v[0],k + " needs a MAC or 10-digit ZeroTier address",err);
+				m["mac"] = MAC(mac).toString(tmp);
+			}
+		} else if ((k == "ipsrc")||(k == "ipdest")) {
+			InetAddress ip(v0.c_str());
+			if ((ip.ss_family != AF_INET)&&(ip.ss_family != AF_INET6))
+				return _fail(*v[0],k + " needs an IP address or CIDR",err);
+			const bool v4 = (ip.ss_family == AF_INET);
+			if (v0.find('/') == std::string::npos)
+				ip.setPort((v4) ? 32 : 128);
+			else if (ip.netmaskBits() > ((v4) ? 32U : 128U))
+				return _fail(*v[0],k + " needs an IP address or CIDR",err);
+			m["type"] = (k == "ipsrc") ? ((v4) ? "MATCH_IPV4_SOURCE" : "MATCH_IPV6_SOURCE") : ((v4) ? "MATCH_IPV4_DEST" : "MATCH_IPV6_DEST");
+			m["ip"] = ip.toString(tmp);
+		} else if (k == "iptos") {
+			uint64_t mask = 0;
+			if (!_number(v0,0xff,mask))
+				return _fail(*v[0],"iptos needs a mask from 0 to 255",err);
+			if (!_range(v[1]->s,0xff,n,n2))
+				return _fail(*v[1],"iptos needs a value or range from 0 to 255 after its mask",err);
+			m["mask"] = mask;
+			m["start"] = n;
+			m["end"] = n2;
+		} else if (k == "ipprotocol") {
+			bool found = false;
+			for(unsigned int p=0;_IP_PROTOCOLS[p].name;++p) {
+				if (_lower(v0) == _IP_PROTOCOLS[p].name) {
+					n = _IP_PROTOCOLS[p].value;
+					found = true;
+				}
+			}
+			if ((!found)&&(!_number(v0,0xff,n)))
+				return _fail(*v[0],"ipprotocol needs tcp, udp, icmp, another known name, or a number from 0 to 255",err);
+			m["ipProtocol"] = n;
+		} else if (k == "icmp") {
+			if (!_number(v0,0xff,n))
+				return _fail(*v[0],"icmp needs a type from 0 to 255",err);
+			const std::string code(_lower(v[1]->s));
+			const bool anyCode = ((code == "-1")||(code == "any"));
+			if ((!anyCode)&&(!_number(code,0xff,n2)))
+				return _fail(*v[1],"icmp needs a code from 0 to 255, or any, after its type",err);
+			m["icmpType"] = n;
+			m["icmpCode"] = (anyCode) ? nlohmann::json() : nlohmann::json(n2);
+		} else if ((k == "sport")||(k == "dport")||(k == "framesize")) {
+			if (!_range(v0,0xffff,n,n2))
+				return _fail(*v[0],k + " needs a number or range from 0 to 65535, e.g. 80 or 8000-8100",err);
+			m["start"] = n;
+			m["end"] = n2;
+		} else if (k == "chr") {
+			uint64_t mask = 0;
+			std::vector<std::string> bits(OSUtils::split(v0.c_str(),",","",""));
+			for(std::vector<std::string>::const_iterator b(bits.begin());b!=bits.end();++b) {
+				bool found = false;
+				for(unsigned int c=0;_CHARACTERISTICS[c].name;++c) {
+					if (_lower(*b) == _CHARACTERISTICS[c].name) {
+						n = _CHARACTERISTICS[c].bit;
+						found = true;
+					}
+				}
+				if ((!found)&&(!_number(*b,63,n)))
+					return _fail(*v[0],"unknown characteristic " + *b + ": expected a name such as tcp_syn or a bit from 0 to 63",err);
+				mask |= (1ULL << n);
+			}
+			if (bits.empty())
+				return _fail(*v[0],"chr needs a comma separated list of characteristics",err);
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)mask);
+			m["mask"] = tmp;
+		} else if (k == "random") {
+			char *end = (char *)0;
+			const double p = strtod(v0.c_str(),&end);
+			if ((v0.empty())||(!end)||(*end)||(!(p >= 0.0))||(p > 1.0))
+				return _fail(*v[0],"random needs a probability from 0 to 1",err);
+			m["probability"] = (uint64_t)(4294967295.0 * p);
+		} else {
+			// The tag matches: a tag name or ID, then a value or the name of one of the tag's enums or flags
+			_RulesTags::const_iterator tag(tags.find(v0));
+			if (tag != tags.end())
+				n = tag->second.id;
+			else if (!_number(v0,0xffffffffULL,n))
+				return _fail(*v[0],"unknown tag " + v0 + ": expected a tag name or ID",err);
+			std::map<std::string,uint64_t>::const_iterator named;
+			if ((tag != tags.end())&&((named = tag->second.values.find(_lower(v[1]->s))) != tag->second.values.end()))
+				n2 = named->second;
+			else if (!_number(v[1]->s,0xffffffffULL,n2))
+				return _fail(*v[1],"invalid value " + v[1]->s + " for tag " + v0 + ": expected a number or one of the tag's enum or flag names",err);
+			m["id"] = n;
+			m["value"] = n2;
+		}
+		entries.push_back(m);
+	}
+	if (i < t.size())
+		++i; // the ;
+
+	entries.push_back(action);
+	return true;
+}
+
+bool RulesCompiler::compileRule(const std::vector<std::string> &words,const nlohmann::json &networkTags,uint64_t nwid,nlohmann::json &entries,std::string &err)
+{
+	entries = nlohmann::json::array();
+	std::vector<_RulesToken> t;
+	for(std::vector<std::string>::const_iterator w(words.begin());w!=words.end();++w) {
+		std::size_t start = 0;
+		while (start <= w->length()) {
+			const std::size_t end = w->find(';',start);
+			_RulesToken tok;
+			tok.line = 0;
+			tok.column = 0;
+			tok.s = w->substr(start,(end == std::string::npos) ? std::string::npos : (end - start));
+			if (tok.s.length() > 0)
+				t.push_back(tok);
+			if (end == std::string::npos)
+				break;
+			tok.s = ";";
+			t.push_back(tok);
+			start = end + 1;
+		}
+	}
+	while ((!t.empty())&&(t.back().s == ";"))
+		t.pop_back();
+	if (t.empty()) {
+		err = "empty rule";
+		return false;
+	}
+	for(unsigned long i=0;i<t.size();++i) {
+		if (t[i].s == ";") {
+			err = "only one rule may be given";
+			return false;
+		}
+	}
+
+	_RulesTags tags;
+	for(unsigned long i=0;((networkTags.is_array())&&(i<networkTags.size()));++i) {
+		const std::string name(OSUtils::jsonString(networkTags[i]["name"],""));
+		if (name.length() > 0)
+			tags[name].id = OSUtils::jsonInt(networkTags[i]["id"],0ULL);
+	}
+	unsigned long i = 0;
+	return _rule(t,i,tags,nwid,entries,err);
+}
+
+bool RulesCompiler::compile(const std::string &script,const nlohmann::json &networkTags,uint64_t nwid,nlohmann::json &config,std::string &err)
+{
+	// Split into words, with ; always a word of its own and # starting a comment
+	std::vector<_RulesToken> t;
+	unsigned int line = 1,column = 0;
+	bool inWord = false,comment = false;
+	for(std::string::const_iterator c(script.begin());c!=script.end();++c) {
+		++column;
+		if (*c == '\n') {
+			++line;
+			column = 0;
+			inWord = false;
+			comment = false;
+		} else if (comment) {
+			continue;
+		} else if ((*c == ' ')||(*c == '\t')||(*c == '\r')) {
+			inWord = false;
+		} else if ((*c == '#')&&(!inWord)) {
+			comment = true;
+		} else if (*c == ';') {
+			_RulesToken end;
+			end.s = ";";
+			end.line = line;
+			end.column = column;
+			t.push_back(end);
+			inWord = false;
+		} else {
+			if (!inWord) {
+				_RulesToken w;
+				w.line = line;
+				w.column = column;
+				t.push_back(w);
+				inWord = true;
+			}
+			t.back().s.push_back(*c);
+		}
+	}
+
+	// First the definitions, so rules may use tags defined anywhere in the script
+	struct Cap
+	{
+		std::string name;
+		uint64_t id;
+		bool dfl;
+		std::vector<unsigned long> rules;
+	};
+	std::vector<Cap> caps;
+	std::vector<unsigned long> rules;
+	_RulesTags tags;
+	for(unsigned long i=0;((networkTags.is_array())&&(i<networkTags.size()));++i) {
+		const std::string name(OSUtils::jsonString(networkTags[i]["name"],""));
+		if (name.length() > 0)
+			tags[name].id = OSUtils::jsonInt(networkTags[i]["id"],0ULL);
+	}
+	nlohmann::json tagDefs = nlohmann::json::array();
+	std::set<std::string> scriptTags;
+	std::set<uint64_t> tagIds,capIds;
+	unsigned long i = 0;
+	while (i < t.size()) {
+		const _RulesToken &at = t[i];
+		const std::string k(_lower(at.s));
+		if (k == ";") {
+			++i;
+		} else if ((k == "macro")||(k == "include")) {
+			return _fail(at,"macros are not supported here, expand them with rule-compiler/cli.js and use controller rules apply",err);
+		} else if ((k == "tag")||(k == "cap")) {
+			const char *const what = (k == "tag") ? "tag" : "capability";
+			++i;
+			if (_endOfRule(t,i))
+				return _fail(at,std::string(what) + " definition is missing a name",err);
+			const _RulesToken &nt = t[i++];
+			if (!_validName(nt.s))
+				return _fail(nt,"invalid " + std::string(what) + " name " + nt.s + ": use letters, digits, and underscores, not starting with a digit or being a keyword",err);
+
+			bool hasId = false,hasDefault = false;
+			uint64_t id = 0;
+			_RulesTag tag;
+			std::string dfl;
+			const _RulesToken *dflAt = (const _RulesToken *)0;
+			Cap cap;
+			cap.dfl = false;
+			while ((i < t.size())&&(t[i].s != ";")) {
+				const _RulesToken &dt = t[i];
+				const std::string d(_lower(dt.s));
+				if (d == "id") {
+					if (hasId)
+						return _fail(dt,std::string("duplicate id in ") + what + " definition",err);
+					if ((++i >= t.size())||(!_number(t[i].s,0xffffffffULL,id)))
+						return _fail((i < t.size()) ? t[i] : dt,std::string(what) + " id needs a number from 0 to 4294967295",err);
+					hasId = true;
+					++i;
+				} else if ((d == "default")&&(k == "cap")) {
+					cap.dfl = true;
+					++i;
+				} else if (d == "default") {
+					if (hasDefault)
+						return _fail(dt,"duplicate default in tag definition",err);
+					if (++i >= t.size())
+						return _fail(dt,"missing value for default",err);
+					dfl = t[i].s;
+					dflAt = &(t[i++]);
+					hasDefault = true;
+				} else if (((d == "enum")||(d == "flag"))&&(k == "tag")) {
+					if ((i + 2) >= t.size())
+						return _fail(dt,"missing " + d + " value or name",err);
+					uint64_t value = 0;
+					if (d == "enum") {
+						if (!_number(t[i + 1].s,0xffffffffULL,value))
+							return _fail(t[i + 1],"invalid enum value " + t[i + 1].s + ": expected a number from 0 to 4294967295",err);
+					} else {
+						// Bit indexes or names of other flags, comma separated
+						std::vector<std::string> bits(OSUtils::split(t[i + 1].s.c_str(),",","",""));
+						for(std::vector<std::string>::const_iterator b(bits.begin());b!=bits.end();++b) {
+							uint64_t bit = 0;
+							std::map<std::string,uint64_t>::const_iterator f(tag.values.find(_lower(*b)));
+							if (f != tag.values.end())
+								value |= f->second;
+							else if (_number(*b,31,bit))
+								value |= (1ULL << bit);
+							else return _fail(t[i + 1],"invalid flag bit " + *b + ": expected a bit from 0 to 31 or a flag name",err);
+						}
+					}
+					const std::string name(_lower(t[i + 2].s));
+					if (!_validName(name))
+						return _fail(t[i + 2],"invalid " + d + " name " + t[i + 2].s,err);
+					if (!tag.values.insert(std::pair<std::string,uint64_t>(name,value)).second)
+						return _fail(t[i + 2],"duplicate name " + t[i + 2].s + " in tag definition",err);
+					i += 3;
+				} else if ((k == "cap")&&(_isAction(d))) {
+					cap.rules.push_back(i);
+					while ((i < t.size())&&(t[i].s != ";"))
+						++i;
+					if (i >= t.size())
+						return _fail(dt,"rule is not ended with ;",err);
+					++i;
+				} else {
+					return _fail(dt,"unexpected " + dt.s + (std::string((k == "tag") ? " in tag definition: expected id, default, enum, or flag" : " in capability definition: expected id, default, or a rule")),err);
+				}
+			}
+			if (i >= t.size())
+				return _fail(at,std::string(what) + " definition of " + nt.s + " is not ended with ;",err);
+			++i;
+			if (!hasId)
+				return _fail(at,std::string(what) + " definition of " + nt.s + " is missing an id",err);
+
+			if (k == "tag") {
+				if (!scriptTags.insert(nt.s).second)
+					return _fail(nt,"tag " + nt.s + " is defined more than once",err);
+				if (!tagIds.insert(id).second)
+					return _fail(at,"tag id " + std::to_string((unsigned long long)id) + " is used by more than one tag",err);
+				tag.id = id;
+				nlohmann::json td;
+				td["id"] = id;
+				td["default"] = nlohmann::json();
+				if (hasDefault) {
+					uint64_t dv = 0;
+					std::map<std::string,uint64_t>::const_iterator named(tag.values.find(_lower(dfl)));
+					if (named != tag.values.end())
+						dv = named->second;
+					else if (!_number(dfl,0xffffffffULL,dv))
+						return _fail(*dflAt,"invalid default " + dfl + ": expected a number or one of the tag's enum or flag names",err);
+					td["default"] = dv;
+				}
+				td["name"] = nt.s;
+				tagDefs.push_back(td);
+				tags[nt.s] = tag;
+			} else {
+				for(std::vector<Cap>::const_iterator c(caps.begin());c!=caps.end();++c) {
+					if (c->name == nt.s)
+						return _fail(nt,"capability " + nt.s + " is defined more than once",err);
+				}
+				if (!capIds.insert(id).second)
+					return _fail(at,"capability id " + std::to_string((unsigned long long)id) + " is used by more than one capability",err);
+				cap.name = nt.s;
+				cap.id = id;
+				caps.push_back(cap);
+			}
+		} else if (_isAction(k)) {
+			rules.push_back(i);
+			while ((i < t.size())&&(t[i].s != ";"))
+				++i;
+			++i; // a last rule may leave out its ;
+		} else {
+			return _fail(at,"unexpected " + at.s + ": expected a rule starting with an action, or a tag or cap definition",err);
+		}
+	}
+
+	// Then the rules
+	config = nlohmann::json::object();
+	nlohmann::json &capDefs = config["capabilities"];
+	capDefs = nlohmann::json::array();
+	for(std::vector<Cap>::const_iterator c(caps.begin());c!=caps.end();++c) {
+		nlohmann::json cd;
+		cd["id"] = c->id;
+		cd["default"] = c->dfl;
+		cd["name"] = c->name;
+		nlohmann::json &cr = cd["rules"];
+		cr = nlohmann::json::array();
+		for(std::vector<unsigned long>::const_iterator r(c->rules.begin());r!=c->rules.end();++r) {
+			unsigned long ri = *r;
+			nlohmann::json entries = nlohmann::json::array();
+			if (!_rule(t,ri,tags,nwid,entries,err))
+				return false;
+			cr.insert(cr.end(),entries.begin(),entries.end());
+		}
+		capDefs.push_back(cd);
+	}
+	nlohmann::json &ruleEntries = config["rules"];
+	ruleEntries = nlohmann::json::array();
+	for(std::vector<unsigned long>::const_iterator r(rules.begin());r!=rules.end();++r) {
+		unsigned long ri = *r;
+		nlohmann::json entries = nlohmann::json::array();
+		if (!_rule(t,ri,tags,nwid,entries,err))
+			return false;
+		ruleEntries.insert(ruleEntries.end(),entries.begin(),entries.end());
+	}
+	config["tags"] = tagDefs;
+	return true;
+}
+
+} // namespace ZeroTier
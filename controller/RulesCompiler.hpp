@@ -0,0 +1,67 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#ifndef ZT_CONTROLLER_RULESCOMPILER_HPP
+#define ZT_CONTROLLER_RULESCOMPILER_HPP
+
+#include <stdint.h>
+
+#include <string>
+#include <vector>
+
+#include "../ext/json/json.hpp"
+
+namespace ZeroTier {
+
+/**
+ * Compiles rules scripts into the controller's JSON flow rules
+ *
+ * The language is the one read by rule-compiler/rule-compiler.js, apart from
+ * macros: tag and cap definitions and rules, each ended by a semicolon. A
+ * rule is an action (accept, drop, break, tee <length> <address>, watch
+ * <length> <address>, or redirect <address>) followed by any number of
+ * [and|or] [not] <match> <value>. Tags may be referred to by the names given
+ * to them in the script or already defined on the network, and tag values by
+ * the names of the tag's enums and flags.
+ */
+class RulesCompiler
+{
+public:
+	/**
+	 * Compile a whole rules script
+	 *
+	 * @param script Rules script
+	 * @param networkTags Tag definitions the network already has, for their names
+	 * @param nwid Network ID, to turn ZeroTier addresses given as MACs into the network's MACs
+	 * @param config Set to an object with rules, capabilities, and tags arrays for the network
+	 * @param err Set to "line <n>, column <n>: <problem>" on failure
+	 * @return True if the script compiled
+	 */
+	static bool compile(const std::string &script,const nlohmann::json &networkTags,uint64_t nwid,nlohmann::json &config,std::string &err);
+
+	/**
+	 * Compile one rule given as the words of a rules script, with or without a trailing ;
+	 *
+	 * @param words Rule, e.g. drop not ethertype ipv4
+	 * @param networkTags Tag definitions the network already has, for their names
+	 * @param nwid Network ID, to turn ZeroTier addresses given as MACs into the network's MACs
+	 * @param entries Set to the rule's match entries followed by its action
+	 * @param err Set to the problem on failure
+	 * @return True if the rule compiled
+	 */
+	static bool compileRule(const std::vector<std::string> &words,const nlohmann::json &networkTags,uint64_t nwid,nlohmann::json &entries,std::string &err);
+};
+
+} // namespace ZeroTier
+
+#endif
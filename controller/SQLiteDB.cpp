@@ -0,0 +1,248 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#include "SQLiteDB.hpp"
+
+#ifdef ZT_CONTROLLER_USE_SQLITE
+
+#include <sqlite3.h>
+
+namespace ZeroTier
+{
+
+SQLiteDB::SQLiteDB(const char *path) :
+	DB(),
+	_path(path),
+	_dbPath(_path + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_SQLITEDB_FILENAME),
+	_db((sqlite3 *)0)
+{
+	OSUtils::mkdir(_path.c_str());
+	OSUtils::lockDownFile(_path.c_str(),true);
+
+	if (sqlite3_open_v2(_dbPath.c_str(),&_db,SQLITE_OPEN_READWRITE|SQLITE_OPEN_CREATE|SQLITE_OPEN_FULLMUTEX,(const char *)0) != SQLITE_OK) {
+		_fail("open");
+		return;
+	}
+	sqlite3_busy_timeout(_db,10000);
+	char *err = (char *)0;
+	if (sqlite3_exec(_db,
+		"PRAGMA journal_mode=WAL;"
+		"PRAGMA synchronous=NORMAL;"
+		"CREATE TABLE IF NOT EXISTS network (id TEXT PRIMARY KEY NOT NULL,config TEXT NOT NULL);"
+		"CREATE TABLE IF NOT EXISTS member (nwid TEXT NOT NULL,id TEXT NOT NULL,config TEXT NOT NULL,PRIMARY KEY (nwid,id));",
+		(int (*)(void *,int,char **,char **))0,(void *)0,&err) != SQLITE_OK) {
+		sqlite3_free(err);
+		_fail("initialize");
+		return;
+	}
+	OSUtils::lockDownFile(_dbPath.c_str(),false);
+
+	// Networks are loaded before members so each member finds its network
+	static const char *const loadSql[2] = { "SELECT config FROM network","SELECT config FROM member" };
+	for(int i=0;i<2;++i) {
+		sqlite3_stmt *s = (sqlite3_stmt *)0;
+		if (sqlite3_prepare_v2(_db,loadSql[i],-1,&s,(const char **)0) != SQLITE_OK) {
+			_fail("read");
+			return;
+		}
+		while (sqlite3_step(s) == SQLITE_ROW) {
+			const char *const config = reinterpret_cast<const char *>(sqlite3_column_text(s,0));
+			if (!config)
+				continue;
+			try {
+				nlohmann::json record(OSUtils::jsonParse(std::string(config)));
+				nlohmann::json nullJson;
+				if (i == 0) {
+					if (OSUtils::jsonString(record["id"],"").length() == 16)
+						_networkChanged(nullJson,record,false);
+				} else {
+					if (OSUtils::jsonString(record["id"],"").length() == 10)
+						_memberChanged(nullJson,record,false);
+				}
+			} catch ( ... ) {}
+		}
+		sqlite3_finalize(s);
+	}
+}
+
+SQLiteDB::~SQLiteDB()
+{
+	std::lock_guard<std::mutex> l(_db_l);
+	if (_db)
+		sqlite3_close(_db);
+}
+
+bool SQLiteDB::waitForReady() { return isReady(); }
+bool SQLiteDB::isReady() { return (_db != (sqlite3 *)0); }
+
+bool SQLiteDB::save(nlohmann::json &record,bool notifyListeners)
+{
+	bool modified = false;
+	if (!_db)
+		return false;
+	try {
+		const std::string objtype = record["objtype"];
+		if (objtype == "network") {
+
+			const uint64_t nwid = OSUtils::jsonIntHex(record["id"],0ULL);
+			if (nwid) {
+				nlohmann::json old;
+				get(nwid,old);
+				if ((!old.is_object())||(!_compareRecords(old,record))) {
+					record["revision"] = OSUtils::jsonInt(record["revision"],0ULL) + 1ULL;
+					{
+						std::lock_guard<std::mutex> l(_db_l);
+						modified = _write("INSERT OR REPLACE INTO network (id,config) VALUES (:nwid,:config)",nwid,0,OSUtils::jsonDump(record,-1));
+						if (!modified)
+							fprintf(stderr,"WARNING: controller unable to write network %.16llx to %s: %s" ZT_EOL_S,(unsigned long long)nwid,_dbPath.c_str(),sqlite3_errmsg(_db));
+					}
+					_networkChanged(old,record,notifyListeners);
+				}
+			}
+
+		} else if (objtype == "member") {
+
+			const uint64_t id = OSUtils::jsonIntHex(record["id"],0ULL);
+			const uint64_t nwid = OSUtils::jsonIntHex(record["nwid"],0ULL);
+			if ((id)&&(nwid)) {
+				nlohmann::json network,old;
+				get(nwid,network,id,old);
+				if ((!old.is_object())||(!_compareRecords(old,record))) {
+					record["revision"] = OSUtils::jsonInt(record["revision"],0ULL) + 1ULL;
+					{
+						std::lock_guard<std::mutex> l(_db_l);
+						modified = _write("INSERT OR REPLACE INTO member (nwid,id,config) VALUES (:nwid,:id,:config)",nwid,id,OSUtils::jsonDump(record,-1));
+						if (!modified)
+							fprintf(stderr,"WARNING: controller unable to write member %.10llx of %.16llx to %s: %s" ZT_EOL_S,(unsigned long long)id,(unsigned long long)nwid,_dbPath.c_str(),sqlite3_errmsg(_db));
+					}
+					_memberChanged(old,record,notifyListeners);
+				}
+			}
+
+		}
+	} catch ( ... ) {} // drop invalid records missing fields
+	return modified;
+}
+
+bool SQLiteDB::write(const nlohmann::json &record)
+{
+	if (!_db)
+		return false;
+	try {
+		nlohmann::json r(record),old;
+		const std::string objtype = OSUtils::jsonString(r["objtype"],"");
+		const uint64_t nwid = OSUtils::jsonIntHex((objtype == "network") ? r["id"] : r["nwid"],0ULL);
+		if (!nwid)
+			return false;
+		if (objtype == "network") {
+			{
+				std::lock_guard<std::mutex> l(_db_l);
+				if (!_write("INSERT OR REPLACE INTO network (id,config) VALUES (:nwid,:config)",nwid,0,OSUtils::jsonDump(r,-1)))
+					return false;
+			}
+			get(nwid,old);
+			_networkChanged(old,r,false);
+			return true;
+		} else if (objtype == "member") {
+			const uint64_t id = OSUtils::jsonIntHex(r["id"],0ULL);
+			if (!id)
+				return false;
+			{
+				std::lock_guard<std::mutex> l(_db_l);
+				if (!_write("INSERT OR REPLACE INTO member (nwid,id,config) VALUES (:nwid,:id,:config)",nwid,id,OSUtils::jsonDump(r,-1)))
+					return false;
+			}
+			nlohmann::json network;
+			get(nwid,network,id,old);
+			_memberChanged(old,r,false);
+			return true;
+		}
+	} catch ( ... ) {}
+	return false;
+}
+
+void SQLiteDB::eraseNetwork(const uint64_t networkId)
+{
+	if (!_db)
+		return;
+	nlohmann::json network,nullJson;
+	get(networkId,network);
+	{
+		// Delete the network and its members in one transaction so a crash can't leave orphans
+		std::lock_guard<std::mutex> l(_db_l);
+		sqlite3_exec(_db,"BEGIN",(int (*)(void *,int,char **,char **))0,(void *)0,(char **)0);
+		const bool ok = ((_write("DELETE FROM member WHERE nwid = :nwid",networkId,0,std::string()))&&(_write("DELETE FROM network WHERE id = :nwid",networkId,0,std::string())));
+		if (!ok)
+			fprintf(stderr,"WARNING: controller unable to delete network %.16llx from %s: %s" ZT_EOL_S,(unsigned long long)networkId,_dbPath.c_str(),sqlite3_errmsg(_db));
+		sqlite3_exec(_db,(ok) ? "COMMIT" : "ROLLBACK",(int (*)(void *,int,char **,char **))0,(void *)0,(char **)0);
+	}
+	_networkChanged(network,nullJson,true);
+	std::lock_guard<std::mutex> l(this->_online_l);
+	this->_online.erase(networkId);
+}
+
+void SQLiteDB::eraseMember(const uint64_t networkId,const uint64_t memberId)
+{
+	if (!_db)
+		return;
+	nlohmann::json network,member,nullJson;
+	get(networkId,network,memberId,member);
+	{
+		std::lock_guard<std::mutex> l(_db_l);
+		if (!_write("DELETE FROM member WHERE nwid = :nwid AND id = :id",networkId,memberId,std::string()))
+			fprintf(stderr,"WARNING: controller unable to delete member %.10llx of %.16llx from %s: %s" ZT_EOL_S,(unsigned long long)memberId,(unsigned long long)networkId,_dbPath.c_str(),sqlite3_errmsg(_db));
+	}
+	_memberChanged(member,nullJson,true);
+	std::lock_guard<std::mutex> l(this->_online_l);
+	this->_online[networkId].erase(memberId);
+}
+
+void SQLiteDB::nodeIsOnline(const uint64_t networkId,const uint64_t memberId,const InetAddress &physicalAddress)
+{
+	std::lock_guard<std::mutex> l(this->_online_l);
+	this->_online[networkId][memberId][OSUtils::now()] = physicalAddress;
+}
+
+void SQLiteDB::_fail(const char *what)
+{
+	_error = std::string("unable to ") + what + " " + _dbPath + ": " + ((_db) ? sqlite3_errmsg(_db) : "out of memory");
+	if (_db) {
+		sqlite3_close(_db);
+		_db = (sqlite3 *)0;
+	}
+}
+
+bool SQLiteDB::_write(const char *sql,uint64_t nwid,uint64_t id,const std::string &json)
+{
+	char nwids[24],ids[24];
+	OSUtils::ztsnprintf(nwids,sizeof(nwids),"%.16llx",(unsigned long long)nwid);
+	OSUtils::ztsnprintf(ids,sizeof(ids),"%.10llx",(unsigned long long)id);
+
+	sqlite3_stmt *s = (sqlite3_stmt *)0;
+	if (sqlite3_prepare_v2(_db,sql,-1,&s,(const char **)0) != SQLITE_OK)
+		return false;
+	int p;
+	if ((p = sqlite3_bind_parameter_index(s,":nwid")) > 0)
+		sqlite3_bind_text(s,p,nwids,-1,SQLITE_TRANSIENT);
+	if ((p = sqlite3_bind_parameter_index(s,":id")) > 0)
+		sqlite3_bind_text(s,p,ids,-1,SQLITE_TRANSIENT);
+	if ((p = sqlite3_bind_parameter_index(s,":config")) > 0)
+		sqlite3_bind_text(s,p,json.data(),(int)json.length(),SQLITE_TRANSIENT);
+	const bool ok = (sqlite3_step(s) == SQLITE_DONE);
+	sqlite3_finalize(s);
+	return ok;
+}
+
+} // namespace ZeroTier
+
+#endif // ZT_CONTROLLER_USE_SQLITE
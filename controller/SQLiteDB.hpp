@@ -0,0 +1,88 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#include "DB.hpp"
+
+#ifdef ZT_CONTROLLER_USE_SQLITE
+
+#ifndef ZT_CONTROLLER_SQLITEDB_HPP
+#define ZT_CONTROLLER_SQLITEDB_HPP
+
+#define ZT_CONTROLLER_SQLITEDB_FILENAME "controller.sqlite"
+
+struct sqlite3;
+
+namespace ZeroTier
+{
+
+/**
+ * Controller DB stored in a single SQLite file under the controller path
+ *
+ * Records are kept as JSON exactly as FileDB writes them, one row per
+ * network or member, so the two can be migrated between losslessly.
+ */
+class SQLiteDB : public DB
+{
+public:
+	/**
+	 * Open or create the database under path and load its records
+	 *
+	 * If the database can't be opened or read, isReady() returns false,
+	 * error() says why, and nothing is read from or written to it.
+	 *
+	 * @param path Controller path
+	 */
+	SQLiteDB(const char *path);
+	virtual ~SQLiteDB();
+
+	virtual bool waitForReady();
+	virtual bool isReady();
+	virtual bool save(nlohmann::json &record,bool notifyListeners);
+	virtual void eraseNetwork(const uint64_t networkId);
+	virtual void eraseMember(const uint64_t networkId,const uint64_t memberId);
+	virtual void nodeIsOnline(const uint64_t networkId,const uint64_t memberId,const InetAddress &physicalAddress);
+
+	/**
+	 * Store a record as is, without bumping its revision or notifying listeners
+	 *
+	 * This is used to migrate records from another DB.
+	 *
+	 * @return True if record was a valid network or member and was written
+	 */
+	bool write(const nlohmann::json &record);
+
+	/**
+	 * @return Why the database could not be opened, or an empty string if it is ready
+	 */
+	inline const std::string &error() const { return _error; }
+
+protected:
+	void _fail(const char *what);
+
+	// Caller must hold _db_l
+	bool _write(const char *sql,uint64_t nwid,uint64_t id,const std::string &json);
+
+	std::string _path;
+	std::string _dbPath;
+	std::string _error;
+	sqlite3 *_db;
+	std::mutex _db_l;
+	std::map< uint64_t,std::map<uint64_t,std::map<int64_t,InetAddress> > > _online;
+	std::mutex _online_l;
+};
+
+} // namespace ZeroTier
+
+#endif // ZT_CONTROLLER_SQLITEDB_HPP
+
+#endif // ZT_CONTROLLER_USE_SQLITE
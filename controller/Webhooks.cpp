@@ -0,0 +1,397 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#include "Webhooks.hpp"
+
+#include <stdio.h>
+#include <string.h>
+
+#include <algorithm>
+#include <list>
+#include <vector>
+
+#ifdef __WINDOWS__
+#include <winsock2.h>
+#include <ws2tcpip.h>
+#else
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <netdb.h>
+#endif
+
+#include "../node/Constants.hpp"
+#include "../node/Utils.hpp"
+#include "../node/SHA512.hpp"
+#include "../node/InetAddress.hpp"
+#include "../osdep/OSUtils.hpp"
+#include "../osdep/Http.hpp"
+#include "../version.h"
+
+namespace ZeroTier {
+
+Webhooks::Webhooks(const std::string &ztPath) :
+	_deadLetterPath(ztPath + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_WEBHOOK_DEAD_LETTER_FILENAME),
+	_globalHooks(nlohmann::json::array())
+{
+	_thread = std::thread([this]() {
+		std::list<_Delivery *> pending;
+		for(;;) {
+			_Delivery *d = (_Delivery *)0;
+			const BlockingQueue<_Delivery *>::TimedWaitResult r = _queue.get(d,1000);
+			if (r == BlockingQueue<_Delivery *>::STOP)
+				break;
+			if ((r == BlockingQueue<_Delivery *>::OK)&&(d))
+				pending.push_back(d);
+
+			for(std::list<_Delivery *>::iterator i(pending.begin());i!=pending.end();) {
+				if ((*i)->nextAttempt <= OSUtils::now()) {
+					std::string err;
+					++(*i)->attempts;
+					if (_deliver(**i,err)) {
+						delete *i;
+						pending.erase(i++);
+						continue;
+					} else if ((*i)->attempts >= (*i)->maxAttempts) {
+						_deadLetter(**i,err);
+						delete *i;
+						pending.erase(i++);
+						continue;
+					}
+					// Back off by the retry delay, then 4 times that, 16 times that...
+					int64_t wait = (*i)->retryDelay;
+					for(unsigned int a=1;((a<(*i)->attempts)&&(wait<ZT_CONTROLLER_WEBHOOK_MAX_BACKOFF));++a)
+						wait *= 4;
+					(*i)->nextAttempt = OSUtils::now() + std::min(wait,(int64_t)ZT_CONTROLLER_WEBHOOK_MAX_BACKOFF);
+				}
+				++i;
+			}
+		}
+
+		// Deliveries that never got through are recorded rather than silently dropped
+		std::vector<_Delivery *> left(_queue.drain());
+		pending.insert(pending.end(),left.begin(),left.end());
+		for(std::list<_Delivery *>::iterator i(pending.begin());i!=pending.end();++i) {
+			_deadLetter(**i,"controller stopped before delivery");
+			delete *i;
+		}
+	});
+}
+
+Webhooks::~Webhooks()
+{
+	_queue.stop();
+	if (_thread.joinable())
+		_thread.join();
+}
+
+void Webhooks::setGlobalHooks(const nlohmann::json &hooks)
+{
+	nlohmann::json valid;
+	const std::string err(validate(hooks,valid));
+	if (!err.empty()) {
+		fprintf(stderr,"WARNING: ignoring controllerWebhooks in local.conf: %s" ZT_EOL_S,err.c_str());
+		return;
+	}
+	std::lock_guard<std::mutex> l(_lock);
+	_globalHooks = valid;
+}
+
+void Webhooks::event(const char *type,uint64_t networkId,const nlohmann::json &networkHooks,const char *objectKey,const nlohmann::json &object)
+{
+	char tmp[64];
+	uint64_t rid;
+	Utils::getSecureRandom(&rid,sizeof(rid));
+
+	nlohmann::json e;
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)rid);
+	e["id"] = tmp;
+	e["type"] = type;
+	e["time"] = OSUtils::now();
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)networkId);
+	e["networkId"] = tmp;
+	e[objectKey] = object;
+	e[objectKey].erase("webhooks"); // never send or list hook secrets
+	e[objectKey].erase("authHook");
+
+	nlohmann::json hooks;
+	{
+		std::lock_guard<std::mutex> l(_lock);
+		_events.push_back(e);
+		while (_events.size() > ZT_CONTROLLER_WEBHOOK_EVENT_HISTORY)
+			_events.pop_front();
+		hooks = _globalHooks;
+	}
+	if (networkHooks.is_array()) {
+		for(unsigned long i=0;i<networkHooks.size();++i)
+			hooks.push_back(networkHooks[i]);
+	}
+
+	const std::string body(OSUtils::jsonDump(e,-1));
+	for(unsigned long i=0;i<hooks.size();++i) {
+		_Delivery *d = new _Delivery;
+		d->url = OSUtils::jsonString(hooks[i]["url"],"");
+		d->secret = OSUtils::jsonString(hooks[i]["secret"],"");
+		d->type = type;
+		d->eventId = e["id"];
+		d->body = body;
+		d->attempts = 0;
+		d->maxAttempts = (unsigned int)OSUtils::jsonInt(hooks[i]["maxAttempts"],ZT_CONTROLLER_WEBHOOK_MAX_ATTEMPTS);
+		d->retryDelay = (int64_t)OSUtils::jsonInt(hooks[i]["retryDelay"],ZT_CONTROLLER_WEBHOOK_RETRY_DELAY);
+		d->nextAttempt = 0;
+		_queue.post(d);
+	}
+}
+
+nlohmann::json Webhooks::events(uint64_t networkId,int64_t since)
+{
+	char nwids[24];
+	OSUtils::ztsnprintf(nwids,sizeof(nwids),"%.16llx",(unsigned long long)networkId);
+	nlohmann::json r = nlohmann::json::array();
+	std::lock_guard<std::mutex> l(_lock);
+	for(std::deque<nlohmann::json>::iterator e(_events.begin());e!=_events.end();++e) {
+		if ((networkId)&&(OSUtils::jsonString((*e)["networkId"],"") != nwids))
+			continue;
+		if ((int64_t)OSUtils::jsonInt((*e)["time"],0ULL) > since)
+			r.push_back(*e);
+	}
+	return r;
+}
+
+bool Webhooks::parseUrl(const std::string &url,std::string &host,unsigned int &port,std::string &path)
+{
+	if ((url.length() > ZT_CONTROLLER_WEBHOOK_MAX_URL_LENGTH)||(url.substr(0,7) != "http://"))
+		return false;
+	if (url.find_first_of(" \t\r\n") != std::string::npos)
+		return false;
+
+	const std::size_t pathAt = url.find('/',7);
+	std::string hostPort(url.substr(7,(pathAt == std::string::npos) ? std::string::npos : (pathAt - 7)));
+	path = (pathAt == std::string::npos) ? std::string("/") : url.substr(pathAt);
+
+	port = 80;
+	std::size_t portAt;
+	if ((!hostPort.empty())&&(hostPort[0] == '[')) {
+		// [IPv6]:port
+		const std::size_t close = hostPort.find(']');
+		if (close == std::string::npos)
+			return false;
+		host = hostPort.substr(1,close - 1);
+		portAt = ((close + 1) < hostPort.length()) ? (close + 1) : std::string::npos;
+		if ((portAt != std::string::npos)&&(hostPort[portAt] != ':'))
+			return false;
+	} else {
+		portAt = hostPort.find(':');
+		host = hostPort.substr(0,portAt);
+	}
+	if (portAt != std::string::npos) {
+		const std::string ps(hostPort.substr(portAt + 1));
+		if ((ps.empty())||(ps.length() > 5)||(ps.find_first_not_of("0123456789") != std::string::npos))
+			return false;
+		port = (unsigned int)Utils::strToUInt(ps.c_str());
+		if ((port == 0)||(port > 65535))
+			return false;
+	}
+	return (!host.empty());
+}
+
+std::string Webhooks::validate(const nlohmann::json &hooks,nlohmann::json &out)
+{
+	out = nlohmann::json::array();
+	if (hooks.is_null())
+		return std::string();
+	if (!hooks.is_array())
+		return "webhooks must be an array";
+	if (hooks.size() > ZT_CONTROLLER_WEBHOOK_MAX_PER_NETWORK)
+		return "too many webhooks";
+	for(unsigned long i=0;i<hooks.size();++i) {
+		if (!hooks[i].is_object())
+			return "each webhook must be an object with a url and optional secret, maxAttempts, and retryDelay";
+		nlohmann::json h(hooks[i]);
+		std::string host,path;
+		unsigned int port;
+		const std::string url(OSUtils::jsonString(h["url"],""));
+		if (url.substr(0,8) == "https://")
+			return std::string("https:// webhook URLs are not supported, use a local http:// relay: ") + url;
+		if (!parseUrl(url,host,port,path))
+			return std::string("invalid webhook URL (only http:// URLs are supported): ") + url;
+		const std::string secret(OSUtils::jsonString(h["secret"],""));
+		if (secret.length() > ZT_CONTROLLER_WEBHOOK_MAX_SECRET_LENGTH)
+			return "webhook secret is too long";
+		const uint64_t maxAttempts = OSUtils::jsonInt(h["maxAttempts"],ZT_CONTROLLER_WEBHOOK_MAX_ATTEMPTS);
+		if ((maxAttempts < 1)||(maxAttempts > ZT_CONTROLLER_WEBHOOK_MAX_ATTEMPTS_LIMIT))
+			return "webhook maxAttempts must be from 1 to " + std::to_string(ZT_CONTROLLER_WEBHOOK_MAX_ATTEMPTS_LIMIT);
+		const uint64_t retryDelay = OSUtils::jsonInt(h["retryDelay"],ZT_CONTROLLER_WEBHOOK_RETRY_DELAY);
+		if ((retryDelay < ZT_CONTROLLER_WEBHOOK_MIN_RETRY_DELAY)||(retryDelay > ZT_CONTROLLER_WEBHOOK_MAX_RETRY_DELAY))
+			return "webhook retryDelay must be from 1000 to 3600000 ms";
+		nlohmann::json nh;
+		nh["url"] = url;
+		nh["secret"] = secret;
+		nh["maxAttempts"] = maxAttempts;
+		nh["retryDelay"] = retryDelay;
+		out.push_back(nh);
+	}
+	return std::string();
+}
+
+// Replace one hook's secret with whether it has one
+static void _redactHook(nlohmann::json &h)
+{
+	if ((!h.is_object())||(h.empty()))
+		return;
+	nlohmann::json::iterator secret(h.find("secret"));
+	h["secretSet"] = ((secret != h.end())&&(secret->is_string())&&(!secret->get<std::string>().empty()));
+	h.erase("secret");
+}
+
+void Webhooks::redactSecrets(nlohmann::json &network)
+{
+	if (!network.is_object())
+		return;
+	nlohmann::json::iterator hooks(network.find("webhooks"));
+	if ((hooks != network.end())&&(hooks->is_array())) {
+		for(unsigned long i=0;i<hooks->size();++i)
+			_redactHook((*hooks)[i]);
+	}
+	nlohmann::json::iterator authHook(network.find("authHook"));
+	if (authHook != network.end())
+		_redactHook(*authHook);
+}
+
+// URL of a hook object, or an empty string
+static std::string _hookUrl(const nlohmann::json &h)
+{
+	if (!h.is_object())
+		return std::string();
+	nlohmann::json::const_iterator url(h.find("url"));
+	return ((url != h.end())&&(url->is_string())) ? url->get<std::string>() : std::string();
+}
+
+// Fill in one hook's secret from the current hook with the same URL, if it was left out
+static void _keepSecret(nlohmann::json &h,const nlohmann::json &current)
+{
+	if ((!h.is_object())||(h.count("secret")))
+		return;
+	const std::string url(_hookUrl(h));
+	if (current.is_array()) {
+		for(unsigned long i=0;i<current.size();++i) {
+			if ((_hookUrl(current[i]) == url)&&(current[i].count("secret"))) {
+				h["secret"] = current[i]["secret"];
+				return;
+			}
+		}
+	} else if ((_hookUrl(current) == url)&&(current.count("secret"))) {
+		h["secret"] = current["secret"];
+	}
+}
+
+void Webhooks::keepSecrets(nlohmann::json &hooks,const nlohmann::json &current)
+{
+	if (hooks.is_array()) {
+		for(unsigned long i=0;i<hooks.size();++i)
+			_keepSecret(hooks[i],current);
+	} else _keepSecret(hooks,current);
+}
+
+unsigned int Webhooks::post(const std::string &url,const std::string &secret,const std::string &body,const std::map<std::string,std::string> &headers,unsigned long timeout,std::string &responseBody)
+{
+	std::string host,path;
+	unsigned int port = 0;
+	if (!parseUrl(url,host,port,path)) {
+		responseBody = "invalid URL";
+		return 0;
+	}
+
+	InetAddress addr;
+	struct addrinfo hints,*res = (struct addrinfo *)0;
+	memset(&hints,0,sizeof(hints));
+	hints.ai_family = AF_UNSPEC;
+	hints.ai_socktype = SOCK_STREAM;
+	if ((getaddrinfo(host.c_str(),(const char *)0,&hints,&res) != 0)||(!res)) {
+		responseBody = std::string("unable to resolve ") + host;
+		return 0;
+	}
+	for(struct addrinfo *ai=res;ai;ai=ai->ai_next) {
+		if ((ai->ai_family == AF_INET)||(ai->ai_family == AF_INET6)) {
+			addr = ai->ai_addr;
+			break;
+		}
+	}
+	freeaddrinfo(res);
+	if (!addr) {
+		responseBody = std::string("no IPv4 or IPv6 address for ") + host;
+		return 0;
+	}
+	addr.setPort(port);
+
+	char tmp[(ZT_HMACSHA384_LEN * 2) + 16];
+	uint8_t mac[ZT_HMACSHA384_LEN];
+	HMACSHA384(secret.data(),(unsigned int)secret.length(),body.data(),(unsigned int)body.length(),mac);
+
+	std::map<std::string,std::string> requestHeaders(headers),responseHeaders;
+	requestHeaders["Host"] = (port == 80) ? host : (host + ":" + std::to_string(port));
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"ZeroTier-Controller/%d.%d.%d",ZEROTIER_ONE_VERSION_MAJOR,ZEROTIER_ONE_VERSION_MINOR,ZEROTIER_ONE_VERSION_REVISION);
+	requestHeaders["User-Agent"] = tmp;
+	requestHeaders["Content-Type"] = "application/json";
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%u",(unsigned int)body.length());
+	requestHeaders["Content-Length"] = tmp;
+	requestHeaders["X-ZeroTier-Signature"] = std::string("sha384=") + Utils::hex(mac,sizeof(mac),tmp);
+
+	responseBody.clear();
+	return Http::POST(
+		65536,
+		timeout,
+		reinterpret_cast<const struct sockaddr *>(&addr),
+		path.c_str(),
+		requestHeaders,
+		body.data(),
+		(unsigned long)body.length(),
+		responseHeaders,
+		responseBody);
+}
+
+bool Webhooks::_deliver(const _Delivery &d,std::string &err)
+{
+	std::map<std::string,std::string> headers;
+	std::string responseBody;
+	headers["X-ZeroTier-Event"] = d.type;
+	headers["X-ZeroTier-Delivery"] = d.eventId;
+	const unsigned int scode = post(d.url,d.secret,d.body,headers,ZT_CONTROLLER_WEBHOOK_TIMEOUT,responseBody);
+	if ((scode >= 200)&&(scode <= 299))
+		return true;
+	if (scode == 0)
+		err = responseBody;
+	else err = std::string("HTTP ") + std::to_string(scode);
+	return false;
+}
+
+void Webhooks::_deadLetter(const _Delivery &d,const std::string &err)
+{
+	nlohmann::json dl;
+	dl["time"] = OSUtils::now();
+	dl["url"] = d.url;
+	dl["attempts"] = d.attempts;
+	dl["error"] = err;
+	try {
+		dl["event"] = OSUtils::jsonParse(d.body);
+	} catch ( ... ) {}
+
+	fprintf(stderr,"WARNING: controller webhook %s event %s could not be delivered to %s: %s" ZT_EOL_S,d.type.c_str(),d.eventId.c_str(),d.url.c_str(),err.c_str());
+	FILE *f = fopen(_deadLetterPath.c_str(),"a");
+	if (f) {
+		fprintf(f,"%s\n",OSUtils::jsonDump(dl,-1).c_str());
+		fclose(f);
+		OSUtils::lockDownFile(_deadLetterPath.c_str(),false);
+	}
+}
+
+} // namespace ZeroTier
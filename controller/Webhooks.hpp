@@ -0,0 +1,172 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#ifndef ZT_CONTROLLER_WEBHOOKS_HPP
+#define ZT_CONTROLLER_WEBHOOKS_HPP
+
+#include <stdint.h>
+
+#include <string>
+#include <map>
+#include <deque>
+#include <thread>
+#include <mutex>
+
+#include "../osdep/BlockingQueue.hpp"
+#include "../ext/json/json.hpp"
+
+// Most webhooks a network may have, and longest allowed URL and secret
+#define ZT_CONTROLLER_WEBHOOK_MAX_PER_NETWORK 8
+#define ZT_CONTROLLER_WEBHOOK_MAX_URL_LENGTH 1024
+#define ZT_CONTROLLER_WEBHOOK_MAX_SECRET_LENGTH 256
+
+// Recent events kept in memory for the events API
+#define ZT_CONTROLLER_WEBHOOK_EVENT_HISTORY 1000
+
+// Default delivery attempts per event and hook before it goes to the dead letter log, and most a hook may set
+#define ZT_CONTROLLER_WEBHOOK_MAX_ATTEMPTS 5
+#define ZT_CONTROLLER_WEBHOOK_MAX_ATTEMPTS_LIMIT 10
+
+// Default wait before the first retry, and bounds a hook may set; each later wait is 4 times longer
+#define ZT_CONTROLLER_WEBHOOK_RETRY_DELAY 15000
+#define ZT_CONTROLLER_WEBHOOK_MIN_RETRY_DELAY 1000
+#define ZT_CONTROLLER_WEBHOOK_MAX_RETRY_DELAY 3600000
+
+// Longest wait between two attempts, however many there have been
+#define ZT_CONTROLLER_WEBHOOK_MAX_BACKOFF 86400000
+
+// Timeout for each delivery attempt
+#define ZT_CONTROLLER_WEBHOOK_TIMEOUT 10000
+
+// Dead letter log, one JSON object per line, in the ZeroTier home path
+#define ZT_CONTROLLER_WEBHOOK_DEAD_LETTER_FILENAME "controller-webhooks-failed.log"
+
+namespace ZeroTier {
+
+/**
+ * Delivers controller events as signed JSON POSTs to webhook URLs
+ *
+ * Each event goes to every global hook and to the hooks of its network.
+ * Deliveries run on a background thread and are retried with backoff as
+ * each hook's maxAttempts and retryDelay say, and ones that still fail are
+ * appended to the dead letter log. Bodies are signed with HMAC-SHA384
+ * keyed with the bytes of the hook's secret.
+ *
+ * Hook secrets are write-only: they are kept in the database but never
+ * returned through the API, exports, events, or the audit log. Only
+ * controller backups include them.
+ */
+class Webhooks
+{
+public:
+	Webhooks(const std::string &ztPath);
+	~Webhooks();
+
+	/**
+	 * Set hooks that receive events for every network
+	 *
+	 * @param hooks Array of { url, secret, maxAttempts, retryDelay } objects
+	 */
+	void setGlobalHooks(const nlohmann::json &hooks);
+
+	/**
+	 * Record an event and queue its delivery
+	 *
+	 * @param type Event type, e.g. member-authorized
+	 * @param networkId Network the event is about
+	 * @param networkHooks The network's webhooks array (may be null)
+	 * @param objectKey Key for the object the event is about, "network" or "member"
+	 * @param object The network or member, copied into the event
+	 */
+	void event(const char *type,uint64_t networkId,const nlohmann::json &networkHooks,const char *objectKey,const nlohmann::json &object);
+
+	/**
+	 * @param networkId Network to list events for or 0 for all
+	 * @param since Only list events newer than this time in ms since epoch
+	 * @return Recent events, oldest first
+	 */
+	nlohmann::json events(uint64_t networkId,int64_t since);
+
+	/**
+	 * Check a webhook URL and split it into its parts
+	 *
+	 * Only http:// URLs are supported. The HTTP client has no TLS, so
+	 * https:// URLs are refused rather than sent in the clear.
+	 *
+	 * @return True if URL is valid
+	 */
+	static bool parseUrl(const std::string &url,std::string &host,unsigned int &port,std::string &path);
+
+	/**
+	 * Check and normalize a webhooks array from the API
+	 *
+	 * @return Empty string if valid, otherwise an error message
+	 */
+	static std::string validate(const nlohmann::json &hooks,nlohmann::json &out);
+
+	/**
+	 * Synchronously POST a signed JSON body to a URL
+	 *
+	 * @param headers Extra request headers
+	 * @param timeout Timeout in milliseconds
+	 * @param responseBody Filled with response body, or an error message if 0 is returned
+	 * @return HTTP status code or 0 if the request could not be made
+	 */
+	static unsigned int post(const std::string &url,const std::string &secret,const std::string &body,const std::map<std::string,std::string> &headers,unsigned long timeout,std::string &responseBody);
+
+	/**
+	 * Replace the secrets of a network's webhooks and authHook with secretSet flags
+	 *
+	 * @param network Network about to leave the controller, changed in place
+	 */
+	static void redactSecrets(nlohmann::json &network);
+
+	/**
+	 * Give hooks sent without a secret field the secret of the current hook with the same URL
+	 *
+	 * This lets a network read from the API be saved back without clearing
+	 * its secrets. An empty secret still clears one.
+	 *
+	 * @param hooks Webhooks array or authHook object from the API, changed in place
+	 * @param current The network's current webhooks array or authHook object
+	 */
+	static void keepSecrets(nlohmann::json &hooks,const nlohmann::json &current);
+
+private:
+	struct _Delivery
+	{
+		std::string url;
+		std::string secret;
+		std::string type;
+		std::string eventId;
+		std::string body;
+		unsigned int attempts;
+		unsigned int maxAttempts;
+		int64_t retryDelay;
+		int64_t nextAttempt;
+	};
+
+	bool _deliver(const _Delivery &d,std::string &err);
+	void _deadLetter(const _Delivery &d,const std::string &err);
+
+	std::string _deadLetterPath;
+	nlohmann::json _globalHooks;
+	std::deque<nlohmann::json> _events;
+	std::mutex _lock;
+	BlockingQueue<_Delivery *> _queue;
+	std::thread _thread;
+};
+
+} // namespace ZeroTier
+
+#endif
@@ -2051,6 +2051,111 @@ ZT_SDK_API enum ZT_ResultCode ZT_Node_orbit(ZT_Node *node,void *tptr,uint64_t mo
  */
 ZT_SDK_API enum ZT_ResultCode ZT_Node_deorbit(ZT_Node *node,void *tptr,uint64_t moonWorldId);
 
+/**
+ * Attempt to contact a known peer at an explicit physical endpoint
+ *
+ * This sends a HELLO to the given address. It does not wait for a reply;
+ * if the peer answers a new path will appear in its path list.
+ *
+ * @param node Node instance
+ * @param tptr Thread pointer to pass to functions/callbacks resulting from this call
+ * @param address ZeroTier address of peer (must already be known)
+ * @param addr Physical IPv4 or IPv6 address and port to try
+ * @return OK or ZT_RESULT_ERROR_BAD_PARAMETER if peer is unknown or address is invalid
+ */
+ZT_SDK_API enum ZT_ResultCode ZT_Node_tryPeer(ZT_Node *node,void *tptr,uint64_t address,const struct sockaddr_storage *addr);
+
+/**
+ * Pin one of a peer's current paths as preferred
+ *
+ * The pinned path is used ahead of better paths until it expires, after
+ * which normal path selection resumes. Bonded peers ignore this.
+ *
+ * @param node Node instance
+ * @param tptr Thread pointer to pass to functions/callbacks resulting from this call
+ * @param address ZeroTier address of peer (must already be known)
+ * @param addr Physical address of one of the peer's active paths or NULL to clear
+ * @return OK or ZT_RESULT_ERROR_BAD_PARAMETER if peer is unknown or addr is not an active path
+ */
+ZT_SDK_API enum ZT_ResultCode ZT_Node_setPeerPreferredPath(ZT_Node *node,void *tptr,uint64_t address,const struct sockaddr_storage *addr);
+
+/**
+ * Immediately request a fresh network config from a network's controller
+ *
+ * Normally config is re-requested on a timer. The request is sent
+ * asynchronously and any new config arrives through the usual callbacks.
+ *
+ * @param node Node instance
+ * @param tptr Thread pointer to pass to functions/callbacks resulting from this call
+ * @param nwid 64-bit network ID
+ * @return OK or ZT_RESULT_ERROR_NETWORK_NOT_FOUND if not a member of this network
+ */
+ZT_SDK_API enum ZT_ResultCode ZT_Node_refreshNetworkConfig(ZT_Node *node,void *tptr,uint64_t nwid);
+
+/**
+ * Set a join authorization token for a network
+ *
+ * The token is sent to the network's controller with each config request
+ * until it is cleared or the network is left. It is not saved, so it only
+ * needs to last until the controller has authorized this node. Setting a
+ * token also requests a fresh config immediately.
+ *
+ * @param node Node instance
+ * @param tptr Thread pointer to pass to functions/callbacks resulting from this call
+ * @param nwid 64-bit network ID
+ * @param token Token string (under 512 bytes) or NULL to clear
+ * @return OK, ZT_RESULT_ERROR_NETWORK_NOT_FOUND, or ZT_RESULT_ERROR_BAD_PARAMETER if token is too long
+ */
+ZT_SDK_API enum ZT_ResultCode ZT_Node_setNetworkAuthToken(ZT_Node *node,void *tptr,uint64_t nwid,const char *token);
+
+/**
+ * Add a peer from its identity so it is known before it is first contacted
+ *
+ * An identity whose address is already known is left alone. If the known
+ * identity differs (an address collision or a replaced node) nothing is
+ * changed and BAD_PARAMETER is returned.
+ *
+ * @param node Node instance
+ * @param tptr Thread pointer to pass to functions/callbacks resulting from this call
+ * @param identity Peer identity in string format (secret part, if any, is ignored)
+ * @param existing If non-NULL set to 0 if added, 1 if already known, 2 if a different identity is known
+ * @return OK or ZT_RESULT_ERROR_BAD_PARAMETER if identity is invalid, ours, or conflicts with a known one
+ */
+ZT_SDK_API enum ZT_ResultCode ZT_Node_addPeer(ZT_Node *node,void *tptr,const char *identity,int *existing);
+
+/**
+ * Get a known peer's public identity in string format
+ *
+ * Peers that are not in memory are looked up in the peer cache via the
+ * state object get callback.
+ *
+ * @param node Node instance
+ * @param tptr Thread pointer to pass to functions/callbacks resulting from this call
+ * @param address ZeroTier address of peer
+ * @param buf Buffer to receive identity string
+ * @param buflen Size of buffer (at least 384 bytes)
+ * @return OK or ZT_RESULT_ERROR_BAD_PARAMETER if peer is unknown or buffer is too small
+ */
+ZT_SDK_API enum ZT_ResultCode ZT_Node_peerIdentity(ZT_Node *node,void *tptr,uint64_t address,char *buf,unsigned int buflen);
+
+/**
+ * Set local limits for a network that can only be more restrictive than its config
+ *
+ * A multicast limit lowers the controller's multicast recipient limit but
+ * can never raise it. Disallowing bridging stops this node from bridging
+ * even if the controller designates it an active bridge; allowing it has
+ * no effect unless the controller does. Limits are not saved and last until
+ * changed or the network is left.
+ *
+ * @param node Node instance
+ * @param tptr Thread pointer to pass to functions/callbacks resulting from this call
+ * @param nwid 64-bit network ID
+ * @param multicastLimit Maximum multicast recipients, or 0 to use the controller's limit
+ * @param allowBridging Nonzero to bridge if the controller allows it, zero to never bridge
+ * @return OK or ZT_RESULT_ERROR_NETWORK_NOT_FOUND if not a member of this network
+ */
+ZT_SDK_API enum ZT_ResultCode ZT_Node_setNetworkLocalLimits(ZT_Node *node,void *tptr,uint64_t nwid,unsigned int multicastLimit,int allowBridging);
+
 /**
  * Get this node's 40-bit ZeroTier address
  *
@@ -151,7 +151,7 @@ libzerotiercore.a:	$(CORE_OBJS)
 
 core: libzerotiercore.a
 
-selftest:	$(CORE_OBJS) $(ONE_OBJS) selftest.o
+selftest:	$(CORE_OBJS) $(ONE_OBJS) selftest.o one
 	$(CXX) $(CXXFLAGS) $(LDFLAGS) -o zerotier-selftest selftest.o $(CORE_OBJS) $(ONE_OBJS) $(LIBS)
 	$(STRIP) zerotier-selftest
 
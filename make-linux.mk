@@ -275,6 +275,14 @@ ifeq ($(ZT_CONTROLLER),1)
 	override INCLUDES+=-I/usr/pgsql-10/include -Iext/hiredis-0.14.1/include/ -Iext/redis-plus-plus-1.1.1/install/centos8/include/sw/
 endif
 
+# SQLite controller storage, selected with settings.controllerDb.type "sqlite" in local.conf. It is
+# built by default so that the selftest covers it; build with ZT_CONTROLLER_SQLITE=0 to leave it out.
+ZT_CONTROLLER_SQLITE?=1
+ifeq ($(ZT_CONTROLLER_SQLITE),1)
+	override LDLIBS+=-lsqlite3
+	override DEFS+=-DZT_CONTROLLER_USE_SQLITE
+endif
+
 # ARM32 hell -- use conservative CFLAGS
 ifeq ($(ZT_ARCHITECTURE),3)
 	ifeq ($(shell if [ -e /usr/bin/dpkg ]; then dpkg --print-architecture; fi),armel)
@@ -325,7 +333,7 @@ libzerotiercore.a:	FORCE
 
 core: libzerotiercore.a
 
-selftest:	$(CORE_OBJS) $(ONE_OBJS) selftest.o
+selftest:	$(CORE_OBJS) $(ONE_OBJS) selftest.o one
 	$(CXX) $(CXXFLAGS) $(LDFLAGS) -o zerotier-selftest selftest.o $(CORE_OBJS) $(ONE_OBJS) $(LDLIBS)
 	$(STRIP) zerotier-selftest
 
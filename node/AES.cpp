@@ -447,6 +447,86 @@ void AES::CTR::finish() noexcept
 	}
 }
 
+// AES-GCM ------------------------------------------------------------------------------------------------------------
+
+void AES::gcmEncrypt(const uint8_t iv[12], const void *const aad, const unsigned int aadLen, const void *const in, const unsigned int len, void *const out, uint8_t tag[16]) const noexcept
+{
+	uint8_t ctr[16];
+	Utils::copy< 12 >(ctr, iv);
+	ctr[12] = 0;
+	ctr[13] = 0;
+	ctr[14] = 0;
+	ctr[15] = 2; // counter 1 is reserved for the tag
+	AES::CTR c(*this);
+	c.init(ctr, out);
+	c.crypt(in, len);
+	c.finish();
+	p_gcmTag(iv, aad, aadLen, out, len, tag);
+}
+
+bool AES::gcmDecrypt(const uint8_t iv[12], const void *const aad, const unsigned int aadLen, const void *const in, const unsigned int len, void *const out, const uint8_t tag[16]) const noexcept
+{
+	uint8_t expected[16];
+	p_gcmTag(iv, aad, aadLen, in, len, expected);
+	if (!Utils::secureEq(expected, tag, 16))
+		return false;
+	uint8_t ctr[16];
+	Utils::copy< 12 >(ctr, iv);
+	ctr[12] = 0;
+	ctr[13] = 0;
+	ctr[14] = 0;
+	ctr[15] = 2;
+	AES::CTR c(*this);
+	c.init(ctr, out);
+	c.crypt(in, len);
+	c.finish();
+	return true;
+}
+
+void AES::p_gcmTag(const uint8_t iv[12], const void *const aad, const unsigned int aadLen, const void *const ct, const unsigned int len, uint8_t tag[16]) const noexcept
+{
+	// Blocks are moved between byte and word form with memcpy() since the software
+	// AES path writes its output as 32-bit words.
+	uint8_t blk[16];
+	uint64_t w[2];
+	Utils::zero< 16 >(blk);
+	encrypt(blk, blk);
+	memcpy(w, blk, 16);
+	const uint64_t h0 = Utils::ntoh(w[0]);
+	const uint64_t h1 = Utils::ntoh(w[1]);
+
+	// GHASH over the AAD and then the ciphertext, each zero padded to a whole block
+	uint64_t y0 = 0, y1 = 0;
+	const uint8_t *const parts[2] = {reinterpret_cast<const uint8_t *>(aad), reinterpret_cast<const uint8_t *>(ct)};
+	const unsigned int partLens[2] = {(aad) ? aadLen : 0, len};
+	for (unsigned int p = 0; p < 2; ++p) {
+		for (unsigned int i = 0; i < partLens[p]; i += 16) {
+			const unsigned int n = ((partLens[p] - i) < 16) ? (partLens[p] - i) : 16;
+			w[0] = 0;
+			w[1] = 0;
+			memcpy(w, parts[p] + i, n);
+			y0 ^= w[0];
+			y1 ^= w[1];
+			s_gfmul(h0, h1, y0, y1);
+		}
+	}
+	y0 ^= Utils::hton((uint64_t)partLens[0] << 3U);
+	y1 ^= Utils::hton((uint64_t)len << 3U);
+	s_gfmul(h0, h1, y0, y1);
+
+	Utils::copy< 12 >(blk, iv);
+	blk[12] = 0;
+	blk[13] = 0;
+	blk[14] = 0;
+	blk[15] = 1;
+	encrypt(blk, blk);
+	w[0] = y0;
+	w[1] = y1;
+	memcpy(tag, w, 16);
+	for (unsigned int i = 0; i < 16; ++i)
+		tag[i] ^= blk[i];
+}
+
 // Software AES and AES key expansion ---------------------------------------------------------------------------------
 
 const uint32_t AES::Te0[256] = {0xc66363a5, 0xf87c7c84, 0xee777799, 0xf67b7b8d, 0xfff2f20d, 0xd66b6bbd, 0xde6f6fb1, 0x91c5c554, 0x60303050, 0x02010103, 0xce6767a9, 0x562b2b7d, 0xe7fefe19, 0xb5d7d762, 0x4dababe6, 0xec76769a, 0x8fcaca45, 0x1f82829d, 0x89c9c940, 0xfa7d7d87, 0xeffafa15, 0xb25959eb, 0x8e4747c9, 0xfbf0f00b, 0x41adadec, 0xb3d4d467, 0x5fa2a2fd, 0x45afafea, 0x239c9cbf, 0x53a4a4f7, 0xe4727296, 0x9bc0c05b, 0x75b7b7c2, 0xe1fdfd1c, 0x3d9393ae, 0x4c26266a, 0x6c36365a, 0x7e3f3f41, 0xf5f7f702, 0x83cccc4f, 0x6834345c, 0x51a5a5f4, 0xd1e5e534, 0xf9f1f108, 0xe2717193, 0xabd8d873, 0x62313153,
@@ -144,6 +144,38 @@ public:
 		p_decryptSW(reinterpret_cast<const uint8_t *>(in), reinterpret_cast<uint8_t *>(out));
 	}
 
+	/**
+	 * Encrypt a whole message with standard AES-256-GCM
+	 *
+	 * This is for small one-shot messages such as files. GHASH is always
+	 * computed in software, so it's not meant for packet processing.
+	 *
+	 * @param iv 96-bit IV (must never be reused with the same key)
+	 * @param aad Additional authenticated data or NULL
+	 * @param aadLen Length of additional authenticated data
+	 * @param in Plaintext
+	 * @param len Length of plaintext
+	 * @param out Buffer for ciphertext (same length as plaintext)
+	 * @param tag Buffer for 128-bit authentication tag
+	 */
+	void gcmEncrypt(const uint8_t iv[12], const void *aad, unsigned int aadLen, const void *in, unsigned int len, void *out, uint8_t tag[16]) const noexcept;
+
+	/**
+	 * Check the tag on and decrypt a whole AES-256-GCM message
+	 *
+	 * Nothing is written to out unless the tag is valid.
+	 *
+	 * @param iv 96-bit IV
+	 * @param aad Additional authenticated data or NULL
+	 * @param aadLen Length of additional authenticated data
+	 * @param in Ciphertext
+	 * @param len Length of ciphertext
+	 * @param out Buffer for plaintext (same length as ciphertext)
+	 * @param tag 128-bit authentication tag to check
+	 * @return True if tag was valid and out now holds the plaintext
+	 */
+	bool gcmDecrypt(const uint8_t iv[12], const void *aad, unsigned int aadLen, const void *in, unsigned int len, void *out, const uint8_t tag[16]) const noexcept;
+
 	class GMACSIVEncryptor;
 	class GMACSIVDecryptor;
 
@@ -546,6 +578,7 @@ private:
 	void p_initSW(const uint8_t *key) noexcept;
 	void p_encryptSW(const uint8_t *in, uint8_t *out) const noexcept;
 	void p_decryptSW(const uint8_t *in, uint8_t *out) const noexcept;
+	void p_gcmTag(const uint8_t iv[12], const void *aad, unsigned int aadLen, const void *ct, unsigned int len, uint8_t tag[16]) const noexcept;
 
 	union
 	{
@@ -112,6 +112,19 @@ public:
 	 */
 	inline char *toString(char buf[11]) const { return Utils::hex10(_a,buf); }
 
+	/**
+	 * @param enc Encoding, where base32 is always 8 characters
+	 * @return String in the requested encoding
+	 */
+	inline char *toString(char buf[11],const Utils::Encoding enc) const
+	{
+		if (enc != Utils::ENCODING_BASE32)
+			return Utils::hex10(_a,buf);
+		uint8_t b[ZT_ADDRESS_LENGTH];
+		copyTo(b,ZT_ADDRESS_LENGTH);
+		return Utils::b32e(b,ZT_ADDRESS_LENGTH,buf);
+	}
+
 	/**
 	 * @return True if this address is not zero
 	 */
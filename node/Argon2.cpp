@@ -0,0 +1,417 @@
+/*
+ * Copyright (c)2013-2020 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#include <stdint.h>
+#include <string.h>
+
+#include <new>
+
+#include "Argon2.hpp"
+#include "Utils.hpp"
+
+namespace ZeroTier {
+
+namespace {
+
+// BLAKE2b (RFC 7693), which Argon2 uses both directly and in its block function
+
+const uint64_t BLAKE2B_IV[8] = {
+	0x6a09e667f3bcc908ULL,0xbb67ae8584caa73bULL,0x3c6ef372fe94f82bULL,0xa54ff53a5f1d36f1ULL,
+	0x510e527fade682d1ULL,0x9b05688c2b3e6c1fULL,0x1f83d9abfb41bd6bULL,0x5be0cd19137e2179ULL
+};
+
+const uint8_t BLAKE2B_SIGMA[12][16] = {
+	{ 0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15 },
+	{ 14,10,4,8,9,15,13,6,1,12,0,2,11,7,5,3 },
+	{ 11,8,12,0,5,2,15,13,10,14,3,6,7,1,9,4 },
+	{ 7,9,3,1,13,12,11,14,2,6,5,10,4,0,15,8 },
+	{ 9,0,5,7,2,4,10,15,14,1,11,12,6,8,3,13 },
+	{ 2,12,6,10,0,11,8,3,4,13,7,5,15,14,1,9 },
+	{ 12,5,1,15,14,13,4,10,0,7,6,3,9,2,8,11 },
+	{ 13,11,7,14,12,1,3,9,5,0,15,4,8,6,2,10 },
+	{ 6,15,14,9,11,3,0,8,12,2,13,7,1,4,10,5 },
+	{ 10,2,8,4,7,6,1,5,15,11,9,14,3,12,13,0 },
+	{ 0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15 },
+	{ 14,10,4,8,9,15,13,6,1,12,0,2,11,7,5,3 }
+};
+
+ZT_INLINE uint64_t rotr64(const uint64_t x,const unsigned int n) noexcept { return (x >> n) | (x << (64 - n)); }
+
+ZT_INLINE uint64_t load64(const uint8_t *p) noexcept
+{
+	return ((uint64_t)p[0]) | ((uint64_t)p[1] << 8) | ((uint64_t)p[2] << 16) | ((uint64_t)p[3] << 24) | ((uint64_t)p[4] << 32) | ((uint64_t)p[5] << 40) | ((uint64_t)p[6] << 48) | ((uint64_t)p[7] << 56);
+}
+
+ZT_INLINE void store64(uint8_t *p,const uint64_t x) noexcept
+{
+	for(unsigned int i=0;i<8;++i)
+		p[i] = (uint8_t)(x >> (i * 8));
+}
+
+ZT_INLINE void store32(uint8_t *p,const uint32_t x) noexcept
+{
+	p[0] = (uint8_t)x;
+	p[1] = (uint8_t)(x >> 8);
+	p[2] = (uint8_t)(x >> 16);
+	p[3] = (uint8_t)(x >> 24);
+}
+
+class Blake2b
+{
+public:
+	explicit Blake2b(const unsigned int outlen) noexcept :
+		_t(0),
+		_buflen(0),
+		_outlen(outlen)
+	{
+		for(unsigned int i=0;i<8;++i)
+			_h[i] = BLAKE2B_IV[i];
+		_h[0] ^= 0x01010000ULL ^ (uint64_t)outlen;
+	}
+
+	~Blake2b() { Utils::burn(this,sizeof(Blake2b)); }
+
+	void update(const void *data,unsigned int len) noexcept
+	{
+		const uint8_t *in = reinterpret_cast<const uint8_t *>(data);
+		while (len > 0) {
+			if (_buflen == 128) {
+				_t += 128;
+				_compress(false);
+				_buflen = 0;
+			}
+			unsigned int n = 128 - _buflen;
+			if (n > len)
+				n = len;
+			memcpy(_buf + _buflen,in,n);
+			_buflen += n;
+			in += n;
+			len -= n;
+		}
+	}
+
+	ZT_INLINE void update32(const uint32_t x) noexcept
+	{
+		uint8_t tmp[4];
+		store32(tmp,x);
+		update(tmp,4);
+	}
+
+	void finish(uint8_t *out) noexcept
+	{
+		_t += _buflen;
+		memset(_buf + _buflen,0,128 - _buflen);
+		_compress(true);
+		uint8_t tmp[64];
+		for(unsigned int i=0;i<8;++i)
+			store64(tmp + (i * 8),_h[i]);
+		memcpy(out,tmp,_outlen);
+		Utils::burn(tmp,sizeof(tmp));
+	}
+
+private:
+	void _compress(const bool last) noexcept
+	{
+		uint64_t m[16],v[16];
+		for(unsigned int i=0;i<16;++i)
+			m[i] = load64(_buf + (i * 8));
+		for(unsigned int i=0;i<8;++i) {
+			v[i] = _h[i];
+			v[i + 8] = BLAKE2B_IV[i];
+		}
+		v[12] ^= _t;
+		if (last)
+			v[14] = ~v[14];
+
+#define ZT_BLAKE2B_G(r,i,a,b,c,d) \
+	a = a + b + m[BLAKE2B_SIGMA[r][2 * i]]; \
+	d = rotr64(d ^ a,32); \
+	c = c + d; \
+	b = rotr64(b ^ c,24); \
+	a = a + b + m[BLAKE2B_SIGMA[r][(2 * i) + 1]]; \
+	d = rotr64(d ^ a,16); \
+	c = c + d; \
+	b = rotr64(b ^ c,63)
+
+		for(unsigned int r=0;r<12;++r) {
+			ZT_BLAKE2B_G(r,0,v[0],v[4],v[8],v[12]);
+			ZT_BLAKE2B_G(r,1,v[1],v[5],v[9],v[13]);
+			ZT_BLAKE2B_G(r,2,v[2],v[6],v[10],v[14]);
+			ZT_BLAKE2B_G(r,3,v[3],v[7],v[11],v[15]);
+			ZT_BLAKE2B_G(r,4,v[0],v[5],v[10],v[15]);
+			ZT_BLAKE2B_G(r,5,v[1],v[6],v[11],v[12]);
+			ZT_BLAKE2B_G(r,6,v[2],v[7],v[8],v[13]);
+			ZT_BLAKE2B_G(r,7,v[3],v[4],v[9],v[14]);
+		}
+
+#undef ZT_BLAKE2B_G
+
+		for(unsigned int i=0;i<8;++i)
+			_h[i] ^= v[i] ^ v[i + 8];
+	}
+
+	uint64_t _h[8];
+	uint64_t _t; // inputs here are far below 2^64 bytes, so the high counter word stays zero
+	uint8_t _buf[128];
+	unsigned int _buflen;
+	const unsigned int _outlen;
+};
+
+// Variable length hash H' from RFC 9106 section 3.3
+void blake2bLong(uint8_t *out,const unsigned int outlen,const void *in,const unsigned int inlen) noexcept
+{
+	if (outlen <= 64) {
+		Blake2b h(outlen);
+		h.update32(outlen);
+		h.update(in,inlen);
+		h.finish(out);
+		return;
+	}
+
+	uint8_t v[64];
+	{
+		Blake2b h(64);
+		h.update32(outlen);
+		h.update(in,inlen);
+		h.finish(v);
+	}
+	memcpy(out,v,32);
+	out += 32;
+	unsigned int remaining = outlen - 32;
+	while (remaining > 64) {
+		Blake2b h(64);
+		h.update(v,64);
+		h.finish(v);
+		memcpy(out,v,32);
+		out += 32;
+		remaining -= 32;
+	}
+	Blake2b h(remaining);
+	h.update(v,64);
+	h.finish(out);
+	Utils::burn(v,sizeof(v));
+}
+
+// Argon2 memory blocks are 1024 bytes, handled as 128 little-endian 64-bit words
+#define ZT_ARGON2_BLOCK_WORDS 128
+#define ZT_ARGON2_SYNC_POINTS 4
+#define ZT_ARGON2_VERSION 0x13
+#define ZT_ARGON2_TYPE_ID 2
+
+ZT_INLINE uint64_t fBlaMka(const uint64_t x,const uint64_t y) noexcept
+{
+	return x + y + (2 * (x & 0xffffffffULL) * (y & 0xffffffffULL));
+}
+
+#define ZT_ARGON2_G(a,b,c,d) \
+	a = fBlaMka(a,b); \
+	d = rotr64(d ^ a,32); \
+	c = fBlaMka(c,d); \
+	b = rotr64(b ^ c,24); \
+	a = fBlaMka(a,b); \
+	d = rotr64(d ^ a,16); \
+	c = fBlaMka(c,d); \
+	b = rotr64(b ^ c,63)
+
+#define ZT_ARGON2_ROUND(v0,v1,v2,v3,v4,v5,v6,v7,v8,v9,v10,v11,v12,v13,v14,v15) \
+	ZT_ARGON2_G(v0,v4,v8,v12); \
+	ZT_ARGON2_G(v1,v5,v9,v13); \
+	ZT_ARGON2_G(v2,v6,v10,v14); \
+	ZT_ARGON2_G(v3,v7,v11,v15); \
+	ZT_ARGON2_G(v0,v5,v10,v15); \
+	ZT_ARGON2_G(v1,v6,v11,v12); \
+	ZT_ARGON2_G(v2,v7,v8,v13); \
+	ZT_ARGON2_G(v3,v4,v9,v14)
+
+// Compression function G: next = P(prev ^ ref) ^ prev ^ ref, XORed into next's old contents if withXor
+void fillBlock(const uint64_t *prev,const uint64_t *ref,uint64_t *next,const bool withXor) noexcept
+{
+	uint64_t r[ZT_ARGON2_BLOCK_WORDS],tmp[ZT_ARGON2_BLOCK_WORDS];
+	for(unsigned int i=0;i<ZT_ARGON2_BLOCK_WORDS;++i) {
+		r[i] = prev[i] ^ ref[i];
+		tmp[i] = (withXor) ? (r[i] ^ next[i]) : r[i];
+	}
+
+	for(unsigned int i=0;i<8;++i) {
+		uint64_t *const v = r + (16 * i);
+		ZT_ARGON2_ROUND(v[0],v[1],v[2],v[3],v[4],v[5],v[6],v[7],v[8],v[9],v[10],v[11],v[12],v[13],v[14],v[15]);
+	}
+	for(unsigned int i=0;i<8;++i) {
+		uint64_t *const v = r + (2 * i);
+		ZT_ARGON2_ROUND(v[0],v[1],v[16],v[17],v[32],v[33],v[48],v[49],v[64],v[65],v[80],v[81],v[96],v[97],v[112],v[113]);
+	}
+
+	for(unsigned int i=0;i<ZT_ARGON2_BLOCK_WORDS;++i)
+		next[i] = tmp[i] ^ r[i];
+}
+
+#undef ZT_ARGON2_ROUND
+#undef ZT_ARGON2_G
+
+} // anonymous namespace
+
+bool Argon2id(const void *pass,unsigned int passlen,const void *salt,unsigned int saltlen,const void *secret,unsigned int secretlen,const void *ad,unsigned int adlen,uint32_t passes,uint32_t memoryKiB,uint32_t lanes,uint8_t *out,unsigned int outlen)
+{
+	if ((passes < 1)||(lanes < 1)||(lanes > 255)||(saltlen < 8)||(outlen < 4)||(memoryKiB < (8 * lanes)))
+		return false;
+	if ((!secret)&&(secretlen))
+		return false;
+	if ((!ad)&&(adlen))
+		return false;
+
+	const uint64_t segmentLength = (uint64_t)memoryKiB / ((uint64_t)lanes * ZT_ARGON2_SYNC_POINTS);
+	const uint64_t laneLength = segmentLength * ZT_ARGON2_SYNC_POINTS;
+	const uint64_t blockCount = laneLength * lanes;
+	uint64_t *const memory = new (std::nothrow) uint64_t[(size_t)(blockCount * ZT_ARGON2_BLOCK_WORDS)];
+	if (!memory)
+		return false;
+
+	// H0 covers every parameter and input, and seeds the first two blocks of each lane
+	uint8_t seed[72];
+	{
+		Blake2b h(64);
+		h.update32(lanes);
+		h.update32(outlen);
+		h.update32(memoryKiB);
+		h.update32(passes);
+		h.update32(ZT_ARGON2_VERSION);
+		h.update32(ZT_ARGON2_TYPE_ID);
+		h.update32(passlen);
+		h.update(pass,passlen);
+		h.update32(saltlen);
+		h.update(salt,saltlen);
+		h.update32(secretlen);
+		if (secretlen)
+			h.update(secret,secretlen);
+		h.update32(adlen);
+		if (adlen)
+			h.update(ad,adlen);
+		h.finish(seed);
+	}
+	uint8_t blockBytes[1024];
+	for(uint32_t l=0;l<lanes;++l) {
+		for(uint32_t b=0;b<2;++b) {
+			store32(seed + 64,b);
+			store32(seed + 68,l);
+			blake2bLong(blockBytes,1024,seed,72);
+			uint64_t *const blk = memory + (((l * laneLength) + b) * ZT_ARGON2_BLOCK_WORDS);
+			for(unsigned int i=0;i<ZT_ARGON2_BLOCK_WORDS;++i)
+				blk[i] = load64(blockBytes + (i * 8));
+		}
+	}
+
+	uint64_t zeroBlock[ZT_ARGON2_BLOCK_WORDS],inputBlock[ZT_ARGON2_BLOCK_WORDS],addressBlock[ZT_ARGON2_BLOCK_WORDS];
+	memset(zeroBlock,0,sizeof(zeroBlock));
+
+	for(uint32_t pss=0;pss<passes;++pss) {
+		for(uint32_t slice=0;slice<ZT_ARGON2_SYNC_POINTS;++slice) {
+			for(uint32_t lane=0;lane<lanes;++lane) {
+				// Argon2id addresses data-independently for the first half of the first pass
+				const bool dataIndependent = ((pss == 0)&&(slice < (ZT_ARGON2_SYNC_POINTS / 2)));
+				if (dataIndependent) {
+					memset(inputBlock,0,sizeof(inputBlock));
+					inputBlock[0] = pss;
+					inputBlock[1] = lane;
+					inputBlock[2] = slice;
+					inputBlock[3] = blockCount;
+					inputBlock[4] = passes;
+					inputBlock[5] = ZT_ARGON2_TYPE_ID;
+				}
+
+				uint64_t startIndex = 0;
+				if ((pss == 0)&&(slice == 0)) {
+					startIndex = 2;
+					if (dataIndependent) {
+						++inputBlock[6];
+						fillBlock(zeroBlock,inputBlock,addressBlock,false);
+						fillBlock(zeroBlock,addressBlock,addressBlock,false);
+					}
+				}
+
+				uint64_t currOffset = (lane * laneLength) + (slice * segmentLength) + startIndex;
+				uint64_t prevOffset = ((currOffset % laneLength) == 0) ? (currOffset + laneLength - 1) : (currOffset - 1);
+				for(uint64_t i=startIndex;i<segmentLength;++i,++currOffset,++prevOffset) {
+					if ((currOffset % laneLength) == 1)
+						prevOffset = currOffset - 1;
+
+					uint64_t pseudoRand;
+					if (dataIndependent) {
+						if ((i % ZT_ARGON2_BLOCK_WORDS) == 0) {
+							++inputBlock[6];
+							fillBlock(zeroBlock,inputBlock,addressBlock,false);
+							fillBlock(zeroBlock,addressBlock,addressBlock,false);
+						}
+						pseudoRand = addressBlock[i % ZT_ARGON2_BLOCK_WORDS];
+					} else {
+						pseudoRand = memory[prevOffset * ZT_ARGON2_BLOCK_WORDS];
+					}
+
+					uint64_t refLane = (pseudoRand >> 32) % lanes;
+					if ((pss == 0)&&(slice == 0))
+						refLane = lane;
+					const bool sameLane = (refLane == lane);
+
+					// Map the low 32 bits of pseudoRand onto the blocks this one may reference
+					uint64_t refAreaSize;
+					if (pss == 0) {
+						if (slice == 0) {
+							refAreaSize = i - 1;
+						} else if (sameLane) {
+							refAreaSize = (slice * segmentLength) + i - 1;
+						} else {
+							refAreaSize = (slice * segmentLength) - ((i == 0) ? 1 : 0);
+						}
+					} else {
+						if (sameLane) {
+							refAreaSize = laneLength - segmentLength + i - 1;
+						} else {
+							refAreaSize = laneLength - segmentLength - ((i == 0) ? 1 : 0);
+						}
+					}
+					uint64_t relPos = pseudoRand & 0xffffffffULL;
+					relPos = (relPos * relPos) >> 32;
+					relPos = refAreaSize - 1 - ((refAreaSize * relPos) >> 32);
+					const uint64_t startPos = ((pss == 0)||(slice == (ZT_ARGON2_SYNC_POINTS - 1))) ? 0 : ((slice + 1) * segmentLength);
+					const uint64_t refIndex = (startPos + relPos) % laneLength;
+
+					fillBlock(
+						memory + (prevOffset * ZT_ARGON2_BLOCK_WORDS),
+						memory + (((refLane * laneLength) + refIndex) * ZT_ARGON2_BLOCK_WORDS),
+						memory + (currOffset * ZT_ARGON2_BLOCK_WORDS),
+						pss != 0);
+				}
+			}
+		}
+	}
+
+	// The tag is H' over the XOR of the last block of every lane
+	uint64_t *const acc = memory + ((laneLength - 1) * ZT_ARGON2_BLOCK_WORDS);
+	for(uint32_t l=1;l<lanes;++l) {
+		const uint64_t *const last = memory + (((l * laneLength) + laneLength - 1) * ZT_ARGON2_BLOCK_WORDS);
+		for(unsigned int i=0;i<ZT_ARGON2_BLOCK_WORDS;++i)
+			acc[i] ^= last[i];
+	}
+	for(unsigned int i=0;i<ZT_ARGON2_BLOCK_WORDS;++i)
+		store64(blockBytes + (i * 8),acc[i]);
+	blake2bLong(out,outlen,blockBytes,1024);
+
+	Utils::burn(memory,(unsigned int)(blockCount * ZT_ARGON2_BLOCK_WORDS * 8));
+	delete [] memory;
+	Utils::burn(seed,sizeof(seed));
+	Utils::burn(blockBytes,sizeof(blockBytes));
+	Utils::burn(addressBlock,sizeof(addressBlock));
+
+	return true;
+}
+
+} // namespace ZeroTier
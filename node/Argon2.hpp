@@ -0,0 +1,47 @@
+/*
+ * Copyright (c)2013-2020 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2025-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+#ifndef ZT_ARGON2_HPP
+#define ZT_ARGON2_HPP
+
+#include "Constants.hpp"
+
+namespace ZeroTier {
+
+/**
+ * Compute Argon2id version 1.3 (RFC 9106)
+ *
+ * This is a portable single-threaded implementation for deriving keys from
+ * passphrases. Lanes are filled one after another, which gives the same
+ * result as filling them in parallel.
+ *
+ * @param pass Password
+ * @param passlen Length of password in bytes
+ * @param salt Salt (at least 8 bytes)
+ * @param saltlen Length of salt in bytes
+ * @param secret Optional secret value K, or NULL
+ * @param secretlen Length of secret in bytes
+ * @param ad Optional associated data X, or NULL
+ * @param adlen Length of associated data in bytes
+ * @param passes Number of passes t (at least 1)
+ * @param memoryKiB Memory size m in KiB (at least 8 times lanes)
+ * @param lanes Degree of parallelism p (1 to 255)
+ * @param out Buffer to receive tag
+ * @param outlen Length of tag in bytes (at least 4)
+ * @return False if a parameter is out of range or memory could not be allocated
+ */
+bool Argon2id(const void *pass,unsigned int passlen,const void *salt,unsigned int saltlen,const void *secret,unsigned int secretlen,const void *ad,unsigned int adlen,uint32_t passes,uint32_t memoryKiB,uint32_t lanes,uint8_t *out,unsigned int outlen);
+
+} // namespace ZeroTier
+
+#endif
@@ -123,8 +123,28 @@ bool Identity::locallyValidate() const
 }
 
 char *Identity::toString(bool includePrivate,char buf[ZT_IDENTITY_STRING_BUFFER_LENGTH]) const
+{
+	return toString(includePrivate,buf,Utils::ENCODING_HEX);
+}
+
+char *Identity::toString(bool includePrivate,char buf[ZT_IDENTITY_STRING_BUFFER_LENGTH],Utils::Encoding enc) const
 {
 	char *p = buf;
+	if (enc == Utils::ENCODING_BASE32) {
+		_address.toString(p,enc);
+		p += strlen(p);
+		*(p++) = ':';
+		*(p++) = '0';
+		*(p++) = ':';
+		Utils::b32e(_publicKey.data,ZT_C25519_PUBLIC_KEY_LEN,p);
+		p += strlen(p);
+		if ((_privateKey)&&(includePrivate)) {
+			*(p++) = ':';
+			Utils::b32e(_privateKey->data,ZT_C25519_PRIVATE_KEY_LEN,p);
+		}
+		return buf;
+	}
+
 	Utils::hex10(_address.toInt(),p);
 	p += 10;
 	*(p++) = ':';
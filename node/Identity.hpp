@@ -258,6 +258,19 @@ public:
 	 */
 	char *toString(bool includePrivate,char buf[ZT_IDENTITY_STRING_BUFFER_LENGTH]) const;
 
+	/**
+	 * Serialize to a more human-friendly string in the given encoding
+	 *
+	 * Base32 encodes the address and keys, keeping the same fields and
+	 * separators. This is for display only: fromString() reads hex.
+	 *
+	 * @param includePrivate If true, include private key (if it exists)
+	 * @param buf Buffer to store string
+	 * @param enc Encoding of the address and keys
+	 * @return ASCII string representation of identity
+	 */
+	char *toString(bool includePrivate,char buf[ZT_IDENTITY_STRING_BUFFER_LENGTH],Utils::Encoding enc) const;
+
 	/**
 	 * Deserialize a human-friendly string
 	 *
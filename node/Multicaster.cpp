@@ -224,7 +224,7 @@ void Multicaster::send(
 
 		Address activeBridges[ZT_MAX_NETWORK_SPECIALISTS];
 		const unsigned int activeBridgeCount = network->config().activeBridges(activeBridges);
-		const unsigned int limit = network->config().multicastLimit;
+		const unsigned int limit = network->multicastLimit();
 
 		if (gs.members.size() >= limit) {
 			// Skip queue if we already have enough members to complete the send operation
@@ -550,8 +550,11 @@ Network::Network(const RuntimeEnvironment *renv,void *tPtr,uint64_t nwid,void *u
 	_lastConfigUpdate(0),
 	_destroyed(false),
 	_netconfFailure(NETCONF_FAILURE_NONE),
-	_portError(0)
+	_portError(0),
+	_localMulticastLimit(0),
+	_localBridging(true)
 {
+	_authToken[0] = (char)0;
 	for(int i=0;i<ZT_NETWORK_MAX_INCOMING_UPDATES;++i)
 		_incomingConfigChunks[i].ts = 0;
 
@@ -1040,6 +1043,27 @@ int Network::setConfiguration(void *tPtr,const NetworkConfig &nconf,bool saveToD
 	return 0;
 }
 
+bool Network::bridgingAllowed() const
+{
+	return ((_localBridging)&&(_config.permitsBridging(RR->identity.address())));
+}
+
+void Network::setLocalLimits(void *tPtr,unsigned int multicastLimit,bool allowBridging)
+{
+	ZT_VirtualNetworkConfig ctmp;
+	bool bridgingChanged;
+	{
+		Mutex::Lock _l(_lock);
+		_localMulticastLimit = multicastLimit;
+		bridgingChanged = ((_localBridging != allowBridging)&&(_portInitialized));
+		_localBridging = allowBridging;
+		if (bridgingChanged)
+			_externalConfig(&ctmp);
+	}
+	if (bridgingChanged)
+		_portError = RR->node->configureVirtualNetworkPort(tPtr,_id,&_uPtr,ZT_VIRTUAL_NETWORK_CONFIG_OPERATION_CONFIG_UPDATE,&ctmp);
+}
+
 void Network::requestConfiguration(void *tPtr)
 {
 	if (_destroyed)
@@ -1191,6 +1215,11 @@ void Network::requestConfiguration(void *tPtr)
 	rmd.add(ZT_NETWORKCONFIG_REQUEST_METADATA_KEY_MAX_NETWORK_TAGS,(uint64_t)ZT_MAX_NETWORK_TAGS);
 	rmd.add(ZT_NETWORKCONFIG_REQUEST_METADATA_KEY_FLAGS,(uint64_t)0);
 	rmd.add(ZT_NETWORKCONFIG_REQUEST_METADATA_KEY_RULES_ENGINE_REV,(uint64_t)ZT_RULES_ENGINE_REVISION);
+	{
+		Mutex::Lock _l(_lock);
+		if (_authToken[0])
+			rmd.add(ZT_NETWORKCONFIG_REQUEST_METADATA_KEY_AUTH,_authToken);
+	}
 
 	RR->t->networkConfigRequestSent(tPtr,*this,ctrl);
 
@@ -1397,7 +1426,7 @@ void Network::_externalConfig(ZT_VirtualNetworkConfig *ec) const
 	ec->mtu = (_config) ? _config.mtu : ZT_DEFAULT_MTU;
 	ec->dhcp = 0;
 	std::vector<Address> ab(_config.activeBridges());
-	ec->bridge = (std::find(ab.begin(),ab.end(),RR->identity.address()) != ab.end()) ? 1 : 0;
+	ec->bridge = ((_localBridging)&&(std::find(ab.begin(),ab.end(),RR->identity.address()) != ab.end())) ? 1 : 0;
 	ec->broadcastEnabled = (_config) ? (_config.enableBroadcast() ? 1 : 0) : 0;
 	ec->portError = _portError;
 	ec->netconfRevision = (_config) ? (unsigned long)_config.revision : 0;
@@ -40,6 +40,7 @@
 
 #define ZT_NETWORK_MAX_INCOMING_UPDATES 3
 #define ZT_NETWORK_MAX_UPDATE_CHUNKS ((ZT_NETWORKCONFIG_DICT_CAPACITY / 1024) + 1)
+#define ZT_NETWORK_AUTH_TOKEN_MAX_LENGTH 512
 
 namespace ZeroTier {
 
@@ -89,6 +90,20 @@ public:
 	inline const NetworkConfig &config() const { return _config; }
 	inline const MAC &mac() const { return _mac; }
 
+	/**
+	 * @return Multicast recipient limit: the controller's, or a lower local limit if one is set
+	 */
+	inline unsigned int multicastLimit() const
+	{
+		const unsigned int l = _config.multicastLimit;
+		return ((_localMulticastLimit)&&(_localMulticastLimit < l)) ? _localMulticastLimit : l;
+	}
+
+	/**
+	 * @return True if the controller designates this node a bridge and local settings allow it
+	 */
+	bool bridgingAllowed() const;
+
 	/**
 	 * Apply filters to an outgoing packet
 	 *
@@ -220,6 +235,28 @@ public:
 		_netconfFailure = NETCONF_FAILURE_NOT_FOUND;
 	}
 
+	/**
+	 * Set a token to present to the controller as join authorization with config requests
+	 *
+	 * @param token Token or NULL/empty to clear
+	 */
+	inline void setAuthToken(const char *token)
+	{
+		Mutex::Lock _l(_lock);
+		Utils::scopy(_authToken,sizeof(_authToken),(token) ? token : "");
+	}
+
+	/**
+	 * Set local limits that can only be more restrictive than the controller's config
+	 *
+	 * If bridging changes and the port is up, the port is sent a config update.
+	 *
+	 * @param tPtr Thread pointer to be handed through to any callbacks called as a result of this call
+	 * @param multicastLimit Maximum multicast recipients, or 0 to use the controller's limit
+	 * @param allowBridging If false, do not bridge even if the controller designates this node a bridge
+	 */
+	void setLocalLimits(void *tPtr,unsigned int multicastLimit,bool allowBridging);
+
 	/**
 	 * Causes this network to request an updated configuration from its master node now
 	 *
@@ -439,6 +476,11 @@ private:
 	} _netconfFailure;
 	int _portError; // return value from port config callback
 
+	char _authToken[ZT_NETWORK_AUTH_TOKEN_MAX_LENGTH];
+
+	unsigned int _localMulticastLimit; // 0 to use the controller's limit
+	bool _localBridging;
+
 	Hashtable<Address,Membership> _memberships;
 
 	Mutex _lock;
@@ -453,6 +453,99 @@ ZT_ResultCode Node::deorbit(void *tptr,uint64_t moonWorldId)
 	return ZT_RESULT_OK;
 }
 
+ZT_ResultCode Node::tryPeer(void *tptr,uint64_t address,const struct sockaddr_storage *addr)
+{
+	if (!addr)
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	const InetAddress *const a = reinterpret_cast<const InetAddress *>(addr);
+	if (((a->ss_family != AF_INET)&&(a->ss_family != AF_INET6))||(a->port() == 0))
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	const SharedPtr<Peer> p(RR->topology->getPeer(tptr,Address(address)));
+	if (!p)
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	p->attemptToContactAt(tptr,-1,*a,_now,true);
+	return ZT_RESULT_OK;
+}
+
+ZT_ResultCode Node::setPeerPreferredPath(void *tptr,uint64_t address,const struct sockaddr_storage *addr)
+{
+	const SharedPtr<Peer> p(RR->topology->getPeer(tptr,Address(address)));
+	if (!p)
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	return (p->setPreferredPath(_now,(addr) ? *reinterpret_cast<const InetAddress *>(addr) : InetAddress())) ? ZT_RESULT_OK : ZT_RESULT_ERROR_BAD_PARAMETER;
+}
+
+ZT_ResultCode Node::refreshNetworkConfig(void *tptr,uint64_t nwid)
+{
+	const SharedPtr<Network> nw(this->network(nwid));
+	if (!nw)
+		return ZT_RESULT_ERROR_NETWORK_NOT_FOUND;
+	nw->requestConfiguration(tptr);
+	return ZT_RESULT_OK;
+}
+
+ZT_ResultCode Node::setNetworkAuthToken(void *tptr,uint64_t nwid,const char *token)
+{
+	if ((token)&&(strlen(token) >= ZT_NETWORK_AUTH_TOKEN_MAX_LENGTH))
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	const SharedPtr<Network> nw(this->network(nwid));
+	if (!nw)
+		return ZT_RESULT_ERROR_NETWORK_NOT_FOUND;
+	nw->setAuthToken(token);
+	if ((token)&&(token[0]))
+		nw->requestConfiguration(tptr);
+	return ZT_RESULT_OK;
+}
+
+ZT_ResultCode Node::addPeer(void *tptr,const char *identity,int *existing)
+{
+	Identity id;
+	if ((!identity)||(!id.fromString(identity))||(id.address() == RR->identity.address())||(!id.locallyValidate()))
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	RR->topology->getPeer(tptr,id.address()); // loads a cached peer, if any, so addPeer() below returns it
+	const SharedPtr<Peer> np(new Peer(RR,RR->identity,id));
+	const SharedPtr<Peer> p(RR->topology->addPeer(tptr,np));
+	if (p == np) {
+		if (existing)
+			*existing = 0;
+		return ZT_RESULT_OK;
+	}
+	const bool same = (p->identity() == id);
+	if (existing)
+		*existing = (same) ? 1 : 2;
+	return (same) ? ZT_RESULT_OK : ZT_RESULT_ERROR_BAD_PARAMETER;
+}
+
+ZT_ResultCode Node::peerIdentity(void *tptr,uint64_t address,char *buf,unsigned int buflen)
+{
+	if ((!buf)||(buflen < ZT_IDENTITY_STRING_BUFFER_LENGTH))
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	SharedPtr<Peer> p(RR->topology->getPeer(tptr,Address(address)));
+	if (!p) // a peer just loaded from the cache is only returned by the next lookup
+		p = RR->topology->getPeer(tptr,Address(address));
+	if (!p)
+		return ZT_RESULT_ERROR_BAD_PARAMETER;
+	p->identity().toString(false,buf);
+	return ZT_RESULT_OK;
+}
+
+int Node::peerProtocolVersion(uint64_t address) const
+{
+	SharedPtr<Peer> p(RR->topology->getPeerNoCache(Address(address)));
+	if ((!p)||(!p->remoteVersionKnown()))
+		return -1;
+	return (int)p->remoteVersionProtocol();
+}
+
+ZT_ResultCode Node::setNetworkLocalLimits(void *tptr,uint64_t nwid,unsigned int multicastLimit,bool allowBridging)
+{
+	const SharedPtr<Network> nw(this->network(nwid));
+	if (!nw)
+		return ZT_RESULT_ERROR_NETWORK_NOT_FOUND;
+	nw->setLocalLimits(tptr,multicastLimit,allowBridging);
+	return ZT_RESULT_OK;
+}
+
 uint64_t Node::address() const
 {
 	return RR->identity.address().toInt();
@@ -505,6 +598,7 @@ ZT_PeerList *Node::peers() const
 			p->paths[p->pathCount].lastSend = (*path)->lastOut();
 			p->paths[p->pathCount].lastReceive = (*path)->lastIn();
 			p->paths[p->pathCount].trustedPathId = RR->topology->getOutboundPathTrust((*path)->address());
+			p->paths[p->pathCount].latencyMean = ((*path)->latency() >= 0xffff) ? -1.0f : (float)(*path)->latency();
 			p->paths[p->pathCount].expired = 0;
 			p->paths[p->pathCount].preferred = ((*path) == bestp) ? 1 : 0;
 			p->paths[p->pathCount].scope = (*path)->ipScope();
@@ -658,6 +752,21 @@ std::vector<World> Node::moons() const
 	return RR->topology->moons();
 }
 
+std::vector<uint64_t> Node::moonsWanted() const
+{
+	return RR->topology->moonsWanted();
+}
+
+bool Node::planetIsDefault() const
+{
+	return Topology::isDefaultPlanet(RR->topology->planet());
+}
+
+bool Node::resetRoots(void *tptr)
+{
+	return RR->topology->resetRoots(tptr);
+}
+
 void Node::ncSendConfig(uint64_t nwid,uint64_t requestPacketId,const Address &destination,const NetworkConfig &nc,bool sendLegacyFormatConfig)
 {
 	_localControllerAuthorizations_m.lock();
@@ -910,6 +1019,69 @@ enum ZT_ResultCode ZT_Node_deorbit(ZT_Node *node,void *tptr,uint64_t moonWorldId
 	}
 }
 
+enum ZT_ResultCode ZT_Node_tryPeer(ZT_Node *node,void *tptr,uint64_t address,const struct sockaddr_storage *addr)
+{
+	try {
+		return reinterpret_cast<ZeroTier::Node *>(node)->tryPeer(tptr,address,addr);
+	} catch ( ... ) {
+		return ZT_RESULT_FATAL_ERROR_INTERNAL;
+	}
+}
+
+enum ZT_ResultCode ZT_Node_setPeerPreferredPath(ZT_Node *node,void *tptr,uint64_t address,const struct sockaddr_storage *addr)
+{
+	try {
+		return reinterpret_cast<ZeroTier::Node *>(node)->setPeerPreferredPath(tptr,address,addr);
+	} catch ( ... ) {
+		return ZT_RESULT_FATAL_ERROR_INTERNAL;
+	}
+}
+
+enum ZT_ResultCode ZT_Node_refreshNetworkConfig(ZT_Node *node,void *tptr,uint64_t nwid)
+{
+	try {
+		return reinterpret_cast<ZeroTier::Node *>(node)->refreshNetworkConfig(tptr,nwid);
+	} catch ( ... ) {
+		return ZT_RESULT_FATAL_ERROR_INTERNAL;
+	}
+}
+
+enum ZT_ResultCode ZT_Node_setNetworkAuthToken(ZT_Node *node,void *tptr,uint64_t nwid,const char *token)
+{
+	try {
+		return reinterpret_cast<ZeroTier::Node *>(node)->setNetworkAuthToken(tptr,nwid,token);
+	} catch ( ... ) {
+		return ZT_RESULT_FATAL_ERROR_INTERNAL;
+	}
+}
+
+enum ZT_ResultCode ZT_Node_addPeer(ZT_Node *node,void *tptr,const char *identity,int *existing)
+{
+	try {
+		return reinterpret_cast<ZeroTier::Node *>(node)->addPeer(tptr,identity,existing);
+	} catch ( ... ) {
+		return ZT_RESULT_FATAL_ERROR_INTERNAL;
+	}
+}
+
+enum ZT_ResultCode ZT_Node_peerIdentity(ZT_Node *node,void *tptr,uint64_t address,char *buf,unsigned int buflen)
+{
+	try {
+		return reinterpret_cast<ZeroTier::Node *>(node)->peerIdentity(tptr,address,buf,buflen);
+	} catch ( ... ) {
+		return ZT_RESULT_FATAL_ERROR_INTERNAL;
+	}
+}
+
+enum ZT_ResultCode ZT_Node_setNetworkLocalLimits(ZT_Node *node,void *tptr,uint64_t nwid,unsigned int multicastLimit,int allowBridging)
+{
+	try {
+		return reinterpret_cast<ZeroTier::Node *>(node)->setNetworkLocalLimits(tptr,nwid,multicastLimit,(allowBridging != 0));
+	} catch ( ... ) {
+		return ZT_RESULT_FATAL_ERROR_INTERNAL;
+	}
+}
+
 uint64_t ZT_Node_address(ZT_Node *node)
 {
 	return reinterpret_cast<ZeroTier::Node *>(node)->address();
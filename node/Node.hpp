@@ -89,6 +89,14 @@ public:
 	ZT_ResultCode multicastUnsubscribe(uint64_t nwid,uint64_t multicastGroup,unsigned long multicastAdi);
 	ZT_ResultCode orbit(void *tptr,uint64_t moonWorldId,uint64_t moonSeed);
 	ZT_ResultCode deorbit(void *tptr,uint64_t moonWorldId);
+	ZT_ResultCode tryPeer(void *tptr,uint64_t address,const struct sockaddr_storage *addr);
+	ZT_ResultCode setPeerPreferredPath(void *tptr,uint64_t address,const struct sockaddr_storage *addr);
+	ZT_ResultCode refreshNetworkConfig(void *tptr,uint64_t nwid);
+	ZT_ResultCode setNetworkAuthToken(void *tptr,uint64_t nwid,const char *token);
+	ZT_ResultCode addPeer(void *tptr,const char *identity,int *existing);
+	ZT_ResultCode peerIdentity(void *tptr,uint64_t address,char *buf,unsigned int buflen);
+	int peerProtocolVersion(uint64_t address) const; // not in ZT_Peer to keep its layout
+	ZT_ResultCode setNetworkLocalLimits(void *tptr,uint64_t nwid,unsigned int multicastLimit,bool allowBridging);
 	uint64_t address() const;
 	void status(ZT_NodeStatus *status) const;
 	ZT_PeerList *peers() const;
@@ -184,6 +192,9 @@ public:
 
 	World planet() const;
 	std::vector<World> moons() const;
+	std::vector<uint64_t> moonsWanted() const;
+	bool planetIsDefault() const;
+	bool resetRoots(void *tptr);
 
 	inline const Identity &identity() const { return _RR.identity; }
 
@@ -230,6 +230,16 @@ SharedPtr<Path> Peer::getAppropriatePath(int64_t now, bool includeExpired, int32
 	if (!_bondToPeer) {
 		Mutex::Lock _l(_paths_m);
 		unsigned int bestPath = ZT_MAX_PEER_NETWORK_PATHS;
+		if (_preferredPath) {
+			// A pinned path wins for as long as it stays alive, after which normal selection resumes
+			for(unsigned int i=0;i<ZT_MAX_PEER_NETWORK_PATHS;++i) {
+				if (_paths[i].p) {
+					if (((now - _paths[i].lr) < ZT_PEER_PATH_EXPIRATION)&&(_paths[i].p->address() == _preferredPath))
+						return _paths[i].p;
+				} else break;
+			}
+			_preferredPath = InetAddress();
+		}
 		/**
 		 * Send traffic across the highest quality path only. This algorithm will still
 		 * use the old path quality metric from protocol version 9.
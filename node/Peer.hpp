@@ -123,6 +123,33 @@ public:
 		return false;
 	}
 
+	/**
+	 * Pin a known path so it is used ahead of better paths until it expires
+	 *
+	 * This is ignored while the peer is bonded, since bonds do their own path selection.
+	 *
+	 * @param now Current time
+	 * @param addr Remote address of an active path or a nil address to clear
+	 * @return True if cleared or addr matches an active path
+	 */
+	inline bool setPreferredPath(int64_t now,const InetAddress &addr)
+	{
+		Mutex::Lock _l(_paths_m);
+		if (addr) {
+			for(unsigned int i=0;i<ZT_MAX_PEER_NETWORK_PATHS;++i) {
+				if (_paths[i].p) {
+					if (((now - _paths[i].lr) < ZT_PEER_PATH_EXPIRATION)&&(_paths[i].p->address() == addr)) {
+						_preferredPath = addr;
+						return true;
+					}
+				} else break;
+			}
+			return false;
+		}
+		_preferredPath = InetAddress();
+		return true;
+	}
+
 	/**
 	 * Send via best direct path
 	 *
@@ -574,6 +601,7 @@ private:
 	uint16_t _vRevision;
 
 	_PeerPath _paths[ZT_MAX_PEER_NETWORK_PATHS];
+	InetAddress _preferredPath; // pinned by user, nil if none
 	Mutex _paths_m;
 
 	Identity _id;
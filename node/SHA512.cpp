@@ -248,6 +248,33 @@ void HMACSHA384(const uint8_t key[ZT_SYMMETRIC_KEY_SIZE],const void *msg,const u
 	SHA384(mac,outer,176);
 }
 
+void HMACSHA384(const void *key,const unsigned int keylen,const void *msg,const unsigned int msglen,uint8_t mac[48])
+{
+	uint8_t kInPadded[128]; // input padded key
+	uint8_t outer[176]; // output padded key | H(input padded key | msg)
+
+	// Keys longer than the block size are hashed first, shorter ones are zero padded (RFC 2104)
+	uint8_t k[128];
+	memset(k,0,sizeof(k));
+	if (keylen > 128)
+		SHA384(k,key,keylen);
+	else if (keylen > 0)
+		memcpy(k,key,keylen);
+
+	for(unsigned int i=0;i<128;++i) {
+		kInPadded[i] = k[i] ^ 0x36;
+		outer[i] = k[i] ^ 0x5c;
+	}
+
+	// H(output padded key | H(input padded key | msg))
+	SHA384(outer + 128,kInPadded,128,msg,msglen);
+	SHA384(mac,outer,176);
+
+	Utils::burn(k,sizeof(k));
+	Utils::burn(kInPadded,sizeof(kInPadded));
+	Utils::burn(outer,sizeof(outer));
+}
+
 void KBKDFHMACSHA384(const uint8_t key[ZT_SYMMETRIC_KEY_SIZE],const char label,const char context,const uint32_t iter,uint8_t out[ZT_SYMMETRIC_KEY_SIZE])
 {
 	uint8_t kbkdfMsg[13];
@@ -72,6 +72,17 @@ void SHA384(void *digest,const void *data0,unsigned int len0,const void *data1,u
  */
 void HMACSHA384(const uint8_t key[ZT_SYMMETRIC_KEY_SIZE],const void *msg,unsigned int msglen,uint8_t mac[48]);
 
+/**
+ * Compute HMAC SHA-384 with a key of any length (RFC 2104)
+ *
+ * @param key Secret key
+ * @param keylen Length of key in bytes
+ * @param msg Message to HMAC
+ * @param msglen Length of message
+ * @param mac Buffer to fill with result
+ */
+void HMACSHA384(const void *key,unsigned int keylen,const void *msg,unsigned int msglen,uint8_t mac[48]);
+
 /**
  * Compute KBKDF (key-based key derivation function) using HMAC-SHA-384 as a PRF
  *
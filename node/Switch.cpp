@@ -283,7 +283,7 @@ void Switch::onLocalEthernet(void *tPtr,const SharedPtr<Network> &network,const
 	// Check if this packet is from someone other than the tap -- i.e. bridged in
 	bool fromBridged;
 	if ((fromBridged = (from != network->mac()))) {
-		if (!network->config().permitsBridging(RR->identity.address())) {
+		if (!network->bridgingAllowed()) {
 			RR->t->outgoingNetworkFrameDropped(tPtr,network,from,to,etherType,vlanId,len,"not a bridge");
 			return;
 		}
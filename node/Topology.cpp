@@ -42,12 +42,7 @@ Topology::Topology(const RuntimeEnvironment *renv,void *tPtr) :
 		} catch ( ... ) {} // ignore invalid cached planets
 	}
 
-	World defaultPlanet;
-	{
-		Buffer<ZT_DEFAULT_WORLD_LENGTH> wtmp(ZT_DEFAULT_WORLD,ZT_DEFAULT_WORLD_LENGTH);
-		defaultPlanet.deserialize(wtmp,0); // throws on error, which would indicate a bad static variable up top
-	}
-	addWorld(tPtr,defaultPlanet,false);
+	addWorld(tPtr,defaultPlanet(),false);
 }
 
 Topology::~Topology()
@@ -328,6 +323,55 @@ void Topology::removeMoon(void *tPtr,const uint64_t id)
 	_memoizeUpstreams(tPtr);
 }
 
+bool Topology::resetRoots(void *tPtr)
+{
+	Mutex::Lock _l2(_peers_m);
+	Mutex::Lock _l1(_upstreams_m);
+
+	bool changed = false;
+
+	if (!isDefaultPlanet(_planet)) {
+		_planet = defaultPlanet();
+		try {
+			Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> sbuf;
+			_planet.serialize(sbuf,false);
+			uint64_t idtmp[2];
+			idtmp[0] = _planet.id(); idtmp[1] = 0;
+			RR->node->stateObjectPut(tPtr,ZT_STATE_OBJECT_PLANET,idtmp,sbuf.data(),sbuf.size());
+		} catch ( ... ) {}
+		changed = true;
+	}
+
+	for(std::vector<World>::const_iterator m(_moons.begin());m!=_moons.end();++m) {
+		uint64_t idtmp[2];
+		idtmp[0] = m->id(); idtmp[1] = 0;
+		RR->node->stateObjectDelete(tPtr,ZT_STATE_OBJECT_MOON,idtmp);
+		changed = true;
+	}
+	_moons.clear();
+	if (!_moonSeeds.empty()) {
+		_moonSeeds.clear();
+		changed = true;
+	}
+
+	_memoizeUpstreams(tPtr);
+
+	return changed;
+}
+
+World Topology::defaultPlanet()
+{
+	World w;
+	Buffer<ZT_DEFAULT_WORLD_LENGTH> wtmp(ZT_DEFAULT_WORLD,ZT_DEFAULT_WORLD_LENGTH);
+	w.deserialize(wtmp,0); // throws on error, which would indicate a bad static variable up top
+	return w;
+}
+
+bool Topology::isDefaultPlanet(const World &w)
+{
+	return (w.id() == defaultPlanet().id());
+}
+
 void Topology::doPeriodicTasks(void *tPtr,int64_t now)
 {
 	{
@@ -269,6 +269,28 @@ public:
 	 */
 	void removeMoon(void *tPtr,const uint64_t id);
 
+	/**
+	 * Go back to the planet compiled into this build and leave all moons
+	 *
+	 * Cached state for the replaced planet and all moons is overwritten or
+	 * deleted, so the reset survives a restart.
+	 *
+	 * @param tPtr Thread pointer to be handed through to any callbacks called as a result of this call
+	 * @return True if anything was changed (false if roots were already at defaults)
+	 */
+	bool resetRoots(void *tPtr);
+
+	/**
+	 * @return Planet compiled into this build
+	 */
+	static World defaultPlanet();
+
+	/**
+	 * @param w Planet to check
+	 * @return True if this is the built-in planet or an update to it (same world ID)
+	 */
+	static bool isDefaultPlanet(const World &w);
+
 	/**
 	 * Clean and flush database
 	 */
@@ -92,6 +92,7 @@ namespace ZeroTier {
 const uint64_t Utils::ZERO256[4] = {0ULL,0ULL,0ULL,0ULL};
 
 const char Utils::HEXCHARS[16] = { '0','1','2','3','4','5','6','7','8','9','a','b','c','d','e','f' };
+const char Utils::BASE32CHARS[32] = { 'a','b','c','d','e','f','g','h','i','j','k','l','m','n','o','p','q','r','s','t','u','v','w','x','y','z','2','3','4','5','6','7' };
 
 #ifdef ZT_ARCH_ARM_HAS_NEON
 Utils::ARMCapabilities::ARMCapabilities() noexcept
@@ -212,6 +213,24 @@ char *Utils::decimal(unsigned long n,char s[24])
 	return s;
 }
 
+char *Utils::b32e(const void *d,unsigned int l,char *s)
+{
+	char *const save = s;
+	unsigned int acc = 0,bits = 0;
+	for(unsigned int i=0;i<l;++i) {
+		acc = (acc << 8) | (unsigned int)reinterpret_cast<const uint8_t *>(d)[i];
+		bits += 8;
+		while (bits >= 5) {
+			bits -= 5;
+			*(s++) = BASE32CHARS[(acc >> bits) & 0x1f];
+		}
+	}
+	if (bits > 0)
+		*(s++) = BASE32CHARS[(acc << (5 - bits)) & 0x1f];
+	*s = (char)0;
+	return save;
+}
+
 void Utils::getSecureRandom(void *buf,unsigned int bytes)
 {
 	static Mutex globalLock;
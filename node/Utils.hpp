@@ -62,6 +62,15 @@ class Utils
 public:
 	static const uint64_t ZERO256[4];
 
+	/**
+	 * Text encodings for printing binary values such as addresses and keys
+	 */
+	enum Encoding
+	{
+		ENCODING_HEX = 0,
+		ENCODING_BASE32 = 1
+	};
+
 #ifdef ZT_ARCH_ARM_HAS_NEON
 	struct ARMCapabilities
 	{
@@ -285,6 +294,16 @@ public:
 		return l;
 	}
 
+	/**
+	 * Encode binary data as RFC 4648 base32 with lower case letters and no padding
+	 *
+	 * @param d Data to encode
+	 * @param l Length of data in bytes
+	 * @param s Buffer, at least ((l * 8) + 4) / 5 + 1 bytes in size
+	 * @return Pointer to s
+	 */
+	static char *b32e(const void *d,unsigned int l,char *s);
+
 	static inline float normalize(float value, float bigMin, float bigMax, float targetMin, float targetMax)
 	{
 		float bigSpan = bigMax - bigMin;
@@ -821,6 +840,7 @@ public:
 	 * Hexadecimal characters 0-f
 	 */
 	static const char HEXCHARS[16];
+	static const char BASE32CHARS[32];
 };
 
 } // namespace ZeroTier
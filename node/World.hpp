@@ -158,6 +158,23 @@ public:
 		return false;
 	}
 
+	/**
+	 * Check whether this World is signed by its own next-update key
+	 *
+	 * Moons created with genmoon are signed this way. Planet updates are signed
+	 * by the key named in the previous planet, so a valid planet may fail this.
+	 *
+	 * @return True if signature verifies against updatesMustBeSignedBy()
+	 */
+	inline bool verifySelfSigned() const
+	{
+		if (_type == TYPE_NULL)
+			return false;
+		Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> tmp;
+		serialize(tmp,true);
+		return C25519::verify(_updatesMustBeSignedBy,tmp.data(),tmp.size(),_signature);
+	}
+
 	/**
 	 * @return True if this World is non-empty
 	 */
@@ -2,6 +2,7 @@ CORE_OBJS=\
 	node/AES.o \
 	node/AES_aesni.o \
 	node/AES_armcrypto.o \
+	node/Argon2.o \
 	node/C25519.o \
 	node/Capability.o \
 	node/CertificateOfMembership.o \
@@ -38,6 +39,11 @@ ONE_OBJS=\
 	controller/FileDB.o \
 	controller/LFDB.o \
 	controller/PostgreSQL.o \
+	controller/SQLiteDB.o \
+	controller/AuditLog.o \
+	controller/ControllerStats.o \
+	controller/Webhooks.o \
+	controller/RulesCompiler.o \
 	osdep/EthernetTap.o \
 	osdep/ManagedRoute.o \
 	osdep/Http.o \
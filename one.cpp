@@ -19,6 +19,7 @@
 #include <stdlib.h>
 #include <string.h>
 #include <stdint.h>
+#include <stdarg.h>
 #include <time.h>
 #include <errno.h>
 
@@ -26,6 +27,7 @@
 
 #ifdef __WINDOWS__
 #include <WinSock2.h>
+#include <ws2tcpip.h>
 #include <Windows.h>
 #include <tchar.h>
 #include <wchar.h>
@@ -48,6 +50,9 @@
 #include <sys/uio.h>
 #include <dirent.h>
 #include <signal.h>
+#include <termios.h>
+#include <netdb.h>
+#include <sys/ioctl.h>
 #ifdef __LINUX__
 #include <sys/prctl.h>
 #include <sys/syscall.h>
@@ -56,7 +61,6 @@
 #include <sys/types.h>
 #include <sys/socket.h>
 #include <ifaddrs.h>
-#include <sys/ioctl.h>
 #ifndef ZT_NO_CAPABILITIES
 #include <linux/capability.h>
 #include <linux/securebits.h>
@@ -64,104 +68,5019 @@
 #endif
 #endif
 
-#include <string>
-#include <stdexcept>
-#include <iostream>
-#include <sstream>
-#include <algorithm>
+#include <string>
+#include <stdexcept>
+#include <iostream>
+#include <sstream>
+#include <algorithm>
+#include <thread>
+#include <atomic>
+
+#include "version.h"
+#include "include/ZeroTierOne.h"
+
+#include "node/Identity.hpp"
+#include "node/CertificateOfMembership.hpp"
+#include "node/Utils.hpp"
+#include "node/NetworkController.hpp"
+#include "node/Buffer.hpp"
+#include "node/World.hpp"
+#include "node/Topology.hpp"
+#include "node/AES.hpp"
+#include "node/Argon2.hpp"
+#include "node/MAC.hpp"
+
+#include "osdep/OSUtils.hpp"
+#include "osdep/Http.hpp"
+#include "osdep/Thread.hpp"
+
+#include "node/BondController.hpp"
+
+#include "service/OneService.hpp"
+
+#include "controller/FileDB.hpp"
+#include "controller/RulesCompiler.hpp"
+#include "controller/SQLiteDB.hpp"
+#include "controller/Webhooks.hpp"
+
+#include "ext/json/json.hpp"
+
+#ifdef __APPLE__
+#include <SystemConfiguration/SystemConfiguration.h>
+#include <CoreServices/CoreServices.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <ifaddrs.h>
+#endif
+
+#define ZT_PID_PATH "zerotier-one.pid"
+
+using namespace ZeroTier;
+
+static OneService *volatile zt1Service = (OneService *)0;
+
+// Encoding of addresses and identities in text output (--encoding=hex|base32).
+// JSON output and everything sent to the service keep the hex the API uses.
+static Utils::Encoding cliEncoding = Utils::ENCODING_HEX;
+
+// Parses an --encoding value, which zerotier-cli and zerotier-idtool both take
+static bool cliParseEncoding(const std::string &s,Utils::Encoding &enc)
+{
+	if (s == "hex")
+		enc = Utils::ENCODING_HEX;
+	else if (s == "base32")
+		enc = Utils::ENCODING_BASE32;
+	else return false;
+	return true;
+}
+
+// An address from the API in the chosen encoding; anything that isn't an address is left alone
+static std::string cliAddress(const std::string &a)
+{
+	if ((cliEncoding == Utils::ENCODING_HEX)||(a.length() != ZT_ADDRESS_LENGTH_HEX)||(a.find_first_not_of("0123456789abcdef") != std::string::npos))
+		return a;
+	char tmp[16];
+	return std::string(Address(Utils::hexStrToU64(a.c_str())).toString(tmp,cliEncoding));
+}
+
+#define PROGRAM_NAME "ZeroTier One"
+#define COPYRIGHT_NOTICE "Copyright (c) 2020 ZeroTier, Inc."
+#define LICENSE_GRANT "Licensed under the ZeroTier BSL 1.1 (see LICENSE.txt)"
+
+/****************************************************************************/
+/* zerotier-cli personality                                                 */
+/****************************************************************************/
+
+// This is getting deprecated soon in favor of the stuff in cli/
+
+// Exit codes, listed by "zerotier-cli help exitcodes" so scripts can tell failures apart
+#define ZT_CLI_EXIT_USAGE 2 // bad arguments or options
+#define ZT_CLI_EXIT_UNREACHABLE 3 // service not running or not reachable
+#define ZT_CLI_EXIT_UNAUTHORIZED 4 // no auth token or the service refused it
+#define ZT_CLI_EXIT_NOT_FOUND 5 // no such network, member, peer, or other object
+#define ZT_CLI_EXIT_FAILED 6 // anything else that went wrong
+
+// JSON output indentation, -1 for compact output (--compact)
+static int cliJsonIndent = 1;
+
+// Exit code for a failed request to the service given its HTTP status, 0 if unreachable
+static int cliExitCode(const unsigned int scode)
+{
+	switch(scode) {
+		case 0: return ZT_CLI_EXIT_UNREACHABLE;
+		case 401:
+		case 403: return ZT_CLI_EXIT_UNAUTHORIZED;
+		case 404: return ZT_CLI_EXIT_NOT_FOUND;
+		default: return ZT_CLI_EXIT_FAILED;
+	}
+}
+
+// Renders JSON printed by any command so that --compact applies everywhere
+static std::string cliJson(const nlohmann::json &j)
+{
+	return OSUtils::jsonDump(j,cliJsonIndent);
+}
+
+// Quiet mode (-q): commands print only their essential value, or nothing for a change that succeeded
+static bool cliQuiet = false;
+
+// Errors and other diagnostics go to stderr in quiet mode so stdout holds only the value
+static FILE *cliDiag()
+{
+	return (cliQuiet) ? stderr : stdout;
+}
+
+// Confirms a change that succeeded, which quiet mode leaves out
+static void cliOK(const char *fmt,...)
+{
+	if (cliQuiet)
+		return;
+	va_list ap;
+	va_start(ap,fmt);
+	vprintf(fmt,ap);
+	va_end(ap);
+}
+
+// Whether human-readable output is colored: --color=always|never|auto, where auto means only when
+// standard output is a terminal and NO_COLOR is not set. JSON output is never colored.
+static bool cliColor = false;
+
+// Color a status by what it means, green when working, yellow while waiting, red when refused or
+// down, then pad it to width so colored columns still line up
+static std::string cliStatus(const std::string &st,const unsigned int width = 0)
+{
+	const char *sgr = (const char *)0;
+	if ((st == "OK")||(st == "ONLINE")||(st == "ACTIVE")||(st == "yes")||(st == "hook"))
+		sgr = "32";
+	else if ((st == "REQUESTING_CONFIGURATION")||(st == "AUTHENTICATION_REQUIRED")||(st == "TUNNELED")||(st == "NOT_TRIED")||(st == "sso")||(st == "limit"))
+		sgr = "33";
+	else if ((st == "ACCESS_DENIED")||(st == "NOT_FOUND")||(st == "PORT_ERROR")||(st == "CLIENT_TOO_OLD")||(st == "OFFLINE")||(st == "FAILED")||(st == "SERVICE_UNREACHABLE")||(st == "NOT_JOINED")||(st.compare(0,6,"ERROR_") == 0)||(st == "no")||(st == "denied"))
+		sgr = "31";
+	std::string r((cliColor)&&(sgr) ? (std::string("\033[") + sgr + "m" + st + "\033[0m") : st);
+	if (st.length() < width)
+		r.append(width - st.length(),' ');
+	return r;
+}
+
+// Print a title or table header line, in bold when color is on
+static void cliHeader(const char *fmt,...)
+{
+	char buf[4096];
+	va_list ap;
+	va_start(ap,fmt);
+	vsnprintf(buf,sizeof(buf),fmt,ap);
+	va_end(ap);
+	if (!cliColor) {
+		fputs(buf,stdout);
+		return;
+	}
+	std::string out;
+	for(const char *l=buf;*l;) {
+		const char *eol = strchr(l,'\n');
+		const char *end = (eol) ? eol : (l + strlen(l));
+		const char *te = ((end > l)&&(end[-1] == '\r')) ? (end - 1) : end;
+		if (te > l)
+			out.append("\033[1m").append(l,te - l).append("\033[0m");
+		out.append(te,end - te);
+		if (!eol)
+			break;
+		out.push_back('\n');
+		l = eol + 1;
+	}
+	fputs(out.c_str(),stdout);
+}
+
+// Commands as listed in help. Shell completion is generated from these too, so the
+// two cannot drift apart. An entry without a description shares the next one's.
+// Controller commands also name the function that runs them.
+typedef int (*CliControllerHandler)(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+struct CliCommand
+{
+	const char *usage;
+	const char *description;
+	CliControllerHandler handler;
+};
+static const CliCommand CLI_COMMANDS[] = {
+	{ "info","Display status info" },
+	{ "listpeers","List all peers" },
+	{ "peers","List all peers (prettier)" },
+	{ "roots [--check]","List roots with online status and latency" },
+	{ "peer <address> try <endpoint> [<endpoint> ...] [--resolve]\n[--timeout=<duration>]","Send HELLO to a known peer at endpoints and report which answer" },
+	{ "peer <address> prefer <endpoint|clear>","Pin one of a peer's paths until it fails" },
+	{ "identity import <file> [--force] [--decrypt]","Add a known peer, or install identity if stopped" },
+	{ "identity export <address> [--private [--encrypted]] [--output=<file>]","Print this node's or a known peer's identity" },
+	{ "identity address <identity>","Print an identity's 10-digit address" },
+	{ "identity pubkey <identity> [--format=hex|base32|base64|raw]","Print an identity's raw public key" },
+	{ "identity verify-ownership <identity.secret> <challenge hex>","Sign a challenge to prove ownership of an identity" },
+	{ "identity check-ownership <identity> <challenge hex> <signature hex>","Check a signature from verify-ownership" },
+	{ "root reset [--yes]","Discard custom planet and moons, use default roots" },
+	{ "listnetworks","List all networks" },
+	{ "join <network ID> [--token=<token>]","Join a network" },
+	{ "leave <network ID>","Leave a network" },
+	{ "network <network ID> show [--watch [--interval=<seconds>]]","Show a network, or print its state changes until OK" },
+	{ "network <network ID> refresh","Re-request network config now" },
+	{ "network <network ID> multicast list|subscribe <mac> [<adi>]|unsubscribe <mac> [<adi>]","List or manually change multicast subscriptions" },
+	{ "network <network ID> set uphook|downhook <path|clear>","Run a program when a network comes up or goes down" },
+	{ "network <network ID> set multicastlimit <n|default>","Lower the controller's multicast recipient limit locally" },
+	{ "network <network ID> set bridge <true|false>","Refuse to bridge even if the controller allows it" },
+	{ "trace <network ID> [--src=<MAC|address>] [--dst=<MAC|address>] [--ethertype=<hex>]","Print metadata of frames sent and received, no payloads" },
+	{ "monitor [--interval=<seconds>]","Dashboard of node, networks, peers, and events" },
+	{ "set <network ID> <setting>","Set a network setting" },
+	{ "set token add --scope=<controller|controller:read>","Create an API token limited to a scope" },
+	{ "set token list|remove <id>","List or remove scoped API tokens" },
+	{ "set planet <url|file> [--signing-key=<key>] [--world-id=<ID>] [--yes]","Download or read a planet, verify it and switch to it" },
+	{ "get <network ID> <setting>","Get a network setting" },
+	{ "planet show|verify [<file>]","Show or check the saved planet or a planet file" },
+	{ "planet switch <file> [--yes]","Switch to a private planet and restart the service" },
+	{ "listmoons","List moons (federated root sets)" },
+	{ "orbit <world ID> <seed>","Join a moon via any member root" },
+	{ "deorbit <world ID>","Leave a moon" },
+	{ "dump","Debug settings dump for support" },
+	{ "help [exitcodes]","Display this help, or what each exit code means" },
+	{ "completion bash|zsh|fish","Print a shell completion script" },
+	{ "controller <command>","Manage networks on this node's controller" },
+	{ (const char *)0,(const char *)0,(CliControllerHandler)0 }
+};
+
+static int cliControllerNew(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerNetworks(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerDelete(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerExport(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerImport(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerBackup(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerRestore(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerMembers(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerMember(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerAuth(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerPool(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerRoute(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerTag(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerAcl(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerDns(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerToken(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerRules(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerSet(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerWebhook(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerEvents(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerAudit(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerStats(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static int cliControllerMigrateDb(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders);
+static const CliCommand CLI_CONTROLLER_COMMANDS[] = {
+	{ "controller new [--name=<name>] [--public] [--ipv4-pool=<cidr>]","Create a network, print its ID",&cliControllerNew },
+	{ "controller networks [--sort=id|name|members]","List networks with member counts",&cliControllerNetworks },
+	{ "controller delete <network ID> [--yes] [--deauth-first]","Delete a network and all its members",&cliControllerDelete },
+	{ "controller export <network ID> [<file>]","Write a network and its members as one JSON document",&cliControllerExport },
+	{ "controller import <file|-> [--new-id]","Recreate an exported network on this controller",&cliControllerImport },
+	{ "controller backup <file|->","Write all networks and members as one JSON document",&cliControllerBackup },
+	{ "controller restore <file|-> [--force]","Restore a backup of this controller, --force if it has networks",&cliControllerRestore },
+	{ "controller members <network ID> [--authorized|--unauthorized]\n[--online[=<minutes>]] [--name-contains=<text>]\n[--limit=<n>] [--offset=<n>]","List members of a network",&cliControllerMembers },
+	{ "controller member <network ID> <address|name>","Show a member, <address> below may also be a name",&cliControllerMember },
+	{ "controller member <network ID> <address> ip add|remove <IP>",(const char *)0,&cliControllerMember },
+	{ "controller member <network ID> <address> ip clear","Manage static IPs, clear reverts to auto-assign",&cliControllerMember },
+	{ "controller member <network ID> <address> tag list|set <name|ID> <value>|clear <name|ID>","Manage a member's flow rule tags",&cliControllerMember },
+	{ "controller member <network ID> <address> cap list|add <name|ID>|remove <name|ID>","Manage a member's capabilities",&cliControllerMember },
+	{ "controller member <network ID> <address> expire <duration|date|never>","Make an authorization lapse, e.g. after 12h, 7d, 2w",&cliControllerMember },
+	{ "controller member <network ID> <address> name|description <text>","Set or, given \"\", clear a member's name or description",&cliControllerMember },
+	{ "controller auth|deauth <network ID> <address|name> [--expire=<duration|date>]",(const char *)0,&cliControllerAuth },
+	{ "controller auth|deauth <network ID> --file=<path|-> [--expire=<duration|date>]","(De)authorize members, file has address[,name] lines",&cliControllerAuth },
+	{ "controller pool <network ID> list|add <start> <end>|add <cidr>|remove <start> <end>","Manage IP assignment pools",&cliControllerPool },
+	{ "controller route <network ID> list|add <target> [<via>]|remove <target>","Manage routes pushed to members",&cliControllerRoute },
+	{ "controller tag <network ID> list|define <ID> <name> [<min>-<max>|any] [--default=<value>]\n|remove <name|ID>","List tags with their member assignments, or define or remove one",&cliControllerTag },
+	{ "controller member set <network ID> <address> tag <name|ID> <value>","Set a member's tag value (same as member ... tag set)",&cliControllerMember },
+	{ "controller acl <network ID> list|add <rule JSON|file|->|remove <ID>|flush","Manage access control entries checked before the network's rules",&cliControllerAcl },
+	{ "controller dns <network ID> show|clear|set <domain> <server> [<server> ...]","Manage the DNS domain and servers pushed to members",&cliControllerDns },
+	{ "controller token new <network ID> <role> [--ttl=<duration>]","Mint a signed token that lets nodes join in a role",&cliControllerToken },
+	{ "controller rules <network ID> show [--decompile]","Show a network's rules as a rules script",&cliControllerRules },
+	{ "controller rules <network ID> apply <file|-> [--source=<script>]","Apply rules compiled by rule-compiler/cli.js",&cliControllerRules },
+	{ "controller rules <network ID> compile <file|-> [--dry-run]","Compile a rules script and apply it, or print the result",&cliControllerRules },
+	{ "controller rules <network ID> list|add <rule|JSON> [--at=<n>]|remove <n>\n|test <source address> <destination address> <ethertype>","List, add, remove, or try out the network's flow rules one at a time",&cliControllerRules },
+	{ "controller set <network ID> [<setting>] [<value>]","Show or change a network setting",&cliControllerSet },
+	{ "controller set <network ID> tagdef [<name> <ID> [<min>-<max>|any] [--default=<value>]]",(const char *)0,&cliControllerSet },
+	{ "controller set <network ID> tagdef <name> remove","List, define, or remove named flow rule tags",&cliControllerSet },
+	{ "controller webhook <network ID> list|add <url> [--secret=<secret>]\n[--max-attempts=<n>] [--retry-delay=<duration>]|remove <url>","List, add, or remove webhooks for network events",&cliControllerWebhook },
+	{ "controller set <network ID> authhook [<url> [--secret=<secret>] [--ttl=<duration>] [--fail-open] | clear]","Show, set, or clear an external member admission hook",&cliControllerSet },
+	{ "controller events [<network ID>] [--since=<ms>]","List recent controller events",&cliControllerEvents },
+	{ "controller audit [--network=<network ID>] [--since=<ms|date|duration>]","List changes to networks and members and who made them",&cliControllerAudit },
+	{ "controller stats [<network ID>]","Show config request, member and authorization counters",&cliControllerStats },
+	{ "controller migrate-db sqlite","Copy controller data into SQLite (service stopped)",&cliControllerMigrateDb },
+	{ (const char *)0,(const char *)0,(CliControllerHandler)0 }
+};
+
+static void cliPrintCommands(FILE *out,const CliCommand *c)
+{
+	for(;c->usage;++c) {
+		// Usages too long for one line continue under their first argument
+		std::string usage(c->usage);
+		const std::string indent(ZT_EOL_S + std::string(2 + usage.find_first_of("<["),' '));
+		for(std::size_t nl=usage.find('\n');nl!=std::string::npos;nl=usage.find('\n',nl + indent.length()))
+			usage.replace(nl,1,indent);
+		if (!c->description)
+			fprintf(out,"  %s" ZT_EOL_S,usage.c_str());
+		else if (usage.length() < 24)
+			fprintf(out,"  %-24s- %s" ZT_EOL_S,usage.c_str(),c->description);
+		else fprintf(out,"  %s" ZT_EOL_S "                          - %s" ZT_EOL_S,usage.c_str(),c->description);
+	}
+}
+
+static void cliPrintHelp(const char *pn,FILE *out)
+{
+	fprintf(out,
+		"%s version %d.%d.%d build %d (platform %d arch %d)" ZT_EOL_S,
+		PROGRAM_NAME,
+		ZEROTIER_ONE_VERSION_MAJOR, ZEROTIER_ONE_VERSION_MINOR, ZEROTIER_ONE_VERSION_REVISION, ZEROTIER_ONE_VERSION_BUILD,
+		ZT_BUILD_PLATFORM, ZT_BUILD_ARCHITECTURE);
+	fprintf(out,
+		COPYRIGHT_NOTICE ZT_EOL_S
+		LICENSE_GRANT ZT_EOL_S);
+	fprintf(out,"Usage: %s [-switches] <command/path> [<args>]" ZT_EOL_S"" ZT_EOL_S,pn);
+	fprintf(out,"Available switches:" ZT_EOL_S);
+	fprintf(out,"  -h                      - Display this help" ZT_EOL_S);
+	fprintf(out,"  -v                      - Show version" ZT_EOL_S);
+	fprintf(out,"  -j                      - Display full raw JSON output" ZT_EOL_S);
+	fprintf(out,"  -q                      - Print only the essential value, errors to stderr" ZT_EOL_S);
+	fprintf(out,"  --compact               - Print JSON on one line instead of indented" ZT_EOL_S);
+	fprintf(out,"  --color=<when>          - Color output: always, never, or auto (default)" ZT_EOL_S);
+	fprintf(out,"  --encoding=<enc>        - Print addresses and identities as hex (default) or base32" ZT_EOL_S);
+	fprintf(out,"  -D<path>                - ZeroTier home path for parameter auto-detect" ZT_EOL_S);
+	fprintf(out,"  -p<port>                - HTTP port (default: auto)" ZT_EOL_S);
+	fprintf(out,"  -T<token>               - Authentication token (default: auto)" ZT_EOL_S);
+	fprintf(out,ZT_EOL_S"Available commands:" ZT_EOL_S);
+	cliPrintCommands(out,CLI_COMMANDS);
+	fprintf(out,ZT_EOL_S"Controller commands:" ZT_EOL_S);
+	cliPrintCommands(out,CLI_CONTROLLER_COMMANDS);
+	fprintf(out,ZT_EOL_S"Available settings:" ZT_EOL_S);
+	fprintf(out,"  Settings to use with [get/set] may include property names from " ZT_EOL_S);
+	fprintf(out,"  the JSON output of \"zerotier-cli -j listnetworks\". Additionally, " ZT_EOL_S);
+	fprintf(out,"  (ip, ip4, ip6, ip6plane, and ip6prefix can be used). For instance:" ZT_EOL_S);
+	fprintf(out,"  zerotier-cli get <network ID> ip6plane will return the 6PLANE address" ZT_EOL_S);
+	fprintf(out,"  assigned to this node." ZT_EOL_S);
+}
+
+static std::string cliFixJsonCRs(const std::string &s)
+{
+	std::string r;
+	for(std::string::const_iterator c(s.begin());c!=s.end();++c) {
+		if (*c == '\n')
+			r.append(ZT_EOL_S);
+		else r.push_back(*c);
+	}
+	return r;
+}
+
+/**
+ * Make a request to the local service and parse any JSON response
+ *
+ * @return HTTP status code or 0 if the service could not be contacted
+ */
+static unsigned int cliRequest(const InetAddress &addr,std::map<std::string,std::string> requestHeaders,const char *method,const std::string &path,const nlohmann::json *body,std::string &responseBody,nlohmann::json &response)
+{
+	std::map<std::string,std::string> responseHeaders;
+	unsigned int scode;
+	responseBody.clear();
+	if (!strcmp(method,"DELETE")) {
+		scode = Http::DEL(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,path.c_str(),requestHeaders,responseHeaders,responseBody);
+	} else if (body) {
+		const std::string b(OSUtils::jsonDump(*body,-1));
+		char cl[128];
+		OSUtils::ztsnprintf(cl,sizeof(cl),"%u",(unsigned int)b.length());
+		requestHeaders["Content-Type"] = "application/json";
+		requestHeaders["Content-Length"] = cl;
+		if (!strcmp(method,"PUT"))
+			scode = Http::PUT(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,path.c_str(),requestHeaders,b.data(),(unsigned long)b.length(),responseHeaders,responseBody);
+		else scode = Http::POST(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,path.c_str(),requestHeaders,b.data(),(unsigned long)b.length(),responseHeaders,responseBody);
+	} else {
+		scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,path.c_str(),requestHeaders,responseHeaders,responseBody);
+	}
+	response = nlohmann::json();
+	if ((scode != 0)&&(responseBody.length() > 0)) {
+		try {
+			response = OSUtils::jsonParse(responseBody);
+		} catch ( ... ) {}
+	}
+	return scode;
+}
+
+/**
+ * Compute the managed route and assignment range for an IPv4 or IPv6 CIDR
+ *
+ * For IPv4 the network and broadcast addresses are excluded from the range
+ * except for /31 and /32, which have no room for them. IPv6 has no broadcast
+ * address, so only the subnet-router anycast (all zero host) address is
+ * excluded, except for /127 and /128.
+ */
+static bool cliCidrPool(const std::string &cidr,std::string &target,std::string &rangeStart,std::string &rangeEnd)
+{
+	const InetAddress a(cidr.c_str());
+	const unsigned int bits = a.netmaskBits();
+	const unsigned int len = (a.isV4()) ? 4 : ((a.isV6()) ? 16 : 0);
+	if ((!len)||(cidr.find('/') == std::string::npos)||(bits == 0)||(bits > (len * 8)))
+		return false;
+
+	uint8_t first[16],last[16];
+	memcpy(first,a.rawIpData(),len);
+	bool nonzero = false;
+	for(unsigned int i=0;i<len;++i) {
+		nonzero |= (first[i] != 0);
+		const unsigned int bitsHere = (bits >= ((i + 1) * 8)) ? 8 : ((bits > (i * 8)) ? (bits - (i * 8)) : 0);
+		const uint8_t mask = (uint8_t)(0xff00 >> bitsHere);
+		first[i] &= mask;
+		last[i] = first[i] | (uint8_t)~mask;
+	}
+	if (!nonzero)
+		return false;
+
+	char buf[64];
+	target = InetAddress(first,len,bits).toString(buf);
+	if (bits < ((len * 8) - 1)) {
+		for(int i=(int)len-1;i>=0;--i) { // first + 1
+			if (++first[i] != 0)
+				break;
+		}
+		if (len == 4) {
+			for(int i=(int)len-1;i>=0;--i) { // last - 1
+				if (last[i]-- != 0)
+					break;
+			}
+		}
+	}
+	rangeStart = InetAddress(first,len,0).toIpString(buf);
+	rangeEnd = InetAddress(last,len,0).toIpString(buf);
+	return true;
+}
+
+static std::string cliTrim(const std::string &s)
+{
+	const std::size_t start = s.find_first_not_of(" \t\r\n");
+	if (start == std::string::npos)
+		return std::string();
+	return s.substr(start,s.find_last_not_of(" \t\r\n") - start + 1);
+}
+
+static bool cliParseBool(const std::string &s,bool &b)
+{
+	if ((s == "1")||(s == "true")||(s == "yes")||(s == "on")) {
+		b = true;
+		return true;
+	} else if ((s == "0")||(s == "false")||(s == "no")||(s == "off")) {
+		b = false;
+		return true;
+	}
+	return false;
+}
+
+// Parse an unsigned decimal that fits in 32 bits, such as a tag ID or value
+static bool cliParseU32(const std::string &s,uint64_t &v)
+{
+	if ((s.empty())||(s.length() > 10)||(s.find_first_not_of("0123456789") != std::string::npos))
+		return false;
+	v = strtoull(s.c_str(),(char **)0,10);
+	return (v <= 0xffffffffULL);
+}
+
+// Find a network tag or capability definition by name or numeric ID, returning its index or -1 if there is none
+static long cliFindDefinition(nlohmann::json &tags,const std::string &nameOrId)
+{
+	uint64_t id = 0;
+	const bool numeric = cliParseU32(nameOrId,id);
+	for(unsigned long i=0;i<tags.size();++i) {
+		if ((numeric) ? (OSUtils::jsonInt(tags[i]["id"],0ULL) == id) : (OSUtils::jsonString(tags[i]["name"],"") == nameOrId))
+			return (long)i;
+	}
+	return -1;
+}
+
+// Render a number of seconds the way listings show ages, e.g. 45s, 12m, 5h, or 3d
+static std::string cliShortDuration(const int64_t seconds)
+{
+	char tmp[64];
+	if (seconds < 120)
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%llds",(long long)seconds);
+	else if (seconds < 7200)
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%lldm",(long long)(seconds / 60));
+	else if (seconds < 172800)
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%lldh",(long long)(seconds / 3600));
+	else OSUtils::ztsnprintf(tmp,sizeof(tmp),"%lldd",(long long)(seconds / 86400));
+	return std::string(tmp);
+}
+
+// Render a time in ms since epoch as a UTC date and time
+static std::string cliUtcTime(const int64_t ms)
+{
+	const time_t t = (time_t)(ms / 1000);
+	const struct tm *const tm = gmtime(&t);
+	char tmp[64];
+	if ((!tm)||(!strftime(tmp,sizeof(tmp),"%Y-%m-%d %H:%M:%S UTC",tm)))
+		return std::string("?");
+	return std::string(tmp);
+}
+
+// Parse a binary planet or moon
+static bool getWorldFromBytes(const std::string &wser,World &w)
+{
+	if ((wser.empty())||(wser.length() > ZT_WORLD_MAX_SERIALIZED_LENGTH))
+		return false;
+	try {
+		Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> wbuf(wser.data(),(unsigned int)wser.length());
+		w.deserialize(wbuf,0);
+		return (bool)w;
+	} catch ( ... ) {
+		return false;
+	}
+}
+
+// Read a binary planet or moon file
+static bool getWorldFromFile(const char *path,World &w)
+{
+	std::string wser;
+	if (!OSUtils::readFile(path,wser))
+		return false;
+	return getWorldFromBytes(wser,w);
+}
+
+// A planet or moon as JSON, in the genmoon input format (minus secrets) so it can be edited and re-signed
+static nlohmann::json worldToJson(const World &w)
+{
+	char tmp[4096];
+	nlohmann::json wj;
+	wj["objtype"] = "world";
+	wj["worldType"] = (w.type() == World::TYPE_PLANET) ? "planet" : "moon";
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)w.id());
+	wj["id"] = tmp;
+	wj["timestamp"] = w.timestamp();
+	wj["updatesMustBeSignedBy"] = Utils::hex(w.updatesMustBeSignedBy().data,ZT_C25519_PUBLIC_KEY_LEN,tmp);
+	wj["signature"] = Utils::hex(w.signature().data,ZT_C25519_SIGNATURE_LEN,tmp);
+	wj["selfSigned"] = w.verifySelfSigned();
+	nlohmann::json rootsj = nlohmann::json::array();
+	for(std::vector<World::Root>::const_iterator r(w.roots().begin());r!=w.roots().end();++r) {
+		nlohmann::json rj;
+		rj["address"] = r->identity.address().toString(tmp);
+		rj["identity"] = r->identity.toString(false,tmp);
+		nlohmann::json eps = nlohmann::json::array();
+		for(std::vector<InetAddress>::const_iterator ep(r->stableEndpoints.begin());ep!=r->stableEndpoints.end();++ep)
+			eps.push_back(ep->toString(tmp));
+		rj["stableEndpoints"] = eps;
+		rootsj.push_back(rj);
+	}
+	wj["roots"] = rootsj;
+	return wj;
+}
+
+/**
+ * Print a planet or moon and each of its roots for a human
+ *
+ * The signature is checked against the key the file itself says updates must be signed by.
+ *
+ * @return True if the world has roots, every root has a valid identity and endpoints, and it is properly signed
+ */
+static bool printWorld(const World &w)
+{
+	char tmp[4096];
+	bool valid = true;
+	printf("%s %.16llx timestamp %llu (%s)" ZT_EOL_S,(w.type() == World::TYPE_PLANET) ? "planet" : "moon",(unsigned long long)w.id(),(unsigned long long)w.timestamp(),cliUtcTime(w.timestamp()).c_str());
+	printf("signing key %s" ZT_EOL_S,Utils::hex(w.updatesMustBeSignedBy().data,ZT_C25519_PUBLIC_KEY_LEN,tmp));
+	if (w.roots().empty()) {
+		printf("no roots" ZT_EOL_S);
+		valid = false;
+	}
+	for(std::vector<World::Root>::const_iterator r(w.roots().begin());r!=w.roots().end();++r) {
+		const bool idOk = r->identity.locallyValidate();
+		std::string eps;
+		for(std::vector<InetAddress>::const_iterator ep(r->stableEndpoints.begin());ep!=r->stableEndpoints.end();++ep) {
+			if (eps.length() > 0)
+				eps.push_back(',');
+			eps.append(ep->toString(tmp));
+		}
+		printf("root %s identity %s endpoints %s" ZT_EOL_S,r->identity.address().toString(tmp,cliEncoding),(idOk) ? "OK" : "INVALID",(eps.length() > 0) ? eps.c_str() : "none");
+		printf("  %s" ZT_EOL_S,r->identity.toString(false,tmp,cliEncoding));
+		if ((!idOk)||(eps.empty()))
+			valid = false;
+	}
+	const bool sigOk = w.verifySelfSigned();
+	printf("signature %s" ZT_EOL_S,(sigOk) ? "OK" : "FAILED");
+	return ((valid)&&(sigOk));
+}
+
+/**
+ * Parse an authorization expiry given as a time from now or a UTC date
+ *
+ * Accepts "never" (0), a duration like 90m, 12h, 7d, or 2w, or a date as
+ * YYYY-MM-DD[THH:MM[:SS]][Z]. Durations are relative to now.
+ */
+static bool cliParseExpiry(const std::string &s,const int64_t now,int64_t &expiry)
+{
+	if (s == "never") {
+		expiry = 0;
+		return true;
+	}
+
+	const std::size_t digits = s.find_first_not_of("0123456789");
+	if ((digits > 0)&&(digits != std::string::npos)&&(digits < 10)&&(digits == (s.length() - 1))) {
+		int64_t unit;
+		switch(s[digits]) {
+			case 's': unit = 1000LL; break;
+			case 'm': unit = 60000LL; break;
+			case 'h': unit = 3600000LL; break;
+			case 'd': unit = 86400000LL; break;
+			case 'w': unit = 604800000LL; break;
+			default: return false;
+		}
+		expiry = now + ((int64_t)strtoll(s.c_str(),(char **)0,10) * unit);
+		return true;
+	}
+
+	int y = 0,mo = 0,d = 0,h = 0,mi = 0,sec = 0,n = 0;
+	if ((sscanf(s.c_str(),"%4d-%2d-%2d%n",&y,&mo,&d,&n) != 3)||(n != 10))
+		return false;
+	const char *rest = s.c_str() + n;
+	if (*rest == 'T') {
+		n = 0;
+		if ((sscanf(rest + 1,"%2d:%2d%n",&h,&mi,&n) != 2)||(n != 5))
+			return false;
+		rest += 6;
+		if (*rest == ':') {
+			n = 0;
+			if ((sscanf(rest + 1,"%2d%n",&sec,&n) != 1)||(n != 2))
+				return false;
+			rest += 3;
+		}
+	}
+	if (*rest == 'Z')
+		++rest;
+	if ((*rest)||(y < 1970)||(mo < 1)||(mo > 12)||(d < 1)||(d > 31)||(h > 23)||(mi > 59)||(sec > 59))
+		return false;
+
+	// Days since epoch of a proleptic Gregorian date, so no reliance on timegm()
+	const int64_t yy = (int64_t)y - ((mo <= 2) ? 1 : 0);
+	const int64_t era = yy / 400;
+	const int64_t yoe = yy - (era * 400);
+	const int64_t doy = (((153 * (int64_t)((mo > 2) ? (mo - 3) : (mo + 9))) + 2) / 5) + (int64_t)d - 1;
+	const int64_t doe = (yoe * 365) + (yoe / 4) - (yoe / 100) + doy;
+	const int64_t days = (era * 146097) + doe - 719468;
+	expiry = ((days * 86400LL) + ((int64_t)h * 3600LL) + ((int64_t)mi * 60LL) + (int64_t)sec) * 1000LL;
+	return true;
+}
+
+// Network settings editable via "controller set," with type 'b'ool, 'i'nteger, or 's'tring
+struct CliControllerSetting
+{
+	const char *name;
+	char type;
+	const char *object; // sub-object containing field or NULL for top level
+	const char *field;
+	bool invert; // boolean stored as the inverse (public vs. private)
+};
+static const CliControllerSetting CLI_CONTROLLER_SETTINGS[] = {
+	{ "name",'s',(const char *)0,"name",false },
+	{ "private",'b',(const char *)0,"private",false },
+	{ "public",'b',(const char *)0,"private",true },
+	{ "multicastLimit",'i',(const char *)0,"multicastLimit",false },
+	{ "mtu",'i',(const char *)0,"mtu",false },
+	{ "memberLimit",'i',(const char *)0,"memberLimit",false },
+	{ "enableBroadcast",'b',(const char *)0,"enableBroadcast",false },
+	{ "ssoEnabled",'b',(const char *)0,"ssoEnabled",false },
+	{ "ssoProvider",'s',(const char *)0,"ssoProvider",false },
+	{ "ssoClientID",'s',(const char *)0,"ssoClientID",false },
+	{ "v4AssignMode.zt",'b',"v4AssignMode","zt",false },
+	{ "v6AssignMode.zt",'b',"v6AssignMode","zt",false },
+	{ "v6AssignMode.rfc4193",'b',"v6AssignMode","rfc4193",false },
+	{ "v6AssignMode.6plane",'b',"v6AssignMode","6plane",false },
+	{ (const char *)0,0,(const char *)0,(const char *)0,false }
+};
+
+static nlohmann::json cliControllerSettingValue(const CliControllerSetting *cs,nlohmann::json &network)
+{
+	nlohmann::json &v = (cs->object) ? network[cs->object][cs->field] : network[cs->field];
+	switch(cs->type) {
+		case 'b': return (OSUtils::jsonBool(v,false) != cs->invert);
+		case 'i': return OSUtils::jsonInt(v,0ULL);
+	}
+	return OSUtils::jsonString(v,"");
+}
+
+// Compare the IPs of two addresses of the same family as big-endian numbers
+static int cliIpCompare(const InetAddress &a,const InetAddress &b)
+{
+	return memcmp(a.rawIpData(),b.rawIpData(),(a.ss_family == AF_INET) ? 4 : 16);
+}
+
+// True if ip lies within [start,end], which must be addresses of the same family
+static bool cliIpInRange(const InetAddress &ip,const InetAddress &start,const InetAddress &end)
+{
+	if ((ip.ss_family != start.ss_family)||(ip.ss_family != end.ss_family))
+		return false;
+	return ((cliIpCompare(ip,start) >= 0)&&(cliIpCompare(ip,end) <= 0));
+}
+
+// One-line summary of a controller network's DNS setting, or "-" if none
+static std::string cliDnsSummary(nlohmann::json &dns)
+{
+	if (!dns.is_object())
+		return std::string("-");
+	std::string out(OSUtils::jsonString(dns["domain"],""));
+	nlohmann::json &srv = dns["servers"];
+	for(unsigned long i=0;((srv.is_array())&&(i<srv.size()));++i) {
+		out.push_back((i == 0) ? ' ' : ',');
+		out.append(OSUtils::jsonString(srv[i],""));
+	}
+	return (out.empty()) ? std::string("-") : out;
+}
+
+// Read a whole file, or standard input if path is "-"
+static bool cliReadInput(const std::string &path,std::string &buf)
+{
+	if (path != "-")
+		return OSUtils::readFile(path.c_str(),buf);
+	char tmp[4096];
+	std::size_t n;
+	while ((n = fread(tmp,1,sizeof(tmp),stdin)) > 0)
+		buf.append(tmp,n);
+	return (!ferror(stdin));
+}
+
+// Print the warnings array of a controller response, one per line
+static void cliPrintWarnings(const nlohmann::json &warnings)
+{
+	if (!warnings.is_array())
+		return;
+	for(unsigned long i=0;i<warnings.size();++i) {
+		if (warnings[i].is_string())
+			fprintf(stderr,"warning: %s" ZT_EOL_S,warnings[i].get<std::string>().c_str());
+	}
+}
+
+/**
+ * Parse an identity from either its string form or its binary serialized form
+ */
+static bool cliParseIdentity(const std::string &data,Identity &id)
+{
+	if (id.fromString(cliTrim(data).c_str()))
+		return true;
+	try {
+		if ((data.length() > 0)&&(data.length() <= ZT_IDENTITY_STRING_BUFFER_LENGTH)) {
+			Buffer<ZT_IDENTITY_STRING_BUFFER_LENGTH> b(data.data(),(unsigned int)data.length());
+			return (id.deserialize(b,0) == data.length());
+		}
+	} catch ( ... ) {}
+	return false;
+}
+
+// Ownership challenges: allowed sizes in bytes, and the prefix the signed message starts with
+#define ZT_CLI_OWNERSHIP_CHALLENGE_MIN 8
+#define ZT_CLI_OWNERSHIP_CHALLENGE_MAX 1024
+#define ZT_CLI_OWNERSHIP_SIGNATURE_PREFIX "ZeroTier identity ownership challenge"
+
+// Argon2id cost for encrypted identity files (RFC 9106's second recommended
+// option), and the most a file may ask for so a hostile file can't stall the
+// CLI or exhaust memory
+#define ZT_CLI_IDENTITY_KDF_PASSES 3
+#define ZT_CLI_IDENTITY_KDF_MEMORY_KIB 65536
+#define ZT_CLI_IDENTITY_KDF_LANES 4
+#define ZT_CLI_IDENTITY_KDF_MAX_PASSES 64
+#define ZT_CLI_IDENTITY_KDF_MAX_MEMORY_KIB 1048576
+
+/**
+ * Prompt for a passphrase on stderr and read it from stdin without echo
+ *
+ * If stdin is not a terminal the passphrase is read as one line with no
+ * prompt, which lets scripts pipe it in.
+ */
+static bool cliReadPassphrase(const char *prompt,std::string &pass)
+{
+	char buf[1024];
+	pass.clear();
+#ifdef __WINDOWS__
+	HANDLE h = GetStdHandle(STD_INPUT_HANDLE);
+	DWORD mode = 0;
+	const bool tty = (GetConsoleMode(h,&mode) != 0);
+	if (tty) {
+		fprintf(stderr,"%s",prompt);
+		fflush(stderr);
+		SetConsoleMode(h,mode & ~ENABLE_ECHO_INPUT);
+	}
+	const bool ok = (fgets(buf,sizeof(buf),stdin) != (char *)0);
+	if (tty) {
+		SetConsoleMode(h,mode);
+		fprintf(stderr,ZT_EOL_S);
+	}
+#else
+	struct termios oldt,newt;
+	const bool tty = ((isatty(STDIN_FILENO))&&(tcgetattr(STDIN_FILENO,&oldt) == 0));
+	if (tty) {
+		fprintf(stderr,"%s",prompt);
+		fflush(stderr);
+		newt = oldt;
+		newt.c_lflag &= ~((tcflag_t)ECHO);
+		tcsetattr(STDIN_FILENO,TCSAFLUSH,&newt);
+	}
+	const bool ok = (fgets(buf,sizeof(buf),stdin) != (char *)0);
+	if (tty) {
+		tcsetattr(STDIN_FILENO,TCSAFLUSH,&oldt);
+		fprintf(stderr,ZT_EOL_S);
+	}
+#endif
+	if (ok) {
+		pass = buf;
+		while ((!pass.empty())&&((pass[pass.length() - 1] == '\n')||(pass[pass.length() - 1] == '\r')))
+			pass.erase(pass.length() - 1);
+	}
+	Utils::burn(buf,sizeof(buf));
+	return ok;
+}
+
+/**
+ * Encrypt an identity's secret key under a passphrase
+ *
+ * The result is a JSON object carrying the public identity in the clear
+ * (also authenticated as AAD) and the secret key bytes encrypted with
+ * AES-256-GCM under a key derived from the passphrase with Argon2id.
+ */
+static bool cliEncryptIdentity(const Identity &id,const std::string &pass,nlohmann::json &out)
+{
+	char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+	const std::string pub(id.toString(false,idtmp));
+	std::string sec(id.toString(true,idtmp));
+	Utils::burn(idtmp,sizeof(idtmp));
+	if (sec.length() <= (pub.length() + 1))
+		return false;
+	uint8_t key[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+	const unsigned int klen = Utils::unhex(sec.c_str() + pub.length() + 1,key,sizeof(key));
+	Utils::burn(&(sec[0]),(unsigned int)sec.length());
+	if (klen == 0)
+		return false;
+
+	uint8_t salt[16],iv[12],k[32];
+	Utils::getSecureRandom(salt,sizeof(salt));
+	Utils::getSecureRandom(iv,sizeof(iv));
+	if (!Argon2id(pass.data(),(unsigned int)pass.length(),salt,sizeof(salt),(const void *)0,0,(const void *)0,0,ZT_CLI_IDENTITY_KDF_PASSES,ZT_CLI_IDENTITY_KDF_MEMORY_KIB,ZT_CLI_IDENTITY_KDF_LANES,k,sizeof(k))) {
+		Utils::burn(key,sizeof(key));
+		return false;
+	}
+
+	uint8_t ct[ZT_IDENTITY_STRING_BUFFER_LENGTH],tag[16];
+	AES aes(k);
+	aes.gcmEncrypt(iv,pub.data(),(unsigned int)pub.length(),key,klen,ct,tag);
+
+	char hbuf[(ZT_IDENTITY_STRING_BUFFER_LENGTH * 2) + 1];
+	out = nlohmann::json::object();
+	out["type"] = "zerotier-encrypted-identity";
+	out["version"] = 2;
+	out["identity"] = pub;
+	out["kdf"] = "argon2id";
+	out["t"] = ZT_CLI_IDENTITY_KDF_PASSES;
+	out["m"] = ZT_CLI_IDENTITY_KDF_MEMORY_KIB;
+	out["p"] = ZT_CLI_IDENTITY_KDF_LANES;
+	out["salt"] = Utils::hex(salt,sizeof(salt),hbuf);
+	out["cipher"] = "aes-256-gcm";
+	out["iv"] = Utils::hex(iv,sizeof(iv),hbuf);
+	out["tag"] = Utils::hex(tag,sizeof(tag),hbuf);
+	out["ciphertext"] = Utils::hex(ct,klen,hbuf);
+
+	Utils::burn(key,sizeof(key));
+	Utils::burn(k,sizeof(k));
+	return true;
+}
+
+/**
+ * Check whether a file's contents are an encrypted identity
+ */
+static bool cliIsEncryptedIdentity(const std::string &data,nlohmann::json &j)
+{
+	try {
+		j = OSUtils::jsonParse(data);
+		return ((j.is_object())&&(OSUtils::jsonString(j["type"],"") == "zerotier-encrypted-identity"));
+	} catch ( ... ) {}
+	return false;
+}
+
+/**
+ * Read a public identity given as a literal, a file, or - for standard input
+ *
+ * Encrypted identity files are accepted too, since their public part is in the clear.
+ */
+static bool cliReadPublicIdentity(const std::string &arg,Identity &id)
+{
+	std::string idbuf;
+	nlohmann::json enc;
+	if ((arg.length() > 32)&&(arg[10] == ':')) {
+		idbuf = arg;
+	} else if (!cliReadInput(arg,idbuf)) {
+		fprintf(stderr,"unable to read %s" ZT_EOL_S,arg.c_str());
+		return false;
+	}
+	if (cliIsEncryptedIdentity(idbuf,enc))
+		idbuf = OSUtils::jsonString(enc["identity"],"");
+	if ((!cliParseIdentity(idbuf,id))||(!id.locallyValidate())) {
+		fprintf(stderr,"%s is not a valid identity" ZT_EOL_S,arg.c_str());
+		return false;
+	}
+	return true;
+}
+
+/**
+ * Standard base64 with padding
+ */
+static std::string cliBase64(const uint8_t *data,const unsigned int len)
+{
+	static const char *const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+	std::string s;
+	for(unsigned int i=0;i<len;i+=3) {
+		const unsigned int n = ((unsigned int)data[i] << 16) | (((i + 1) < len) ? ((unsigned int)data[i + 1] << 8) : 0) | (((i + 2) < len) ? (unsigned int)data[i + 2] : 0);
+		s.push_back(chars[(n >> 18) & 63]);
+		s.push_back(chars[(n >> 12) & 63]);
+		s.push_back(((i + 1) < len) ? chars[(n >> 6) & 63] : '=');
+		s.push_back(((i + 2) < len) ? chars[n & 63] : '=');
+	}
+	return s;
+}
+
+/**
+ * Decrypt an encrypted identity, returning false on a bad passphrase or file
+ */
+static bool cliDecryptIdentity(nlohmann::json &j,const std::string &pass,Identity &id,std::string &err)
+{
+	if ((OSUtils::jsonInt(j["version"],0ULL) != 2)||(OSUtils::jsonString(j["kdf"],"") != "argon2id")||(OSUtils::jsonString(j["cipher"],"") != "aes-256-gcm")) {
+		err = "unsupported encrypted identity format";
+		return false;
+	}
+	const std::string pub(OSUtils::jsonString(j["identity"],""));
+	const uint64_t t = OSUtils::jsonInt(j["t"],0ULL);
+	const uint64_t m = OSUtils::jsonInt(j["m"],0ULL);
+	const uint64_t p = OSUtils::jsonInt(j["p"],0ULL);
+	const std::string salth(OSUtils::jsonString(j["salt"],"")),ivh(OSUtils::jsonString(j["iv"],"")),tagh(OSUtils::jsonString(j["tag"],"")),cth(OSUtils::jsonString(j["ciphertext"],""));
+	uint8_t salt[16],iv[12],tag[16],ct[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+	Identity pid;
+	if ((!pid.fromString(pub.c_str()))||
+	    (t == 0)||(t > ZT_CLI_IDENTITY_KDF_MAX_PASSES)||(p == 0)||(p > 255)||(m < (8 * p))||(m > ZT_CLI_IDENTITY_KDF_MAX_MEMORY_KIB)||
+	    (salth.length() != 32)||(Utils::unhex(salth.c_str(),salt,sizeof(salt)) != sizeof(salt))||
+	    (ivh.length() != 24)||(Utils::unhex(ivh.c_str(),iv,sizeof(iv)) != sizeof(iv))||
+	    (tagh.length() != 32)||(Utils::unhex(tagh.c_str(),tag,sizeof(tag)) != sizeof(tag))||
+	    (cth.length() > (sizeof(ct) * 2))) {
+		err = "malformed encrypted identity";
+		return false;
+	}
+	const unsigned int ctlen = Utils::unhex(cth.c_str(),ct,sizeof(ct));
+	if (ctlen == 0) {
+		err = "malformed encrypted identity";
+		return false;
+	}
+
+	uint8_t k[32],key[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+	if (!Argon2id(pass.data(),(unsigned int)pass.length(),salt,sizeof(salt),(const void *)0,0,(const void *)0,0,(uint32_t)t,(uint32_t)m,(uint32_t)p,k,sizeof(k))) {
+		err = "unable to allocate memory for key derivation";
+		return false;
+	}
+	AES aes(k);
+	const bool ok = aes.gcmDecrypt(iv,pub.data(),(unsigned int)pub.length(),ct,ctlen,key,tag);
+	Utils::burn(k,sizeof(k));
+	if (!ok) {
+		err = "wrong passphrase or corrupted file";
+		return false;
+	}
+
+	char hbuf[(ZT_IDENTITY_STRING_BUFFER_LENGTH * 2) + 1];
+	std::string sec(pub);
+	sec.push_back(':');
+	sec.append(Utils::hex(key,ctlen,hbuf));
+	const bool valid = ((id.fromString(sec.c_str()))&&(id == pid)&&(id.hasPrivate())&&(id.locallyValidate()));
+	Utils::burn(key,sizeof(key));
+	Utils::burn(hbuf,sizeof(hbuf));
+	Utils::burn(&(sec[0]),(unsigned int)sec.length());
+	if (!valid) {
+		id = Identity();
+		err = "decrypted secret key does not match identity";
+		return false;
+	}
+	return true;
+}
+
+/**
+ * Render a JSON rule array back into rules script syntax
+ *
+ * This is best effort. Tag and capability names are not stored by the
+ * controller so they come out as numeric IDs, and anything the rule
+ * compiler has no syntax for is emitted as a comment.
+ */
+static void cliDecompileRules(const nlohmann::json &rules,const char *indent,std::string &out)
+{
+	static const char *const chrNames[64] = {
+		"tcp_fin","tcp_syn","tcp_rst","tcp_psh","tcp_ack","tcp_urg","tcp_ece","tcp_cwr","tcp_ns","tcp_rs2","tcp_rs1","tcp_rs0",
+		0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,
+		"macauth","ipauth","broadcast","multicast","inbound"
+	};
+	char tmp[256];
+	std::string matches;
+	for(unsigned long i=0;i<rules.size();++i) {
+		const nlohmann::json &r = rules[i];
+		const std::string type(OSUtils::jsonString(r["type"],""));
+		if (type.compare(0,7,"ACTION_") == 0) {
+			if ((type == "ACTION_DROP")||(type == "ACTION_ACCEPT")||(type == "ACTION_BREAK")) {
+				out.append(indent);
+				out.append((type == "ACTION_DROP") ? "drop" : ((type == "ACTION_ACCEPT") ? "accept" : "break"));
+			} else if ((type == "ACTION_TEE")||(type == "ACTION_WATCH")) {
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s%s %lld %s",indent,(type == "ACTION_TEE") ? "tee" : "watch",(long long)OSUtils::jsonInt(r["length"],0ULL),OSUtils::jsonString(r["address"],"").c_str());
+				out.append(tmp);
+			} else if (type == "ACTION_REDIRECT") {
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"%sredirect %s",indent,OSUtils::jsonString(r["address"],"").c_str());
+				out.append(tmp);
+			} else {
+				out.append(indent);
+				out.append("# unsupported action ");
+				out.append(type);
+				out.append(ZT_EOL_S);
+				out.append(indent);
+				out.append("break");
+			}
+			if (matches.empty()) {
+				out.append(";" ZT_EOL_S);
+			} else {
+				out.append(matches);
+				out.append(ZT_EOL_S);
+				out.append(indent);
+				out.append(";" ZT_EOL_S);
+				matches.clear();
+			}
+			continue;
+		}
+
+		std::string m;
+		if ((type == "MATCH_SOURCE_ZEROTIER_ADDRESS")||(type == "MATCH_DEST_ZEROTIER_ADDRESS")) {
+			m = ((type == "MATCH_SOURCE_ZEROTIER_ADDRESS") ? "ztsrc " : "ztdest ") + OSUtils::jsonString(r["zt"],"");
+		} else if ((type == "MATCH_VLAN_ID")||(type == "MATCH_VLAN_PCP")||(type == "MATCH_VLAN_DEI")) {
+			const char *const k = (type == "MATCH_VLAN_ID") ? "vlanId" : ((type == "MATCH_VLAN_PCP") ? "vlanPcp" : "vlanDei");
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s %llu",(type == "MATCH_VLAN_ID") ? "vlan" : ((type == "MATCH_VLAN_PCP") ? "vlanpcp" : "vlandei"),(unsigned long long)OSUtils::jsonInt(r[k],0ULL));
+			m = tmp;
+		} else if ((type == "MATCH_MAC_SOURCE")||(type == "MATCH_MAC_DEST")) {
+			m = ((type == "MATCH_MAC_SOURCE") ? "macsrc " : "macdest ") + OSUtils::jsonString(r["mac"],"");
+		} else if ((type == "MATCH_IPV4_SOURCE")||(type == "MATCH_IPV6_SOURCE")) {
+			m = "ipsrc " + OSUtils::jsonString(r["ip"],"");
+		} else if ((type == "MATCH_IPV4_DEST")||(type == "MATCH_IPV6_DEST")) {
+			m = "ipdest " + OSUtils::jsonString(r["ip"],"");
+		} else if (type == "MATCH_IP_TOS") {
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"iptos 0x%llx %llu-%llu",(unsigned long long)OSUtils::jsonInt(r["mask"],0ULL),(unsigned long long)OSUtils::jsonInt(r["start"],0ULL),(unsigned long long)OSUtils::jsonInt(r["end"],0ULL));
+			m = tmp;
+		} else if (type == "MATCH_IP_PROTOCOL") {
+			const unsigned long long p = OSUtils::jsonInt(r["ipProtocol"],0ULL);
+			switch(p) {
+				case 0x01: m = "ipprotocol icmp"; break;
+				case 0x06: m = "ipprotocol tcp"; break;
+				case 0x11: m = "ipprotocol udp"; break;
+				case 0x3a: m = "ipprotocol icmp6"; break;
+				default:
+					OSUtils::ztsnprintf(tmp,sizeof(tmp),"ipprotocol %llu",p);
+					m = tmp;
+					break;
+			}
+		} else if (type == "MATCH_ETHERTYPE") {
+			const unsigned long long et = OSUtils::jsonInt(r["etherType"],0ULL);
+			switch(et) {
+				case 0x0800: m = "ethertype ipv4"; break;
+				case 0x0806: m = "ethertype arp"; break;
+				case 0x86dd: m = "ethertype ipv6"; break;
+				default:
+					OSUtils::ztsnprintf(tmp,sizeof(tmp),"ethertype 0x%.4llx",et);
+					m = tmp;
+					break;
+			}
+		} else if (type == "MATCH_ICMP") {
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"icmp %llu %lld",(unsigned long long)OSUtils::jsonInt(r["icmpType"],0ULL),r["icmpCode"].is_number() ? (long long)OSUtils::jsonInt(r["icmpCode"],0ULL) : -1LL);
+			m = tmp;
+		} else if ((type == "MATCH_IP_SOURCE_PORT_RANGE")||(type == "MATCH_IP_DEST_PORT_RANGE")||(type == "MATCH_FRAME_SIZE_RANGE")) {
+			const char *const k = (type == "MATCH_IP_SOURCE_PORT_RANGE") ? "sport" : ((type == "MATCH_IP_DEST_PORT_RANGE") ? "dport" : "framesize");
+			const unsigned long long start = OSUtils::jsonInt(r["start"],0ULL);
+			const unsigned long long end = OSUtils::jsonInt(r["end"],0ULL);
+			if (start == end)
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s %llu",k,start);
+			else OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s %llu-%llu",k,start,end);
+			m = tmp;
+		} else if (type == "MATCH_CHARACTERISTICS") {
+			const uint64_t mask = Utils::hexStrToU64(OSUtils::jsonString(r["mask"],"0").c_str());
+			m = "chr ";
+			for(unsigned int b=0;b<64;++b) {
+				if ((mask & (1ULL << b)) != 0) {
+					if (m.length() > 4)
+						m.push_back(',');
+					if (chrNames[b]) {
+						m.append(chrNames[b]);
+					} else {
+						OSUtils::ztsnprintf(tmp,sizeof(tmp),"%u",b);
+						m.append(tmp);
+					}
+				}
+			}
+		} else if (type == "MATCH_RANDOM") {
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"random %g",(double)OSUtils::jsonInt(r["probability"],0ULL) / 4294967295.0);
+			m = tmp;
+		} else if ((type == "MATCH_TAGS_DIFFERENCE")||(type == "MATCH_TAGS_BITWISE_AND")||(type == "MATCH_TAGS_BITWISE_OR")||(type == "MATCH_TAGS_BITWISE_XOR")||(type == "MATCH_TAGS_EQUAL")||(type == "MATCH_TAG_SENDER")||(type == "MATCH_TAG_RECEIVER")) {
+			const char *k;
+			if (type == "MATCH_TAGS_DIFFERENCE") k = "tdiff";
+			else if (type == "MATCH_TAGS_BITWISE_AND") k = "tand";
+			else if (type == "MATCH_TAGS_BITWISE_OR") k = "tor";
+			else if (type == "MATCH_TAGS_BITWISE_XOR") k = "txor";
+			else if (type == "MATCH_TAGS_EQUAL") k = "teq";
+			else if (type == "MATCH_TAG_SENDER") k = "tseq";
+			else k = "treq";
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s %llu %llu",k,(unsigned long long)OSUtils::jsonInt(r["id"],0ULL),(unsigned long long)OSUtils::jsonInt(r["value"],0ULL));
+			m = tmp;
+		} else {
+			matches.append(ZT_EOL_S);
+			matches.append(indent);
+			matches.append("\t# unsupported match ");
+			matches.append(type);
+			continue;
+		}
+
+		matches.append(ZT_EOL_S);
+		matches.append(indent);
+		matches.push_back('\t');
+		if (OSUtils::jsonBool(r["or"],false))
+			matches.append("or ");
+		if (OSUtils::jsonBool(r["not"],false))
+			matches.append("not ");
+		matches.append(m);
+	}
+	if (!matches.empty()) {
+		out.append(indent);
+		out.append("# trailing matches without an action were omitted" ZT_EOL_S);
+	}
+}
+
+// Print a member's tags or capabilities along with the names the network defines for them
+static void cliPrintMemberRules(nlohmann::json &member,nlohmann::json &network,const bool tags)
+{
+	nlohmann::json &defs = network[(tags) ? "tags" : "capabilities"];
+	nlohmann::json &current = member[(tags) ? "tags" : "capabilities"];
+	cliHeader("200 controller member %s %s" ZT_EOL_S "%s" ZT_EOL_S,OSUtils::jsonString(member["id"],"").c_str(),(tags) ? "tags" : "capabilities",(tags) ? "<id>       <name>                           <value>" : "<id>       <name>");
+	for(unsigned long i=0;i<current.size();++i) {
+		if ((tags)&&((!current[i].is_array())||(current[i].size() != 2)))
+			continue;
+		const uint64_t id = OSUtils::jsonInt((tags) ? current[i][0] : current[i],0ULL);
+		const long d = cliFindDefinition(defs,std::to_string((unsigned long long)id));
+		const std::string name((d >= 0) ? OSUtils::jsonString(defs[d]["name"],"") : std::string("(undeclared)"));
+		if (tags)
+			printf("%-10llu %-32s %llu" ZT_EOL_S,(unsigned long long)id,(name.length() > 0) ? name.c_str() : "-",(unsigned long long)OSUtils::jsonInt(current[i][1],0ULL));
+		else printf("%-10llu %s" ZT_EOL_S,(unsigned long long)id,(name.length() > 0) ? name.c_str() : "-");
+	}
+}
+
+static int cliControllerError(const char *cmd,unsigned int scode,const std::string &responseBody)
+{
+	if (scode == 0)
+		fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+	else fprintf(cliDiag(),"%u controller %s %s" ZT_EOL_S,scode,cmd,responseBody.c_str());
+	return cliExitCode(scode);
+}
+
+static std::string cliUrlEncode(const std::string &s)
+{
+	std::string enc;
+	for(std::string::const_iterator c(s.begin());c!=s.end();++c) {
+		if (((*c >= 'a')&&(*c <= 'z'))||((*c >= 'A')&&(*c <= 'Z'))||((*c >= '0')&&(*c <= '9'))||(*c == '-')||(*c == '_')||(*c == '.')) {
+			enc.push_back(*c);
+		} else {
+			char h[8];
+			OSUtils::ztsnprintf(h,sizeof(h),"%%%.2X",(unsigned int)((unsigned char)*c));
+			enc.append(h);
+		}
+	}
+	return enc;
+}
+
+// Addresses of members of a network with exactly this name
+static unsigned int cliMembersNamed(const std::string &nwid,const std::string &name,std::vector<std::string> &addresses,std::string &responseBody,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	nlohmann::json r;
+	const unsigned int scode = cliRequest(addr,requestHeaders,"GET",std::string("/controller/network/") + nwid + "/member?offset=0&nameContains=" + cliUrlEncode(name),(const nlohmann::json *)0,responseBody,r);
+	if ((scode != 200)||(!r.is_object()))
+		return (scode == 200) ? 500 : scode;
+	nlohmann::json &data = r["data"];
+	for(unsigned long i=0;i<data.size();++i) {
+		if (OSUtils::jsonString(data[i]["name"],"") == name)
+			addresses.push_back(OSUtils::jsonString(data[i]["id"],""));
+	}
+	return scode;
+}
+
+// Members may be selected by 10-digit address or by a name only one member has
+static int cliResolveMember(const char *cmd,const std::string &nwid,const std::string &selector,std::string &address,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	if ((selector.length() == 10)&&(selector.find_first_not_of("0123456789abcdefABCDEF") == std::string::npos)) {
+		address = selector;
+		return 0;
+	}
+	std::string responseBody;
+	std::vector<std::string> matches;
+	const unsigned int scode = cliMembersNamed(nwid,selector,matches,responseBody,addr,requestHeaders);
+	if (scode != 200)
+		return cliControllerError(cmd,scode,responseBody);
+	if (matches.empty()) {
+		fprintf(stderr,"%s is not an address or the name of a member of %s" ZT_EOL_S,selector.c_str(),nwid.c_str());
+		return ZT_CLI_EXIT_NOT_FOUND;
+	}
+	if (matches.size() > 1) {
+		std::string l;
+		for(std::vector<std::string>::const_iterator m(matches.begin());m!=matches.end();++m)
+			l.append((l.empty()) ? "" : ", ").append(*m);
+		fprintf(stderr,"%s is the name of more than one member of %s (%s), use an address instead" ZT_EOL_S,selector.c_str(),nwid.c_str(),l.c_str());
+		return ZT_CLI_EXIT_USAGE;
+	}
+	address = matches[0];
+	return 0;
+}
+
+static int cliSetTokenError(const char *cmd,unsigned int scode,const std::string &responseBody)
+{
+	if (scode == 0)
+		fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+	else fprintf(cliDiag(),"%u set token %s %s" ZT_EOL_S,scode,cmd,responseBody.c_str());
+	return cliExitCode(scode);
+}
+
+// set token add --scope=<controller|controller:read> | set token list | set token remove <id>
+static int cliSetToken(const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json r;
+	unsigned int scode;
+	if ((args.size() == 2)&&(args[1] == "add")) {
+		std::map<std::string,std::string>::const_iterator s(longOpts.find("scope"));
+		if ((s == longOpts.end())||((s->second != "controller")&&(s->second != "controller:read"))) {
+			fprintf(stderr,"invalid format: set token add --scope=<controller|controller:read>" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		nlohmann::json b;
+		b["scope"] = s->second;
+		scode = cliRequest(addr,requestHeaders,"POST","/token",&b,responseBody,r);
+		if ((scode != 200)||(!r.is_object()))
+			return cliSetTokenError("add",scode,responseBody);
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson(r).c_str());
+		} else {
+			printf("200 set token add %s %s" ZT_EOL_S,OSUtils::jsonString(r["id"],"-").c_str(),OSUtils::jsonString(r["scope"],"-").c_str());
+			printf("%s" ZT_EOL_S,OSUtils::jsonString(r["token"],"").c_str());
+		}
+		return 0;
+	} else if ((args.size() == 2)&&(args[1] == "list")) {
+		scode = cliRequest(addr,requestHeaders,"GET","/token",(const nlohmann::json *)0,responseBody,r);
+		if ((scode != 200)||(!r.is_array()))
+			return cliSetTokenError("list",scode,responseBody);
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson(r).c_str());
+			return 0;
+		}
+		cliHeader("200 set token list <id> <scope> <created>" ZT_EOL_S);
+		for(unsigned long i=0;i<r.size();++i)
+			printf("200 set token list %s %s %s" ZT_EOL_S,OSUtils::jsonString(r[i]["id"],"-").c_str(),OSUtils::jsonString(r[i]["scope"],"-").c_str(),cliUtcTime(OSUtils::jsonInt(r[i]["created"],0ULL)).c_str());
+		return 0;
+	} else if ((args.size() == 3)&&(args[1] == "remove")) {
+		scode = cliRequest(addr,requestHeaders,"DELETE",std::string("/token/") + args[2],(const nlohmann::json *)0,responseBody,r);
+		if (scode != 200)
+			return cliSetTokenError("remove",scode,responseBody);
+		cliOK("200 set token remove OK" ZT_EOL_S);
+		return 0;
+	}
+	fprintf(stderr,"invalid format: set token add --scope=<controller|controller:read> | set token list | set token remove <id>" ZT_EOL_S);
+	return ZT_CLI_EXIT_USAGE;
+}
+
+// Parse the --interval=<seconds> option of --watch commands, which defaults to one second
+static bool cliWatchInterval(const std::map<std::string,std::string> &longOpts,unsigned long &interval,const unsigned long dfl = 1000)
+{
+	interval = dfl;
+	std::map<std::string,std::string>::const_iterator i(longOpts.find("interval"));
+	if (i == longOpts.end())
+		return true;
+	if ((i->second.empty())||(i->second.length() > 4)||(i->second.find_first_not_of("0123456789") != std::string::npos))
+		return false;
+	interval = strtoul(i->second.c_str(),(char **)0,10) * 1000;
+	return (interval > 0);
+}
+
+// Comma-separated ZeroTier-assigned addresses of a network from /network, or "-"
+static std::string cliNetworkAddresses(nlohmann::json &n)
+{
+	std::string aa;
+	nlohmann::json &assignedAddresses = n["assignedAddresses"];
+	for(unsigned long i=0;i<assignedAddresses.size();++i) {
+		if (assignedAddresses[i].is_string()) {
+			if (aa.length() > 0)
+				aa.push_back(',');
+			aa.append(assignedAddresses[i].get<std::string>());
+		}
+	}
+	return (aa.length() > 0) ? aa : std::string("-");
+}
+
+// Quiet mode form of a joined network: its assigned addresses, one per line
+static void cliPrintNetworkAddresses(nlohmann::json &n)
+{
+	nlohmann::json &assignedAddresses = n["assignedAddresses"];
+	for(unsigned long i=0;i<assignedAddresses.size();++i) {
+		if (assignedAddresses[i].is_string())
+			printf("%s" ZT_EOL_S,assignedAddresses[i].get<std::string>().c_str());
+	}
+}
+
+// Show a planet, confirm, then hand it to the service, which restarts to use it
+static int cliPlanetSwitch(const char *cmd,const std::string &from,const World &w,const std::string &homeDir,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	if ((!printWorld(w))||(w.type() != World::TYPE_PLANET)) {
+		fprintf(stderr,"%s is not a valid planet; not switching" ZT_EOL_S,from.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	if (longOpts.find("yes") == longOpts.end()) {
+		fprintf(stderr,"Switch this node to planet %.16llx? It will restart and use only these roots, and will no longer accept updates to its current planet. [y/N] ",(unsigned long long)w.id());
+		fflush(stderr);
+		char answer[64];
+		if ((!fgets(answer,sizeof(answer),stdin))||((cliTrim(answer) != "y")&&(cliTrim(answer) != "yes"))) {
+			fprintf(stderr,"not switched" ZT_EOL_S);
+			return ZT_CLI_EXIT_FAILED;
+		}
+	}
+
+	Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> wbuf;
+	w.serialize(wbuf);
+	char *const whex = new char[(wbuf.size() * 2) + 1];
+	nlohmann::json b;
+	b["planet"] = Utils::hex(wbuf.data(),wbuf.size(),whex);
+	delete [] whex;
+	std::map<std::string,std::string> switchHeaders(requestHeaders);
+	switchHeaders["X-Confirm-Planet-Switch"] = "true";
+	std::string responseBody;
+	nlohmann::json j;
+	const unsigned int scode = cliRequest(addr,switchHeaders,"PUT","/planet",&b,responseBody,j);
+	if (scode == 200) {
+		if (json)
+			printf("%s" ZT_EOL_S,cliJson(j).c_str());
+		else cliOK("200 %s OK: the service is restarting with planet %.16llx" ZT_EOL_S,cmd,(unsigned long long)w.id());
+		return 0;
+	} else if (scode != 0) {
+		fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,cmd,responseBody.c_str());
+		return cliExitCode(scode);
+	}
+
+	// Service is not running, so install the planet for its next start
+	const std::string planetPath(homeDir + ZT_PATH_SEPARATOR_S + "planet");
+	std::string oldPlanet;
+	if ((OSUtils::readFile(planetPath.c_str(),oldPlanet))&&(!OSUtils::writeFile((planetPath + ".saved_before_switch").c_str(),oldPlanet))) {
+		fprintf(stderr,"unable to save old planet to %s.saved_before_switch" ZT_EOL_S,planetPath.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	if (!OSUtils::writeFile(planetPath.c_str(),wbuf.data(),wbuf.size())) {
+		fprintf(stderr,"unable to write %s" ZT_EOL_S,planetPath.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	cliOK("200 %s OK: the service is not running, planet %.16llx will be used when it starts" ZT_EOL_S,cmd,(unsigned long long)w.id());
+	return 0;
+}
+
+// Fetch a file over plain HTTP, returning false with the reason in body on failure
+static bool cliHttpDownload(const std::string &url,unsigned long maxSize,std::string &body)
+{
+	std::string host,path;
+	unsigned int port = 0;
+	if (!Webhooks::parseUrl(url,host,port,path)) {
+		body = "invalid URL (only http:// is supported)";
+		return false;
+	}
+
+	InetAddress addr;
+	struct addrinfo hints,*res = (struct addrinfo *)0;
+	memset(&hints,0,sizeof(hints));
+	hints.ai_family = AF_UNSPEC;
+	hints.ai_socktype = SOCK_STREAM;
+	if ((getaddrinfo(host.c_str(),(const char *)0,&hints,&res) != 0)||(!res)) {
+		body = std::string("unable to resolve ") + host;
+		return false;
+	}
+	for(struct addrinfo *ai=res;ai;ai=ai->ai_next) {
+		if ((ai->ai_family == AF_INET)||(ai->ai_family == AF_INET6)) {
+			addr = ai->ai_addr;
+			break;
+		}
+	}
+	freeaddrinfo(res);
+	if (!addr) {
+		body = std::string("no IPv4 or IPv6 address for ") + host;
+		return false;
+	}
+	addr.setPort(port);
+
+	char ua[64];
+	std::map<std::string,std::string> requestHeaders,responseHeaders;
+	requestHeaders["Host"] = (port == 80) ? host : (host + ":" + std::to_string(port));
+	OSUtils::ztsnprintf(ua,sizeof(ua),"zerotier-cli/%d.%d.%d",ZEROTIER_ONE_VERSION_MAJOR,ZEROTIER_ONE_VERSION_MINOR,ZEROTIER_ONE_VERSION_REVISION);
+	requestHeaders["User-Agent"] = ua;
+	const unsigned int scode = Http::GET(maxSize,60000,(const struct sockaddr *)&addr,path.c_str(),requestHeaders,responseHeaders,body);
+	if (scode == 200)
+		return true;
+	if (scode != 0)
+		body = std::string("HTTP ") + std::to_string(scode);
+	return false;
+}
+
+// Parse IP/port, IP:port, [IPv6]:port or, if resolve is set, host:port or host/port into one or more endpoints
+static bool cliParseEndpoint(const std::string &s,const bool resolve,std::vector<InetAddress> &endpoints,bool &resolved,std::string &err)
+{
+	resolved = false;
+
+	std::string host,port;
+	std::size_t sep;
+	if ((sep = s.rfind('/')) != std::string::npos) {
+		host = s.substr(0,sep);
+		port = s.substr(sep + 1);
+	} else if ((s.length() > 0)&&(s[0] == '[')) {
+		if ((sep = s.find("]:")) != std::string::npos) {
+			host = s.substr(1,sep - 1);
+			port = s.substr(sep + 2);
+		}
+	} else if (((sep = s.find(':')) != std::string::npos)&&(s.find(':',sep + 1) == std::string::npos)) {
+		host = s.substr(0,sep);
+		port = s.substr(sep + 1);
+	}
+	const unsigned long p = ((port.length() > 0)&&(port.length() <= 5)&&(port.find_first_not_of("0123456789") == std::string::npos)) ? strtoul(port.c_str(),(char **)0,10) : 0;
+	if ((host.empty())||(p == 0)||(p > 0xffff)) {
+		err = "expected an IP/port such as 10.0.0.2/9993";
+		return false;
+	}
+
+	uint8_t ipb[16];
+	InetAddress ip;
+	if (inet_pton(AF_INET,host.c_str(),ipb) == 1) {
+		ip.set(ipb,4,(unsigned int)p);
+		endpoints.push_back(ip);
+		return true;
+	}
+	if (inet_pton(AF_INET6,host.c_str(),ipb) == 1) {
+		ip.set(ipb,16,(unsigned int)p);
+		endpoints.push_back(ip);
+		return true;
+	}
+	if (!resolve) {
+		err = host + " is not an IP address, add --resolve to look up host names";
+		return false;
+	}
+
+	struct addrinfo hints,*res = (struct addrinfo *)0;
+	memset(&hints,0,sizeof(hints));
+	hints.ai_family = AF_UNSPEC;
+	hints.ai_socktype = SOCK_DGRAM;
+	if ((getaddrinfo(host.c_str(),(const char *)0,&hints,&res) != 0)||(!res)) {
+		err = std::string("unable to resolve ") + host;
+		return false;
+	}
+	const std::size_t before = endpoints.size();
+	for(struct addrinfo *ai=res;ai;ai=ai->ai_next) {
+		if ((ai->ai_family != AF_INET)&&(ai->ai_family != AF_INET6))
+			continue;
+		InetAddress a(ai->ai_addr);
+		a.setPort((unsigned int)p);
+		if (std::find(endpoints.begin() + before,endpoints.end(),a) == endpoints.end())
+			endpoints.push_back(a);
+	}
+	freeaddrinfo(res);
+	if (endpoints.size() == before) {
+		err = std::string("no IPv4 or IPv6 address for ") + host;
+		return false;
+	}
+	resolved = true;
+	return true;
+}
+
+// peer <address> try <endpoint> [<endpoint> ...] [--resolve] [--timeout=<duration>]
+static int cliPeerTry(const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	if ((args.size() < 3)||(args[0].length() != 10)) {
+		fprintf(stderr,"invalid format: peer <address> try <endpoint> [<endpoint> ...] [--resolve] [--timeout=<duration>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const bool resolve = (longOpts.count("resolve") > 0);
+
+	// Each endpoint tried, and what was given for it if it came from a host name
+	char tmp[128];
+	nlohmann::json b;
+	std::map<std::string,std::string>::const_iterator o(longOpts.find("timeout"));
+	if (o != longOpts.end()) {
+		int64_t ms = 0;
+		const std::string &t = o->second;
+		if ((t.empty())||(t[t.length() - 1] < 'a')||(!cliParseExpiry(t,0,ms))||(ms < 1000)||(ms > 30000)) {
+			fprintf(stderr,"invalid --timeout %s: expected a duration from 1s to 30s like 10s" ZT_EOL_S,t.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		b["timeout"] = ms;
+	}
+	std::map<std::string,std::string> from;
+	nlohmann::json &eps = b["endpoints"];
+	eps = nlohmann::json::array();
+	for(unsigned long i=2;i<args.size();++i) {
+		std::vector<InetAddress> a;
+		std::string err;
+		bool resolved = false;
+		if (!cliParseEndpoint(args[i],resolve,a,resolved,err)) {
+			fprintf(stderr,"invalid endpoint %s: %s" ZT_EOL_S,args[i].c_str(),err.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		for(std::vector<InetAddress>::const_iterator e(a.begin());e!=a.end();++e) {
+			const std::string es(e->toString(tmp));
+			if (resolved)
+				from[es] = args[i];
+			eps.push_back(es);
+		}
+	}
+
+	std::string responseBody;
+	nlohmann::json r;
+	const unsigned int scode = cliRequest(addr,requestHeaders,"POST",std::string("/peer/") + args[0] + "/try",&b,responseBody,r);
+	if (scode == 0) {
+		fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S,responseBody.c_str());
+		return ZT_CLI_EXIT_UNREACHABLE;
+	}
+	if ((scode != 200)||(!r.is_object())) {
+		if (scode == 404)
+			printf("404 peer try: %s is not a known peer" ZT_EOL_S,args[0].c_str());
+		else fprintf(cliDiag(),"%u peer try %s" ZT_EOL_S,scode,responseBody.c_str());
+		return cliExitCode(scode);
+	}
+
+	// The service waits for endpoints to answer before responding, so each result is final
+	nlohmann::json &results = r["endpoints"];
+	unsigned long activeCount = 0;
+	for(unsigned long i=0;i<results.size();++i) {
+		std::map<std::string,std::string>::const_iterator f(from.find(OSUtils::jsonString(results[i]["endpoint"],"")));
+		if (f != from.end())
+			results[i]["resolvedFrom"] = f->second;
+		if (OSUtils::jsonBool(results[i]["active"],false))
+			++activeCount;
+	}
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(r).c_str());
+	} else {
+		cliHeader("200 peer try %s" ZT_EOL_S "<endpoint>                                     <result>      <from>" ZT_EOL_S,args[0].c_str());
+		for(unsigned long i=0;i<results.size();++i) {
+			const std::string result(OSUtils::jsonString(results[i]["result"],"failed"));
+			printf("%-46s %s %s" ZT_EOL_S,
+				OSUtils::jsonString(results[i]["endpoint"],"-").c_str(),
+				cliStatus((result == "active") ? "ACTIVE" : ((result == "not_attempted") ? "NOT_TRIED" : "FAILED"),13).c_str(),
+				OSUtils::jsonString(results[i]["resolvedFrom"],"-").c_str());
+		}
+	}
+	return (activeCount > 0) ? 0 : ZT_CLI_EXIT_FAILED;
+}
+
+// The planet a node in homeDir trusts now: its saved planet, or the built-in one if it has none
+static World cliCurrentPlanet(const std::string &homeDir)
+{
+	World w;
+	if ((getWorldFromFile((homeDir + ZT_PATH_SEPARATOR_S + "planet").c_str(),w))&&(w.type() == World::TYPE_PLANET))
+		return w;
+	return Topology::defaultPlanet();
+}
+
+// set planet <url|file> [--signing-key=<key>] [--world-id=<ID>]
+static int cliSetPlanet(const std::vector<std::string> &args,const std::string &homeDir,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	if (args.size() != 2) {
+		fprintf(stderr,"invalid format: set planet <url|file> [--signing-key=<key>] [--world-id=<ID>] [--yes]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string &from = args[1];
+
+	std::map<std::string,std::string>::const_iterator o(longOpts.find("signing-key"));
+	const bool pinKey = (o != longOpts.end());
+	C25519::Public key;
+	if ((pinKey)&&((o->second.length() != (ZT_C25519_PUBLIC_KEY_LEN * 2))||(Utils::unhex(o->second.c_str(),key.data,ZT_C25519_PUBLIC_KEY_LEN) != ZT_C25519_PUBLIC_KEY_LEN))) {
+		fprintf(stderr,"--signing-key must be the %u hex digit key shown as the planet's signing key" ZT_EOL_S,ZT_C25519_PUBLIC_KEY_LEN * 2);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const bool pinId = ((o = longOpts.find("world-id")) != longOpts.end());
+	const uint64_t worldId = (pinId) ? Utils::hexStrToU64(o->second.c_str()) : 0;
+	if ((pinId)&&((o->second.length() == 0)||(o->second.length() > 16)||(o->second.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos))) {
+		fprintf(stderr,"--world-id must be a planet ID of up to 16 hex digits" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	World w;
+	if ((from.substr(0,7) == "http://")||(from.substr(0,8) == "https://")) {
+		if (from.substr(0,8) == "https://") {
+			fprintf(stderr,"https:// is not supported; download the planet separately and use: set planet <file>" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		// Nothing authenticates a plain http download, so the planet must match something already trusted
+		if ((!pinKey)&&(!pinId)) {
+			fprintf(stderr,"refusing to use a planet downloaded over plain http without --signing-key=<key> or --world-id=<ID> to check it against" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		std::string wser;
+		if (!cliHttpDownload(from,ZT_WORLD_MAX_SERIALIZED_LENGTH + 1,wser)) {
+			fprintf(stderr,"unable to download %s: %s" ZT_EOL_S,from.c_str(),wser.c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		if (!getWorldFromBytes(wser,w)) {
+			fprintf(stderr,"%s did not return a valid planet file" ZT_EOL_S,from.c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+	} else if (!getWorldFromFile(from.c_str(),w)) {
+		fprintf(stderr,"%s is not readable or is not a valid planet file" ZT_EOL_S,from.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+
+	if ((pinKey)&&(memcmp(w.updatesMustBeSignedBy().data,key.data,ZT_C25519_PUBLIC_KEY_LEN) != 0)) {
+		fprintf(stderr,"%s is not signed with the key given by --signing-key; not switching" ZT_EOL_S,from.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	if (pinId) {
+		if (w.id() != worldId) {
+			fprintf(stderr,"%s is planet %.16llx, not %.16llx; not switching" ZT_EOL_S,from.c_str(),(unsigned long long)w.id(),(unsigned long long)worldId);
+			return ZT_CLI_EXIT_FAILED;
+		}
+		// An ID alone is easy to copy, so it only pins a planet whose signing key this node already trusts
+		const World current(cliCurrentPlanet(homeDir));
+		if ((!pinKey)&&(current.id() != worldId)) {
+			fprintf(stderr,"this node's current planet is %.16llx, so --world-id can not check %s; use --signing-key instead" ZT_EOL_S,(unsigned long long)current.id(),from.c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		if ((!pinKey)&&(memcmp(w.updatesMustBeSignedBy().data,current.updatesMustBeSignedBy().data,ZT_C25519_PUBLIC_KEY_LEN) != 0)) {
+			fprintf(stderr,"%s is not signed with the key of this node's current planet %.16llx; use --signing-key to trust a different key" ZT_EOL_S,from.c_str(),(unsigned long long)current.id());
+			return ZT_CLI_EXIT_FAILED;
+		}
+	}
+
+	return cliPlanetSwitch("set planet",from,w,homeDir,longOpts,json,addr,requestHeaders);
+}
+
+// network <network ID> multicast list|subscribe <mac> [<adi>]|unsubscribe <mac> [<adi>]
+static int cliNetworkMulticast(const std::vector<std::string> &args,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	const std::string op((args.size() >= 3) ? args[2] : std::string());
+	if ((args[0].length() != 16)||(!(((op == "list")&&(args.size() == 3))||(((op == "subscribe")||(op == "unsubscribe"))&&(args.size() >= 4)&&(args.size() <= 5))))) {
+		fprintf(stderr,"invalid format: network <network ID> multicast list|subscribe <mac> [<adi>]|unsubscribe <mac> [<adi>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string adi((args.size() == 5) ? args[4] : std::string("0"));
+	if ((op != "list")&&((adi.empty())||(adi.length() > 10)||(adi.find_first_not_of("0123456789") != std::string::npos)||(Utils::strToU64(adi.c_str()) > 0xffffffffULL))) {
+		fprintf(stderr,"invalid ADI %s: must be an integer from 0 to 4294967295" ZT_EOL_S,adi.c_str());
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	const std::string path(std::string("/network/") + args[0] + "/multicast");
+	std::string responseBody;
+	nlohmann::json j;
+	unsigned int scode;
+	if (op == "subscribe") {
+		nlohmann::json b;
+		b["mac"] = args[3];
+		b["adi"] = Utils::strToU64(adi.c_str());
+		scode = cliRequest(addr,requestHeaders,"POST",path,&b,responseBody,j);
+	} else if (op == "unsubscribe") {
+		scode = cliRequest(addr,requestHeaders,"DELETE",path + "/" + args[3] + "/" + adi,(const nlohmann::json *)0,responseBody,j);
+	} else {
+		scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,j);
+	}
+	if (scode == 0) {
+		fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S,responseBody.c_str());
+		return ZT_CLI_EXIT_UNREACHABLE;
+	}
+	if ((scode != 200)||(!j.is_array())) {
+		if ((scode == 404)&&((!j.is_object())||(!j.count("message"))))
+			printf("404 network multicast %s: not a member of network %s" ZT_EOL_S,op.c_str(),args[0].c_str());
+		else fprintf(cliDiag(),"%u network multicast %s %s" ZT_EOL_S,scode,op.c_str(),(j.is_object()) ? OSUtils::jsonString(j["message"],responseBody.c_str()).c_str() : responseBody.c_str());
+		return cliExitCode(scode);
+	}
+
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(j).c_str());
+		return 0;
+	}
+	cliHeader("200 network multicast %s" ZT_EOL_S,op.c_str());
+	cliHeader("<mac>             <adi>      <source>" ZT_EOL_S);
+	for(unsigned long i=0;i<j.size();++i) {
+		printf("%-17s %-10llu %s" ZT_EOL_S,
+			OSUtils::jsonString(j[i]["mac"],"-").c_str(),
+			(unsigned long long)OSUtils::jsonInt(j[i]["adi"],0ULL),
+			(OSUtils::jsonBool(j[i]["manual"],false)) ? "manual" : "interface");
+	}
+	return 0;
+}
+
+// A MAC address, or a 10-digit ZeroTier address standing for its MAC on a network
+static bool cliParseTraceMac(const std::string &s,const uint64_t nwid,std::string &mac)
+{
+	char tmp[32];
+	if ((s.length() == 10)&&(s.find_first_not_of("0123456789abcdefABCDEF") == std::string::npos)) {
+		mac = MAC(Address(Utils::hexStrToU64(s.c_str())),nwid).toString(tmp);
+		return true;
+	}
+	uint64_t m = 0;
+	unsigned int digits = 0;
+	for(std::string::const_iterator c(s.begin());c!=s.end();++c) {
+		if ((*c == ':')||(*c == '-'))
+			continue;
+		const char l = (char)tolower(*c);
+		if ((l >= '0')&&(l <= '9'))
+			m = (m << 4) | (uint64_t)(l - '0');
+		else if ((l >= 'a')&&(l <= 'f'))
+			m = (m << 4) | (uint64_t)(l - 'a' + 10);
+		else return false;
+		++digits;
+	}
+	if (digits != 12)
+		return false;
+	mac = MAC(m).toString(tmp);
+	return true;
+}
+
+static std::string cliEtherTypeName(const unsigned int etherType)
+{
+	switch(etherType) {
+		case 0x0800: return std::string("IPv4");
+		case 0x0806: return std::string("ARP");
+		case 0x86dd: return std::string("IPv6");
+	}
+	char tmp[16];
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"0x%.4x",etherType);
+	return std::string(tmp);
+}
+
+// trace <network ID> [--src=<MAC|address>] [--dst=<MAC|address>] [--ethertype=<hex>]
+static int cliTrace(const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	if ((args.size() != 1)||(args[0].length() != 16)) {
+		fprintf(stderr,"invalid format: trace <network ID> [--src=<MAC|address>] [--dst=<MAC|address>] [--ethertype=<hex>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const uint64_t nwid = Utils::hexStrToU64(args[0].c_str());
+
+	std::string src,dst;
+	std::map<std::string,std::string>::const_iterator o(longOpts.find("src"));
+	if ((o != longOpts.end())&&(!cliParseTraceMac(o->second,nwid,src))) {
+		fprintf(stderr,"invalid --src %s: expected a MAC or 10-digit ZeroTier address" ZT_EOL_S,o->second.c_str());
+		return ZT_CLI_EXIT_USAGE;
+	}
+	if (((o = longOpts.find("dst")) != longOpts.end())&&(!cliParseTraceMac(o->second,nwid,dst))) {
+		fprintf(stderr,"invalid --dst %s: expected a MAC or 10-digit ZeroTier address" ZT_EOL_S,o->second.c_str());
+		return ZT_CLI_EXIT_USAGE;
+	}
+	long etherType = -1;
+	if ((o = longOpts.find("ethertype")) != longOpts.end()) {
+		const std::string et(((o->second.length() > 2)&&(o->second[0] == '0')&&((o->second[1] == 'x')||(o->second[1] == 'X'))) ? o->second.substr(2) : o->second);
+		if ((et.empty())||(et.length() > 4)||(et.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)) {
+			fprintf(stderr,"invalid --ethertype %s: expected up to 4 hex digits such as 0800 or 86dd" ZT_EOL_S,o->second.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		etherType = (long)strtoul(et.c_str(),(char **)0,16);
+	}
+
+	// Polling keeps the service tracing, and it stops on its own shortly after this exits.
+	// The first request only starts the trace, so frames from an earlier one are not shown.
+	const std::string path(std::string("/network/") + args[0] + "/trace");
+	bool started = false;
+	uint64_t since = 0;
+	for(;;) {
+		std::string responseBody;
+		nlohmann::json r;
+		const unsigned int scode = cliRequest(addr,requestHeaders,"GET",(started) ? (path + "?since=" + std::to_string((unsigned long long)since)) : path,(const nlohmann::json *)0,responseBody,r);
+		if (scode == 0) {
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S,responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
+		}
+		if (scode == 404) {
+			printf("404 trace: not a member of network %s" ZT_EOL_S,args[0].c_str());
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+		if ((scode != 200)||(!r.is_object())) {
+			fprintf(cliDiag(),"%u trace %s" ZT_EOL_S,scode,responseBody.c_str());
+			return cliExitCode(scode);
+		}
+		if ((!started)&&(!json))
+			cliHeader("200 trace %s: frame metadata only, Ctrl-C to stop" ZT_EOL_S "<time>                  <dir> <src>             <dst>             <type> <vlan> <length>" ZT_EOL_S,args[0].c_str());
+		started = true;
+
+		const uint64_t dropped = OSUtils::jsonInt(r["dropped"],0ULL);
+		if ((dropped > 0)&&(!json))
+			fprintf(stderr,"(%llu frames not shown, output could not keep up)" ZT_EOL_S,(unsigned long long)dropped);
+		nlohmann::json &frames = r["frames"];
+		for(unsigned long i=0;i<frames.size();++i) {
+			nlohmann::json &f = frames[i];
+			const unsigned int et = (unsigned int)OSUtils::jsonInt(f["etherType"],0ULL);
+			if ((!src.empty())&&(OSUtils::jsonString(f["src"],"") != src))
+				continue;
+			if ((!dst.empty())&&(OSUtils::jsonString(f["dst"],"") != dst))
+				continue;
+			if ((etherType >= 0)&&((long)et != etherType))
+				continue;
+			if (json) {
+				printf("%s" ZT_EOL_S,OSUtils::jsonDump(f,-1).c_str());
+			} else {
+				const int64_t t = (int64_t)OSUtils::jsonInt(f["time"],0ULL);
+				const unsigned int vlanId = (unsigned int)OSUtils::jsonInt(f["vlanId"],0ULL);
+				printf("%s.%.3u %-5s %-17s %-17s %-6s %-6s %llu" ZT_EOL_S,
+					cliUtcTime(t).substr(0,19).c_str(),
+					(unsigned int)(t % 1000),
+					OSUtils::jsonString(f["direction"],"-").c_str(),
+					OSUtils::jsonString(f["src"],"-").c_str(),
+					OSUtils::jsonString(f["dst"],"-").c_str(),
+					cliEtherTypeName(et).c_str(),
+					(vlanId) ? std::to_string(vlanId).c_str() : "-",
+					(unsigned long long)OSUtils::jsonInt(f["length"],0ULL));
+			}
+		}
+		fflush(stdout);
+		since = OSUtils::jsonInt(r["next"],since);
+		Thread::sleep(250);
+	}
+}
+
+// network <network ID> show [--watch [--interval=<seconds>]]
+static int cliNetworkShow(const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	const std::string path(std::string("/network/") + args[0]);
+	const bool watch = (longOpts.count("watch") > 0);
+	unsigned long interval = 0;
+	if ((!cliWatchInterval(longOpts,interval))||((!watch)&&(longOpts.count("interval")))) {
+		fprintf(stderr,"invalid format: network <network ID> show [--watch [--interval=<seconds>]]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	std::string responseBody;
+	nlohmann::json n;
+	if (!watch) {
+		const unsigned int scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,n);
+		if (scode == 0) {
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
+		}
+		if ((scode != 200)||(!n.is_object())) {
+			fprintf(cliDiag(),"%u network show %s" ZT_EOL_S,scode,responseBody.c_str());
+			return cliExitCode(scode);
+		}
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson(n).c_str());
+			return 0;
+		}
+		if (cliQuiet) {
+			cliPrintNetworkAddresses(n);
+			return 0;
+		}
+		cliHeader("200 network show <nwid> <name> <mac> <status> <type> <dev> <ZT assigned ips>" ZT_EOL_S);
+		printf("200 network show %s %s %s %s %s %s %s" ZT_EOL_S,
+			OSUtils::jsonString(n["nwid"],"-").c_str(),
+			OSUtils::jsonString(n["name"],"-").c_str(),
+			OSUtils::jsonString(n["mac"],"-").c_str(),
+			cliStatus(OSUtils::jsonString(n["status"],"-")).c_str(),
+			OSUtils::jsonString(n["type"],"-").c_str(),
+			OSUtils::jsonString(n["portDeviceName"],"-").c_str(),
+			cliNetworkAddresses(n).c_str());
+		return 0;
+	}
+
+	// Print the state each time it changes, and stop once the network is up. The service
+	// going away or the network being left are shown as states rather than ending the watch.
+	if ((!json)&&(!cliQuiet))
+		cliHeader("200 network show %s: watching every %lus until OK, Ctrl-C to stop" ZT_EOL_S,args[0].c_str(),interval / 1000);
+	std::string last;
+	for(;;) {
+		const unsigned int scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,n);
+		std::string status,state;
+		if (scode == 0) {
+			status = "SERVICE_UNREACHABLE";
+		} else if (scode == 404) {
+			status = "NOT_JOINED";
+		} else if ((scode != 200)||(!n.is_object())) {
+			status = std::string("ERROR_") + std::to_string(scode);
+		} else {
+			status = OSUtils::jsonString(n["status"],"-");
+			state = cliNetworkAddresses(n);
+		}
+		state = (state.empty()) ? status : (status + " " + state);
+
+		if (state != last) {
+			const int64_t now = OSUtils::now();
+			if (json) {
+				nlohmann::json t;
+				t["time"] = now;
+				t["status"] = status;
+				if (scode == 200)
+					t["network"] = n;
+				printf("%s" ZT_EOL_S,OSUtils::jsonDump(t,-1).c_str());
+			} else if (!cliQuiet) {
+				const std::string addrs((scode == 200) ? cliNetworkAddresses(n) : std::string());
+				printf("%s %s%s" ZT_EOL_S,cliUtcTime(now).c_str(),cliStatus(status).c_str(),(addrs.empty()) ? "" : (std::string(" ") + addrs).c_str());
+			}
+			fflush(stdout);
+			last = state;
+		}
+		if (status == "OK") {
+			if ((cliQuiet)&&(!json))
+				cliPrintNetworkAddresses(n);
+			return 0;
+		}
+		Thread::sleep(interval);
+	}
+}
+
+// Columns and rows of the terminal standard output goes to, false if it is not a terminal
+static bool cliTerminalSize(unsigned int &cols,unsigned int &rows)
+{
+#ifdef __WINDOWS__
+	HANDLE h = GetStdHandle(STD_OUTPUT_HANDLE);
+	CONSOLE_SCREEN_BUFFER_INFO csbi;
+	DWORD mode = 0;
+	if ((!GetConsoleMode(h,&mode))||(!GetConsoleScreenBufferInfo(h,&csbi)))
+		return false;
+	SetConsoleMode(h,mode | 0x0004); // ENABLE_VIRTUAL_TERMINAL_PROCESSING, so escape codes work
+	cols = (unsigned int)(csbi.srWindow.Right - csbi.srWindow.Left + 1);
+	rows = (unsigned int)(csbi.srWindow.Bottom - csbi.srWindow.Top + 1);
+#else
+	struct winsize ws;
+	if ((!isatty(STDOUT_FILENO))||(ioctl(STDOUT_FILENO,TIOCGWINSZ,&ws) != 0))
+		return false;
+	cols = ws.ws_col;
+	rows = ws.ws_row;
+#endif
+	return ((cols > 0)&&(rows > 0));
+}
+
+// Cut or space-pad a line to exactly width columns, counting UTF-8 characters rather than bytes
+static std::string cliFit(const std::string &s,const unsigned int width)
+{
+	std::string r;
+	unsigned int w = 0;
+	for(std::string::const_iterator c(s.begin());c!=s.end();++c) {
+		if (((*c & 0xc0) != 0x80)&&(++w > width))
+			break;
+		r.push_back(*c);
+	}
+	while (w < width) {
+		r.push_back(' ');
+		++w;
+	}
+	return r;
+}
+
+// One line of a monitor panel per item, ending in a count of those there was no room for
+static void cliMonitorPanel(const std::string &title,const std::vector<std::string> &items,const unsigned long height,std::vector<std::string> &lines)
+{
+	lines.push_back(title);
+	for(unsigned long i=0;((i<items.size())&&(lines.size()<height));++i) {
+		if (((lines.size() + 1) == height)&&((i + 1) < items.size())) {
+			lines.push_back(std::string("... ") + std::to_string(items.size() - i) + " more");
+			break;
+		}
+		lines.push_back(items[i]);
+	}
+}
+
+struct CliMonitorEvent
+{
+	int64_t time;
+	std::string type;
+	std::string subject;
+	std::string message;
+};
+
+// What monitor compares between refreshes to find events
+struct CliMonitorState
+{
+	CliMonitorState() : reachable(false) {}
+	bool reachable;
+	std::string node;
+	std::map< std::string,std::pair<std::string,std::string> > networks; // ID -> status, assigned IPs
+	std::map< std::string,std::string > peers; // address -> best path or RELAY
+	std::map< std::string,bool > roots; // address -> online
+};
+
+// monitor [--interval=<seconds>]
+static int cliMonitor(const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	unsigned long interval = 0;
+	if ((!args.empty())||(!cliWatchInterval(longOpts,interval,2000))) {
+		fprintf(stderr,"invalid format: monitor [--interval=<seconds>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	// Without a terminal, or with -j, only the events are printed, one per line
+	unsigned int cols = 0,rows = 0;
+	const bool dashboard = ((!json)&&(cliTerminalSize(cols,rows)));
+
+	std::vector<CliMonitorEvent> events;
+	CliMonitorState last;
+	bool started = false;
+	for(;;) {
+		const int64_t now = OSUtils::now();
+		std::string responseBody,error;
+		nlohmann::json status,networks,peers;
+		const unsigned int scode = cliRequest(addr,requestHeaders,"GET","/status",(const nlohmann::json *)0,responseBody,status);
+		if (!started) {
+			if (scode == 0) {
+				fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S,responseBody.c_str());
+				return ZT_CLI_EXIT_UNREACHABLE;
+			}
+			if ((scode != 200)||(!status.is_object())) {
+				fprintf(cliDiag(),"%u monitor %s" ZT_EOL_S,scode,responseBody.c_str());
+				return cliExitCode(scode);
+			}
+		}
+		if (scode == 0)
+			error = "service unreachable: " + responseBody;
+		else if ((scode != 200)||(!status.is_object()))
+			error = std::to_string(scode) + " " + responseBody;
+		else if ((cliRequest(addr,requestHeaders,"GET","/network",(const nlohmann::json *)0,responseBody,networks) != 200)||(!networks.is_array()))
+			error = "unable to list networks: " + responseBody;
+		else if ((cliRequest(addr,requestHeaders,"GET","/peer",(const nlohmann::json *)0,responseBody,peers) != 200)||(!peers.is_array()))
+			error = "unable to list peers: " + responseBody;
+
+		CliMonitorState state;
+		state.reachable = error.empty();
+		if (state.reachable) {
+			state.node = (OSUtils::jsonBool(status["tcpFallbackActive"],false)) ? "TUNNELED" : ((OSUtils::jsonBool(status["online"],false)) ? "ONLINE" : "OFFLINE");
+			for(unsigned long i=0;i<networks.size();++i)
+				state.networks[OSUtils::jsonString(networks[i]["nwid"],"")] = std::pair<std::string,std::string>(OSUtils::jsonString(networks[i]["status"],"-"),cliNetworkAddresses(networks[i]));
+			for(unsigned long i=0;i<peers.size();++i) {
+				nlohmann::json &p = peers[i];
+				const std::string pa(OSUtils::jsonString(p["address"],""));
+				const std::string role(OSUtils::jsonString(p["role"],""));
+				std::string path("RELAY");
+				int64_t lastReceive = 0;
+				nlohmann::json &paths = p["paths"];
+				for(unsigned long k=0;k<paths.size();++k) {
+					if (OSUtils::jsonBool(paths[k]["preferred"],false))
+						path = OSUtils::jsonString(paths[k]["address"],"-");
+					lastReceive = std::max(lastReceive,(int64_t)OSUtils::jsonInt(paths[k]["lastReceive"],0ULL));
+				}
+				state.peers[pa] = path;
+				if ((role == "PLANET")||(role == "MOON"))
+					state.roots[pa] = ((lastReceive > 0)&&((now - lastReceive) < (ZT_PATH_HEARTBEAT_PERIOD + 5000)));
+			}
+		}
+
+		// Events are the differences from the last refresh
+		std::vector<CliMonitorEvent> fresh;
+		CliMonitorEvent e;
+		e.time = now;
+		if (!started) {
+			e.type = "monitor";
+			e.subject = OSUtils::jsonString(status["address"],"-");
+			e.message = "monitoring " + e.subject + ", " + state.node + ", " + std::to_string(state.networks.size()) + " network(s), " + std::to_string(state.peers.size()) + " peer(s)";
+			fresh.push_back(e);
+		} else if (state.reachable != last.reachable) {
+			e.type = "service";
+			e.subject = "";
+			e.message = (state.reachable) ? std::string("service reachable again") : error;
+			fresh.push_back(e);
+		}
+		if ((started)&&(state.reachable)&&(last.reachable)) {
+			if (state.node != last.node) {
+				e.type = "node";
+				e.subject = OSUtils::jsonString(status["address"],"-");
+				e.message = "node " + last.node + " -> " + state.node;
+				fresh.push_back(e);
+			}
+			e.type = "network";
+			for(std::map< std::string,std::pair<std::string,std::string> >::const_iterator n(state.networks.begin());n!=state.networks.end();++n) {
+				e.subject = n->first;
+				std::map< std::string,std::pair<std::string,std::string> >::const_iterator o(last.networks.find(n->first));
+				if (o == last.networks.end()) {
+					e.message = "network " + n->first + " joined, " + n->second.first;
+					fresh.push_back(e);
+					continue;
+				}
+				if (o->second.first != n->second.first) {
+					e.message = "network " + n->first + " " + o->second.first + " -> " + n->second.first;
+					fresh.push_back(e);
+				}
+				if (o->second.second != n->second.second) {
+					e.message = "network " + n->first + " addresses " + n->second.second;
+					fresh.push_back(e);
+				}
+			}
+			for(std::map< std::string,std::pair<std::string,std::string> >::const_iterator o(last.networks.begin());o!=last.networks.end();++o) {
+				if (!state.networks.count(o->first)) {
+					e.subject = o->first;
+					e.message = "network " + o->first + " left";
+					fresh.push_back(e);
+				}
+			}
+			e.type = "root";
+			for(std::map< std::string,bool >::const_iterator r(state.roots.begin());r!=state.roots.end();++r) {
+				std::map< std::string,bool >::const_iterator o(last.roots.find(r->first));
+				if ((o == last.roots.end()) ? r->second : (o->second != r->second)) {
+					e.subject = r->first;
+					e.message = "root " + r->first + ((r->second) ? " online" : " offline");
+					fresh.push_back(e);
+				}
+			}
+			e.type = "peer";
+			for(std::map< std::string,std::string >::const_iterator p(state.peers.begin());p!=state.peers.end();++p) {
+				e.subject = p->first;
+				std::map< std::string,std::string >::const_iterator o(last.peers.find(p->first));
+				if (o == last.peers.end())
+					e.message = "peer " + p->first + " new, " + ((p->second == "RELAY") ? p->second : ("DIRECT " + p->second));
+				else if (o->second != p->second)
+					e.message = "peer " + p->first + " " + ((p->second == "RELAY") ? p->second : ("DIRECT " + p->second));
+				else continue;
+				fresh.push_back(e);
+			}
+			for(std::map< std::string,std::string >::const_iterator o(last.peers.begin());o!=last.peers.end();++o) {
+				if (!state.peers.count(o->first)) {
+					e.subject = o->first;
+					e.message = "peer " + o->first + " gone";
+					fresh.push_back(e);
+				}
+			}
+		}
+		if ((state.reachable)||(!started))
+			last = state;
+		else last.reachable = false;
+		started = true;
+
+		if (!dashboard) {
+			for(std::vector<CliMonitorEvent>::const_iterator f(fresh.begin());f!=fresh.end();++f) {
+				if (json) {
+					nlohmann::json ej;
+					ej["time"] = f->time;
+					ej["type"] = f->type;
+					ej["subject"] = f->subject;
+					ej["message"] = f->message;
+					printf("%s" ZT_EOL_S,OSUtils::jsonDump(ej,-1).c_str());
+				} else {
+					printf("%s %s" ZT_EOL_S,cliUtcTime(f->time).c_str(),f->message.c_str());
+				}
+			}
+			fflush(stdout);
+			Thread::sleep(interval);
+			continue;
+		}
+		events.insert(events.end(),fresh.begin(),fresh.end());
+		if (events.size() > 1000)
+			events.erase(events.begin(),events.begin() + (events.size() - 1000));
+
+		// Top: node status, middle: networks and peers side by side if there is room, bottom: events
+		cliTerminalSize(cols,rows);
+		const std::string rule(cols,'-');
+		std::vector<std::string> screen;
+		char tmp[1024];
+		if (state.reachable) {
+			const unsigned long long up = (unsigned long long)OSUtils::jsonInt(status["uptime"],0ULL) / 1000;
+			unsigned long ok = 0,direct = 0,rootsOnline = 0;
+			for(std::map< std::string,std::pair<std::string,std::string> >::const_iterator n(state.networks.begin());n!=state.networks.end();++n)
+				ok += (n->second.first == "OK") ? 1 : 0;
+			for(std::map< std::string,std::string >::const_iterator p(state.peers.begin());p!=state.peers.end();++p)
+				direct += (p->second != "RELAY") ? 1 : 0;
+			for(std::map< std::string,bool >::const_iterator r(state.roots.begin());r!=state.roots.end();++r)
+				rootsOnline += (r->second) ? 1 : 0;
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s  %s  %s  up %llud%.2lluh%.2llum%.2llus  %s",
+				cliAddress(OSUtils::jsonString(status["address"],"-")).c_str(),
+				OSUtils::jsonString(status["version"],"-").c_str(),
+				state.node.c_str(),
+				up / 86400,(up % 86400) / 3600,(up % 3600) / 60,up % 60,
+				cliUtcTime(now).c_str());
+			screen.push_back(tmp);
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"networks %lu (%lu OK)  peers %lu (%lu direct)  roots %lu/%lu online  every %lus, Ctrl-C to quit",
+				(unsigned long)state.networks.size(),ok,
+				(unsigned long)state.peers.size(),direct,
+				rootsOnline,(unsigned long)state.roots.size(),
+				interval / 1000);
+			screen.push_back(tmp);
+		} else {
+			screen.push_back(error);
+			screen.push_back(std::string("retrying every ") + std::to_string(interval / 1000) + "s, Ctrl-C to quit");
+		}
+		screen.push_back(rule);
+
+		std::vector<std::string> networkItems,peerItems;
+		if (state.reachable) {
+			for(unsigned long i=0;i<networks.size();++i) {
+				nlohmann::json &n = networks[i];
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s %s %-7s %s",
+					OSUtils::jsonString(n["nwid"],"-").c_str(),
+					cliFit(OSUtils::jsonString(n["name"],"-"),16).c_str(),
+					OSUtils::jsonString(n["status"],"-").c_str(),
+					cliNetworkAddresses(n).c_str());
+				networkItems.push_back(tmp);
+			}
+			std::vector< std::pair<int,std::string> > byLatency;
+			for(unsigned long i=0;i<peers.size();++i) {
+				nlohmann::json &p = peers[i];
+				const std::string pa(OSUtils::jsonString(p["address"],"-"));
+				const int latency = (int)OSUtils::jsonInt(p["latency"],0);
+				const std::string &path = state.peers[pa];
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"%-10s %-6s %5s %s",
+					cliAddress(pa).c_str(),
+					OSUtils::jsonString(p["role"],"-").c_str(),
+					(latency >= 0) ? std::to_string(latency).c_str() : "-",
+					(path == "RELAY") ? path.c_str() : ("DIRECT " + path).c_str());
+				byLatency.push_back(std::pair<int,std::string>((latency >= 0) ? latency : 0x7fffffff,tmp));
+			}
+			std::sort(byLatency.begin(),byLatency.end());
+			for(std::vector< std::pair<int,std::string> >::const_iterator p(byLatency.begin());p!=byLatency.end();++p)
+				peerItems.push_back(p->second);
+		}
+
+		const unsigned long eventRows = std::max(5UL,(unsigned long)rows / 4);
+		const unsigned long top = screen.size();
+		const unsigned long middleRows = (rows > (top + eventRows + 1)) ? (rows - (top + eventRows + 1)) : 2;
+		std::vector<std::string> left,right;
+		if (cols >= 100) {
+			cliMonitorPanel("NETWORKS <nwid> <name> <status> <ips>",networkItems,middleRows,left);
+			cliMonitorPanel("PEERS by latency <ztaddr> <role> <lat> <path>",peerItems,middleRows,right);
+			const unsigned int lw = (cols - 3) / 2;
+			for(unsigned long i=0;i<middleRows;++i)
+				screen.push_back(cliFit((i < left.size()) ? left[i] : std::string(),lw) + " | " + ((i < right.size()) ? right[i] : std::string()));
+		} else {
+			const unsigned long networkRows = std::min((unsigned long)networkItems.size() + 1,std::max(2UL,middleRows / 2));
+			cliMonitorPanel("NETWORKS <nwid> <name> <status> <ips>",networkItems,networkRows,left);
+			cliMonitorPanel("PEERS by latency <ztaddr> <role> <lat> <path>",peerItems,middleRows - left.size(),right);
+			screen.insert(screen.end(),left.begin(),left.end());
+			screen.insert(screen.end(),right.begin(),right.end());
+			screen.resize(top + middleRows);
+		}
+		screen.push_back(rule);
+		screen.push_back("EVENTS");
+		for(unsigned long i=(events.size() > (eventRows - 1)) ? (events.size() - (eventRows - 1)) : 0;i<events.size();++i)
+			screen.push_back(cliUtcTime(events[i].time).substr(11,8) + " " + events[i].message);
+
+		// Redrawn from the top left each time, the last line without a newline so the screen does not scroll
+		std::string out("\033[H\033[2J");
+		for(unsigned long i=0;((i<screen.size())&&(i<rows));++i) {
+			if (i > 0)
+				out.append("\r\n");
+			out.append(cliFit(screen[i],cols));
+		}
+		fwrite(out.data(),1,out.length(),stdout);
+		fflush(stdout);
+		Thread::sleep(interval);
+	}
+}
+
+// Split a flat rule array into rules, each a run of matches ending in an action, as the indexes of their
+// first and last entries. Trailing matches without an action do nothing and are left out.
+static void cliRuleGroups(const nlohmann::json &rules,std::vector< std::pair<unsigned long,unsigned long> > &groups)
+{
+	unsigned long first = 0;
+	for(unsigned long i=0;i<rules.size();++i) {
+		if (OSUtils::jsonString(rules[i]["type"],"").compare(0,7,"ACTION_") == 0) {
+			groups.push_back(std::pair<unsigned long,unsigned long>(first,i));
+			first = i + 1;
+		}
+	}
+}
+
+// One rule on one line in rules script syntax, e.g. "drop not ethertype ipv4 and ..." without the ;
+static std::string cliRuleText(const nlohmann::json &rules,const std::pair<unsigned long,unsigned long> &g)
+{
+	nlohmann::json one = nlohmann::json::array();
+	for(unsigned long i=g.first;i<=g.second;++i)
+		one.push_back(rules[i]);
+	std::string script,line;
+	cliDecompileRules(one,"",script);
+	for(std::string::const_iterator c(script.begin());c!=script.end();++c) {
+		if ((*c == '\r')||(*c == '\n')||(*c == '\t')||(*c == ' ')||(*c == ';')) {
+			if ((line.length() > 0)&&(line[line.length() - 1] != ' '))
+				line.push_back(' ');
+		} else line.push_back(*c);
+	}
+	while ((line.length() > 0)&&(line[line.length() - 1] == ' '))
+		line.erase(line.length() - 1);
+	return line;
+}
+
+static bool cliParseEtherType(const std::string &s,uint64_t &et)
+{
+	if (s == "ipv4") et = 0x0800;
+	else if (s == "arp") et = 0x0806;
+	else if (s == "ipv6") et = 0x86dd;
+	else if ((s.length() > 2)&&(s.length() <= 6)&&(s[0] == '0')&&((s[1] == 'x')||(s[1] == 'X'))&&(s.find_first_not_of("0123456789abcdefABCDEF",2) == std::string::npos))
+		et = Utils::hexStrToU64(s.c_str() + 2);
+	else if (!cliParseU32(s,et))
+		return false;
+	return (et <= 0xffff);
+}
+
+// Whether a rule entry matches a frame from src to dst with ether type et as far as those tell:
+// 0 for no, 1 for yes, 2 when it depends on more of the frame than that
+static int cliRuleMatches(const nlohmann::json &r,const uint64_t src,const uint64_t dst,const uint64_t et)
+{
+	const std::string type(OSUtils::jsonString(r["type"],""));
+	const bool ip = ((et == 0x0800)||(et == 0x86dd));
+	if (type == "MATCH_SOURCE_ZEROTIER_ADDRESS")
+		return (Utils::hexStrToU64(OSUtils::jsonString(r["zt"],"0").c_str()) == src) ? 1 : 0;
+	if (type == "MATCH_DEST_ZEROTIER_ADDRESS")
+		return (Utils::hexStrToU64(OSUtils::jsonString(r["zt"],"0").c_str()) == dst) ? 1 : 0;
+	if (type == "MATCH_ETHERTYPE")
+		return (OSUtils::jsonInt(r["etherType"],0ULL) == et) ? 1 : 0;
+	if ((type == "MATCH_IPV4_SOURCE")||(type == "MATCH_IPV4_DEST"))
+		return (et == 0x0800) ? 2 : 0;
+	if ((type == "MATCH_IPV6_SOURCE")||(type == "MATCH_IPV6_DEST"))
+		return (et == 0x86dd) ? 2 : 0;
+	if ((type == "MATCH_IP_TOS")||(type == "MATCH_IP_PROTOCOL")||(type == "MATCH_ICMP")||(type == "MATCH_IP_SOURCE_PORT_RANGE")||(type == "MATCH_IP_DEST_PORT_RANGE"))
+		return (ip) ? 2 : 0;
+	return 2;
+}
+
+// controller set <network ID> tagdef [<name> <id> [<min>-<max>|any] [--default=<value>] | <name> remove],
+// which controller tag define and remove also use, cmd naming the command for messages
+static int cliControllerTagDef(const char *cmd,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	const std::string path(std::string("/controller/network/") + args[1]);
+	const bool remove = ((args.size() == 5)&&(args[4] == "remove"));
+	uint64_t id = 0,tmin = 0,tmax = 0,dfl = 0;
+	bool range = false;
+	if ((args.size() != 3)&&(!remove)) {
+		if ((args.size() < 5)||(args.size() > 6)||(!cliParseU32(args[4],id))) {
+			fprintf(stderr,"invalid format: controller set <network ID> tagdef [<name> <id> [<min>-<max>|any] [--default=<value>] | <name> remove]" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		const std::string &name = args[3];
+		if ((name.empty())||(name.length() > 64)||((name[0] >= '0')&&(name[0] <= '9'))||(name.find_first_not_of("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != std::string::npos)) {
+			fprintf(stderr,"invalid tag name %s: use letters, digits, and underscores, not starting with a digit" ZT_EOL_S,name.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		if ((args.size() == 6)&&(args[5] != "any")) {
+			const std::size_t dash = args[5].find('-');
+			if ((dash == std::string::npos)||(!cliParseU32(args[5].substr(0,dash),tmin))||(!cliParseU32(args[5].substr(dash + 1),tmax))||(tmin > tmax)) {
+				fprintf(stderr,"invalid range %s: expected <min>-<max> or any" ZT_EOL_S,args[5].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			range = true;
+		}
+		std::map<std::string,std::string>::const_iterator d(longOpts.find("default"));
+		if ((d != longOpts.end())&&((!cliParseU32(d->second,dfl))||((range)&&((dfl < tmin)||(dfl > tmax))))) {
+			fprintf(stderr,"invalid default %s: must be a 32-bit value within the tag's range" ZT_EOL_S,d->second.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+	}
+
+	std::string responseBody;
+	nlohmann::json network;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError(cmd,scode,responseBody);
+	nlohmann::json tags(network["tags"]);
+	if (!tags.is_array())
+		tags = nlohmann::json::array();
+
+	if (args.size() == 3) {
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson(tags).c_str());
+			return 0;
+		}
+		cliHeader("<name>               <id>       <default>  <range>" ZT_EOL_S);
+		for(unsigned long i=0;i<tags.size();++i) {
+			nlohmann::json &t = tags[i];
+			char tmp[64];
+			if (t["min"].is_number())
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"%llu-%llu",(unsigned long long)OSUtils::jsonInt(t["min"],0ULL),(unsigned long long)OSUtils::jsonInt(t["max"],0ULL));
+			else OSUtils::ztsnprintf(tmp,sizeof(tmp),"any");
+			const std::string name(OSUtils::jsonString(t["name"],""));
+			const std::string d((t["default"].is_number()) ? std::to_string((unsigned long long)OSUtils::jsonInt(t["default"],0ULL)) : std::string("-"));
+			printf("%-20s %-10llu %-10s %s" ZT_EOL_S,(name.length() > 0) ? name.c_str() : "-",(unsigned long long)OSUtils::jsonInt(t["id"],0ULL),d.c_str(),tmp);
+		}
+		return 0;
+	}
+
+	const long existing = cliFindDefinition(tags,args[3]);
+	if (remove) {
+		if (existing < 0) {
+			fprintf(stderr,"network %s has no tag named %s" ZT_EOL_S,args[1].c_str(),args[3].c_str());
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+		tags.erase((std::size_t)existing);
+	} else {
+		if ((existing >= 0)&&(OSUtils::jsonInt(tags[existing]["id"],0ULL) != id)) {
+			fprintf(stderr,"tag name %s is already used by tag %llu" ZT_EOL_S,args[3].c_str(),(unsigned long long)OSUtils::jsonInt(tags[existing]["id"],0ULL));
+			return ZT_CLI_EXIT_FAILED;
+		}
+		long i = cliFindDefinition(tags,args[4]);
+		if (i < 0) {
+			tags.push_back({{"id",id},{"default",nlohmann::json()}});
+			i = (long)tags.size() - 1;
+		}
+		nlohmann::json &t = tags[i];
+		t["name"] = args[3];
+		if (range) {
+			t["min"] = tmin;
+			t["max"] = tmax;
+		} else {
+			t.erase("min");
+			t.erase("max");
+		}
+		if (longOpts.count("default"))
+			t["default"] = dfl;
+	}
+
+	nlohmann::json update;
+	update["tags"] = tags;
+	scode = cliRequest(addr,requestHeaders,"POST",path,&update,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError(cmd,scode,responseBody);
+	if (json)
+		printf("%s" ZT_EOL_S,cliJson(network["tags"]).c_str());
+	else cliOK("200 controller %s OK" ZT_EOL_S,cmd);
+	return 0;
+}
+
+// controller webhook <network ID> list|add <url> [...]|remove <url>, op is empty to list, and
+// controller set <network ID> webhook [...] which is the older spelling of the same thing
+static int cliControllerManageWebhooks(const char *cmd,const std::string &nwid,const std::string &op,const std::string &url,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	const std::string path(std::string("/controller/network/") + nwid);
+	if ((op == "add")&&(url.substr(0,7) != "http://")) {
+		fprintf(stderr,"invalid webhook URL %s: only http:// URLs are supported" ZT_EOL_S,url.c_str());
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	nlohmann::json h;
+	if (op == "add") {
+		h["url"] = url;
+		std::map<std::string,std::string>::const_iterator o(longOpts.find("secret"));
+		h["secret"] = (o != longOpts.end()) ? o->second : std::string();
+		if ((o = longOpts.find("max-attempts")) != longOpts.end()) {
+			uint64_t n = 0;
+			if ((!cliParseU32(o->second,n))||(n < 1)||(n > 10)) {
+				fprintf(stderr,"invalid --max-attempts %s: expected a number from 1 to 10" ZT_EOL_S,o->second.c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			h["maxAttempts"] = n;
+		}
+		if ((o = longOpts.find("retry-delay")) != longOpts.end()) {
+			int64_t ms = 0;
+			const std::string &t = o->second;
+			if ((t.empty())||(t[t.length() - 1] < 'a')||(!cliParseExpiry(t,0,ms))||(ms < 1000)||(ms > 3600000)) {
+				fprintf(stderr,"invalid --retry-delay %s: expected a duration from 1s to 1h like 30s or 5m" ZT_EOL_S,t.c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			h["retryDelay"] = ms;
+		}
+	}
+
+	std::string responseBody;
+	nlohmann::json network;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError(cmd,scode,responseBody);
+	nlohmann::json hooks(network["webhooks"]);
+	if (!hooks.is_array())
+		hooks = nlohmann::json::array();
+
+	if (op.empty()) {
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson(hooks).c_str());
+			return 0;
+		}
+		cliHeader("<url> <signed> <attempts> <retryDelay>" ZT_EOL_S);
+		for(unsigned long i=0;i<hooks.size();++i) {
+			printf("%s %s %llu %s" ZT_EOL_S,
+				OSUtils::jsonString(hooks[i]["url"],"-").c_str(),
+				(OSUtils::jsonBool(hooks[i]["secretSet"],false)) ? "yes" : "no",
+				(unsigned long long)OSUtils::jsonInt(hooks[i]["maxAttempts"],5ULL),
+				cliShortDuration((int64_t)OSUtils::jsonInt(hooks[i]["retryDelay"],15000ULL) / 1000).c_str());
+		}
+		return 0;
+	}
+
+	nlohmann::json nh = nlohmann::json::array();
+	for(unsigned long i=0;i<hooks.size();++i) {
+		if (OSUtils::jsonString(hooks[i]["url"],"") != url)
+			nh.push_back(hooks[i]);
+	}
+	if (op == "remove") {
+		if (nh.size() == hooks.size()) {
+			fprintf(stderr,"network %s has no webhook %s" ZT_EOL_S,nwid.c_str(),url.c_str());
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+	} else {
+		nh.push_back(h);
+	}
+
+	nlohmann::json update;
+	update["webhooks"] = nh;
+	scode = cliRequest(addr,requestHeaders,"POST",path,&update,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError(cmd,scode,responseBody);
+	if (json)
+		printf("%s" ZT_EOL_S,cliJson(network["webhooks"]).c_str());
+	else if (!strcmp(cmd,"set"))
+		cliOK("200 controller set webhook OK" ZT_EOL_S);
+	else cliOK("200 controller webhook %s OK" ZT_EOL_S,op.c_str());
+	return 0;
+}
+
+// controller set <network ID> authhook [<url> [--secret=<secret>] [--ttl=<duration>] [--fail-open] | clear]
+static int cliControllerAuthHook(const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	const std::string path(std::string("/controller/network/") + args[1]);
+	if ((args.size() != 3)&&(args.size() != 4)) {
+		fprintf(stderr,"invalid format: controller set <network ID> authhook [<url> [--secret=<secret>] [--ttl=<duration>] [--fail-open] | clear]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	std::string responseBody;
+	nlohmann::json network;
+	unsigned int scode;
+	if (args.size() == 3) {
+		scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("set",scode,responseBody);
+		nlohmann::json &hook = network["authHook"];
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson((hook.is_object()) ? hook : nlohmann::json::object()).c_str());
+			return 0;
+		}
+		if ((!hook.is_object())||(OSUtils::jsonString(hook["url"],"").empty())) {
+			printf("200 controller set authhook: none" ZT_EOL_S);
+			return 0;
+		}
+		cliHeader("<url> <signed> <ttl> <failMode>" ZT_EOL_S);
+		printf("%s %s %s %s" ZT_EOL_S,
+			OSUtils::jsonString(hook["url"],"").c_str(),
+			(OSUtils::jsonBool(hook["secretSet"],false)) ? "yes" : "no",
+			cliShortDuration((int64_t)OSUtils::jsonInt(hook["ttl"],0ULL) / 1000).c_str(),
+			OSUtils::jsonString(hook["failMode"],"closed").c_str());
+		return 0;
+	}
+
+	nlohmann::json update;
+	if (args[3] == "clear") {
+		update["authHook"] = nlohmann::json::object();
+	} else {
+		if (args[3].substr(0,7) != "http://") {
+			fprintf(stderr,"invalid authhook URL %s: only http:// URLs are supported" ZT_EOL_S,args[3].c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		nlohmann::json &h = update["authHook"];
+		h["url"] = args[3];
+		std::map<std::string,std::string>::const_iterator o(longOpts.find("secret"));
+		h["secret"] = (o != longOpts.end()) ? o->second : std::string();
+		if ((o = longOpts.find("ttl")) != longOpts.end()) {
+			int64_t ms = 0;
+			const std::string &t = o->second;
+			if ((t != "0")&&((t.empty())||(t[t.length() - 1] < 'a')||(!cliParseExpiry(t,0,ms))||(ms <= 0))) {
+				fprintf(stderr,"invalid --ttl %s: expected 0 or a duration like 30s, 5m, or 1h" ZT_EOL_S,t.c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			h["ttl"] = ms;
+		}
+		h["failMode"] = (longOpts.count("fail-open")) ? "open" : "closed";
+	}
+
+	scode = cliRequest(addr,requestHeaders,"POST",path,&update,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("set",scode,responseBody);
+	if (json)
+		printf("%s" ZT_EOL_S,cliJson(network["authHook"]).c_str());
+	else cliOK("200 controller set authhook OK" ZT_EOL_S);
+	return 0;
+}
+
+// controller migrate-db sqlite
+static int cliControllerMigrateDb(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	if ((args.size() != 2)||(args[1] != "sqlite")) {
+		fprintf(stderr,"invalid format: controller migrate-db sqlite" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+#ifdef ZT_CONTROLLER_USE_SQLITE
+	std::string responseBody;
+	nlohmann::json j;
+	if (cliRequest(addr,requestHeaders,"GET","/status",(const nlohmann::json *)0,responseBody,j) != 0) {
+		fprintf(stderr,"the service is running; stop it before migrating controller data" ZT_EOL_S);
+		return ZT_CLI_EXIT_FAILED;
+	}
+
+	// Same controller path the service would use
+	std::string dbPath(homeDir + ZT_PATH_SEPARATOR_S "controller.d");
+	std::string lc;
+	if (OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S "local.conf").c_str(),lc)) {
+		try {
+			nlohmann::json localConfig(OSUtils::jsonParse(lc));
+			const std::string cdbp(OSUtils::jsonString(localConfig["settings"]["controllerDbPath"],""));
+			if (cdbp.length() > 0)
+				dbPath = cdbp;
+		} catch ( ... ) {
+			fprintf(stderr,"unable to parse %s" ZT_PATH_SEPARATOR_S "local.conf" ZT_EOL_S,homeDir.c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+	}
+	const std::string sqlitePath(dbPath + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_SQLITEDB_FILENAME);
+	if (OSUtils::fileExists(sqlitePath.c_str(),false)) {
+		fprintf(stderr,"%s already exists; move it aside to migrate again" ZT_EOL_S,sqlitePath.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+
+	FileDB src(dbPath.c_str());
+	unsigned long networks = 0,members = 0,failed = 0;
+	bool opened = false;
+	{
+		SQLiteDB dst(dbPath.c_str());
+		if (dst.isReady()) {
+			opened = true;
+			src.each([&](uint64_t networkId,const nlohmann::json &network,uint64_t memberId,const nlohmann::json &member) {
+				if (dst.write((memberId) ? member : network)) {
+					if (memberId) ++members; else ++networks;
+				} else ++failed;
+			});
+		} else {
+			fprintf(stderr,"%s" ZT_EOL_S,dst.error().c_str());
+			++failed;
+		}
+	}
+
+	// Reopen the new database and check that every record came back unchanged
+	if (opened) {
+		SQLiteDB check(dbPath.c_str());
+		if (!check.isReady()) {
+			fprintf(stderr,"%s" ZT_EOL_S,check.error().c_str());
+			++failed;
+		} else {
+			src.each([&](uint64_t networkId,const nlohmann::json &network,uint64_t memberId,const nlohmann::json &member) {
+				nlohmann::json n,m;
+				if (memberId) {
+					if ((!check.get(networkId,n,memberId,m))||(m != member)) {
+						fprintf(stderr,"member %.10llx of network %.16llx did not migrate correctly" ZT_EOL_S,(unsigned long long)memberId,(unsigned long long)networkId);
+						++failed;
+					}
+				} else if ((!check.get(networkId,n))||(n != network)) {
+					fprintf(stderr,"network %.16llx did not migrate correctly" ZT_EOL_S,(unsigned long long)networkId);
+					++failed;
+				}
+			});
+		}
+	}
+	if (failed) {
+		OSUtils::rm(sqlitePath.c_str());
+		OSUtils::rm((sqlitePath + "-wal").c_str());
+		OSUtils::rm((sqlitePath + "-shm").c_str());
+		fprintf(stderr,"migration failed (%lu records); %s was removed and the existing data is unchanged" ZT_EOL_S,failed,sqlitePath.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	cliOK("200 controller migrate-db OK: %lu networks and %lu members copied to %s" ZT_EOL_S,networks,members,sqlitePath.c_str());
+	printf("set \"controllerDb\": { \"type\": \"sqlite\" } under \"settings\" in local.conf to use it; the old files are left in place" ZT_EOL_S);
+	return 0;
+#else
+	fprintf(stderr,"this build does not include SQLite controller storage (build with ZT_CONTROLLER_SQLITE=1)" ZT_EOL_S);
+	return ZT_CLI_EXIT_FAILED;
+#endif
+}
+
+// controller new [--name=<name>] [--public] [--ipv4-pool=<cidr>]
+static int cliControllerNew(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json response;
+
+	std::string ownerAddress;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET","/status",(const nlohmann::json *)0,responseBody,response);
+	if (scode == 200)
+		ownerAddress = OSUtils::jsonString(response["address"],"");
+	if (ownerAddress.length() != 10)
+		return cliControllerError("new",scode,responseBody);
+
+	nlohmann::json network;
+	std::map<std::string,std::string>::const_iterator o(longOpts.find("name"));
+	if (o != longOpts.end())
+		network["name"] = o->second;
+	network["private"] = (longOpts.count("public") == 0);
+	o = longOpts.find("ipv4-pool");
+	if (o != longOpts.end()) {
+		std::string target,rangeStart,rangeEnd;
+		if ((!InetAddress(o->second.c_str()).isV4())||(!cliCidrPool(o->second,target,rangeStart,rangeEnd))) {
+			fprintf(stderr,"%s: invalid IPv4 pool %s (expected CIDR such as 10.147.17.0/24)" ZT_EOL_S,pn,o->second.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		network["routes"] = nlohmann::json::array();
+		network["routes"].push_back({{"target",target},{"via",nlohmann::json()}});
+		network["ipAssignmentPools"] = nlohmann::json::array();
+		network["ipAssignmentPools"].push_back({{"ipRangeStart",rangeStart},{"ipRangeEnd",rangeEnd}});
+		network["v4AssignMode"] = {{"zt",true}};
+	}
+
+	scode = cliRequest(addr,requestHeaders,"POST",std::string("/controller/network/") + ownerAddress + "______",&network,responseBody,response);
+	if ((scode != 200)||(!response.is_object()))
+		return cliControllerError("new",scode,responseBody);
+	if (json)
+		printf("%s" ZT_EOL_S,cliJson(response).c_str());
+	else printf("%s" ZT_EOL_S,OSUtils::jsonString(response["id"],"").c_str());
+	return 0;
+}
+
+// controller networks [--sort=id|name|members]
+static int cliControllerNetworks(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	const std::string sortBy((longOpts.count("sort")) ? longOpts.find("sort")->second : std::string("id"));
+	if ((sortBy != "id")&&(sortBy != "name")&&(sortBy != "members")) {
+		fprintf(stderr,"invalid sort order %s: expected id, name, or members" ZT_EOL_S,sortBy.c_str());
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	nlohmann::json ids;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET","/controller/network",(const nlohmann::json *)0,responseBody,ids);
+	if ((scode != 200)||(!ids.is_array()))
+		return cliControllerError("networks",scode,responseBody);
+
+	std::vector<nlohmann::json> networks;
+	for(unsigned long i=0;i<ids.size();++i) {
+		const std::string path(std::string("/controller/network/") + OSUtils::jsonString(ids[i],""));
+		nlohmann::json network,summary;
+		scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,network);
+		if (scode == 404)
+			continue; // deleted while listing
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("networks",scode,responseBody);
+		scode = cliRequest(addr,requestHeaders,"GET",path + "/summary",(const nlohmann::json *)0,responseBody,summary);
+		if ((scode != 200)||(!summary.is_object()))
+			return cliControllerError("networks",scode,responseBody);
+		network["totalMemberCount"] = summary["totalMemberCount"];
+		network["authorizedMemberCount"] = summary["authorizedMemberCount"];
+		network["activeMemberCount"] = summary["activeMemberCount"];
+		network["memberLimit"] = summary["memberLimit"];
+		networks.push_back(network);
+	}
+
+	if (sortBy == "name") {
+		std::stable_sort(networks.begin(),networks.end(),[](const nlohmann::json &a,const nlohmann::json &b) {
+			return (OSUtils::jsonString(a["name"],"") < OSUtils::jsonString(b["name"],""));
+		});
+	} else if (sortBy == "members") {
+		std::stable_sort(networks.begin(),networks.end(),[](const nlohmann::json &a,const nlohmann::json &b) {
+			return (OSUtils::jsonInt(a["totalMemberCount"],0ULL) > OSUtils::jsonInt(b["totalMemberCount"],0ULL));
+		});
+	}
+
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(nlohmann::json(networks)).c_str());
+		return 0;
+	}
+	if (cliQuiet) {
+		for(std::vector<nlohmann::json>::iterator n(networks.begin());n!=networks.end();++n)
+			printf("%s" ZT_EOL_S,OSUtils::jsonString((*n)["id"],"-").c_str());
+		return 0;
+	}
+
+	// Show how close the controller is to its network limit, if it has one
+	nlohmann::json status;
+	std::string usage;
+	if ((cliRequest(addr,requestHeaders,"GET","/controller",(const nlohmann::json *)0,responseBody,status) == 200)&&(OSUtils::jsonInt(status["maxNetworks"],0ULL) > 0))
+		usage = std::string(" (") + std::to_string(networks.size()) + " of " + std::to_string(OSUtils::jsonInt(status["maxNetworks"],0ULL)) + " allowed)";
+
+	cliHeader("200 controller networks%s" ZT_EOL_S "<nwid>           <name>           <access>  <members> <auth> <limit> <active> <created>  <pools>" ZT_EOL_S,usage.c_str());
+	for(std::vector<nlohmann::json>::iterator n(networks.begin());n!=networks.end();++n) {
+		char created[64];
+		const time_t ct = (time_t)(OSUtils::jsonInt((*n)["creationTime"],0ULL) / 1000);
+		const struct tm *ctm = gmtime(&ct);
+		if ((ct > 0)&&(ctm))
+			strftime(created,sizeof(created),"%Y-%m-%d",ctm);
+		else OSUtils::ztsnprintf(created,sizeof(created),"-");
+
+		std::string pools;
+		nlohmann::json &ipp = (*n)["ipAssignmentPools"];
+		for(unsigned long i=0;i<ipp.size();++i) {
+			if (pools.length() > 0)
+				pools.push_back(',');
+			pools.append(OSUtils::jsonString(ipp[i]["ipRangeStart"],""));
+			pools.push_back('-');
+			pools.append(OSUtils::jsonString(ipp[i]["ipRangeEnd"],""));
+		}
+
+		const uint64_t memberLimit = OSUtils::jsonInt((*n)["memberLimit"],0ULL);
+		const std::string limit((memberLimit) ? std::to_string(memberLimit) : std::string("-"));
+
+		std::string name(OSUtils::jsonString((*n)["name"],""));
+		printf("%s %-16s %-9s %9llu %6llu %7s %8llu %-10s %s" ZT_EOL_S,
+			OSUtils::jsonString((*n)["id"],"").c_str(),
+			(name.length() > 0) ? name.c_str() : "-",
+			(OSUtils::jsonBool((*n)["private"],true)) ? "PRIVATE" : "PUBLIC",
+			(unsigned long long)OSUtils::jsonInt((*n)["totalMemberCount"],0ULL),
+			(unsigned long long)OSUtils::jsonInt((*n)["authorizedMemberCount"],0ULL),
+			limit.c_str(),
+			(unsigned long long)OSUtils::jsonInt((*n)["activeMemberCount"],0ULL),
+			created,
+			(pools.length() > 0) ? pools.c_str() : "-");
+	}
+	return 0;
+}
+
+// controller members <network ID> [--authorized|--unauthorized] [--online[=<minutes>]] [...]
+static int cliControllerMembers(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	if ((args.size() < 2)||(args[1].length() != 16)) {
+		fprintf(stderr,"invalid format: must be a 16-digit (network) ID" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	if ((longOpts.count("authorized"))&&(longOpts.count("unauthorized"))) {
+		fprintf(stderr,"--authorized and --unauthorized are mutually exclusive" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	// Always send a filter so the controller returns full member objects
+	std::string query("?offset=");
+	std::map<std::string,std::string>::const_iterator o(longOpts.find("offset"));
+	query.append((o != longOpts.end()) ? o->second : std::string("0"));
+	if ((o = longOpts.find("limit")) != longOpts.end())
+		query.append("&limit=").append(o->second);
+	if (longOpts.count("authorized"))
+		query.append("&authorized=true");
+	else if (longOpts.count("unauthorized"))
+		query.append("&authorized=false");
+	if ((o = longOpts.find("online")) != longOpts.end())
+		query.append("&online=").append(o->second);
+	if ((o = longOpts.find("name-contains")) != longOpts.end())
+		query.append("&nameContains=").append(cliUrlEncode(o->second));
+
+	nlohmann::json r;
+	const unsigned int scode = cliRequest(addr,requestHeaders,"GET",std::string("/controller/network/") + args[1] + "/member" + query,(const nlohmann::json *)0,responseBody,r);
+	if ((scode != 200)||(!r.is_object()))
+		return cliControllerError("members",scode,responseBody);
+
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(r).c_str());
+		return 0;
+	}
+
+	nlohmann::json &data = r["data"];
+	if (cliQuiet) {
+		for(unsigned long i=0;i<data.size();++i)
+			printf("%s" ZT_EOL_S,OSUtils::jsonString(data[i]["id"],"-").c_str());
+		return 0;
+	}
+
+	const int64_t now = OSUtils::now();
+	cliHeader("200 controller members (%llu matching)" ZT_EOL_S "<address>  <name>           <auth> <expires> <lastSeen> <version> <ips>" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(r["totalItems"],0ULL));
+	for(unsigned long i=0;i<data.size();++i) {
+		nlohmann::json &m = data[i];
+		const bool authorized = OSUtils::jsonBool(m["authorized"],false);
+
+		const int64_t lrt = (int64_t)OSUtils::jsonInt(m["lastRequestTime"],0ULL);
+		const std::string lastSeen((lrt > 0) ? cliShortDuration((now - lrt) / 1000) : std::string("-"));
+
+		// Time left on an expiring authorization, or whether one has already lapsed
+		const int64_t authExpiry = (int64_t)OSUtils::jsonInt(m["authExpiry"],0ULL);
+		std::string expires("-");
+		if ((authorized)&&(authExpiry > 0))
+			expires = (authExpiry > now) ? cliShortDuration((authExpiry - now) / 1000) : std::string("now");
+		else if ((!authorized)&&(OSUtils::jsonString(m["lastDeauthorizedReason"],"") == "expired"))
+			expires = "expired";
+
+		char version[64];
+		const int vMajor = (int)OSUtils::jsonInt(m["vMajor"],(uint64_t)-1);
+		if (vMajor >= 0)
+			OSUtils::ztsnprintf(version,sizeof(version),"%d.%d.%d",vMajor,(int)OSUtils::jsonInt(m["vMinor"],0ULL),(int)OSUtils::jsonInt(m["vRev"],0ULL));
+		else OSUtils::ztsnprintf(version,sizeof(version),"-");
+
+		std::string ips;
+		nlohmann::json &ipa = m["ipAssignments"];
+		for(unsigned long k=0;k<ipa.size();++k) {
+			if (ips.length() > 0)
+				ips.push_back(',');
+			ips.append(OSUtils::jsonString(ipa[k],""));
+		}
+
+		// Decisions made by the network's authHook, and members turned away by its member limit or
+		// until they complete SSO, are shown as such
+		const char *auth = (authorized) ? "yes" : "no";
+		if (OSUtils::jsonString(m["authRefusedReason"],"") == "sso")
+			auth = "sso";
+		else if ((!authorized)&&(OSUtils::jsonBool(m["authHookAdmitted"],false)))
+			auth = "hook";
+		else if ((!authorized)&&(OSUtils::jsonString(m["authHookResult"],"") == "deny"))
+			auth = "denied";
+		else if ((!authorized)&&(OSUtils::jsonString(m["authRefusedReason"],"") == "memberLimit"))
+			auth = "limit";
+
+		const std::string name(OSUtils::jsonString(m["name"],""));
+		printf("%s %-16s %s %-9s %-10s %-9s %s" ZT_EOL_S,
+			OSUtils::jsonString(m["id"],"").c_str(),
+			(name.length() > 0) ? name.c_str() : "-",
+			cliStatus(auth,6).c_str(),
+			expires.c_str(),
+			lastSeen.c_str(),
+			version,
+			(ips.length() > 0) ? ips.c_str() : "-");
+	}
+	return 0;
+}
+
+// controller member <network ID> <address|name> [ip|tag|cap|expire|name|description ...],
+// and controller member set <network ID> <address> tag <name|ID> <value>
+static int cliControllerMember(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	// controller member set <network ID> <address> tag <name|ID> <value> is another spelling of tag set
+	if ((args.size() == 7)&&(args[1] == "set")&&(args[4] == "tag")) {
+		std::vector<std::string> a(args);
+		a[1] = args[2];
+		a[2] = args[3];
+		a[3] = "tag";
+		a[4] = "set";
+		return cliControllerMember(pn,homeDir,a,longOpts,json,addr,requestHeaders);
+	}
+	if ((args.size() < 3)||(args[1].length() != 16)) {
+		fprintf(stderr,"invalid format: controller member <network ID> <address|name> [<command>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	std::string address;
+	const int rc = cliResolveMember("member",args[1],args[2],address,addr,requestHeaders);
+	if (rc)
+		return rc;
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+	const std::string memberPath(networkPath + "/member/" + address);
+
+	nlohmann::json member;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",memberPath,(const nlohmann::json *)0,responseBody,member);
+	if ((scode != 200)||(!member.is_object()))
+		return cliControllerError("member",scode,responseBody);
+
+	if (args.size() == 3) {
+		printf("%s" ZT_EOL_S,cliJson(member).c_str());
+		return 0;
+	}
+
+	nlohmann::json update;
+	if (args[3] == "ip") {
+		const std::string op((args.size() >= 5) ? args[4] : std::string());
+		nlohmann::json &current = member["ipAssignments"];
+		nlohmann::json ips = nlohmann::json::array();
+
+		if (op == "clear") {
+			update["noAutoAssignIps"] = false;
+		} else if (((op == "add")||(op == "remove"))&&(args.size() == 6)) {
+			const InetAddress ip(args[5].c_str());
+			if (((ip.ss_family != AF_INET)&&(ip.ss_family != AF_INET6))||(args[5].find('/') != std::string::npos)) {
+				fprintf(stderr,"invalid IP address %s" ZT_EOL_S,args[5].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			char ipstr[64];
+			ip.toIpString(ipstr);
+
+			bool assigned = false;
+			for(unsigned long i=0;i<current.size();++i) {
+				if (InetAddress(OSUtils::jsonString(current[i],"").c_str()).ipsEqual(ip))
+					assigned = true;
+				else ips.push_back(current[i]);
+			}
+
+			if (op == "remove") {
+				if (!assigned) {
+					fprintf(stderr,"%s is not assigned to %s" ZT_EOL_S,ipstr,address.c_str());
+					return ZT_CLI_EXIT_NOT_FOUND;
+				}
+			} else {
+				if (!assigned) {
+					// Must fall within a managed route or assignment pool
+					nlohmann::json network;
+					scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+					if ((scode != 200)||(!network.is_object()))
+						return cliControllerError("member",scode,responseBody);
+					bool inRange = false;
+					nlohmann::json &routes = network["routes"];
+					for(unsigned long i=0;((!inRange)&&(i<routes.size()));++i)
+						inRange = InetAddress(OSUtils::jsonString(routes[i]["target"],"").c_str()).containsAddress(ip);
+					nlohmann::json &pools = network["ipAssignmentPools"];
+					for(unsigned long i=0;((!inRange)&&(i<pools.size()));++i)
+						inRange = cliIpInRange(ip,InetAddress(OSUtils::jsonString(pools[i]["ipRangeStart"],"").c_str()),InetAddress(OSUtils::jsonString(pools[i]["ipRangeEnd"],"").c_str()));
+					if (!inRange) {
+						fprintf(stderr,"%s is outside this network's managed routes and assignment pools" ZT_EOL_S,ipstr);
+						return ZT_CLI_EXIT_FAILED;
+					}
+
+					// Must not be assigned to anyone else
+					nlohmann::json others;
+					scode = cliRequest(addr,requestHeaders,"GET",networkPath + "/member?offset=0",(const nlohmann::json *)0,responseBody,others);
+					if ((scode != 200)||(!others.is_object()))
+						return cliControllerError("member",scode,responseBody);
+					nlohmann::json &data = others["data"];
+					for(unsigned long i=0;i<data.size();++i) {
+						if (OSUtils::jsonString(data[i]["id"],"") == address)
+							continue;
+						nlohmann::json &oips = data[i]["ipAssignments"];
+						for(unsigned long k=0;k<oips.size();++k) {
+							if (InetAddress(OSUtils::jsonString(oips[k],"").c_str()).ipsEqual(ip)) {
+								fprintf(stderr,"%s is already assigned to %s" ZT_EOL_S,ipstr,OSUtils::jsonString(data[i]["id"],"").c_str());
+								return ZT_CLI_EXIT_FAILED;
+							}
+						}
+					}
+				}
+				ips.push_back(ipstr);
+			}
+		} else {
+			fprintf(stderr,"invalid format: controller member <network ID> <address> ip add|remove <IP> or ip clear" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		update["ipAssignments"] = ips;
+	} else if (((args[3] == "name")||(args[3] == "description"))&&(args.size() == 5)) {
+		// Names select members in place of addresses, so warn if another member already has this one
+		if ((args[3] == "name")&&(args[4].length() > 0)) {
+			std::vector<std::string> named;
+			scode = cliMembersNamed(args[1],args[4],named,responseBody,addr,requestHeaders);
+			if (scode != 200)
+				return cliControllerError("member",scode,responseBody);
+			for(std::vector<std::string>::const_iterator n(named.begin());n!=named.end();++n) {
+				if (*n != address)
+					fprintf(stderr,"warning: %s is also named %s, so that name can no longer select a member" ZT_EOL_S,n->c_str(),args[4].c_str());
+			}
+		}
+		update[args[3]] = args[4];
+	} else if ((args[3] == "expire")&&(args.size() == 5)) {
+		int64_t expiry = 0;
+		const int64_t now = OSUtils::now();
+		if (!cliParseExpiry(args[4],now,expiry)) {
+			fprintf(stderr,"invalid expiry %s: expected a duration such as 12h, 7d, or 2w, a UTC date as YYYY-MM-DD[THH:MM[:SS]], or never" ZT_EOL_S,args[4].c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		if ((expiry > 0)&&(expiry <= now)) {
+			fprintf(stderr,"%s is in the past" ZT_EOL_S,args[4].c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		if (!OSUtils::jsonBool(member["authorized"],false)) {
+			fprintf(stderr,"%s is not authorized, authorize it with an expiry using controller auth %s %s --expire=%s" ZT_EOL_S,address.c_str(),args[1].c_str(),address.c_str(),args[4].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		update["authExpiry"] = expiry;
+	} else if ((args[3] == "tag")||(args[3] == "cap")) {
+		// Tags and capabilities are given by ID or by the name the network defines for them
+		const bool tag = (args[3] == "tag");
+		const std::string op((args.size() >= 5) ? args[4] : std::string());
+		if (!((tag) ? (((op == "list")&&(args.size() == 5))||((op == "set")&&(args.size() == 7))||((op == "clear")&&(args.size() == 6))) : (((op == "list")&&(args.size() == 5))||(((op == "add")||(op == "remove"))&&(args.size() == 6))))) {
+			if (tag)
+				fprintf(stderr,"invalid format: controller member <network ID> <address> tag list|set <name|ID> <value>|clear <name|ID>" ZT_EOL_S);
+			else fprintf(stderr,"invalid format: controller member <network ID> <address> cap list|add <name|ID>|remove <name|ID>" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		nlohmann::json network;
+		scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("member",scode,responseBody);
+		nlohmann::json &defs = network[(tag) ? "tags" : "capabilities"];
+
+		if (op == "list") {
+			if (json) {
+				printf("%s" ZT_EOL_S,cliJson(member[(tag) ? "tags" : "capabilities"]).c_str());
+			} else {
+				cliPrintMemberRules(member,network,tag);
+			}
+			return 0;
+		}
+
+		// An undeclared tag can still be set by the numeric ID the network's rules use for it,
+		// which the controller checks
+		uint64_t id = 0,value = 0;
+		const long d = cliFindDefinition(defs,args[5]);
+		if (d >= 0) {
+			id = OSUtils::jsonInt(defs[d]["id"],0ULL);
+		} else if ((op == "add")||(!cliParseU32(args[5],id))) {
+			fprintf(stderr,"network %s declares no %s %s (see controller rules %s show)" ZT_EOL_S,args[1].c_str(),(tag) ? "tag" : "capability",args[5].c_str(),args[1].c_str());
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+		if (op == "set") {
+			if (!cliParseU32(args[6],value)) {
+				fprintf(stderr,"invalid tag value %s: expected an integer from 0 to 4294967295" ZT_EOL_S,args[6].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			if ((d >= 0)&&(defs[d]["min"].is_number())&&((value < OSUtils::jsonInt(defs[d]["min"],0ULL))||(value > OSUtils::jsonInt(defs[d]["max"],0ULL)))) {
+				fprintf(stderr,"invalid value %llu for tag %s: must be from %llu to %llu" ZT_EOL_S,(unsigned long long)value,args[5].c_str(),(unsigned long long)OSUtils::jsonInt(defs[d]["min"],0ULL),(unsigned long long)OSUtils::jsonInt(defs[d]["max"],0ULL));
+				return ZT_CLI_EXIT_USAGE;
+			}
+		}
+
+		nlohmann::json &current = member[(tag) ? "tags" : "capabilities"];
+		nlohmann::json updated = nlohmann::json::array();
+		bool had = false;
+		for(unsigned long i=0;i<current.size();++i) {
+			const uint64_t cid = (tag) ? (((current[i].is_array())&&(current[i].size() == 2)) ? OSUtils::jsonInt(current[i][0],0ULL) : 0xffffffffffffffffULL) : OSUtils::jsonInt(current[i],0ULL);
+			if (cid == id)
+				had = true;
+			else if (cid != 0xffffffffffffffffULL)
+				updated.push_back(current[i]);
+		}
+		if (((op == "clear")||(op == "remove"))&&(!had)) {
+			fprintf(stderr,"%s does not have %s %s" ZT_EOL_S,address.c_str(),(tag) ? "tag" : "capability",args[5].c_str());
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+		if (op == "set")
+			updated.push_back({id,value});
+		else if (op == "add")
+			updated.push_back(id);
+		update[(tag) ? "tags" : "capabilities"] = updated;
+
+		scode = cliRequest(addr,requestHeaders,"POST",memberPath,&update,responseBody,member);
+		if ((scode != 200)||(!member.is_object()))
+			return cliControllerError("member",scode,responseBody);
+		if (json)
+			printf("%s" ZT_EOL_S,cliJson(member).c_str());
+		else cliPrintMemberRules(member,network,tag);
+		return 0;
+	} else {
+		cliPrintHelp(pn,stderr);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	scode = cliRequest(addr,requestHeaders,"POST",memberPath,&update,responseBody,member);
+	if ((scode != 200)||(!member.is_object()))
+		return cliControllerError("member",scode,responseBody);
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(member).c_str());
+	} else if (args[3] == "expire") {
+		const int64_t authExpiry = (int64_t)OSUtils::jsonInt(member["authExpiry"],0ULL);
+		if (authExpiry > 0)
+			printf("200 controller member %s authorization expires %s (in %s)" ZT_EOL_S,OSUtils::jsonString(member["id"],"").c_str(),cliUtcTime(authExpiry).c_str(),cliShortDuration((authExpiry - OSUtils::now()) / 1000).c_str());
+		else printf("200 controller member %s authorization never expires" ZT_EOL_S,OSUtils::jsonString(member["id"],"").c_str());
+	} else if ((args[3] == "name")||(args[3] == "description")) {
+		const std::string v(OSUtils::jsonString(member[args[3]],""));
+		if (v.length() > 0)
+			printf("200 controller member %s %s %s" ZT_EOL_S,OSUtils::jsonString(member["id"],"").c_str(),args[3].c_str(),v.c_str());
+		else printf("200 controller member %s %s cleared" ZT_EOL_S,OSUtils::jsonString(member["id"],"").c_str(),args[3].c_str());
+	} else {
+		nlohmann::json &ipa = member["ipAssignments"];
+		printf("200 controller member %s ipAssignments:",OSUtils::jsonString(member["id"],"").c_str());
+		for(unsigned long i=0;i<ipa.size();++i)
+			printf(" %s",OSUtils::jsonString(ipa[i],"").c_str());
+		printf(ZT_EOL_S);
+	}
+	return 0;
+}
+
+// controller auth|deauth <network ID> <address|name>|--file=<path|-> [--expire=<duration|date>]
+static int cliControllerAuth(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	const std::string &cmd = args[0];
+	std::string responseBody;
+
+	const bool authorize = (cmd == "auth");
+	std::map<std::string,std::string>::const_iterator fileOpt(longOpts.find("file"));
+	if ((args.size() < 2)||(args[1].length() != 16)||((fileOpt == longOpts.end()) ? (args.size() != 3) : (args.size() != 2))) {
+		fprintf(stderr,"invalid format: controller %s <network ID> <address|name> or controller %s <network ID> --file=<path|->" ZT_EOL_S,cmd.c_str(),cmd.c_str());
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+
+	std::map<std::string,std::string>::const_iterator expireOpt(longOpts.find("expire"));
+	int64_t expiry = 0;
+	if (expireOpt != longOpts.end()) {
+		if (!authorize) {
+			fprintf(stderr,"--expire only applies to controller auth" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		const int64_t now = OSUtils::now();
+		if ((!cliParseExpiry(expireOpt->second,now,expiry))||((expiry > 0)&&(expiry <= now))) {
+			fprintf(stderr,"invalid expiry %s: expected a future duration such as 12h, 7d, or 2w, a UTC date as YYYY-MM-DD[THH:MM[:SS]], or never" ZT_EOL_S,expireOpt->second.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+	}
+
+	// Each entry is an address and optional name, from the command line or one per line of a file
+	std::vector< std::pair<std::string,std::string> > entries;
+	if (fileOpt == longOpts.end()) {
+		std::string address;
+		const int rc = cliResolveMember(cmd.c_str(),args[1],args[2],address,addr,requestHeaders);
+		if (rc)
+			return rc;
+		entries.push_back(std::pair<std::string,std::string>(address,std::string()));
+	} else {
+		FILE *f = (fileOpt->second == "-") ? stdin : fopen(fileOpt->second.c_str(),"r");
+		if (!f) {
+			fprintf(stderr,"unable to open %s" ZT_EOL_S,fileOpt->second.c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		char line[1024];
+		while (fgets(line,sizeof(line),f)) {
+			std::string l(cliTrim(line));
+			if ((l.empty())||(l[0] == '#'))
+				continue;
+			const std::size_t comma = l.find(',');
+			if (comma == std::string::npos)
+				entries.push_back(std::pair<std::string,std::string>(l,std::string()));
+			else entries.push_back(std::pair<std::string,std::string>(cliTrim(l.substr(0,comma)),cliTrim(l.substr(comma + 1))));
+		}
+		if (f != stdin)
+			fclose(f);
+	}
+
+	nlohmann::json succeeded = nlohmann::json::array();
+	nlohmann::json unchanged = nlohmann::json::array();
+	nlohmann::json failed = nlohmann::json::array();
+	for(std::vector< std::pair<std::string,std::string> >::const_iterator e(entries.begin());e!=entries.end();++e) {
+		nlohmann::json fail;
+		fail["address"] = e->first;
+		if ((e->first.length() != 10)||(e->first.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)) {
+			fail["error"] = "invalid address";
+			failed.push_back(fail);
+			continue;
+		}
+		const std::string memberPath(networkPath + "/member/" + e->first);
+
+		nlohmann::json member;
+		unsigned int scode = cliRequest(addr,requestHeaders,"GET",memberPath,(const nlohmann::json *)0,responseBody,member);
+		if (scode == 0)
+			return cliControllerError(cmd.c_str(),scode,responseBody);
+		if ((scode == 404)&&(!authorize)) {
+			fail["error"] = "not a member";
+			failed.push_back(fail);
+			continue;
+		} else if ((scode != 200)&&(scode != 404)) {
+			fail["error"] = responseBody;
+			failed.push_back(fail);
+			continue;
+		}
+
+		const bool nameChanged = ((e->second.length() > 0)&&(OSUtils::jsonString(member["name"],"") != e->second));
+		if ((scode == 200)&&(OSUtils::jsonBool(member["authorized"],false) == authorize)&&(!nameChanged)&&(expireOpt == longOpts.end())) {
+			unchanged.push_back(e->first);
+			continue;
+		}
+
+		nlohmann::json update;
+		update["authorized"] = authorize;
+		if (e->second.length() > 0)
+			update["name"] = e->second;
+		if (expireOpt != longOpts.end())
+			update["authExpiry"] = expiry;
+		scode = cliRequest(addr,requestHeaders,"POST",memberPath,&update,responseBody,member);
+		if (scode == 200) {
+			succeeded.push_back(e->first);
+		} else if (scode == 0) {
+			return cliControllerError(cmd.c_str(),scode,responseBody);
+		} else {
+			fail["error"] = responseBody;
+			failed.push_back(fail);
+		}
+	}
+
+	if (json) {
+		nlohmann::json r;
+		r["succeeded"] = succeeded;
+		r[(authorize) ? "alreadyAuthorized" : "alreadyDeauthorized"] = unchanged;
+		r["failed"] = failed;
+		printf("%s" ZT_EOL_S,cliJson(r).c_str());
+	} else {
+		for(unsigned long i=0;i<failed.size();++i)
+			fprintf(stderr,"%s: %s" ZT_EOL_S,OSUtils::jsonString(failed[i]["address"],"").c_str(),OSUtils::jsonString(failed[i]["error"],"").c_str());
+		printf("%s controller %s %lu %s, %lu already %s, %lu failed" ZT_EOL_S,
+			(failed.empty()) ? "200" : "400",
+			cmd.c_str(),
+			(unsigned long)succeeded.size(),
+			(authorize) ? "authorized" : "deauthorized",
+			(unsigned long)unchanged.size(),
+			(authorize) ? "authorized" : "deauthorized",
+			(unsigned long)failed.size());
+	}
+	return (failed.empty()) ? 0 : ZT_CLI_EXIT_FAILED;
+}
+
+// controller pool <network ID> list|add <start> <end>|add <cidr>|remove <start> <end>
+static int cliControllerPool(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	const std::string op((args.size() >= 3) ? args[2] : std::string());
+	if ((args.size() < 3)||(args[1].length() != 16)||(!(((op == "list")&&(args.size() == 3))||((op == "add")&&((args.size() == 4)||(args.size() == 5)))||((op == "remove")&&(args.size() == 5))))) {
+		fprintf(stderr,"invalid format: controller pool <network ID> list|add <start> <end>|add <cidr>|remove <start> <end>" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+
+	InetAddress rangeStart,rangeEnd;
+	if (op != "list") {
+		if (args.size() == 4) {
+			std::string target,rs,re;
+			if (!cliCidrPool(args[3],target,rs,re)) {
+				fprintf(stderr,"invalid CIDR %s" ZT_EOL_S,args[3].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			rangeStart.fromString(rs.c_str());
+			rangeEnd.fromString(re.c_str());
+		} else {
+			rangeStart.fromString(args[3].c_str());
+			rangeEnd.fromString(args[4].c_str());
+			if (((rangeStart.ss_family != AF_INET)&&(rangeStart.ss_family != AF_INET6))||(rangeStart.ss_family != rangeEnd.ss_family)||(args[3].find('/') != std::string::npos)||(args[4].find('/') != std::string::npos)) {
+				fprintf(stderr,"invalid range %s %s: expected two IPv4 or two IPv6 addresses" ZT_EOL_S,args[3].c_str(),args[4].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			if (cliIpCompare(rangeStart,rangeEnd) > 0) {
+				fprintf(stderr,"invalid range %s %s: start is after end" ZT_EOL_S,args[3].c_str(),args[4].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+		}
+	}
+
+	nlohmann::json network;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("pool",scode,responseBody);
+	nlohmann::json pools = network["ipAssignmentPools"];
+	if (!pools.is_array())
+		pools = nlohmann::json::array();
+
+	if (op != "list") {
+		char s1[64],s2[64];
+		nlohmann::json newPools = nlohmann::json::array();
+		bool found = false;
+		for(unsigned long i=0;i<pools.size();++i) {
+			const InetAddress ps(OSUtils::jsonString(pools[i]["ipRangeStart"],"").c_str());
+			const InetAddress pe(OSUtils::jsonString(pools[i]["ipRangeEnd"],"").c_str());
+			if (op == "add") {
+				if ((ps.ss_family == rangeStart.ss_family)&&(cliIpCompare(rangeStart,pe) <= 0)&&(cliIpCompare(ps,rangeEnd) <= 0)) {
+					fprintf(stderr,"pool %s-%s overlaps existing pool %s-%s" ZT_EOL_S,rangeStart.toIpString(s1),rangeEnd.toIpString(s2),OSUtils::jsonString(pools[i]["ipRangeStart"],"").c_str(),OSUtils::jsonString(pools[i]["ipRangeEnd"],"").c_str());
+					return ZT_CLI_EXIT_FAILED;
+				}
+			} else if ((ps.ipsEqual(rangeStart))&&(pe.ipsEqual(rangeEnd))) {
+				found = true;
+				continue;
+			}
+			newPools.push_back(pools[i]);
+		}
+		if (op == "add") {
+			nlohmann::json pool;
+			pool["ipRangeStart"] = rangeStart.toIpString(s1);
+			pool["ipRangeEnd"] = rangeEnd.toIpString(s2);
+			newPools.push_back(pool);
+		} else if (!found) {
+			fprintf(stderr,"no pool %s-%s on this network" ZT_EOL_S,rangeStart.toIpString(s1),rangeEnd.toIpString(s2));
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+
+		nlohmann::json update;
+		update["ipAssignmentPools"] = newPools;
+		scode = cliRequest(addr,requestHeaders,"POST",networkPath,&update,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("pool",scode,responseBody);
+		pools = network["ipAssignmentPools"];
+
+		if (op == "remove") {
+			// Existing assignments are left alone, but say how many are no longer covered by any pool
+			nlohmann::json members;
+			scode = cliRequest(addr,requestHeaders,"GET",networkPath + "/member?offset=0",(const nlohmann::json *)0,responseBody,members);
+			if ((scode == 200)&&(members.is_object())) {
+				unsigned long outside = 0;
+				nlohmann::json &data = members["data"];
+				for(unsigned long i=0;i<data.size();++i) {
+					nlohmann::json &ipa = data[i]["ipAssignments"];
+					for(unsigned long k=0;k<ipa.size();++k) {
+						const InetAddress ip(OSUtils::jsonString(ipa[k],"").c_str());
+						bool covered = false;
+						for(unsigned long p=0;((!covered)&&(p<pools.size()));++p)
+							covered = cliIpInRange(ip,InetAddress(OSUtils::jsonString(pools[p]["ipRangeStart"],"").c_str()),InetAddress(OSUtils::jsonString(pools[p]["ipRangeEnd"],"").c_str()));
+						if (!covered)
+							++outside;
+					}
+				}
+				if (outside > 0)
+					fprintf(stderr,"warning: %lu member IP assignment(s) fall outside all remaining pools" ZT_EOL_S,outside);
+			}
+		}
+	}
+
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(pools).c_str());
+	} else {
+		cliHeader("200 controller pool" ZT_EOL_S "<start>                                  <end>" ZT_EOL_S);
+		for(unsigned long i=0;i<pools.size();++i)
+			printf("%-40s %s" ZT_EOL_S,OSUtils::jsonString(pools[i]["ipRangeStart"],"").c_str(),OSUtils::jsonString(pools[i]["ipRangeEnd"],"").c_str());
+	}
+	return 0;
+}
+
+// controller route <network ID> list|add <target> [<via>]|remove <target>
+static int cliControllerRoute(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	const std::string op((args.size() >= 3) ? args[2] : std::string());
+	if ((args.size() < 3)||(args[1].length() != 16)||(!(((op == "list")&&(args.size() == 3))||((op == "add")&&((args.size() == 4)||(args.size() == 5)))||((op == "remove")&&(args.size() == 4))))) {
+		fprintf(stderr,"invalid format: controller route <network ID> list|add <target> [<via>]|remove <target>" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+
+	InetAddress target,via;
+	char tmp[64];
+	if (op != "list") {
+		target.fromString(args[3].c_str());
+		if (((target.ss_family != AF_INET)&&(target.ss_family != AF_INET6))||(args[3].find('/') == std::string::npos)||(!target.netmaskBitsValid())) {
+			fprintf(stderr,"invalid route target %s: expected an IPv4 or IPv6 CIDR" ZT_EOL_S,args[3].c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		if (args.size() == 5) {
+			via.fromString(args[4].c_str());
+			if ((via.ss_family != target.ss_family)||(args[4].find('/') != std::string::npos)) {
+				fprintf(stderr,"invalid via %s: expected an IP address in the same family as the target" ZT_EOL_S,args[4].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+		}
+	}
+
+	nlohmann::json routes;
+	unsigned int scode;
+	if (op == "add") {
+		nlohmann::json network;
+		scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("route",scode,responseBody);
+
+		nlohmann::json &rts = network["routes"];
+		nlohmann::json &pools = network["ipAssignmentPools"];
+		bool viaOk = (!via);
+		for(unsigned long i=0;i<rts.size();++i) {
+			const InetAddress rt(OSUtils::jsonString(rts[i]["target"],"").c_str());
+			if ((rt.netmaskBits() == target.netmaskBits())&&(rt.network().ipsEqual(target.network()))) {
+				fprintf(stderr,"route %s already exists on this network" ZT_EOL_S,OSUtils::jsonString(rts[i]["target"],"").c_str());
+				return ZT_CLI_EXIT_FAILED;
+			}
+			if ((via)&&(rt.containsAddress(via)))
+				viaOk = true;
+		}
+		for(unsigned long i=0;((!viaOk)&&(i<pools.size()));++i)
+			viaOk = cliIpInRange(via,InetAddress(OSUtils::jsonString(pools[i]["ipRangeStart"],"").c_str()),InetAddress(OSUtils::jsonString(pools[i]["ipRangeEnd"],"").c_str()));
+		if (!viaOk) {
+			fprintf(stderr,"via %s is not within any existing route or IP assignment pool on this network" ZT_EOL_S,via.toIpString(tmp));
+			return ZT_CLI_EXIT_FAILED;
+		}
+		if (target.netmaskBits() == 0)
+			fprintf(stderr,"warning: %s is a default route and will be used by every member that allows default route override" ZT_EOL_S,target.toString(tmp));
+
+		nlohmann::json route;
+		route["target"] = target.toString(tmp);
+		if (via)
+			route["via"] = via.toIpString(tmp);
+		scode = cliRequest(addr,requestHeaders,"POST",networkPath + "/routes",&route,responseBody,routes);
+	} else if (op == "remove") {
+		std::string t(target.toString(tmp));
+		std::replace(t.begin(),t.end(),'/','_');
+		scode = cliRequest(addr,requestHeaders,"DELETE",networkPath + "/routes/" + t,(const nlohmann::json *)0,responseBody,routes);
+		if (scode == 404) {
+			fprintf(stderr,"no route %s on this network" ZT_EOL_S,target.toString(tmp));
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+	} else {
+		scode = cliRequest(addr,requestHeaders,"GET",networkPath + "/routes",(const nlohmann::json *)0,responseBody,routes);
+	}
+	if ((scode != 200)||(!routes.is_array()))
+		return cliControllerError("route",scode,responseBody);
+
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(routes).c_str());
+	} else {
+		cliHeader("200 controller route" ZT_EOL_S "<target>                                    <via>" ZT_EOL_S);
+		for(unsigned long i=0;i<routes.size();++i) {
+			const std::string v(OSUtils::jsonString(routes[i]["via"],""));
+			printf("%-43s %s" ZT_EOL_S,OSUtils::jsonString(routes[i]["target"],"").c_str(),(v.length() > 0) ? v.c_str() : "-");
+		}
+	}
+	return 0;
+}
+
+// controller tag <network ID> list|define <ID> <name> [...]|remove <name|ID>
+static int cliControllerTag(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	const std::string op((args.size() >= 3) ? args[2] : std::string());
+	if ((args.size() < 3)||(args[1].length() != 16)||(!(((op == "list")&&(args.size() == 3))||((op == "define")&&(args.size() >= 5)&&(args.size() <= 6))||((op == "remove")&&(args.size() == 4))))) {
+		fprintf(stderr,"invalid format: controller tag <network ID> list|define <ID> <name> [<min>-<max>|any] [--default=<value>]|remove <name|ID>" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	// Defining and removing are the same edits as controller set tagdef, with the ID first
+	if (op == "define") {
+		uint64_t id = 0;
+		if (!cliParseU32(args[3],id)) {
+			fprintf(stderr,"invalid tag ID %s: expected an integer from 0 to 4294967295" ZT_EOL_S,args[3].c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		std::vector<std::string> a;
+		a.push_back("set");
+		a.push_back(args[1]);
+		a.push_back("tagdef");
+		a.push_back(args[4]);
+		a.push_back(args[3]);
+		if (args.size() == 6)
+			a.push_back(args[5]);
+		return cliControllerTagDef("tag define",a,longOpts,json,addr,requestHeaders);
+	} else if (op == "remove") {
+		std::vector<std::string> a;
+		a.push_back("set");
+		a.push_back(args[1]);
+		a.push_back("tagdef");
+		a.push_back(args[3]);
+		a.push_back("remove");
+		return cliControllerTagDef("tag remove",a,longOpts,json,addr,requestHeaders);
+	}
+
+	nlohmann::json network,r;
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("tag",scode,responseBody);
+	// A filter with no limit returns every member as a full object, tags included
+	scode = cliRequest(addr,requestHeaders,"GET",networkPath + "/member?offset=0",(const nlohmann::json *)0,responseBody,r);
+	if ((scode != 200)||(!r.is_object()))
+		return cliControllerError("tag",scode,responseBody);
+
+	nlohmann::json &defs = network["tags"];
+	nlohmann::json &data = r["data"];
+	nlohmann::json assignments = nlohmann::json::array();
+	for(unsigned long i=0;i<data.size();++i) {
+		nlohmann::json &mt = data[i]["tags"];
+		for(unsigned long k=0;k<mt.size();++k) {
+			if ((mt[k].is_array())&&(mt[k].size() == 2))
+				assignments.push_back({{"member",OSUtils::jsonString(data[i]["id"],"")},{"id",OSUtils::jsonInt(mt[k][0],0ULL)},{"value",OSUtils::jsonInt(mt[k][1],0ULL)}});
+		}
+	}
+
+	if (json) {
+		nlohmann::json out;
+		out["tags"] = (defs.is_array()) ? defs : nlohmann::json::array();
+		out["assignments"] = assignments;
+		printf("%s" ZT_EOL_S,cliJson(out).c_str());
+		return 0;
+	}
+	cliHeader("200 controller tag %s" ZT_EOL_S "<id>       <name>               <default>  <range>" ZT_EOL_S,args[1].c_str());
+	for(unsigned long i=0;i<defs.size();++i) {
+		nlohmann::json &t = defs[i];
+		char range[64];
+		if (t["min"].is_number())
+			OSUtils::ztsnprintf(range,sizeof(range),"%llu-%llu",(unsigned long long)OSUtils::jsonInt(t["min"],0ULL),(unsigned long long)OSUtils::jsonInt(t["max"],0ULL));
+		else OSUtils::ztsnprintf(range,sizeof(range),"any");
+		const std::string name(OSUtils::jsonString(t["name"],""));
+		const std::string d((t["default"].is_number()) ? std::to_string((unsigned long long)OSUtils::jsonInt(t["default"],0ULL)) : std::string("-"));
+		printf("%-10llu %-20s %-10s %s" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(t["id"],0ULL),(name.length() > 0) ? name.c_str() : "-",d.c_str(),range);
+	}
+	cliHeader(ZT_EOL_S "<address>  <id>       <name>               <value>" ZT_EOL_S);
+	for(unsigned long i=0;i<assignments.size();++i) {
+		nlohmann::json &a = assignments[i];
+		const long d = cliFindDefinition(defs,std::to_string((unsigned long long)OSUtils::jsonInt(a["id"],0ULL)));
+		const std::string name((d >= 0) ? OSUtils::jsonString(defs[d]["name"],"") : std::string());
+		printf("%s %-10llu %-20s %llu" ZT_EOL_S,OSUtils::jsonString(a["member"],"").c_str(),(unsigned long long)OSUtils::jsonInt(a["id"],0ULL),(name.length() > 0) ? name.c_str() : "-",(unsigned long long)OSUtils::jsonInt(a["value"],0ULL));
+	}
+	return 0;
+}
+
+// controller acl <network ID> list|add <rule JSON|file|->|remove <ID>|flush
+static int cliControllerAcl(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	const std::string op((args.size() >= 3) ? args[2] : std::string());
+	if ((args.size() < 3)||(args[1].length() != 16)||(!((((op == "list")||(op == "flush"))&&(args.size() == 3))||(((op == "add")||(op == "remove"))&&(args.size() == 4))))) {
+		fprintf(stderr,"invalid format: controller acl <network ID> list|add <rule JSON|file|->|remove <ID>|flush" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string aclPath(std::string("/controller/network/") + args[1] + "/acl");
+
+	nlohmann::json acl;
+	unsigned int scode;
+	if (op == "add") {
+		// The rule may be given inline or read from a file or standard input
+		std::string buf(args[3]);
+		if ((buf.empty())||(buf[0] != '{')) {
+			buf.clear();
+			if (!cliReadInput(args[3],buf)) {
+				fprintf(stderr,"unable to read %s" ZT_EOL_S,args[3].c_str());
+				return ZT_CLI_EXIT_FAILED;
+			}
+		}
+		nlohmann::json rule;
+		try {
+			rule = OSUtils::jsonParse(buf);
+		} catch ( ... ) {}
+		if (!rule.is_object()) {
+			fprintf(stderr,"invalid rule %s: expected a JSON object like {\"action\":\"drop\",\"source\":\"10.0.0.0/8\",\"etherTypes\":[\"0x0800\"]}" ZT_EOL_S,args[3].c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		scode = cliRequest(addr,requestHeaders,"POST",aclPath,&rule,responseBody,acl);
+		if (scode == 400) {
+			nlohmann::json e;
+			try {
+				e = OSUtils::jsonParse(responseBody);
+			} catch ( ... ) {}
+			fprintf(stderr,"invalid rule: %s" ZT_EOL_S,(e.is_object()) ? OSUtils::jsonString(e["message"],responseBody.c_str()).c_str() : responseBody.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+	} else if (op == "remove") {
+		uint64_t id = 0;
+		if ((!cliParseU32(args[3],id))||(id == 0)) {
+			fprintf(stderr,"invalid ACL entry ID %s: expected a number from controller acl %s list" ZT_EOL_S,args[3].c_str(),args[1].c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		scode = cliRequest(addr,requestHeaders,"DELETE",aclPath + "/" + std::to_string((unsigned long long)id),(const nlohmann::json *)0,responseBody,acl);
+		if (scode == 404) {
+			fprintf(stderr,"no ACL entry %llu on network %s" ZT_EOL_S,(unsigned long long)id,args[1].c_str());
+			return ZT_CLI_EXIT_NOT_FOUND;
+		}
+	} else if (op == "flush") {
+		scode = cliRequest(addr,requestHeaders,"DELETE",aclPath,(const nlohmann::json *)0,responseBody,acl);
+	} else {
+		scode = cliRequest(addr,requestHeaders,"GET",aclPath,(const nlohmann::json *)0,responseBody,acl);
+	}
+	if ((scode != 200)||(!acl.is_array()))
+		return cliControllerError("acl",scode,responseBody);
+
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(acl).c_str());
+	} else {
+		cliHeader("200 controller acl" ZT_EOL_S "<id>       <action> <source>                                    <destination>                               <etherTypes>" ZT_EOL_S);
+		for(unsigned long i=0;i<acl.size();++i) {
+			std::string ets;
+			nlohmann::json &et = acl[i]["etherTypes"];
+			for(unsigned long j=0;j<et.size();++j) {
+				char tmp[16];
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s0x%.4x",(j > 0) ? "," : "",(unsigned int)OSUtils::jsonInt(et[j],0ULL));
+				ets.append(tmp);
+			}
+			printf("%-10llu %-8s %-43s %-43s %s" ZT_EOL_S,
+				(unsigned long long)OSUtils::jsonInt(acl[i]["id"],0ULL),
+				OSUtils::jsonString(acl[i]["action"],"-").c_str(),
+				OSUtils::jsonString(acl[i]["source"],"any").c_str(),
+				OSUtils::jsonString(acl[i]["destination"],"any").c_str(),
+				(ets.length() > 0) ? ets.c_str() : "any");
+		}
+	}
+	return 0;
+}
+
+// controller token new <network ID> <role> [--ttl=<duration>]
+static int cliControllerToken(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json response;
+
+	if ((args.size() != 4)||(args[1] != "new")||(args[2].length() != 16)) {
+		fprintf(stderr,"invalid format: controller token new <network ID> <role> [--ttl=<duration>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	nlohmann::json req;
+	req["role"] = args[3];
+	std::map<std::string,std::string>::const_iterator ttl(longOpts.find("ttl"));
+	if (ttl != longOpts.end()) {
+		int64_t ms = 0;
+		const std::string &t = ttl->second;
+		if ((t.empty())||(t[t.length() - 1] < 'a')||(!cliParseExpiry(t,0,ms))||(ms <= 0)) {
+			fprintf(stderr,"invalid --ttl %s: expected a duration like 90m, 12h, 7d, or 2w" ZT_EOL_S,t.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		req["ttl"] = ms;
+	}
+	const unsigned int scode = cliRequest(addr,requestHeaders,"POST",std::string("/controller/network/") + args[2] + "/token",&req,responseBody,response);
+	if ((scode != 200)||(!response.is_object()))
+		return cliControllerError("token",scode,responseBody);
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(response).c_str());
+	} else {
+		printf("%s" ZT_EOL_S,OSUtils::jsonString(response["token"],"").c_str());
+		fprintf(stderr,"role %s on %s, expires %s; join with: zerotier-cli join %s --token=<token>" ZT_EOL_S,OSUtils::jsonString(response["role"],"").c_str(),args[2].c_str(),cliUtcTime((int64_t)OSUtils::jsonInt(response["expires"],0ULL)).c_str(),args[2].c_str());
+	}
+	return 0;
+}
+
+// controller events [<network ID>] [--since=<ms>]
+static int cliControllerEvents(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json response;
+
+	if ((args.size() > 2)||((args.size() == 2)&&(args[1].length() != 16))) {
+		fprintf(stderr,"invalid format: controller events [<network ID>] [--since=<ms>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	std::string path((args.size() == 2) ? (std::string("/controller/network/") + args[1] + "/event") : std::string("/controller/event"));
+	std::map<std::string,std::string>::const_iterator since(longOpts.find("since"));
+	if (since != longOpts.end())
+		path.append("?since=").append(since->second);
+	const unsigned int scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,response);
+	if ((scode != 200)||(!response.is_array()))
+		return cliControllerError("events",scode,responseBody);
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(response).c_str());
+		return 0;
+	}
+	cliHeader("<time>                  <type>               <network ID>     <member>" ZT_EOL_S);
+	for(unsigned long i=0;i<response.size();++i) {
+		nlohmann::json &e = response[i];
+		printf("%-23s %-20s %-16s %s" ZT_EOL_S,
+			cliUtcTime((int64_t)OSUtils::jsonInt(e["time"],0ULL)).c_str(),
+			OSUtils::jsonString(e["type"],"-").c_str(),
+			OSUtils::jsonString(e["networkId"],"-").c_str(),
+			(e["member"].is_object()) ? OSUtils::jsonString(e["member"]["id"],"-").c_str() : "-");
+	}
+	return 0;
+}
+
+// controller audit [--network=<network ID>] [--since=<ms|date|duration>]
+static int cliControllerAudit(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json response;
+
+	std::map<std::string,std::string>::const_iterator network(longOpts.find("network"));
+	std::map<std::string,std::string>::const_iterator since(longOpts.find("since"));
+	if ((args.size() != 1)||((network != longOpts.end())&&(network->second.length() != 16))) {
+		fprintf(stderr,"invalid format: controller audit [--network=<network ID>] [--since=<ms|date|duration>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	std::string path("/controller/audit?since=");
+	if (since != longOpts.end()) {
+		// Milliseconds since epoch, a UTC date, or a duration meaning that long ago
+		int64_t t = 0;
+		if ((since->second.length() > 0)&&(since->second.find_first_not_of("0123456789") == std::string::npos)) {
+			t = (int64_t)Utils::strToU64(since->second.c_str());
+		} else if ((since->second == "never")||(!cliParseExpiry(since->second,0,t))) {
+			fprintf(stderr,"invalid --since %s: use ms since epoch, a date like 2020-01-31T12:00Z, or a duration like 12h" ZT_EOL_S,since->second.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		} else if (since->second.find('-') == std::string::npos) {
+			t = OSUtils::now() - t;
+		}
+		char tmp[64];
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%lld",(long long)t);
+		path.append(tmp);
+	} else path.push_back('0');
+	if (network != longOpts.end())
+		path.append("&network=").append(network->second);
+	const unsigned int scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,response);
+	if ((scode != 200)||(!response.is_array()))
+		return cliControllerError("audit",scode,responseBody);
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(response).c_str());
+		return 0;
+	}
+	cliHeader("<time>                  <actor>          <operation>          <network ID>     <member>   <change>" ZT_EOL_S);
+	for(unsigned long i=0;i<response.size();++i) {
+		nlohmann::json &e = response[i];
+		nlohmann::json &before = e["before"];
+		nlohmann::json &after = e["after"];
+		std::string change;
+		if ((before.is_object())&&(after.is_object())) {
+			for(nlohmann::json::const_iterator k(after.begin());k!=after.end();++k) {
+				if (change.length() > 0)
+					change.append(", ");
+				change.append(k.key()).append(" ").append(OSUtils::jsonDump(before[k.key()],-1)).append(" -> ").append(OSUtils::jsonDump(k.value(),-1));
+			}
+		} else if (after.is_object()) {
+			change = OSUtils::jsonDump(after,-1);
+		} else if (before.is_object()) {
+			change = std::string("was ") + OSUtils::jsonDump(before,-1);
+		}
+		printf("%-23s %-16s %-20s %-16s %-10s %s" ZT_EOL_S,
+			cliUtcTime((int64_t)OSUtils::jsonInt(e["time"],0ULL)).c_str(),
+			OSUtils::jsonString(e["actor"],"-").c_str(),
+			OSUtils::jsonString(e["op"],"-").c_str(),
+			OSUtils::jsonString(e["networkId"],"-").c_str(),
+			OSUtils::jsonString(e["memberId"],"-").c_str(),
+			change.c_str());
+	}
+	return 0;
+}
+
+// controller stats [<network ID>]
+static int cliControllerStats(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json response;
+
+	if ((args.size() > 2)||((args.size() == 2)&&(args[1].length() != 16))) {
+		fprintf(stderr,"invalid format: controller stats [<network ID>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const unsigned int scode = cliRequest(addr,requestHeaders,"GET",(args.size() == 2) ? (std::string("/controller/network/") + args[1] + "/stats") : std::string("/controller/stats"),(const nlohmann::json *)0,responseBody,response);
+	if ((scode != 200)||(!response.is_object()))
+		return cliControllerError("stats",scode,responseBody);
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson(response).c_str());
+		return 0;
+	}
+	if (args.size() == 2) {
+		cliHeader("200 controller stats %s" ZT_EOL_S,args[1].c_str());
+		printf("counting since:      %s" ZT_EOL_S,cliUtcTime((int64_t)OSUtils::jsonInt(response["since"],0ULL)).c_str());
+		printf("config requests:     %llu" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(response["configRequests"],0ULL));
+		printf("new members:         %llu" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(response["newMembers"],0ULL));
+		printf("authorizations:      %llu" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(response["authorizations"],0ULL));
+		printf("deauthorizations:    %llu" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(response["deauthorizations"],0ULL));
+		printf("active last 5 min:   %llu" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(response["activeMembers5m"],0ULL));
+		printf("active last 60 min:  %llu" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(response["activeMembers60m"],0ULL));
+		return 0;
+	}
+	cliHeader("200 controller stats" ZT_EOL_S);
+	printf("%llu networks, %llu members (%llu authorized, %llu active)" ZT_EOL_S,
+		(unsigned long long)OSUtils::jsonInt(response["networkCount"],0ULL),
+		(unsigned long long)OSUtils::jsonInt(response["memberCount"],0ULL),
+		(unsigned long long)OSUtils::jsonInt(response["authorizedMemberCount"],0ULL),
+		(unsigned long long)OSUtils::jsonInt(response["activeMemberCount"],0ULL));
+	cliHeader("<network ID>     <requests> <new> <auth> <deauth> <active 5m> <active 60m>" ZT_EOL_S);
+	nlohmann::json &networks = response["networks"];
+	if (networks.is_object()) {
+		for(nlohmann::json::iterator n(networks.begin());n!=networks.end();++n) {
+			nlohmann::json &c = n.value();
+			printf("%-16s %10llu %5llu %6llu %8llu %11llu %12llu" ZT_EOL_S,
+				n.key().c_str(),
+				(unsigned long long)OSUtils::jsonInt(c["configRequests"],0ULL),
+				(unsigned long long)OSUtils::jsonInt(c["newMembers"],0ULL),
+				(unsigned long long)OSUtils::jsonInt(c["authorizations"],0ULL),
+				(unsigned long long)OSUtils::jsonInt(c["deauthorizations"],0ULL),
+				(unsigned long long)OSUtils::jsonInt(c["activeMembers5m"],0ULL),
+				(unsigned long long)OSUtils::jsonInt(c["activeMembers60m"],0ULL));
+		}
+	}
+	return 0;
+}
+
+// controller dns <network ID> show|clear|set <domain> <server> [<server> ...]
+static int cliControllerDns(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	const std::string op((args.size() >= 3) ? args[2] : std::string());
+	if ((args.size() < 3)||(args[1].length() != 16)||(!((((op == "show")||(op == "clear"))&&(args.size() == 3))||((op == "set")&&(args.size() >= 5))))) {
+		fprintf(stderr,"invalid format: controller dns <network ID> show|clear|set <domain> <server> [<server> ...]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+
+	nlohmann::json dns;
+	std::vector<InetAddress> servers;
+	char tmp[64];
+	if (op == "set") {
+		const std::string &domain = args[3];
+		if ((domain.empty())||(domain.length() >= sizeof(((ZT_VirtualNetworkDNS *)0)->domain))||(domain.find_first_not_of("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-") != std::string::npos)) {
+			fprintf(stderr,"invalid domain %s" ZT_EOL_S,domain.c_str());
+			return ZT_CLI_EXIT_USAGE;
+		}
+		if ((args.size() - 4) > ZT_MAX_DNS_SERVERS) {
+			fprintf(stderr,"too many DNS servers: at most %d are allowed" ZT_EOL_S,ZT_MAX_DNS_SERVERS);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		dns["domain"] = domain;
+		dns["servers"] = nlohmann::json::array();
+		for(unsigned long i=4;i<args.size();++i) {
+			const InetAddress sa(args[i].c_str());
+			if (((sa.ss_family != AF_INET)&&(sa.ss_family != AF_INET6))||(args[i].find('/') != std::string::npos)) {
+				fprintf(stderr,"invalid DNS server %s: expected an IPv4 or IPv6 address" ZT_EOL_S,args[i].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			if (std::find(servers.begin(),servers.end(),sa) != servers.end()) {
+				fprintf(stderr,"DNS server %s is listed more than once" ZT_EOL_S,args[i].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			servers.push_back(sa);
+			dns["servers"].push_back(sa.toIpString(tmp));
+		}
+	}
+
+	nlohmann::json network;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("dns",scode,responseBody);
+
+	if (op != "show") {
+		// Members may not be able to reach resolvers outside the network through the tunnel
+		nlohmann::json &rts = network["routes"];
+		nlohmann::json &pools = network["ipAssignmentPools"];
+		for(std::vector<InetAddress>::const_iterator sa(servers.begin());sa!=servers.end();++sa) {
+			bool inside = false;
+			for(unsigned long i=0;((!inside)&&(i<rts.size()));++i) {
+				const InetAddress rt(OSUtils::jsonString(rts[i]["target"],"").c_str());
+				inside = ((rt.netmaskBits() > 0)&&(rt.containsAddress(*sa)));
+			}
+			for(unsigned long i=0;((!inside)&&(i<pools.size()));++i)
+				inside = cliIpInRange(*sa,InetAddress(OSUtils::jsonString(pools[i]["ipRangeStart"],"").c_str()),InetAddress(OSUtils::jsonString(pools[i]["ipRangeEnd"],"").c_str()));
+			if (!inside)
+				fprintf(stderr,"warning: DNS server %s is not within any route or IP assignment pool on this network, so members may not be able to reach it" ZT_EOL_S,sa->toIpString(tmp));
+		}
+
+		nlohmann::json update;
+		update["dns"] = (op == "set") ? dns : nlohmann::json();
+		scode = cliRequest(addr,requestHeaders,"POST",networkPath,&update,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("dns",scode,responseBody);
+	}
+
+	nlohmann::json &nd = network["dns"];
+	if (json) {
+		printf("%s" ZT_EOL_S,cliJson((nd.is_object()) ? nd : nlohmann::json::object()).c_str());
+	} else if (cliDnsSummary(nd) == "-") {
+		printf("200 controller dns: none" ZT_EOL_S);
+	} else {
+		printf("200 controller dns" ZT_EOL_S "domain  %s" ZT_EOL_S "servers",OSUtils::jsonString(nd["domain"],"").c_str());
+		nlohmann::json &srv = nd["servers"];
+		for(unsigned long i=0;((srv.is_array())&&(i<srv.size()));++i)
+			printf(" %s",OSUtils::jsonString(srv[i],"").c_str());
+		printf(ZT_EOL_S);
+	}
+	return 0;
+}
+
+// controller rules <network ID> show|apply|compile|list|add|remove|test ...,
+// also reached as controller rule, the older spelling
+static int cliControllerRules(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	const std::string op((args.size() >= 3) ? args[2] : std::string());
+	if ((args.size() < 3)||(args[1].length() != 16)||(!((((op == "show")||(op == "list"))&&(args.size() == 3))||((op == "add")&&(args.size() >= 4))||((op == "remove")&&(args.size() == 4))||((op == "test")&&(args.size() == 6))||(((op == "compile")||(op == "apply"))&&(args.size() == 4))))) {
+		fprintf(stderr,"invalid format: controller rules <network ID> show [--decompile] | list | add <rule|JSON> [--at=<n>] | remove <n> | test <source address> <destination address> <ethertype> | compile <rules script|-> [--dry-run] | apply <compiled rules file|-> [--source=<rules script>]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+	nlohmann::json network;
+	unsigned int scode;
+
+	if (op == "show") {
+		scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("rules",scode,responseBody);
+		if (json) {
+			nlohmann::json j;
+			j["rules"] = network["rules"];
+			j["capabilities"] = network["capabilities"];
+			j["tags"] = network["tags"];
+			j["rulesSource"] = network["rulesSource"];
+			printf("%s" ZT_EOL_S,cliJson(j).c_str());
+			return 0;
+		}
+		const std::string source(OSUtils::jsonString(network["rulesSource"],""));
+		if ((!source.empty())&&(longOpts.find("decompile") == longOpts.end())) {
+			printf("%s",source.c_str());
+			if (source[source.length() - 1] != '\n')
+				printf(ZT_EOL_S);
+			return 0;
+		}
+
+		std::string out("# Decompiled from the rules on network ");
+		out.append(args[1]);
+		out.append(". Tags and capabilities without a stored" ZT_EOL_S "# name are named after their numeric IDs." ZT_EOL_S ZT_EOL_S);
+		char tmp[128];
+		nlohmann::json &tags = network["tags"];
+		for(unsigned long i=0;i<tags.size();++i) {
+			const unsigned long long id = OSUtils::jsonInt(tags[i]["id"],0ULL);
+			const std::string name(OSUtils::jsonString(tags[i]["name"],""));
+			if (name.length() > 0)
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"tag %s" ZT_EOL_S "\tid %llu" ZT_EOL_S,name.c_str(),id);
+			else OSUtils::ztsnprintf(tmp,sizeof(tmp),"tag tag%llu" ZT_EOL_S "\tid %llu" ZT_EOL_S,id,id);
+			out.append(tmp);
+			if (tags[i]["default"].is_number()) {
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"\tdefault %llu" ZT_EOL_S,(unsigned long long)OSUtils::jsonInt(tags[i]["default"],0ULL));
+				out.append(tmp);
+			}
+			out.append(";" ZT_EOL_S ZT_EOL_S);
+		}
+		nlohmann::json &caps = network["capabilities"];
+		for(unsigned long i=0;i<caps.size();++i) {
+			const unsigned long long id = OSUtils::jsonInt(caps[i]["id"],0ULL);
+			const std::string name(OSUtils::jsonString(caps[i]["name"],""));
+			if (name.length() > 0)
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"cap %s" ZT_EOL_S "\tid %llu" ZT_EOL_S,name.c_str(),id);
+			else OSUtils::ztsnprintf(tmp,sizeof(tmp),"cap cap%llu" ZT_EOL_S "\tid %llu" ZT_EOL_S,id,id);
+			out.append(tmp);
+			cliDecompileRules(caps[i]["rules"],"\t",out);
+			out.append(";" ZT_EOL_S ZT_EOL_S);
+		}
+		cliDecompileRules(network["rules"],"",out);
+		printf("%s",out.c_str());
+		return 0;
+	}
+
+	if ((op == "list")||(op == "add")||(op == "remove")||(op == "test")) {
+		scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("rules",scode,responseBody);
+		nlohmann::json rules(network["rules"]);
+		if (!rules.is_array())
+			rules = nlohmann::json::array();
+		std::vector< std::pair<unsigned long,unsigned long> > groups;
+		cliRuleGroups(rules,groups);
+
+		if (op == "list") {
+			if (json) {
+				nlohmann::json out = nlohmann::json::array();
+				for(unsigned long g=0;g<groups.size();++g) {
+					nlohmann::json entries = nlohmann::json::array();
+					for(unsigned long i=groups[g].first;i<=groups[g].second;++i)
+						entries.push_back(rules[i]);
+					out.push_back(entries);
+				}
+				printf("%s" ZT_EOL_S,cliJson(out).c_str());
+				return 0;
+			}
+			cliHeader("200 controller rules %s" ZT_EOL_S "<n>  <rule>" ZT_EOL_S,args[1].c_str());
+			for(unsigned long g=0;g<groups.size();++g)
+				printf("%-4lu %s" ZT_EOL_S,g + 1,cliRuleText(rules,groups[g]).c_str());
+			return 0;
+		}
+
+		if (op == "test") {
+			uint64_t src = 0,dst = 0,et = 0;
+			for(int k=0;k<2;++k) {
+				const std::string &a = args[3 + k];
+				if ((a.length() != 10)||(a.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)) {
+					fprintf(stderr,"invalid address %s: expected a 10-digit ZeroTier address" ZT_EOL_S,a.c_str());
+					return ZT_CLI_EXIT_USAGE;
+				}
+				((k == 0) ? src : dst) = Utils::hexStrToU64(a.c_str());
+			}
+			if (!cliParseEtherType(args[5],et)) {
+				fprintf(stderr,"invalid ethertype %s: expected ipv4, arp, ipv6, or a number such as 0x86dd" ZT_EOL_S,args[5].c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+
+			// Access control entries come first, as the controller puts them before the network's rules
+			nlohmann::json steps = nlohmann::json::array();
+			nlohmann::json result;
+			nlohmann::json &acl = network["acl"];
+			for(unsigned long e=0;((result.is_null())&&(e<acl.size()));++e) {
+				nlohmann::json &ets = acl[e]["etherTypes"];
+				int m = (ets.empty()) ? 1 : 0;
+				for(unsigned long i=0;i<ets.size();++i) {
+					if (OSUtils::jsonInt(ets[i],0ULL) == et)
+						m = 1;
+				}
+				for(int k=0;k<2;++k) {
+					const std::string p(OSUtils::jsonString(acl[e][(k == 0) ? "source" : "destination"],"any"));
+					int pm = 1;
+					if (p.length() == 10)
+						pm = (Utils::hexStrToU64(p.c_str()) == ((k == 0) ? src : dst)) ? 1 : 0;
+					else if (p != "any")
+						pm = (et == ((p.find(':') == std::string::npos) ? 0x0800ULL : 0x86ddULL)) ? 2 : 0;
+					m = ((m == 0)||(pm == 0)) ? 0 : (((m == 1)&&(pm == 1)) ? 1 : 2);
+				}
+				if (m == 0)
+					continue;
+				nlohmann::json s;
+				s["acl"] = acl[e]["id"];
+				s["match"] = (m == 1) ? "yes" : "maybe";
+				s["action"] = acl[e]["action"];
+				steps.push_back(s);
+				if (m == 1)
+					result = s;
+			}
+
+			// Then the rules, evaluated as the network does: matches AND together unless marked or,
+			// and the first rule whose matches hold decides, except tee and watch which carry on
+			for(unsigned long g=0;((result.is_null())&&(g<groups.size()));++g) {
+				int set = 1;
+				for(unsigned long i=groups[g].first;i<groups[g].second;++i) {
+					int m = cliRuleMatches(rules[i],src,dst,et);
+					if ((m != 2)&&(OSUtils::jsonBool(rules[i]["not"],false)))
+						m = 1 - m;
+					if (OSUtils::jsonBool(rules[i]["or"],false))
+						set = ((set == 1)||(m == 1)) ? 1 : (((set == 0)&&(m == 0)) ? 0 : 2);
+					else set = ((set == 0)||(m == 0)) ? 0 : (((set == 1)&&(m == 1)) ? 1 : 2);
+				}
+				if (set == 0)
+					continue;
+				const std::string type(OSUtils::jsonString(rules[groups[g].second]["type"],""));
+				std::string action(type.substr(7));
+				std::transform(action.begin(),action.end(),action.begin(),::tolower);
+				nlohmann::json s;
+				s["rule"] = g + 1;
+				s["match"] = (set == 1) ? "yes" : "maybe";
+				s["action"] = action;
+				s["text"] = cliRuleText(rules,groups[g]);
+				steps.push_back(s);
+				if ((set == 1)&&(type != "ACTION_TEE")&&(type != "ACTION_WATCH"))
+					result = s;
+			}
+			if (result.is_null()) {
+				result["action"] = "drop";
+				result["match"] = "none";
+			}
+
+			if (json) {
+				nlohmann::json out;
+				out["source"] = args[3];
+				out["destination"] = args[4];
+				out["etherType"] = et;
+				out["steps"] = steps;
+				out["result"] = result;
+				printf("%s" ZT_EOL_S,cliJson(out).c_str());
+				return 0;
+			}
+			cliHeader("200 controller rules test %s -> %s %s" ZT_EOL_S "<rule> <match> <rule>" ZT_EOL_S,args[3].c_str(),args[4].c_str(),cliEtherTypeName((unsigned int)et).c_str());
+			for(unsigned long i=0;i<steps.size();++i) {
+				nlohmann::json &s = steps[i];
+				const std::string label((s["acl"].is_number()) ? ("acl " + std::to_string((unsigned long long)OSUtils::jsonInt(s["acl"],0ULL))) : std::to_string((unsigned long long)OSUtils::jsonInt(s["rule"],0ULL)));
+				printf("%-6s %-7s %s" ZT_EOL_S,label.c_str(),OSUtils::jsonString(s["match"],"").c_str(),(s["text"].is_string()) ? OSUtils::jsonString(s["text"],"").c_str() : OSUtils::jsonString(s["action"],"").c_str());
+			}
+			if (result["acl"].is_number())
+				printf("result: %s by acl %llu" ZT_EOL_S,OSUtils::jsonString(result["action"],"").c_str(),(unsigned long long)OSUtils::jsonInt(result["acl"],0ULL));
+			else if (result["rule"].is_number())
+				printf("result: %s by rule %llu%s" ZT_EOL_S,OSUtils::jsonString(result["action"],"").c_str(),(unsigned long long)OSUtils::jsonInt(result["rule"],0ULL),(OSUtils::jsonString(result["action"],"") == "break") ? ", the sender's capabilities decide" : "");
+			else printf("result: drop, no rule matched" ZT_EOL_S);
+			return 0;
+		}
+
+		nlohmann::json update;
+		if (op == "remove") {
+			uint64_t n = 0;
+			if ((!cliParseU32(args[3],n))||(n == 0)||(n > groups.size())) {
+				fprintf(stderr,"invalid rule %s: expected a number from controller rules %s list" ZT_EOL_S,args[3].c_str(),args[1].c_str());
+				return ZT_CLI_EXIT_NOT_FOUND;
+			}
+			rules.erase(rules.begin() + groups[n - 1].first,rules.begin() + groups[n - 1].second + 1);
+		} else {
+			// A rule is rules script words, or JSON for one entry (an action) or an array ending in an action
+			std::vector<std::string> words;
+			for(unsigned long i=3;i<args.size();++i) {
+				std::vector<std::string> w(OSUtils::split(args[i].c_str()," \t\r\n","",""));
+				words.insert(words.end(),w.begin(),w.end());
+			}
+			nlohmann::json entries;
+			std::string err;
+			if ((!words.empty())&&((words[0][0] == '{')||(words[0][0] == '['))) {
+				try {
+					entries = OSUtils::jsonParse(args[3]);
+				} catch ( ... ) {
+					entries = nlohmann::json();
+				}
+				if (entries.is_object())
+					entries = nlohmann::json::array({ entries });
+				bool ok = ((args.size() == 4)&&(entries.is_array())&&(!entries.empty()));
+				for(unsigned long i=0;((ok)&&(i<entries.size()));++i)
+					ok = ((entries[i].is_object())&&((OSUtils::jsonString(entries[i]["type"],"").compare(0,7,"ACTION_") == 0) == (i == (entries.size() - 1))));
+				if (!ok) {
+					fprintf(stderr,"invalid rule: JSON must be a quoted action object or an array of match objects ending in one action" ZT_EOL_S);
+					return ZT_CLI_EXIT_USAGE;
+				}
+			} else if (!RulesCompiler::compileRule(words,network["tags"],Utils::hexStrToU64(args[1].c_str()),entries,err)) {
+				fprintf(stderr,"invalid rule: %s" ZT_EOL_S,err.c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+
+			// New rules go before a trailing catch-all such as the default accept, where they can still match
+			unsigned long at = groups.size();
+			if ((!groups.empty())&&(groups.back().first == groups.back().second))
+				at = groups.size() - 1;
+			std::map<std::string,std::string>::const_iterator atOpt(longOpts.find("at"));
+			if (atOpt != longOpts.end()) {
+				uint64_t n = 0;
+				if ((!cliParseU32(atOpt->second,n))||(n == 0)||(n > (groups.size() + 1))) {
+					fprintf(stderr,"invalid --at %s: expected a position from 1 to %lu" ZT_EOL_S,atOpt->second.c_str(),(unsigned long)groups.size() + 1);
+					return ZT_CLI_EXIT_USAGE;
+				}
+				at = (unsigned long)n - 1;
+			}
+			const unsigned long pos = (at < groups.size()) ? groups[at].first : ((groups.empty()) ? 0 : (groups.back().second + 1));
+			rules.insert(rules.begin() + pos,entries.begin(),entries.end());
+		}
+
+		// Rules edited here no longer match any stored rules script
+		update["rules"] = rules;
+		update["rulesSource"] = "";
+		scode = cliRequest(addr,requestHeaders,"POST",networkPath,&update,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("rules",scode,responseBody);
+		if (network["rules"].size() != rules.size()) {
+			fprintf(stderr,"the controller kept %lu of %lu rule entries, check the rule with controller rules %s list" ZT_EOL_S,(unsigned long)network["rules"].size(),(unsigned long)rules.size(),args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		if (json)
+			printf("%s" ZT_EOL_S,cliJson(network["rules"]).c_str());
+		else cliOK("200 controller rules %s OK" ZT_EOL_S,op.c_str());
+		return 0;
+	}
+
+	nlohmann::json update;
+	if (op == "compile") {
+		// A rules script, compiled here as rule-compiler/cli.js would apart from macros
+		std::string source;
+		if (!cliReadInput(args[3],source)) {
+			fprintf(stderr,"unable to read %s" ZT_EOL_S,args[3].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+		if ((scode != 200)||(!network.is_object()))
+			return cliControllerError("rules",scode,responseBody);
+		nlohmann::json compiled;
+		std::string err;
+		if (!RulesCompiler::compile(source,network["tags"],Utils::hexStrToU64(args[1].c_str()),compiled,err)) {
+			fprintf(stderr,"%s: %s" ZT_EOL_S,(args[3] == "-") ? "<stdin>" : args[3].c_str(),err.c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+
+		// Tags the script doesn't define stay as they are, and those it does keep ranges set with tagdef
+		nlohmann::json tags(network["tags"]);
+		if (!tags.is_array())
+			tags = nlohmann::json::array();
+		nlohmann::json &defined = compiled["tags"];
+		for(unsigned long i=0;i<defined.size();++i) {
+			const uint64_t id = OSUtils::jsonInt(defined[i]["id"],0ULL);
+			bool found = false;
+			for(unsigned long j=0;j<tags.size();++j) {
+				if (OSUtils::jsonInt(tags[j]["id"],0ULL) == id) {
+					tags[j]["name"] = defined[i]["name"];
+					tags[j]["default"] = defined[i]["default"];
+					found = true;
+				} else if (OSUtils::jsonString(tags[j]["name"],"") == OSUtils::jsonString(defined[i]["name"],"")) {
+					tags[j].erase("name");
+				}
+			}
+			if (!found)
+				tags.push_back(defined[i]);
+		}
+		update["rules"] = compiled["rules"];
+		update["capabilities"] = compiled["capabilities"];
+		update["tags"] = tags;
+		update["rulesSource"] = source;
+		if (longOpts.find("dry-run") != longOpts.end()) {
+			printf("%s" ZT_EOL_S,cliJson(update).c_str());
+			return 0;
+		}
+	} else {
+		// The input is the output of rule-compiler/cli.js, or just its config object or rules array
+		std::string buf;
+		if (!cliReadInput(args[3],buf)) {
+			fprintf(stderr,"unable to read %s" ZT_EOL_S,args[3].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		nlohmann::json compiled;
+		try {
+			compiled = OSUtils::jsonParse(buf);
+		} catch ( ... ) {
+			fprintf(stderr,"%s is not valid JSON (apply rules scripts with controller rules %s compile)" ZT_EOL_S,args[3].c_str(),args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		nlohmann::json tagsByName,capabilitiesByName;
+		if ((compiled.is_object())&&(compiled["config"].is_object())) {
+			tagsByName = compiled["tagsByName"];
+			capabilitiesByName = compiled["capabilitiesByName"];
+			compiled = compiled["config"];
+		}
+		if (compiled.is_array()) {
+			update["rules"] = compiled;
+		} else if ((compiled.is_object())&&(compiled["rules"].is_array())) {
+			update["rules"] = compiled["rules"];
+			if (compiled["capabilities"].is_array()) {
+				// Name capabilities after the script's definitions
+				nlohmann::json &caps = update["capabilities"];
+				caps = compiled["capabilities"];
+				for(unsigned long i=0;((capabilitiesByName.is_object())&&(i<caps.size()));++i) {
+					for(nlohmann::json::iterator n(capabilitiesByName.begin());n!=capabilitiesByName.end();++n) {
+						if (OSUtils::jsonInt(n.value(),0ULL) == OSUtils::jsonInt(caps[i]["id"],0ULL))
+							caps[i]["name"] = n.key();
+					}
+				}
+			}
+			if (compiled["tags"].is_array()) {
+				// Name tags after the script's definitions, and keep names and ranges set with tagdef
+				nlohmann::json current;
+				scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,current);
+				if ((scode != 200)||(!current.is_object()))
+					return cliControllerError("rules",scode,responseBody);
+				nlohmann::json &tags = update["tags"];
+				tags = compiled["tags"];
+				for(unsigned long i=0;i<tags.size();++i) {
+					const std::string id(std::to_string((unsigned long long)OSUtils::jsonInt(tags[i]["id"],0ULL)));
+					const long c = cliFindDefinition(current["tags"],id);
+					if (c >= 0) {
+						nlohmann::json &ct = current["tags"][c];
+						if (ct.count("name")) tags[i]["name"] = ct["name"];
+						if (ct.count("min")) tags[i]["min"] = ct["min"];
+						if (ct.count("max")) tags[i]["max"] = ct["max"];
+					}
+					if (tagsByName.is_object()) {
+						for(nlohmann::json::iterator n(tagsByName.begin());n!=tagsByName.end();++n) {
+							if (OSUtils::jsonInt(n.value()["id"],0ULL) == OSUtils::jsonInt(tags[i]["id"],0ULL))
+								tags[i]["name"] = n.key();
+						}
+					}
+				}
+			}
+		} else {
+			fprintf(stderr,"%s does not contain a rules array" ZT_EOL_S,args[3].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		std::map<std::string,std::string>::const_iterator sourceOpt(longOpts.find("source"));
+		if (sourceOpt != longOpts.end()) {
+			std::string source;
+			if (!OSUtils::readFile(sourceOpt->second.c_str(),source)) {
+				fprintf(stderr,"unable to read %s" ZT_EOL_S,sourceOpt->second.c_str());
+				return ZT_CLI_EXIT_FAILED;
+			}
+			update["rulesSource"] = source;
+		} else {
+			update["rulesSource"] = "";
+		}
+	}
+
+	scode = cliRequest(addr,requestHeaders,"POST",networkPath,&update,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("rules",scode,responseBody);
+
+	// The controller silently drops rule entries it can't parse, so check that everything made it
+	const unsigned long sent = (unsigned long)update["rules"].size();
+	const unsigned long kept = (unsigned long)network["rules"].size();
+	if (json) {
+		nlohmann::json j;
+		j["rules"] = network["rules"];
+		j["capabilities"] = network["capabilities"];
+		j["tags"] = network["tags"];
+		printf("%s" ZT_EOL_S,cliJson(j).c_str());
+	} else {
+		printf("200 controller rules %lu rules, %lu capabilities, %lu tags" ZT_EOL_S,kept,(unsigned long)network["capabilities"].size(),(unsigned long)network["tags"].size());
+	}
+	if (kept != sent) {
+		fprintf(stderr,"warning: the controller rejected %lu of %lu rule entries" ZT_EOL_S,(kept < sent) ? (sent - kept) : 0UL,sent);
+		return ZT_CLI_EXIT_FAILED;
+	}
+	return 0;
+}
+
+// controller delete <network ID> [--yes] [--deauth-first]
+static int cliControllerDelete(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	if ((args.size() != 2)||(args[1].length() != 16)) {
+		fprintf(stderr,"invalid format: controller delete <network ID> [--yes] [--deauth-first]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string networkPath(std::string("/controller/network/") + args[1]);
+
+	nlohmann::json network;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",networkPath,(const nlohmann::json *)0,responseBody,network);
+	if (scode == 404) {
+		fprintf(stderr,"network %s does not exist on this controller" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_NOT_FOUND;
+	}
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("delete",scode,responseBody);
+	nlohmann::json members;
+	scode = cliRequest(addr,requestHeaders,"GET",networkPath + "/member",(const nlohmann::json *)0,responseBody,members);
+	if ((scode != 200)||(!members.is_object()))
+		return cliControllerError("delete",scode,responseBody);
+	const std::string name(OSUtils::jsonString(network["name"],""));
+
+	if (longOpts.find("yes") == longOpts.end()) {
+		fprintf(stderr,"Delete network %s (%s) and its %lu member(s)? This cannot be undone. [y/N] ",args[1].c_str(),(name.length() > 0) ? name.c_str() : "unnamed",(unsigned long)members.size());
+		fflush(stderr);
+		char answer[64];
+		if ((!fgets(answer,sizeof(answer),stdin))||((cliTrim(answer) != "y")&&(cliTrim(answer) != "yes"))) {
+			fprintf(stderr,"not deleted" ZT_EOL_S);
+			return ZT_CLI_EXIT_FAILED;
+		}
+	}
+
+	// Deauthorizing first makes the controller revoke members' credentials so they drop off
+	// right away, instead of keeping their last config after the network disappears.
+	unsigned long deauthorized = 0;
+	if ((longOpts.find("deauth-first") != longOpts.end())&&(members.size() > 0)) {
+		nlohmann::json addresses = nlohmann::json::array();
+		for(nlohmann::json::iterator m(members.begin());m!=members.end();++m)
+			addresses.push_back(m.key());
+		nlohmann::json results;
+		scode = cliRequest(addr,requestHeaders,"POST",networkPath + "/member/batch-deauthorize",&addresses,responseBody,results);
+		if ((scode != 200)||(!results.is_object()))
+			return cliControllerError("delete",scode,responseBody);
+		nlohmann::json &r = results["results"];
+		for(nlohmann::json::iterator i(r.begin());i!=r.end();++i) {
+			if (OSUtils::jsonBool(i.value()["success"],false))
+				++deauthorized;
+			else fprintf(stderr,"warning: unable to deauthorize %s: %s" ZT_EOL_S,i.key().c_str(),OSUtils::jsonString(i.value()["error"],"").c_str());
+		}
+	}
+
+	nlohmann::json deleted;
+	scode = cliRequest(addr,requestHeaders,"DELETE",networkPath,(const nlohmann::json *)0,responseBody,deleted);
+	if (scode != 200)
+		return cliControllerError("delete",scode,responseBody);
+
+	if (json) {
+		nlohmann::json j;
+		j["id"] = args[1];
+		j["name"] = name;
+		j["membersDeleted"] = members.size();
+		j["membersDeauthorized"] = deauthorized;
+		printf("%s" ZT_EOL_S,cliJson(j).c_str());
+	} else {
+		cliOK("200 controller delete %s OK, %lu member(s) deleted" ZT_EOL_S,args[1].c_str(),(unsigned long)members.size());
+	}
+	return 0;
+}
+
+// controller export <network ID> [<file>]
+static int cliControllerExport(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	if ((args.size() < 2)||(args.size() > 3)||(args[1].length() != 16)) {
+		fprintf(stderr,"invalid format: controller export <network ID> [file]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	nlohmann::json doc;
+	const unsigned int scode = cliRequest(addr,requestHeaders,"GET",std::string("/controller/network/") + args[1] + "/export",(const nlohmann::json *)0,responseBody,doc);
+	if ((scode != 200)||(!doc.is_object()))
+		return cliControllerError("export",scode,responseBody);
+	const std::string out(cliJson(doc) + ZT_EOL_S);
+	if (args.size() == 2) {
+		printf("%s",out.c_str());
+		return 0;
+	}
+	if (!OSUtils::writeFile(args[2].c_str(),out)) {
+		fprintf(stderr,"unable to write %s" ZT_EOL_S,args[2].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	cliOK("200 controller export %s OK, %lu member(s) written to %s" ZT_EOL_S,args[1].c_str(),(unsigned long)doc["members"].size(),args[2].c_str());
+	return 0;
+}
+
+// controller import <file|-> [--new-id]
+static int cliControllerImport(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json response;
+
+	if (args.size() != 2) {
+		fprintf(stderr,"invalid format: controller import <file|-> [--new-id]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	std::string buf;
+	if (!cliReadInput(args[1],buf)) {
+		fprintf(stderr,"unable to read %s" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	nlohmann::json doc;
+	try {
+		doc = OSUtils::jsonParse(buf);
+	} catch ( ... ) {}
+	if ((!doc.is_object())||(!doc["network"].is_object())) {
+		fprintf(stderr,"%s is not a network export (create one with controller export)" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+
+	// Keeping the ID only works on the controller whose address it starts with, the service checks this
+	std::string nwid(OSUtils::jsonString(doc["network"]["id"],""));
+	unsigned int scode;
+	if (longOpts.find("new-id") != longOpts.end()) {
+		scode = cliRequest(addr,requestHeaders,"GET","/status",(const nlohmann::json *)0,responseBody,response);
+		const std::string ownerAddress((scode == 200) ? OSUtils::jsonString(response["address"],"") : std::string());
+		if (ownerAddress.length() != 10)
+			return cliControllerError("import",scode,responseBody);
+		nwid = ownerAddress + "______";
+	} else if (nwid.length() != 16) {
+		fprintf(stderr,"%s has no network ID, use --new-id" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+
+	scode = cliRequest(addr,requestHeaders,"POST",std::string("/controller/network/") + nwid + "/import",&doc,responseBody,response);
+	if ((scode != 200)||(!response.is_object()))
+		return cliControllerError("import",scode,responseBody);
+	if (json)
+		printf("%s" ZT_EOL_S,cliJson(response).c_str());
+	else cliOK("200 controller import %s OK, %lu member(s)" ZT_EOL_S,OSUtils::jsonString(response["id"],"").c_str(),(unsigned long)OSUtils::jsonInt(response["memberCount"],0ULL));
+	cliPrintWarnings(response["warnings"]);
+	return 0;
+}
+
+// controller backup <file|->
+static int cliControllerBackup(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	if (args.size() != 2) {
+		fprintf(stderr,"invalid format: controller backup <file|->" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	nlohmann::json doc;
+	const unsigned int scode = cliRequest(addr,requestHeaders,"GET","/controller/backup",(const nlohmann::json *)0,responseBody,doc);
+	if ((scode != 200)||(!doc.is_object()))
+		return cliControllerError("backup",scode,responseBody);
+	const std::string out(OSUtils::jsonDump(doc,-1) + ZT_EOL_S);
+	if (args[1] == "-") {
+		fwrite(out.data(),1,out.length(),stdout);
+		return 0;
+	}
+
+	// Written beside the file and renamed over it so an interrupted backup never replaces a good one
+	const std::string tmpPath(args[1] + ".tmp");
+	if (!OSUtils::writeSecretFile(tmpPath.c_str(),out)) {
+		fprintf(stderr,"unable to write %s" ZT_EOL_S,tmpPath.c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	if (!OSUtils::rename(tmpPath.c_str(),args[1].c_str())) {
+		OSUtils::rm(tmpPath.c_str());
+		fprintf(stderr,"unable to write %s" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	cliOK("200 controller backup OK, %lu network(s) and %lu member(s) written to %s" ZT_EOL_S,(unsigned long)OSUtils::jsonInt(doc["networkCount"],0ULL),(unsigned long)OSUtils::jsonInt(doc["memberCount"],0ULL),args[1].c_str());
+	return 0;
+}
+
+// controller restore <file|-> [--force]
+static int cliControllerRestore(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+	nlohmann::json response;
+
+	if (args.size() != 2) {
+		fprintf(stderr,"invalid format: controller restore <file|-> [--force]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	std::string buf;
+	if (!cliReadInput(args[1],buf)) {
+		fprintf(stderr,"unable to read %s" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	if ((buf.length() >= 2)&&((unsigned char)buf[0] == 0x1f)&&((unsigned char)buf[1] == 0x8b)) {
+		fprintf(stderr,"%s is compressed; decompress it with gzip -d first" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	nlohmann::json doc;
+	try {
+		doc = OSUtils::jsonParse(buf);
+	} catch ( ... ) {}
+	if ((!doc.is_object())||(!doc["networks"].is_array())) {
+		fprintf(stderr,"%s is not a controller backup (create one with controller backup)" ZT_EOL_S,args[1].c_str());
+		return ZT_CLI_EXIT_FAILED;
+	}
+	const unsigned int scode = cliRequest(addr,requestHeaders,"POST",(longOpts.count("force")) ? "/controller/restore?force=1" : "/controller/restore",&doc,responseBody,response);
+	if ((scode != 200)||(!response.is_object()))
+		return cliControllerError("restore",scode,responseBody);
+	if (json)
+		printf("%s" ZT_EOL_S,cliJson(response).c_str());
+	else cliOK("200 controller restore OK, %lu network(s) (%lu replaced) and %lu member(s)" ZT_EOL_S,(unsigned long)OSUtils::jsonInt(response["networkCount"],0ULL),(unsigned long)OSUtils::jsonInt(response["replacedNetworkCount"],0ULL),(unsigned long)OSUtils::jsonInt(response["memberCount"],0ULL));
+	cliPrintWarnings(response["warnings"]);
+	return 0;
+}
+
+// controller webhook <network ID> list|add <url> [...]|remove <url>
+static int cliControllerWebhook(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	const bool list = ((args.size() == 2)||((args.size() == 3)&&(args[2] == "list")));
+	if ((args.size() < 2)||(args[1].length() != 16)||((!list)&&((args.size() != 4)||((args[2] != "add")&&(args[2] != "remove"))))) {
+		fprintf(stderr,"invalid format: controller webhook <network ID> list|add <url> [--secret=<secret>] [--max-attempts=<n>] [--retry-delay=<duration>]|remove <url>" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	return cliControllerManageWebhooks("webhook",args[1],(list) ? std::string() : args[2],(list) ? std::string() : args[3],longOpts,json,addr,requestHeaders);
+}
+
+// controller set <network ID> [<setting>] [<value>]
+static int cliControllerSet(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	std::string responseBody;
+
+	if ((args.size() < 2)||(args[1].length() != 16)) {
+		fprintf(stderr,"invalid format: must be a 16-digit (network) ID" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	const std::string path(std::string("/controller/network/") + args[1]);
+	if ((args.size() >= 3)&&(args[2] == "tagdef"))
+		return cliControllerTagDef("set tagdef",args,longOpts,json,addr,requestHeaders);
+	if ((args.size() >= 3)&&(args[2] == "webhook")) {
+		if ((args.size() == 3)||(args.size() == 4))
+			return cliControllerManageWebhooks("set",args[1],(args.size() == 4) ? "add" : "",(args.size() == 4) ? args[3] : std::string(),longOpts,json,addr,requestHeaders);
+		if ((args.size() == 5)&&(args[4] == "remove"))
+			return cliControllerManageWebhooks("set",args[1],"remove",args[3],longOpts,json,addr,requestHeaders);
+		fprintf(stderr,"invalid format: controller set <network ID> webhook [<url> [--secret=<secret>] | <url> remove]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	if ((args.size() >= 3)&&(args[2] == "authhook"))
+		return cliControllerAuthHook(args,longOpts,json,addr,requestHeaders);
+
+	const CliControllerSetting *cs = (const CliControllerSetting *)0;
+	if (args.size() >= 3) {
+		for(const CliControllerSetting *s=CLI_CONTROLLER_SETTINGS;s->name;++s) {
+			if (args[2] == s->name) {
+				cs = s;
+				break;
+			}
+		}
+		if (!cs) {
+			fprintf(stderr,"unknown setting %s, valid settings are:",args[2].c_str());
+			for(const CliControllerSetting *s=CLI_CONTROLLER_SETTINGS;s->name;++s)
+				fprintf(stderr," %s",s->name);
+			fprintf(stderr,ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+	}
+
+	// Validate new value before touching the controller
+	nlohmann::json value;
+	if ((cs)&&(args.size() >= 4)) {
+		const std::string &vs = args[3];
+		if (cs->type == 'b') {
+			bool b = false;
+			if (!cliParseBool(vs,b)) {
+				fprintf(stderr,"invalid value for %s: expected true or false" ZT_EOL_S,cs->name);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			value = (b != cs->invert);
+		} else if (cs->type == 'i') {
+			if ((vs.empty())||(vs.find_first_not_of("0123456789") != std::string::npos)||(vs.length() > 9)) {
+				fprintf(stderr,"invalid value for %s: expected a non-negative integer" ZT_EOL_S,cs->name);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			const unsigned long long n = strtoull(vs.c_str(),(char **)0,10);
+			if ((!strcmp(cs->name,"mtu"))&&((n < ZT_MIN_MTU)||(n > ZT_MAX_MTU))) {
+				fprintf(stderr,"invalid value for mtu: must be between %d and %d" ZT_EOL_S,ZT_MIN_MTU,ZT_MAX_MTU);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			value = (uint64_t)n;
+		} else {
+			value = vs;
+		}
+	}
+
+	nlohmann::json network;
+	unsigned int scode = cliRequest(addr,requestHeaders,"GET",path,(const nlohmann::json *)0,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("set",scode,responseBody);
 
-#include "version.h"
-#include "include/ZeroTierOne.h"
+	if (!cs) {
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson(network).c_str());
+		} else {
+			for(const CliControllerSetting *s=CLI_CONTROLLER_SETTINGS;s->name;++s) {
+				const nlohmann::json v(cliControllerSettingValue(s,network));
+				printf("%-22s %s" ZT_EOL_S,s->name,(v.is_string()) ? v.get<std::string>().c_str() : OSUtils::jsonDump(v,-1).c_str());
+			}
+			printf("%-22s %s" ZT_EOL_S,"dns",cliDnsSummary(network["dns"]).c_str());
+		}
+		return 0;
+	}
 
-#include "node/Identity.hpp"
-#include "node/CertificateOfMembership.hpp"
-#include "node/Utils.hpp"
-#include "node/NetworkController.hpp"
-#include "node/Buffer.hpp"
-#include "node/World.hpp"
+	if (value.is_null()) {
+		const nlohmann::json v(cliControllerSettingValue(cs,network));
+		if ((json)||(!v.is_string()))
+			printf("%s" ZT_EOL_S,OSUtils::jsonDump(v,-1).c_str());
+		else printf("%s" ZT_EOL_S,v.get<std::string>().c_str());
+		return 0;
+	}
 
-#include "osdep/OSUtils.hpp"
-#include "osdep/Http.hpp"
-#include "osdep/Thread.hpp"
+	// Assign mode objects are replaced whole by the controller, so send every field back
+	nlohmann::json update;
+	if (cs->object) {
+		update[cs->object] = network[cs->object];
+		if (!update[cs->object].is_object())
+			update[cs->object] = nlohmann::json::object();
+		update[cs->object][cs->field] = value;
+	} else {
+		update[cs->field] = value;
+	}
 
-#include "node/BondController.hpp"
+	scode = cliRequest(addr,requestHeaders,"POST",path,&update,responseBody,network);
+	if ((scode != 200)||(!network.is_object()))
+		return cliControllerError("set",scode,responseBody);
+	if (json)
+		printf("%s" ZT_EOL_S,cliJson(network).c_str());
+	else cliOK("200 controller set OK" ZT_EOL_S);
+	return 0;
+}
 
-#include "service/OneService.hpp"
+// Run the controller subcommand named by args[0] using its entry in CLI_CONTROLLER_COMMANDS
+static int cliController(const char *pn,const std::string &homeDir,const std::vector<std::string> &args,const std::map<std::string,std::string> &longOpts,bool json,const InetAddress &addr,const std::map<std::string,std::string> &requestHeaders)
+{
+	if (!args.empty()) {
+		// controller rule is the older spelling of controller rules
+		const std::string cmd((args[0] == "rule") ? std::string("rules") : args[0]);
+		for(const CliCommand *c=CLI_CONTROLLER_COMMANDS;c->usage;++c) {
+			const std::vector<std::string> w(OSUtils::split(c->usage," \n","",""));
+			if (w.size() < 2)
+				continue;
+			const std::vector<std::string> names(OSUtils::split(w[1].c_str(),"|","",""));
+			if (std::find(names.begin(),names.end(),cmd) != names.end())
+				return c->handler(pn,homeDir,args,longOpts,json,addr,requestHeaders);
+		}
+	}
+	cliPrintHelp(pn,stderr);
+	return ZT_CLI_EXIT_USAGE;
+}
 
-#include "ext/json/json.hpp"
+// Find the service's port and auth token in the home path unless given, returning 0 or an exit code
+// and printing why not unless quiet
+static int cliFindService(const char *pn,const std::string &homeDir,unsigned int &port,std::string &authToken,const bool quiet)
+{
+	if ((port)&&(authToken.length()))
+		return 0;
+	if (!homeDir.length()) {
+		if (!quiet)
+			fprintf(stderr,"%s: missing port or authentication token and no home directory specified to auto-detect" ZT_EOL_S,pn);
+		return ZT_CLI_EXIT_USAGE;
+	}
+
+	if (!port) {
+		std::string portStr;
+		OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S + "zerotier-one.port").c_str(),portStr);
+		port = Utils::strToUInt(portStr.c_str());
+		if ((port == 0)||(port > 0xffff)) {
+			if (!quiet)
+				fprintf(stderr,"%s: missing port and zerotier-one.port not found in %s" ZT_EOL_S,pn,homeDir.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
+		}
+	}
 
+	if (!authToken.length()) {
+		OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S + "authtoken.secret").c_str(),authToken);
+#ifdef __UNIX_LIKE__
+		if (!authToken.length()) {
+			const char *hd = getenv("HOME");
+			if (hd) {
+				char p[4096];
 #ifdef __APPLE__
-#include <SystemConfiguration/SystemConfiguration.h>
-#include <CoreServices/CoreServices.h>
-#include <sys/types.h>
-#include <sys/socket.h>
-#include <ifaddrs.h>
+				OSUtils::ztsnprintf(p,sizeof(p),"%s/Library/Application Support/ZeroTier/One/authtoken.secret",hd);
+#else
+				OSUtils::ztsnprintf(p,sizeof(p),"%s/.zeroTierOneAuthToken",hd);
 #endif
+				OSUtils::readFile(p,authToken);
+			}
+		}
+#endif
+		if (!authToken.length()) {
+			if (!quiet)
+				fprintf(stderr,"%s: missing authentication token and authtoken.secret not found (or readable) in %s" ZT_EOL_S,pn,homeDir.c_str());
+			return ZT_CLI_EXIT_UNAUTHORIZED;
+		}
+	}
+	return 0;
+}
 
-#define ZT_PID_PATH "zerotier-one.pid"
+// One argument position of a usage from help, as far as completion is concerned
+struct CliCompletionItem
+{
+	std::vector<std::string> words; // literal words allowed here
+	std::string placeholder; // or the <argument> that is, if any
+};
 
-using namespace ZeroTier;
+// Split a usage at a separator outside of <> and [], dropping empty pieces
+static std::vector<std::string> cliSplitUsage(const std::string &s,const char sep)
+{
+	std::vector<std::string> r;
+	std::string t;
+	int depth = 0;
+	for(std::string::const_iterator c(s.begin());c!=s.end();++c) {
+		if ((*c == '<')||(*c == '['))
+			++depth;
+		else if (((*c == '>')||(*c == ']'))&&(depth > 0))
+			--depth;
+		if ((depth == 0)&&((*c == sep)||((sep == ' ')&&(*c == '\n')))) {
+			if (!cliTrim(t).empty())
+				r.push_back(cliTrim(t));
+			t.clear();
+		} else {
+			t.push_back(*c);
+		}
+	}
+	if (!cliTrim(t).empty())
+		r.push_back(cliTrim(t));
+	return r;
+}
 
-static OneService *volatile zt1Service = (OneService *)0;
+// Add one word of a usage to a position: a literal, an <argument>, or an optional [group]
+// completed from the first word of each of its alternatives. Switches are not positions.
+static void cliUsageWord(const std::string &w,CliCompletionItem &item)
+{
+	if (w[0] == '[') {
+		std::vector<std::string> alts(cliSplitUsage(w.substr(1,w.length() - 2),'|'));
+		for(std::vector<std::string>::const_iterator a(alts.begin());a!=alts.end();++a) {
+			std::vector<std::string> first(cliSplitUsage(*a,' '));
+			if ((!first.empty())&&(first[0][0] != '['))
+				cliUsageWord(first[0],item);
+		}
+	} else if (w[0] == '<') {
+		if (item.placeholder.empty())
+			item.placeholder = w;
+	} else if (w[0] != '-') {
+		item.words.push_back(w);
+	}
+}
 
-#define PROGRAM_NAME "ZeroTier One"
-#define COPYRIGHT_NOTICE "Copyright (c) 2020 ZeroTier, Inc."
-#define LICENSE_GRANT "Licensed under the ZeroTier BSL 1.1 (see LICENSE.txt)"
+// The ways a usage from help can be typed, one position per argument. A word after | that
+// follows an argument, as in "list|add <x>|remove <y>", is another choice for the last
+// literal position rather than the next position.
+static void cliUsageSequences(const std::string &usage,std::vector< std::vector<CliCompletionItem> > &sequences)
+{
+	std::vector<CliCompletionItem> seq;
+	long sub = -1;
+
+	// A usage wrapped in the help text carries on after the line break, as in "list|add <x>\n|remove <y>"
+	std::string u(usage);
+	for(std::size_t nl=u.find("\n|");nl!=std::string::npos;nl=u.find("\n|",nl))
+		u.erase(nl,1);
+	const std::vector<std::string> tokens(cliSplitUsage(u,' '));
+	for(std::vector<std::string>::const_iterator t(tokens.begin());t!=tokens.end();++t) {
+		const std::vector<std::string> parts(cliSplitUsage(*t,'|'));
+		if (parts.empty())
+			continue;
+		CliCompletionItem item;
+		if ((parts[0][0] != '<')&&(parts[0][0] != '[')&&(parts[0][0] != '-')) {
+			for(std::vector<std::string>::const_iterator p(parts.begin());p!=parts.end();++p)
+				cliUsageWord(*p,item);
+			sub = (long)seq.size();
+			seq.push_back(item);
+			continue;
+		}
+		cliUsageWord(parts[0],item);
+		if ((!item.words.empty())||(!item.placeholder.empty()))
+			seq.push_back(item);
+		for(unsigned long i=1;i<parts.size();++i) {
+			if ((sub < 0)||(parts[i][0] == '<')||(parts[i][0] == '[')||(parts[i][0] == '-'))
+				continue;
+			sequences.push_back(seq);
+			seq.resize((unsigned long)sub);
+			CliCompletionItem alt;
+			alt.words.push_back(parts[i]);
+			seq.push_back(alt);
+		}
+	}
+	sequences.push_back(seq);
+}
 
-/****************************************************************************/
-/* zerotier-cli personality                                                 */
-/****************************************************************************/
+// __complete <word> ... <current word>, called by the scripts from "completion" to list what
+// could come next. Network IDs and addresses are looked up from the service if it answers,
+// using any -D, -p, -T, or -H switches on the line being completed.
+static int cliComplete(int argc,char **argv)
+{
+	const std::string cur((argc > 2) ? argv[argc - 1] : "");
+	if (cur.find('=') != std::string::npos)
+		return 0; // no values for --switch=, which lets the shell complete file names
+	std::vector<std::string> typed;
+	std::set<std::string> given;
+	std::string homeDir,ip("127.0.0.1"),authToken;
+	unsigned int port = 0;
+	for(int i=2;i<(argc - 1);++i) {
+		const std::string w(argv[i]);
+		if ((w.length() < 2)||(w[0] != '-'))
+			typed.push_back(w);
+		else if (w[1] == '-')
+			given.insert(w.substr(0,w.find('=')));
+		else if ((w[1] == 'D')&&(w.length() > 2))
+			homeDir = w.substr(2);
+		else if ((w[1] == 'p')&&(w.length() > 2))
+			port = Utils::strToUInt(w.c_str() + 2);
+		else if ((w[1] == 'T')&&(w.length() > 2))
+			authToken = w.substr(2);
+		else if ((w[1] == 'H')&&(w.length() > 2))
+			ip = w.substr(2);
+	}
 
-// This is getting deprecated soon in favor of the stuff in cli/
+	std::set<std::string> candidates;
+	std::set<std::string> lookups;
+	const bool controller = ((!typed.empty())&&(typed[0] == "controller"));
+	if ((cur.length() > 1)&&(cur[0] == '-')&&(cur[1] == '-')) {
+		candidates.insert("--compact");
+		candidates.insert("--color=always");
+		candidates.insert("--color=never");
+		candidates.insert("--color=auto");
+		candidates.insert("--encoding=hex");
+		candidates.insert("--encoding=base32");
+	}
+	static const CliCommand *const tables[2] = { CLI_COMMANDS,CLI_CONTROLLER_COMMANDS };
+	for(int tn=0;tn<2;++tn) {
+		for(const CliCommand *c=tables[tn];c->usage;++c) {
+			std::vector< std::vector<CliCompletionItem> > sequences;
+			cliUsageSequences(c->usage,sequences);
+			for(std::vector< std::vector<CliCompletionItem> >::const_iterator seq(sequences.begin());seq!=sequences.end();++seq) {
+				bool matches = true;
+				long lastLiteral = -1;
+				for(unsigned long i=0;i<seq->size();++i) {
+					if ((*seq)[i].placeholder.empty())
+						lastLiteral = (long)i;
+					if ((i < typed.size())&&((*seq)[i].placeholder.empty())&&(std::find((*seq)[i].words.begin(),(*seq)[i].words.end(),typed[i]) == (*seq)[i].words.end()))
+						matches = false;
+				}
+				if (!matches)
+					continue;
 
-static void cliPrintHelp(const char *pn,FILE *out)
+				if ((!cur.empty())&&(cur[0] == '-')) {
+					// Switches of every usage whose command words have all been typed
+					if ((long)typed.size() <= lastLiteral)
+						continue;
+					const std::string u(c->usage);
+					for(std::size_t f=u.find("--");f!=std::string::npos;f=u.find("--",f + 2)) {
+						const std::size_t e = u.find_first_not_of("abcdefghijklmnopqrstuvwxyz0123456789-",f + 2);
+						const std::string name(u.substr(f,e - f));
+						if ((name.length() > 2)&&(!given.count(name)))
+							candidates.insert(((e != std::string::npos)&&(u[e] == '=')) ? (name + "=") : name);
+					}
+				} else if (typed.size() < seq->size()) {
+					const CliCompletionItem &item = (*seq)[typed.size()];
+					candidates.insert(item.words.begin(),item.words.end());
+					if (item.placeholder == "<network ID>")
+						lookups.insert((controller) ? "controller networks" : "networks");
+					else if (((item.placeholder == "<address>")||(item.placeholder == "<address|name>"))&&((!controller)||(typed.size() >= 3)))
+						lookups.insert((controller) ? "members" : "peers");
+					else if ((item.placeholder == "<setting>")&&(controller))
+						lookups.insert("settings");
+				}
+			}
+		}
+	}
+
+	if (lookups.count("settings")) {
+		for(const CliControllerSetting *s=CLI_CONTROLLER_SETTINGS;s->name;++s)
+			candidates.insert(s->name);
+		lookups.erase("settings");
+	}
+	if ((!lookups.empty())&&(cliFindService(argv[0],(homeDir.length()) ? homeDir : OneService::platformDefaultHomePath(),port,authToken,true) == 0)) {
+		InetAddress addr;
+		char addrtmp[256];
+		OSUtils::ztsnprintf(addrtmp,sizeof(addrtmp),"%s/%u",ip.c_str(),port);
+		addr = InetAddress(addrtmp);
+		std::map<std::string,std::string> requestHeaders;
+		requestHeaders["X-ZT1-Auth"] = authToken;
+		std::string responseBody;
+		nlohmann::json r;
+		if ((lookups.count("networks"))&&(cliRequest(addr,requestHeaders,"GET","/network",(const nlohmann::json *)0,responseBody,r) == 200)) {
+			for(unsigned long i=0;i<r.size();++i)
+				candidates.insert(OSUtils::jsonString(r[i]["nwid"],""));
+		}
+		if ((lookups.count("controller networks"))&&(cliRequest(addr,requestHeaders,"GET","/controller/network",(const nlohmann::json *)0,responseBody,r) == 200)) {
+			for(unsigned long i=0;i<r.size();++i)
+				candidates.insert(OSUtils::jsonString(r[i],""));
+		}
+		if ((lookups.count("peers"))&&(cliRequest(addr,requestHeaders,"GET","/peer",(const nlohmann::json *)0,responseBody,r) == 200)) {
+			for(unsigned long i=0;i<r.size();++i)
+				candidates.insert(OSUtils::jsonString(r[i]["address"],""));
+		}
+		if ((lookups.count("members"))&&(typed[2].length() == 16)&&(typed[2].find_first_not_of("0123456789abcdef") == std::string::npos)&&(cliRequest(addr,requestHeaders,"GET",std::string("/controller/network/") + typed[2] + "/member",(const nlohmann::json *)0,responseBody,r) == 200)&&(r.is_object())) {
+			for(nlohmann::json::iterator m(r.begin());m!=r.end();++m)
+				candidates.insert(m.key());
+		}
+	}
+
+	for(std::set<std::string>::const_iterator c(candidates.begin());c!=candidates.end();++c) {
+		if ((!c->empty())&&(c->compare(0,cur.length(),cur) == 0))
+			printf("%s" ZT_EOL_S,c->c_str());
+	}
+	return 0;
+}
+
+// completion bash|zsh|fish
+static int cliCompletion(const std::vector<std::string> &args)
 {
-	fprintf(out,
-		"%s version %d.%d.%d build %d (platform %d arch %d)" ZT_EOL_S,
-		PROGRAM_NAME,
-		ZEROTIER_ONE_VERSION_MAJOR, ZEROTIER_ONE_VERSION_MINOR, ZEROTIER_ONE_VERSION_REVISION, ZEROTIER_ONE_VERSION_BUILD,
-		ZT_BUILD_PLATFORM, ZT_BUILD_ARCHITECTURE);
-	fprintf(out,
-		COPYRIGHT_NOTICE ZT_EOL_S
-		LICENSE_GRANT ZT_EOL_S);
-	fprintf(out,"Usage: %s [-switches] <command/path> [<args>]" ZT_EOL_S"" ZT_EOL_S,pn);
-	fprintf(out,"Available switches:" ZT_EOL_S);
-	fprintf(out,"  -h                      - Display this help" ZT_EOL_S);
-	fprintf(out,"  -v                      - Show version" ZT_EOL_S);
-	fprintf(out,"  -j                      - Display full raw JSON output" ZT_EOL_S);
-	fprintf(out,"  -D<path>                - ZeroTier home path for parameter auto-detect" ZT_EOL_S);
-	fprintf(out,"  -p<port>                - HTTP port (default: auto)" ZT_EOL_S);
-	fprintf(out,"  -T<token>               - Authentication token (default: auto)" ZT_EOL_S);
-	fprintf(out,ZT_EOL_S"Available commands:" ZT_EOL_S);
-	fprintf(out,"  info                    - Display status info" ZT_EOL_S);
-	fprintf(out,"  listpeers               - List all peers" ZT_EOL_S);
-	fprintf(out,"  peers                   - List all peers (prettier)" ZT_EOL_S);
-	fprintf(out,"  listnetworks            - List all networks" ZT_EOL_S);
-	fprintf(out,"  join <network ID>          - Join a network" ZT_EOL_S);
-	fprintf(out,"  leave <network ID>         - Leave a network" ZT_EOL_S);
-	fprintf(out,"  set <network ID> <setting> - Set a network setting" ZT_EOL_S);
-	fprintf(out,"  get <network ID> <setting> - Get a network setting" ZT_EOL_S);
-	fprintf(out,"  listmoons               - List moons (federated root sets)" ZT_EOL_S);
-	fprintf(out,"  orbit <world ID> <seed> - Join a moon via any member root" ZT_EOL_S);
-	fprintf(out,"  deorbit <world ID>      - Leave a moon" ZT_EOL_S);
-	fprintf(out,"  dump                    - Debug settings dump for support" ZT_EOL_S);
-	fprintf(out,ZT_EOL_S"Available settings:" ZT_EOL_S);
-	fprintf(out,"  Settings to use with [get/set] may include property names from " ZT_EOL_S);
-	fprintf(out,"  the JSON output of \"zerotier-cli -j listnetworks\". Additionally, " ZT_EOL_S);
-	fprintf(out,"  (ip, ip4, ip6, ip6plane, and ip6prefix can be used). For instance:" ZT_EOL_S);
-	fprintf(out,"  zerotier-cli get <network ID> ip6plane will return the 6PLANE address" ZT_EOL_S);
-	fprintf(out,"  assigned to this node." ZT_EOL_S);
+	if ((args.size() == 1)&&(args[0] == "bash")) {
+		printf(
+			"# bash completion for zerotier-cli, from \"zerotier-cli completion bash\"" ZT_EOL_S
+			"# Save it in /etc/bash_completion.d, or source it from ~/.bashrc." ZT_EOL_S
+			"_zerotier_cli()" ZT_EOL_S
+			"{" ZT_EOL_S
+			"\tlocal line=\"${COMP_LINE:0:COMP_POINT}\"" ZT_EOL_S
+			"\tlocal -a words" ZT_EOL_S
+			"\tread -ra words <<< \"$line\"" ZT_EOL_S
+			"\t[[ \"$line\" == *[[:space:]] ]] && words+=(\"\")" ZT_EOL_S
+			"\tlocal IFS=$'\\n'" ZT_EOL_S
+			"\tCOMPREPLY=($(\"${words[0]}\" __complete \"${words[@]:1}\" 2>/dev/null))" ZT_EOL_S
+			"\t[[ ${#COMPREPLY[@]} -eq 1 && \"${COMPREPLY[0]}\" == *= ]] && compopt -o nospace" ZT_EOL_S
+			"}" ZT_EOL_S
+			"complete -o default -F _zerotier_cli zerotier-cli" ZT_EOL_S);
+		return 0;
+	} else if ((args.size() == 1)&&(args[0] == "zsh")) {
+		printf(
+			"#compdef zerotier-cli" ZT_EOL_S
+			"# zsh completion for zerotier-cli, from \"zerotier-cli completion zsh\"" ZT_EOL_S
+			"# Save it as _zerotier-cli in a directory in $fpath, or source it from ~/.zshrc." ZT_EOL_S
+			"_zerotier-cli()" ZT_EOL_S
+			"{" ZT_EOL_S
+			"\tlocal -a candidates" ZT_EOL_S
+			"\tcandidates=(${(f)\"$(\"${words[1]}\" __complete \"${(@)words[2,CURRENT]}\" 2>/dev/null)\"})" ZT_EOL_S
+			"\tif (( ${#candidates} == 0 )); then" ZT_EOL_S
+			"\t\t_files" ZT_EOL_S
+			"\t\treturn" ZT_EOL_S
+			"\tfi" ZT_EOL_S
+			"\tcompadd -S '' -- ${(M)candidates:#*=}" ZT_EOL_S
+			"\tcompadd -- ${candidates:#*=}" ZT_EOL_S
+			"}" ZT_EOL_S
+			"if [[ \"${funcstack[1]}\" == _zerotier-cli ]]; then" ZT_EOL_S
+			"\t_zerotier-cli \"$@\"" ZT_EOL_S
+			"else" ZT_EOL_S
+			"\tcompdef _zerotier-cli zerotier-cli" ZT_EOL_S
+			"fi" ZT_EOL_S);
+		return 0;
+	} else if ((args.size() == 1)&&(args[0] == "fish")) {
+		printf(
+			"# fish completion for zerotier-cli, from \"zerotier-cli completion fish\"" ZT_EOL_S
+			"# Save it as ~/.config/fish/completions/zerotier-cli.fish." ZT_EOL_S
+			"function __zerotier_cli_complete" ZT_EOL_S
+			"\tset -l words (commandline -opc) (commandline -ct)" ZT_EOL_S
+			"\tset -l candidates ($words[1] __complete $words[2..-1] 2>/dev/null)" ZT_EOL_S
+			"\ttest (count $candidates) -gt 0; or return 1" ZT_EOL_S
+			"\tprintf '%%s\\n' $candidates" ZT_EOL_S
+			"end" ZT_EOL_S
+			"complete -c zerotier-cli -f -a '(__zerotier_cli_complete)'" ZT_EOL_S
+			"complete -c zerotier-cli -F -n 'not __zerotier_cli_complete >/dev/null'" ZT_EOL_S);
+		return 0;
+	}
+	fprintf(stderr,"invalid format: completion bash|zsh|fish" ZT_EOL_S);
+	return ZT_CLI_EXIT_USAGE;
 }
 
-static std::string cliFixJsonCRs(const std::string &s)
+// help [exitcodes]
+static int cliHelp(const char *pn,const std::vector<std::string> &args)
 {
-	std::string r;
-	for(std::string::const_iterator c(s.begin());c!=s.end();++c) {
-		if (*c == '\n')
-			r.append(ZT_EOL_S);
-		else r.push_back(*c);
+	if (args.empty()) {
+		cliPrintHelp(pn,stdout);
+		return 0;
 	}
-	return r;
+	if ((args.size() != 1)||(args[0] != "exitcodes")) {
+		fprintf(stderr,"invalid format: help [exitcodes]" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	printf("%d  success" ZT_EOL_S,0);
+	printf("%d  usage error: bad arguments or options" ZT_EOL_S,ZT_CLI_EXIT_USAGE);
+	printf("%d  service unreachable: not running, or no port file in the home directory" ZT_EOL_S,ZT_CLI_EXIT_UNREACHABLE);
+	printf("%d  unauthorized: no auth token, or the service refused it" ZT_EOL_S,ZT_CLI_EXIT_UNAUTHORIZED);
+	printf("%d  not found: no such network, member, peer, or other object" ZT_EOL_S,ZT_CLI_EXIT_NOT_FOUND);
+	printf("%d  operation failed: anything else" ZT_EOL_S,ZT_CLI_EXIT_FAILED);
+	return 0;
 }
 
 #ifdef __WINDOWS__
@@ -170,25 +5089,38 @@ static int cli(int argc, _TCHAR* argv[])
 static int cli(int argc,char **argv)
 #endif
 {
+	// Completion runs on every tab press and must not print errors or need switches of its own
+	if ((argc > 1)&&(strcmp(argv[1],"__complete") == 0))
+		return cliComplete(argc,argv);
+
 	unsigned int port = 0;
 	std::string homeDir,command,arg1,arg2,authToken;
 	std::string ip("127.0.0.1");
+	std::map<std::string,std::string> longOpts;
+	std::vector<std::string> args;
 	bool json = false;
 	for(int i=1;i<argc;++i) {
-		if (argv[i][0] == '-') {
+		if ((argv[i][0] == '-')&&(argv[i][1] == '-')&&(argv[i][2])) {
+			// Long options take the form --name or --name=value
+			const char *eq = strchr(argv[i] + 2,'=');
+			if (eq)
+				longOpts[std::string(argv[i] + 2,eq - (argv[i] + 2))] = eq + 1;
+			else longOpts[argv[i] + 2] = "";
+		} else if ((argv[i][0] == '-')&&(argv[i][1])) { // a lone - is an argument meaning standard input
 			switch(argv[i][1]) {
 
-				case 'q': // ignore -q used to invoke this personality
+				case 'q':
 					if (argv[i][2]) {
 						cliPrintHelp(argv[0],stdout);
-						return 1;
+						return ZT_CLI_EXIT_USAGE;
 					}
+					cliQuiet = true;
 					break;
 
 				case 'j':
 					if (argv[i][2]) {
 						cliPrintHelp(argv[0],stdout);
-						return 1;
+						return ZT_CLI_EXIT_USAGE;
 					}
 					json = true;
 					break;
@@ -197,7 +5129,7 @@ static int cli(int argc,char **argv)
 					port = Utils::strToUInt(argv[i] + 2);
 					if ((port > 0xffff)||(port == 0)) {
 						cliPrintHelp(argv[0],stdout);
-						return 1;
+						return ZT_CLI_EXIT_USAGE;
 					}
 					break;
 
@@ -206,7 +5138,7 @@ static int cli(int argc,char **argv)
 						homeDir = argv[i] + 2;
 					} else {
 						cliPrintHelp(argv[0],stdout);
-						return 1;
+						return ZT_CLI_EXIT_USAGE;
 					}
 					break;
 
@@ -215,7 +5147,7 @@ static int cli(int argc,char **argv)
 						ip = argv[i] + 2;
 					} else {
 						cliPrintHelp(argv[0],stdout);
-						return 1;
+						return ZT_CLI_EXIT_USAGE;
 					}
 					break;
 
@@ -224,25 +5156,30 @@ static int cli(int argc,char **argv)
 						authToken = argv[i] + 2;
 					} else {
 						cliPrintHelp(argv[0],stdout);
-						return 1;
+						return ZT_CLI_EXIT_USAGE;
 					}
 					break;
 
 				case 'v':
 					if (argv[i][2]) {
 						cliPrintHelp(argv[0],stdout);
-						return 1;
+						return ZT_CLI_EXIT_USAGE;
 					}
 					printf("%d.%d.%d" ZT_EOL_S,ZEROTIER_ONE_VERSION_MAJOR,ZEROTIER_ONE_VERSION_MINOR,ZEROTIER_ONE_VERSION_REVISION);
 					return 0;
 
 				case 'h':
 				case '?':
-				default:
 					cliPrintHelp(argv[0],stdout);
 					return 0;
+
+				default:
+					cliPrintHelp(argv[0],stdout);
+					return ZT_CLI_EXIT_USAGE;
 			}
 		} else {
+			if (command.length())
+				args.push_back(argv[i]);
 			if (arg1.length())
 				arg2 = argv[i];
 			else if (command.length())
@@ -250,48 +5187,34 @@ static int cli(int argc,char **argv)
 			else command = argv[i];
 		}
 	}
+	if (longOpts.find("compact") != longOpts.end())
+		cliJsonIndent = -1;
+	std::map<std::string,std::string>::const_iterator color(longOpts.find("color"));
+	if ((color == longOpts.end())||(color->second == "auto")) {
+		const char *noColor = getenv("NO_COLOR");
+		unsigned int cols = 0,rows = 0;
+		cliColor = (((!noColor)||(!*noColor))&&(cliTerminalSize(cols,rows)));
+	} else if (color->second == "always") {
+		cliColor = true;
+	} else if (color->second != "never") {
+		fprintf(stderr,"invalid --color: expected always, never, or auto" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
+	std::map<std::string,std::string>::const_iterator encoding(longOpts.find("encoding"));
+	if ((encoding != longOpts.end())&&(!cliParseEncoding(encoding->second,cliEncoding))) {
+		fprintf(stderr,"invalid --encoding: expected hex or base32" ZT_EOL_S);
+		return ZT_CLI_EXIT_USAGE;
+	}
 	if (!homeDir.length())
 		homeDir = OneService::platformDefaultHomePath();
 
-	// TODO: cleanup this logic
-	if ((!port)||(!authToken.length())) {
-		if (!homeDir.length()) {
-			fprintf(stderr,"%s: missing port or authentication token and no home directory specified to auto-detect" ZT_EOL_S,argv[0]);
-			return 2;
-		}
-
-		if (!port) {
-			std::string portStr;
-			OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S + "zerotier-one.port").c_str(),portStr);
-			port = Utils::strToUInt(portStr.c_str());
-			if ((port == 0)||(port > 0xffff)) {
-				fprintf(stderr,"%s: missing port and zerotier-one.port not found in %s" ZT_EOL_S,argv[0],homeDir.c_str());
-				return 2;
-			}
-		}
-
-		if (!authToken.length()) {
-			OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S + "authtoken.secret").c_str(),authToken);
-#ifdef __UNIX_LIKE__
-			if (!authToken.length()) {
-				const char *hd = getenv("HOME");
-				if (hd) {
-					char p[4096];
-#ifdef __APPLE__
-					OSUtils::ztsnprintf(p,sizeof(p),"%s/Library/Application Support/ZeroTier/One/authtoken.secret",hd);
-#else
-					OSUtils::ztsnprintf(p,sizeof(p),"%s/.zeroTierOneAuthToken",hd);
-#endif
-					OSUtils::readFile(p,authToken);
-				}
-			}
-#endif
-			if (!authToken.length()) {
-				fprintf(stderr,"%s: missing authentication token and authtoken.secret not found (or readable) in %s" ZT_EOL_S,argv[0],homeDir.c_str());
-				return 2;
-			}
-		}
-	}
+	if (command == "completion")
+		return cliCompletion(args);
+	if (command == "help")
+		return cliHelp(argv[0],args);
+	const int found = cliFindService(argv[0],homeDir,port,authToken,false);
+	if (found != 0)
+		return found;
 
 	InetAddress addr;
 	{
@@ -319,68 +5242,100 @@ static int cli(int argc,char **argv)
 			printf("%s", cliFixJsonCRs(responseBody).c_str());
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if ((command == "info")||(command == "status")) {
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/status",requestHeaders,responseHeaders,responseBody);
 
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 
 		nlohmann::json j;
 		try {
 			j = OSUtils::jsonParse(responseBody);
 		} catch (std::exception &exc) {
-			printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
 		} catch ( ... ) {
-			printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
 		}
 
 		if (scode == 200) {
 			if (json) {
-				printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+				printf("%s" ZT_EOL_S,cliJson(j).c_str());
+			} else if (cliQuiet) {
+				printf("%s" ZT_EOL_S,cliAddress(OSUtils::jsonString(j["address"],"-")).c_str());
 			} else {
 				if (j.is_object()) {
-					printf("200 info %s %s %s" ZT_EOL_S,
-						OSUtils::jsonString(j["address"],"-").c_str(),
+					char uptime[64];
+					const unsigned long long up = (unsigned long long)OSUtils::jsonInt(j["uptime"],0ULL) / 1000;
+					if (j.count("uptime"))
+						OSUtils::ztsnprintf(uptime,sizeof(uptime),"up %llud%.2lluh%.2llum%.2llus",up / 86400,(up % 86400) / 3600,(up % 3600) / 60,up % 60);
+					else OSUtils::ztsnprintf(uptime,sizeof(uptime),"up -");
+					printf("200 info %s %s %s %s" ZT_EOL_S,
+						cliAddress(OSUtils::jsonString(j["address"],"-")).c_str(),
 						OSUtils::jsonString(j["version"],"-").c_str(),
-						((j["tcpFallbackActive"]) ? "TUNNELED" : ((j["online"]) ? "ONLINE" : "OFFLINE")));
+						cliStatus((j["tcpFallbackActive"]) ? "TUNNELED" : ((j["online"]) ? "ONLINE" : "OFFLINE")).c_str(),
+						uptime);
+
+					// Warn about ports that could not be bound as configured
+					nlohmann::json &ports = j["ports"];
+					static const char *const portNames[3] = { "primary","secondary","tertiary" };
+					for(int i=0;((ports.is_object())&&(i<3));++i) {
+						nlohmann::json &p = ports[portNames[i]];
+						if (OSUtils::jsonBool(p["mismatch"],false)) {
+							char cs[16],es[16];
+							if (!OSUtils::jsonBool(p["enabled"],true))
+								OSUtils::ztsnprintf(cs,sizeof(cs),"disabled");
+							else if (OSUtils::jsonInt(p["configured"],0ULL) == 0)
+								OSUtils::ztsnprintf(cs,sizeof(cs),"auto");
+							else OSUtils::ztsnprintf(cs,sizeof(cs),"%u",(unsigned int)OSUtils::jsonInt(p["configured"],0ULL));
+							if (OSUtils::jsonInt(p["effective"],0ULL) == 0)
+								OSUtils::ztsnprintf(es,sizeof(es),"none");
+							else OSUtils::ztsnprintf(es,sizeof(es),"%u",(unsigned int)OSUtils::jsonInt(p["effective"],0ULL));
+							fprintf(stderr,"warning: %s port mismatch (configured: %s, effective: %s)" ZT_EOL_S,portNames[i],cs,es);
+						}
+					}
+					if ((ports.is_object())&&(OSUtils::jsonBool(ports["portMapping"]["mismatch"],false)))
+						fprintf(stderr,"warning: port mapping mismatch (configured: %s, effective: %s)" ZT_EOL_S,(OSUtils::jsonBool(ports["portMapping"]["configured"],false)) ? "on" : "off",(OSUtils::jsonBool(ports["portMapping"]["effective"],false)) ? "on" : "off");
 				}
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "listpeers") {
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/peer",requestHeaders,responseHeaders,responseBody);
 
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 
 		nlohmann::json j;
 		try {
 			j = OSUtils::jsonParse(responseBody);
 		} catch (std::exception &exc) {
-			printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
 		} catch ( ... ) {
-			printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
 		}
 
 		if (scode == 200) {
 			if (json) {
-				printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+				printf("%s" ZT_EOL_S,cliJson(j).c_str());
+			} else if (cliQuiet) {
+				for(unsigned long k=0;((j.is_array())&&(k<j.size()));++k)
+					printf("%s" ZT_EOL_S,cliAddress(OSUtils::jsonString(j[k]["address"],"-")).c_str());
 			} else {
-				printf("200 listpeers <ztaddr> <path> <latency> <version> <role>" ZT_EOL_S);
+				cliHeader("200 listpeers <ztaddr> <path> <latency> <version> <role>" ZT_EOL_S);
 				if (j.is_array()) {
 					for(unsigned long k=0;k<j.size();++k) {
 						nlohmann::json &p = j[k];
@@ -411,7 +5366,7 @@ static int cli(int argc,char **argv)
 							ver[1] = (char)0;
 						}
 						printf("200 listpeers %s %s %d %s %s" ZT_EOL_S,
-							OSUtils::jsonString(p["address"],"-").c_str(),
+							cliAddress(OSUtils::jsonString(p["address"],"-")).c_str(),
 							bestPath.c_str(),
 							(int)OSUtils::jsonInt(p["latency"],0),
 							ver,
@@ -421,33 +5376,36 @@ static int cli(int argc,char **argv)
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "peers") {
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/peer",requestHeaders,responseHeaders,responseBody);
 
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 
 		nlohmann::json j;
 		try {
 			j = OSUtils::jsonParse(responseBody);
 		} catch (std::exception &exc) {
-			printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
 		} catch ( ... ) {
-			printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
 		}
 
 		if (scode == 200) {
 			if (json) {
-				printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+				printf("%s" ZT_EOL_S,cliJson(j).c_str());
+			} else if (cliQuiet) {
+				for(unsigned long k=0;((j.is_array())&&(k<j.size()));++k)
+					printf("%s" ZT_EOL_S,cliAddress(OSUtils::jsonString(j[k]["address"],"-")).c_str());
 			} else {
-				printf("200 peers\n<ztaddr>   <ver>  <role> <lat> <link> <lastTX> <lastRX> <path>" ZT_EOL_S);
+				cliHeader("200 peers\n<ztaddr>   <ver>   <proto> <role> <lat> <link> <lastTX> <lastRX> <path>" ZT_EOL_S);
 				if (j.is_array()) {
 					for(unsigned long k=0;k<j.size();++k) {
 						nlohmann::json &p = j[k];
@@ -467,19 +5425,21 @@ static int cli(int argc,char **argv)
 							}
 						}
 						if (bestPath.length() == 0) bestPath = "RELAY";
-						char ver[128];
+						char ver[128],proto[32];
 						int64_t vmaj = p["versionMajor"];
 						int64_t vmin = p["versionMinor"];
 						int64_t vrev = p["versionRev"];
-						if (vmaj >= 0) {
+						const int64_t vproto = p["versionProto"].is_number() ? (int64_t)p["versionProto"] : -1LL;
+						if (vmaj >= 0)
 							OSUtils::ztsnprintf(ver,sizeof(ver),"%lld.%lld.%lld",vmaj,vmin,vrev);
-						} else {
-							ver[0] = '-';
-							ver[1] = (char)0;
-						}
-						printf("%s %-6s %-6s %5d %s" ZT_EOL_S,
-							OSUtils::jsonString(p["address"],"-").c_str(),
+						else OSUtils::ztsnprintf(ver,sizeof(ver),"unknown");
+						if (vproto >= 0)
+							OSUtils::ztsnprintf(proto,sizeof(proto),"%lld",vproto);
+						else OSUtils::ztsnprintf(proto,sizeof(proto),"-");
+						printf("%-10s %-7s %-7s %-6s %5d %s" ZT_EOL_S,
+							cliAddress(OSUtils::jsonString(p["address"],"-")).c_str(),
 							ver,
+							proto,
 							OSUtils::jsonString(p["role"],"-").c_str(),
 							(int)OSUtils::jsonInt(p["latency"],0),
 							bestPath.c_str());
@@ -488,39 +5448,188 @@ static int cli(int argc,char **argv)
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
+		}
+	} else if (command == "roots") {
+		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/peer",requestHeaders,responseHeaders,responseBody);
+
+		if (scode == 0) {
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
+		}
+
+		nlohmann::json j;
+		try {
+			j = OSUtils::jsonParse(responseBody);
+		} catch (std::exception &exc) {
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
+		} catch ( ... ) {
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
+		}
+
+		if (scode != 200) {
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
+		}
+
+		// Roots from the planet built into this node are reported as defaults
+		bool planetIsDefault = false;
+		{
+			std::map<std::string,std::string> statusHeaders;
+			std::string statusBody;
+			if (Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/status",requestHeaders,statusHeaders,statusBody) == 200) {
+				try {
+					nlohmann::json sj(OSUtils::jsonParse(statusBody));
+					planetIsDefault = OSUtils::jsonBool(sj["planetIsDefault"],false);
+				} catch ( ... ) {}
+			}
+		}
+
+		// Join the peer list against root roles to report which roots are actually reachable
+		const int64_t now = OSUtils::now();
+		unsigned long onlineCount = 0;
+		nlohmann::json roots = nlohmann::json::array();
+		if (j.is_array()) {
+			for(unsigned long k=0;k<j.size();++k) {
+				nlohmann::json &p = j[k];
+				const std::string role(OSUtils::jsonString(p["role"],""));
+				if ((role != "PLANET")&&(role != "MOON"))
+					continue;
+
+				nlohmann::json r;
+				r["address"] = p["address"];
+				r["source"] = (role == "PLANET") ? (planetIsDefault ? "default" : "planet") : "moon";
+				r["default"] = ((role == "PLANET")&&(planetIsDefault));
+				r["latency"] = p["latency"];
+				r["version"] = p["version"];
+
+				int64_t lastReceive = 0;
+				std::string endpoint;
+				nlohmann::json &paths = p["paths"];
+				if (paths.is_array()) {
+					for(unsigned long i=0;i<paths.size();++i) {
+						nlohmann::json &path = paths[i];
+						const int64_t lr = (int64_t)OSUtils::jsonInt(path["lastReceive"],0);
+						if (lr > lastReceive)
+							lastReceive = lr;
+						if ((OSUtils::jsonBool(path["preferred"],false))||(endpoint.empty()))
+							endpoint = OSUtils::jsonString(path["address"],"");
+					}
+				}
+				const bool online = ((lastReceive > 0)&&((now - lastReceive) < (ZT_PATH_HEARTBEAT_PERIOD + 5000)));
+				if (online)
+					++onlineCount;
+				r["online"] = online;
+				r["lastReceive"] = lastReceive;
+				if (endpoint.length() > 0)
+					r["endpoint"] = endpoint;
+				else r["endpoint"] = nlohmann::json();
+				roots.push_back(r);
+			}
+		}
+
+		if (json) {
+			printf("%s" ZT_EOL_S,cliJson(roots).c_str());
+		} else {
+			cliHeader("200 roots\n<ztaddr>   <source> <status>  <lat> <lastRX>  <endpoint>" ZT_EOL_S);
+			for(unsigned long k=0;k<roots.size();++k) {
+				nlohmann::json &r = roots[k];
+				const int64_t lastReceive = (int64_t)OSUtils::jsonInt(r["lastReceive"],0);
+				char lastRx[64];
+				if (lastReceive > 0)
+					OSUtils::ztsnprintf(lastRx,sizeof(lastRx),"%lld",(long long)(now - lastReceive));
+				else OSUtils::ztsnprintf(lastRx,sizeof(lastRx),"-");
+				printf("%-10s %-8s %s %5d %-8s %s" ZT_EOL_S,
+					cliAddress(OSUtils::jsonString(r["address"],"-")).c_str(),
+					OSUtils::jsonString(r["source"],"-").c_str(),
+					cliStatus((OSUtils::jsonBool(r["online"],false)) ? "ONLINE" : "OFFLINE",7).c_str(),
+					(int)OSUtils::jsonInt(r["latency"],0),
+					lastRx,
+					OSUtils::jsonString(r["endpoint"],"-").c_str());
+			}
+		}
+
+		if ((longOpts.count("check"))&&(onlineCount == 0)) {
+			if (!json)
+				fprintf(stderr,"no roots are online" ZT_EOL_S);
+			return ZT_CLI_EXIT_FAILED;
+		}
+		return 0;
+	} else if (command == "root") {
+		if ((arg1 != "reset")||(args.size() != 1)) {
+			fprintf(stderr,"invalid format: root reset [--yes]" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		if (!longOpts.count("yes")) {
+			fprintf(stderr,"Discard any custom planet and all moons and go back to the default roots? [y/N] ");
+			char answer[64];
+			answer[0] = (char)0;
+			if (!fgets(answer,sizeof(answer),stdin))
+				answer[0] = (char)0;
+			if ((answer[0] != 'y')&&(answer[0] != 'Y')) {
+				fprintf(stderr,"roots not reset" ZT_EOL_S);
+				return ZT_CLI_EXIT_FAILED;
+			}
+		}
+		requestHeaders["Content-Type"] = "application/json";
+		requestHeaders["Content-Length"] = "2";
+		const unsigned int scode = Http::POST(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/root/reset",requestHeaders,"{}",2,responseHeaders,responseBody);
+		if (scode == 200) {
+			if (json) {
+				printf("%s",cliFixJsonCRs(responseBody).c_str());
+			} else {
+				nlohmann::json j;
+				try {
+					j = OSUtils::jsonParse(responseBody);
+				} catch ( ... ) {}
+				if (!OSUtils::jsonBool(j["changed"],false)) {
+					cliOK("200 root reset OK (already using default roots)" ZT_EOL_S);
+				} else {
+					const unsigned long moonsRemoved = (j["moonsRemoved"].is_array()) ? (unsigned long)j["moonsRemoved"].size() : 0;
+					cliOK("200 root reset OK (%s, %lu moon(s) removed)" ZT_EOL_S,(OSUtils::jsonBool(j["planetReset"],false)) ? "planet reset" : "planet unchanged",moonsRemoved);
+				}
+			}
+			return 0;
+		} else if (scode == 0) {
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
+		} else {
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "bond") {
 		/* zerotier-cli bond */
 		if (arg1.empty()) {
 			printf("(bond) command is missing required arugments" ZT_EOL_S);
-			return 2;
+			return ZT_CLI_EXIT_USAGE;
 		}
 		/* zerotier-cli bond list */
 		if (arg1 == "list") {
 			fprintf(stderr, "zerotier-cli bond list\n");
 			const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/bonds",requestHeaders,responseHeaders,responseBody);
 			if (scode == 0) {
-				printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-				return 1;
+				fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+				return ZT_CLI_EXIT_UNREACHABLE;
 			}
 			nlohmann::json j;
 			try {
 				j = OSUtils::jsonParse(responseBody);
 			} catch (std::exception &exc) {
-				printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-				return 1;
+				fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+				return cliExitCode(scode);
 			} catch ( ... ) {
-				printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-				return 1;
+				fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+				return cliExitCode(scode);
 			}
 			if (scode == 200) {
 				if (json) {
-					printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+					printf("%s" ZT_EOL_S,cliJson(j).c_str());
 				} else {
 					bool bFoundBond = false;
-					printf("    <peer>                        <bondtype>    <status>    <links>" ZT_EOL_S);
+					cliHeader("    <peer>                        <bondtype>    <status>    <links>" ZT_EOL_S);
 					if (j.is_array()) {
 						for(unsigned long k=0;k<j.size();++k) {
 							nlohmann::json &p = j[k];
@@ -542,7 +5651,7 @@ static int cli(int argc,char **argv)
 									policyStr = BondController::getPolicyStrByCode(bondingPolicy);
 								}
 								printf("%10s  %32s    %8s        %d/%d" ZT_EOL_S,
-									OSUtils::jsonString(p ["address"],"-").c_str(),
+									cliAddress(OSUtils::jsonString(p ["address"],"-")).c_str(),
 									policyStr.c_str(),
 									healthStr.c_str(),
 									numAliveLinks,
@@ -556,8 +5665,8 @@ static int cli(int argc,char **argv)
 				}
 				return 0;
 			} else {
-				printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-				return 1;
+				fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+				return cliExitCode(scode);
 			}
 		}
 		else if (arg1.length() == 10) { /* zerotier-cli bond <peerId> enable */
@@ -583,12 +5692,12 @@ static int cli(int argc,char **argv)
 					if (json) {
 						printf("%s",cliFixJsonCRs(responseBody).c_str());
 					} else {
-						printf("200 bond OK" ZT_EOL_S);
+						cliOK("200 bond OK" ZT_EOL_S);
 					}
 					return 0;
 				} else {
-					printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-					return 1;
+					fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+					return cliExitCode(scode);
 				}
 				return 0;
 			}
@@ -601,22 +5710,22 @@ static int cli(int argc,char **argv)
 					responseHeaders,
 					responseBody);
 				if (scode == 0) {
-					printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-					return 1;
+					fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+					return ZT_CLI_EXIT_UNREACHABLE;
 				}
 				nlohmann::json j;
 				try {
 					j = OSUtils::jsonParse(responseBody);
 				} catch (std::exception &exc) {
-					printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-					return 1;
+					fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+					return cliExitCode(scode);
 				} catch ( ... ) {
-					printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-					return 1;
+					fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+					return cliExitCode(scode);
 				}
 				if (scode == 200) {
 					if (json) {
-						printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+						printf("%s" ZT_EOL_S,cliJson(j).c_str());
 					} else {
 						bool bFoundBond = false;
 						std::string healthStr;
@@ -669,45 +5778,45 @@ static int cli(int argc,char **argv)
 					}
 					return 0;
 				} else {
-					printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-					return 1;
+					fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+					return cliExitCode(scode);
 				}
-				return 2;
+				return ZT_CLI_EXIT_USAGE;
 			}
 		}
 		/* zerotier-cli bond command was malformed in some way */
 		printf("(bond) command is missing required arugments" ZT_EOL_S);
-		return 2;
+		return ZT_CLI_EXIT_USAGE;
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/bonds",requestHeaders,responseHeaders,responseBody);
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 	} else if (command == "listbonds") {
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/bonds",requestHeaders,responseHeaders,responseBody);
 
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 
 		nlohmann::json j;
 		try {
 			j = OSUtils::jsonParse(responseBody);
 		} catch (std::exception &exc) {
-			printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
 		} catch ( ... ) {
-			printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
 		}
 
 		if (scode == 200) {
 			if (json) {
-				printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+				printf("%s" ZT_EOL_S,cliJson(j).c_str());
 			} else {
 				bool bFoundBond = false;
-				printf("    <peer>                        <bondtype>    <status>    <links>" ZT_EOL_S);
+				cliHeader("    <peer>                        <bondtype>    <status>    <links>" ZT_EOL_S);
 				if (j.is_array()) {
 					for(unsigned long k=0;k<j.size();++k) {
 						nlohmann::json &p = j[k];
@@ -732,7 +5841,7 @@ static int cli(int argc,char **argv)
 							}
 
 							printf("%10s  %32s    %8s        %d/%d" ZT_EOL_S,
-								OSUtils::jsonString(p["address"],"-").c_str(),
+								cliAddress(OSUtils::jsonString(p["address"],"-")).c_str(),
 								policyStr.c_str(),
 								healthStr.c_str(),
 								numAliveLinks,
@@ -746,33 +5855,36 @@ static int cli(int argc,char **argv)
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "listnetworks") {
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/network",requestHeaders,responseHeaders,responseBody);
 
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 
 		nlohmann::json j;
 		try {
 			j = OSUtils::jsonParse(responseBody);
 		} catch (std::exception &exc) {
-			printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
 		} catch ( ... ) {
-			printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
 		}
 
 		if (scode == 200) {
 			if (json) {
-				printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+				printf("%s" ZT_EOL_S,cliJson(j).c_str());
+			} else if (cliQuiet) {
+				for(unsigned long i=0;((j.is_array())&&(i<j.size()));++i)
+					printf("%s" ZT_EOL_S,OSUtils::jsonString(j[i]["nwid"],"-").c_str());
 			} else {
-				printf("200 listnetworks <nwid> <name> <mac> <status> <type> <dev> <ZT assigned ips>" ZT_EOL_S);
+				cliHeader("200 listnetworks <nwid> <name> <mac> <status> <type> <dev> <ZT assigned ips>" ZT_EOL_S);
 				if (j.is_array()) {
 					for(unsigned long i=0;i<j.size();++i) {
 						nlohmann::json &n = j[i];
@@ -793,7 +5905,7 @@ static int cli(int argc,char **argv)
 								OSUtils::jsonString(n["nwid"],"-").c_str(),
 								OSUtils::jsonString(n["name"],"-").c_str(),
 								OSUtils::jsonString(n["mac"],"-").c_str(),
-								OSUtils::jsonString(n["status"],"-").c_str(),
+								cliStatus(OSUtils::jsonString(n["status"],"-")).c_str(),
 								OSUtils::jsonString(n["type"],"-").c_str(),
 								OSUtils::jsonString(n["portDeviceName"],"-").c_str(),
 								aa.c_str());
@@ -803,41 +5915,53 @@ static int cli(int argc,char **argv)
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "join") {
 		if (arg1.length() != 16) {
-			printf("invalid network id" ZT_EOL_S);
-			return 2;
+			fprintf(cliDiag(),"invalid network id" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
 		}
+		nlohmann::json jb = nlohmann::json::object();
+		std::map<std::string,std::string>::const_iterator token(longOpts.find("token"));
+		if (token != longOpts.end()) {
+			if ((token->second.empty())||(token->second.length() >= 512)) {
+				fprintf(stderr,"invalid --token: expected a token under 512 characters" ZT_EOL_S);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			jb["authToken"] = token->second;
+		}
+		const std::string body(OSUtils::jsonDump(jb,-1));
+		char cl[128];
+		OSUtils::ztsnprintf(cl,sizeof(cl),"%u",(unsigned int)body.length());
 		requestHeaders["Content-Type"] = "application/json";
-		requestHeaders["Content-Length"] = "2";
+		requestHeaders["Content-Length"] = cl;
 		unsigned int scode = Http::POST(
 			1024 * 1024 * 16,
 			60000,
 			(const struct sockaddr *)&addr,
 			(std::string("/network/") + arg1).c_str(),
 			requestHeaders,
-			"{}",
-			2,
+			body.data(),
+			(unsigned long)body.length(),
 			responseHeaders,
 			responseBody);
 		if (scode == 200) {
 			if (json) {
 				printf("%s",cliFixJsonCRs(responseBody).c_str());
 			} else {
-				printf("200 join OK" ZT_EOL_S);
+				cliOK("200 join OK" ZT_EOL_S);
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "leave") {
 		if (arg1.length() != 16) {
-			printf("invalid network id" ZT_EOL_S);
-			return 2;
+			fprintf(cliDiag(),"invalid network id" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
 		}
 		unsigned int scode = Http::DEL(
 			1024 * 1024 * 16,
@@ -851,38 +5975,141 @@ static int cli(int argc,char **argv)
 			if (json) {
 				printf("%s",cliFixJsonCRs(responseBody).c_str());
 			} else {
-				printf("200 leave OK" ZT_EOL_S);
+				cliOK("200 leave OK" ZT_EOL_S);
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
+		}
+	} else if (command == "network") {
+		if ((arg1.length() == 16)&&(args.size() == 2)&&(args[1] == "show"))
+			return cliNetworkShow(args,longOpts,json,addr,requestHeaders);
+		if ((args.size() >= 2)&&(args[1] == "multicast"))
+			return cliNetworkMulticast(args,json,addr,requestHeaders);
+		if ((arg1 == "multicast")&&(args.size() >= 3)) {
+			// Also accepted as network multicast <op> <network ID> ...
+			std::vector<std::string> margs(args);
+			margs[0] = args[2];
+			margs[1] = "multicast";
+			margs[2] = args[1];
+			return cliNetworkMulticast(margs,json,addr,requestHeaders);
+		}
+		const bool refresh = ((args.size() == 2)&&(args[1] == "refresh"));
+		const bool setHook = ((args.size() == 4)&&(args[1] == "set")&&((args[2] == "uphook")||(args[2] == "downhook")));
+		const bool setLimit = ((args.size() == 4)&&(args[1] == "set")&&((args[2] == "multicastlimit")||(args[2] == "bridge")));
+		if ((arg1.length() != 16)||((!refresh)&&(!setHook)&&(!setLimit))) {
+			fprintf(stderr,"invalid format: network <network ID> show|refresh|multicast|set uphook|downhook <path|clear> | set multicastlimit <n|default> | set bridge <true|false>" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		nlohmann::json b(nlohmann::json::object());
+		std::string path("/network/");
+		path.append(arg1);
+		if (setHook) {
+			const std::string hook((args[3] == "clear") ? std::string() : args[3]);
+			// The same rules as the service, which stores hooks in the network's local.conf dictionary
+			if ((!hook.empty())&&((hook[0] != '/')||(hook.length() > 1000)||(hook.find_first_of("\\=\r\n") != std::string::npos))) {
+				fprintf(stderr,"hook must be an absolute path of at most 1000 characters without \\, = or line breaks" ZT_EOL_S);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			b[(args[2] == "uphook") ? "upHook" : "downHook"] = hook;
+		} else if ((setLimit)&&(args[2] == "multicastlimit")) {
+			// Local limits can only lower the controller's, so 0 (default) means use the controller's
+			uint64_t limit = 0;
+			if ((args[3] != "default")&&(!cliParseU32(args[3],limit))) {
+				fprintf(stderr,"multicast limit must be a number of recipients or default" ZT_EOL_S);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			b["multicastLimit"] = limit;
+		} else if (setLimit) {
+			bool bridge = true;
+			if (!cliParseBool(args[3],bridge)) {
+				fprintf(stderr,"bridge must be true or false" ZT_EOL_S);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			b["allowBridging"] = bridge;
+		} else {
+			path.append("/refresh");
+		}
+		nlohmann::json j;
+		const unsigned int scode = cliRequest(addr,requestHeaders,"POST",path,&b,responseBody,j);
+		if (scode == 200) {
+			if (json) {
+				printf("%s",cliFixJsonCRs(responseBody).c_str());
+			} else if ((setHook)||(setLimit)) {
+				cliOK("200 network set %s OK" ZT_EOL_S,args[2].c_str());
+			} else {
+				cliOK("200 network refresh OK" ZT_EOL_S);
+			}
+			return 0;
+		} else if (scode == 0) {
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
+		} else {
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
+		}
+	} else if (command == "trace") {
+		return cliTrace(args,longOpts,json,addr,requestHeaders);
+	} else if (command == "monitor") {
+		return cliMonitor(args,longOpts,json,addr,requestHeaders);
+	} else if (command == "planet") {
+		const bool sw = ((arg1 == "switch")&&(args.size() == 2));
+		if ((!sw)&&(!(((arg1 == "show")||(arg1 == "verify"))&&(args.size() <= 2)))) {
+			fprintf(stderr,"invalid format: planet show|verify [<file>] | switch <file> [--yes]" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+
+		// Without a file, show or verify the planet this node has saved in its home directory
+		const std::string path((args.size() == 2) ? args[1] : (homeDir + ZT_PATH_SEPARATOR_S + "planet"));
+		World w;
+		if (!getWorldFromFile(path.c_str(),w)) {
+			if (args.size() == 1)
+				fprintf(stderr,"no saved planet in %s; the node uses its built-in default planet until it saves one" ZT_EOL_S,homeDir.c_str());
+			else fprintf(stderr,"%s is not readable or is not a valid planet file" ZT_EOL_S,path.c_str());
+			return ZT_CLI_EXIT_FAILED;
 		}
+
+		if (arg1 == "show") {
+			if (json)
+				printf("%s" ZT_EOL_S,cliJson(worldToJson(w)).c_str());
+			else printWorld(w);
+			return 0;
+		}
+		if (arg1 == "verify") {
+			const bool valid = ((printWorld(w))&&(w.type() == World::TYPE_PLANET));
+			if (w.type() != World::TYPE_PLANET)
+				printf("not a planet (moons are used with orbit)" ZT_EOL_S);
+			printf("%s" ZT_EOL_S,(valid) ? "VALID" : "INVALID");
+			return (valid) ? 0 : ZT_CLI_EXIT_FAILED;
+		}
+
+		return cliPlanetSwitch("planet switch",path,w,homeDir,longOpts,json,addr,requestHeaders);
 	} else if (command == "listmoons") {
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/moon",requestHeaders,responseHeaders,responseBody);
 
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 
 		nlohmann::json j;
 		try {
 			j = OSUtils::jsonParse(responseBody);
 		} catch (std::exception &exc) {
-			printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
 		} catch ( ... ) {
-			printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
 		}
 
 		if (scode == 200) {
-			printf("%s" ZT_EOL_S,OSUtils::jsonDump(j).c_str());
+			printf("%s" ZT_EOL_S,cliJson(j).c_str());
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "orbit") {
 		const uint64_t worldId = Utils::hexStrToU64(arg1.c_str());
@@ -905,11 +6132,11 @@ static int cli(int argc,char **argv)
 				responseHeaders,
 				responseBody);
 			if (scode == 200) {
-				printf("200 orbit OK" ZT_EOL_S);
+				cliOK("200 orbit OK" ZT_EOL_S);
 				return 0;
 			} else {
-				printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-				return 1;
+				fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+				return cliExitCode(scode);
 			}
 		}
 	} else if (command == "deorbit") {
@@ -925,29 +6152,375 @@ static int cli(int argc,char **argv)
 			if (json) {
 				printf("%s",cliFixJsonCRs(responseBody).c_str());
 			} else {
-				printf("200 deorbit OK" ZT_EOL_S);
+				cliOK("200 deorbit OK" ZT_EOL_S);
 			}
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
+		}
+	} else if ((command == "identity")&&(arg1 == "address")) {
+		if (args.size() != 2) {
+			fprintf(stderr,"invalid format: identity address <identity>" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+
+		Identity id;
+		if (!cliReadPublicIdentity(args[1],id))
+			return ZT_CLI_EXIT_FAILED;
+		char abuf[16];
+		printf("%s" ZT_EOL_S,id.address().toString(abuf,cliEncoding));
+		return 0;
+	} else if ((command == "identity")&&(arg1 == "pubkey")) {
+		// --format wins over --encoding, which only picks the default
+		std::map<std::string,std::string>::const_iterator f(longOpts.find("format"));
+		const std::string format((f != longOpts.end()) ? f->second : std::string((cliEncoding == Utils::ENCODING_BASE32) ? "base32" : "hex"));
+		if ((args.size() != 2)||((format != "hex")&&(format != "base32")&&(format != "base64")&&(format != "raw"))) {
+			fprintf(stderr,"invalid format: identity pubkey <identity> [--format=hex|base32|base64|raw]" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		Identity id;
+		if (!cliReadPublicIdentity(args[1],id))
+			return ZT_CLI_EXIT_FAILED;
+
+		// Type 0 (c25519) identities have a 64-byte public key: the Curve25519 (X25519) key
+		// used for key agreement followed by the Ed25519 key used for signatures
+		const C25519::Public &pub = id.publicKey();
+		char tmp[(ZT_C25519_PUBLIC_KEY_LEN * 2) + 1];
+		if (json) {
+			nlohmann::json j;
+			j["address"] = id.address().toString(tmp);
+			j["type"] = "c25519";
+			j["publicKey"] = Utils::hex(pub.data,ZT_C25519_PUBLIC_KEY_LEN,tmp);
+			j["x25519"] = Utils::hex(pub.data,32,tmp);
+			j["ed25519"] = Utils::hex(pub.data + 32,32,tmp);
+			printf("%s" ZT_EOL_S,cliJson(j).c_str());
+		} else if (format == "raw") {
+			fwrite(pub.data,1,ZT_C25519_PUBLIC_KEY_LEN,stdout);
+		} else if (format == "base64") {
+			printf("%s" ZT_EOL_S,cliBase64(pub.data,ZT_C25519_PUBLIC_KEY_LEN).c_str());
+		} else if (format == "base32") {
+			printf("%s" ZT_EOL_S,Utils::b32e(pub.data,ZT_C25519_PUBLIC_KEY_LEN,tmp));
+		} else {
+			printf("%s" ZT_EOL_S,Utils::hex(pub.data,ZT_C25519_PUBLIC_KEY_LEN,tmp));
+		}
+		return 0;
+	} else if ((command == "identity")&&((arg1 == "verify-ownership")||(arg1 == "check-ownership"))) {
+		const bool sign = (arg1 == "verify-ownership");
+		if (args.size() != (sign ? 3U : 4U)) {
+			fprintf(stderr,"invalid format: identity verify-ownership <identity.secret> <challenge hex> | check-ownership <identity> <challenge hex> <signature hex>" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+
+		// A literal identity is accepted for checking, otherwise it is read from a file
+		Identity id;
+		std::string idbuf;
+		if ((!sign)&&(args[1].length() > 32)&&(args[1][10] == ':')) {
+			idbuf = args[1];
+		} else if (!cliReadInput(args[1],idbuf)) {
+			fprintf(stderr,"unable to read %s" ZT_EOL_S,args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		if ((!cliParseIdentity(idbuf,id))||(!id.locallyValidate())) {
+			fprintf(stderr,"%s is not a valid identity" ZT_EOL_S,args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		if ((sign)&&(!id.hasPrivate())) {
+			fprintf(stderr,"%s does not contain a secret key" ZT_EOL_S,args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+
+		uint8_t challenge[ZT_CLI_OWNERSHIP_CHALLENGE_MAX];
+		const std::string &ch = args[2];
+		if ((ch.length() < (ZT_CLI_OWNERSHIP_CHALLENGE_MIN * 2))||(ch.length() > (sizeof(challenge) * 2))||((ch.length() & 1) != 0)||(ch.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)) {
+			fprintf(stderr,"invalid challenge: expected %d to %d bytes in hex" ZT_EOL_S,ZT_CLI_OWNERSHIP_CHALLENGE_MIN,ZT_CLI_OWNERSHIP_CHALLENGE_MAX);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		const unsigned int chlen = Utils::unhex(ch.c_str(),challenge,sizeof(challenge));
+
+		// The challenge is signed under a fixed prefix so a challenger can't get anything else signed
+		std::string msg(ZT_CLI_OWNERSHIP_SIGNATURE_PREFIX,sizeof(ZT_CLI_OWNERSHIP_SIGNATURE_PREFIX));
+		msg.append((const char *)challenge,chlen);
+		char atmp[16];
+		char hexbuf[(ZT_C25519_SIGNATURE_LEN * 2) + 1];
+		if (sign) {
+			const C25519::Signature sig(id.sign(msg.data(),(unsigned int)msg.length()));
+			printf("%s" ZT_EOL_S,Utils::hex(sig.data,ZT_C25519_SIGNATURE_LEN,hexbuf));
+			return 0;
+		}
+
+		uint8_t sig[ZT_C25519_SIGNATURE_LEN];
+		const bool valid = ((args[3].length() == (ZT_C25519_SIGNATURE_LEN * 2))&&(args[3].find_first_not_of("0123456789abcdefABCDEF") == std::string::npos)&&
+			(Utils::unhex(args[3].c_str(),sig,sizeof(sig)) == sizeof(sig))&&(id.verify(msg.data(),(unsigned int)msg.length(),sig,sizeof(sig))));
+		if (json) {
+			nlohmann::json j;
+			j["address"] = id.address().toString(atmp);
+			j["valid"] = valid;
+			printf("%s" ZT_EOL_S,cliJson(j).c_str());
+		} else if (valid) {
+			cliOK("200 identity check-ownership OK: signature proves ownership of %s" ZT_EOL_S,id.address().toString(atmp,cliEncoding));
+		} else {
+			fprintf(stderr,"signature does not prove ownership of %s" ZT_EOL_S,id.address().toString(atmp,cliEncoding));
+		}
+		return (valid) ? 0 : ZT_CLI_EXIT_FAILED;
+	} else if (command == "identity") {
+		if ((args.size() != 2)||((arg1 != "import")&&(arg1 != "export"))) {
+			fprintf(stderr,"invalid format: identity import <file> [--force] [--decrypt] | export <address> [--private [--encrypted]] [--output=<file>]" ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		if (arg1 == "export") {
+			const std::string &want = args[1];
+			if ((want.length() != 10)||(want.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos)) {
+				fprintf(stderr,"invalid address %s: expected a 10-digit ZeroTier address" ZT_EOL_S,want.c_str());
+				return ZT_CLI_EXIT_USAGE;
+			}
+			const bool priv = (longOpts.find("private") != longOpts.end());
+			const bool encrypted = (longOpts.find("encrypted") != longOpts.end());
+			if ((encrypted)&&(!priv)) {
+				fprintf(stderr,"--encrypted only applies to private keys; use it with --private" ZT_EOL_S);
+				return ZT_CLI_EXIT_USAGE;
+			}
+			char atmp[16];
+
+			// This node's own identity is read from its files, anything else is a known peer
+			Identity id;
+			std::string idbuf;
+			if (!OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S + "identity.secret").c_str(),idbuf))
+				OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S + "identity.public").c_str(),idbuf);
+			if ((id.fromString(cliTrim(idbuf).c_str()))&&(want == id.address().toString(atmp))) {
+				if ((priv)&&(!id.hasPrivate())) {
+					fprintf(stderr,"unable to read identity.secret in %s (are you root?)" ZT_EOL_S,homeDir.c_str());
+					return ZT_CLI_EXIT_FAILED;
+				}
+			} else {
+				id = Identity();
+				if (priv) {
+					fprintf(stderr,"%s is not this node's address; private keys are only available for this node's own identity" ZT_EOL_S,want.c_str());
+					return ZT_CLI_EXIT_FAILED;
+				}
+				nlohmann::json j;
+				const unsigned int scode = cliRequest(addr,requestHeaders,"GET",std::string("/peer/") + want + "/identity",(const nlohmann::json *)0,responseBody,j);
+				if (scode == 200) {
+					id.fromString(OSUtils::jsonString(j["identity"],"").c_str());
+				} else if (scode == 0) {
+					// Service is not running, so look in its peer cache directly
+					std::string cached;
+					if ((OSUtils::readFile((homeDir + ZT_PATH_SEPARATOR_S + "peers.d" + ZT_PATH_SEPARATOR_S + want + ".peer").c_str(),cached))&&(cached.length() > 1)&&(cached[0] == 1)) {
+						try {
+							Buffer<ZT_IDENTITY_STRING_BUFFER_LENGTH> b(cached.data() + 1,(unsigned int)std::min(cached.length() - 1,(std::size_t)ZT_IDENTITY_STRING_BUFFER_LENGTH));
+							id.deserialize(b,0);
+						} catch ( ... ) {
+							id = Identity();
+						}
+					}
+				} else if (scode != 404) {
+					fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+					return cliExitCode(scode);
+				}
+				if ((!id)||(want != id.address().toString(atmp))) {
+					fprintf(stderr,"%s is not this node or a known peer" ZT_EOL_S,want.c_str());
+					return ZT_CLI_EXIT_NOT_FOUND;
+				}
+			}
+
+			if ((priv)&&(longOpts.find("yes") == longOpts.end())) {
+				fprintf(stderr,"Export the private key of %s? Anyone who has it can impersonate this node. [y/N] ",want.c_str());
+				fflush(stderr);
+				char answer[64];
+				if ((!fgets(answer,sizeof(answer),stdin))||((cliTrim(answer) != "y")&&(cliTrim(answer) != "yes"))) {
+					fprintf(stderr,"not exported" ZT_EOL_S);
+					return ZT_CLI_EXIT_FAILED;
+				}
+			}
+
+			std::string ids;
+			if (encrypted) {
+				std::string pass,again;
+				if ((!cliReadPassphrase("Passphrase: ",pass))||(!cliReadPassphrase("Passphrase (again): ",again))) {
+					fprintf(stderr,"unable to read passphrase" ZT_EOL_S);
+					return ZT_CLI_EXIT_FAILED;
+				}
+				const bool same = (pass == again);
+				if (!again.empty())
+					Utils::burn(&(again[0]),(unsigned int)again.length());
+				if (pass.empty()) {
+					fprintf(stderr,"passphrase must not be empty" ZT_EOL_S);
+					return ZT_CLI_EXIT_FAILED;
+				}
+				if (!same) {
+					Utils::burn(&(pass[0]),(unsigned int)pass.length());
+					fprintf(stderr,"passphrases do not match" ZT_EOL_S);
+					return ZT_CLI_EXIT_FAILED;
+				}
+				nlohmann::json ej;
+				const bool ok = cliEncryptIdentity(id,pass,ej);
+				Utils::burn(&(pass[0]),(unsigned int)pass.length());
+				if (!ok) {
+					fprintf(stderr,"unable to encrypt identity %s" ZT_EOL_S,want.c_str());
+					return ZT_CLI_EXIT_FAILED;
+				}
+				ids = OSUtils::jsonDump(ej);
+			} else {
+				char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+				ids = id.toString(priv,idtmp,cliEncoding);
+			}
+			std::map<std::string,std::string>::const_iterator output(longOpts.find("output"));
+			if ((output == longOpts.end())||(output->second.empty())) {
+				printf("%s" ZT_EOL_S,ids.c_str());
+				return 0;
+			}
+			if (!((priv) ? OSUtils::writeSecretFile(output->second.c_str(),ids + ZT_EOL_S) : OSUtils::writeFile(output->second.c_str(),ids + ZT_EOL_S))) {
+				fprintf(stderr,"unable to write %s" ZT_EOL_S,output->second.c_str());
+				return ZT_CLI_EXIT_FAILED;
+			}
+			cliOK("200 identity export OK: %s written to %s" ZT_EOL_S,want.c_str(),output->second.c_str());
+			return 0;
+		}
+
+		std::string idbuf;
+		Identity id;
+		if (!cliReadInput(args[1],idbuf)) {
+			fprintf(stderr,"unable to read %s" ZT_EOL_S,args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		nlohmann::json ej;
+		if (cliIsEncryptedIdentity(idbuf,ej)) {
+			if (longOpts.find("decrypt") == longOpts.end()) {
+				fprintf(stderr,"%s is an encrypted identity; use --decrypt to import it" ZT_EOL_S,args[1].c_str());
+				return ZT_CLI_EXIT_FAILED;
+			}
+			std::string pass,err;
+			if (!cliReadPassphrase("Passphrase: ",pass)) {
+				fprintf(stderr,"unable to read passphrase" ZT_EOL_S);
+				return ZT_CLI_EXIT_FAILED;
+			}
+			const bool ok = cliDecryptIdentity(ej,pass,id,err);
+			if (!pass.empty())
+				Utils::burn(&(pass[0]),(unsigned int)pass.length());
+			if (!ok) {
+				fprintf(stderr,"unable to decrypt %s: %s" ZT_EOL_S,args[1].c_str(),err.c_str());
+				return ZT_CLI_EXIT_FAILED;
+			}
+		} else if (longOpts.find("decrypt") != longOpts.end()) {
+			fprintf(stderr,"%s is not an encrypted identity" ZT_EOL_S,args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		} else if ((!cliParseIdentity(idbuf,id))||(!id.locallyValidate())) {
+			fprintf(stderr,"%s does not contain a valid identity" ZT_EOL_S,args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+
+		char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+		char atmp[16];
+		nlohmann::json b,j;
+		b["identity"] = id.toString(false,idtmp);
+		const unsigned int scode = cliRequest(addr,requestHeaders,"POST","/peer",&b,responseBody,j);
+		if (scode == 200) {
+			// Service is running, so the identity becomes a known peer
+			if (json) {
+				printf("%s",cliFixJsonCRs(responseBody).c_str());
+			} else if (OSUtils::jsonBool(j["added"],false)) {
+				cliOK("200 identity import OK: %s added as a known peer" ZT_EOL_S,id.address().toString(atmp,cliEncoding));
+			} else {
+				cliOK("200 identity import OK: %s is already a known peer" ZT_EOL_S,id.address().toString(atmp,cliEncoding));
+			}
+			return 0;
+		} else if (scode != 0) {
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
+		}
+
+		// Service is not running, so install the identity as this node's own
+		if (!id.hasPrivate()) {
+			fprintf(stderr,"the service is not running and %s has no secret key, so it cannot be installed as this node's identity" ZT_EOL_S,args[1].c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		const std::string secretPath(homeDir + ZT_PATH_SEPARATOR_S + "identity.secret");
+		const std::string publicPath(homeDir + ZT_PATH_SEPARATOR_S + "identity.public");
+		std::string oldbuf;
+		Identity oldid;
+		if ((OSUtils::readFile(secretPath.c_str(),oldbuf))&&(oldid.fromString(cliTrim(oldbuf).c_str()))) {
+			if ((oldid == id)&&(oldid.hasPrivate())) {
+				cliOK("200 identity import OK: %s is already this node's identity" ZT_EOL_S,id.address().toString(atmp,cliEncoding));
+				return 0;
+			}
+			if (longOpts.find("force") == longOpts.end()) {
+				fprintf(stderr,"this node already has identity %s; use --force to replace it (the old one is saved as identity.secret.saved_before_replace)" ZT_EOL_S,oldid.address().toString(atmp,cliEncoding));
+				return ZT_CLI_EXIT_FAILED;
+			}
+			if (!OSUtils::writeSecretFile((secretPath + ".saved_before_replace").c_str(),oldbuf)) {
+				fprintf(stderr,"unable to save old identity to %s.saved_before_replace" ZT_EOL_S,secretPath.c_str());
+				return ZT_CLI_EXIT_FAILED;
+			}
+		}
+		if ((!OSUtils::writeSecretFile(secretPath.c_str(),std::string(id.toString(true,idtmp))))||(!OSUtils::writeFile(publicPath.c_str(),std::string(id.toString(false,idtmp))))) {
+			fprintf(stderr,"unable to write identity files in %s" ZT_EOL_S,homeDir.c_str());
+			return ZT_CLI_EXIT_FAILED;
+		}
+		cliOK("200 identity import OK: %s installed as this node's identity" ZT_EOL_S,id.address().toString(atmp,cliEncoding));
+		return 0;
+	} else if (command == "peer") {
+		if ((args.size() >= 2)&&(args[1] == "try"))
+			return cliPeerTry(args,longOpts,json,addr,requestHeaders);
+		if ((arg1.length() != 10)||(args.size() != 3)||(args[1] != "prefer")) {
+			fprintf(stderr,"invalid format: peer <address> prefer <endpoint|clear> or peer <address> try <endpoint> ..." ZT_EOL_S);
+			return ZT_CLI_EXIT_USAGE;
+		}
+		const std::string path(std::string("/peer/") + arg1 + "/prefer");
+		nlohmann::json j;
+		unsigned int scode;
+		if (args[2] == "clear") {
+			scode = cliRequest(addr,requestHeaders,"DELETE",path,(const nlohmann::json *)0,responseBody,j);
+		} else {
+			nlohmann::json b;
+			b["endpoint"] = args[2];
+			scode = cliRequest(addr,requestHeaders,"POST",path,&b,responseBody,j);
+		}
+		if (scode == 200) {
+			if (json) {
+				printf("%s",cliFixJsonCRs(responseBody).c_str());
+			} else {
+				cliOK("200 peer prefer OK" ZT_EOL_S);
+			}
+			return 0;
+		} else if (scode == 0) {
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
+		} else {
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "set") {
+		if (arg1 == "token")
+			return cliSetToken(args,longOpts,json,addr,requestHeaders);
+		if (arg1 == "planet")
+			return cliSetPlanet(args,homeDir,longOpts,json,addr,requestHeaders);
 		if (arg1.length() != 16) {
 			fprintf(stderr,"invalid format: must be a 16-digit (network) ID\n");
-			return 2;
+			return ZT_CLI_EXIT_USAGE;
 		}
 		if (!arg2.length()) {
 			fprintf(stderr,"invalid format: include a property name to set\n");
-			return 2;
+			return ZT_CLI_EXIT_USAGE;
 		}
 		std::size_t eqidx = arg2.find('=');
 		if (eqidx != std::string::npos) {
-			if ((arg2.substr(0,eqidx) == "allowManaged")||(arg2.substr(0,eqidx) == "allowGlobal")||(arg2.substr(0,eqidx) == "allowDefault")||(arg2.substr(0,eqidx) == "allowDNS")) {
-				char jsons[1024];
+			char jsons[1024];
+			jsons[0] = (char)0;
+			if ((arg2.substr(0,eqidx) == "allowManaged")||(arg2.substr(0,eqidx) == "allowGlobal")||(arg2.substr(0,eqidx) == "allowDefault")||(arg2.substr(0,eqidx) == "allowDNS")||(arg2.substr(0,eqidx) == "allowBridging")) {
 				OSUtils::ztsnprintf(jsons,sizeof(jsons),"{\"%s\":%s}",
 					arg2.substr(0,eqidx).c_str(),
 					(((arg2.substr(eqidx,2) == "=t")||(arg2.substr(eqidx,2) == "=1")) ? "true" : "false"));
+			} else if (arg2.substr(0,eqidx) == "multicastLimit") {
+				// Local limits can only lower the controller's, so 0 (default) means use the controller's
+				const std::string v(arg2.substr(eqidx + 1));
+				uint64_t limit = 0;
+				if ((v != "default")&&(!cliParseU32(v,limit))) {
+					fprintf(stderr,"multicast limit must be a number of recipients or default" ZT_EOL_S);
+					return ZT_CLI_EXIT_USAGE;
+				}
+				OSUtils::ztsnprintf(jsons,sizeof(jsons),"{\"multicastLimit\":%llu}",(unsigned long long)limit);
+			}
+			if (jsons[0]) {
 				char cl[128];
 				OSUtils::ztsnprintf(cl,sizeof(cl),"%u",(unsigned int)strlen(jsons));
 				requestHeaders["Content-Type"] = "application/json";
@@ -966,37 +6539,37 @@ static int cli(int argc,char **argv)
 					printf("%s",cliFixJsonCRs(responseBody).c_str());
 					return 0;
 				} else {
-					printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-					return 1;
+					fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+					return cliExitCode(scode);
 				}
 			}
 		} else {
 			cliPrintHelp(argv[0],stderr);
-			return 2;
+			return ZT_CLI_EXIT_USAGE;
 		}
 	} else if (command == "get") {
 		if (arg1.length() != 16) {
 			fprintf(stderr,"invalid format: must be a 16-digit (network) ID\n");
-			return 2;
+			return ZT_CLI_EXIT_USAGE;
 		}
 		if (!arg2.length()) {
 			fprintf(stderr,"invalid format: include a property name to get\n");
-			return 2;
+			return ZT_CLI_EXIT_USAGE;
 		}
 		const unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/network",requestHeaders,responseHeaders,responseBody);
 		if (scode == 0) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return ZT_CLI_EXIT_UNREACHABLE;
 		}
 		nlohmann::json j;
 		try {
 			j = OSUtils::jsonParse(responseBody);
 		} catch (std::exception &exc) {
-			printf("%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (%s)" ZT_EOL_S,scode,command.c_str(),exc.what());
+			return cliExitCode(scode);
 		} catch ( ... ) {
-			printf("%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s invalid JSON response (unknown exception)" ZT_EOL_S,scode,command.c_str());
+			return cliExitCode(scode);
 		}
 		bool bNetworkFound = false;
 		if (j.is_array()) {
@@ -1009,7 +6582,7 @@ static int cli(int argc,char **argv)
 						if (arg2 != "ip" && arg2 != "ip4" && arg2 != "ip6" && arg2 != "ip6plane" && arg2 != "ip6prefix") {
 							aa.append(OSUtils::jsonString(n[arg2],"-")); // Standard network property field
 							if (aa == "-") {
-								printf("error, unknown property name\n");
+								fprintf(cliDiag(),"error, unknown property name\n");
 								break;
 							}
 							printf("%s\n",aa.c_str());
@@ -1058,14 +6631,15 @@ static int cli(int argc,char **argv)
 				}
 			}
 		}
-		if (!bNetworkFound) {
+		if ((scode == 200)&&(!bNetworkFound)) {
 			fprintf(stderr,"unknown network ID, check that you are a member of the network\n");
+			return ZT_CLI_EXIT_NOT_FOUND;
 		}
 		if (scode == 200) {
 			return 0;
 		} else {
-			printf("%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"%u %s %s" ZT_EOL_S,scode,command.c_str(),responseBody.c_str());
+			return cliExitCode(scode);
 		}
 	} else if (command == "dump") {
 		std::stringstream dump;
@@ -1086,8 +6660,8 @@ static int cli(int argc,char **argv)
 		dump << "status" << ZT_EOL_S << "------" << ZT_EOL_S;
 		unsigned int scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/status",requestHeaders,responseHeaders,responseBody);
 		if (scode != 200) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return cliExitCode(scode);
 		}
 		dump << responseBody << ZT_EOL_S;
 
@@ -1098,8 +6672,8 @@ static int cli(int argc,char **argv)
 		dump << ZT_EOL_S << "networks" << ZT_EOL_S << "--------" << ZT_EOL_S;
 		scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/network",requestHeaders,responseHeaders,responseBody);
 		if (scode != 200) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return cliExitCode(scode);
 		}
 		dump << responseBody << ZT_EOL_S;
 
@@ -1110,8 +6684,8 @@ static int cli(int argc,char **argv)
 		dump << ZT_EOL_S << "peers" << ZT_EOL_S << "-----" << ZT_EOL_S;
 		scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/peer",requestHeaders,responseHeaders,responseBody);
 		if (scode != 200) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return cliExitCode(scode);
 		}
 		dump << responseBody << ZT_EOL_S;
 
@@ -1119,8 +6693,8 @@ static int cli(int argc,char **argv)
 		dump << ZT_EOL_S << "bonds" << ZT_EOL_S << "-----" << ZT_EOL_S;
 		scode = Http::GET(1024 * 1024 * 16,60000,(const struct sockaddr *)&addr,"/bonds",requestHeaders,responseHeaders,responseBody);
 		if (scode != 200) {
-			printf("Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
-			return 1;
+			fprintf(cliDiag(),"Error connecting to the ZeroTier service: %s\n\nPlease check that the service is running and that TCP port 9993 can be contacted via 127.0.0.1." ZT_EOL_S, responseBody.c_str());
+			return cliExitCode(scode);
 		}
 		dump << responseBody << ZT_EOL_S;
 
@@ -1202,7 +6776,7 @@ static int cli(int argc,char **argv)
 		int fd = open((char*)path, O_CREAT|O_RDWR,0664);
 		if (fd == -1) {
 			fprintf(stderr, "Error creating file.\n");
-			return 1;
+			return ZT_CLI_EXIT_FAILED;
 		}
 		write(fd, dump.str().c_str(), dump.str().size());	
 		close(fd);
@@ -1298,7 +6872,7 @@ static int cli(int argc,char **argv)
 			);
 			if (err = FALSE) {
 				fprintf(stderr, "Error writing file");
-				return 1;
+				return ZT_CLI_EXIT_FAILED;
 			}
 			CloseHandle(file);
 		}
@@ -1374,7 +6948,7 @@ static int cli(int argc,char **argv)
 		int fd = open(cwd, O_CREAT|O_RDWR,0664);
 		if (fd == -1) {
 			fprintf(stderr, "Error creating file.\n");
-			return 1;
+			return ZT_CLI_EXIT_FAILED;
 		}
 		write(fd, dump.str().c_str(), dump.str().size());	
 		close(fd);
@@ -1384,9 +6958,11 @@ static int cli(int argc,char **argv)
 
 		// fprintf(stderr, "%s\n", dump.str().c_str());
 
+	} else if (command == "controller") {
+		return cliController(argv[0],homeDir,args,longOpts,json,addr,requestHeaders);
 	} else {
 		cliPrintHelp(argv[0],stderr);
-		return 0;
+		return ZT_CLI_EXIT_USAGE;
 	}
 
 	return 0;
@@ -1405,14 +6981,19 @@ static void idtoolPrintHelp(FILE *out,const char *pn)
 	fprintf(out,
 		COPYRIGHT_NOTICE ZT_EOL_S
 		LICENSE_GRANT ZT_EOL_S);
-	fprintf(out,"Usage: %s <command> [<args>]" ZT_EOL_S"" ZT_EOL_S"Commands:" ZT_EOL_S,pn);
+	fprintf(out,"Usage: %s [--encoding=hex|base32] <command> [<args>]" ZT_EOL_S"" ZT_EOL_S"Commands:" ZT_EOL_S,pn);
 	fprintf(out,"  generate [<identity.secret>] [<identity.public>] [<vanity>]" ZT_EOL_S);
+	fprintf(out,"  batchgenerate <count> <directory> [<threads>]" ZT_EOL_S);
 	fprintf(out,"  validate <identity.secret/public>" ZT_EOL_S);
 	fprintf(out,"  getpublic <identity.secret>" ZT_EOL_S);
 	fprintf(out,"  sign <identity.secret> <file>" ZT_EOL_S);
 	fprintf(out,"  verify <identity.secret/public> <file> <signature>" ZT_EOL_S);
+	fprintf(out,"  verifymanifest <identity.secret/public> <manifest>" ZT_EOL_S);
 	fprintf(out,"  initmoon <identity.public of first seed>" ZT_EOL_S);
 	fprintf(out,"  genmoon <moon json>" ZT_EOL_S);
+	fprintf(out,"  genplanet <output file> <signing identity.secret> [<roots json>|-]" ZT_EOL_S);
+	fprintf(out,"  showworld <planet/moon file>" ZT_EOL_S);
+	fprintf(out,"  verifyworld <planet/moon file>" ZT_EOL_S);
 }
 
 static Identity getIdFromArg(char *arg)
@@ -1437,6 +7018,18 @@ static int idtool(int argc, _TCHAR* argv[])
 static int idtool(int argc,char **argv)
 #endif
 {
+	// --encoding may come anywhere, and is taken out so each command sees only its own arguments
+	int argn = 1;
+	for(int i=1;i<argc;++i) {
+		if (!strncmp(argv[i],"--encoding=",11)) {
+			if (!cliParseEncoding(std::string(argv[i] + 11),cliEncoding)) {
+				fprintf(stderr,"invalid --encoding: expected hex or base32" ZT_EOL_S);
+				return 1;
+			}
+		} else argv[argn++] = argv[i];
+	}
+	argc = argn;
+
 	if (argc < 2) {
 		idtoolPrintHelp(stdout,argv[0]);
 		return 1;
@@ -1479,7 +7072,59 @@ static int idtool(int argc,char **argv)
 					return 1;
 				} else printf("%s written" ZT_EOL_S,argv[3]);
 			}
-		} else printf("%s",idser.c_str());
+		} else printf("%s",id.toString(true,idtmp,cliEncoding));
+	} else if (!strcmp(argv[1],"batchgenerate")) {
+		if (argc < 4) {
+			idtoolPrintHelp(stdout,argv[0]);
+			return 1;
+		}
+		const unsigned long count = Utils::strToULong(argv[2]);
+		unsigned long threadCount = (argc >= 5) ? Utils::strToULong(argv[4]) : (unsigned long)std::thread::hardware_concurrency();
+		if (threadCount == 0)
+			threadCount = 1;
+		if (threadCount > count)
+			threadCount = count;
+		if (count == 0) {
+			fprintf(stderr,"count must be at least 1" ZT_EOL_S);
+			return 1;
+		}
+		const std::string dir(argv[3]);
+		if (!OSUtils::mkdir(dir)) {
+			fprintf(stderr,"unable to create directory %s" ZT_EOL_S,dir.c_str());
+			return 1;
+		}
+
+		// Generation is memory-hard and CPU bound, so each thread takes the next slot until all are done
+		std::atomic<unsigned long> next(0),written(0),failed(0);
+		const int64_t start = OSUtils::now();
+		std::vector<std::thread> threads;
+		for(unsigned long t=0;t<threadCount;++t) {
+			threads.push_back(std::thread([&]() {
+				char idtmp[1024];
+				while (next++ < count) {
+					Identity id;
+					std::string fn;
+					do {
+						id.generate();
+						fn = dir + ZT_PATH_SEPARATOR_S + id.address().toString(idtmp) + ".secret";
+					} while (OSUtils::fileExists(fn.c_str(),false)); // never overwrite, however unlikely a collision is
+					if (OSUtils::writeSecretFile(fn.c_str(),std::string(id.toString(true,idtmp)),true)) {
+						++written;
+					} else {
+						fprintf(stderr,"Error writing to %s" ZT_EOL_S,fn.c_str());
+						++failed;
+					}
+				}
+			}));
+		}
+		for(std::vector<std::thread>::iterator t(threads.begin());t!=threads.end();++t)
+			t->join();
+
+		printf("%lu identities written to %s in %.2fs using %lu threads" ZT_EOL_S,(unsigned long)written,dir.c_str(),(double)(OSUtils::now() - start) / 1000.0,threadCount);
+		if (failed > 0) {
+			fprintf(stderr,"%lu identities could not be written" ZT_EOL_S,(unsigned long)failed);
+			return 1;
+		}
 	} else if (!strcmp(argv[1],"validate")) {
 		if (argc < 3) {
 			idtoolPrintHelp(stdout,argv[0]);
@@ -1509,7 +7154,7 @@ static int idtool(int argc,char **argv)
 		}
 
 		char idtmp[1024];
-		printf("%s",id.toString(false,idtmp));
+		printf("%s",id.toString(false,idtmp,cliEncoding));
 	} else if (!strcmp(argv[1],"sign")) {
 		if (argc < 4) {
 			idtoolPrintHelp(stdout,argv[0]);
@@ -1572,6 +7217,69 @@ static int idtool(int argc,char **argv)
 				return 1;
 			}
 		}
+	} else if (!strcmp(argv[1],"verifymanifest")) {
+		if (argc < 4) {
+			idtoolPrintHelp(stdout,argv[0]);
+			return 1;
+		}
+
+		Identity id = getIdFromArg(argv[2]);
+		if (!id) {
+			fprintf(stderr,"Identity argument invalid or file unreadable: %s" ZT_EOL_S,argv[2]);
+			return 1;
+		}
+
+		std::string manifest;
+		if (!OSUtils::readFile(argv[3],manifest)) {
+			fprintf(stderr,"%s is not readable" ZT_EOL_S,argv[3]);
+			return 1;
+		}
+
+		// Paths in the manifest are relative to the directory it is in
+		std::string baseDir(argv[3]);
+		std::size_t sep = baseDir.find_last_of("/" ZT_PATH_SEPARATOR_S);
+		baseDir = (sep == std::string::npos) ? std::string() : baseDir.substr(0,sep + 1);
+
+		unsigned long passed = 0,failed = 0,lineNo = 0;
+		std::istringstream lines(manifest);
+		std::string line;
+		while (std::getline(lines,line)) {
+			++lineNo;
+			line = cliTrim(line);
+			if ((line.empty())||(line[0] == '#'))
+				continue;
+
+			const std::size_t ws = line.find_first_of(" \t");
+			if (ws == std::string::npos) {
+				fprintf(stderr,"%s:%lu: expected <signature> <path>" ZT_EOL_S,argv[3],lineNo);
+				++failed;
+				continue;
+			}
+			const std::string path(cliTrim(line.substr(ws)));
+			const std::string fullPath(((path[0] == '/')||(path[0] == ZT_PATH_SEPARATOR)) ? path : (baseDir + path));
+
+			char buf[4096];
+			const std::string signature(buf,Utils::unhex(line.substr(0,ws).c_str(),buf,(unsigned int)sizeof(buf)));
+			std::string inf;
+			if (!OSUtils::readFile(fullPath.c_str(),inf)) {
+				printf("%s: FAILED (not readable)" ZT_EOL_S,path.c_str());
+				++failed;
+			} else if (id.verify(inf.data(),(unsigned int)inf.length(),signature.data(),(unsigned int)signature.length())) {
+				printf("%s: OK" ZT_EOL_S,path.c_str());
+				++passed;
+			} else {
+				printf("%s: FAILED" ZT_EOL_S,path.c_str());
+				++failed;
+			}
+		}
+
+		if ((passed + failed) == 0) {
+			fprintf(stderr,"%s has no entries" ZT_EOL_S,argv[3]);
+			return 1;
+		}
+		printf("%lu passed, %lu failed" ZT_EOL_S,passed,failed);
+		if (failed)
+			return 1;
 	} else if (!strcmp(argv[1],"initmoon")) {
 		if (argc < 3) {
 			idtoolPrintHelp(stdout,argv[0]);
@@ -1660,6 +7368,128 @@ static int idtool(int argc,char **argv)
 			OSUtils::writeFile(fn,wbuf.data(),wbuf.size());
 			printf("wrote %s (signed world with timestamp %llu)" ZT_EOL_S,fn,(unsigned long long)now);
 		}
+	} else if (!strcmp(argv[1],"genplanet")) {
+		if ((argc < 4)||(argc > 5)) {
+			idtoolPrintHelp(stdout,argv[0]);
+			return 1;
+		}
+
+		const Identity signer = getIdFromArg(argv[3]);
+		if ((!signer)||(!signer.hasPrivate())) {
+			fprintf(stderr,"%s is not a valid identity with a secret key" ZT_EOL_S,argv[3]);
+			return 1;
+		}
+
+		// Roots come from a file or standard input, as an array or as an object with a roots array (e.g. showworld output)
+		std::string buf;
+		if ((argc == 5)&&(strcmp(argv[4],"-") != 0)) {
+			if (!OSUtils::readFile(argv[4],buf)) {
+				fprintf(stderr,"cannot read %s" ZT_EOL_S,argv[4]);
+				return 1;
+			}
+		} else {
+			char tmp[4096];
+			std::size_t n;
+			while ((n = fread(tmp,1,sizeof(tmp),stdin)) > 0)
+				buf.append(tmp,n);
+		}
+		nlohmann::json pj;
+		try {
+			pj = OSUtils::jsonParse(buf);
+		} catch ( ... ) {
+			fprintf(stderr,"roots are not valid JSON" ZT_EOL_S);
+			return 1;
+		}
+		nlohmann::json rootsj((pj.is_object()) ? pj["roots"] : pj);
+		if ((!rootsj.is_array())||(rootsj.empty())||(rootsj.size() > ZT_WORLD_MAX_ROOTS)) {
+			fprintf(stderr,"roots must be an array of 1 to %d objects with an identity and stableEndpoints" ZT_EOL_S,ZT_WORLD_MAX_ROOTS);
+			return 1;
+		}
+
+		// A private planet normally keeps the default planet's ID so nodes will accept it in place of the default
+		uint64_t id = ZT_WORLD_ID_EARTH;
+		int64_t ts = OSUtils::now();
+		C25519::Public updatesMustBeSignedBy(signer.publicKey());
+		if (pj.is_object()) {
+			if (pj.count("id"))
+				id = Utils::hexStrToU64(OSUtils::jsonString(pj["id"],"0").c_str());
+			if (pj.count("updatesMustBeSignedBy")) {
+				if (Utils::unhex(OSUtils::jsonString(pj["updatesMustBeSignedBy"],"").c_str(),updatesMustBeSignedBy.data,ZT_C25519_PUBLIC_KEY_LEN) != ZT_C25519_PUBLIC_KEY_LEN) {
+					fprintf(stderr,"updatesMustBeSignedBy must be a %d byte public key in hex" ZT_EOL_S,ZT_C25519_PUBLIC_KEY_LEN);
+					return 1;
+				}
+			}
+		}
+		if (!id) {
+			fprintf(stderr,"planet ID is invalid" ZT_EOL_S);
+			return 1;
+		}
+
+		std::vector<World::Root> roots;
+		for(unsigned long i=0;i<(unsigned long)rootsj.size();++i) {
+			nlohmann::json &r = rootsj[i];
+			const std::string ids((r.is_object()) ? OSUtils::jsonString(r["identity"],"") : std::string());
+			World::Root root;
+			if ((!root.identity.fromString(ids.c_str()))||(!root.identity.locallyValidate())) {
+				fprintf(stderr,"root %lu: invalid identity" ZT_EOL_S,i);
+				return 1;
+			}
+			nlohmann::json &eps = r["stableEndpoints"];
+			if ((!eps.is_array())||(eps.empty())||(eps.size() > ZT_WORLD_MAX_STABLE_ENDPOINTS_PER_ROOT)) {
+				fprintf(stderr,"root %lu: stableEndpoints must list 1 to %d IP/port endpoints" ZT_EOL_S,i,ZT_WORLD_MAX_STABLE_ENDPOINTS_PER_ROOT);
+				return 1;
+			}
+			for(unsigned long k=0;k<(unsigned long)eps.size();++k) {
+				const std::string eps2(OSUtils::jsonString(eps[k],""));
+				const InetAddress ep(eps2.c_str());
+				if (((ep.ss_family != AF_INET)&&(ep.ss_family != AF_INET6))||(ep.port() == 0)) {
+					fprintf(stderr,"root %lu: invalid endpoint %s, expected IP/port" ZT_EOL_S,i,eps2.c_str());
+					return 1;
+				}
+				root.stableEndpoints.push_back(ep);
+			}
+			std::sort(root.stableEndpoints.begin(),root.stableEndpoints.end());
+			roots.push_back(root);
+		}
+		std::sort(roots.begin(),roots.end());
+
+		World w(World::make(World::TYPE_PLANET,id,ts,updatesMustBeSignedBy,roots,signer.privateKeyPair()));
+		Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> wbuf;
+		w.serialize(wbuf);
+		if (!OSUtils::writeFile(argv[2],wbuf.data(),wbuf.size())) {
+			fprintf(stderr,"cannot write %s" ZT_EOL_S,argv[2]);
+			return 1;
+		}
+		printf("wrote %s (signed planet %.16llx with %u roots, timestamp %llu)" ZT_EOL_S,argv[2],(unsigned long long)id,(unsigned int)roots.size(),(unsigned long long)ts);
+	} else if (!strcmp(argv[1],"showworld")) {
+		if (argc < 3) {
+			idtoolPrintHelp(stdout,argv[0]);
+			return 1;
+		}
+
+		World w;
+		if (!getWorldFromFile(argv[2],w)) {
+			fprintf(stderr,"%s is not readable or is not a valid planet/moon file" ZT_EOL_S,argv[2]);
+			return 1;
+		}
+
+		printf("%s" ZT_EOL_S,OSUtils::jsonDump(worldToJson(w)).c_str());
+	} else if (!strcmp(argv[1],"verifyworld")) {
+		if (argc != 3) {
+			idtoolPrintHelp(stdout,argv[0]);
+			return 1;
+		}
+
+		World w;
+		if (!getWorldFromFile(argv[2],w)) {
+			fprintf(stderr,"%s is not readable or is not a valid planet/moon file" ZT_EOL_S,argv[2]);
+			printf("INVALID" ZT_EOL_S);
+			return 1;
+		}
+
+		const bool valid = printWorld(w);
+		printf("%s" ZT_EOL_S,(valid) ? "VALID" : "INVALID");
+		return (valid) ? 0 : 1;
 	} else {
 		idtoolPrintHelp(stdout,argv[0]);
 		return 1;
@@ -2045,6 +7875,11 @@ public:
 							OSUtils::rm((homeDir + ZT_PATH_SEPARATOR_S + "identity.public").c_str());
 						}
 					}	continue; // restart!
+					case OneService::ONE_IDENTITY_REPLACED:
+					case OneService::ONE_PLANET_REPLACED:
+						delete zt1Service;
+						zt1Service = (OneService *)0;
+						continue; // restart with new identity or planet
 				}
 				break; // terminate loop -- normally we don't keep restarting
 			}
@@ -2162,7 +7997,12 @@ int main(int argc,char **argv)
 					if (argv[i][2]) {
 						printHelp(argv[0],stdout);
 						return 0;
-					} else return cli(argc,argv);
+					} else {
+						// Drop this -q so a later one can mean quiet mode to the cli
+						for(int k=i;k<(argc - 1);++k)
+							argv[k] = argv[k + 1];
+						return cli(argc - 1,argv);
+					}
 
 #ifdef __WINDOWS__
 				case 'C': // Run from command line instead of as Windows service
@@ -322,6 +322,35 @@ bool OSUtils::writeFile(const char *path,const void *buf,unsigned int len)
 	return false;
 }
 
+bool OSUtils::writeSecretFile(const char *path,const std::string &s,bool exclusive)
+{
+#ifdef __WINDOWS__
+	if ((exclusive)&&(fileExists(path,false)))
+		return false;
+	if (!writeFile(path,s))
+		return false;
+	lockDownFile(path,false);
+	return true;
+#else
+	const int fd = ::open(path,O_WRONLY|O_CREAT|((exclusive) ? O_EXCL : O_TRUNC),0600);
+	if (fd < 0)
+		return false;
+	fchmod(fd,0600); // an existing file keeps its mode through O_TRUNC
+	bool ok = true;
+	for(std::string::size_type w=0;w<s.length();) {
+		const ssize_t n = ::write(fd,s.data() + w,s.length() - w);
+		if (n <= 0) {
+			ok = false;
+			break;
+		}
+		w += (std::string::size_type)n;
+	}
+	if (::close(fd) != 0)
+		ok = false;
+	return ok;
+#endif
+}
+
 std::vector<std::string> OSUtils::split(const char *s,const char *const sep,const char *esc,const char *quot)
 {
 	std::vector<std::string> fields;
@@ -272,6 +272,20 @@ public:
 	 */
 	static inline bool writeFile(const char *path,const std::string &s) { return writeFile(path,s.data(),(unsigned int)s.length()); }
 
+	/**
+	 * Write a file that holds secrets, replacing any current file contents
+	 *
+	 * The file is created readable only by its owner, so no other user can open
+	 * it even if the write fails part way. On Windows it is locked down after
+	 * writing instead.
+	 *
+	 * @param path Path to write
+	 * @param s Data to write
+	 * @param exclusive If true, fail rather than replace an existing file
+	 * @return True if entire file was successfully written
+	 */
+	static bool writeSecretFile(const char *path,const std::string &s,bool exclusive = false);
+
 	/**
 	 * @param c ASCII character to convert
 	 * @return Lower case ASCII character or unchanged if not a letter
@@ -20,7 +20,14 @@
 #include <iostream>
 #include <string>
 #include <vector>
+#include <map>
+#include <set>
+#include <algorithm>
 #include <thread>
+#include <mutex>
+#include <atomic>
+#include <condition_variable>
+#include <functional>
 
 #include "node/Constants.hpp"
 #include "node/Hashtable.hpp"
@@ -34,18 +41,30 @@
 #include "node/MAC.hpp"
 #include "node/NetworkConfig.hpp"
 #include "node/Peer.hpp"
+#include "node/Path.hpp"
 #include "node/Dictionary.hpp"
 #include "node/SHA512.hpp"
+#include "node/Argon2.hpp"
 #include "node/C25519.hpp"
 #include "node/Poly1305.hpp"
 #include "node/CertificateOfMembership.hpp"
 #include "node/Node.hpp"
 #include "node/IncomingPacket.hpp"
+#include "node/World.hpp"
 
 #include "osdep/OSUtils.hpp"
 #include "osdep/Phy.hpp"
 #include "osdep/PortMapper.hpp"
 #include "osdep/Thread.hpp"
+#include "osdep/Http.hpp"
+
+#include "controller/EmbeddedNetworkController.hpp"
+#include "controller/FileDB.hpp"
+#include "controller/SQLiteDB.hpp"
+#include "controller/RulesCompiler.hpp"
+#include "service/OneService.hpp"
+
+#include "ext/json/json.hpp"
 
 #if defined(ZT_USE_X64_ASM_SALSA2012) && defined(ZT_ARCH_X64)
 #include "ext/x64-salsa2012-asm/salsa2012.h"
@@ -58,6 +77,21 @@
 #include <tchar.h>
 #endif
 
+#ifdef __UNIX_LIKE__
+#include <unistd.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <signal.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <sys/wait.h>
+#include <sys/ioctl.h>
+#include <ifaddrs.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+extern char **environ;
+#endif
+
 using namespace ZeroTier;
 
 //////////////////////////////////////////////////////////////////////////////
@@ -84,6 +118,21 @@ static const unsigned char poly1305TV1Tag[16] = { 0xa6,0xf7,0x45,0x00,0x8f,0x81,
 static const char *sha512TV0Input = "supercalifragilisticexpealidocious";
 static const unsigned char sha512TV0Digest[64] = { 0x18,0x2a,0x85,0x59,0x69,0xe5,0xd3,0xe6,0xcb,0xf6,0x05,0x24,0xad,0xf2,0x88,0xd1,0xbb,0xf2,0x52,0x92,0x81,0x24,0x31,0xf6,0xd2,0x52,0xf1,0xdb,0xc1,0xcb,0x44,0xdf,0x21,0x57,0x3d,0xe1,0xb0,0x6b,0x68,0x75,0x95,0x9f,0x3b,0x6f,0x87,0xb1,0x13,0x81,0xd0,0xbc,0x79,0x2c,0x43,0x3a,0x13,0x55,0x3c,0xe0,0x84,0xc2,0x92,0x55,0x31,0x1c };
 
+// RFC 4231 test cases 1 and 6 (the second uses a key longer than the block size)
+static const unsigned char hmacSha384TV0Mac[48] = { 0xaf,0xd0,0x39,0x44,0xd8,0x48,0x95,0x62,0x6b,0x08,0x25,0xf4,0xab,0x46,0x90,0x7f,0x15,0xf9,0xda,0xdb,0xe4,0x10,0x1e,0xc6,0x82,0xaa,0x03,0x4c,0x7c,0xeb,0xc5,0x9c,0xfa,0xea,0x9e,0xa9,0x07,0x6e,0xde,0x7f,0x4a,0xf1,0x52,0xe8,0xb2,0xfa,0x9c,0xb6 };
+static const unsigned char hmacSha384TV1Mac[48] = { 0x4e,0xce,0x08,0x44,0x85,0x81,0x3e,0x90,0x88,0xd2,0xc6,0x3a,0x04,0x1b,0xc5,0xb4,0x4f,0x9e,0xf1,0x01,0x2a,0x2b,0x58,0x8f,0x3c,0xd1,0x1f,0x05,0x03,0x3a,0xc4,0xc6,0x0c,0x2e,0xf6,0xab,0x40,0x30,0xfe,0x82,0x96,0x24,0x8d,0xf1,0x63,0xf4,0x49,0x52 };
+
+// RFC 9106 section 5.3: Argon2id with t=3, m=32 KiB, p=4 and a secret and associated data
+static const unsigned char argon2idTVTag[32] = { 0x0d,0x64,0x0d,0xf5,0x8d,0x78,0x76,0x6c,0x08,0xc0,0x37,0xa3,0x4a,0x8b,0x53,0xc9,0xd0,0x1e,0xf0,0x45,0x2d,0x75,0xb6,0x5e,0xb5,0x25,0x20,0xe9,0x6b,0x01,0xe6,0x59 };
+
+// AES-256-GCM test case 16 from the GCM specification (60 byte plaintext and 20 bytes of AAD)
+static const unsigned char aesGcmTVKey[32] = { 0xfe,0xff,0xe9,0x92,0x86,0x65,0x73,0x1c,0x6d,0x6a,0x8f,0x94,0x67,0x30,0x83,0x08,0xfe,0xff,0xe9,0x92,0x86,0x65,0x73,0x1c,0x6d,0x6a,0x8f,0x94,0x67,0x30,0x83,0x08 };
+static const unsigned char aesGcmTVIV[12] = { 0xca,0xfe,0xba,0xbe,0xfa,0xce,0xdb,0xad,0xde,0xca,0xf8,0x88 };
+static const unsigned char aesGcmTVAAD[20] = { 0xfe,0xed,0xfa,0xce,0xde,0xad,0xbe,0xef,0xfe,0xed,0xfa,0xce,0xde,0xad,0xbe,0xef,0xab,0xad,0xda,0xd2 };
+static const unsigned char aesGcmTVPlaintext[60] = { 0xd9,0x31,0x32,0x25,0xf8,0x84,0x06,0xe5,0xa5,0x59,0x09,0xc5,0xaf,0xf5,0x26,0x9a,0x86,0xa7,0xa9,0x53,0x15,0x34,0xf7,0xda,0x2e,0x4c,0x30,0x3d,0x8a,0x31,0x8a,0x72,0x1c,0x3c,0x0c,0x95,0x95,0x68,0x09,0x53,0x2f,0xcf,0x0e,0x24,0x49,0xa6,0xb5,0x25,0xb1,0x6a,0xed,0xf5,0xaa,0x0d,0xe6,0x57,0xba,0x63,0x7b,0x39 };
+static const unsigned char aesGcmTVCiphertext[60] = { 0x52,0x2d,0xc1,0xf0,0x99,0x56,0x7d,0x07,0xf4,0x7f,0x37,0xa3,0x2a,0x84,0x42,0x7d,0x64,0x3a,0x8c,0xdc,0xbf,0xe5,0xc0,0xc9,0x75,0x98,0xa2,0xbd,0x25,0x55,0xd1,0xaa,0x8c,0xb0,0x8e,0x48,0x59,0x0d,0xbb,0x3d,0xa7,0xb0,0x8b,0x10,0x56,0x82,0x88,0x38,0xc5,0xf6,0x1e,0x63,0x93,0xba,0x7a,0x0a,0xbc,0xc9,0xf6,0x62 };
+static const unsigned char aesGcmTVTag[16] = { 0x76,0xfc,0x6e,0xce,0x0f,0x4e,0x17,0x68,0xcd,0xdf,0x88,0x53,0xbb,0x2d,0x55,0x1b };
+
 struct C25519TestVector
 {
 	unsigned char pub1[64];
@@ -288,6 +337,68 @@ static int testCrypto()
 	}
 	std::cout << "PASS" << std::endl;
 
+	std::cout << "[crypto] Testing HMAC-SHA384... "; std::cout.flush();
+	memset(buf2,0x0b,20);
+	HMACSHA384(buf2,20,"Hi There",8,(uint8_t *)buf1);
+	if (memcmp(buf1,hmacSha384TV0Mac,48)) {
+		std::cout << "FAIL (1)" << std::endl;
+		return -1;
+	}
+	memset(buf2,0xaa,131);
+	HMACSHA384(buf2,131,"Test Using Larger Than Block-Size Key - Hash Key First",54,(uint8_t *)buf1);
+	if (memcmp(buf1,hmacSha384TV1Mac,48)) {
+		std::cout << "FAIL (2)" << std::endl;
+		return -1;
+	}
+	std::cout << "PASS" << std::endl;
+
+	std::cout << "[crypto] Testing Argon2id... "; std::cout.flush();
+	memset(buf2,0x01,32);
+	memset(buf2 + 32,0x02,16);
+	memset(buf2 + 48,0x03,8);
+	memset(buf2 + 56,0x04,12);
+	if ((!Argon2id(buf2,32,buf2 + 32,16,buf2 + 48,8,buf2 + 56,12,3,32,4,(uint8_t *)buf1,32))||(memcmp(buf1,argon2idTVTag,32))) {
+		std::cout << "FAIL (1)" << std::endl;
+		return -1;
+	}
+	if ((Argon2id(buf2,32,buf2 + 32,16,(const void *)0,0,(const void *)0,0,3,31,4,(uint8_t *)buf1,32))||(Argon2id(buf2,32,buf2 + 32,4,(const void *)0,0,(const void *)0,0,3,32,4,(uint8_t *)buf1,32))) {
+		std::cout << "FAIL (2: out of range parameters accepted)" << std::endl;
+		return -1;
+	}
+	std::cout << "PASS" << std::endl;
+
+	std::cout << "[crypto] Testing AES-256-GCM... "; std::cout.flush();
+	{
+		AES aes(aesGcmTVKey);
+		uint8_t tag[16];
+		aes.gcmEncrypt(aesGcmTVIV,aesGcmTVAAD,20,aesGcmTVPlaintext,60,buf1,tag);
+		if ((memcmp(buf1,aesGcmTVCiphertext,60))||(memcmp(tag,aesGcmTVTag,16))) {
+			std::cout << "FAIL (1)" << std::endl;
+			return -1;
+		}
+		memset(buf2,0,60);
+		if ((!aes.gcmDecrypt(aesGcmTVIV,aesGcmTVAAD,20,aesGcmTVCiphertext,60,buf2,aesGcmTVTag))||(memcmp(buf2,aesGcmTVPlaintext,60))) {
+			std::cout << "FAIL (2)" << std::endl;
+			return -1;
+		}
+		memcpy(buf1,aesGcmTVCiphertext,60);
+		buf1[17] ^= 0x01;
+		memset(buf2,0,60);
+		const bool accepted = aes.gcmDecrypt(aesGcmTVIV,aesGcmTVAAD,20,buf1,60,buf2,aesGcmTVTag);
+		bool untouched = true;
+		for(unsigned int i=0;i<60;++i)
+			untouched &= (buf2[i] == 0);
+		if ((accepted)||(!untouched)) {
+			std::cout << "FAIL (3: tampered ciphertext accepted)" << std::endl;
+			return -1;
+		}
+		if (aes.gcmDecrypt(aesGcmTVIV,aesGcmTVAAD,19,aesGcmTVCiphertext,60,buf2,aesGcmTVTag)) {
+			std::cout << "FAIL (4: wrong AAD accepted)" << std::endl;
+			return -1;
+		}
+	}
+	std::cout << "PASS" << std::endl;
+
 	std::cout << "[crypto] Testing Poly1305... "; std::cout.flush();
 	Poly1305::compute(buf1,poly1305TV0Input,sizeof(poly1305TV0Input),poly1305TV0Key);
 	if (memcmp(buf1,poly1305TV0Tag,16)) {
@@ -674,6 +785,19 @@ static int testOther()
 		return -1;
 	}
 
+	std::cout << "[other] Testing base32 against RFC 4648 test vectors... "; std::cout.flush();
+	{
+		static const char *const b32in[7] = { "","f","fo","foo","foob","fooba","foobar" };
+		static const char *const b32out[7] = { "","my","mzxq","mzxw6","mzxw6yq","mzxw6ytb","mzxw6ytboi" };
+		for(int i=0;i<7;++i) {
+			if (strcmp(Utils::b32e(b32in[i],(unsigned int)strlen(b32in[i]),buf2),b32out[i]) != 0) {
+				std::cout << "FAIL (" << b32in[i] << " -> " << buf2 << ")" << std::endl;
+				return -1;
+			}
+		}
+	}
+	std::cout << "PASS" << std::endl;
+
 	std::cout << "[other] Testing InetAddress encode/decode..."; std::cout.flush();
 	std::cout << " " << InetAddress("127.0.0.1/9993").toString(buf);
 	std::cout << " " << InetAddress("feed:dead:babe:dead:beef:f00d:1234:5678/12345").toString(buf);
@@ -1050,70 +1174,3964 @@ static int testPhy()
 	return 0;
 }
 
+//////////////////////////////////////////////////////////////////////////////
+// Controller and CLI test fixtures
+
+// Longer than the controller ignores repeated config requests from a member for
+#define ZT_TEST_CONFIG_REQUEST_PERIOD 1100
+
+// Print why a check failed, for use as: if (!testCheck(x == y,"x")) return -1;
+static bool testCheck(const bool ok,const char *why)
+{
+	if (!ok)
+		std::cout << "FAIL (" << why << ")" << std::endl;
+	return ok;
+}
+
+// Areas named on the command line, or empty to run every test
+static std::vector<std::string> testAreas;
+static bool testSelected(const char *area)
+{
+	return ((testAreas.empty())||(std::find(testAreas.begin(),testAreas.end(),std::string(area)) != testAreas.end()));
+}
+
+// zerotier-cli next to this program, set in main()
+static std::string testCliPath;
+
+// Create an empty directory for a test under the system temporary directory
+static std::string testTempDir(const char *name)
+{
+	char tmp[256];
 #ifdef __WINDOWS__
-int __cdecl _tmain(int argc, _TCHAR* argv[])
+	char td[MAX_PATH];
+	GetTempPathA(sizeof(td),td);
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%szt-selftest-%lu-%s",td,(unsigned long)GetCurrentProcessId(),name);
 #else
-int main(int argc,char **argv)
+	const char *td = getenv("TMPDIR");
+	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%s/zt-selftest-%lu-%s",((td)&&(*td)) ? td : "/tmp",(unsigned long)getpid(),name);
 #endif
+	OSUtils::rmDashRf(tmp);
+	OSUtils::mkdir(tmp);
+	return std::string(tmp);
+}
+
+// Split an API path like network/<id>/member into its parts
+static std::vector<std::string> testPath(const std::string &path)
 {
-	int r = 0;
+	std::vector<std::string> ps;
+	std::string::size_type s = 0;
+	while (s <= path.length()) {
+		std::string::size_type e = path.find('/',s);
+		if (e == std::string::npos)
+			e = path.length();
+		if (e > s)
+			ps.push_back(path.substr(s,e - s));
+		s = e + 1;
+	}
+	return ps;
+}
 
-#ifdef __WINDOWS__
-	WSADATA wsaData;
-	WSAStartup(MAKEWORD(2,2),&wsaData);
-#endif
+// A network controller with its own Node and home directory. It answers config requests
+// through this object, so tests can act as members as well as call the controller's API.
+class TestController : public NetworkController::Sender
+{
+public:
+	TestController(const char *name,const std::string &localConf = std::string(),const bool ownIdentity = false) :
+		home(testTempDir(name)),
+		node((Node *)0),
+		controller((EmbeddedNetworkController *)0),
+		_nextPacketId(1)
+	{
+		if (localConf.length() > 0)
+			OSUtils::writeFile((home + ZT_PATH_SEPARATOR_S "local.conf").c_str(),localConf);
+		if (ownIdentity) {
+			Identity id;
+			id.generate();
+			char tmp[512];
+			_ownIdentity = id.toString(true,tmp);
+		}
 
-	// Code to generate the C25519 test vectors -- did this once and then
-	// put these up top so that we can ensure that every platform produces
-	// the same result.
-	/*
-	for(int k=0;k<32;++k) {
-		C25519::Pair p1 = C25519::generate();
-		C25519::Pair p2 = C25519::generate();
-		unsigned char agg[64];
-		C25519::agree(p1,p2.pub,agg,64);
-		C25519::Signature sig1 = C25519::sign(p1,agg,64);
-		C25519::Signature sig2 = C25519::sign(p2,agg,64);
-		printf("{{");
-		for(int i=0;i<64;++i)
-			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p1.pub.data[i]);
-		printf("},{");
-		for(int i=0;i<64;++i)
-			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p1.priv.data[i]);
-		printf("},{");
-		for(int i=0;i<64;++i)
-			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p2.pub.data[i]);
-		printf("},{");
-		for(int i=0;i<64;++i)
-			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p2.priv.data[i]);
-		printf("},{");
-		for(int i=0;i<64;++i)
-			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)agg[i]);
-		printf("},{");
-		for(int i=0;i<96;++i)
-			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)sig1.data[i]);
-		printf("},{");
-		for(int i=0;i<96;++i)
-			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)sig2.data[i]);
-		printf("}}\n");
+		ZT_Node_Callbacks cb;
+		memset(&cb,0,sizeof(cb));
+		cb.version = 0;
+		cb.statePutFunction = &_statePut;
+		cb.stateGetFunction = &_stateGet;
+		cb.wirePacketSendFunction = &_wirePacketSend;
+		cb.virtualNetworkFrameFunction = &_virtualNetworkFrame;
+		cb.virtualNetworkConfigFunction = &_virtualNetworkConfig;
+		cb.eventCallback = &_event;
+		node = new Node(this,(void *)0,&cb,OSUtils::now());
+
+		controller = new EmbeddedNetworkController(node,home.c_str(),(home + ZT_PATH_SEPARATOR_S "controller.d").c_str(),9993,(RedisConfig *)0);
+		controller->init(node->identity(),this);
+		char tmp[32];
+		address = node->identity().address().toString(tmp);
 	}
-	exit(0);
-	*/
 
-	std::cout << "[info] sizeof(void *) == " << sizeof(void *) << std::endl;
-	std::cout << "[info] OSUtils::now() == " << OSUtils::now() << std::endl;
-	std::cout << "[info] hardware concurrency == " << std::thread::hardware_concurrency() << std::endl;
-	std::cout << "[info] sizeof(NetworkConfig) == " << sizeof(ZeroTier::NetworkConfig) << std::endl;
+	~TestController()
+	{
+		delete controller;
+		delete node;
+		OSUtils::rmDashRf(home.c_str());
+	}
 
-	srand((unsigned int)time(0));
+	unsigned int get(const std::string &path,nlohmann::json &r,const std::map<std::string,std::string> &urlArgs = std::map<std::string,std::string>())
+	{
+		std::string body,ct;
+		const unsigned int scode = controller->handleControlPlaneHttpGET(testPath(path),urlArgs,std::map<std::string,std::string>(),std::string(),body,ct);
+		_parse(body,r);
+		return scode;
+	}
 
-	///*
-	r |= testOther();
-	r |= testCrypto();
-	r |= testPacket();
-	r |= testIdentity();
-	r |= testCertificate();
-	r |= testPhy();
+	unsigned int post(const std::string &path,const nlohmann::json &b,nlohmann::json &r,const std::map<std::string,std::string> &urlArgs = std::map<std::string,std::string>(),const char *actor = "authtoken")
+	{
+		std::map<std::string,std::string> headers;
+		headers["x-zt1-actor"] = actor;
+		std::string body,ct;
+		const unsigned int scode = controller->handleControlPlaneHttpPOST(testPath(path),urlArgs,headers,(b.is_null()) ? std::string() : OSUtils::jsonDump(b,-1),body,ct);
+		_parse(body,r);
+		return scode;
+	}
+
+	unsigned int del(const std::string &path,nlohmann::json &r,const std::map<std::string,std::string> &urlArgs = std::map<std::string,std::string>())
+	{
+		std::map<std::string,std::string> headers;
+		headers["x-zt1-actor"] = "authtoken";
+		std::string body,ct;
+		const unsigned int scode = controller->handleControlPlaneHttpDELETE(testPath(path),urlArgs,headers,std::string(),body,ct);
+		_parse(body,r);
+		return scode;
+	}
+
+	// Create a network with the given settings and return its ID, or an empty string on failure
+	std::string createNetwork(const nlohmann::json &settings = nlohmann::json::object())
+	{
+		nlohmann::json r;
+		if (post("network/" + address + "______",settings,r) != 200)
+			return std::string();
+		return OSUtils::jsonString(r["id"],"");
+	}
+
+	// Ask for a network's config as a member would, returning 1 if a config was sent, 0 if an
+	// error was, or -1 if there was no answer in time
+	int request(const std::string &nwid,const Identity &id,const unsigned long timeout = 15000)
+	{
+		Dictionary<ZT_NETWORKCONFIG_METADATA_DICT_CAPACITY> md;
+		md.add(ZT_NETWORKCONFIG_REQUEST_METADATA_KEY_RULES_ENGINE_REV,(uint64_t)ZT_RULES_ENGINE_REVISION);
+		uint64_t packetId;
+		{
+			std::lock_guard<std::mutex> l(_replies_l);
+			packetId = _nextPacketId++;
+		}
+		controller->request(Utils::hexStrToU64(nwid.c_str()),InetAddress("127.0.0.1/9993"),packetId,id,md);
+		std::unique_lock<std::mutex> l(_replies_l);
+		const int64_t until = OSUtils::now() + (int64_t)timeout;
+		while (_replies.find(packetId) == _replies.end()) {
+			if (OSUtils::now() >= until)
+				return -1;
+			_replies_c.wait_for(l,std::chrono::milliseconds(100));
+		}
+		return _replies[packetId];
+	}
+
+	virtual void ncSendConfig(uint64_t nwid,uint64_t requestPacketId,const Address &destination,const NetworkConfig &nc,bool sendLegacyFormatConfig)
+	{
+		std::lock_guard<std::mutex> l(_replies_l);
+		_replies[requestPacketId] = 1;
+		_replies_c.notify_all();
+	}
+	virtual void ncSendRevocation(const Address &destination,const Revocation &rev) {}
+	virtual void ncSendError(uint64_t nwid,uint64_t requestPacketId,const Address &destination,NetworkController::ErrorCode errorCode)
+	{
+		std::lock_guard<std::mutex> l(_replies_l);
+		_replies[requestPacketId] = 0;
+		_replies_c.notify_all();
+	}
+
+	const std::string home;
+	Node *node;
+	EmbeddedNetworkController *controller;
+	std::string address;
+
+private:
+	static void _parse(const std::string &body,nlohmann::json &r)
+	{
+		try {
+			r = (body.length() > 0) ? OSUtils::jsonParse(body) : nlohmann::json();
+		} catch ( ... ) {
+			r = nlohmann::json();
+		}
+	}
+
+	// Every test controller shares one identity, since generating them takes a while
+	static const std::string &_identity()
+	{
+		static std::string ids;
+		static std::mutex l;
+		std::lock_guard<std::mutex> ll(l);
+		if (ids.empty()) {
+			Identity id;
+			id.generate();
+			char tmp[512];
+			ids = id.toString(true,tmp);
+		}
+		return ids;
+	}
+
+	static void _statePut(ZT_Node *,void *,void *,enum ZT_StateObjectType,const uint64_t [2],const void *,int) {}
+	static int _stateGet(ZT_Node *,void *uptr,void *,enum ZT_StateObjectType type,const uint64_t [2],void *data,unsigned int maxlen)
+	{
+		if (type != ZT_STATE_OBJECT_IDENTITY_SECRET)
+			return -1;
+		const std::string &ids = (reinterpret_cast<TestController *>(uptr)->_ownIdentity.empty()) ? _identity() : reinterpret_cast<TestController *>(uptr)->_ownIdentity;
+		if (ids.length() > maxlen)
+			return -1;
+		memcpy(data,ids.data(),ids.length());
+		return (int)ids.length();
+	}
+	static int _wirePacketSend(ZT_Node *,void *,void *,int64_t,const struct sockaddr_storage *,const void *,unsigned int,unsigned int) { return 0; }
+	static void _virtualNetworkFrame(ZT_Node *,void *,void *,uint64_t,void **,uint64_t,uint64_t,unsigned int,unsigned int,const void *,unsigned int) {}
+	static int _virtualNetworkConfig(ZT_Node *,void *,void *,uint64_t,void **,enum ZT_VirtualNetworkConfigOperation,const ZT_VirtualNetworkConfig *) { return 0; }
+	static void _event(ZT_Node *,void *,void *,enum ZT_Event,const void *) {}
+
+	std::string _ownIdentity; // or empty to use the shared one
+	std::map<uint64_t,int> _replies;
+	uint64_t _nextPacketId;
+	std::mutex _replies_l;
+	std::condition_variable _replies_c;
+};
+
+#ifdef __UNIX_LIKE__
+
+// A minimal HTTP server on 127.0.0.1 for testing things that make HTTP requests. Requests are
+// answered one at a time by a handler, and one that returns 0 is left unanswered until the
+// server is destroyed so that timeouts can be tested.
+class TestHttpServer
+{
+public:
+	struct Request
+	{
+		std::string method;
+		std::string path;
+		std::map<std::string,std::string> headers; // names in lower case
+		std::string body;
+	};
+	typedef std::function<unsigned int (const Request &,std::string &)> Handler;
+
+	TestHttpServer(const Handler &h) :
+		_handler(h),
+		_port(0),
+		_run(true)
+	{
+		_s = socket(AF_INET,SOCK_STREAM,0);
+		struct sockaddr_in sa;
+		memset(&sa,0,sizeof(sa));
+		sa.sin_family = AF_INET;
+		sa.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+		socklen_t sl = sizeof(sa);
+		if ((bind(_s,(const struct sockaddr *)&sa,sizeof(sa)) == 0)&&(listen(_s,16) == 0)&&(getsockname(_s,(struct sockaddr *)&sa,&sl) == 0))
+			_port = ntohs(sa.sin_port);
+		_thread = std::thread([this]() { _main(); });
+	}
+
+	~TestHttpServer()
+	{
+		_run = false;
+		_thread.join();
+		::close(_s);
+		for(std::vector<int>::iterator c(_hung.begin());c!=_hung.end();++c)
+			::close(*c);
+	}
+
+	inline unsigned int port() const { return _port; }
+	inline std::string url(const char *path) const { return std::string("http://127.0.0.1:") + std::to_string(_port) + path; }
+	inline std::vector<Request> requests()
+	{
+		std::lock_guard<std::mutex> l(_requests_l);
+		return _requests;
+	}
+
+private:
+	void _main()
+	{
+		while (_run) {
+			struct pollfd pfd;
+			pfd.fd = _s;
+			pfd.events = POLLIN;
+			pfd.revents = 0;
+			if (poll(&pfd,1,100) <= 0)
+				continue;
+			const int c = accept(_s,(struct sockaddr *)0,(socklen_t *)0);
+			if (c < 0)
+				continue;
+			Request rq;
+			if (!_read(c,rq)) {
+				::close(c);
+				continue;
+			}
+			{
+				std::lock_guard<std::mutex> l(_requests_l);
+				_requests.push_back(rq);
+			}
+			std::string body;
+			const unsigned int scode = _handler(rq,body);
+			if (!scode) {
+				_hung.push_back(c);
+				continue;
+			}
+			char tmp[256];
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"HTTP/1.1 %u Test\r\nContent-Type: application/json\r\nContent-Length: %lu\r\nConnection: close\r\n\r\n",scode,(unsigned long)body.length());
+			std::string resp(tmp);
+			resp.append(body);
+			for(std::string::size_type sent=0;sent<resp.length();) {
+				const ssize_t n = ::send(c,resp.data() + sent,resp.length() - sent,0);
+				if (n <= 0)
+					break;
+				sent += (std::string::size_type)n;
+			}
+			::close(c);
+		}
+	}
+
+	static bool _read(const int c,Request &rq)
+	{
+		struct timeval tv;
+		tv.tv_sec = 5;
+		tv.tv_usec = 0;
+		setsockopt(c,SOL_SOCKET,SO_RCVTIMEO,&tv,sizeof(tv));
+
+		std::string d;
+		char buf[4096];
+		std::string::size_type he;
+		while ((he = d.find("\r\n\r\n")) == std::string::npos) {
+			const ssize_t n = ::recv(c,buf,sizeof(buf),0);
+			if (n <= 0)
+				return false;
+			d.append(buf,(std::string::size_type)n);
+		}
+
+		std::string::size_type eol = d.find("\r\n");
+		const std::string first(d.substr(0,eol));
+		const std::string::size_type sp1 = first.find(' ');
+		const std::string::size_type sp2 = first.find(' ',sp1 + 1);
+		if ((sp1 == std::string::npos)||(sp2 == std::string::npos))
+			return false;
+		rq.method = first.substr(0,sp1);
+		rq.path = first.substr(sp1 + 1,sp2 - sp1 - 1);
+		while (eol < he) {
+			const std::string::size_type next = d.find("\r\n",eol + 2);
+			const std::string line(d.substr(eol + 2,next - eol - 2));
+			const std::string::size_type colon = line.find(':');
+			if (colon != std::string::npos) {
+				std::string name(line.substr(0,colon));
+				for(std::string::size_type i=0;i<name.length();++i)
+					name[i] = OSUtils::toLower(name[i]);
+				std::string::size_type vs = colon + 1;
+				while ((vs < line.length())&&(line[vs] == ' '))
+					++vs;
+				rq.headers[name] = line.substr(vs);
+			}
+			eol = next;
+		}
+
+		const unsigned long cl = (rq.headers.count("content-length")) ? Utils::strToULong(rq.headers["content-length"].c_str()) : 0;
+		while (d.length() < (he + 4 + cl)) {
+			const ssize_t n = ::recv(c,buf,sizeof(buf),0);
+			if (n <= 0)
+				return false;
+			d.append(buf,(std::string::size_type)n);
+		}
+		rq.body = d.substr(he + 4,cl);
+		return true;
+	}
+
+	Handler _handler;
+	int _s;
+	unsigned int _port;
+	volatile bool _run;
+	std::thread _thread;
+	std::vector<int> _hung;
+	std::vector<Request> _requests;
+	std::mutex _requests_l;
+};
+
+// Run a program with the given arguments and extra environment variables (NO_COLOR is
+// always removed first), returning its exit status or -1 if it could not be run. With tty
+// its standard output is a pseudo-terminal, otherwise both outputs are pipes.
+static int testRun(const std::string &program,const std::vector<std::string> &args,std::string &out,std::string &err,const std::vector<std::string> &env = std::vector<std::string>(),const bool tty = false)
+{
+	out.clear();
+	err.clear();
+
+	int outFds[2] = { -1,-1 },errFds[2] = { -1,-1 };
+	std::string ptyName;
+	if (tty) {
+		outFds[0] = posix_openpt(O_RDWR|O_NOCTTY);
+		if ((outFds[0] < 0)||(grantpt(outFds[0]) != 0)||(unlockpt(outFds[0]) != 0)||(!ptsname(outFds[0])))
+			return -1;
+		ptyName = ptsname(outFds[0]);
+		struct winsize ws;
+		memset(&ws,0,sizeof(ws));
+		ws.ws_col = 80;
+		ws.ws_row = 24;
+		ioctl(outFds[0],TIOCSWINSZ,&ws);
+	} else if (pipe(outFds) != 0) {
+		return -1;
+	}
+	if (pipe(errFds) != 0)
+		return -1;
+
+	std::vector<std::string> envs;
+	for(char **e=environ;*e;++e) {
+		if (strncmp(*e,"NO_COLOR=",9) != 0)
+			envs.push_back(*e);
+	}
+	envs.insert(envs.end(),env.begin(),env.end());
+	std::vector<char *> argv,envp;
+	argv.push_back(const_cast<char *>(program.c_str()));
+	for(std::vector<std::string>::const_iterator a(args.begin());a!=args.end();++a)
+		argv.push_back(const_cast<char *>(a->c_str()));
+	argv.push_back((char *)0);
+	for(std::vector<std::string>::const_iterator e(envs.begin());e!=envs.end();++e)
+		envp.push_back(const_cast<char *>(e->c_str()));
+	envp.push_back((char *)0);
+
+	const pid_t pid = fork();
+	if (pid < 0)
+		return -1;
+	if (pid == 0) {
+		const int in = open("/dev/null",O_RDONLY);
+		dup2(in,0);
+		if (tty) {
+			setsid();
+			const int s = open(ptyName.c_str(),O_RDWR);
+			dup2(s,1);
+		} else {
+			dup2(outFds[1],1);
+		}
+		dup2(errFds[1],2);
+		for(int fd=3;fd<256;++fd)
+			::close(fd);
+		execve(program.c_str(),argv.data(),envp.data());
+		_exit(127);
+	}
+
+	if (!tty)
+		::close(outFds[1]);
+	::close(errFds[1]);
+	std::string *const sinks[2] = { &out,&err };
+	bool open[2] = { true,true };
+	while ((open[0])||(open[1])) {
+		struct pollfd pfds[2];
+		pfds[0].fd = (open[0]) ? outFds[0] : -1;
+		pfds[0].events = POLLIN;
+		pfds[0].revents = 0;
+		pfds[1].fd = (open[1]) ? errFds[0] : -1;
+		pfds[1].events = POLLIN;
+		pfds[1].revents = 0;
+		if (poll(pfds,2,60000) <= 0)
+			break;
+		for(int k=0;k<2;++k) {
+			if (pfds[k].revents) {
+				char buf[4096];
+				const ssize_t n = ::read(pfds[k].fd,buf,sizeof(buf));
+				if (n > 0)
+					sinks[k]->append(buf,(std::string::size_type)n);
+				else open[k] = false;
+			}
+		}
+	}
+	::close(outFds[0]);
+	::close(errFds[0]);
+
+	int status = 0;
+	if (waitpid(pid,&status,0) != pid)
+		return -1;
+	return (WIFEXITED(status)) ? WEXITSTATUS(status) : -1;
+}
+
+// The path of a program on PATH, or empty if it isn't there
+static std::string testFindProgram(const char *name)
+{
+	const char *path = getenv("PATH");
+	std::vector<std::string> dirs(OSUtils::split((path) ? path : "/usr/bin:/bin",":","",""));
+	for(std::vector<std::string>::const_iterator d(dirs.begin());d!=dirs.end();++d) {
+		const std::string p(*d + "/" + name);
+		if (access(p.c_str(),X_OK) == 0)
+			return p;
+	}
+	return std::string();
+}
+
+
+// Run zerotier-cli as testRun() does
+static int testRunCli(const std::vector<std::string> &args,std::string &out,std::string &err,const std::vector<std::string> &env = std::vector<std::string>(),const bool tty = false)
+{
+	return testRun(testCliPath,args,out,err,env,tty);
+}
+
+// A fake ZeroTier service for CLI tests: requests must carry its auth token and are
+// answered by a handler, so the CLI can be run against fixed data
+class TestFakeService
+{
+public:
+	TestFakeService(const TestHttpServer::Handler &h) :
+		home(testTempDir("fake-service")),
+		_http([h](const TestHttpServer::Request &rq,std::string &body) -> unsigned int {
+			std::map<std::string,std::string>::const_iterator a(rq.headers.find("x-zt1-auth"));
+			if ((a == rq.headers.end())||(a->second != "selftest")) {
+				body = "{}";
+				return 401;
+			}
+			return h(rq,body);
+		})
+	{
+	}
+
+	~TestFakeService()
+	{
+		OSUtils::rmDashRf(home.c_str());
+	}
+
+	// Run zerotier-cli against this service
+	int cli(const std::vector<std::string> &args,std::string &out,std::string &err,const std::vector<std::string> &env = std::vector<std::string>(),const bool tty = false)
+	{
+		std::vector<std::string> a;
+		a.push_back(std::string("-D") + home);
+		a.push_back(std::string("-p") + std::to_string(_http.port()));
+		a.push_back("-Tselftest");
+		a.insert(a.end(),args.begin(),args.end());
+		return testRunCli(a,out,err,env,tty);
+	}
+
+	const std::string home;
+
+private:
+	TestHttpServer _http;
+};
+
+// The first local IPv4 address ZeroTier will use for paths (loopback is never one), or an empty string
+static std::string testPathAddress()
+{
+	std::string ips;
+	struct ifaddrs *ifatbl = (struct ifaddrs *)0;
+	if ((getifaddrs(&ifatbl) == 0)&&(ifatbl)) {
+		for(struct ifaddrs *ifa=ifatbl;ifa;ifa=ifa->ifa_next) {
+			if ((ifa->ifa_addr)&&(ifa->ifa_addr->sa_family == AF_INET)) {
+				const InetAddress ip(ifa->ifa_addr);
+				if (Path::isAddressValidForPath(ip)) {
+					char tmp[64];
+					ips = ip.toIpString(tmp);
+					break;
+				}
+			}
+		}
+		freeifaddrs(ifatbl);
+	}
+	return ips;
+}
+
+// A real ZeroTier service with its embedded controller running on a thread in this process,
+// with its own home directory and port
+class TestService
+{
+public:
+	// Files are written into the home directory (by relative path) before the service starts
+	TestService(const char *name,const char *bindIp = "127.0.0.1",const std::map<std::string,std::string> &files = std::map<std::string,std::string>()) :
+		home(testTempDir(name)),
+		port(0),
+		udpPort(0),
+		_service((OneService *)0)
+	{
+		for(std::map<std::string,std::string>::const_iterator f(files.begin());f!=files.end();++f) {
+			const std::string::size_type sep = f->first.rfind(ZT_PATH_SEPARATOR);
+			if (sep != std::string::npos)
+				OSUtils::mkdir(home + ZT_PATH_SEPARATOR_S + f->first.substr(0,sep));
+			OSUtils::writeFile((home + ZT_PATH_SEPARATOR_S + f->first).c_str(),f->second);
+		}
+		for(int attempt=0;((attempt<8)&&(!_service));++attempt) {
+			// Bind only to bindIp, with ZeroTier's UDP on the port after the control port
+			const unsigned int p = 20000 + ((unsigned int)rand() % 30000);
+			OSUtils::writeFile((home + ZT_PATH_SEPARATOR_S "local.conf").c_str(),std::string("{\"settings\":{\"portMappingEnabled\":false,\"allowTcpFallbackRelay\":false,\"allowSecondaryPort\":false,\"bind\":[\"") + bindIp + "/" + std::to_string(p + 1) + "\"]}}");
+			OneService *s = OneService::newInstance(home.c_str(),p);
+			std::thread t([s]() { s->run(); });
+			bool up = false;
+			for(int i=0;i<300;++i) { // service startup includes generating an identity
+				if (s->reasonForTermination() != OneService::ONE_STILL_RUNNING)
+					break;
+				authToken.clear();
+				OSUtils::readFile((home + ZT_PATH_SEPARATOR_S "authtoken.secret").c_str(),authToken);
+				if (authToken.length() > 0) {
+					nlohmann::json st;
+					if (_api(p,"GET","/status",nlohmann::json(),st,authToken) == 200) {
+						address = OSUtils::jsonString(st["address"],"");
+						up = true;
+						break;
+					}
+				}
+				Thread::sleep(100);
+			}
+			if (up) {
+				_service = s;
+				_thread = std::move(t);
+				port = p;
+				udpPort = p + 1;
+			} else {
+				s->terminate();
+				t.join();
+				delete s;
+			}
+		}
+	}
+
+	~TestService()
+	{
+		if (_service) {
+			_service->terminate();
+			_thread.join();
+			delete _service;
+		}
+		OSUtils::rmDashRf(home.c_str());
+	}
+
+	inline bool ok() const { return (_service != (OneService *)0); }
+
+	// Make a JSON API request, with the service's own auth token unless another is given
+	unsigned int api(const char *method,const std::string &path,const nlohmann::json &body,nlohmann::json &r,const char *token = (const char *)0)
+	{
+		return _api(port,method,path,body,r,(token) ? std::string(token) : authToken);
+	}
+
+	// Make a JSON API request with extra headers, such as a confirmation header
+	unsigned int api(const char *method,const std::string &path,const nlohmann::json &body,nlohmann::json &r,const std::map<std::string,std::string> &headers)
+	{
+		return _api(port,method,path,body,r,authToken,headers);
+	}
+
+	// Run zerotier-cli against this service
+	int cli(const std::vector<std::string> &args,std::string &out,std::string &err,const std::vector<std::string> &env = std::vector<std::string>(),const bool tty = false)
+	{
+		std::vector<std::string> a;
+		a.push_back(std::string("-D") + home);
+		a.push_back(std::string("-p") + std::to_string(port));
+		a.insert(a.end(),args.begin(),args.end());
+		return testRunCli(a,out,err,env,tty);
+	}
+
+	const std::string home;
+	unsigned int port;
+	unsigned int udpPort;
+	std::string authToken;
+	std::string address;
+
+private:
+	static unsigned int _api(const unsigned int port,const char *method,const std::string &path,const nlohmann::json &body,nlohmann::json &r,const std::string &token,const std::map<std::string,std::string> &extraHeaders = std::map<std::string,std::string>())
+	{
+		InetAddress addr((std::string("127.0.0.1/") + std::to_string(port)).c_str());
+		std::map<std::string,std::string> headers(extraHeaders),responseHeaders;
+		std::string responseBody;
+		headers["X-ZT1-Auth"] = token;
+		unsigned int scode;
+		if (!strcmp(method,"GET")) {
+			scode = Http::GET(16777216,30000,(const struct sockaddr *)&addr,path.c_str(),headers,responseHeaders,responseBody);
+		} else if (!strcmp(method,"DELETE")) {
+			scode = Http::DEL(16777216,30000,(const struct sockaddr *)&addr,path.c_str(),headers,responseHeaders,responseBody);
+		} else {
+			const std::string b((body.is_null()) ? std::string() : OSUtils::jsonDump(body,-1));
+			headers["Content-Type"] = "application/json";
+			headers["Content-Length"] = std::to_string(b.length());
+			if (!strcmp(method,"PUT"))
+				scode = Http::PUT(16777216,30000,(const struct sockaddr *)&addr,path.c_str(),headers,b.data(),(unsigned long)b.length(),responseHeaders,responseBody);
+			else scode = Http::POST(16777216,30000,(const struct sockaddr *)&addr,path.c_str(),headers,b.data(),(unsigned long)b.length(),responseHeaders,responseBody);
+		}
+		try {
+			r = (responseBody.length() > 0) ? OSUtils::jsonParse(responseBody) : nlohmann::json();
+		} catch ( ... ) {
+			r = nlohmann::json();
+		}
+		return scode;
+	}
+
+	OneService *_service;
+	std::thread _thread;
+};
+
+#endif // __UNIX_LIKE__
+
+static int testControllerPagination()
+{
+	std::cout << "[controller] Testing network list pagination... "; std::cout.flush();
+
+	TestController c("pagination");
+	std::vector<std::string> nwids;
+	for(int i=0;i<5;++i) {
+		nwids.push_back(c.createNetwork());
+		if (!testCheck(nwids.back().length() == 16,"create network"))
+			return -1;
+	}
+	std::sort(nwids.begin(),nwids.end());
+
+	nlohmann::json r;
+	std::map<std::string,std::string> args;
+	args["page"] = "2";
+	args["pageSize"] = "2";
+	if (!testCheck(c.get("network",r,args) == 200,"page 2"))
+		return -1;
+	if (!testCheck((r["data"].size() == 2)&&(r["data"][0] == nwids[2])&&(r["data"][1] == nwids[3])&&(r["totalPages"] == 3)&&(r["totalItems"] == 5),"page 2 contents"))
+		return -1;
+	args["page"] = "3";
+	if (!testCheck((c.get("network",r,args) == 200)&&(r["data"].size() == 1)&&(r["data"][0] == nwids[4]),"last partial page"))
+		return -1;
+	args["page"] = "4";
+	if (!testCheck((c.get("network",r,args) == 200)&&(r["data"].size() == 0)&&(r["totalItems"] == 5),"page past the end"))
+		return -1;
+
+	// (page - 1) * pageSize would wrap to a small offset here without the page number check
+	args["page"] = "18446744073709551615";
+	args["pageSize"] = "1000";
+	if (!testCheck((c.get("network",r,args) == 200)&&(r["data"].size() == 0),"huge page number"))
+		return -1;
+	args["page"] = "9223372036854775809";
+	args["pageSize"] = "2";
+	if (!testCheck((c.get("network",r,args) == 200)&&(r["data"].size() == 0),"page that wraps its offset"))
+		return -1;
+
+	args["page"] = "0";
+	if (!testCheck(c.get("network",r,args) == 400,"page 0"))
+		return -1;
+	args["page"] = "1";
+	args["pageSize"] = "1000000";
+	if (!testCheck(c.get("network",r,args) == 400,"oversized page"))
+		return -1;
+
+	if (!testCheck((c.get("network",r) == 200)&&(r.is_array())&&(r.size() == 5),"unpaginated list"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerMemberFilters()
+{
+	std::cout << "[controller] Testing member list filters and paging... "; std::cout.flush();
+
+	TestController c("member-filters");
+	const std::string nwid(c.createNetwork());
+	if (!testCheck(nwid.length() == 16,"create network"))
+		return -1;
+	nlohmann::json r;
+	auto member = [&](const std::string &address,const char *name,const bool authorized) {
+		nlohmann::json m;
+		m["name"] = name;
+		m["authorized"] = authorized;
+		return (c.post("network/" + nwid + "/member/" + address,m,r) == 200);
+	};
+	if (!testCheck((member("1111111111","lab-printer",true))&&(member("2222222222","Lab desktop",false))&&(member("3333333333","office",true)),"create members"))
+		return -1;
+
+	// Two members that have asked for config, one authorized afterwards
+	Identity a,b;
+	a.generate();
+	b.generate();
+	char tmp[32];
+	const std::string aa(a.address().toString(tmp)),ba(b.address().toString(tmp));
+	if (!testCheck((c.request(nwid,a) == 0)&&(c.request(nwid,b) == 0)&&(member(aa,"lab-phone",true)),"members online"))
+		return -1;
+
+	// IDs of the matching members, in the order listed
+	auto list = [&](const std::map<std::string,std::string> &args) {
+		std::vector<std::string> found;
+		if ((c.get("network/" + nwid + "/member",r,args) != 200)||(!r["data"].is_array()))
+			return found;
+		for(unsigned long i=0;i<r["data"].size();++i)
+			found.push_back(OSUtils::jsonString(r["data"][i]["id"],""));
+		return found;
+	};
+	auto sorted = [](std::vector<std::string> v) {
+		std::sort(v.begin(),v.end());
+		return v;
+	};
+	std::map<std::string,std::string> args;
+	args["offset"] = "0";
+	const std::vector<std::string> all(list(args));
+	if (!testCheck((all.size() == 5)&&(all == sorted(all))&&(r["totalItems"] == 5)&&(r["data"][0].count("lastRequestTime")),"all members in ID order"))
+		return -1;
+
+	args["authorized"] = "true";
+	if (!testCheck(list(args) == sorted({ "1111111111","3333333333",aa }),"authorized"))
+		return -1;
+	args["authorized"] = "false";
+	if (!testCheck(list(args) == sorted({ "2222222222",ba }),"unauthorized"))
+		return -1;
+	args.erase("authorized");
+	args["online"] = "5";
+	if (!testCheck((list(args) == sorted({ aa,ba }))&&(OSUtils::jsonInt(r["data"][0]["lastRequestTime"],0ULL) > 0),"online"))
+		return -1;
+	args["authorized"] = "1";
+	if (!testCheck(list(args) == std::vector<std::string>(1,aa),"online and authorized"))
+		return -1;
+	args.erase("online");
+	args.erase("authorized");
+	args["nameContains"] = "lab";
+	if (!testCheck(list(args) == sorted({ "1111111111",aa }),"name contains, case sensitive"))
+		return -1;
+	args.erase("nameContains");
+
+	args["offset"] = "1";
+	args["limit"] = "2";
+	if (!testCheck((list(args) == std::vector<std::string>(all.begin() + 1,all.begin() + 3))&&(r["totalItems"] == 5)&&(r["offset"] == 1)&&(r["limit"] == 2),"offset and limit"))
+		return -1;
+	args["offset"] = "4";
+	if (!testCheck((list(args) == std::vector<std::string>(1,all[4]))&&(r["totalItems"] == 5),"last page"))
+		return -1;
+	args["offset"] = "5";
+	if (!testCheck((list(args).empty())&&(r["totalItems"] == 5),"past the end"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerHookSecrets()
+{
+	std::cout << "[controller] Testing that hook secrets are write-only... "; std::cout.flush();
+
+	TestController c("hook-secrets");
+	nlohmann::json settings,hook,r;
+	hook["url"] = "http://127.0.0.1:9/hook";
+	hook["secret"] = "webhook-secret-1";
+	hook["maxAttempts"] = 1;
+	settings["webhooks"] = nlohmann::json::array();
+	settings["webhooks"].push_back(hook);
+	settings["authHook"]["url"] = "http://127.0.0.1:9/admit";
+	settings["authHook"]["secret"] = "authhook-secret-2";
+	const std::string nwid(c.createNetwork(settings));
+	if (!testCheck(nwid.length() == 16,"create network"))
+		return -1;
+
+	std::vector<std::string> reads;
+	reads.push_back("network/" + nwid);
+	reads.push_back("network/" + nwid + "/export");
+	reads.push_back("audit");
+	reads.push_back("event");
+	for(std::vector<std::string>::const_iterator path(reads.begin());path!=reads.end();++path) {
+		if (!testCheck(c.get(*path,r) == 200,path->c_str()))
+			return -1;
+		const std::string d(r.dump());
+		if (!testCheck((d.find("webhook-secret-1") == std::string::npos)&&(d.find("authhook-secret-2") == std::string::npos),(*path + " has no secrets").c_str()))
+			return -1;
+	}
+
+	// Only backups keep them, so a restore onto a new controller signs as before. An import of an
+	// export can't, and names each hook that lost its secret.
+	if (!testCheck((c.get("backup",r) == 200)&&(r.dump().find("webhook-secret-1") != std::string::npos)&&(r.dump().find("authhook-secret-2") != std::string::npos),"backup has the secrets"))
+		return -1;
+	nlohmann::json doc;
+	if (!testCheck((c.get("network/" + nwid + "/export",doc) == 200)&&(c.post("network/" + c.address + "______/import",doc,r) == 200),"import an export"))
+		return -1;
+	if (!testCheck((r["warnings"].size() == 2)&&(r["warnings"].dump().find("http://127.0.0.1:9/hook") != std::string::npos)&&(r["warnings"].dump().find("http://127.0.0.1:9/admit") != std::string::npos),"import warns of lost secrets"))
+		return -1;
+
+	if (!testCheck(c.get("network/" + nwid,r) == 200,"get network"))
+		return -1;
+	if (!testCheck((OSUtils::jsonBool(r["webhooks"][0]["secretSet"],false))&&(OSUtils::jsonBool(r["authHook"]["secretSet"],false))&&(!r["webhooks"][0].count("secret")),"secretSet in place of secrets"))
+		return -1;
+
+	// Saving a network read from the API keeps its secrets, and an empty secret clears one
+	nlohmann::json update,after;
+	update["webhooks"] = r["webhooks"];
+	update["authHook"] = r["authHook"];
+	if (!testCheck(c.post("network/" + nwid,update,after) == 200,"save network back"))
+		return -1;
+	if (!testCheck((after.dump().find("secret-") == std::string::npos)&&(OSUtils::jsonBool(after["webhooks"][0]["secretSet"],false))&&(OSUtils::jsonBool(after["authHook"]["secretSet"],false)),"secrets kept"))
+		return -1;
+	update["authHook"]["secret"] = "";
+	if (!testCheck((c.post("network/" + nwid,update,after) == 200)&&(!OSUtils::jsonBool(after["authHook"]["secretSet"],true))&&(OSUtils::jsonBool(after["webhooks"][0]["secretSet"],false)),"empty secret clears it"))
+		return -1;
+
+	// There is no TLS, so https:// hooks are refused rather than sent in the clear
+	update["webhooks"][0]["url"] = "https://127.0.0.1/hook";
+	if (!testCheck(c.post("network/" + nwid,update,after) == 400,"https hook refused"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+#ifdef __UNIX_LIKE__
+static int testControllerWebhooks()
+{
+	std::cout << "[controller] Testing webhook signing, retry, and delivery... "; std::cout.flush();
+
+	std::mutex l;
+	unsigned int flakyCalls = 0;
+	TestHttpServer http([&](const TestHttpServer::Request &rq,std::string &body) -> unsigned int {
+		if (rq.path == "/dead")
+			return 500;
+		if (rq.path == "/flaky") {
+			std::lock_guard<std::mutex> ll(l);
+			if (++flakyCalls == 1)
+				return 503;
+		}
+		return 200;
+	});
+
+	// Wait until a hook path has had at least n requests
+	auto requestsTo = [&](const char *path,const unsigned long n,const int64_t timeout) {
+		std::vector<TestHttpServer::Request> rqs;
+		const int64_t until = OSUtils::now() + timeout;
+		for(;;) {
+			rqs.clear();
+			const std::vector<TestHttpServer::Request> all(http.requests());
+			for(unsigned long i=0;i<all.size();++i) {
+				if (all[i].path == path)
+					rqs.push_back(all[i]);
+			}
+			if ((rqs.size() >= n)||(OSUtils::now() >= until))
+				break;
+			Thread::sleep(50);
+		}
+		return rqs;
+	};
+	auto signedWith = [](const TestHttpServer::Request &rq,const std::string &secret) {
+		uint8_t mac[ZT_HMACSHA384_LEN];
+		char hex[(ZT_HMACSHA384_LEN * 2) + 1];
+		HMACSHA384(secret.data(),(unsigned int)secret.length(),rq.body.data(),(unsigned int)rq.body.length(),mac);
+		std::map<std::string,std::string>::const_iterator sig(rq.headers.find("x-zerotier-signature"));
+		return ((sig != rq.headers.end())&&(sig->second == (std::string("sha384=") + Utils::hex(mac,sizeof(mac),hex))));
+	};
+
+	TestController c("webhooks");
+	nlohmann::json settings,hook,r;
+	settings["webhooks"] = nlohmann::json::array();
+	hook["url"] = http.url("/ok");
+	hook["secret"] = "a webhook secret";
+	settings["webhooks"].push_back(hook);
+	hook["url"] = http.url("/flaky");
+	hook["secret"] = "flaky secret";
+	hook["retryDelay"] = 1000;
+	settings["webhooks"].push_back(hook);
+	hook["url"] = http.url("/dead");
+	hook["secret"] = "";
+	hook["maxAttempts"] = 2;
+	settings["webhooks"].push_back(hook);
+	const std::string nwid(c.createNetwork(settings));
+	if (!testCheck(nwid.length() == 16,"create network"))
+		return -1;
+
+	std::vector<TestHttpServer::Request> ok(requestsTo("/ok",1,5000));
+	if (!testCheck(ok.size() == 1,"event delivered"))
+		return -1;
+	nlohmann::json e;
+	try {
+		e = OSUtils::jsonParse(ok[0].body);
+	} catch ( ... ) {}
+	if (!testCheck((OSUtils::jsonString(e["type"],"") == "network-created")&&(OSUtils::jsonString(e["networkId"],"") == nwid)&&(ok[0].headers["x-zerotier-event"] == "network-created")&&(ok[0].headers["x-zerotier-delivery"] == OSUtils::jsonString(e["id"],"")),"event body and headers"))
+		return -1;
+	if (!testCheck(signedWith(ok[0],"a webhook secret"),"HMAC-SHA384 of the body keyed with the secret"))
+		return -1;
+
+	std::vector<TestHttpServer::Request> flaky(requestsTo("/flaky",2,8000));
+	if (!testCheck(flaky.size() == 2,"failed delivery retried"))
+		return -1;
+	if (!testCheck((flaky[0].body == flaky[1].body)&&(flaky[0].headers["x-zerotier-delivery"] == flaky[1].headers["x-zerotier-delivery"])&&(signedWith(flaky[1],"flaky secret")),"retry is the same signed event"))
+		return -1;
+
+	// The dead hook is tried maxAttempts times and the event then goes to the dead letter log
+	std::vector<TestHttpServer::Request> dead(requestsTo("/dead",2,30000));
+	std::string log;
+	for(int i=0;i<50;++i) {
+		log.clear();
+		if ((OSUtils::readFile((c.home + ZT_PATH_SEPARATOR_S "controller-webhooks-failed.log").c_str(),log))&&(log.find("HTTP 500") != std::string::npos))
+			break;
+		Thread::sleep(100);
+	}
+	if (!testCheck((dead.size() == 2)&&(log.find(http.url("/dead")) != std::string::npos)&&(log.find("HTTP 500") != std::string::npos),"undeliverable event in dead letter log"))
+		return -1;
+
+	// Saving the hooks as read from the API keeps their secrets, so later events are still signed with them
+	if (!testCheck(c.get("network/" + nwid,r) == 200,"get network"))
+		return -1;
+	nlohmann::json update;
+	update["webhooks"] = r["webhooks"];
+	update["webhooks"].erase(2);
+	if (!testCheck(c.post("network/" + nwid,update,r) == 200,"save hooks back"))
+		return -1;
+	nlohmann::json member;
+	member["authorized"] = true;
+	if (!testCheck(c.post("network/" + nwid + "/member/1a2b3c4d5e",member,r) == 200,"authorize member"))
+		return -1;
+	ok = requestsTo("/ok",2,5000);
+	flaky = requestsTo("/flaky",3,5000);
+	if (!testCheck((ok.size() == 2)&&(flaky.size() == 3),"member event delivered"))
+		return -1;
+	if (!testCheck((ok[1].headers["x-zerotier-event"] == "member-authorized")&&(signedWith(ok[1],"a webhook secret"))&&(signedWith(flaky[2],"flaky secret")),"still signed with the kept secrets"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerAuthHook()
+{
+	std::cout << "[controller] Testing authHook answers and their cache... "; std::cout.flush();
+
+	std::atomic<bool> allow(true);
+	TestHttpServer http([&](const TestHttpServer::Request &rq,std::string &body) -> unsigned int {
+		if (rq.path == "/slow")
+			Thread::sleep(6000); // longer than the controller waits for an authHook
+		body = (allow) ? "{\"authorized\":true}" : "{\"authorized\":false}";
+		return 200;
+	});
+	auto hookCalls = [&](const char *path) {
+		unsigned long n = 0;
+		const std::vector<TestHttpServer::Request> all(http.requests());
+		for(unsigned long i=0;i<all.size();++i) {
+			if (all[i].path == path)
+				++n;
+		}
+		return n;
+	};
+
+	TestController c("auth-hook");
+	nlohmann::json settings,r;
+	settings["authHook"]["url"] = http.url("/admit");
+	settings["authHook"]["ttl"] = 3000;
+	const std::string nwid(c.createNetwork(settings));
+	if (!testCheck(nwid.length() == 16,"create network"))
+		return -1;
+	Identity a,b;
+	a.generate();
+	b.generate();
+	char tmp[32];
+	const std::string am(a.address().toString(tmp)),bm(b.address().toString(tmp));
+
+	// An allowed member is admitted, but only for as long as the answer is cached
+	if (!testCheck(c.request(nwid,a) == 1,"allowed member admitted"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/member/" + am,r) == 200)&&(!OSUtils::jsonBool(r["authorized"],true))&&(r["lastAuthorizedCredentialType"].is_null()),"allow not saved as an authorization"))
+		return -1;
+	if (!testCheck((OSUtils::jsonString(r["authHookResult"],"") == "allow")&&(OSUtils::jsonBool(r["authHookAdmitted"],false))&&(OSUtils::jsonInt(r["authHookExpires"],0ULL) > 0ULL),"cached answer shown"))
+		return -1;
+	std::string saved;
+	OSUtils::readFile((c.home + ZT_PATH_SEPARATOR_S "controller.d" ZT_PATH_SEPARATOR_S "network" ZT_PATH_SEPARATOR_S + nwid + ZT_PATH_SEPARATOR_S "member" ZT_PATH_SEPARATOR_S + am + ".json").c_str(),saved);
+	if (!testCheck((saved.length() > 0)&&(saved.find("authHook") == std::string::npos)&&(saved.find("\"authorized\":true") == std::string::npos),"answer not in the member's file"))
+		return -1;
+	Thread::sleep(ZT_TEST_CONFIG_REQUEST_PERIOD);
+	if (!testCheck((c.request(nwid,a) == 1)&&(hookCalls("/admit") == 1),"cached answer reused"))
+		return -1;
+
+	// Once the answer expires the hook is asked again, and a denial refuses the member
+	allow = false;
+	Thread::sleep(2000);
+	if (!testCheck((c.request(nwid,a) == 0)&&(hookCalls("/admit") == 2),"hook asked again after ttl"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/member/" + am,r) == 200)&&(OSUtils::jsonString(r["authHookResult"],"") == "deny")&&(!OSUtils::jsonBool(r["authHookAdmitted"],true)),"denial cached"))
+		return -1;
+	if (!testCheck((c.request(nwid,b) == 0)&&(hookCalls("/admit") == 3),"denied member refused"))
+		return -1;
+	Thread::sleep(ZT_TEST_CONFIG_REQUEST_PERIOD);
+	if (!testCheck((c.request(nwid,b) == 0)&&(hookCalls("/admit") == 3),"cached denial reused"))
+		return -1;
+
+	// A hook that times out refuses members unless it fails open, and fail-open is not an authorization
+	allow = true;
+	settings["authHook"]["url"] = http.url("/slow");
+	settings["authHook"]["ttl"] = 300000;
+	settings["authHook"]["failMode"] = "closed";
+	const std::string closedNwid(c.createNetwork(settings));
+	settings["authHook"]["failMode"] = "open";
+	const std::string openNwid(c.createNetwork(settings));
+	if (!testCheck((closedNwid.length() == 16)&&(openNwid.length() == 16),"create networks"))
+		return -1;
+	if (!testCheck(c.request(closedNwid,a) == 0,"timeout with failMode closed refuses"))
+		return -1;
+	if (!testCheck((c.get("network/" + closedNwid + "/member/" + am,r) == 200)&&(OSUtils::jsonString(r["authHookResult"],"") == "error")&&(!OSUtils::jsonBool(r["authHookAdmitted"],true)),"closed failure cached"))
+		return -1;
+	if (!testCheck(c.request(openNwid,a) == 1,"timeout with failMode open admits"))
+		return -1;
+	if (!testCheck((c.get("network/" + openNwid + "/member/" + am,r) == 200)&&(!OSUtils::jsonBool(r["authorized"],true))&&(r["lastAuthorizedCredential"].is_null())&&(OSUtils::jsonBool(r["authHookAdmitted"],false)),"fail-open not saved as an authorization"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+#endif // __UNIX_LIKE__
+
+#ifdef __UNIX_LIKE__
+static int testCliRoots()
+{
+	std::cout << "[cli] Testing roots against a mixed set of online and offline roots... "; std::cout.flush();
+
+	const int64_t now = OSUtils::now();
+	nlohmann::json peers = nlohmann::json::array();
+	nlohmann::json p,path;
+	p["address"] = "1111111111";
+	p["role"] = "PLANET";
+	p["latency"] = 12;
+	p["version"] = "1.6.2";
+	path["address"] = "10.0.0.1/9993";
+	path["lastReceive"] = now - 1000;
+	path["preferred"] = true;
+	p["paths"] = nlohmann::json::array();
+	p["paths"].push_back(path);
+	peers.push_back(p);
+	p["address"] = "2222222222";
+	p["paths"][0]["address"] = "10.0.0.2/9993";
+	p["paths"][0]["lastReceive"] = now - 600000;
+	peers.push_back(p);
+	p["address"] = "3333333333";
+	p["role"] = "MOON";
+	p["paths"] = nlohmann::json::array();
+	peers.push_back(p);
+	p["address"] = "4444444444";
+	p["role"] = "LEAF";
+	peers.push_back(p);
+
+	nlohmann::json offline = peers;
+	offline[0]["paths"][0]["lastReceive"] = now - 600000;
+	bool allOffline = false;
+	TestFakeService svc([&](const TestHttpServer::Request &rq,std::string &body) -> unsigned int {
+		if (rq.path != "/peer")
+			return 404;
+		body = OSUtils::jsonDump((allOffline) ? offline : peers,-1);
+		return 200;
+	});
+
+	std::string out,err;
+	std::vector<std::string> args;
+	args.push_back("-j");
+	args.push_back("roots");
+	if (!testCheck(svc.cli(args,out,err) == 0,"roots -j exit status"))
+		return -1;
+	nlohmann::json roots;
+	try {
+		roots = OSUtils::jsonParse(out);
+	} catch ( ... ) {}
+	if (!testCheck((roots.is_array())&&(roots.size() == 3),"roots -j should list the two planet roots and the moon"))
+		return -1;
+	if (!testCheck((OSUtils::jsonBool(roots[0]["online"],false))&&(OSUtils::jsonString(roots[0]["endpoint"],"") == "10.0.0.1/9993")&&(OSUtils::jsonString(roots[0]["source"],"") == "planet"),"online planet root"))
+		return -1;
+	if (!testCheck((!OSUtils::jsonBool(roots[1]["online"],true))&&(!OSUtils::jsonBool(roots[2]["online"],true))&&(roots[2]["endpoint"].is_null())&&(OSUtils::jsonString(roots[2]["source"],"") == "moon"),"offline roots"))
+		return -1;
+
+	args.clear();
+	args.push_back("roots");
+	args.push_back("--check");
+	if (!testCheck(svc.cli(args,out,err) == 0,"roots --check with one root online"))
+		return -1;
+	if (!testCheck((out.find("1111111111 planet   ONLINE ") != std::string::npos)&&(out.find("3333333333 moon     OFFLINE") != std::string::npos)&&(out.find("4444444444") == std::string::npos),"roots table"))
+		return -1;
+
+	allOffline = true;
+	if (!testCheck(svc.cli(args,out,err) == 6,"roots --check with no roots online"))
+		return -1;
+	if (!testCheck(err.find("no roots are online") != std::string::npos,"roots --check message"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+static int testServiceScopedTokens()
+{
+	std::cout << "[controller] Testing scoped API tokens... "; std::cout.flush();
+
+	TestService s("scoped-tokens");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json req,r,readToken,fullToken;
+	req["scope"] = "controller:read";
+	if (!testCheck((s.api("POST","/token",req,readToken) == 200)&&(OSUtils::jsonString(readToken["token"],"").length() > 0),"create controller:read token"))
+		return -1;
+	req["scope"] = "controller";
+	if (!testCheck((s.api("POST","/token",req,fullToken) == 200)&&(OSUtils::jsonString(fullToken["token"],"").length() > 0),"create controller token"))
+		return -1;
+	const std::string rt(OSUtils::jsonString(readToken["token"],"")),ft(OSUtils::jsonString(fullToken["token"],""));
+	struct stat st;
+	if (!testCheck((stat((s.home + ZT_PATH_SEPARATOR_S "authtoken.scoped.secret").c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"tokens file readable only by its owner"))
+		return -1;
+
+	// A controller token may change the controller, but nothing else
+	nlohmann::json settings,hook;
+	hook["url"] = "http://127.0.0.1:9/hook";
+	hook["secret"] = "scoped-webhook-secret";
+	hook["maxAttempts"] = 1;
+	settings["webhooks"] = nlohmann::json::array();
+	settings["webhooks"].push_back(hook);
+	settings["authHook"]["url"] = "http://127.0.0.1:9/admit";
+	settings["authHook"]["secret"] = "scoped-authhook-secret";
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r,ft.c_str()) == 200,"controller token creates a network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	if (!testCheck(nwid.length() == 16,"network ID"))
+		return -1;
+	if (!testCheck(s.api("GET","/status",nlohmann::json(),r,ft.c_str()) == 403,"controller token reads /status"))
+		return -1;
+	if (!testCheck(s.api("GET","/network",nlohmann::json(),r,ft.c_str()) == 403,"controller token reads /network"))
+		return -1;
+	if (!testCheck(s.api("POST","/token",req,r,ft.c_str()) == 403,"controller token creates a token"))
+		return -1;
+	if (!testCheck(OSUtils::jsonString(r["message"],"").find("scope") != std::string::npos,"403 message"))
+		return -1;
+
+	// A controller:read token may only read the controller
+	if (!testCheck(s.api("GET","/controller/network/" + nwid,nlohmann::json(),r,rt.c_str()) == 200,"read token gets a network"))
+		return -1;
+	nlohmann::json update;
+	update["name"] = "renamed";
+	if (!testCheck(s.api("POST","/controller/network/" + nwid,update,r,rt.c_str()) == 403,"read token updates a network"))
+		return -1;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",nlohmann::json::object(),r,rt.c_str()) == 403,"read token creates a network"))
+		return -1;
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/0123456789",update,r,rt.c_str()) == 403,"read token changes a member"))
+		return -1;
+	if (!testCheck(s.api("DELETE","/controller/network/" + nwid,nlohmann::json(),r,rt.c_str()) == 403,"read token deletes a network"))
+		return -1;
+	if (!testCheck(s.api("GET","/status",nlohmann::json(),r,rt.c_str()) == 403,"read token reads /status"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonString(r["name"],"") != "renamed"),"denied update not applied"))
+		return -1;
+
+	// ... and never sees a secret
+	std::vector<std::string> reads;
+	reads.push_back("/controller/network/" + nwid);
+	reads.push_back("/controller/network/" + nwid + "/export");
+	reads.push_back("/controller/audit");
+	reads.push_back("/controller/event");
+	for(std::vector<std::string>::const_iterator path(reads.begin());path!=reads.end();++path) {
+		if (!testCheck(s.api("GET",*path,nlohmann::json(),r,rt.c_str()) == 200,path->c_str()))
+			return -1;
+		const std::string d(r.dump());
+		if (!testCheck((d.find("scoped-webhook-secret") == std::string::npos)&&(d.find("scoped-authhook-secret") == std::string::npos),(*path + " has no secrets").c_str()))
+			return -1;
+	}
+	if (!testCheck((s.api("GET","/controller/backup",nlohmann::json(),r,rt.c_str()) == 403)&&(s.api("GET","/controller/backup",nlohmann::json(),r,ft.c_str()) == 200),"backups, which have secrets, need the controller scope"))
+		return -1;
+	if (!testCheck((s.api("GET","/token",nlohmann::json(),r) == 200)&&(r.dump().find(rt) == std::string::npos)&&(r.dump().find(ft) == std::string::npos),"token list has no tokens"))
+		return -1;
+
+	// A deleted token no longer authenticates anything
+	if (!testCheck(s.api("DELETE","/token/" + OSUtils::jsonString(readToken["id"],""),nlohmann::json(),r) == 200,"delete read token"))
+		return -1;
+	if (!testCheck(s.api("GET","/controller/network/" + nwid,nlohmann::json(),r,rt.c_str()) == 401,"deleted token refused"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+// A signed planet with one root, serialized as a planet file
+static std::string testPlanet(const uint64_t id,const uint64_t ts,const C25519::Pair &key,const Identity &root,const char *endpoint = "10.0.0.1/9993")
+{
+	std::vector<World::Root> roots;
+	roots.push_back(World::Root());
+	roots.back().identity = root;
+	roots.back().stableEndpoints.push_back(InetAddress(endpoint));
+	Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> b;
+	World::make(World::TYPE_PLANET,id,ts,key.pub,roots,key).serialize(b);
+	return std::string((const char *)b.data(),b.size());
+}
+
+
+static int testIdtoolShowWorld()
+{
+	std::cout << "[cli] Testing idtool showworld and verifyworld on valid, superseded, and badly signed planets... "; std::cout.flush();
+
+	const C25519::Pair key(C25519::generate());
+	Identity root;
+	root.generate();
+	const std::string dir(testTempDir("showworld"));
+	const std::string idtool(testCliPath.substr(0,testCliPath.rfind('/')) + "/zerotier-idtool");
+	const std::string current(testPlanet(0x1234,2000,key,root)),old(testPlanet(0x1234,1000,key,root));
+	std::string bad(current);
+	bad[bad.length() - 1] ^= 0x01; // last byte of the signature
+	OSUtils::writeFile((dir + "/current").c_str(),current);
+	OSUtils::writeFile((dir + "/old").c_str(),old);
+	OSUtils::writeFile((dir + "/bad").c_str(),bad);
+	OSUtils::writeFile((dir + "/garbage").c_str(),std::string("not a planet"));
+
+	std::string out,err;
+	nlohmann::json w;
+	auto show = [&](const char *f) {
+		w = nlohmann::json();
+		const int rc = testRun(idtool,{ "showworld",dir + "/" + f },out,err);
+		try {
+			w = OSUtils::jsonParse(out);
+		} catch ( ... ) {}
+		return rc;
+	};
+	char tmp[256];
+	if (!testCheck((show("current") == 0)&&(w["worldType"] == "planet")&&(w["id"] == "0000000000001234")&&(w["timestamp"] == 2000)&&(w["updatesMustBeSignedBy"] == Utils::hex(key.pub.data,ZT_C25519_PUBLIC_KEY_LEN,tmp)),"valid planet decoded"))
+		return -1;
+	if (!testCheck((OSUtils::jsonBool(w["selfSigned"],false))&&(w["roots"].size() == 1)&&(w["roots"][0]["address"] == root.address().toString(tmp))&&(w["roots"][0]["stableEndpoints"] == nlohmann::json::array({ "10.0.0.1/9993" })),"valid planet roots and signature"))
+		return -1;
+	if (!testCheck((testRun(idtool,{ "verifyworld",dir + "/current" },out,err) == 0)&&(out.find("signature OK") != std::string::npos)&&(out.find("VALID") != std::string::npos),"valid planet verifies"))
+		return -1;
+	if (!testCheck((testRun(idtool,{ "--encoding=base32","verifyworld",dir + "/current" },out,err) == 0)&&(out.find(std::string("root ") + root.address().toString(tmp,Utils::ENCODING_BASE32) + " identity OK") != std::string::npos),"roots in base32"))
+		return -1;
+
+	// A superseded planet still decodes and verifies, but a node holding the newer one won't take it
+	if (!testCheck((show("old") == 0)&&(w["timestamp"] == 1000)&&(OSUtils::jsonBool(w["selfSigned"],false))&&(testRun(idtool,{ "verifyworld",dir + "/old" },out,err) == 0),"superseded planet decoded"))
+		return -1;
+	World wc,wo;
+	Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> bc(current.data(),(unsigned int)current.length()),bo(old.data(),(unsigned int)old.length());
+	wc.deserialize(bc,0);
+	wo.deserialize(bo,0);
+	if (!testCheck((!wc.shouldBeReplacedBy(wo))&&(wo.shouldBeReplacedBy(wc)),"superseded planet not taken"))
+		return -1;
+
+	if (!testCheck((show("bad") == 0)&&(w["timestamp"] == 2000)&&(!OSUtils::jsonBool(w["selfSigned"],true)),"bad signature decoded but not self-signed"))
+		return -1;
+	if (!testCheck((testRun(idtool,{ "verifyworld",dir + "/bad" },out,err) == 1)&&(out.find("signature FAILED") != std::string::npos)&&(out.find("INVALID") != std::string::npos),"bad signature fails verification"))
+		return -1;
+	if (!testCheck((show("garbage") == 1)&&(err.find("not a valid planet/moon file") != std::string::npos),"not a planet"))
+		return -1;
+
+	OSUtils::rmDashRf(dir.c_str());
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliSetPlanet()
+{
+	std::cout << "[cli] Testing set planet requires a pinned key or world ID over http... "; std::cout.flush();
+
+	const C25519::Pair key(C25519::generate()),otherKey(C25519::generate());
+	Identity root;
+	root.generate();
+	char tmp[256];
+	const std::string keyHex(Utils::hex(key.pub.data,ZT_C25519_PUBLIC_KEY_LEN,tmp));
+	const std::string otherKeyHex(Utils::hex(otherKey.pub.data,ZT_C25519_PUBLIC_KEY_LEN,tmp));
+
+	std::string served(testPlanet(0x1234,2000,key,root));
+	TestHttpServer planets([&served](const TestHttpServer::Request &rq,std::string &body) -> unsigned int {
+		body = served;
+		return 200;
+	});
+	std::vector<std::string> switched;
+	TestFakeService s([&switched](const TestHttpServer::Request &rq,std::string &body) -> unsigned int {
+		body = "{}";
+		if ((rq.method != "PUT")||(rq.path != "/planet"))
+			return 404;
+		switched.push_back(OSUtils::jsonString(OSUtils::jsonParse(rq.body)["planet"],""));
+		return 200;
+	});
+	const std::string url(planets.url("/planet"));
+	std::string out,err;
+
+	// Nothing to check a plain http download against
+	if (!testCheck((s.cli({ "set","planet",url,"--yes" },out,err) == 2)&&(err.find("--signing-key") != std::string::npos),"unpinned http planet refused"))
+		return -1;
+	if (!testCheck(s.cli({ "set","planet",url,"--signing-key=1234","--yes" },out,err) == 2,"malformed key refused"))
+		return -1;
+	if (!testCheck((s.cli({ "set","planet",url,"--signing-key=" + otherKeyHex,"--yes" },out,err) == 6)&&(planets.requests().size() == 1),"planet signed by another key refused"))
+		return -1;
+
+	// The built-in planet is not 0x1234, so an ID alone can not vouch for it
+	if (!testCheck(s.cli({ "set","planet",url,"--world-id=1234","--yes" },out,err) == 6,"world ID not matching the current planet refused"))
+		return -1;
+	if (!testCheck((switched.empty())&&(s.cli({ "set","planet",url,"--signing-key=" + keyHex,"--world-id=1234","--yes" },out,err) == 0),"planet with pinned key and ID accepted"))
+		return -1;
+	char wbytes[ZT_WORLD_MAX_SERIALIZED_LENGTH];
+	if (!testCheck((switched.size() == 1)&&(std::string(wbytes,Utils::unhex(switched[0].c_str(),wbytes,sizeof(wbytes))) == served),"downloaded planet sent to the service"))
+		return -1;
+
+	// With 0x1234 saved as the node's planet, its ID is enough, but only for planets signed by its key
+	if (!testCheck(OSUtils::writeFile((s.home + ZT_PATH_SEPARATOR_S + "planet").c_str(),served),"save current planet"))
+		return -1;
+	served = testPlanet(0x1234,3000,key,root);
+	if (!testCheck((s.cli({ "set","planet",url,"--world-id=1234","--yes" },out,err) == 0)&&(switched.size() == 2),"newer planet with the same key accepted by ID"))
+		return -1;
+	served = testPlanet(0x1234,4000,otherKey,root);
+	if (!testCheck(s.cli({ "set","planet",url,"--world-id=1234","--yes" },out,err) == 6,"same ID with a different key refused"))
+		return -1;
+	if (!testCheck(s.cli({ "set","planet",url,"--world-id=5678","--yes" },out,err) == 6,"wrong world ID refused"))
+		return -1;
+
+	// A local file needs no pin
+	const std::string file(s.home + ZT_PATH_SEPARATOR_S + "other.planet");
+	if (!testCheck((OSUtils::writeFile(file.c_str(),served))&&(s.cli({ "set","planet",file,"--yes" },out,err) == 0)&&(switched.size() == 3),"local planet file accepted"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+// Create, read, update and delete records in one controller DB backend, reopening it to check what was stored
+template<typename D>
+static int testControllerDbBackend(const char *backend)
+{
+	std::cout << "[controller] Testing " << backend << " controller storage... "; std::cout.flush();
+
+	const std::string dir(testTempDir((std::string("controller-db-") + backend).c_str()));
+	const uint64_t nwid = 0x8056c2e21c000001ULL,other = 0x8056c2e21c000002ULL;
+	const uint64_t mids[3] = { 0x0a1b2c3d4eULL,0x1b2c3d4e5fULL,0x2c3d4e5f6aULL };
+	const char *const midStrs[3] = { "0a1b2c3d4e","1b2c3d4e5f","2c3d4e5f6a" };
+	nlohmann::json n,m;
+	std::vector<nlohmann::json> members; // get() appends to this
+	{
+		D db(dir.c_str());
+		for(const char *id : { "8056c2e21c000001","8056c2e21c000002" }) {
+			nlohmann::json network;
+			network["id"] = network["nwid"] = id;
+			network["name"] = "stored";
+			DB::initNetwork(network);
+			if (!testCheck(db.save(network,false),"create network"))
+				return -1;
+		}
+		for(int i=0;i<3;++i) {
+			nlohmann::json member;
+			member["id"] = member["address"] = midStrs[i];
+			member["nwid"] = "8056c2e21c000001";
+			member["objtype"] = "member";
+			member["name"] = std::string("member-") + std::to_string(i);
+			DB::initMember(member);
+			if (!testCheck(db.save(member,false),"create member"))
+				return -1;
+		}
+		if (!testCheck((db.get(nwid,n))&&(n["name"] == "stored")&&(n["revision"] == 1)&&(db.get(nwid,n,members))&&(members.size() == 3),"read back"))
+			return -1;
+
+		if (!testCheck((db.get(nwid,n,mids[1],m))&&(m["authorized"] == false),"read member"))
+			return -1;
+		m["authorized"] = true;
+		m["ipAssignments"] = nlohmann::json::array({ "10.7.0.2" });
+		if (!testCheck((db.save(m,false))&&(db.get(nwid,n,mids[1],m))&&(m["authorized"] == true)&&(m["revision"] == 2),"update member"))
+			return -1;
+		if (!testCheck((!db.save(m,false))&&(db.get(nwid,n,mids[1],m))&&(m["revision"] == 2),"unchanged record not saved again"))
+			return -1;
+		n["name"] = "renamed";
+		if (!testCheck((db.save(n,false))&&(db.get(nwid,n))&&(n["name"] == "renamed")&&(n["revision"] == 2),"update network"))
+			return -1;
+
+		db.eraseMember(nwid,mids[2]);
+		members.clear();
+		if (!testCheck((!db.get(nwid,n,mids[2],m))&&(db.get(nwid,n,members))&&(members.size() == 2),"delete member"))
+			return -1;
+	}
+
+	// Everything above, and nothing more, is there after a restart
+	{
+		D db(dir.c_str());
+		if (!testCheck((db.get(nwid,n))&&(n["name"] == "renamed")&&(n["revision"] == 2)&&(db.get(other,n)),"networks after reopening"))
+			return -1;
+		members.clear();
+		if (!testCheck((db.get(nwid,n,members))&&(members.size() == 2)&&(!db.get(nwid,n,mids[2],m)),"members after reopening"))
+			return -1;
+		if (!testCheck((db.get(nwid,n,mids[1],m))&&(m["authorized"] == true)&&(m["ipAssignments"] == nlohmann::json::array({ "10.7.0.2" }))&&(m["revision"] == 2)&&(m["name"] == "member-1"),"updated member after reopening"))
+			return -1;
+
+		db.eraseNetwork(nwid);
+		if (!testCheck((!db.get(nwid,n))&&(!db.get(nwid,n,mids[0],m))&&(db.get(other,n)),"delete network"))
+			return -1;
+	}
+	{
+		D db(dir.c_str());
+		if (!testCheck((!db.get(nwid,n))&&(!db.get(nwid,n,mids[0],m))&&(!db.get(nwid,n,mids[1],m))&&(db.get(other,n)),"deleted network and its members stay gone"))
+			return -1;
+	}
+	OSUtils::rmDashRf(dir.c_str());
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+#ifdef ZT_CONTROLLER_USE_SQLITE
+// A database that can't be used is reported to the caller instead of ending the process
+static int testControllerSQLiteUnusable()
+{
+	std::cout << "[controller] Testing unusable SQLite controller storage... "; std::cout.flush();
+
+	const std::string dir(testTempDir("controller-db-sqlite-unusable"));
+	const std::string dbFile(dir + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_SQLITEDB_FILENAME);
+	nlohmann::json network;
+	network["id"] = network["nwid"] = "8056c2e21c000001";
+	DB::initNetwork(network);
+
+	// A directory where the database belongs can't be opened at all
+	OSUtils::mkdir(dbFile);
+	{
+		SQLiteDB db(dir.c_str());
+		if (!testCheck((!db.isReady())&&(db.error().find(dbFile) != std::string::npos),"unopenable database reported"))
+			return -1;
+		if (!testCheck(!db.save(network,false),"save to unopenable database refused"))
+			return -1;
+	}
+	OSUtils::rmDashRf(dbFile.c_str());
+
+	// Nor can a file that isn't a database
+	if (!testCheck(OSUtils::writeFile(dbFile.c_str(),std::string(4096,'x')),"write file"))
+		return -1;
+	{
+		SQLiteDB db(dir.c_str());
+		if (!testCheck((!db.isReady())&&(db.error().find("not a database") != std::string::npos),"corrupt database reported"))
+			return -1;
+		if (!testCheck((!db.save(network,false))&&(!db.get(0x8056c2e21c000001ULL,network)),"corrupt database left alone"))
+			return -1;
+	}
+	std::string after;
+	if (!testCheck((OSUtils::readFile(dbFile.c_str(),after))&&(after == std::string(4096,'x')),"corrupt database unchanged"))
+		return -1;
+	OSUtils::rmDashRf(dir.c_str());
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+#endif
+
+static int testControllerQuotas()
+{
+	std::cout << "[controller] Testing controller network and member limits... "; std::cout.flush();
+
+	TestController c("controller-quotas","{ \"settings\": { \"controllerMaxNetworks\": 2,\"controllerMaxMembersPerNetwork\": 2 } }");
+	nlohmann::json settings,r;
+	if (!testCheck((c.get("",r) == 200)&&(r["maxNetworks"] == 2)&&(r["maxMembersPerNetwork"] == 2),"limits reported"))
+		return -1;
+
+	// The network limit refuses creating and importing a network once it's reached, and frees up on delete
+	settings["private"] = false;
+	const std::string nwid(c.createNetwork(settings)),second(c.createNetwork());
+	if (!testCheck((nwid.length() == 16)&&(second.length() == 16),"create up to the network limit"))
+		return -1;
+	if (!testCheck((c.post("network/" + c.address + "______",settings,r) == 403)&&(OSUtils::jsonString(r["message"],"").find("controllerMaxNetworks") != std::string::npos),"create past the network limit"))
+		return -1;
+	nlohmann::json doc;
+	if (!testCheck((c.get("network/" + second + "/export",doc) == 200)&&(c.post("network/" + c.address + "______/import",doc,r) == 403),"import past the network limit"))
+		return -1;
+	if (!testCheck((c.post("network/" + second,settings,r) == 200),"existing network still editable at the limit"))
+		return -1;
+	if (!testCheck((c.del("network/" + second,r) == 200)&&(c.createNetwork().length() == 16),"room after a delete"))
+		return -1;
+
+	// Members of a public network are admitted up to the per-network default, and refused after it
+	Identity ids[4];
+	for(int i=0;i<4;++i)
+		ids[i].generate();
+	char mids[4][16];
+	for(int i=0;i<4;++i)
+		ids[i].address().toString(mids[i]);
+	if (!testCheck((c.request(nwid,ids[0]) == 1)&&(c.request(nwid,ids[1]) == 1),"members up to the limit"))
+		return -1;
+	if (!testCheck((c.request(nwid,ids[2]) == 0)&&(c.get("network/" + nwid + "/member/" + mids[2],r) == 200)&&(r["authorized"] == false)&&(r["authRefusedReason"] == "memberLimit"),"member past the limit refused"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/summary",r) == 200)&&(r["memberLimit"] == 2)&&(r["authorizedMemberCount"] == 2),"summary"))
+		return -1;
+
+	// The network's own limit overrides the default, and a refused member gets in once there is room
+	settings = nlohmann::json::object();
+	settings["memberLimit"] = 3;
+	Thread::sleep(ZT_TEST_CONFIG_REQUEST_PERIOD);
+	if (!testCheck((c.post("network/" + nwid,settings,r) == 200)&&(c.request(nwid,ids[2]) == 1),"raised limit admits a refused member"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/member/" + mids[2],r) == 200)&&(r["authorized"] == true)&&(OSUtils::jsonString(r["authRefusedReason"],"").empty()),"refusal cleared"))
+		return -1;
+
+	// Lowering the limit leaves every member already in authorized and served, and only stops new ones
+	settings["memberLimit"] = 1;
+	if (!testCheck((c.post("network/" + nwid,settings,r) == 200)&&(c.get("network/" + nwid + "/summary",r) == 200)&&(r["memberLimit"] == 1),"lower the limit"))
+		return -1;
+	Thread::sleep(ZT_TEST_CONFIG_REQUEST_PERIOD);
+	for(int i=0;i<3;++i) {
+		if (!testCheck((c.request(nwid,ids[i]) == 1)&&(c.get("network/" + nwid + "/member/" + mids[i],r) == 200)&&(r["authorized"] == true)&&(OSUtils::jsonString(r["authRefusedReason"],"").empty()),"existing member unaffected by a lower limit"))
+			return -1;
+	}
+	if (!testCheck((c.request(nwid,ids[3]) == 0)&&(c.get("network/" + nwid + "/member/" + mids[3],r) == 200)&&(r["authRefusedReason"] == "memberLimit"),"new member refused under the lower limit"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/summary",r) == 200)&&(r["authorizedMemberCount"] == 3),"nobody deauthorized"))
+		return -1;
+
+	// An admin can still authorize past the limit by hand
+	settings = nlohmann::json::object();
+	settings["authorized"] = true;
+	Thread::sleep(ZT_TEST_CONFIG_REQUEST_PERIOD);
+	if (!testCheck((c.post("network/" + nwid + "/member/" + mids[3],settings,r) == 200)&&(r["authorized"] == true)&&(OSUtils::jsonString(r["authRefusedReason"],"").empty())&&(c.request(nwid,ids[3]) == 1),"authorized by hand past the limit"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerAuditLog()
+{
+	std::cout << "[controller] Testing audit log entries, actors, order, and rotation... "; std::cout.flush();
+
+	const std::string dir(testTempDir("audit-log"));
+	const std::string path(dir + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_AUDIT_LOG_FILENAME);
+	const uint64_t nwid = 0x8056c2e21c000001ULL,other = 0x8056c2e21c000002ULL;
+	nlohmann::json r;
+	{
+		AuditLog log(dir);
+		nlohmann::json member,updated,before,after;
+		member["objtype"] = "member";
+		member["id"] = "1a2b3c4d5e";
+		member["name"] = "laptop";
+		member["authorized"] = false;
+		member["ipAssignments"] = nlohmann::json::array();
+		member["revision"] = 1;
+		log.record("authtoken","member-create",nwid,0x1a2b3c4d5eULL,nlohmann::json(),member);
+		updated = member;
+		updated["authorized"] = true;
+		updated["revision"] = 2;
+		updated["lastAuthorizedCredential"] = "member-credential";
+		log.record("token:ops","member-authorize",nwid,0x1a2b3c4d5eULL,member,updated);
+		before["name"] = "lab";
+		after["name"] = "lab";
+		after["authHook"]["url"] = "https://example.com/admit";
+		after["authHook"]["secret"] = "hook-secret";
+		log.record("controller","network-update",other,0,before,after);
+		r = log.query(0,0);
+	}
+
+	// Entries come back in the order they were recorded, holding only what changed
+	if (!testCheck((r.size() == 3)&&(r[0]["op"] == "member-create")&&(r[1]["op"] == "member-authorize")&&(r[2]["op"] == "network-update"),"entries in order"))
+		return -1;
+	if (!testCheck((r[0]["actor"] == "authtoken")&&(r[1]["actor"] == "token:ops")&&(r[2]["actor"] == "controller"),"actors"))
+		return -1;
+	if (!testCheck((OSUtils::jsonInt(r[0]["time"],0ULL) <= OSUtils::jsonInt(r[1]["time"],0ULL))&&(OSUtils::jsonInt(r[1]["time"],0ULL) <= OSUtils::jsonInt(r[2]["time"],0ULL)),"times in order"))
+		return -1;
+	if (!testCheck((r[0]["networkId"] == "8056c2e21c000001")&&(r[0]["memberId"] == "1a2b3c4d5e")&&(r[0]["before"].is_null())&&(r[0]["after"] == OSUtils::jsonParse("{\"name\":\"laptop\",\"authorized\":false,\"ipAssignments\":[]}")),"created member summarized"))
+		return -1;
+	if (!testCheck((r[1]["before"] == OSUtils::jsonParse("{\"authorized\":false}"))&&(r[1]["after"] == OSUtils::jsonParse("{\"authorized\":true}")),"only the changed field recorded"))
+		return -1;
+	if (!testCheck((r[2]["networkId"] == "8056c2e21c000002")&&(!r[2].count("memberId"))&&(r[2]["before"]["authHook"].is_null())&&(OSUtils::jsonBool(r[2]["after"]["authHook"]["secretSet"],false))&&(!r[2]["after"]["authHook"].count("secret")),"hook secret left out"))
+		return -1;
+	std::string d;
+	if (!testCheck((OSUtils::readFile(path.c_str(),d))&&(d.find("hook-secret") == std::string::npos)&&(d.find("member-credential") == std::string::npos),"no secrets on disk"))
+		return -1;
+
+	// A log grown past its maximum size moves to .1, which is still read, replacing any older .1
+	auto grow = [&]() {
+		FILE *f = fopen(path.c_str(),"a");
+		if (!f)
+			return false;
+		const std::string padding(ZT_CONTROLLER_AUDIT_LOG_MAX_SIZE,'#');
+		fprintf(f,"%s\n",padding.c_str());
+		fclose(f);
+		return true;
+	};
+	AuditLog log(dir);
+	if (!testCheck(grow(),"grow log"))
+		return -1;
+	log.record("authtoken","network-delete",nwid,0,nlohmann::json(),nlohmann::json());
+	r = log.query(nwid,0);
+	if (!testCheck((!OSUtils::fileExists(path.c_str()))&&(OSUtils::fileExists((path + ".1").c_str())),"rotated"))
+		return -1;
+	if (!testCheck((r.size() == 3)&&(r[0]["op"] == "member-create")&&(r[2]["op"] == "network-delete"),"rotated entries still listed"))
+		return -1;
+	log.record("authtoken","network-create",nwid,0,nlohmann::json(),nlohmann::json());
+	if (!testCheck((log.query(nwid,0).size() == 4)&&(log.query(other,0).size() == 1),"entries across both files by network"))
+		return -1;
+	if (!testCheck(grow(),"grow log again"))
+		return -1;
+	log.record("authtoken","network-update",nwid,0,nlohmann::json(),nlohmann::json());
+	r = log.query(0,0);
+	if (!testCheck((r.size() == 2)&&(r[0]["op"] == "network-create")&&(r[1]["op"] == "network-update"),"second rotation replaces the first"))
+		return -1;
+	if (!testCheck(log.query(0,OSUtils::jsonInt(r[1]["time"],0ULL)).empty(),"since excludes older entries"))
+		return -1;
+
+	// Actors come from the token the request was made with, or api if none was given
+	TestController c("audit-actors");
+	const std::string cnwid(c.createNetwork());
+	nlohmann::json n;
+	n["name"] = "renamed";
+	if (!testCheck((cnwid.length() == 16)&&(c.post("network/" + cnwid,n,r,std::map<std::string,std::string>(),"token:abc123") == 200),"update with a scoped token"))
+		return -1;
+	std::string body,ct;
+	n["name"] = "renamed again";
+	if (!testCheck(c.controller->handleControlPlaneHttpPOST(testPath("network/" + cnwid),std::map<std::string,std::string>(),std::map<std::string,std::string>(),OSUtils::jsonDump(n,-1),body,ct) == 200,"update without an actor"))
+		return -1;
+	if (!testCheck((c.get("audit",r) == 200)&&(r.size() == 3),"controller audit"))
+		return -1;
+	if (!testCheck((r[0]["op"] == "network-create")&&(r[0]["actor"] == "authtoken")&&(r[1]["actor"] == "token:abc123")&&(r[1]["after"]["name"] == "renamed")&&(r[2]["actor"] == "api"),"controller actors"))
+		return -1;
+
+	OSUtils::rmDashRf(dir.c_str());
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerStats()
+{
+	std::cout << "[controller] Testing controller stats counters, active windows, and persistence... "; std::cout.flush();
+
+	const std::string dir(testTempDir("controller-stats"));
+	const uint64_t nwid = 0x8056c2e21c000001ULL,other = 0x8056c2e21c000002ULL;
+	const int64_t now = OSUtils::now();
+	nlohmann::json r;
+	{
+		ControllerStats st(dir);
+		st.request(nwid,0x1111111111ULL,now - 60000);
+		st.request(nwid,0x2222222222ULL,now - ZT_CONTROLLER_STATS_ACTIVE_SHORT);
+		st.request(nwid,0x3333333333ULL,now - 1800000);
+		st.request(nwid,0x4444444444ULL,now - ZT_CONTROLLER_STATS_ACTIVE_LONG);
+		st.configServed(nwid);
+		st.configServed(nwid);
+		st.newMember(nwid);
+		st.authorization(nwid,true);
+		st.authorization(nwid,true);
+		st.authorization(nwid,false);
+		st.request(other,0x1111111111ULL,now);
+		r = st.get(nwid,now);
+		if (!testCheck((r["configRequests"] == 2)&&(r["newMembers"] == 1)&&(r["authorizations"] == 2)&&(r["deauthorizations"] == 1),"counters"))
+			return -1;
+		if (!testCheck((r["activeMembers5m"] == 1)&&(r["activeMembers60m"] == 3),"active windows end at their length"))
+			return -1;
+		if (!testCheck((st.get(nwid,now + ZT_CONTROLLER_STATS_ACTIVE_LONG)["activeMembers60m"] == 0)&&(st.get(0x8056c2e21c000003ULL,now)["configRequests"] == 0),"later clock and unknown network"))
+			return -1;
+	}
+
+	// Counters and recent requests carry over a restart, and erased networks stay gone
+	{
+		ControllerStats st(dir);
+		r = st.get(nwid,now);
+		if (!testCheck((r["configRequests"] == 2)&&(r["authorizations"] == 2)&&(r["deauthorizations"] == 1)&&(r["activeMembers5m"] == 1)&&(r["activeMembers60m"] == 3),"counters after restart"))
+			return -1;
+		st.erase(other);
+		if (!testCheck((st.all(now).size() == 1)&&(st.all(now).count("8056c2e21c000001")),"erased network left out"))
+			return -1;
+	}
+	{
+		ControllerStats st(dir);
+		if (!testCheck((st.all(now).size() == 1)&&(st.get(other,now)["activeMembers5m"] == 0),"erased network gone after restart"))
+			return -1;
+	}
+	OSUtils::rmDashRf(dir.c_str());
+
+	// The controller counts requests and their answers, and forgets a network when it's deleted
+	TestController c("controller-stats");
+	nlohmann::json settings;
+	settings["private"] = false;
+	const std::string cnwid(c.createNetwork(settings));
+	Identity id;
+	id.generate();
+	if (!testCheck((cnwid.length() == 16)&&(c.request(cnwid,id) == 1),"member request"))
+		return -1;
+	if (!testCheck((c.get("network/" + cnwid + "/stats",r) == 200)&&(r["configRequests"] == 1)&&(r["newMembers"] == 1)&&(r["authorizations"] == 1)&&(r["activeMembers5m"] == 1),"request counted"))
+		return -1;
+	if (!testCheck((c.get("stats",r) == 200)&&(r["networks"].count(cnwid)),"network listed"))
+		return -1;
+	if (!testCheck((c.del("network/" + cnwid,r) == 200)&&(c.get("stats",r) == 200)&&(!r["networks"].count(cnwid)),"deleted network forgotten"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerRulesCompiler()
+{
+	std::cout << "[controller] Testing the rules compiler... "; std::cout.flush();
+
+	// Default drop, established TCP, and WireGuard only between members tagged for it
+	const std::string script(
+		"# WireGuard mesh\n"
+		"tag role\n"
+		"\tid 1\n"
+		"\tenum 1 wg\n"
+		";\n"
+		"\n"
+		"cap ssh\n"
+		"\tid 10\n"
+		"\taccept ipprotocol tcp and dport 22;\n"
+		";\n"
+		"\n"
+		"accept ipprotocol tcp and not chr tcp_syn; # established\n"
+		"accept ipprotocol udp and dport 51820 and tseq role wg and treq role wg;\n"
+		"drop;\n");
+	const nlohmann::json expected(OSUtils::jsonParse(
+		"{\"rules\":["
+		"{\"type\":\"MATCH_IP_PROTOCOL\",\"not\":false,\"or\":false,\"ipProtocol\":6},"
+		"{\"type\":\"MATCH_CHARACTERISTICS\",\"not\":true,\"or\":false,\"mask\":\"0000000000000002\"},"
+		"{\"type\":\"ACTION_ACCEPT\"},"
+		"{\"type\":\"MATCH_IP_PROTOCOL\",\"not\":false,\"or\":false,\"ipProtocol\":17},"
+		"{\"type\":\"MATCH_IP_DEST_PORT_RANGE\",\"not\":false,\"or\":false,\"start\":51820,\"end\":51820},"
+		"{\"type\":\"MATCH_TAG_SENDER\",\"not\":false,\"or\":false,\"id\":1,\"value\":1},"
+		"{\"type\":\"MATCH_TAG_RECEIVER\",\"not\":false,\"or\":false,\"id\":1,\"value\":1},"
+		"{\"type\":\"ACTION_ACCEPT\"},"
+		"{\"type\":\"ACTION_DROP\"}],"
+		"\"capabilities\":[{\"id\":10,\"default\":false,\"name\":\"ssh\",\"rules\":["
+		"{\"type\":\"MATCH_IP_PROTOCOL\",\"not\":false,\"or\":false,\"ipProtocol\":6},"
+		"{\"type\":\"MATCH_IP_DEST_PORT_RANGE\",\"not\":false,\"or\":false,\"start\":22,\"end\":22},"
+		"{\"type\":\"ACTION_ACCEPT\"}]}],"
+		"\"tags\":[{\"id\":1,\"default\":null,\"name\":\"role\"}]}"));
+	nlohmann::json config;
+	std::string err;
+	if (!testCheck(RulesCompiler::compile(script,nlohmann::json::array(),0x8056c2e21c000001ULL,config,err),err.c_str()))
+		return -1;
+	if (!testCheck(config == expected,"compiled policy"))
+		return -1;
+
+	// Errors point at the word that caused them
+	auto compileError = [&](const char *bad) {
+		nlohmann::json c;
+		std::string e;
+		if (RulesCompiler::compile(bad,nlohmann::json::array(),0x8056c2e21c000001ULL,c,e))
+			return std::string("compiled");
+		return e.substr(0,e.find(':'));
+	};
+	if (!testCheck(compileError("accept;\ndrop ethertype ipv5;\n") == "line 2, column 16","bad value"))
+		return -1;
+	if (!testCheck(compileError("accept\n  ipprotocol tcp and nosuch 1;\n") == "line 2, column 22","unknown match"))
+		return -1;
+	if (!testCheck(compileError("accept ipprotocol tcp and;") == "line 1, column 23","missing match"))
+		return -1;
+	if (!testCheck(compileError("drop teq role 1;") == "line 1, column 10","unknown tag"))
+		return -1;
+	if (!testCheck(compileError("tag a\n id 1\n;\ntag b\n id 1\n;\n") == "line 4, column 1","duplicate tag ID"))
+		return -1;
+	if (!testCheck(compileError("tag a\n\tid 1\n") == "line 1, column 1","unterminated tag"))
+		return -1;
+	if (!testCheck(compileError("macro m\n;\n") == "line 1, column 1","macro"))
+		return -1;
+
+	// Single rules, as controller rules add takes them, may use the network's tag names
+	std::vector<std::string> words;
+	words.push_back("drop");
+	words.push_back("not");
+	words.push_back("teq");
+	words.push_back("dept");
+	words.push_back("3;");
+	nlohmann::json entries;
+	const nlohmann::json tags(OSUtils::jsonParse("[{\"id\":5,\"name\":\"dept\"}]"));
+	if (!testCheck(RulesCompiler::compileRule(words,tags,0,entries,err),err.c_str()))
+		return -1;
+	if (!testCheck(entries == OSUtils::jsonParse("[{\"type\":\"MATCH_TAGS_EQUAL\",\"not\":true,\"or\":false,\"id\":5,\"value\":3},{\"type\":\"ACTION_DROP\"}]"),"single rule"))
+		return -1;
+	words.push_back("accept");
+	if (!testCheck(!RulesCompiler::compileRule(words,tags,0,entries,err),"two rules"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerExportImport()
+{
+	std::cout << "[controller] Testing network export and import... "; std::cout.flush();
+
+	TestController a("export-a"),b("export-b",std::string(),true);
+	nlohmann::json settings,r;
+	settings["name"] = "exported";
+	settings["v4AssignMode"]["zt"] = true;
+	settings["ipAssignmentPools"] = nlohmann::json::array();
+	settings["ipAssignmentPools"].push_back(nlohmann::json::object({ { "ipRangeStart","10.7.0.1" },{ "ipRangeEnd","10.7.0.254" } }));
+	settings["routes"] = nlohmann::json::array();
+	settings["routes"].push_back(nlohmann::json::object({ { "target","10.7.0.0/24" } }));
+	settings["tags"] = nlohmann::json::array();
+	settings["tags"].push_back(nlohmann::json::object({ { "id",2000 },{ "default",1 } }));
+	const std::string nwid(a.createNetwork(settings));
+	if (!testCheck(nwid.length() == 16,"create network"))
+		return -1;
+	const char *mids[3] = { "0a1b2c3d4e","1b2c3d4e5f","2c3d4e5f6a" };
+	for(int i=0;i<3;++i) {
+		nlohmann::json m;
+		m["name"] = std::string("member-") + mids[i];
+		m["authorized"] = (i != 1);
+		m["ipAssignments"] = nlohmann::json::array({ std::string("10.7.0.") + std::to_string(20 + i) });
+		m["tags"] = nlohmann::json::array();
+		m["tags"].push_back(nlohmann::json::array({ 2000,i }));
+		if (!testCheck(a.post("network/" + nwid + "/member/" + mids[i],m,r) == 200,"create member"))
+			return -1;
+	}
+	nlohmann::json doc;
+	if (!testCheck((a.get("network/" + nwid + "/export",doc) == 200)&&(doc["members"].size() == 3),"export"))
+		return -1;
+
+	// An export with its IDs, and the revisions that saving bumps, taken out so two can be compared
+	auto sameExport = [](nlohmann::json x,nlohmann::json y) {
+		for(nlohmann::json *d : { &x,&y }) {
+			nlohmann::json &n = (*d)["network"];
+			n.erase("id");
+			n.erase("nwid");
+			n.erase("revision");
+			d->erase("exportTime");
+			d->erase("controller");
+			for(unsigned long i=0;i<(*d)["members"].size();++i) {
+				(*d)["members"][i].erase("nwid");
+				(*d)["members"][i].erase("revision");
+			}
+		}
+		return (x == y);
+	};
+
+	// Round trip on the same controller, under a new ID since this one is taken
+	if (!testCheck(a.post("network/" + nwid + "/import",doc,r) == 409,"import over an existing network"))
+		return -1;
+	if (!testCheck(a.post("network/" + a.address + "______/import",doc,r) == 200,"import with a new ID"))
+		return -1;
+	const std::string copy(OSUtils::jsonString(r["id"],""));
+	nlohmann::json copyDoc;
+	if (!testCheck((copy.length() == 16)&&(copy != nwid)&&(OSUtils::jsonInt(r["memberCount"],0ULL) == 3ULL),"new ID and member count"))
+		return -1;
+	if (!testCheck((a.get("network/" + copy + "/export",copyDoc) == 200)&&(sameExport(doc,copyDoc)),"export of the copy matches"))
+		return -1;
+	if (!testCheck(OSUtils::jsonString(copyDoc["members"][0]["nwid"],"") == copy,"members rewritten to the new ID"))
+		return -1;
+
+	// Onto another controller, which cannot keep an ID with the first one's address
+	if (!testCheck(b.post("network/" + nwid + "/import",doc,r) == 400,"import keeping another controller's ID"))
+		return -1;
+	if (!testCheck(b.post("network/" + b.address + "______/import",doc,r) == 200,"import onto another controller"))
+		return -1;
+	const std::string moved(OSUtils::jsonString(r["id"],""));
+	if (!testCheck((moved.substr(0,10) == b.address)&&(b.get("network/" + moved + "/export",copyDoc) == 200)&&(sameExport(doc,copyDoc)),"export from the other controller matches"))
+		return -1;
+
+	// A member that fails to save rolls back the whole import. A file where the network's
+	// member directory would go makes every member write fail.
+	const std::string failing(b.address + "0000f1");
+	const std::string blocker(b.home + ZT_PATH_SEPARATOR_S "controller.d" ZT_PATH_SEPARATOR_S "network" ZT_PATH_SEPARATOR_S + failing);
+	OSUtils::writeFile(blocker.c_str(),std::string("not a directory"));
+	if (!testCheck((b.post("network/" + failing + "/import",doc,r) == 500)&&(OSUtils::jsonString(r["message"],"").find("nothing was imported") != std::string::npos),"failed save reported"))
+		return -1;
+	if (!testCheck((b.get("network/" + failing,r) == 404)&&(!OSUtils::fileExists((b.home + ZT_PATH_SEPARATOR_S "controller.d" ZT_PATH_SEPARATOR_S "network" ZT_PATH_SEPARATOR_S + failing + ".json").c_str())),"nothing left behind"))
+		return -1;
+	OSUtils::rm(blocker.c_str());
+	if (!testCheck((b.post("network/" + failing + "/import",doc,r) == 200)&&(b.get("network/" + failing + "/export",copyDoc) == 200)&&(sameExport(doc,copyDoc)),"import succeeds once it can be saved"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testControllerAuthExpiry()
+{
+	std::cout << "[controller] Testing authorization expiry against an injected clock... "; std::cout.flush();
+
+	TestController c("auth-expiry");
+	const std::string nwid(c.createNetwork());
+	if (!testCheck(nwid.length() == 16,"create network"))
+		return -1;
+	const int64_t expiry = OSUtils::now() + 3600000LL;
+	nlohmann::json m,r;
+	m["authorized"] = true;
+	m["authExpiry"] = expiry;
+	if (!testCheck((c.post("network/" + nwid + "/member/1111111111",m,r) == 200)&&(c.post("network/" + nwid + "/member/2222222222",m,r) == 200),"authorize expiring members"))
+		return -1;
+	m["authExpiry"] = 0;
+	if (!testCheck(c.post("network/" + nwid + "/member/3333333333",m,r) == 200,"authorize member without expiry"))
+		return -1;
+
+	if (!testCheck(c.controller->expireAuthorizations(expiry - 1) == 0,"nothing expires early"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/member/1111111111",r) == 200)&&(OSUtils::jsonBool(r["authorized"],false)),"still authorized before expiry"))
+		return -1;
+
+	// An expiry extended after the controller last looked is read again and honored
+	m["authExpiry"] = expiry + 3600000LL;
+	if (!testCheck(c.post("network/" + nwid + "/member/2222222222",m,r) == 200,"extend expiry"))
+		return -1;
+	if (!testCheck(c.controller->expireAuthorizations(expiry) == 1,"one member expires at its expiry"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/member/1111111111",r) == 200)&&(!OSUtils::jsonBool(r["authorized"],true))&&(OSUtils::jsonString(r["lastDeauthorizedReason"],"") == "expired")&&((int64_t)OSUtils::jsonInt(r["lastDeauthorizedTime"],0ULL) == expiry),"deauthorized as expired at the injected time"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/member/2222222222",r) == 200)&&(OSUtils::jsonBool(r["authorized"],false)),"extended member kept"))
+		return -1;
+	if (!testCheck(c.controller->expireAuthorizations(expiry + 1) == 0,"an expired member is not expired again"))
+		return -1;
+
+	if (!testCheck(c.controller->expireAuthorizations(expiry + 7200000LL) == 1,"extended member expires later"))
+		return -1;
+	if (!testCheck((c.get("network/" + nwid + "/member/3333333333",r) == 200)&&(OSUtils::jsonBool(r["authorized"],false)),"member without expiry kept"))
+		return -1;
+
+	nlohmann::json audit;
+	unsigned long expiredEntries = 0;
+	c.get("audit",audit);
+	for(unsigned long i=0;i<audit.size();++i) {
+		if ((OSUtils::jsonString(audit[i]["op"],"") == "member-deauthorize")&&(OSUtils::jsonString(audit[i]["actor"],"") == "controller"))
+			++expiredEntries;
+	}
+	if (!testCheck(expiredEntries == 2,"each expiry audited once"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testServiceOpenApi()
+{
+	std::cout << "[controller] Testing doc/openapi.json against the routes the service serves... "; std::cout.flush();
+
+	// The document is looked for in the source tree this program was built in
+	const std::string path(testCliPath.substr(0,testCliPath.rfind('/')) + "/doc/openapi.json");
+	std::string doc;
+	if (!OSUtils::readFile(path.c_str(),doc)) {
+		std::cout << "SKIPPED (no " << path << ")" << std::endl;
+		return 0;
+	}
+	nlohmann::json api;
+	try {
+		api = OSUtils::jsonParse(doc);
+	} catch ( ... ) {}
+	if (!testCheck(api["paths"].is_object(),"document has paths"))
+		return -1;
+
+	std::set<std::string> documented,served;
+	for(nlohmann::json::iterator p(api["paths"].begin());p!=api["paths"].end();++p) {
+		for(nlohmann::json::iterator m(p.value().begin());m!=p.value().end();++m) {
+			std::string method(m.key());
+			if ((method != "get")&&(method != "post")&&(method != "put")&&(method != "delete"))
+				continue;
+			for(std::string::iterator c(method.begin());c!=method.end();++c)
+				*c = (char)toupper(*c);
+			documented.insert(method + " " + p.key());
+		}
+	}
+	for(const char *const *r=OneService::controlPlaneRoutes();*r;++r)
+		served.insert(*r);
+	for(const char *const *r=EmbeddedNetworkController::controlPlaneRoutes();*r;++r)
+		served.insert(*r);
+
+	for(std::set<std::string>::const_iterator r(served.begin());r!=served.end();++r) {
+		if (!testCheck(documented.count(*r) > 0,(*r + " is not documented").c_str()))
+			return -1;
+	}
+	for(std::set<std::string>::const_iterator r(documented.begin());r!=documented.end();++r) {
+		if (!testCheck(served.count(*r) > 0,(*r + " is documented but not served").c_str()))
+			return -1;
+	}
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+// A network with a declared tag, a tag only its rules use, and a capability whose rules use another
+static void testTagNetwork(nlohmann::json &settings)
+{
+	settings["tags"] = nlohmann::json::array();
+	settings["tags"].push_back(nlohmann::json::object({ { "id",1 },{ "name","dept" },{ "min",0 },{ "max",10 } }));
+	settings["rules"] = nlohmann::json::array();
+	settings["rules"].push_back(nlohmann::json::object({ { "type","MATCH_TAGS_EQUAL" },{ "id",2000 },{ "value",0 } }));
+	settings["rules"].push_back(nlohmann::json::object({ { "type","ACTION_ACCEPT" } }));
+	nlohmann::json cap;
+	cap["id"] = 7;
+	cap["name"] = "admin";
+	cap["rules"] = nlohmann::json::array();
+	cap["rules"].push_back(nlohmann::json::object({ { "type","MATCH_TAG_SENDER" },{ "id",3000 },{ "value",1 } }));
+	cap["rules"].push_back(nlohmann::json::object({ { "type","ACTION_ACCEPT" } }));
+	settings["capabilities"] = nlohmann::json::array({ cap });
+}
+
+static int testControllerMemberTags()
+{
+	std::cout << "[controller] Testing member tag and capability validation... "; std::cout.flush();
+
+	TestController c("member-tags");
+	nlohmann::json settings,m,r;
+	testTagNetwork(settings);
+	const std::string nwid(c.createNetwork(settings));
+	if (!testCheck(nwid.length() == 16,"create network"))
+		return -1;
+	const std::string mp("network/" + nwid + "/member/1a2b3c4d5e");
+
+	m["tags"] = nlohmann::json::array({ nlohmann::json::array({ 1,5 }) });
+	if (!testCheck(c.post(mp,m,r) == 200,"declared tag"))
+		return -1;
+	m["tags"] = nlohmann::json::array({ nlohmann::json::array({ 1,11 }) });
+	if (!testCheck(c.post(mp,m,r) == 400,"declared tag out of range"))
+		return -1;
+	m["tags"] = nlohmann::json::array({ nlohmann::json::array({ 2000,3 }),nlohmann::json::array({ 3000,1 }) });
+	if (!testCheck(c.post(mp,m,r) == 200,"tags used by the network's and a capability's rules"))
+		return -1;
+	if (!testCheck((c.get(mp,r) == 200)&&(r["tags"] == m["tags"]),"tags saved"))
+		return -1;
+	m["tags"] = nlohmann::json::array({ nlohmann::json::array({ 4000,1 }) });
+	if (!testCheck((c.post(mp,m,r) == 400)&&(OSUtils::jsonString(r["message"],"").find("4000") != std::string::npos),"unknown tag rejected"))
+		return -1;
+	m.erase("tags");
+
+	m["capabilities"] = nlohmann::json::array({ 7 });
+	if (!testCheck(c.post(mp,m,r) == 200,"declared capability"))
+		return -1;
+	m["capabilities"] = nlohmann::json::array({ 8 });
+	if (!testCheck(c.post(mp,m,r) == 400,"unknown capability rejected"))
+		return -1;
+	if (!testCheck((c.get(mp,r) == 200)&&(r["capabilities"] == nlohmann::json::array({ 7 })),"rejected update not saved"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliEncoding()
+{
+	std::cout << "[cli] Testing --encoding=base32 for addresses and identities... "; std::cout.flush();
+
+	Identity id;
+	id.generate();
+	char abuf[16],a32[16],idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+	id.address().toString(abuf);
+	id.address().toString(a32,Utils::ENCODING_BASE32);
+	if (!testCheck(strlen(a32) == 8,"base32 address length"))
+		return -1;
+
+	nlohmann::json status,peers = nlohmann::json::array(),p;
+	status["address"] = abuf;
+	status["version"] = "1.6.2";
+	status["online"] = true;
+	status["tcpFallbackActive"] = false;
+	p["address"] = abuf;
+	p["role"] = "LEAF";
+	p["latency"] = 5;
+	p["versionMajor"] = 1;
+	p["versionMinor"] = 6;
+	p["versionRev"] = 2;
+	p["paths"] = nlohmann::json::array();
+	peers.push_back(p);
+	TestFakeService svc([&](const TestHttpServer::Request &rq,std::string &body) -> unsigned int {
+		if (rq.path == "/status")
+			body = OSUtils::jsonDump(status,-1);
+		else if (rq.path == "/peer")
+			body = OSUtils::jsonDump(peers,-1);
+		else return 404;
+		return 200;
+	});
+
+	std::string out,err;
+	if (!testCheck((svc.cli({ "--encoding=base32","info" },out,err) == 0)&&(out.find(std::string("200 info ") + a32 + " 1.6.2 ONLINE") != std::string::npos),"base32 info"))
+		return -1;
+	if (!testCheck((svc.cli({ "--encoding=base32","peers" },out,err) == 0)&&(out.find(std::string(a32) + "   1.6.2") != std::string::npos),"base32 peers"))
+		return -1;
+	if (!testCheck((svc.cli({ "--encoding=base32","listpeers" },out,err) == 0)&&(out.find(std::string("200 listpeers ") + a32 + " ") != std::string::npos),"base32 listpeers"))
+		return -1;
+	if (!testCheck((svc.cli({ "-q","--encoding=base32","info" },out,err) == 0)&&(out == std::string(a32) + ZT_EOL_S),"base32 info -q"))
+		return -1;
+	if (!testCheck((svc.cli({ "-q","--encoding=base32","peers" },out,err) == 0)&&(out.find(std::string(a32) + ZT_EOL_S) != std::string::npos),"base32 peers -q"))
+		return -1;
+	if (!testCheck((svc.cli({ "--encoding=hex","info" },out,err) == 0)&&(out.find(std::string("200 info ") + abuf + " ") != std::string::npos),"hex info"))
+		return -1;
+
+	// JSON keeps the hex the API uses
+	nlohmann::json j;
+	if (!testCheck(svc.cli({ "--encoding=base32","-j","info" },out,err) == 0,"base32 info -j"))
+		return -1;
+	try {
+		j = OSUtils::jsonParse(out);
+	} catch ( ... ) {}
+	if (!testCheck(OSUtils::jsonString(j["address"],"") == abuf,"JSON stays hex"))
+		return -1;
+	if (!testCheck((svc.cli({ "--encoding=base64","info" },out,err) == 2)&&(err.find("invalid --encoding") != std::string::npos),"unknown encoding refused"))
+		return -1;
+
+	// zerotier-idtool prints identities in base32 but reads and writes files in hex
+	const std::string dir(testTempDir("encoding"));
+	const std::string idtool(testCliPath.substr(0,testCliPath.rfind('/')) + "/zerotier-idtool");
+	OSUtils::writeFile((dir + "/identity.secret").c_str(),std::string(id.toString(true,idtmp)));
+	if (!testCheck((testRun(idtool,{ "getpublic",dir + "/identity.secret","--encoding=base32" },out,err) == 0)&&(out == id.toString(false,idtmp,Utils::ENCODING_BASE32)),"idtool getpublic base32"))
+		return -1;
+	if (!testCheck((out.substr(0,11) == std::string(a32) + ":0:")&&(out.length() == 11 + 103),"base32 identity fields"))
+		return -1;
+	if (!testCheck((testRun(idtool,{ "--encoding=hex","getpublic",dir + "/identity.secret" },out,err) == 0)&&(out == id.toString(false,idtmp)),"idtool getpublic hex"))
+		return -1;
+	std::string saved;
+	if (!testCheck((testRun(idtool,{ "--encoding=base32","generate",dir + "/new.secret" },out,err) == 0)&&(OSUtils::readFile((dir + "/new.secret").c_str(),saved))&&(saved.find(':') == 10),"generated files stay hex"))
+		return -1;
+	if (!testCheck(testRun(idtool,{ "--encoding=octal","getpublic",dir + "/identity.secret" },out,err) == 1,"idtool unknown encoding refused"))
+		return -1;
+
+	// identity pubkey defaults to base32 under --encoding=base32, but an explicit --format wins
+	char pk[(ZT_C25519_PUBLIC_KEY_LEN * 2) + 1];
+	if (!testCheck((testRunCli({ "-D" + dir,"-p1","-Tselftest","--encoding=base32","identity","pubkey",dir + "/identity.secret" },out,err) == 0)&&(out == std::string(Utils::b32e(id.publicKey().data,ZT_C25519_PUBLIC_KEY_LEN,pk)) + ZT_EOL_S),"public key in base32"))
+		return -1;
+	if (!testCheck((testRunCli({ "-D" + dir,"-p1","-Tselftest","--encoding=base32","identity","pubkey",dir + "/identity.secret","--format=hex" },out,err) == 0)&&(out == std::string(Utils::hex(id.publicKey().data,ZT_C25519_PUBLIC_KEY_LEN,pk)) + ZT_EOL_S),"--format wins over --encoding"))
+		return -1;
+
+	OSUtils::rmDashRf(dir.c_str());
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliRootReset()
+{
+	std::cout << "[cli] Testing root reset keeps custom roots until confirmed and is idempotent... "; std::cout.flush();
+
+	// Start with a custom planet and a moon already saved in the home directory
+	const C25519::Pair key(C25519::generate());
+	Identity root;
+	root.generate();
+	std::vector<World::Root> moonRoots;
+	moonRoots.push_back(World::Root());
+	moonRoots.back().identity = root;
+	moonRoots.back().stableEndpoints.push_back(InetAddress("10.0.0.2/9993"));
+	Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH> mb;
+	const uint64_t moonId = root.address().toInt();
+	World::make(World::TYPE_MOON,moonId,1000,key.pub,moonRoots,key).serialize(mb);
+	char moonFile[64];
+	OSUtils::ztsnprintf(moonFile,sizeof(moonFile),"moons.d" ZT_PATH_SEPARATOR_S "%.16llx.moon",(unsigned long long)moonId);
+	std::map<std::string,std::string> files;
+	files["planet"] = testPlanet(0x1234,2000,key,root);
+	files[moonFile] = std::string((const char *)mb.data(),mb.size());
+
+	TestService s("cli-root-reset","127.0.0.1",files);
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json st,moons;
+	if (!testCheck((s.api("GET","/status",nlohmann::json(),st) == 200)&&(OSUtils::jsonInt(st["planetWorldId"],0ULL) == 0x1234ULL)&&(!OSUtils::jsonBool(st["planetIsDefault"],true)),"custom planet in use"))
+		return -1;
+	if (!testCheck((s.api("GET","/moon",nlohmann::json(),moons) == 200)&&(moons.size() == 1),"moon in use"))
+		return -1;
+
+	// Without confirmation nothing is reset
+	std::string out,err;
+	if (!testCheck((s.cli({ "root","reset" },out,err) == 6)&&(err.find("roots not reset") != std::string::npos),"unconfirmed reset refused"))
+		return -1;
+	if (!testCheck((s.cli({ "root","bogus" },out,err) == 2)&&(s.cli({ "root","reset","now","--yes" },out,err) == 2),"invalid root commands refused"))
+		return -1;
+	std::string saved;
+	if (!testCheck((s.api("GET","/status",nlohmann::json(),st) == 200)&&(OSUtils::jsonInt(st["planetWorldId"],0ULL) == 0x1234ULL)&&(s.api("GET","/moon",nlohmann::json(),moons) == 200)&&(moons.size() == 1),"custom roots kept"))
+		return -1;
+	if (!testCheck((OSUtils::fileExists((s.home + ZT_PATH_SEPARATOR_S + moonFile).c_str()))&&(OSUtils::readFile((s.home + ZT_PATH_SEPARATOR_S "planet").c_str(),saved))&&(saved == files["planet"]),"custom roots still saved"))
+		return -1;
+
+	if (!testCheck((s.cli({ "root","reset","--yes" },out,err) == 0)&&(out.find("200 root reset OK (planet reset, 1 moon(s) removed)") != std::string::npos),"reset"))
+		return -1;
+	if (!testCheck((s.api("GET","/status",nlohmann::json(),st) == 200)&&(OSUtils::jsonInt(st["planetWorldId"],0ULL) != 0x1234ULL)&&(OSUtils::jsonBool(st["planetIsDefault"],false)),"default planet in use"))
+		return -1;
+	if (!testCheck((s.api("GET","/moon",nlohmann::json(),moons) == 200)&&(moons.empty())&&(!OSUtils::fileExists((s.home + ZT_PATH_SEPARATOR_S + moonFile).c_str())),"moon left"))
+		return -1;
+	World planet;
+	try {
+		saved.clear();
+		OSUtils::readFile((s.home + ZT_PATH_SEPARATOR_S "planet").c_str(),saved);
+		planet.deserialize(Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH>(saved.data(),(unsigned int)saved.length()),0);
+	} catch ( ... ) {}
+	if (!testCheck(planet.id() == OSUtils::jsonInt(st["planetWorldId"],0ULL),"default planet saved"))
+		return -1;
+	nlohmann::json roots;
+	if (!testCheck(s.cli({ "-j","roots" },out,err) == 0,"roots after reset"))
+		return -1;
+	try {
+		roots = OSUtils::jsonParse(out);
+	} catch ( ... ) {}
+	bool allDefault = roots.is_array();
+	for(unsigned long k=0;k<roots.size();++k)
+		allDefault &= ((OSUtils::jsonString(roots[k]["source"],"") == "default")&&(OSUtils::jsonBool(roots[k]["default"],false)));
+	if (!testCheck(allDefault,"roots marked default"))
+		return -1;
+
+	// Resetting again changes nothing and still succeeds
+	if (!testCheck((s.cli({ "root","reset","--yes" },out,err) == 0)&&(out.find("200 root reset OK (already using default roots)") != std::string::npos),"second reset"))
+		return -1;
+	nlohmann::json r;
+	if (!testCheck((s.api("POST","/root/reset",nlohmann::json::object(),r) == 200)&&(!OSUtils::jsonBool(r["changed"],true))&&(!OSUtils::jsonBool(r["planetReset"],true))&&(r["moonsRemoved"].empty())&&(OSUtils::jsonInt(r["planetWorldId"],0ULL) == planet.id()),"reset is idempotent"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testServiceIdentityReplace()
+{
+	std::cout << "[cli] Testing node identity replacement file modes and rollback... "; std::cout.flush();
+
+	TestService s("identity-replace");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	const std::string secretPath(s.home + ZT_PATH_SEPARATOR_S "identity.secret");
+	const std::string publicPath(s.home + ZT_PATH_SEPARATOR_S "identity.public");
+	std::string oldSecret,oldPublic,now;
+	if (!testCheck((OSUtils::readFile(secretPath.c_str(),oldSecret))&&(OSUtils::readFile(publicPath.c_str(),oldPublic)),"read identity"))
+		return -1;
+
+	Identity id;
+	id.generate();
+	char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+	nlohmann::json req,r;
+	req["identity"] = id.toString(true,idtmp);
+	std::map<std::string,std::string> confirm;
+	confirm["X-Confirm-Identity-Replace"] = "true";
+	if (!testCheck(s.api("PUT","/node/identity",req,r) == 403,"replace without confirmation refused"))
+		return -1;
+
+	// A failed write puts back the old identity, leaving secret and public matching
+	OSUtils::rm(publicPath.c_str());
+	OSUtils::mkdir(publicPath);
+	if (!testCheck(s.api("PUT","/node/identity",req,r,confirm) == 500,"failed replace reports an error"))
+		return -1;
+	now.clear();
+	if (!testCheck((OSUtils::readFile(secretPath.c_str(),now))&&(now == oldSecret),"old identity restored"))
+		return -1;
+	struct stat st;
+	if (!testCheck((stat(secretPath.c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"restored identity readable only by its owner"))
+		return -1;
+	if (!testCheck((stat((secretPath + ".saved_before_replace").c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"backup readable only by its owner"))
+		return -1;
+
+	OSUtils::rmDashRf(publicPath.c_str());
+	OSUtils::writeFile(publicPath.c_str(),oldPublic);
+	if (!testCheck((s.api("PUT","/node/identity",req,r,confirm) == 200)&&(OSUtils::jsonBool(r["restarting"],false)),"replace identity"))
+		return -1;
+	now.clear();
+	if (!testCheck((OSUtils::readFile(secretPath.c_str(),now))&&(now == std::string(id.toString(true,idtmp))),"new identity saved"))
+		return -1;
+	if (!testCheck((stat(secretPath.c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"new identity readable only by its owner"))
+		return -1;
+	now.clear();
+	if (!testCheck((OSUtils::readFile((secretPath + ".saved_before_replace").c_str(),now))&&(now == oldSecret),"old identity backed up"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliNetworkHooks()
+{
+	std::cout << "[cli] Testing network up and down hook validation... "; std::cout.flush();
+
+	TestService s("cli-network-hooks");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r;
+	settings["private"] = false;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	std::string out,err;
+	if (!testCheck(s.cli({ "join",nwid },out,err) == 0,"join"))
+		return -1;
+
+	if (!testCheck((s.cli({ "network",nwid,"set","uphook","/opt/zt/up" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonString(r["upHook"],"") == "/opt/zt/up"),"set up hook"))
+		return -1;
+
+	// Paths the network's local.conf cannot store are refused, not silently dropped
+	if (!testCheck((s.cli({ "network",nwid,"set","uphook","/opt/a=b" },out,err) == 2)&&(s.cli({ "network",nwid,"set","downhook","opt/down" },out,err) == 2)&&(s.cli({ "network",nwid,"set","downhook","/opt/a\\b" },out,err) == 2),"invalid hooks refused by the cli"))
+		return -1;
+	const char *badHooks[4] = { "/opt/a=b","relative/path","/opt/a\nb","/opt/a\\b" };
+	for(unsigned int i=0;i<4;++i) {
+		nlohmann::json bad;
+		bad["upHook"] = badHooks[i];
+		if (!testCheck((s.api("POST","/network/" + nwid,bad,r) == 400)&&(OSUtils::jsonString(r["message"],"").find("upHook") != std::string::npos),badHooks[i]))
+			return -1;
+	}
+	nlohmann::json bad;
+	bad["downHook"] = std::string("/") + std::string(1000,'a');
+	if (!testCheck(s.api("POST","/network/" + nwid,bad,r) == 400,"long hook refused"))
+		return -1;
+	bad = nlohmann::json::object();
+	bad["downHook"] = 5;
+	if (!testCheck(s.api("POST","/network/" + nwid,bad,r) == 400,"non-string hook refused"))
+		return -1;
+	if (!testCheck((s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonString(r["upHook"],"") == "/opt/zt/up")&&(OSUtils::jsonString(r["downHook"],"") == ""),"hooks unchanged"))
+		return -1;
+
+	if (!testCheck((s.cli({ "network",nwid,"set","uphook","clear" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonString(r["upHook"],"x") == ""),"clear up hook"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliIdentityFiles()
+{
+	std::cout << "[cli] Testing identity import and export file modes... "; std::cout.flush();
+
+	// With no service running the CLI installs the identity itself
+	const std::string stopped(testTempDir("cli-identity-import"));
+	const std::string secretPath(stopped + ZT_PATH_SEPARATOR_S "identity.secret");
+	Identity oldid,id;
+	oldid.generate();
+	id.generate();
+	char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+	const std::string oldSecret(oldid.toString(true,idtmp));
+	const std::string file(stopped + ZT_PATH_SEPARATOR_S "new.secret");
+	std::string out,err,now;
+	if (!testCheck((OSUtils::writeFile(secretPath.c_str(),oldSecret))&&(OSUtils::writeFile(file.c_str(),std::string(id.toString(true,idtmp)))),"write identities"))
+		return -1;
+	chmod(secretPath.c_str(),0644);
+	if (!testCheck(testRunCli({ std::string("-D") + stopped,"-p1","-Tselftest","identity","import",file,"--force" },out,err) == 0,"import identity"))
+		return -1;
+	if (!testCheck((OSUtils::readFile(secretPath.c_str(),now))&&(now == std::string(id.toString(true,idtmp))),"new identity saved"))
+		return -1;
+	struct stat st;
+	if (!testCheck((stat(secretPath.c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"new identity readable only by its owner"))
+		return -1;
+	now.clear();
+	if (!testCheck((OSUtils::readFile((secretPath + ".saved_before_replace").c_str(),now))&&(now == oldSecret),"old identity backed up"))
+		return -1;
+	if (!testCheck((stat((secretPath + ".saved_before_replace").c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"backup readable only by its owner"))
+		return -1;
+
+	// A private key exported to a file is never readable by anyone else
+	const std::string exported(stopped + ZT_PATH_SEPARATOR_S "exported.secret");
+	if (!testCheck((OSUtils::writeFile(exported.c_str(),std::string()))&&(chmod(exported.c_str(),0644) == 0),"create export file"))
+		return -1;
+	if (!testCheck(testRunCli({ std::string("-D") + stopped,"-p1","-Tselftest","identity","export",id.address().toString(idtmp),"--private","--yes",std::string("--output=") + exported },out,err) == 0,"export private identity"))
+		return -1;
+	now.clear();
+	if (!testCheck((OSUtils::readFile(exported.c_str(),now))&&(now == std::string(id.toString(true,idtmp)) + ZT_EOL_S),"private identity exported"))
+		return -1;
+	if (!testCheck((stat(exported.c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"exported identity readable only by its owner"))
+		return -1;
+
+	// An encrypted export only imports again with the right passphrase
+	const std::string encrypted(stopped + ZT_PATH_SEPARATOR_S "exported.json");
+	const std::string cli(testCliPath + " -D" + stopped + " -p1 -Tselftest identity ");
+	if (!testCheck(testRun("/bin/sh",{ "-c","printf 'correct horse\\ncorrect horse\\n' | " + cli + "export " + id.address().toString(idtmp) + " --private --encrypted --yes --output=" + encrypted },out,err) == 0,"export encrypted identity"))
+		return -1;
+	nlohmann::json ej;
+	now.clear();
+	if (!testCheck((OSUtils::readFile(encrypted.c_str(),now))&&(now.find(std::string(id.toString(true,idtmp)).substr(strlen(id.toString(false,idtmp)) + 1)) == std::string::npos),"secret key not exported in the clear"))
+		return -1;
+	try {
+		ej = OSUtils::jsonParse(now);
+	} catch ( ... ) {}
+	if (!testCheck((OSUtils::jsonString(ej["kdf"],"") == "argon2id")&&(OSUtils::jsonString(ej["cipher"],"") == "aes-256-gcm")&&(OSUtils::jsonString(ej["identity"],"") == id.toString(false,idtmp)),"encrypted identity format"))
+		return -1;
+	if (!testCheck((OSUtils::writeFile(secretPath.c_str(),oldSecret))&&(testRun("/bin/sh",{ "-c","printf 'wrong horse\\n' | " + cli + "import " + encrypted + " --decrypt --force" },out,err) == 6)&&(err.find("wrong passphrase") != std::string::npos),"wrong passphrase refused"))
+		return -1;
+	now.clear();
+	if (!testCheck((OSUtils::readFile(secretPath.c_str(),now))&&(now == oldSecret),"identity unchanged after wrong passphrase"))
+		return -1;
+	if (!testCheck(testRun("/bin/sh",{ "-c","printf 'correct horse\\n' | " + cli + "import " + encrypted + " --decrypt --force" },out,err) == 0,"import encrypted identity"))
+		return -1;
+	now.clear();
+	if (!testCheck((OSUtils::readFile(secretPath.c_str(),now))&&(now == std::string(id.toString(true,idtmp))),"decrypted identity saved"))
+		return -1;
+	OSUtils::rmDashRf(stopped.c_str());
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliNetworkLimits()
+{
+	std::cout << "[cli] Testing local network multicast limit and bridge settings... "; std::cout.flush();
+
+	TestService s("cli-network-limits");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r;
+	settings["private"] = false;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	nlohmann::json m;
+	m["activeBridge"] = true;
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/" + s.address,m,r) == 200,"make this node a bridge"))
+		return -1;
+
+	// This node joins its own controller's network, which designates it a bridge
+	std::string out,err;
+	if (!testCheck(s.cli({ "join",nwid },out,err) == 0,"join"))
+		return -1;
+	for(int i=0;i<300;++i) {
+		if ((s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonBool(r["bridge"],false)))
+			break;
+		Thread::sleep(100);
+	}
+	if (!testCheck((OSUtils::jsonBool(r["bridge"],false))&&(OSUtils::jsonBool(r["allowBridging"],false))&&(OSUtils::jsonInt(r["multicastLimit"],1ULL) == 0ULL),"controller's settings by default"))
+		return -1;
+
+	const std::string nlc(s.home + ZT_PATH_SEPARATOR_S "networks.d" ZT_PATH_SEPARATOR_S + nwid + ".local.conf");
+	std::string saved;
+	if (!testCheck((s.cli({ "network",nwid,"set","multicastlimit","8" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonInt(r["multicastLimit"],0ULL) == 8ULL),"set multicast limit"))
+		return -1;
+	if (!testCheck((OSUtils::readFile(nlc.c_str(),saved))&&(saved.find("multicastLimit=8\n") != std::string::npos),"multicast limit saved"))
+		return -1;
+	if (!testCheck((s.cli({ "network",nwid,"set","bridge","false" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(!OSUtils::jsonBool(r["allowBridging"],true))&&(!OSUtils::jsonBool(r["bridge"],true)),"bridging refused locally"))
+		return -1;
+
+	// Invalid values are refused and leave the settings alone
+	if (!testCheck((s.cli({ "network",nwid,"set","multicastlimit","-1" },out,err) == 2)&&(s.cli({ "network",nwid,"set","multicastlimit","lots" },out,err) == 2)&&(s.cli({ "network",nwid,"set","bridge","maybe" },out,err) == 2),"invalid values refused by the cli"))
+		return -1;
+	if (!testCheck((s.cli({ "set",nwid,"multicastLimit=lots" },out,err) == 2)&&(s.cli({ "set",nwid,"multicastLimit=4294967296" },out,err) == 2),"invalid values refused by set"))
+		return -1;
+	nlohmann::json bad;
+	bad["multicastLimit"] = -3;
+	if (!testCheck(s.api("POST","/network/" + nwid,bad,r) == 400,"negative limit refused"))
+		return -1;
+	bad = nlohmann::json::object();
+	bad["multicastLimit"] = 4;
+	bad["allowBridging"] = "no";
+	if (!testCheck(s.api("POST","/network/" + nwid,bad,r) == 400,"non-boolean bridging refused"))
+		return -1;
+	if (!testCheck((s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonInt(r["multicastLimit"],0ULL) == 8ULL)&&(!OSUtils::jsonBool(r["allowBridging"],true)),"settings unchanged"))
+		return -1;
+
+	// Allowing bridging again only restores what the controller allows, with either spelling
+	if (!testCheck((s.cli({ "set",nwid,"multicastLimit=6" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonInt(r["multicastLimit"],0ULL) == 6ULL),"set multicast limit with set"))
+		return -1;
+	if (!testCheck((s.cli({ "set",nwid,"allowBridging=1" },out,err) == 0)&&(s.cli({ "set",nwid,"allowBridging=0" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(!OSUtils::jsonBool(r["allowBridging"],true)),"set bridging with set"))
+		return -1;
+	if (!testCheck((s.cli({ "network",nwid,"set","bridge","true" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonBool(r["bridge"],false)),"bridging allowed again"))
+		return -1;
+	m["activeBridge"] = false;
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/" + s.address,m,r) == 200,"stop making this node a bridge"))
+		return -1;
+	for(int i=0;i<300;++i) {
+		if ((s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(!OSUtils::jsonBool(r["bridge"],true)))
+			break;
+		Thread::sleep(100);
+	}
+	if (!testCheck((!OSUtils::jsonBool(r["bridge"],true))&&(OSUtils::jsonBool(r["allowBridging"],false)),"controller refusal wins"))
+		return -1;
+
+	saved.clear();
+	if (!testCheck((s.cli({ "network",nwid,"set","multicastlimit","default" },out,err) == 0)&&(s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonInt(r["multicastLimit"],1ULL) == 0ULL),"controller's limit again"))
+		return -1;
+	if (!testCheck((OSUtils::readFile(nlc.c_str(),saved))&&(saved.find("multicastLimit") == std::string::npos),"default limit not saved"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliRules()
+{
+	std::cout << "[cli] Testing controller rules compile, add, remove, and test... "; std::cout.flush();
+
+	TestService s("cli-rules");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json r;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",nlohmann::json::object(),r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	const std::string networkPath("/controller/network/" + nwid);
+
+	auto rules = [&](const char *op,const char *a = (const char *)0,const char *b = (const char *)0,const char *c = (const char *)0) {
+		std::vector<std::string> args;
+		args.push_back("controller");
+		args.push_back("rules");
+		args.push_back(nwid);
+		args.push_back(op);
+		if (a) args.push_back(a);
+		if (b) args.push_back(b);
+		if (c) args.push_back(c);
+		std::string out,err;
+		const int ec = s.cli(args,out,err);
+		return std::pair<int,std::string>(ec,out + err);
+	};
+
+	const std::string script(
+		"tag role\n"
+		"\tid 1\n"
+		"\tenum 1 wg\n"
+		";\n"
+		"accept ipprotocol tcp and not chr tcp_syn;\n"
+		"accept ipprotocol udp and dport 51820 and tseq role wg and treq role wg;\n"
+		"drop;\n");
+	const std::string scriptPath(s.home + ZT_PATH_SEPARATOR_S "policy.ztrules");
+	const std::string badPath(s.home + ZT_PATH_SEPARATOR_S "bad.ztrules");
+	OSUtils::writeFile(scriptPath.c_str(),script);
+	OSUtils::writeFile(badPath.c_str(),std::string("accept;\ndrop ethertype ipv5;\n"));
+
+	std::pair<int,std::string> res(rules("compile",scriptPath.c_str(),"--dry-run"));
+	if (!testCheck((res.first == 0)&&(res.second.find("MATCH_TAG_RECEIVER") != std::string::npos),"dry run prints the compiled rules"))
+		return -1;
+	if (!testCheck((s.api("GET",networkPath,nlohmann::json(),r) == 200)&&(r["rules"].size() == 1),"dry run changes nothing"))
+		return -1;
+	res = rules("compile",badPath.c_str());
+	if (!testCheck((res.first == 6)&&(res.second.find("line 2, column 16:") != std::string::npos),"compile error with line and column"))
+		return -1;
+	if (!testCheck(rules("compile",scriptPath.c_str()).first == 0,"compile"))
+		return -1;
+	if (!testCheck((s.api("GET",networkPath,nlohmann::json(),r) == 200)&&(r["rules"].size() == 9)&&(OSUtils::jsonString(r["rulesSource"],"") == script),"compiled rules and source stored"))
+		return -1;
+	if (!testCheck((r["tags"].size() == 1)&&(OSUtils::jsonString(r["tags"][0]["name"],"") == "role"),"script tag defined"))
+		return -1;
+
+	res = rules("list");
+	if (!testCheck((res.first == 0)&&(res.second.find("3    drop") != std::string::npos),"list"))
+		return -1;
+	if (!testCheck(rules("add","drop ethertype arp;","--at=1").first == 0,"add"))
+		return -1;
+	if (!testCheck((s.api("GET",networkPath,nlohmann::json(),r) == 200)&&(r["rules"].size() == 11)&&(OSUtils::jsonInt(r["rules"][0]["etherType"],0ULL) == 0x0806)&&(OSUtils::jsonString(r["rulesSource"],"x") == ""),"rule added first"))
+		return -1;
+	if (!testCheck(rules("add","drop","nosuch","1").first == 2,"add an invalid rule"))
+		return -1;
+	res = rules("test",s.address.c_str(),"1a2b3c4d5e","arp");
+	if (!testCheck((res.first == 0)&&(res.second.find("result: drop by rule 1") != std::string::npos),"test"))
+		return -1;
+	if (!testCheck(rules("remove","1").first == 0,"remove"))
+		return -1;
+	if (!testCheck((s.api("GET",networkPath,nlohmann::json(),r) == 200)&&(r["rules"].size() == 9),"rule removed"))
+		return -1;
+	if (!testCheck(rules("remove","4").first == 5,"remove a rule that doesn't exist"))
+		return -1;
+	if (!testCheck(rules("del","1").first == 2,"del is not a rules command"))
+		return -1;
+
+	std::string out,err;
+	std::vector<std::string> args;
+	args.push_back("controller");
+	args.push_back("rule");
+	args.push_back(nwid);
+	args.push_back("list");
+	if (!testCheck((s.cli(args,out,err) == 0)&&(out.find("3    drop") != std::string::npos),"controller rule still lists rules"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliMemberTags()
+{
+	std::cout << "[cli] Testing member tags and capabilities by name... "; std::cout.flush();
+
+	TestService s("cli-member-tags");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r;
+	testTagNetwork(settings);
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/1a2b3c4d5e",nlohmann::json::object(),r) == 200,"create member"))
+		return -1;
+
+	auto member = [&](const char *a,const char *b,const char *c,const char *d = (const char *)0) {
+		std::vector<std::string> args;
+		args.push_back("controller");
+		args.push_back("member");
+		args.push_back(nwid);
+		args.push_back("1a2b3c4d5e");
+		args.push_back(a);
+		args.push_back(b);
+		args.push_back(c);
+		if (d)
+			args.push_back(d);
+		std::string out,err;
+		return s.cli(args,out,err);
+	};
+	if (!testCheck(member("tag","set","dept","4") == 0,"set tag by name"))
+		return -1;
+	if (!testCheck(member("tag","set","dept","11") == 2,"value outside the declared range"))
+		return -1;
+	if (!testCheck(member("tag","set","2000","9") == 0,"set a tag the rules use by ID"))
+		return -1;
+	if (!testCheck(member("tag","set","4000","1") == 6,"controller rejects an unknown tag ID"))
+		return -1;
+	if (!testCheck(member("tag","set","nosuch","1") == 5,"unknown tag name"))
+		return -1;
+	if (!testCheck(member("cap","add","admin") == 0,"add capability by name"))
+		return -1;
+	if (!testCheck(member("cap","add","8") == 5,"unknown capability"))
+		return -1;
+	if (!testCheck(member("tag","clear","dept") == 0,"clear tag by name"))
+		return -1;
+
+	if (!testCheck(s.api("GET","/controller/network/" + nwid + "/member/1a2b3c4d5e",nlohmann::json(),r) == 200,"get member"))
+		return -1;
+	if (!testCheck((r["tags"] == nlohmann::json::array({ nlohmann::json::array({ 2000,9 }) }))&&(r["capabilities"] == nlohmann::json::array({ 7 })),"member tags and capabilities"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliBackupRestore()
+{
+	std::cout << "[cli] Testing controller backup and restore round trip... "; std::cout.flush();
+
+	TestService s("backup-restore");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,hook,r;
+	settings["name"] = "backed-up";
+	settings["private"] = true;
+	settings["v4AssignMode"]["zt"] = true;
+	settings["ipAssignmentPools"] = nlohmann::json::array();
+	settings["ipAssignmentPools"].push_back(nlohmann::json::object({ { "ipRangeStart","10.9.0.1" },{ "ipRangeEnd","10.9.0.254" } }));
+	settings["routes"] = nlohmann::json::array();
+	settings["routes"].push_back(nlohmann::json::object({ { "target","10.9.0.0/24" } }));
+	settings["tags"] = nlohmann::json::array();
+	settings["tags"].push_back(nlohmann::json::object({ { "id",1000 },{ "default",0 } }));
+	hook["url"] = "http://127.0.0.1:9/hook";
+	hook["secret"] = "backup-webhook-secret";
+	hook["maxAttempts"] = 1;
+	settings["webhooks"] = nlohmann::json::array();
+	settings["webhooks"].push_back(hook);
+	settings["authHook"]["url"] = "http://127.0.0.1:9/admit";
+	settings["authHook"]["secret"] = "backup-authhook-secret";
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	const char *mids[3] = { "1a2b3c4d5e","2b3c4d5e6f","3c4d5e6f7a" };
+	for(int i=0;i<3;++i) {
+		nlohmann::json m;
+		m["name"] = std::string("member-") + mids[i];
+		m["authorized"] = (i != 2);
+		m["ipAssignments"] = nlohmann::json::array();
+		m["ipAssignments"].push_back(std::string("10.9.0.") + std::to_string(10 + i));
+		m["tags"] = nlohmann::json::array();
+		m["tags"].push_back(nlohmann::json::array({ 1000,i }));
+		if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/" + mids[i],m,r) == 200,"create member"))
+			return -1;
+	}
+
+	// Every member, exactly as the API returns it
+	auto members = [&](nlohmann::json &all) {
+		all = nlohmann::json::object();
+		nlohmann::json list;
+		if (s.api("GET","/controller/network/" + nwid + "/member",nlohmann::json(),list) != 200)
+			return false;
+		for(nlohmann::json::iterator m(list.begin());m!=list.end();++m) {
+			if (s.api("GET","/controller/network/" + nwid + "/member/" + m.key(),nlohmann::json(),all[m.key()]) != 200)
+				return false;
+		}
+		return true;
+	};
+	nlohmann::json before,network;
+	if (!testCheck((members(before))&&(before.size() == 3),"read members"))
+		return -1;
+	if (!testCheck(s.api("GET","/controller/network/" + nwid,nlohmann::json(),network) == 200,"read network"))
+		return -1;
+
+	const std::string file(s.home + ZT_PATH_SEPARATOR_S "controller.backup");
+	std::string out,err,saved;
+	std::vector<std::string> args;
+	args.push_back("controller");
+	args.push_back("backup");
+	args.push_back(file);
+	if (!testCheck(s.cli(args,out,err) == 0,"backup"))
+		return -1;
+	struct stat st;
+	if (!testCheck((stat(file.c_str(),&st) == 0)&&((st.st_mode & 0077) == 0),"backup readable only by its owner"))
+		return -1;
+	args[2] = "-";
+	if (!testCheck((s.cli(args,out,err) == 0)&&(out.find("backup-webhook-secret") != std::string::npos)&&(out.find("backup-authhook-secret") != std::string::npos),"backup has the hook secrets"))
+		return -1;
+	const std::string plain(out);
+	nlohmann::json fromFile,fromStdout(OSUtils::jsonParse(plain));
+	try {
+		if (OSUtils::readFile(file.c_str(),saved))
+			fromFile = OSUtils::jsonParse(saved);
+		fromFile.erase("backupTime");
+		fromStdout.erase("backupTime");
+	} catch ( ... ) {
+		fromFile = nlohmann::json();
+	}
+	if (!testCheck((fromFile.is_object())&&(fromFile == fromStdout),"file and standard output get the same plain JSON document"))
+		return -1;
+	args[2] = file;
+
+	// Restoring over changed members puts them back exactly along with their network
+	nlohmann::json change;
+	change["name"] = "changed";
+	change["authorized"] = false;
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/" + mids[0],change,r) == 200,"change member"))
+		return -1;
+	if (!testCheck(s.api("DELETE","/controller/network/" + nwid + "/member/" + mids[1],nlohmann::json(),r) == 200,"delete member"))
+		return -1;
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/4d5e6f7a8b",change,r) == 200,"add member"))
+		return -1;
+	args[1] = "restore";
+	if (!testCheck(s.cli(args,out,err) != 0,"restore onto a controller with networks needs --force"))
+		return -1;
+	args.push_back("--force");
+	if (!testCheck(s.cli(args,out,err) == 0,"restore --force"))
+		return -1;
+	nlohmann::json after;
+	if (!testCheck((members(after))&&(after == before),"members match the backup exactly"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(r == network)&&(OSUtils::jsonBool(r["webhooks"][0]["secretSet"],false)),"network matches the backup with its secret kept"))
+		return -1;
+
+	// ... and onto a controller without the network recreates it
+	if (!testCheck(s.api("DELETE","/controller/network/" + nwid,nlohmann::json(),r) == 200,"delete network"))
+		return -1;
+	args.pop_back();
+	if (!testCheck(s.cli(args,out,err) == 0,"restore"))
+		return -1;
+	if (!testCheck((members(after))&&(after == before),"members recreated exactly"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(r == network),"network recreated exactly"))
+		return -1;
+
+	// The recreated hooks sign with the secrets they had, not with an empty key
+	const std::string networkFile(s.home + ZT_PATH_SEPARATOR_S "controller.d" ZT_PATH_SEPARATOR_S "network" ZT_PATH_SEPARATOR_S + nwid + ".json");
+	std::string stored;
+	if (!testCheck((OSUtils::readFile(networkFile.c_str(),stored))&&(OSUtils::jsonString(OSUtils::jsonParse(stored)["webhooks"][0]["secret"],"") == "backup-webhook-secret")&&(OSUtils::jsonString(OSUtils::jsonParse(stored)["authHook"]["secret"],"") == "backup-authhook-secret"),"secrets restored onto a controller without the network"))
+		return -1;
+
+	// A backup whose hook lost its secret, e.g. one edited by hand, restores with a warning naming the hook
+	nlohmann::json doc(OSUtils::jsonParse(plain));
+	doc["networks"][0]["network"]["webhooks"][0].erase("secret");
+	doc["networks"][0]["network"]["webhooks"][0]["secretSet"] = true;
+	if (!testCheck(OSUtils::writeFile(file.c_str(),OSUtils::jsonDump(doc,-1)),"write edited backup"))
+		return -1;
+	if (!testCheck(s.api("DELETE","/controller/network/" + nwid,nlohmann::json(),r) == 200,"delete network again"))
+		return -1;
+	if (!testCheck((s.cli(args,out,err) == 0)&&(err.find("warning: network " + nwid + " hook http://127.0.0.1:9/hook had a secret that is not in the backup") != std::string::npos)&&(err.find("/admit") == std::string::npos),"missing secret warned"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(!OSUtils::jsonBool(r["webhooks"][0]["secretSet"],true))&&(OSUtils::jsonBool(r["authHook"]["secretSet"],false)),"only the hook without a secret lost it"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliCompletion()
+{
+	std::cout << "[cli] Testing completion scripts against the command table... "; std::cout.flush();
+
+	const std::string dir(testTempDir("completion"));
+	std::string help,err;
+	if (!testCheck(testRunCli(std::vector<std::string>(1,"help"),help,err) == 0,"help"))
+		return -1;
+
+	// Each usage's leading words, as help prints them from the command table, must complete
+	// after the words before them
+	std::map< std::string,std::set<std::string> > expected;
+	bool commands = false;
+	std::vector<std::string> lines(OSUtils::split(help.c_str(),"\r\n","",""));
+	for(std::vector<std::string>::const_iterator l(lines.begin());l!=lines.end();++l) {
+		if (*l == "Available commands:")
+			commands = true;
+		else if (*l == "Available settings:")
+			commands = false;
+		if ((!commands)||(l->length() < 3)||((*l)[0] != ' ')||((*l)[1] != ' ')||((*l)[2] == ' '))
+			continue;
+		std::string prefix;
+		std::vector<std::string> words(OSUtils::split(l->c_str()," ","",""));
+		for(std::vector<std::string>::const_iterator w(words.begin());w!=words.end();++w) {
+			if (((*w)[0] == '<')||((*w)[0] == '[')||((*w)[0] == '-'))
+				break;
+			std::vector<std::string> alts(OSUtils::split(w->c_str(),"|","",""));
+			expected[prefix].insert(alts.begin(),alts.end());
+			prefix += alts[0] + " ";
+		}
+	}
+	if (!testCheck((expected[""].count("controller"))&&(expected["controller "].count("rules"))&&(expected["controller rules "].empty()),"command table read from help"))
+		return -1;
+
+	// Usages wrapped in help carry on after the line break
+	expected["controller rules 8056c2e21c000001 "].insert("test");
+	expected["controller rules 8056c2e21c000001 "].insert("remove");
+	expected["controller tag 8056c2e21c000001 "].insert("remove");
+
+	// Each shell is run the way it runs its completion function, on the words typed so far
+	const std::string cliDir((testCliPath.rfind('/') == std::string::npos) ? std::string(".") : testCliPath.substr(0,testCliPath.rfind('/')));
+	const char *const shells[3] = { "bash","zsh","fish" };
+	std::string skipped;
+	for(int sh=0;sh<3;++sh) {
+		const std::string shell(testFindProgram(shells[sh]));
+		if (shell.empty()) {
+			skipped.append((skipped.empty()) ? "" : " or ").append(shells[sh]);
+			continue;
+		}
+		std::vector<std::string> args;
+		args.push_back("completion");
+		args.push_back(shells[sh]);
+		std::string script;
+		if (!testCheck(testRunCli(args,script,err) == 0,"completion"))
+			return -1;
+		const std::string scriptPath(dir + "/zerotier-cli." + shells[sh]);
+		OSUtils::writeFile(scriptPath.c_str(),script);
+
+		for(std::map< std::string,std::set<std::string> >::const_iterator e(expected.begin());e!=expected.end();++e) {
+			const std::string line(std::string((sh == 2) ? "zerotier-cli" : testCliPath.c_str()) + " -D" + dir + " " + e->first);
+			args.clear();
+			if (sh == 0) {
+				args.push_back("-c");
+				args.push_back("source \"$1\"; COMP_LINE=\"$2\"; COMP_POINT=${#COMP_LINE}; _zerotier_cli; printf '%s\\n' \"${COMPREPLY[@]}\"");
+				args.push_back("bash");
+			} else if (sh == 1) {
+				args.push_back("-f");
+				args.push_back("-c");
+				args.push_back("compdef() { :; }; _files() { :; }; compadd() { local a; for a in \"$@\"; do [[ $a == -* || -z $a ]] || print -r -- \"$a\"; done; }; source \"$1\"; words=(${(z)2} \"\"); CURRENT=${#words}; _zerotier-cli");
+				args.push_back("zsh");
+			} else {
+				args.push_back("--no-config");
+				args.push_back("-c");
+				args.push_back("set -x PATH $argv[1] $PATH; source $argv[2]; complete -C $argv[3]");
+				args.push_back(cliDir);
+			}
+			args.push_back(scriptPath);
+			args.push_back(line);
+			std::string out;
+			testRun(shell,args,out,err);
+			std::set<std::string> got;
+			std::vector<std::string> candidates(OSUtils::split(out.c_str(),"\r\n","",""));
+			for(std::vector<std::string>::const_iterator c(candidates.begin());c!=candidates.end();++c)
+				got.insert(c->substr(0,c->find('\t'))); // fish follows each with a tab and a description
+			for(std::set<std::string>::const_iterator w(e->second.begin());w!=e->second.end();++w) {
+				const std::string why(std::string(shells[sh]) + " completes \"" + e->first + "\" with " + *w);
+				if (!testCheck(got.count(*w) == 1,why.c_str()))
+					return -1;
+			}
+		}
+	}
+
+	// Switches complete once a usage's command words are typed
+	std::vector<std::string> args;
+	args.push_back("__complete");
+	args.push_back("controller");
+	args.push_back("rules");
+	args.push_back("8056c2e21c000001");
+	args.push_back("compile");
+	args.push_back("x");
+	args.push_back("--");
+	std::string out;
+	if (!testCheck((testRunCli(args,out,err) == 0)&&(out.find("--dry-run") != std::string::npos)&&(out.find("--source=") == std::string::npos),"switches"))
+		return -1;
+
+	// Usages wrapped in help carry on after the line break
+	args.resize(1);
+	args.push_back("controller");
+	args.push_back("members");
+	args.push_back("8056c2e21c000001");
+	args.push_back("--");
+	if (!testCheck((testRunCli(args,out,err) == 0)&&(out.find("--authorized") != std::string::npos)&&(out.find("--limit=") != std::string::npos),"wrapped usage"))
+		return -1;
+
+	args.resize(1);
+	args.push_back("--");
+	if (!testCheck((testRunCli(args,out,err) == 0)&&(out.find("--compact") != std::string::npos)&&(out.find("--encoding=base32") != std::string::npos),"global switches"))
+		return -1;
+
+	OSUtils::rmDashRf(dir.c_str());
+	if (skipped.empty())
+		std::cout << "PASS" << std::endl;
+	else std::cout << "PASS (no " << skipped << " to run)" << std::endl;
+	return 0;
+}
+
+static int testCliExitCodes()
+{
+	std::cout << "[cli] Testing exit codes against a stopped service and a missing network... "; std::cout.flush();
+
+	std::string out,err;
+	if (!testCheck((testRunCli({ "help","exitcodes" },out,err) == 0)&&(out.find("3  service unreachable") != std::string::npos)&&(out.find("5  not found") != std::string::npos),"help exitcodes"))
+		return -1;
+	if (!testCheck((testRunCli({ "help" },out,err) == 0)&&(testRunCli({ "help","nosuch" },out,err) == 2),"help"))
+		return -1;
+	if (!testCheck((testRunCli({ "-x","info" },out,err) == 2)&&(testRunCli({ "-p99999","info" },out,err) == 2)&&(testRunCli({ "--color=sometimes","info" },out,err) == 2),"bad options"))
+		return -1;
+
+	// Nothing listens on port 1, and a home without a port file means no service either
+	const std::string stopped(testTempDir("exit-codes-stopped"));
+	auto down = [&](std::vector<std::string> args) {
+		args.insert(args.begin(),"-Tselftest");
+		args.insert(args.begin(),"-p1");
+		args.insert(args.begin(),std::string("-D") + stopped);
+		return testRunCli(args,out,err);
+	};
+	if (!testCheck((down({ "info" }) == 3)&&(down({ "listnetworks" }) == 3)&&(down({ "join","8056c2e21c000001" }) == 3)&&(down({ "leave","8056c2e21c000001" }) == 3),"stopped service"))
+		return -1;
+	if (!testCheck((down({ "network","8056c2e21c000001","show" }) == 3)&&(down({ "controller","networks" }) == 3)&&(down({ "peers" }) == 3),"stopped service, other commands"))
+		return -1;
+	if (!testCheck((down({ "join","8056c2e21c" }) == 2)&&(down({ "nosuchcommand" }) == 2),"usage errors come before connecting"))
+		return -1;
+	if (!testCheck(testRunCli({ std::string("-D") + stopped,"info" },out,err) == 3,"no port file"))
+		return -1;
+	OSUtils::rmDashRf(stopped.c_str());
+
+	TestService s("cli-exit-codes");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	const std::string missing("8056c2e21c00ffff");
+	if (!testCheck((s.cli({ "leave",missing },out,err) == 5)&&(s.cli({ "get",missing,"name" },out,err) == 5)&&(s.cli({ "network",missing,"show" },out,err) == 5),"missing network"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","members",missing },out,err) == 5)&&(s.cli({ "controller","delete",missing,"--yes" },out,err) == 5),"missing controller network"))
+		return -1;
+	if (!testCheck((s.cli({ "-Twrong","info" },out,err) == 4)&&(s.cli({ "-Twrong","listnetworks" },out,err) == 4),"refused token"))
+		return -1;
+	if (!testCheck((s.cli({ "info" },out,err) == 0)&&(s.cli({ "listnetworks" },out,err) == 0),"success"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliQuiet()
+{
+	std::cout << "[cli] Testing quiet mode output byte for byte... "; std::cout.flush();
+
+	TestService s("cli-quiet");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r;
+	settings["private"] = true;
+	settings["v4AssignMode"]["zt"] = true;
+	settings["routes"] = OSUtils::jsonParse("[{\"target\":\"10.147.17.0/24\"}]");
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	nlohmann::json member;
+	member["authorized"] = true;
+	member["ipAssignments"] = OSUtils::jsonParse("[\"10.147.17.5\"]");
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/" + s.address,member,r) == 200,"authorize own member"))
+		return -1;
+
+	std::string out,err;
+	if (!testCheck((s.cli({ "-q","info" },out,err) == 0)&&(out == s.address + ZT_EOL_S),"info prints the address"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","listnetworks" },out,err) == 0)&&(out.empty()),"no networks prints nothing"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","join",nwid },out,err) == 0)&&(out.empty())&&(err.empty()),"join prints nothing"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","listnetworks" },out,err) == 0)&&(out == nwid + ZT_EOL_S),"listnetworks prints network IDs"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","controller","networks" },out,err) == 0)&&(out == nwid + ZT_EOL_S),"controller networks prints network IDs"))
+		return -1;
+	for(int i=0;i<300;++i) { // so a network that can't come up fails here rather than hanging the watch
+		if ((s.api("GET","/network/" + nwid,nlohmann::json(),r) == 200)&&(r["status"] == "OK"))
+			break;
+		Thread::sleep(100);
+	}
+	if (!testCheck(r["status"] == "OK","network up"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","network",nwid,"show","--watch","--interval=1" },out,err) == 0)&&(out == std::string("10.147.17.5/24") + ZT_EOL_S),"watch prints only the assigned address"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","network",nwid,"show" },out,err) == 0)&&(out == std::string("10.147.17.5/24") + ZT_EOL_S),"network show prints the assigned address"))
+		return -1;
+
+	// -j wins, and errors keep their exit codes but go to stderr
+	if (!testCheck((s.cli({ "-q","-j","info" },out,err) == 0)&&(OSUtils::jsonString(OSUtils::jsonParse(out)["address"],"") == s.address),"-j wins over -q"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","join","8056c2e21c" },out,err) == 2)&&(out.empty())&&(!err.empty()),"usage error on stderr"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","network","8056c2e21c00ffff","show" },out,err) == 5)&&(out.empty())&&(err.find("404") != std::string::npos),"not found on stderr"))
+		return -1;
+	if (!testCheck((s.cli({ "network","8056c2e21c00ffff","show" },out,err) == 5)&&(out.find("404") != std::string::npos),"not found on stdout without -q"))
+		return -1;
+	if (!testCheck((s.cli({ "-q","leave",nwid },out,err) == 0)&&(out.empty())&&(err.empty()),"leave prints nothing"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliColor()
+{
+	std::cout << "[cli] Testing color with NO_COLOR, without a terminal, and forced... "; std::cout.flush();
+
+	TestService s("cli-color");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	const std::vector<std::string> noColor(1,"NO_COLOR=1");
+	std::string out,err;
+	auto colored = [&](std::vector<std::string> args,const std::vector<std::string> &env,const bool tty) {
+		args.push_back("info");
+		if (s.cli(args,out,err,env,tty) != 0)
+			return -1;
+		return (out.find('\033') != std::string::npos) ? 1 : 0;
+	};
+	if (!testCheck((colored({},std::vector<std::string>(),false) == 0)&&(colored({ "--color=auto" },std::vector<std::string>(),false) == 0),"not a terminal"))
+		return -1;
+	if (!testCheck((colored({},noColor,true) == 0)&&(colored({ "--color=auto" },noColor,true) == 0),"NO_COLOR on a terminal"))
+		return -1;
+	if (!testCheck(colored({ "--color=never" },std::vector<std::string>(),true) == 0,"never on a terminal"))
+		return -1;
+	if (!testCheck((colored({ "--color=always" },std::vector<std::string>(),false) == 1)&&(colored({ "--color=always" },noColor,false) == 1),"always"))
+		return -1;
+	if (!testCheck(colored({ "-j","--color=always" },std::vector<std::string>(),false) == 0,"JSON never colored"))
+		return -1;
+
+	// Headers are bold and statuses colored by what they mean
+	if (!testCheck((s.cli({ "--color=always","listnetworks" },out,err) == 0)&&(out.find("\033[1m200 listnetworks <nwid>") == 0),"bold header"))
+		return -1;
+	if (!testCheck((s.cli({ "--color=never","listnetworks" },out,err) == 0)&&(out.find("200 listnetworks <nwid>") == 0),"plain header"))
+		return -1;
+	if (!testCheck((s.cli({ "--color=always","info" },out,err) == 0)&&((out.find("\033[32mONLINE\033[0m") != std::string::npos)||(out.find("\033[31mOFFLINE\033[0m") != std::string::npos)),"colored status"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliPeerTry()
+{
+	std::cout << "[cli] Testing peer try against a second service... "; std::cout.flush();
+
+	const std::string ip(testPathAddress());
+	if (ip.empty()) {
+		std::cout << "SKIPPED (no non-loopback IPv4 address)" << std::endl;
+		return 0;
+	}
+
+	// a knows b as the only root of its planet, so b is a known peer
+	TestService b("peer-try-b",ip.c_str());
+	if (!testCheck(b.ok(),"start b"))
+		return -1;
+	nlohmann::json st,r;
+	if (!testCheck(b.api("GET","/status",nlohmann::json(),st) == 200,"status"))
+		return -1;
+	const std::string live(ip + "/" + std::to_string(b.udpPort));
+	const C25519::Pair key(C25519::generate());
+	std::map<std::string,std::string> files;
+	files["planet"] = testPlanet(0x1234,2000,key,Identity(OSUtils::jsonString(st["publicIdentity"],"").c_str()),live.c_str());
+	TestService a("peer-try-a",ip.c_str(),files);
+	if (!testCheck(a.ok(),"start a"))
+		return -1;
+
+	std::string out,err;
+	std::vector<std::string> args;
+	args.push_back("-j");
+	args.push_back("peer");
+	args.push_back(b.address);
+	args.push_back("try");
+	args.push_back(live);
+	args.push_back("127.0.0.1/9");
+	args.push_back("--timeout=3s");
+	if (!testCheck(a.cli(args,out,err) == 0,"try with one live endpoint"))
+		return -1;
+	try {
+		r = OSUtils::jsonParse(out);
+	} catch ( ... ) {
+		r = nlohmann::json();
+	}
+	nlohmann::json &eps = r["endpoints"];
+	if (!testCheck((eps.is_array())&&(eps.size() == 2),"endpoints in result"))
+		return -1;
+	if (!testCheck((OSUtils::jsonString(eps[0]["endpoint"],"") == live)&&(OSUtils::jsonBool(eps[0]["active"],false))&&(OSUtils::jsonString(eps[0]["result"],"") == "active"),"live endpoint became active"))
+		return -1;
+	if (!testCheck((!OSUtils::jsonBool(eps[1]["active"],true))&&(OSUtils::jsonString(eps[1]["result"],"") == "failed"),"dead endpoint failed"))
+		return -1;
+	if (!testCheck(OSUtils::jsonInt(r["waited"],0) >= 3000,"waited for the dead endpoint"))
+		return -1;
+
+	// The peer has answered, so its protocol version is known
+	if (!testCheck(a.api("GET","/peer/" + b.address,nlohmann::json(),r) == 200,"get peer"))
+		return -1;
+	if (!testCheck((r["versionProto"].is_number())&&((int)r["versionProto"] == ZT_PROTO_VERSION),"peer protocol version"))
+		return -1;
+
+	args.clear();
+	args.push_back("peer");
+	args.push_back(b.address);
+	args.push_back("try");
+	args.push_back("127.0.0.1/9");
+	args.push_back("--timeout=1s");
+	if (!testCheck(a.cli(args,out,err) == 6,"try with no live endpoint"))
+		return -1;
+	if (!testCheck(out.find("127.0.0.1/9") != std::string::npos && out.find("FAILED") != std::string::npos,"failed endpoint printed"))
+		return -1;
+	args.back() = "--timeout=31s";
+	if (!testCheck(a.cli(args,out,err) == 2,"timeout out of range"))
+		return -1;
+
+	// A held response is wrapped for JSONP like any other
+	nlohmann::json t;
+	t["endpoints"] = nlohmann::json::array({ "127.0.0.1/9" });
+	t["timeout"] = 1000;
+	const std::string body(OSUtils::jsonDump(t,-1));
+	InetAddress addr((std::string("127.0.0.1/") + std::to_string(a.port)).c_str());
+	std::map<std::string,std::string> headers,responseHeaders;
+	std::string responseBody;
+	headers["X-ZT1-Auth"] = a.authToken;
+	headers["Content-Type"] = "application/json";
+	headers["Content-Length"] = std::to_string(body.length());
+	if (!testCheck(Http::POST(16777216,30000,(const struct sockaddr *)&addr,("/peer/" + b.address + "/try?jsonp=cb").c_str(),headers,body.data(),(unsigned long)body.length(),responseHeaders,responseBody) == 200,"try with jsonp"))
+		return -1;
+	if (!testCheck((responseBody.compare(0,3,"cb(") == 0)&&(responseBody.find("\"failed\"") != std::string::npos)&&(responseBody.substr(responseBody.length() - 2) == ");")&&(responseHeaders["content-type"] == "application/javascript"),"jsonp response"))
+		return -1;
+
+	t["timeout"] = 30001;
+	if (!testCheck(a.api("POST","/peer/" + b.address + "/try",t,r) == 400,"timeout out of range"))
+		return -1;
+	t["timeout"] = 1000;
+	if (!testCheck(a.api("POST","/peer/0123456789/try",t,r) == 404,"unknown peer"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerNew()
+{
+	std::cout << "[cli] Testing controller new creates networks that can be fetched... "; std::cout.flush();
+
+	TestService s("cli-controller-new");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	std::string out,err;
+	nlohmann::json r;
+
+	// Private with no pools by default
+	if (!testCheck((s.cli({ "controller","new" },out,err) == 0)&&(out.length() == 17)&&(out.compare(0,10,s.address) == 0),"new prints the network ID"))
+		return -1;
+	const std::string plain(out.substr(0,16));
+	if (!testCheck((s.api("GET","/controller/network/" + plain,nlohmann::json(),r) == 200)&&(r["id"] == plain)&&(OSUtils::jsonBool(r["private"],false))&&(r["ipAssignmentPools"].empty())&&(r["routes"].empty()),"default network"))
+		return -1;
+
+	if (!testCheck(s.cli({ "controller","new","--name=lab","--public","--ipv4-pool=10.147.17.0/24" },out,err) == 0,"new with options"))
+		return -1;
+	const std::string lab(out.substr(0,16));
+	if (!testCheck((s.api("GET","/controller/network/" + lab,nlohmann::json(),r) == 200)&&(r["name"] == "lab")&&(!OSUtils::jsonBool(r["private"],true))&&(OSUtils::jsonBool(r["v4AssignMode"]["zt"],false)),"named public network"))
+		return -1;
+	if (!testCheck((r["routes"].size() == 1)&&(r["routes"][0]["target"] == "10.147.17.0/24")&&(r["routes"][0]["via"].is_null()),"pool's route added"))
+		return -1;
+	if (!testCheck((r["ipAssignmentPools"].size() == 1)&&(r["ipAssignmentPools"][0]["ipRangeStart"] == "10.147.17.1")&&(r["ipAssignmentPools"][0]["ipRangeEnd"] == "10.147.17.254"),"pool range"))
+		return -1;
+
+	if (!testCheck(s.cli({ "-j","controller","new","--name=json" },out,err) == 0,"new with -j"))
+		return -1;
+	try {
+		r = OSUtils::jsonParse(out);
+	} catch ( ... ) {
+		r = nlohmann::json();
+	}
+	if (!testCheck((r["name"] == "json")&&(OSUtils::jsonString(r["id"],"").length() == 16),"-j prints the network"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network",nlohmann::json(),r) == 200)&&(r.size() == 3),"all networks listed"))
+		return -1;
+
+	if (!testCheck((s.cli({ "controller","new","--ipv4-pool=10.147.17.0" },out,err) == 2)&&(s.cli({ "controller","new","--ipv4-pool=fd00::/64" },out,err) == 2),"invalid pool"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerDelete()
+{
+	std::cout << "[cli] Testing controller delete removes the network's members... "; std::cout.flush();
+
+	TestService s("cli-controller-delete");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r,m;
+	settings["name"] = "lab";
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	const std::string memberFile(s.home + "/controller.d/network/" + nwid + "/member/1111111111.json");
+	m["authorized"] = true;
+	if (!testCheck((s.api("POST","/controller/network/" + nwid + "/member/1111111111",m,r) == 200)&&(s.api("POST","/controller/network/" + nwid + "/member/2222222222",nlohmann::json::object(),r) == 200),"create members"))
+		return -1;
+	if (!testCheck(OSUtils::fileExists(memberFile.c_str()),"member saved"))
+		return -1;
+
+	// Without --yes, the confirmation gets no answer and nothing is deleted
+	std::string out,err;
+	if (!testCheck((s.cli({ "controller","delete",nwid },out,err) == 6)&&(err.find("Delete network " + nwid + " (lab) and its 2 member(s)?") != std::string::npos)&&(err.find("not deleted") != std::string::npos),"not confirmed"))
+		return -1;
+	if (!testCheck(s.api("GET","/controller/network/" + nwid + "/member/1111111111",nlohmann::json(),r) == 200,"member kept"))
+		return -1;
+
+	if (!testCheck(s.cli({ "-j","controller","delete",nwid,"--yes","--deauth-first" },out,err) == 0,"delete"))
+		return -1;
+	r = OSUtils::jsonParse(out);
+	if (!testCheck((r["id"] == nwid)&&(r["name"] == "lab")&&(r["membersDeleted"] == 2)&&(r["membersDeauthorized"] == 2),"delete result"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 404)&&(s.api("GET","/controller/network/" + nwid + "/member/1111111111",nlohmann::json(),r) == 404)&&(s.api("GET","/controller/network/" + nwid + "/member/2222222222",nlohmann::json(),r) == 404),"network and members gone"))
+		return -1;
+	if (!testCheck(!OSUtils::fileExists(memberFile.c_str()),"member file gone"))
+		return -1;
+
+	// A network made again with the same ID starts with no members
+	if (!testCheck((s.api("POST","/controller/network/" + nwid,nlohmann::json::object(),r) == 200)&&(s.api("GET","/controller/network/" + nwid + "/member",nlohmann::json(),r) == 200)&&(r.empty()),"recreated network has no members"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","delete","8056c2e21c00ffff","--yes" },out,err) == 5)&&(err.find("does not exist on this controller") != std::string::npos),"missing network"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerDns()
+{
+	std::cout << "[cli] Testing controller DNS set, replace, and clear... "; std::cout.flush();
+
+	TestService s("cli-controller-dns");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r;
+	settings["routes"] = OSUtils::jsonParse("[{\"target\":\"10.147.17.0/24\"},{\"target\":\"0.0.0.0/0\",\"via\":\"10.147.17.1\"}]");
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	auto dns = [&]() {
+		r = nlohmann::json();
+		s.api("GET","/controller/network/" + nwid,nlohmann::json(),r);
+		return r["dns"];
+	};
+
+	std::string out,err;
+	if (!testCheck((s.cli({ "controller","dns",nwid,"show" },out,err) == 0)&&(out == std::string("200 controller dns: none") + ZT_EOL_S),"none at first"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","dns",nwid,"set","lab.example","10.147.17.2" },out,err) == 0)&&(err.empty())&&(out == std::string("200 controller dns" ZT_EOL_S "domain  lab.example" ZT_EOL_S "servers 10.147.17.2") + ZT_EOL_S),"set"))
+		return -1;
+	if (!testCheck((dns()["domain"] == "lab.example")&&(r["dns"]["servers"] == nlohmann::json::array({ "10.147.17.2" })),"set on the controller"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","set",nwid },out,err) == 0)&&(out.find("dns                    lab.example 10.147.17.2") != std::string::npos),"shown by controller set"))
+		return -1;
+
+	// Setting again replaces the domain and every server, warning about those members may not
+	// reach (a default route doesn't count)
+	if (!testCheck((s.cli({ "controller","dns",nwid,"set","corp.example","10.147.17.3","fd00::53","8.8.8.8" },out,err) == 0),"replace"))
+		return -1;
+	if (!testCheck((err.find("DNS server fd00::53 is not within") != std::string::npos)&&(err.find("DNS server 8.8.8.8 is not within") != std::string::npos)&&(err.find("10.147.17.3") == std::string::npos),"warnings for unreachable servers"))
+		return -1;
+	if (!testCheck((dns()["domain"] == "corp.example")&&(r["dns"]["servers"] == nlohmann::json::array({ "10.147.17.3","fd00::53","8.8.8.8" })),"replaced on the controller"))
+		return -1;
+
+	if (!testCheck((s.cli({ "controller","dns",nwid,"set","bad_domain","10.147.17.2" },out,err) == 2)&&(s.cli({ "controller","dns",nwid,"set","lab.example","10.147.17.0/24" },out,err) == 2),"invalid domain and server"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","dns",nwid,"set","lab.example","10.147.17.2","10.147.17.2" },out,err) == 2)&&(s.cli({ "controller","dns",nwid,"set","lab.example","10.147.17.2","10.147.17.3","10.147.17.4","10.147.17.5","10.147.17.6" },out,err) == 2),"repeated and too many servers"))
+		return -1;
+	if (!testCheck(dns()["domain"] == "corp.example","unchanged by invalid settings"))
+		return -1;
+
+	if (!testCheck((s.cli({ "controller","dns",nwid,"clear" },out,err) == 0)&&(out == std::string("200 controller dns: none") + ZT_EOL_S),"clear"))
+		return -1;
+	if (!testCheck(dns().empty(),"cleared on the controller"))
+		return -1;
+	if (!testCheck((s.cli({ "-j","controller","dns",nwid,"show" },out,err) == 0)&&(OSUtils::jsonParse(out) == nlohmann::json::object()),"show with -j"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerMigrateDb()
+{
+	std::cout << "[cli] Testing controller migrate-db... "; std::cout.flush();
+
+	std::string out,err;
+	const std::string home(testTempDir("cli-migrate-db"));
+	auto migrate = [&]() {
+		return testRunCli({ std::string("-D") + home,"-p1","-Tselftest","controller","migrate-db","sqlite" },out,err);
+	};
+	if (!testCheck(testRunCli({ std::string("-D") + home,"-p1","-Tselftest","controller","migrate-db","postgres" },out,err) == 2,"unknown target"))
+		return -1;
+#ifdef ZT_CONTROLLER_USE_SQLITE
+	// Networks and members with different revisions and contents, some members edited after creation
+	const std::string dbPath(home + ZT_PATH_SEPARATOR_S "controller.d");
+	unsigned long records = 0;
+	{
+		FileDB db(dbPath.c_str());
+		const char *const nwids[3] = { "8056c2e21c000001","8056c2e21c000002","8056c2e21c000003" };
+		for(int i=0;i<3;++i) {
+			nlohmann::json network;
+			network["id"] = network["nwid"] = nwids[i];
+			network["name"] = std::string("migrated-") + std::to_string(i);
+			network["private"] = (i != 2);
+			network["routes"] = nlohmann::json::array({ nlohmann::json::object({ { "target",std::string("10.") + std::to_string(i) + ".0.0/16" },{ "via",nullptr } }) });
+			DB::initNetwork(network);
+			db.save(network,false);
+			++records;
+			for(int k=0;k<(i * 2);++k) {
+				char mid[16];
+				OSUtils::ztsnprintf(mid,sizeof(mid),"%.10llx",0x0a1b2c3d00ULL + (unsigned long long)((i * 16) + k));
+				nlohmann::json member;
+				member["id"] = member["address"] = mid;
+				member["nwid"] = nwids[i];
+				member["objtype"] = "member";
+				member["name"] = std::string("node-") + mid;
+				member["tags"] = nlohmann::json::array({ nlohmann::json::array({ 2000,k }) });
+				DB::initMember(member);
+				db.save(member,false);
+				if (k & 1) {
+					member["authorized"] = true;
+					member["ipAssignments"] = nlohmann::json::array({ std::string("10.") + std::to_string(i) + ".0." + std::to_string(k + 1) });
+					db.save(member,false);
+				}
+				++records;
+			}
+		}
+	}
+
+	if (!testCheck((migrate() == 0)&&(out.find("3 networks and 6 members copied") != std::string::npos),"migrate"))
+		return -1;
+	const std::string sqlitePath(dbPath + ZT_PATH_SEPARATOR_S ZT_CONTROLLER_SQLITEDB_FILENAME);
+	if (!testCheck(OSUtils::fileExists(sqlitePath.c_str(),false),"database created"))
+		return -1;
+
+	// Every record, revisions included, reads back the same from the new database
+	{
+		FileDB src(dbPath.c_str());
+		SQLiteDB dst(dbPath.c_str());
+		unsigned long same = 0,copied = 0;
+		src.each([&](uint64_t networkId,const nlohmann::json &network,uint64_t memberId,const nlohmann::json &member) {
+			nlohmann::json n,m;
+			if (memberId) {
+				if ((dst.get(networkId,n,memberId,m))&&(m == member))
+					++same;
+			} else if ((dst.get(networkId,n))&&(n == network)) {
+				++same;
+			}
+		});
+		dst.each([&](uint64_t,const nlohmann::json &,uint64_t,const nlohmann::json &) { ++copied; });
+		if (!testCheck((same == records)&&(copied == records),"every record preserved"))
+			return -1;
+	}
+
+	// An existing database is never overwritten
+	if (!testCheck((migrate() == 6)&&(err.find("already exists") != std::string::npos),"existing database refused"))
+		return -1;
+	OSUtils::rmDashRf(home.c_str());
+
+	// Nor does it run while the service that owns the data is up
+	TestService s("cli-migrate-db");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","migrate-db","sqlite" },out,err) == 6)&&(err.find("stop it") != std::string::npos)&&(!OSUtils::fileExists((s.home + ZT_PATH_SEPARATOR_S "controller.d" ZT_PATH_SEPARATOR_S ZT_CONTROLLER_SQLITEDB_FILENAME).c_str(),false)),"running service refused"))
+		return -1;
+#else
+	if (!testCheck((migrate() == 6)&&(err.find("ZT_CONTROLLER_SQLITE=1") != std::string::npos),"build without SQLite"))
+		return -1;
+	OSUtils::rmDashRf(home.c_str());
+#endif
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerMemberNames()
+{
+	std::cout << "[cli] Testing controller member selection by name... "; std::cout.flush();
+
+	TestService s("cli-member-names");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json r;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",nlohmann::json::object(),r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	const char *const members[4][2] = { { "1a2b3c4d5e","laptop" },{ "2b3c4d5e6f","laptop-2" },{ "3c4d5e6f7a","shared" },{ "4d5e6f7a8b","shared" } };
+	for(int i=0;i<4;++i) {
+		nlohmann::json m;
+		m["name"] = members[i][1];
+		if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/" + members[i][0],m,r) == 200,"create member"))
+			return -1;
+	}
+	auto authorized = [&](const char *address) {
+		return ((s.api("GET","/controller/network/" + nwid + "/member/" + address,nlohmann::json(),r) == 200)&&(OSUtils::jsonBool(r["authorized"],false)));
+	};
+
+	// A name only one member has selects it, even when other names contain it
+	std::string out,err;
+	if (!testCheck((s.cli({ "-j","controller","member",nwid,"laptop" },out,err) == 0)&&(OSUtils::jsonString(OSUtils::jsonParse(out)["id"],"") == "1a2b3c4d5e"),"show by name"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","auth",nwid,"laptop" },out,err) == 0)&&(authorized("1a2b3c4d5e"))&&(!authorized("2b3c4d5e6f")),"auth by name"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","member",nwid,"laptop-2","description","spare" },out,err) == 0)&&(s.api("GET","/controller/network/" + nwid + "/member/2b3c4d5e6f",nlohmann::json(),r) == 200)&&(r["description"] == "spare"),"member command by name"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","deauth",nwid,"laptop" },out,err) == 0)&&(!authorized("1a2b3c4d5e")),"deauth by name"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","auth",nwid,"nosuch" },out,err) == 5)&&(err.find("not an address or the name of a member") != std::string::npos),"unknown name"))
+		return -1;
+
+	// A name several members share selects none of them, and the error lists who has it
+	if (!testCheck((s.cli({ "controller","auth",nwid,"shared" },out,err) == 2)&&(err.find("more than one member") != std::string::npos)&&(err.find("3c4d5e6f7a") != std::string::npos)&&(err.find("4d5e6f7a8b") != std::string::npos),"ambiguous name refused"))
+		return -1;
+	if (!testCheck((!authorized("3c4d5e6f7a"))&&(!authorized("4d5e6f7a8b")),"nobody authorized by an ambiguous name"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","deauth",nwid,"shared" },out,err) == 2)&&(s.cli({ "controller","member",nwid,"shared" },out,err) == 2),"ambiguous name refused by other commands"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","auth",nwid,"3c4d5e6f7a" },out,err) == 0)&&(authorized("3c4d5e6f7a")),"address still works"))
+		return -1;
+
+	// Giving a member a name another already has warns, but still sets it
+	if (!testCheck((s.cli({ "controller","member",nwid,"1a2b3c4d5e","name","shared" },out,err) == 0)&&(err.find("warning: 3c4d5e6f7a is also named shared") != std::string::npos)&&(err.find("warning: 4d5e6f7a8b is also named shared") != std::string::npos),"collision warned"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid + "/member/1a2b3c4d5e",nlohmann::json(),r) == 200)&&(r["name"] == "shared")&&(s.cli({ "controller","member",nwid,"laptop" },out,err) == 5),"name set despite the warning"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","member",nwid,"3c4d5e6f7a","name","unique" },out,err) == 0)&&(err.find("warning") == std::string::npos),"no warning for a new name"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","member",nwid,"unique","name","unique" },out,err) == 0)&&(err.find("warning") == std::string::npos),"no warning for a member's own name"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerSet()
+{
+	std::cout << "[cli] Testing controller set reads and changes network settings... "; std::cout.flush();
+
+	TestService s("cli-controller-set");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json r;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",nlohmann::json::object(),r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	std::string out,err;
+
+	if (!testCheck((s.cli({ "controller","set",nwid,"private" },out,err) == 0)&&(out == std::string("true") + ZT_EOL_S),"private by default"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","set",nwid,"private","false" },out,err) == 0)&&(s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(!OSUtils::jsonBool(r["private"],true)),"made public"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","set",nwid,"public" },out,err) == 0)&&(out == std::string("true") + ZT_EOL_S),"public reads inverted"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","set",nwid,"public","no" },out,err) == 0)&&(s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonBool(r["private"],false)),"made private again"))
+		return -1;
+
+	if (!testCheck((s.cli({ "controller","set",nwid,"name","lab" },out,err) == 0)&&(s.cli({ "controller","set",nwid,"name" },out,err) == 0)&&(out == std::string("lab") + ZT_EOL_S),"name"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","set",nwid,"v6AssignMode.rfc4193","true" },out,err) == 0)&&(s.cli({ "controller","set",nwid,"v6AssignMode.6plane","on" },out,err) == 0),"assign modes"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonBool(r["v6AssignMode"]["rfc4193"],false))&&(OSUtils::jsonBool(r["v6AssignMode"]["6plane"],false)),"both assign modes kept"))
+		return -1;
+	if (!testCheck((s.cli({ "-j","controller","set",nwid,"mtu","1400" },out,err) == 0)&&(OSUtils::jsonInt(OSUtils::jsonParse(out)["mtu"],0ULL) == 1400),"mtu with -j"))
+		return -1;
+
+	// Dump every setting, and validate before sending anything
+	if (!testCheck((s.cli({ "controller","set",nwid },out,err) == 0)&&(out.find("name                   lab") != std::string::npos)&&(out.find("mtu                    1400") != std::string::npos),"dump"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","set",nwid,"mtu","100" },out,err) == 2)&&(s.cli({ "controller","set",nwid,"private","maybe" },out,err) == 2),"invalid values"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","set",nwid,"colour","blue" },out,err) == 2)&&(err.find("valid settings are: name private public") != std::string::npos),"unknown setting lists valid ones"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid,nlohmann::json(),r) == 200)&&(OSUtils::jsonInt(r["mtu"],0ULL) == 1400)&&(OSUtils::jsonBool(r["private"],false)),"unchanged by invalid values"))
+		return -1;
+	if (!testCheck(s.cli({ "controller","set","8056c2e21c00ffff","name" },out,err) == 5,"missing network"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerNetworks()
+{
+	std::cout << "[cli] Testing controller networks member counts and sorting... "; std::cout.flush();
+
+	TestService s("cli-controller-networks");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	std::map<std::string,std::string> ids;
+	const char *names[3] = { "charlie","alpha","bravo" };
+	nlohmann::json r;
+	for(int i=0;i<3;++i) {
+		nlohmann::json settings;
+		settings["name"] = names[i];
+		settings["private"] = (i != 2);
+		if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+			return -1;
+		ids[names[i]] = OSUtils::jsonString(r["id"],"");
+	}
+	auto member = [&](const char *nw,const std::string &address,const bool authorized) {
+		nlohmann::json m;
+		m["authorized"] = authorized;
+		return (s.api("POST","/controller/network/" + ids[nw] + "/member/" + address,m,r) == 200);
+	};
+	if (!testCheck((member("alpha","1111111111",true))&&(member("alpha","2222222222",true))&&(member("alpha","3333333333",false))&&(member("bravo","1111111111",false)),"create members"))
+		return -1;
+
+	// This node joining bravo makes it bravo's one active (and, as bravo is public, authorized) member
+	std::string out,err;
+	if (!testCheck(s.cli({ "join",ids["bravo"] },out,err) == 0,"join"))
+		return -1;
+	for(int i=0;i<300;++i) {
+		if ((s.api("GET","/controller/network/" + ids["bravo"] + "/summary",nlohmann::json(),r) == 200)&&(OSUtils::jsonInt(r["activeMemberCount"],0ULL) == 1))
+			break;
+		Thread::sleep(100);
+	}
+	if (!testCheck(OSUtils::jsonInt(r["activeMemberCount"],0ULL) == 1,"member active"))
+		return -1;
+
+	// Each row is <nwid> <name> <access> <members> <auth> <limit> <active> <created> <pools>
+	auto rows = [&](std::vector<std::string> args) {
+		std::vector<std::string> names;
+		args.insert(args.begin(),"networks");
+		args.insert(args.begin(),"controller");
+		if (s.cli(args,out,err) != 0)
+			return names;
+		std::vector<std::string> lines(OSUtils::split(out.c_str(),"\r\n","",""));
+		for(std::vector<std::string>::const_iterator l(lines.begin());l!=lines.end();++l) {
+			std::vector<std::string> f(OSUtils::split(l->c_str()," ","",""));
+			if ((f.size() == 9)&&(f[0].length() == 16))
+				names.push_back(f[1] + " " + f[2] + " " + f[3] + " " + f[4] + " " + f[6] + " " + f[8]);
+		}
+		return names;
+	};
+	std::vector<std::string> byId(rows({})),byName(rows({ "--sort=name" })),byMembers(rows({ "--sort=members" }));
+	if (!testCheck((byName.size() == 3)&&(byName[0] == "alpha PRIVATE 3 2 0 -")&&(byName[1] == "bravo PUBLIC 2 1 1 -")&&(byName[2] == "charlie PRIVATE 0 0 0 -"),"counts by name"))
+		return -1;
+	if (!testCheck((byMembers.size() == 3)&&(byMembers[0].compare(0,5,"alpha") == 0)&&(byMembers[1].compare(0,5,"bravo") == 0)&&(byMembers[2].compare(0,7,"charlie") == 0),"sorted by members"))
+		return -1;
+	std::map<std::string,std::string> nameById;
+	for(std::map<std::string,std::string>::const_iterator i(ids.begin());i!=ids.end();++i)
+		nameById[i->second] = i->first;
+	if (!testCheck(byId.size() == 3,"listed by ID"))
+		return -1;
+	std::vector<std::string>::const_iterator row(byId.begin());
+	for(std::map<std::string,std::string>::const_iterator i(nameById.begin());((i!=nameById.end())&&(row!=byId.end()));++i,++row) {
+		if (!testCheck(row->compare(0,i->second.length() + 1,i->second + " ") == 0,"sorted by ID"))
+			return -1;
+	}
+	if (!testCheck(s.cli({ "controller","networks","--sort=size" },out,err) == 2,"unknown sort"))
+		return -1;
+
+	if (!testCheck(s.cli({ "-j","controller","networks","--sort=name" },out,err) == 0,"networks with -j"))
+		return -1;
+	r = OSUtils::jsonParse(out);
+	if (!testCheck((r.size() == 3)&&(r[0]["id"] == ids["alpha"])&&(r[0]["totalMemberCount"] == 3)&&(r[0]["authorizedMemberCount"] == 2)&&(r[1]["activeMemberCount"] == 1)&&(r[2]["totalMemberCount"] == 0),"-j counts"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerMemberIps()
+{
+	std::cout << "[cli] Testing member IP assignment ranges and conflicts... "; std::cout.flush();
+
+	TestService s("cli-member-ips");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r;
+	settings["routes"] = OSUtils::jsonParse("[{\"target\":\"10.147.17.0/24\"},{\"target\":\"fd00:1::/64\"}]");
+	settings["ipAssignmentPools"] = OSUtils::jsonParse("[{\"ipRangeStart\":\"10.147.18.10\",\"ipRangeEnd\":\"10.147.18.20\"}]");
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	if (!testCheck((s.api("POST","/controller/network/" + nwid + "/member/1111111111",nlohmann::json::object(),r) == 200)&&(s.api("POST","/controller/network/" + nwid + "/member/2222222222",nlohmann::json::object(),r) == 200),"create members"))
+		return -1;
+
+	std::string out,err;
+	auto ip = [&](const char *member,const char *op,const char *address) {
+		std::vector<std::string> args({ "controller","member",nwid,member,"ip",op });
+		if (address)
+			args.push_back(address);
+		return s.cli(args,out,err);
+	};
+	if (!testCheck((ip("1111111111","add","10.147.17.5") == 0)&&(out == std::string("200 controller member 1111111111 ipAssignments: 10.147.17.5") + ZT_EOL_S),"add within a route"))
+		return -1;
+	if (!testCheck((ip("1111111111","add","10.147.18.20") == 0)&&(ip("1111111111","add","fd00:1::5") == 0),"add within a pool and an IPv6 route"))
+		return -1;
+	if (!testCheck((ip("1111111111","add","10.147.17.5") == 0)&&(out == std::string("200 controller member 1111111111 ipAssignments: 10.147.18.20 fd00:1::5 10.147.17.5") + ZT_EOL_S),"adding again doesn't duplicate"))
+		return -1;
+
+	// Out of range, in use by another member, or not an address at all
+	if (!testCheck((ip("2222222222","add","10.147.19.1") == 6)&&(err.find("outside this network's managed routes and assignment pools") != std::string::npos),"outside routes and pools"))
+		return -1;
+	if (!testCheck((ip("2222222222","add","10.147.18.21") == 6)&&(ip("2222222222","add","fd00:2::5") == 6),"just past a pool, and another IPv6 prefix"))
+		return -1;
+	if (!testCheck((ip("2222222222","add","10.147.17.5") == 6)&&(err.find("10.147.17.5 is already assigned to 1111111111") != std::string::npos),"conflict"))
+		return -1;
+	if (!testCheck((ip("2222222222","add","fd00:1:0:0::5") == 6)&&(err.find("already assigned to 1111111111") != std::string::npos),"conflict written differently"))
+		return -1;
+	if (!testCheck((ip("2222222222","add","10.147.17.0/24") == 2)&&(ip("2222222222","add","lab") == 2)&&(ip("2222222222","drop","10.147.17.6") == 2),"invalid arguments"))
+		return -1;
+	if (!testCheck((s.api("GET","/controller/network/" + nwid + "/member/2222222222",nlohmann::json(),r) == 200)&&(r["ipAssignments"].empty()),"nothing assigned on failure"))
+		return -1;
+
+	// Removing frees the address for another member
+	if (!testCheck((ip("1111111111","remove","10.147.17.9") == 5)&&(ip("1111111111","remove","10.147.17.5") == 0),"remove"))
+		return -1;
+	if (!testCheck(ip("2222222222","add","10.147.17.5") == 0,"freed address reassigned"))
+		return -1;
+	if (!testCheck((s.cli({ "-j","controller","member",nwid,"2222222222","ip","add","10.147.17.6" },out,err) == 0)&&(OSUtils::jsonParse(out)["ipAssignments"] == nlohmann::json::array({ "10.147.17.5","10.147.17.6" })),"add with -j"))
+		return -1;
+
+	nlohmann::json noAuto;
+	noAuto["noAutoAssignIps"] = true;
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/1111111111",noAuto,r) == 200,"turn off auto-assign"))
+		return -1;
+	if (!testCheck((ip("1111111111","clear",(const char *)0) == 0)&&(s.api("GET","/controller/network/" + nwid + "/member/1111111111",nlohmann::json(),r) == 200)&&(r["ipAssignments"].empty())&&(!OSUtils::jsonBool(r["noAutoAssignIps"],true)),"clear reverts to auto-assign"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerAuthFile()
+{
+	std::cout << "[cli] Testing bulk auth and deauth from a file... "; std::cout.flush();
+
+	TestService s("cli-auth-file");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json r,m;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",nlohmann::json::object(),r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+	m["authorized"] = true;
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/4444444444",m,r) == 200,"create authorized member"))
+		return -1;
+	auto member = [&](const char *address) {
+		r = nlohmann::json();
+		s.api("GET","/controller/network/" + nwid + "/member/" + address,nlohmann::json(),r);
+		return OSUtils::jsonBool(r["authorized"],false);
+	};
+
+	// Keeps going past the invalid address, and the duplicate is already authorized the second time
+	const std::string dir(testTempDir("auth-file"));
+	const std::string file(dir + "/members");
+	OSUtils::writeFile(file.c_str(),std::string("# classroom\n1111111111,alice\n2222222222\nnot-an-address\n\n1111111111\n 3333333333 , bob \n4444444444\n"));
+	std::string out,err;
+	if (!testCheck(s.cli({ "controller","auth",nwid,"--file=" + file },out,err) == 6,"auth with a failure"))
+		return -1;
+	if (!testCheck((out == std::string("400 controller auth 3 authorized, 2 already authorized, 1 failed") + ZT_EOL_S)&&(err.find("not-an-address: invalid address") != std::string::npos),"auth summary"))
+		return -1;
+	if (!testCheck((member("1111111111"))&&(r["name"] == "alice")&&(member("2222222222"))&&(member("3333333333"))&&(r["name"] == "bob")&&(member("4444444444")),"members authorized and named"))
+		return -1;
+	if (!testCheck(s.cli({ "-j","controller","auth",nwid,"--file=" + file },out,err) == 6,"auth again with -j"))
+		return -1;
+	r = OSUtils::jsonParse(out);
+	if (!testCheck((r["succeeded"].empty())&&(r["alreadyAuthorized"].size() == 5)&&(r["failed"].size() == 1)&&(r["failed"][0]["address"] == "not-an-address"),"-j summary"))
+		return -1;
+
+	OSUtils::writeFile(file.c_str(),std::string("1111111111\n5555555555\n3333333333\n"));
+	if (!testCheck((s.cli({ "controller","deauth",nwid,"--file=" + file },out,err) == 6)&&(out == std::string("400 controller deauth 2 deauthorized, 0 already deauthorized, 1 failed") + ZT_EOL_S)&&(err.find("5555555555: not a member") != std::string::npos),"deauth with a failure"))
+		return -1;
+	if (!testCheck((!member("1111111111"))&&(member("2222222222"))&&(!member("3333333333"))&&(s.api("GET","/controller/network/" + nwid + "/member/5555555555",nlohmann::json(),r) == 404),"members deauthorized"))
+		return -1;
+	OSUtils::writeFile(file.c_str(),std::string("1111111111\n2222222222\n"));
+	if (!testCheck((s.cli({ "controller","deauth",nwid,"--file=" + file },out,err) == 0)&&(out == std::string("200 controller deauth 1 deauthorized, 1 already deauthorized, 0 failed") + ZT_EOL_S),"deauth with no failures"))
+		return -1;
+
+	if (!testCheck((s.cli({ "controller","auth",nwid,"--file=-" },out,err) == 0)&&(out.find("0 authorized, 0 already authorized, 0 failed") != std::string::npos),"empty standard input"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","auth",nwid,"--file=" + dir + "/missing" },out,err) == 6)&&(s.cli({ "controller","auth",nwid,"1111111111","--file=" + file },out,err) == 2),"missing file and extra address"))
+		return -1;
+
+	OSUtils::rmDashRf(dir.c_str());
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerPools()
+{
+	std::cout << "[cli] Testing pool CIDR ranges and overlaps... "; std::cout.flush();
+
+	TestService s("cli-pools");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json r;
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",nlohmann::json::object(),r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+
+	// Adds a pool, returning the exit code and leaving the range it became, if added, in range
+	std::string out,err,range;
+	auto add = [&](const char *a,const char *b = (const char *)0) {
+		std::vector<std::string> args({ "-j","controller","pool",nwid,"add",a });
+		if (b)
+			args.push_back(b);
+		range.clear();
+		const int rc = s.cli(args,out,err);
+		if (rc == 0) {
+			r = OSUtils::jsonParse(out);
+			range = OSUtils::jsonString(r.back()["ipRangeStart"],"") + "-" + OSUtils::jsonString(r.back()["ipRangeEnd"],"");
+		}
+		return rc;
+	};
+
+	// IPv4 leaves out network and broadcast addresses except where there's no room for them,
+	// and IPv6 leaves out only the all zero host address
+	if (!testCheck((add("10.0.1.0/24") == 0)&&(range == "10.0.1.1-10.0.1.254"),"/24"))
+		return -1;
+	if (!testCheck((add("10.0.2.7/30") == 0)&&(range == "10.0.2.5-10.0.2.6"),"/30 with host bits set"))
+		return -1;
+	if (!testCheck((add("10.0.0.0/31") == 0)&&(range == "10.0.0.0-10.0.0.1"),"/31"))
+		return -1;
+	if (!testCheck((add("10.0.0.4/32") == 0)&&(range == "10.0.0.4-10.0.0.4"),"/32"))
+		return -1;
+	if (!testCheck((add("fd00::/127") == 0)&&(range == "fd00::-fd00::1"),"/127"))
+		return -1;
+	if (!testCheck((add("fd00:1::/64") == 0)&&(range == "fd00:1::1-fd00:1::ffff:ffff:ffff:ffff"),"/64"))
+		return -1;
+	if (!testCheck((add("10.0.0.0/33") == 2)&&(add("0.0.0.0/0") == 2)&&(add("10.0.3.0") == 2),"invalid CIDR"))
+		return -1;
+	if (!testCheck((add("10.0.3.9","10.0.3.1") == 2)&&(add("10.0.3.1","fd00:2::1") == 2),"invalid range"))
+		return -1;
+
+	// Overlaps at either end are refused with the pool they hit, while an adjacent range is fine
+	if (!testCheck((add("fd00::1/128") == 6)&&(err.find("overlaps existing pool fd00::-fd00::1") != std::string::npos),"/128 inside /127"))
+		return -1;
+	if (!testCheck((add("10.0.0.1","10.0.0.3") == 6)&&(err.find("overlaps existing pool 10.0.0.0-10.0.0.1") != std::string::npos),"overlaps the start"))
+		return -1;
+	if (!testCheck((add("10.0.1.254","10.0.2.0") == 6)&&(add("10.0.0.0/16") == 6),"overlaps the end, and contains others"))
+		return -1;
+	if (!testCheck((add("10.0.0.2","10.0.0.3") == 0)&&(r.size() == 7),"adjacent range"))
+		return -1;
+
+	// Removing a pool warns about assignments it leaves uncovered
+	nlohmann::json m;
+	m["ipAssignments"] = nlohmann::json::array({ "10.0.1.5","10.0.0.2" });
+	if (!testCheck(s.api("POST","/controller/network/" + nwid + "/member/1111111111",m,r) == 200,"create member"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","pool",nwid,"remove","10.0.1.1","10.0.1.254" },out,err) == 0)&&(err.find("warning: 1 member IP assignment(s) fall outside all remaining pools") != std::string::npos),"remove warns"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","pool",nwid,"remove","10.0.1.1","10.0.1.254" },out,err) == 5),"remove a missing pool"))
+		return -1;
+	if (!testCheck((s.cli({ "controller","pool",nwid,"list" },out,err) == 0)&&(out.find("10.0.1.1") == std::string::npos)&&(out.find("fd00:1::ffff:ffff:ffff:ffff") != std::string::npos),"list"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+static int testCliControllerRoutes()
+{
+	std::cout << "[cli] Testing route duplicates, via checks, and the default route warning... "; std::cout.flush();
+
+	TestService s("cli-routes");
+	if (!testCheck(s.ok(),"start service"))
+		return -1;
+	nlohmann::json settings,r;
+	settings["routes"] = OSUtils::jsonParse("[{\"target\":\"10.147.17.0/24\"}]");
+	settings["ipAssignmentPools"] = OSUtils::jsonParse("[{\"ipRangeStart\":\"10.147.18.10\",\"ipRangeEnd\":\"10.147.18.20\"}]");
+	if (!testCheck(s.api("POST","/controller/network/" + s.address + "______",settings,r) == 200,"create network"))
+		return -1;
+	const std::string nwid(OSUtils::jsonString(r["id"],""));
+
+	std::string out,err;
+	auto route = [&](const char *op,const char *target,const char *via = (const char *)0) {
+		std::vector<std::string> args({ "controller","route",nwid,op,target });
+		if (via)
+			args.push_back(via);
+		return s.cli(args,out,err);
+	};
+	if (!testCheck((route("add","10.0.0.0/8","10.147.17.1") == 0)&&(err.empty()),"via within a route"))
+		return -1;
+	if (!testCheck((route("add","192.168.0.0/16","10.147.18.15") == 0)&&(route("add","172.16.0.0/12","192.0.2.1") == 6)&&(err.find("not within any existing route or IP assignment pool") != std::string::npos),"via within a pool, and outside both"))
+		return -1;
+
+	// The same target, however it's written, is refused
+	if (!testCheck((route("add","10.0.0.0/8") == 6)&&(err.find("route 10.0.0.0/8 already exists") != std::string::npos),"duplicate"))
+		return -1;
+	if (!testCheck((route("add","10.147.17.1/24") == 6)&&(route("add","10.0.0.0/8","10.147.17.2") == 6),"duplicate with host bits, or another via"))
+		return -1;
+	if (!testCheck(route("add","10.0.0.0/9") == 0,"same address, other length"))
+		return -1;
+
+	// Default routes are added, with a warning
+	if (!testCheck((route("add","0.0.0.0/0","10.147.17.1") == 0)&&(err.find("warning: 0.0.0.0/0 is a default route") != std::string::npos),"IPv4 default route warning"))
+		return -1;
+	if (!testCheck((route("add","::/0") == 0)&&(err.find("warning: ::/0 is a default route") != std::string::npos),"IPv6 default route warning"))
+		return -1;
+	if (!testCheck((route("add","0.0.0.0/0") == 6)&&(err.find("already exists") != std::string::npos),"duplicate default route"))
+		return -1;
+
+	if (!testCheck((route("add","10.0.0.0") == 2)&&(route("add","fd00::/64","10.147.17.1") == 2),"invalid target and via"))
+		return -1;
+	if (!testCheck(s.cli({ "-j","controller","route",nwid,"list" },out,err) == 0,"list with -j"))
+		return -1;
+	r = OSUtils::jsonParse(out);
+	if (!testCheck((r.size() == 6)&&(r[1]["target"] == "10.0.0.0/8")&&(r[1]["via"] == "10.147.17.1")&&(r[5]["target"] == "::/0")&&(r[5]["via"].is_null()),"routes listed"))
+		return -1;
+	if (!testCheck((route("remove","0.0.0.0/0") == 0)&&(route("remove","0.0.0.0/0") == 5),"remove"))
+		return -1;
+
+	std::cout << "PASS" << std::endl;
+	return 0;
+}
+
+#endif
+
+#ifdef __WINDOWS__
+int __cdecl _tmain(int argc, _TCHAR* argv[])
+#else
+int main(int argc,char **argv)
+#endif
+{
+	int r = 0;
+
+#ifdef __WINDOWS__
+	WSADATA wsaData;
+	WSAStartup(MAKEWORD(2,2),&wsaData);
+#endif
+
+	// Code to generate the C25519 test vectors -- did this once and then
+	// put these up top so that we can ensure that every platform produces
+	// the same result.
+	/*
+	for(int k=0;k<32;++k) {
+		C25519::Pair p1 = C25519::generate();
+		C25519::Pair p2 = C25519::generate();
+		unsigned char agg[64];
+		C25519::agree(p1,p2.pub,agg,64);
+		C25519::Signature sig1 = C25519::sign(p1,agg,64);
+		C25519::Signature sig2 = C25519::sign(p2,agg,64);
+		printf("{{");
+		for(int i=0;i<64;++i)
+			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p1.pub.data[i]);
+		printf("},{");
+		for(int i=0;i<64;++i)
+			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p1.priv.data[i]);
+		printf("},{");
+		for(int i=0;i<64;++i)
+			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p2.pub.data[i]);
+		printf("},{");
+		for(int i=0;i<64;++i)
+			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)p2.priv.data[i]);
+		printf("},{");
+		for(int i=0;i<64;++i)
+			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)agg[i]);
+		printf("},{");
+		for(int i=0;i<96;++i)
+			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)sig1.data[i]);
+		printf("},{");
+		for(int i=0;i<96;++i)
+			printf("%s0x%.2x",((i > 0) ? "," : ""),(unsigned int)sig2.data[i]);
+		printf("}}\n");
+	}
+	exit(0);
+	*/
+
+	std::cout << "[info] sizeof(void *) == " << sizeof(void *) << std::endl;
+	std::cout << "[info] OSUtils::now() == " << OSUtils::now() << std::endl;
+	std::cout << "[info] hardware concurrency == " << std::thread::hardware_concurrency() << std::endl;
+	std::cout << "[info] sizeof(NetworkConfig) == " << sizeof(ZeroTier::NetworkConfig) << std::endl;
+
+	srand((unsigned int)time(0));
+#ifndef __WINDOWS__
+	for(int i=1;i<argc;++i)
+		testAreas.push_back(std::string(argv[i]));
+#endif
+
+#ifdef __UNIX_LIKE__
+	// CLI tests run the zerotier-cli that was built alongside this program
+	signal(SIGPIPE,SIG_IGN);
+	testCliPath = argv[0];
+	testCliPath = ((testCliPath.rfind('/') == std::string::npos) ? std::string(".") : testCliPath.substr(0,testCliPath.rfind('/'))) + "/zerotier-cli";
+#endif
+
+	///*
+	if (testSelected("other")) r |= testOther();
+	if (testSelected("crypto")) r |= testCrypto();
+	if (testSelected("packet")) r |= testPacket();
+	if (testSelected("identity")) r |= testIdentity();
+	if (testSelected("certificate")) r |= testCertificate();
+	if (testSelected("phy")) r |= testPhy();
+	if (testSelected("controller")) r |= testControllerPagination();
+	if (testSelected("controller")) r |= testControllerMemberFilters();
+	if (testSelected("controller")) r |= testControllerRulesCompiler();
+	if (testSelected("controller")) r |= testServiceOpenApi();
+	if (testSelected("controller")) r |= testControllerExportImport();
+	if (testSelected("controller")) r |= testControllerAuthExpiry();
+	if (testSelected("controller")) r |= testControllerMemberTags();
+	if (testSelected("controller")) r |= testControllerHookSecrets();
+	if (testSelected("controller")) r |= testControllerDbBackend<FileDB>("file");
+#ifdef ZT_CONTROLLER_USE_SQLITE
+	if (testSelected("controller")) r |= testControllerDbBackend<SQLiteDB>("sqlite");
+	if (testSelected("controller")) r |= testControllerSQLiteUnusable();
+#endif
+	if (testSelected("controller")) r |= testControllerQuotas();
+	if (testSelected("controller")) r |= testControllerAuditLog();
+	if (testSelected("controller")) r |= testControllerStats();
+#ifdef __UNIX_LIKE__
+	if (testSelected("controller")) r |= testControllerWebhooks();
+	if (testSelected("controller")) r |= testControllerAuthHook();
+	if (testSelected("controller")) r |= testServiceScopedTokens();
+	if (testSelected("cli")) r |= testCliRoots();
+	if (testSelected("cli")) r |= testCliBackupRestore();
+	if (testSelected("cli")) r |= testCliSetPlanet();
+	if (testSelected("cli")) r |= testIdtoolShowWorld();
+	if (testSelected("cli")) r |= testCliRootReset();
+	if (testSelected("cli")) r |= testCliEncoding();
+	if (testSelected("cli")) r |= testCliNetworkLimits();
+	if (testSelected("cli")) r |= testCliNetworkHooks();
+	if (testSelected("cli")) r |= testCliRules();
+	if (testSelected("cli")) r |= testCliCompletion();
+	if (testSelected("cli")) r |= testCliExitCodes();
+	if (testSelected("cli")) r |= testCliQuiet();
+	if (testSelected("cli")) r |= testCliColor();
+	if (testSelected("cli")) r |= testCliMemberTags();
+	if (testSelected("cli")) r |= testCliPeerTry();
+	if (testSelected("cli")) r |= testCliControllerNew();
+	if (testSelected("cli")) r |= testCliControllerSet();
+	if (testSelected("cli")) r |= testCliControllerNetworks();
+	if (testSelected("cli")) r |= testCliControllerMemberIps();
+	if (testSelected("cli")) r |= testCliControllerAuthFile();
+	if (testSelected("cli")) r |= testCliControllerPools();
+	if (testSelected("cli")) r |= testCliControllerRoutes();
+	if (testSelected("cli")) r |= testCliControllerDelete();
+	if (testSelected("cli")) r |= testCliControllerDns();
+	if (testSelected("cli")) r |= testCliControllerMigrateDb();
+	if (testSelected("cli")) r |= testCliControllerMemberNames();
+	if (testSelected("cli")) r |= testServiceIdentityReplace();
+	if (testSelected("cli")) r |= testCliIdentityFiles();
+#endif
 	//*/
 
 	if (r)
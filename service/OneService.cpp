@@ -21,9 +21,12 @@
 #include <vector>
 #include <algorithm>
 #include <list>
+#include <deque>
+#include <set>
 #include <thread>
 #include <mutex>
 #include <condition_variable>
+#include <atomic>
 
 #include "../version.h"
 #include "../include/ZeroTierOne.h"
@@ -34,6 +37,7 @@
 #include "../node/Utils.hpp"
 #include "../node/InetAddress.hpp"
 #include "../node/MAC.hpp"
+#include "../node/MulticastGroup.hpp"
 #include "../node/Identity.hpp"
 #include "../node/World.hpp"
 #include "../node/Salsa20.hpp"
@@ -136,6 +140,16 @@ using json = nlohmann::json;
 // TCP activity timeout
 #define ZT_TCP_ACTIVITY_TIMEOUT 60000
 
+// Frame metadata kept per traced network for clients polling /network/<nwid>/trace
+#define ZT_TRACE_MAX_FRAMES 4096
+
+// Stop tracing a network this long after its trace was last polled
+#define ZT_TRACE_IDLE_TIMEOUT 10000
+
+// How long POST /peer/<address>/try waits for endpoints to answer, by default and at most
+#define ZT_PEER_TRY_DEFAULT_TIMEOUT 5000
+#define ZT_PEER_TRY_MAX_TIMEOUT 30000
+
 #if ZT_VAULT_SUPPORT
 size_t curlResponseWrite(void *ptr, size_t size, size_t nmemb, std::string *data)
 {
@@ -172,6 +186,13 @@ static std::string _trimString(const std::string &s)
 	return s.substr(start,end - start);
 }
 
+// Identity type is the second field of address:type:public[:secret]; only 0 (C25519/Ed25519) exists today
+static unsigned int _identityType(const char *id)
+{
+	const char *t = strchr(id,':');
+	return (t) ? (unsigned int)strtoul(t + 1,(char **)0,10) : 0;
+}
+
 static void _networkToJson(nlohmann::json &nj,const ZT_VirtualNetworkConfig *nc,const std::string &portDeviceName,const OneService::NetworkSettings &localSettings)
 {
 	char tmp[256];
@@ -200,7 +221,7 @@ static void _networkToJson(nlohmann::json &nj,const ZT_VirtualNetworkConfig *nc,
 	nj["type"] = ntype;
 	nj["mtu"] = nc->mtu;
 	nj["dhcp"] = (bool)(nc->dhcp != 0);
-	nj["bridge"] = (bool)(nc->bridge != 0);
+	nj["bridge"] = ((nc->bridge != 0)&&(localSettings.allowBridging));
 	nj["broadcastEnabled"] = (bool)(nc->broadcastEnabled != 0);
 	nj["portError"] = nc->portError;
 	nj["netconfRevision"] = nc->netconfRevision;
@@ -209,6 +230,10 @@ static void _networkToJson(nlohmann::json &nj,const ZT_VirtualNetworkConfig *nc,
 	nj["allowGlobal"] = localSettings.allowGlobal;
 	nj["allowDefault"] = localSettings.allowDefault;
 	nj["allowDNS"] = localSettings.allowDNS;
+	nj["upHook"] = localSettings.upHook;
+	nj["downHook"] = localSettings.downHook;
+	nj["multicastLimit"] = localSettings.multicastLimit;
+	nj["allowBridging"] = localSettings.allowBridging;
 
 	nlohmann::json aa = nlohmann::json::array();
 	for(unsigned int i=0;i<nc->assignedAddressCount;++i) {
@@ -253,7 +278,22 @@ static void _networkToJson(nlohmann::json &nj,const ZT_VirtualNetworkConfig *nc,
 	
 }
 
-static void _peerToJson(nlohmann::json &pj,const ZT_Peer *peer)
+static void _peerPathToJson(nlohmann::json &j,const ZT_PeerPhysicalPath *path)
+{
+	char tmp[256];
+	int64_t lastSend = path->lastSend;
+	int64_t lastReceive = path->lastReceive;
+	j["address"] = reinterpret_cast<const InetAddress *>(&(path->address))->toString(tmp);
+	j["lastSend"] = (lastSend < 0) ? 0 : lastSend;
+	j["lastReceive"] = (lastReceive < 0) ? 0 : lastReceive;
+	j["latency"] = (int)path->latencyMean;
+	j["trustedPathId"] = path->trustedPathId;
+	j["active"] = (bool)(path->expired == 0);
+	j["expired"] = (bool)(path->expired != 0);
+	j["preferred"] = (bool)(path->preferred != 0);
+}
+
+static void _peerToJson(nlohmann::json &pj,const ZT_Peer *peer,const int versionProto)
 {
 	char tmp[256];
 
@@ -269,8 +309,11 @@ static void _peerToJson(nlohmann::json &pj,const ZT_Peer *peer)
 	pj["versionMajor"] = peer->versionMajor;
 	pj["versionMinor"] = peer->versionMinor;
 	pj["versionRev"] = peer->versionRev;
-	OSUtils::ztsnprintf(tmp,sizeof(tmp),"%d.%d.%d",peer->versionMajor,peer->versionMinor,peer->versionRev);
-	pj["version"] = tmp;
+	pj["versionProto"] = versionProto;
+	if (peer->versionMajor >= 0) {
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"%d.%d.%d",peer->versionMajor,peer->versionMinor,peer->versionRev);
+		pj["version"] = tmp;
+	} else pj["version"] = "unknown";
 	pj["latency"] = peer->latency;
 	pj["role"] = prole;
 	pj["isBonded"] = peer->isBonded;
@@ -281,16 +324,8 @@ static void _peerToJson(nlohmann::json &pj,const ZT_Peer *peer)
 
 	nlohmann::json pa = nlohmann::json::array();
 	for(unsigned int i=0;i<peer->pathCount;++i) {
-		int64_t lastSend = peer->paths[i].lastSend;
-		int64_t lastReceive = peer->paths[i].lastReceive;
 		nlohmann::json j;
-		j["address"] = reinterpret_cast<const InetAddress *>(&(peer->paths[i].address))->toString(tmp);
-		j["lastSend"] = (lastSend < 0) ? 0 : lastSend;
-		j["lastReceive"] = (lastReceive < 0) ? 0 : lastReceive;
-		j["trustedPathId"] = peer->paths[i].trustedPathId;
-		j["active"] = (bool)(peer->paths[i].expired == 0);
-		j["expired"] = (bool)(peer->paths[i].expired != 0);
-		j["preferred"] = (bool)(peer->paths[i].preferred != 0);
+		_peerPathToJson(j,&(peer->paths[i]));
 		pa.push_back(j);
 	}
 	pj["paths"] = pa;
@@ -365,6 +400,17 @@ static void _moonToJson(nlohmann::json &mj,const World &world)
 	mj["waiting"] = false;
 }
 
+// Configured vs. effective state of one of the service's ports, where a configured port of 0 means automatic
+static bool _portStatusToJson(nlohmann::json &pj,const bool enabled,const unsigned int configured,const unsigned int effective)
+{
+	const bool mismatch = (enabled) ? ((effective == 0)||((configured != 0)&&(configured != effective))) : (effective != 0);
+	pj["enabled"] = enabled;
+	pj["configured"] = configured;
+	pj["effective"] = effective;
+	pj["mismatch"] = mismatch;
+	return mismatch;
+}
+
 class OneServiceImpl;
 
 static int SnodeVirtualNetworkConfigFunction(ZT_Node *node,void *uptr,void *tptr,uint64_t nwid,void **nuptr,enum ZT_VirtualNetworkConfigOperation op,const ZT_VirtualNetworkConfig *nwconf);
@@ -442,6 +488,9 @@ struct TcpConnection
 	std::string readq;
 	std::string writeq;
 	Mutex writeq_m;
+
+	// Accepted on the metrics listener, which serves only /metrics
+	bool metrics;
 };
 
 struct OneServiceIncomingPacket
@@ -460,6 +509,7 @@ public:
 
 	const std::string _homePath;
 	std::string _authToken;
+	json _scopedTokens; // additional API tokens limited to a scope, see _tokenScopeAllows()
 	std::string _controllerDbPath;
 	const std::string _networksPath;
 	const std::string _moonsPath;
@@ -470,6 +520,10 @@ public:
 	SoftwareUpdater *_updater;
 	PhySocket *_localControlSocket4;
 	PhySocket *_localControlSocket6;
+
+	// Optional unauthenticated Prometheus metrics listener (settings.metricsListen)
+	InetAddress _metricsListen;
+	PhySocket *_metricsSocket;
 	bool _updateAutoApply;
 	bool _allowTcpFallbackRelay;
 	bool _allowSecondaryPort;
@@ -477,6 +531,7 @@ public:
 	unsigned int _primaryPort;
 	unsigned int _secondaryPort;
 	unsigned int _tertiaryPort;
+	unsigned int _commandLinePort; // primary port if local.conf does not set one
 	volatile unsigned int _udpPortPickerCounter;
 
 	// Local configuration and memo-ized information from it
@@ -513,9 +568,19 @@ public:
 	uint64_t _lastSendToGlobalV4;
 #endif
 
+	// Time this service instance was started (ms since epoch)
+	const int64_t _startTime;
+
 	// Last potential sleep/wake event
 	uint64_t _lastRestart;
 
+	// Set once the node has come online at least once since start (used by /health)
+	volatile bool _wasOnline;
+
+	// If nonzero, restart at this time because the identity or planet was replaced via the API
+	volatile int64_t _restartAt;
+	volatile ReasonForTermination _restartReason;
+
 	// Deadline for the next background task service function
 	volatile int64_t _nextBackgroundTaskDeadline;
 
@@ -523,25 +588,68 @@ public:
 	struct NetworkState
 	{
 		NetworkState() :
-			tap((EthernetTap *)0)
+			service((OneServiceImpl *)0),
+			tap((EthernetTap *)0),
+			hookUp(false),
+			rxBytes(0),
+			txBytes(0)
 		{
 			// Real defaults are in network 'up' code in network event handler
 			settings.allowManaged = true;
 			settings.allowGlobal = false;
 			settings.allowDefault = false;
 			settings.allowDNS = false;
+			settings.multicastLimit = 0;
+			settings.allowBridging = true;
 			memset(&config, 0, sizeof(ZT_VirtualNetworkConfig));
 		}
 
+		OneServiceImpl *service; // for the tap's frame handler, which gets this state as its argument
 		std::shared_ptr<EthernetTap> tap;
 		ZT_VirtualNetworkConfig config; // memcpy() of raw config from core
 		std::vector<InetAddress> managedIps;
 		std::map< InetAddress, SharedPtr<ManagedRoute> > managedRoutes;
 		NetworkSettings settings;
+		bool hookUp; // up hook has run and down hook has not run since
+		std::set<MulticastGroup> manualMulticastGroups; // subscribed via the API, kept when the tap drops them
+		std::atomic<uint64_t> rxBytes,txBytes; // Ethernet frame bytes from and to the network (for metrics)
 	};
 	std::map<uint64_t,NetworkState> _nets;
 	Mutex _nets_m;
 
+	// Peer tries waiting for their endpoints to answer before the HTTP response is sent. HTTP
+	// requests are handled by the main loop's thread, which is the only one to touch these.
+	struct PeerTry
+	{
+		TcpConnection *tc; // connection the response is sent on
+		uint64_t address;
+		int64_t started;
+		int64_t until;
+		std::string jsonp; // callback to wrap the response in if the request asked for JSONP
+		json response;
+	};
+	std::list<PeerTry> _peerTries;
+
+	// Metadata (never payloads) of frames on networks being traced via the API
+	struct TraceFrame
+	{
+		uint64_t seq;
+		int64_t time;
+		bool outbound;
+		uint64_t src,dst;
+		unsigned int etherType,vlanId,len;
+	};
+	struct NetworkTrace
+	{
+		NetworkTrace() : seq(0),until(0) {}
+		uint64_t seq; // sequence number of the next frame
+		int64_t until; // trace stops at this time unless polled again
+		std::deque<TraceFrame> frames;
+	};
+	std::map<uint64_t,NetworkTrace> _traces;
+	Mutex _traces_m;
+	std::atomic<bool> _tracing; // !_traces.empty(), so untraced frames can skip _traces_m
+
 	// Active TCP/IP connections
 	std::vector< TcpConnection * > _tcpConnections;
 	Mutex _tcpConnections_m;
@@ -585,15 +693,22 @@ public:
 		,_updater((SoftwareUpdater *)0)
 		,_localControlSocket4((PhySocket *)0)
 		,_localControlSocket6((PhySocket *)0)
+		,_metricsSocket((PhySocket *)0)
 		,_updateAutoApply(false)
 		,_primaryPort(port)
+		,_commandLinePort(port)
 		,_udpPortPickerCounter(0)
 		,_lastDirectReceiveFromGlobal(0)
 #ifdef ZT_TCP_FALLBACK_RELAY
 		,_lastSendToGlobalV4(0)
 #endif
+		,_startTime(OSUtils::now())
 		,_lastRestart(0)
+		,_wasOnline(false)
+		,_restartAt(0)
+		,_restartReason(ONE_STILL_RUNNING)
 		,_nextBackgroundTaskDeadline(0)
+		,_tracing(false)
 		,_tcpFallbackTunnel((TcpConnection *)0)
 		,_termReason(ONE_STILL_RUNNING)
 		,_portMappingEnabled(true)
@@ -623,6 +738,7 @@ public:
 		_binder.closeAll(_phy);
 		_phy.close(_localControlSocket4);
 		_phy.close(_localControlSocket6);
+		_phy.close(_metricsSocket);
 
 #if ZT_VAULT_SUPPORT
 		curl_global_cleanup();
@@ -656,6 +772,40 @@ public:
 					}
 				}
 				_authToken = _trimString(_authToken);
+
+				std::string scoped;
+				_scopedTokens = json::array();
+				if (OSUtils::readFile((_homePath + ZT_PATH_SEPARATOR_S "authtoken.scoped.secret").c_str(),scoped)) {
+					try {
+						json st(OSUtils::jsonParse(scoped));
+						if (st.is_array())
+							_scopedTokens = st;
+					} catch ( ... ) {
+						fprintf(stderr,"WARNING: unable to parse authtoken.scoped.secret, scoped API tokens are disabled" ZT_EOL_S);
+					}
+				}
+			}
+
+			{
+				// The core generates a new identity if it can't load one, which would silently
+				// replace an existing one that is merely unreadable. Refuse to start instead.
+				const std::string identitySecretPath(_homePath + ZT_PATH_SEPARATOR_S "identity.secret");
+				if (OSUtils::fileExists(identitySecretPath.c_str())) {
+					std::string idser;
+					if (!OSUtils::readFile(identitySecretPath.c_str(),idser)) {
+						Mutex::Lock _l(_termReason_m);
+						_termReason = ONE_UNRECOVERABLE_ERROR;
+						_fatalErrorMessage = std::string("identity.secret exists but could not be read (check ownership and permissions of ") + identitySecretPath + ")";
+						return _termReason;
+					}
+					Identity id;
+					if ((!id.fromString(_trimString(idser).c_str()))||(!id.hasPrivate())) {
+						Mutex::Lock _l(_termReason_m);
+						_termReason = ONE_UNRECOVERABLE_ERROR;
+						_fatalErrorMessage = std::string("identity.secret is not a valid secret identity (restore it from backup, or remove it to generate a new identity with a new address): ") + identitySecretPath;
+						return _termReason;
+					}
+				}
 			}
 
 			{
@@ -713,6 +863,15 @@ public:
 				_localControlSocket6 = _phy.tcpListen((const struct sockaddr *)&lo6);
 			}
 
+			// Metrics are off unless settings.metricsListen is set, and a failure to bind is not fatal
+			if (_metricsListen) {
+				_metricsSocket = _phy.tcpListen((const struct sockaddr *)&_metricsListen);
+				if (!_metricsSocket) {
+					char tmp[128];
+					fprintf(stderr,"WARNING: unable to bind metrics listener to %s" ZT_EOL_S,_metricsListen.toString(tmp));
+				}
+			}
+
 			// Save primary port to a file so CLIs and GUIs can learn it easily
 			char portstr[64];
 			OSUtils::ztsnprintf(portstr,sizeof(portstr),"%u",_ports[0]);
@@ -781,8 +940,11 @@ public:
 				std::vector<std::string> networksDotD(OSUtils::listDirectory((_homePath + ZT_PATH_SEPARATOR_S "networks.d").c_str()));
 				for(std::vector<std::string>::iterator f(networksDotD.begin());f!=networksDotD.end();++f) {
 					std::size_t dot = f->find_last_of('.');
-					if ((dot == 16)&&(f->substr(16) == ".conf"))
-						_node->join(Utils::hexStrToU64(f->substr(0,dot).c_str()),(void *)0,(void *)0);
+					if ((dot == 16)&&(f->substr(16) == ".conf")) {
+						const uint64_t nwid = Utils::hexStrToU64(f->substr(0,dot).c_str());
+						_node->join(nwid,(void *)0,(void *)0);
+						_applyLocalLimits(nwid);
+					}
 				}
 			}
 
@@ -820,6 +982,13 @@ public:
 
 				const int64_t now = OSUtils::now();
 
+				// Restart with a new identity or planet once the API response replacing it has gone out
+				if ((_restartAt > 0)&&(now >= _restartAt)) {
+					Mutex::Lock _l(_termReason_m);
+					_termReason = _restartReason;
+					break;
+				}
+
 				// Attempt to detect sleep/wake events by detecting delay overruns
 				bool restarted = false;
 				if ((now > clockShouldBe)&&((now - clockShouldBe) > 10000)) {
@@ -888,6 +1057,9 @@ public:
 							if (n->second.tap) {
 								mgChanges.push_back(std::pair< uint64_t,std::pair< std::vector<MulticastGroup>,std::vector<MulticastGroup> > >(n->first,std::pair< std::vector<MulticastGroup>,std::vector<MulticastGroup> >()));
 								n->second.tap->scanMulticastGroups(mgChanges.back().second.first,mgChanges.back().second.second);
+								const std::set<MulticastGroup> &manual = n->second.manualMulticastGroups;
+								std::vector<MulticastGroup> &removed = mgChanges.back().second.second;
+								removed.erase(std::remove_if(removed.begin(),removed.end(),[&manual](const MulticastGroup &mg) { return (manual.count(mg) > 0); }),removed.end());
 							}
 						}
 					}
@@ -925,7 +1097,12 @@ public:
 					OSUtils::cleanDirectory((_homePath + ZT_PATH_SEPARATOR_S "peers.d").c_str(),now - 2592000000LL); // delete older than 30 days
 				}
 
-				const unsigned long delay = (dl > now) ? (unsigned long)(dl - now) : 500;
+				// Answer peer tries that are done, and look again soon while any are waiting
+				_checkPeerTries(now);
+
+				unsigned long delay = (dl > now) ? (unsigned long)(dl - now) : 500;
+				if ((!_peerTries.empty())&&(delay > 100))
+					delay = 100;
 				clockShouldBe = now + (int64_t)delay;
 				_phy.poll(delay);
 			}
@@ -1145,6 +1322,13 @@ public:
 			fprintf(out,"allowGlobal=%d\n",(int)n->second.settings.allowGlobal);
 			fprintf(out,"allowDefault=%d\n",(int)n->second.settings.allowDefault);
 			fprintf(out,"allowDNS=%d\n",(int)n->second.settings.allowDNS);
+			if (n->second.settings.upHook.length() > 0)
+				fprintf(out,"upHook=%s\n",n->second.settings.upHook.c_str());
+			if (n->second.settings.downHook.length() > 0)
+				fprintf(out,"downHook=%s\n",n->second.settings.downHook.c_str());
+			if (n->second.settings.multicastLimit > 0)
+				fprintf(out,"multicastLimit=%u\n",n->second.settings.multicastLimit);
+			fprintf(out,"allowBridging=%d\n",(int)n->second.settings.allowBridging);
 			fclose(out);
 		}
 
@@ -1158,6 +1342,51 @@ public:
 	// Internal implementation methods for control plane, route setup, etc.
 	// =========================================================================
 
+	// Keep in step with handleControlPlaneHttpRequest() and doc/openapi.json, which selftest checks against this
+	static const char *const *_controlPlaneRoutes()
+	{
+		static const char *const routes[] = {
+			"GET /health",
+			"GET /status",
+			"GET /node/identity",
+			"PUT /node/identity",
+			"PUT /planet",
+			"GET /network",
+			"GET /network/{networkId}",
+			"POST /network/{networkId}",
+			"DELETE /network/{networkId}",
+			"POST /network/{networkId}/refresh",
+			"GET /network/{networkId}/multicast",
+			"POST /network/{networkId}/multicast",
+			"DELETE /network/{networkId}/multicast/{mac}/{adi}",
+			"GET /network/{networkId}/trace",
+			"GET /peer",
+			"POST /peer",
+			"GET /peer/{address}",
+			"GET /peer/{address}/identity",
+			"GET /peer/{address}/paths",
+			"POST /peer/{address}/try",
+			"POST /peer/{address}/prefer",
+			"DELETE /peer/{address}/prefer",
+			"GET /bonds",
+			"GET /bonds/{address}",
+			"GET /bond/show/{address}",
+			"POST /bond/rotate/{address}",
+			"GET /moon",
+			"GET /moon/{moonId}",
+			"POST /moon/{moonId}",
+			"DELETE /moon/{moonId}",
+			"GET /token",
+			"POST /token",
+			"DELETE /token/{tokenId}",
+			"POST /root/reset",
+			"GET /metrics", // on the metrics listener only, see onHttpRequestToServer()
+			(const char *)0
+		};
+		return routes;
+	}
+
+	// Requests that answer later, like peer tries, set deferred and send their response on tc themselves
 	inline unsigned int handleControlPlaneHttpRequest(
 		const InetAddress &fromAddress,
 		unsigned int httpMethod,
@@ -1165,7 +1394,9 @@ public:
 		const std::map<std::string,std::string> &headers,
 		const std::string &body,
 		std::string &responseBody,
-		std::string &responseContentType)
+		std::string &responseContentType,
+		TcpConnection *tc,
+		bool &deferred)
 	{
 		char tmp[256];
 		unsigned int scode = 404;
@@ -1173,10 +1404,10 @@ public:
 		std::vector<std::string> ps(OSUtils::split(path.c_str(),"/","",""));
 		std::map<std::string,std::string> urlArgs;
 
-		/* Note: this is kind of restricted in what it'll take. It does not support
-		 * URL encoding, and /'s in URL args will screw it up. But the only URL args
-		 * it really uses in ?jsonp=funcionName, and otherwise it just takes simple
-		 * paths to simply-named resources. */
+		/* Note: this is kind of restricted in what it'll take. Only %XX escapes in
+		 * URL arg values are decoded, and unescaped /'s in URL args will screw it up.
+		 * But the URL args are things like ?jsonp=funcionName or simple filters, and
+		 * otherwise it just takes simple paths to simply-named resources. */
 		if (!ps.empty()) {
 			std::size_t qpos = ps[ps.size() - 1].find('?');
 			if (qpos != std::string::npos) {
@@ -1187,7 +1418,16 @@ public:
 					std::size_t eqpos = a->find('=');
 					if (eqpos == std::string::npos)
 						urlArgs[*a] = "";
-					else urlArgs[a->substr(0,eqpos)] = a->substr(eqpos + 1);
+					else {
+						std::string &v = urlArgs[a->substr(0,eqpos)];
+						for(std::size_t i=eqpos+1;i<a->length();++i) {
+							if (((*a)[i] == '%')&&((i + 2) < a->length())) {
+								char h[3] = { (*a)[i+1],(*a)[i+2],0 };
+								v.push_back((char)strtoul(h,(char **)0,16));
+								i += 2;
+							} else v.push_back((*a)[i]);
+						}
+					}
 				}
 			}
 		} else {
@@ -1195,6 +1435,8 @@ public:
 		}
 
 		bool isAuth = false;
+		bool scopeDenied = false;
+		std::string actor("authtoken"); // which token made the request, for the controller's audit log
 		{
 			std::map<std::string,std::string>::const_iterator ah(headers.find("x-zt1-auth"));
 			if ((ah != headers.end())&&(_authToken == ah->second)) {
@@ -1204,6 +1446,30 @@ public:
 				if ((ah != urlArgs.end())&&(_authToken == ah->second))
 					isAuth = true;
 			}
+
+			// A scoped token authenticates only the requests its scope allows
+			if (!isAuth) {
+				std::string token;
+				ah = headers.find("x-zt1-auth");
+				if (ah != headers.end()) {
+					token = ah->second;
+				} else {
+					ah = urlArgs.find("auth");
+					if (ah != urlArgs.end())
+						token = ah->second;
+				}
+				if (!token.empty()) {
+					for(json::iterator t(_scopedTokens.begin());t!=_scopedTokens.end();++t) {
+						if (OSUtils::jsonString((*t)["token"],"") == token) {
+							if (_tokenScopeAllows(OSUtils::jsonString((*t)["scope"],""),httpMethod,ps))
+								isAuth = true;
+							else scopeDenied = true;
+							actor = "token:" + OSUtils::jsonString((*t)["id"],"");
+							break;
+						}
+					}
+				}
+			}
 		}
 
 #ifdef __SYNOLOGY__
@@ -1233,13 +1499,50 @@ public:
 					if(strlen(buf) > 0) {
 						snprintf(user, 256, "%s", buf);
 						isAuth = true;
+						actor = "synology";
 					}
 				}
 				pclose(fp);
 			}
 		}
 #endif
-		if (httpMethod == HTTP_GET) {
+		if ((httpMethod == HTTP_GET)&&(ps[0] == "health")) {
+			// Health is deliberately unauthenticated so that readiness and liveness probes
+			// can use it. It reveals nothing beyond a coarse status string.
+			const char *reason = (const char *)0;
+
+			ZT_NodeStatus status;
+			_node->status(&status);
+			Identity id;
+			if ((!id.fromString(status.publicIdentity))||(!id.locallyValidate())) {
+				reason = "identity_error";
+			} else {
+				bool rootReachable = false;
+				ZT_PeerList *pl = _node->peers();
+				if (pl) {
+					const int64_t now = OSUtils::now();
+					for(unsigned long i=0;((i<pl->peerCount)&&(!rootReachable));++i) {
+						if (pl->peers[i].role == ZT_PEER_ROLE_LEAF)
+							continue;
+						for(unsigned int k=0;k<pl->peers[i].pathCount;++k) {
+							if ((!pl->peers[i].paths[k].expired)&&((now - pl->peers[i].paths[k].lastReceive) < (ZT_PATH_HEARTBEAT_PERIOD + 5000))) {
+								rootReachable = true;
+								break;
+							}
+						}
+					}
+					_node->freeQueryResult((void *)pl);
+				}
+				if ((!status.online)||(!rootReachable))
+					reason = (_wasOnline) ? "no_roots" : "starting";
+			}
+
+			res["status"] = (reason) ? reason : "ok";
+			scode = (reason) ? 503 : 200;
+		} else if (scopeDenied) {
+			res["message"] = "this token's scope does not allow this request";
+			scode = 403;
+		} else if (httpMethod == HTTP_GET) {
 			if (isAuth) {
 				if (ps[0] == "bond") {
 					if (_node->bondController()->inUse()) {
@@ -1267,13 +1570,22 @@ public:
 						scode = 400; /* bond controller is not enabled */
 					}
 				}
-				if (ps[0] == "status") {
+				if ((ps[0] == "node")&&(ps.size() == 2)&&(ps[1] == "identity")) {
+					ZT_NodeStatus status;
+					_node->status(&status);
+					OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",status.address);
+					res["address"] = tmp;
+					res["publicIdentity"] = status.publicIdentity;
+					res["identityType"] = _identityType(status.publicIdentity);
+					scode = 200;
+				} else if (ps[0] == "status") {
 					ZT_NodeStatus status;
 					_node->status(&status);
 
 					OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",status.address);
 					res["address"] = tmp;
 					res["publicIdentity"] = status.publicIdentity;
+					res["identityType"] = _identityType(status.publicIdentity);
 					res["online"] = (bool)(status.online != 0);
 					res["tcpFallbackActive"] = (_tcpFallbackTunnel != (TcpConnection *)0);
 					res["versionMajor"] = ZEROTIER_ONE_VERSION_MAJOR;
@@ -1283,12 +1595,46 @@ public:
 					OSUtils::ztsnprintf(tmp,sizeof(tmp),"%d.%d.%d",ZEROTIER_ONE_VERSION_MAJOR,ZEROTIER_ONE_VERSION_MINOR,ZEROTIER_ONE_VERSION_REVISION);
 					res["version"] = tmp;
 					res["clock"] = OSUtils::now();
+					res["startTime"] = _startTime;
+					res["uptime"] = OSUtils::now() - _startTime;
 
 					{
 						Mutex::Lock _l(_localConfig_m);
 						res["config"] = _localConfig;
 					}
 					json &settings = res["config"]["settings"];
+
+					// Ports as configured vs. as actually bound, which differ if a requested port could not be used
+					{
+						const std::vector<InetAddress> bound(_binder.allBoundLocalInterfaceAddresses());
+						unsigned int effective[3];
+						for(int i=0;i<3;++i) {
+							effective[i] = 0;
+							for(std::vector<InetAddress>::const_iterator b(bound.begin());b!=bound.end();++b) {
+								if ((_ports[i])&&(b->port() == _ports[i])) {
+									effective[i] = _ports[i];
+									break;
+								}
+							}
+						}
+#ifdef ZT_USE_MINIUPNPC
+						const bool portMapping = _portMappingEnabled;
+						const bool portMapped = (_portMapper != (PortMapper *)0);
+#else
+						const bool portMapping = false;
+						const bool portMapped = false;
+#endif
+						json &ports = res["ports"];
+						bool mismatch = _portStatusToJson(ports["primary"],true,(unsigned int)OSUtils::jsonInt(settings["primaryPort"],(uint64_t)_commandLinePort) & 0xffff,effective[0]);
+						mismatch |= _portStatusToJson(ports["secondary"],_allowSecondaryPort,_secondaryPort,effective[1]);
+						mismatch |= _portStatusToJson(ports["tertiary"],(_allowSecondaryPort)&&(portMapping),_tertiaryPort,effective[2]);
+						json &pm = ports["portMapping"];
+						pm["configured"] = portMapping;
+						pm["effective"] = portMapped;
+						pm["mismatch"] = (portMapping != portMapped);
+						ports["mismatch"] = (mismatch)||(OSUtils::jsonBool(pm["mismatch"],false));
+					}
+
 					settings["primaryPort"] = OSUtils::jsonInt(settings["primaryPort"],(uint64_t)_primaryPort) & 0xffff;
 					settings["allowTcpFallbackRelay"] = OSUtils::jsonBool(settings["allowTcpFallbackRelay"],_allowTcpFallbackRelay);
 /*
@@ -1321,6 +1667,7 @@ public:
 					const World planet(_node->planet());
 					res["planetWorldId"] = planet.id();
 					res["planetWorldTimestamp"] = planet.timestamp();
+					res["planetIsDefault"] = _node->planetIsDefault();
 
 					scode = 200;
 				} else if (ps[0] == "moon") {
@@ -1379,6 +1726,23 @@ public:
 								}
 							}
 
+						} else if ((ps.size() == 3)&&(ps[2] == "multicast")) {
+							// Return [array] of the network's multicast subscriptions
+
+							if (_multicastToJson(Utils::hexStrToU64(ps[1].c_str()),res))
+								scode = 200;
+						} else if ((ps.size() == 3)&&(ps[2] == "trace")) {
+							// Return frames seen since ?since=<seq>, tracing the network until polling stops
+
+							const uint64_t wantnw = Utils::hexStrToU64(ps[1].c_str());
+							for(unsigned long i=0;i<nws->networkCount;++i) {
+								if (nws->networks[i].nwid == wantnw) {
+									std::map<std::string,std::string>::const_iterator since(urlArgs.find("since"));
+									_traceToJson(wantnw,(since != urlArgs.end()),(since != urlArgs.end()) ? Utils::strToU64(since->second.c_str()) : 0,res);
+									scode = 200;
+									break;
+								}
+							}
 						} else scode = 404;
 						_node->freeQueryResult((void *)nws);
 					} else scode = 500;
@@ -1391,7 +1755,7 @@ public:
 							res = nlohmann::json::array();
 							for(unsigned long i=0;i<pl->peerCount;++i) {
 								nlohmann::json pj;
-								_peerToJson(pj,&(pl->peers[i]));
+								_peerToJson(pj,&(pl->peers[i]),_node->peerProtocolVersion(pl->peers[i].address));
 								res.push_back(pj);
 							}
 
@@ -1402,12 +1766,41 @@ public:
 							uint64_t wantp = Utils::hexStrToU64(ps[1].c_str());
 							for(unsigned long i=0;i<pl->peerCount;++i) {
 								if (pl->peers[i].address == wantp) {
-									_peerToJson(res,&(pl->peers[i]));
+									_peerToJson(res,&(pl->peers[i]),_node->peerProtocolVersion(pl->peers[i].address));
 									scode = 200;
 									break;
 								}
 							}
 
+						} else if ((ps.size() == 3)&&(ps[2] == "paths")) {
+							// Return [array] of a single peer's physical paths or 404 if not found
+
+							uint64_t wantp = Utils::hexStrToU64(ps[1].c_str());
+							for(unsigned long i=0;i<pl->peerCount;++i) {
+								if (pl->peers[i].address == wantp) {
+									res = nlohmann::json::array();
+									for(unsigned int k=0;k<pl->peers[i].pathCount;++k) {
+										nlohmann::json pj;
+										_peerPathToJson(pj,&(pl->peers[i].paths[k]));
+										res.push_back(pj);
+									}
+									scode = 200;
+									break;
+								}
+							}
+
+						} else if ((ps.size() == 3)&&(ps[2] == "identity")) {
+							// Return a known peer's public identity, including peers only in the peer cache
+
+							uint64_t wantp = Utils::hexStrToU64(ps[1].c_str());
+							char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+							if (_node->peerIdentity((void *)0,wantp,idtmp,sizeof(idtmp)) == ZT_RESULT_OK) {
+								OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)wantp);
+								res["address"] = tmp;
+								res["identity"] = idtmp;
+								scode = 200;
+							} else scode = 404;
+
 						} else scode = 404;
 						_node->freeQueryResult((void *)pl);
 					} else scode = 500;
@@ -1420,7 +1813,7 @@ public:
 							res = nlohmann::json::array();
 							for(unsigned long i=0;i<pl->peerCount;++i) {
 								nlohmann::json pj;
-								_peerToJson(pj,&(pl->peers[i]));
+								_peerToJson(pj,&(pl->peers[i]),_node->peerProtocolVersion(pl->peers[i].address));
 								res.push_back(pj);
 							}
 
@@ -1431,7 +1824,7 @@ public:
 							uint64_t wantp = Utils::hexStrToU64(ps[1].c_str());
 							for(unsigned long i=0;i<pl->peerCount;++i) {
 								if (pl->peers[i].address == wantp) {
-									_peerToJson(res,&(pl->peers[i]));
+									_peerToJson(res,&(pl->peers[i]),_node->peerProtocolVersion(pl->peers[i].address));
 									scode = 200;
 									break;
 								}
@@ -1440,6 +1833,19 @@ public:
 						} else scode = 404;
 						_node->freeQueryResult((void *)pl);
 					} else scode = 500;
+				} else if (ps[0] == "token") {
+					if (ps.size() == 1) {
+						// List scoped tokens without their secrets
+						res = json::array();
+						for(json::iterator t(_scopedTokens.begin());t!=_scopedTokens.end();++t) {
+							json tj;
+							tj["id"] = (*t)["id"];
+							tj["scope"] = (*t)["scope"];
+							tj["created"] = (*t)["created"];
+							res.push_back(tj);
+						}
+						scode = 200;
+					} // else 404
 				} else {
 					if (_controller) {
 						scode = _controller->handleControlPlaneHttpGET(std::vector<std::string>(ps.begin()+1,ps.end()),urlArgs,headers,body,responseBody,responseContentType);
@@ -1474,7 +1880,31 @@ public:
 						scode = 400; /* bond controller is not enabled */
 					}
 				}
-				if (ps[0] == "moon") {
+				if ((ps[0] == "root")&&(ps.size() == 2)&&(ps[1] == "reset")) {
+					const std::vector<World> moons(_node->moons());
+					const std::vector<uint64_t> moonsWanted(_node->moonsWanted());
+					const bool planetReset = !_node->planetIsDefault();
+					const bool changed = _node->resetRoots((void *)0);
+
+					char tmp[64];
+					json removed = json::array();
+					for(std::vector<World>::const_iterator m(moons.begin());m!=moons.end();++m) {
+						OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)m->id());
+						removed.push_back(tmp);
+					}
+					for(std::vector<uint64_t>::const_iterator m(moonsWanted.begin());m!=moonsWanted.end();++m) {
+						OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)*m);
+						removed.push_back(tmp);
+					}
+
+					const World planet(_node->planet());
+					res["planetWorldId"] = planet.id();
+					res["planetWorldTimestamp"] = planet.timestamp();
+					res["planetReset"] = planetReset;
+					res["moonsRemoved"] = removed;
+					res["changed"] = changed;
+					scode = 200;
+				} else if (ps[0] == "moon") {
 					if (ps.size() == 2) {
 
 						uint64_t seed = 0;
@@ -1511,6 +1941,214 @@ public:
 						}
 
 					} else scode = 404;
+				} else if ((ps[0] == "node")&&(ps.size() == 2)&&(ps[1] == "identity")&&(httpMethod == HTTP_PUT)) {
+					// Replace this node's identity, which takes effect after an automatic restart
+
+					std::map<std::string,std::string>::const_iterator confirm(headers.find("x-confirm-identity-replace"));
+					Identity id;
+					try {
+						json j(OSUtils::jsonParse(body));
+						if (j.is_object())
+							id.fromString(OSUtils::jsonString(j["identity"],"").c_str());
+					} catch ( ... ) {
+						// discard invalid JSON
+					}
+
+					if ((confirm == headers.end())||(confirm->second != "true")) {
+						res["message"] = "replacing the node identity requires the header X-Confirm-Identity-Replace: true";
+						scode = 403;
+					} else if ((!id)||(!id.hasPrivate())||(!id.locallyValidate())) {
+						res["message"] = "identity must be a valid identity including its secret key";
+						scode = 400;
+					} else {
+						const std::string secretPath(_homePath + ZT_PATH_SEPARATOR_S "identity.secret");
+						const std::string publicPath(_homePath + ZT_PATH_SEPARATOR_S "identity.public");
+						char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+						std::string oldid,oldpub;
+						const bool hadOld = OSUtils::readFile(secretPath.c_str(),oldid);
+						const bool hadOldPublic = OSUtils::readFile(publicPath.c_str(),oldpub);
+						bool ok = ((!hadOld)||(OSUtils::writeSecretFile((secretPath + ".saved_before_replace").c_str(),oldid)));
+						if (ok) {
+							ok = ((OSUtils::writeSecretFile(secretPath.c_str(),std::string(id.toString(true,idtmp))))&&(OSUtils::writeFile(publicPath.c_str(),std::string(id.toString(false,idtmp)))));
+							if (!ok) {
+								// Put back the old identity so identity.secret and identity.public still match
+								if (hadOld)
+									OSUtils::writeSecretFile(secretPath.c_str(),oldid);
+								else OSUtils::rm(secretPath.c_str());
+								if (hadOldPublic)
+									OSUtils::writeFile(publicPath.c_str(),oldpub);
+								else OSUtils::rm(publicPath.c_str());
+							}
+						}
+						if (ok) {
+							res["address"] = id.address().toString(tmp);
+							res["publicIdentity"] = id.toString(false,idtmp);
+							res["identityType"] = _identityType(idtmp);
+							res["restarting"] = true;
+							_restartReason = ONE_IDENTITY_REPLACED;
+							_restartAt = OSUtils::now() + 1000;
+							scode = 200;
+						} else {
+							res["message"] = "unable to write identity files";
+							scode = 500;
+						}
+					}
+				} else if ((ps[0] == "planet")&&(ps.size() == 1)&&(httpMethod == HTTP_PUT)) {
+					// Replace the planet (root set), which takes effect after an automatic restart
+
+					std::map<std::string,std::string>::const_iterator confirm(headers.find("x-confirm-planet-switch"));
+					std::string planetHex;
+					try {
+						json j(OSUtils::jsonParse(body));
+						if (j.is_object())
+							planetHex = OSUtils::jsonString(j["planet"],"");
+					} catch ( ... ) {
+						// discard invalid JSON
+					}
+					World w;
+					char wbytes[ZT_WORLD_MAX_SERIALIZED_LENGTH];
+					const unsigned int wlen = ((planetHex.length() > 0)&&(planetHex.length() <= (ZT_WORLD_MAX_SERIALIZED_LENGTH * 2))) ? Utils::unhex(planetHex.c_str(),wbytes,sizeof(wbytes)) : 0;
+					try {
+						if (wlen > 0)
+							w.deserialize(Buffer<ZT_WORLD_MAX_SERIALIZED_LENGTH>(wbytes,wlen),0);
+					} catch ( ... ) {
+						w = World();
+					}
+
+					if ((confirm == headers.end())||(confirm->second != "true")) {
+						res["message"] = "switching the planet requires the header X-Confirm-Planet-Switch: true";
+						scode = 403;
+					} else if ((w.type() != World::TYPE_PLANET)||(w.roots().empty())||(!w.verifySelfSigned())) {
+						res["message"] = "planet must be a hex encoded, properly signed planet file with at least one root";
+						scode = 400;
+					} else {
+						const std::string planetPath(_homePath + ZT_PATH_SEPARATOR_S "planet");
+						std::string oldPlanet;
+						if (OSUtils::readFile(planetPath.c_str(),oldPlanet))
+							OSUtils::writeFile((planetPath + ".saved_before_switch").c_str(),oldPlanet);
+						if (OSUtils::writeFile(planetPath.c_str(),wbytes,wlen)) {
+							OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)w.id());
+							res["id"] = tmp;
+							res["timestamp"] = w.timestamp();
+							res["roots"] = (unsigned long)w.roots().size();
+							res["restarting"] = true;
+							_restartReason = ONE_PLANET_REPLACED;
+							_restartAt = OSUtils::now() + 1000;
+							scode = 200;
+						} else {
+							res["message"] = "unable to write planet file";
+							scode = 500;
+						}
+					}
+				} else if (ps[0] == "peer") {
+					if (ps.size() == 1) {
+						// Register a peer's identity ahead of first contact
+
+						std::string identity;
+						try {
+							json j(OSUtils::jsonParse(body));
+							if (j.is_object())
+								identity = OSUtils::jsonString(j["identity"],"");
+						} catch ( ... ) {
+							// discard invalid JSON
+						}
+
+						Identity id;
+						int existing = 0;
+						if ((!id.fromString(identity.c_str()))||(!id.locallyValidate())) {
+							res["message"] = "identity is not valid";
+							scode = 400;
+						} else if (id.address().toInt() == _node->address()) {
+							res["message"] = "identity has this node's address";
+							scode = 409;
+						} else if (_node->addPeer((void *)0,identity.c_str(),&existing) == ZT_RESULT_OK) {
+							res["address"] = id.address().toString(tmp);
+							res["added"] = (existing == 0);
+							scode = 200;
+						} else if (existing == 2) {
+							res["address"] = id.address().toString(tmp);
+							res["message"] = "a different identity with this address is already known";
+							scode = 409;
+						} else scode = 500;
+					} else if ((ps.size() == 3)&&(ps[2] == "try")) {
+						// Send HELLO to a known peer at explicit endpoints; any that answer show up in /peer/<address>/paths
+
+						const uint64_t wantp = Utils::hexStrToU64(ps[1].c_str());
+						std::vector<std::string> endpoints;
+						uint64_t timeout = ZT_PEER_TRY_DEFAULT_TIMEOUT;
+						try {
+							json j(OSUtils::jsonParse(body));
+							if (j.is_object()) {
+								json &eps = j["endpoints"];
+								if (eps.is_array()) {
+									for(unsigned long i=0;i<eps.size();++i)
+										endpoints.push_back(OSUtils::jsonString(eps[i],""));
+								}
+								timeout = OSUtils::jsonInt(j["timeout"],(uint64_t)ZT_PEER_TRY_DEFAULT_TIMEOUT);
+							}
+						} catch ( ... ) {
+							// discard invalid JSON
+						}
+
+						if ((endpoints.empty())||(timeout > ZT_PEER_TRY_MAX_TIMEOUT)) {
+							scode = 400;
+						} else {
+							if (_isKnownPeer(wantp)) {
+								// The response is sent by _checkPeerTries() once every endpoint tried has answered or the timeout is up
+								PeerTry t;
+								t.tc = tc;
+								t.address = wantp;
+								t.started = OSUtils::now();
+								t.until = t.started + (int64_t)timeout;
+								std::map<std::string,std::string>::const_iterator jsonp(urlArgs.find("jsonp"));
+								if (jsonp != urlArgs.end())
+									t.jsonp = jsonp->second;
+								OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)wantp);
+								t.response["address"] = tmp;
+								t.response["timeout"] = timeout;
+								json &results = t.response["endpoints"];
+								results = json::array();
+								for(std::vector<std::string>::const_iterator ep(endpoints.begin());ep!=endpoints.end();++ep) {
+									const InetAddress epa(ep->c_str());
+									json r;
+									r["endpoint"] = *ep;
+									r["attempted"] = (_node->tryPeer((void *)0,wantp,reinterpret_cast<const struct sockaddr_storage *>(&epa)) == ZT_RESULT_OK);
+									r["active"] = false;
+									results.push_back(r);
+								}
+								_peerTries.push_back(t);
+								deferred = true;
+								scode = 200;
+							} else scode = 404;
+						}
+					} else if ((ps.size() == 3)&&(ps[2] == "prefer")) {
+						// Pin one of a peer's active paths until it expires
+
+						const uint64_t wantp = Utils::hexStrToU64(ps[1].c_str());
+						std::string endpoint;
+						try {
+							json j(OSUtils::jsonParse(body));
+							if (j.is_object())
+								endpoint = OSUtils::jsonString(j["endpoint"],"");
+						} catch ( ... ) {
+							// discard invalid JSON
+						}
+
+						const InetAddress epa(endpoint.c_str());
+						if ((epa.ss_family != AF_INET)&&(epa.ss_family != AF_INET6)) {
+							scode = 400;
+						} else if (!_isKnownPeer(wantp)) {
+							scode = 404;
+						} else if (_node->setPeerPreferredPath((void *)0,wantp,reinterpret_cast<const struct sockaddr_storage *>(&epa)) == ZT_RESULT_OK) {
+							OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)wantp);
+							res["address"] = tmp;
+							res["preferredPath"] = endpoint;
+							scode = 200;
+						} else {
+							res["message"] = "endpoint is not among this peer's active paths";
+							scode = 400;
+						}
+					} else scode = 404;
 				} else if (ps[0] == "network") {
 					if (ps.size() == 2) {
 
@@ -1522,6 +2160,8 @@ public:
 								if (nws->networks[i].nwid == wantnw) {
 									OneService::NetworkSettings localSettings;
 									getNetworkSettings(nws->networks[i].nwid,localSettings);
+									bool badToken = false;
+									const char *badSetting = (const char *)0;
 
 									try {
 										json j(OSUtils::jsonParse(body));
@@ -1534,26 +2174,117 @@ public:
 											if (allowDefault.is_boolean()) localSettings.allowDefault = (bool)allowDefault;
 											json &allowDNS = j["allowDNS"];
 											if (allowDNS.is_boolean()) localSettings.allowDNS = (bool)allowDNS;
+											json &upHook = j["upHook"];
+											if ((upHook.is_string())&&(_validHookPath(upHook))) localSettings.upHook = upHook;
+											else if (!upHook.is_null()) badSetting = "upHook must be an absolute path of at most 1000 characters without \\, = or line breaks (empty to clear)";
+											json &downHook = j["downHook"];
+											if ((downHook.is_string())&&(_validHookPath(downHook))) localSettings.downHook = downHook;
+											else if (!downHook.is_null()) badSetting = "downHook must be an absolute path of at most 1000 characters without \\, = or line breaks (empty to clear)";
+											json &authToken = j["authToken"];
+											if (authToken.is_string()) badToken = (_node->setNetworkAuthToken((void *)0,wantnw,authToken.get<std::string>().c_str()) != ZT_RESULT_OK);
+											json &multicastLimit = j["multicastLimit"];
+											if ((multicastLimit.is_number_unsigned())&&(multicastLimit.get<uint64_t>() <= 0xffffffffULL))
+												localSettings.multicastLimit = (unsigned int)multicastLimit.get<uint64_t>();
+											else if (!multicastLimit.is_null()) badSetting = "multicastLimit must be a non-negative integer (0 for the controller's limit)";
+											json &allowBridging = j["allowBridging"];
+											if (allowBridging.is_boolean()) localSettings.allowBridging = (bool)allowBridging;
+											else if (!allowBridging.is_null()) badSetting = "allowBridging must be true or false";
 										}
 									} catch ( ... ) {
 										// discard invalid JSON
 									}
 
+									if (badSetting) {
+										res["message"] = badSetting;
+										scode = 400;
+										break;
+									}
 									setNetworkSettings(nws->networks[i].nwid,localSettings);
-									_networkToJson(res,&(nws->networks[i]),portDeviceName(nws->networks[i].nwid),localSettings);
-
-									scode = 200;
+									_node->setNetworkLocalLimits((void *)0,wantnw,localSettings.multicastLimit,(localSettings.allowBridging) ? 1 : 0);
+									if (badToken) {
+										res["message"] = "authToken is too long";
+										scode = 400;
+									} else {
+										_networkToJson(res,&(nws->networks[i]),portDeviceName(nws->networks[i].nwid),localSettings);
+										scode = 200;
+									}
 									break;
 								}
 							}
 							_node->freeQueryResult((void *)nws);
 						} else scode = 500;
 
+					} else if ((ps.size() == 3)&&(ps[2] == "multicast")) {
+						const uint64_t wantnw = Utils::hexStrToU64(ps[1].c_str());
+						MulticastGroup mg;
+						std::string err("body must be an object with a mac and an adi");
+						try {
+							json j(OSUtils::jsonParse(body));
+							if (j.is_object())
+								err = _parseMulticastGroup(OSUtils::jsonString(j["mac"],""),j["adi"],mg);
+						} catch ( ... ) {}
+						if (!err.empty()) {
+							res["message"] = err;
+							scode = 400;
+						} else if (_node->multicastSubscribe((void *)0,wantnw,mg.mac().toInt(),mg.adi()) == ZT_RESULT_OK) {
+							{
+								Mutex::Lock _l(_nets_m);
+								std::map<uint64_t,NetworkState>::iterator n(_nets.find(wantnw));
+								if (n != _nets.end())
+									n->second.manualMulticastGroups.insert(mg);
+							}
+							_multicastToJson(wantnw,res);
+							scode = 200;
+						} else scode = 404;
+					} else if ((ps.size() == 3)&&(ps[2] == "refresh")) {
+						const uint64_t wantnw = Utils::hexStrToU64(ps[1].c_str());
+						if (_node->refreshNetworkConfig((void *)0,wantnw) == ZT_RESULT_OK) {
+							OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.16llx",(unsigned long long)wantnw);
+							res["id"] = tmp;
+							res["result"] = true;
+							scode = 200;
+						} else scode = 404;
 					} else scode = 404;
+				} else if (ps[0] == "token") {
+					if (ps.size() == 1) {
+						std::string scope;
+						try {
+							json j(OSUtils::jsonParse(body));
+							if (j.is_object())
+								scope = OSUtils::jsonString(j["scope"],"");
+						} catch ( ... ) {}
+						if ((scope == "controller")||(scope == "controller:read")) {
+							unsigned char r[29];
+							Utils::getSecureRandom(r,sizeof(r));
+							std::string token;
+							for(unsigned int i=0;i<24;++i)
+								token.push_back("abcdefghijklmnopqrstuvwxyz0123456789"[(unsigned long)r[i] % 36]);
+							json t;
+							OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.2x%.2x%.2x%.2x%.2x",r[24],r[25],r[26],r[27],r[28]);
+							t["id"] = tmp;
+							t["token"] = token;
+							t["scope"] = scope;
+							t["created"] = OSUtils::now();
+							_scopedTokens.push_back(t);
+							if (_saveScopedTokens()) {
+								res = t;
+								scode = 200;
+							} else {
+								_scopedTokens.erase(_scopedTokens.size() - 1);
+								res["message"] = "unable to write authtoken.scoped.secret";
+								scode = 500;
+							}
+						} else {
+							res["message"] = "scope must be controller or controller:read";
+							scode = 400;
+						}
+					} // else 404
 				} else {
-					if (_controller)
-						scode = _controller->handleControlPlaneHttpPOST(std::vector<std::string>(ps.begin()+1,ps.end()),urlArgs,headers,body,responseBody,responseContentType);
-					else scode = 404;
+					if (_controller) {
+						std::map<std::string,std::string> controllerHeaders(headers);
+						controllerHeaders["x-zt1-actor"] = actor; // never taken from the client
+						scode = _controller->handleControlPlaneHttpPOST(std::vector<std::string>(ps.begin()+1,ps.end()),urlArgs,controllerHeaders,body,responseBody,responseContentType);
+					} else scode = 404;
 				}
 
 			} else scode = 401; // isAuth == false
@@ -1566,6 +2297,46 @@ public:
 						res["result"] = true;
 						scode = 200;
 					} // else 404
+				} else if (ps[0] == "peer") {
+					if ((ps.size() == 3)&&(ps[2] == "prefer")) {
+						const uint64_t wantp = Utils::hexStrToU64(ps[1].c_str());
+						if (_node->setPeerPreferredPath((void *)0,wantp,(const struct sockaddr_storage *)0) == ZT_RESULT_OK) {
+							OSUtils::ztsnprintf(tmp,sizeof(tmp),"%.10llx",(unsigned long long)wantp);
+							res["address"] = tmp;
+							res["preferredPath"] = json();
+							scode = 200;
+						} else scode = 404;
+					} // else 404
+				} else if ((ps[0] == "network")&&(ps.size() == 5)&&(ps[2] == "multicast")) {
+					const uint64_t wantnw = Utils::hexStrToU64(ps[1].c_str());
+					MulticastGroup mg;
+					const std::string err(_parseMulticastGroup(ps[3],json(ps[4]),mg));
+					json subs;
+					if (!err.empty()) {
+						res["message"] = err;
+						scode = 400;
+					} else if (_multicastToJson(wantnw,subs)) {
+						bool subscribed = false;
+						char mtmp[32];
+						for(json::iterator m(subs.begin());m!=subs.end();++m) {
+							if ((OSUtils::jsonString((*m)["mac"],"") == mg.mac().toString(mtmp))&&(OSUtils::jsonInt((*m)["adi"],0ULL) == (uint64_t)mg.adi()))
+								subscribed = true;
+						}
+						if (subscribed) {
+							_node->multicastUnsubscribe(wantnw,mg.mac().toInt(),mg.adi());
+							{
+								Mutex::Lock _l(_nets_m);
+								std::map<uint64_t,NetworkState>::iterator n(_nets.find(wantnw));
+								if (n != _nets.end())
+									n->second.manualMulticastGroups.erase(mg);
+							}
+							_multicastToJson(wantnw,res);
+							scode = 200;
+						} else {
+							res["message"] = "not subscribed to that group";
+							scode = 404;
+						}
+					} else scode = 404;
 				} else if (ps[0] == "network") {
 					ZT_VirtualNetworkList *nws = _node->networks();
 					if (nws) {
@@ -1582,10 +2353,30 @@ public:
 						} // else 404
 						_node->freeQueryResult((void *)nws);
 					} else scode = 500;
+				} else if (ps[0] == "token") {
+					if (ps.size() == 2) {
+						json kept = json::array();
+						for(json::iterator t(_scopedTokens.begin());t!=_scopedTokens.end();++t) {
+							if (OSUtils::jsonString((*t)["id"],"") != ps[1])
+								kept.push_back(*t);
+						}
+						if (kept.size() != _scopedTokens.size()) {
+							_scopedTokens = kept;
+							if (_saveScopedTokens()) {
+								res["result"] = true;
+								scode = 200;
+							} else {
+								res["message"] = "unable to write authtoken.scoped.secret";
+								scode = 500;
+							}
+						} // else 404
+					} // else 404
 				} else {
-					if (_controller)
-						scode = _controller->handleControlPlaneHttpDELETE(std::vector<std::string>(ps.begin()+1,ps.end()),urlArgs,headers,body,responseBody,responseContentType);
-					else scode = 404;
+					if (_controller) {
+						std::map<std::string,std::string> controllerHeaders(headers);
+						controllerHeaders["x-zt1-actor"] = actor; // never taken from the client
+						scode = _controller->handleControlPlaneHttpDELETE(std::vector<std::string>(ps.begin()+1,ps.end()),urlArgs,controllerHeaders,body,responseBody,responseContentType);
+					} else scode = 404;
 				}
 
 			} else scode = 401; // isAuth = false
@@ -1863,6 +2654,26 @@ public:
 			}
 		}
 
+		// metricsListen is a port number (bound to loopback) or an explicit IP/port
+		_metricsListen.zero();
+		json &ml = settings["metricsListen"];
+		if (ml.is_number()) {
+			_metricsListen.fromString("127.0.0.1");
+			_metricsListen.setPort((unsigned int)OSUtils::jsonInt(ml,0ULL) & 0xffff);
+		} else if (ml.is_string()) {
+			const std::string mls(ml.get<std::string>());
+			if (mls.find('/') == std::string::npos) {
+				_metricsListen.fromString("127.0.0.1");
+				_metricsListen.setPort(Utils::strToUInt(mls.c_str()) & 0xffff);
+			} else {
+				_metricsListen.fromString(mls.c_str());
+			}
+		}
+		if ((_metricsListen.port() == 0)&&(_metricsListen)) {
+			fprintf(stderr,"WARNING: invalid metricsListen setting, metrics disabled" ZT_EOL_S);
+			_metricsListen.zero();
+		}
+
 		json &amf = settings["allowManagementFrom"];
 		if (amf.is_array()) {
 			for(unsigned long i=0;i<amf.size();++i) {
@@ -2163,6 +2974,7 @@ public:
 			tc->parent = this;
 			tc->sock = sockN;
 			tc->remoteAddr = from;
+			tc->metrics = ((_metricsSocket)&&(sockL == _metricsSocket));
 			tc->lastReceive = OSUtils::now();
 			http_parser_init(&(tc->parser),HTTP_REQUEST);
 			tc->parser.data = (void *)tc;
@@ -2179,6 +2991,11 @@ public:
 			if (tc == _tcpFallbackTunnel) {
 				_tcpFallbackTunnel = (TcpConnection *)0;
 			}
+			for(std::list<PeerTry>::iterator t(_peerTries.begin());t!=_peerTries.end();) {
+				if (t->tc == tc)
+					_peerTries.erase(t++);
+				else ++t;
+			}
 			{
 				Mutex::Lock _l(_tcpConnections_m);
 				_tcpConnections.erase(std::remove(_tcpConnections.begin(),_tcpConnections.end(),tc),_tcpConnections.end());
@@ -2204,8 +3021,9 @@ public:
 						case 'H': {
 							// This is only allowed from IPs permitted to access the management
 							// backplane, which is just 127.0.0.1/::1 unless otherwise configured.
-							bool allow;
-							{
+							// The metrics listener is limited only by the address it is bound to.
+							bool allow = tc->metrics;
+							if (!allow) {
 								Mutex::Lock _l(_localConfig_m);
 								if (_allowManagementFrom.empty()) {
 									allow = (tc->remoteAddr.ipScope() == InetAddress::IP_SCOPE_LOOPBACK);
@@ -2367,6 +3185,7 @@ public:
 						char friendlyName[128];
 						OSUtils::ztsnprintf(friendlyName,sizeof(friendlyName),"ZeroTier One [%.16llx]",nwid);
 
+						n.service = this;
 						n.tap = EthernetTap::newInstance(
 							nullptr,
 							_homePath.c_str(),
@@ -2376,7 +3195,7 @@ public:
 							nwid,
 							friendlyName,
 							StapFrameHandler,
-							(void *)this);
+							(void *)&n);
 						*nuptr = (void *)&n;
 
 						char nlcpath[256];
@@ -2412,6 +3231,15 @@ public:
 							n.settings.allowGlobal = nc.getB("allowGlobal", false);
 							n.settings.allowDefault = nc.getB("allowDefault", false);
 							n.settings.allowDNS = nc.getB("allowDNS", false);
+							char hook[1024];
+							if (nc.get("upHook",hook,sizeof(hook)) > 0)
+								n.settings.upHook = hook;
+							if (nc.get("downHook",hook,sizeof(hook)) > 0)
+								n.settings.downHook = hook;
+							char mcl[16];
+							if (nc.get("multicastLimit",mcl,sizeof(mcl)) > 0)
+								n.settings.multicastLimit = Utils::strToUInt(mcl);
+							n.settings.allowBridging = nc.getB("allowBridging", true);
 						}
 					} catch (std::exception &exc) {
 #ifdef __WINDOWS__
@@ -2446,6 +3274,12 @@ public:
 #endif
 					syncManagedStuff(n,true,true,true);
 					n.tap->setMtu(nwc->mtu);
+
+					const bool up = (nwc->status == ZT_NETWORK_STATUS_OK);
+					if (up != n.hookUp) {
+						n.hookUp = up;
+						_runNetworkHook(n,up);
+					}
 				} else {
 					_nets.erase(nwid);
 					return -999; // tap init failed
@@ -2454,6 +3288,10 @@ public:
 
 			case ZT_VIRTUAL_NETWORK_CONFIG_OPERATION_DOWN:
 			case ZT_VIRTUAL_NETWORK_CONFIG_OPERATION_DESTROY:
+				if (n.hookUp) {
+					n.hookUp = false;
+					_runNetworkHook(n,false);
+				}
 				if (n.tap) { // sanity check
 #if defined(__WINDOWS__) && !defined(ZT_SDK)
 					std::string winInstanceId(((WindowsEthernetTap *)(n.tap.get()))->instanceId());
@@ -2461,6 +3299,11 @@ public:
 					*nuptr = (void *)0;
 					n.tap.reset();
 					_nets.erase(nwid);
+					{
+						Mutex::Lock _l(_traces_m);
+						_traces.erase(nwid);
+						_tracing = !_traces.empty();
+					}
 #if defined(__WINDOWS__) && !defined(ZT_SDK)
 					if ((op == ZT_VIRTUAL_NETWORK_CONFIG_OPERATION_DESTROY)&&(winInstanceId.length() > 0))
 						WindowsEthernetTap::deletePersistentTapDevice(winInstanceId.c_str());
@@ -2489,6 +3332,10 @@ public:
 				this->terminate();
 			}	break;
 
+			case ZT_EVENT_ONLINE: {
+				_wasOnline = true;
+			}	break;
+
 			case ZT_EVENT_TRACE: {
 				if (metaData) {
 					::fprintf(stderr,"%s" ZT_EOL_S,(const char *)metaData);
@@ -2878,6 +3725,8 @@ public:
 		if ((!n)||(!n->tap))
 			return;
 		n->tap->put(MAC(sourceMac),MAC(destMac),etherType,data,len);
+		n->rxBytes += len;
+		_traceFrame(nwid,false,sourceMac,destMac,etherType,vlanId,len);
 	}
 
 	inline int nodePathCheckFunction(uint64_t ztaddr,const int64_t localSocket,const struct sockaddr_storage *remoteAddr)
@@ -2950,23 +3799,382 @@ public:
 		else return 0;
 	}
 
-	inline void tapFrameHandler(uint64_t nwid, const MAC& from, const MAC& to, unsigned int etherType, unsigned int vlanId, const void* data, unsigned int len)
+	// The controller scope allows all of /controller, controller:read only its GET requests other
+	// than backups, which include hook secrets
+	static bool _tokenScopeAllows(const std::string &scope,unsigned int httpMethod,const std::vector<std::string> &ps)
+	{
+		if ((ps.empty())||(ps[0] != "controller"))
+			return false;
+		if (scope == "controller")
+			return true;
+		return ((scope == "controller:read")&&(httpMethod == HTTP_GET)&&(!((ps.size() == 2)&&(ps[1] == "backup"))));
+	}
+
+	bool _saveScopedTokens()
+	{
+		return OSUtils::writeSecretFile((_homePath + ZT_PATH_SEPARATOR_S "authtoken.scoped.secret").c_str(),OSUtils::jsonDump(_scopedTokens));
+	}
+
+	// Parse a multicast group from the API, returning an empty string or an error
+	static std::string _parseMulticastGroup(const std::string &mac,const json &adi,MulticastGroup &mg)
+	{
+		std::string hex;
+		for(std::string::const_iterator c(mac.begin());c!=mac.end();++c) {
+			if ((*c != ':')&&(*c != '-'))
+				hex.push_back(*c);
+		}
+		if ((hex.length() != 12)||(hex.find_first_not_of("0123456789abcdefABCDEF") != std::string::npos))
+			return "mac must be a MAC address like 01:00:5e:00:00:fb";
+		const MAC m(Utils::hexStrToU64(hex.c_str()));
+		if ((m[0] & 0x01) == 0)
+			return "mac must be a multicast MAC address (first octet odd)";
+		uint64_t a = 0;
+		if (adi.is_number_unsigned()) {
+			a = adi;
+		} else if ((adi.is_string())&&(!adi.get<std::string>().empty())&&(adi.get<std::string>().length() <= 10)&&(adi.get<std::string>().find_first_not_of("0123456789") == std::string::npos)) {
+			a = Utils::strToU64(adi.get<std::string>().c_str());
+		} else if (!adi.is_null()) {
+			return "adi must be an integer from 0 to 4294967295";
+		}
+		if (a > 0xffffffffULL)
+			return "adi must be an integer from 0 to 4294967295";
+		mg = MulticastGroup(m,(uint32_t)a);
+		return std::string();
+	}
+
+	// Record a frame's metadata if its network is being traced
+	void _traceFrame(const uint64_t nwid,const bool outbound,const uint64_t src,const uint64_t dst,const unsigned int etherType,const unsigned int vlanId,const unsigned int len)
+	{
+		if (!_tracing.load(std::memory_order_relaxed))
+			return;
+		Mutex::Lock _l(_traces_m);
+		std::map<uint64_t,NetworkTrace>::iterator t(_traces.find(nwid));
+		if (t == _traces.end())
+			return;
+		const int64_t now = OSUtils::now();
+		if (now > t->second.until) {
+			_traces.erase(t);
+			_tracing = !_traces.empty();
+			return;
+		}
+		TraceFrame f;
+		f.seq = t->second.seq++;
+		f.time = now;
+		f.outbound = outbound;
+		f.src = src;
+		f.dst = dst;
+		f.etherType = etherType;
+		f.vlanId = vlanId;
+		f.len = len;
+		t->second.frames.push_back(f);
+		if (t->second.frames.size() > ZT_TRACE_MAX_FRAMES)
+			t->second.frames.pop_front();
+	}
+
+	// Frames traced on a network since a sequence number, starting or extending the trace.
+	// Without one only the next sequence number is returned, to start reading from.
+	void _traceToJson(const uint64_t nwid,const bool all,uint64_t since,json &out)
+	{
+		char tmp[32];
+		json frames = json::array();
+		Mutex::Lock _l(_traces_m);
+		NetworkTrace &t = _traces[nwid];
+		_tracing = true;
+		t.until = OSUtils::now() + ZT_TRACE_IDLE_TIMEOUT;
+		if (!all)
+			since = t.seq;
+		uint64_t dropped = 0;
+		if ((!t.frames.empty())&&(since < t.frames.front().seq))
+			dropped = t.frames.front().seq - since;
+		for(std::deque<TraceFrame>::const_iterator f(t.frames.begin());f!=t.frames.end();++f) {
+			if (f->seq < since)
+				continue;
+			json fj;
+			fj["seq"] = f->seq;
+			fj["time"] = f->time;
+			fj["direction"] = (f->outbound) ? "out" : "in";
+			fj["src"] = MAC(f->src).toString(tmp);
+			fj["dst"] = MAC(f->dst).toString(tmp);
+			fj["etherType"] = f->etherType;
+			fj["vlanId"] = f->vlanId;
+			fj["length"] = f->len;
+			frames.push_back(fj);
+		}
+		out["next"] = t.seq;
+		out["dropped"] = dropped;
+		out["frames"] = frames;
+	}
+
+	// Current multicast subscriptions of a network, or false if it is not joined
+	bool _multicastToJson(const uint64_t nwid,json &out)
+	{
+		ZT_VirtualNetworkConfig *nc = _node->networkConfig(nwid);
+		if (!nc)
+			return false;
+		std::set<MulticastGroup> manual;
+		{
+			Mutex::Lock _l(_nets_m);
+			std::map<uint64_t,NetworkState>::const_iterator n(_nets.find(nwid));
+			if (n != _nets.end())
+				manual = n->second.manualMulticastGroups;
+		}
+		char tmp[32];
+		out = json::array();
+		for(unsigned int i=0;i<nc->multicastSubscriptionCount;++i) {
+			const MulticastGroup mg(MAC(nc->multicastSubscriptions[i].mac),(uint32_t)nc->multicastSubscriptions[i].adi);
+			json m;
+			m["mac"] = mg.mac().toString(tmp);
+			m["adi"] = mg.adi();
+			m["manual"] = (manual.count(mg) > 0);
+			out.push_back(m);
+		}
+		_node->freeQueryResult((void *)nc);
+		return true;
+	}
+
+	// Hooks are absolute paths, and must survive the network's local.conf dictionary format
+	static bool _validHookPath(const std::string &path)
+	{
+		if (path.empty())
+			return true;
+		if ((path[0] != '/')||(path.length() > 1000))
+			return false;
+		return (path.find_first_of("\\=\r\n") == std::string::npos);
+	}
+
+	// Run a network's up or down hook, if it has one, without waiting for it to finish
+	void _runNetworkHook(const NetworkState &n,bool up)
+	{
+		const std::string &hook = (up) ? n.settings.upHook : n.settings.downHook;
+		if (hook.empty())
+			return;
+#ifdef __WINDOWS__
+		fprintf(stderr,"WARNING: network up/down hooks are not supported on this platform" ZT_EOL_S);
+#else
+		// Hooks run as the service user (usually root), so refuse any file another user could have changed
+		struct stat st;
+		if ((stat(hook.c_str(),&st) != 0)||(!S_ISREG(st.st_mode))||((st.st_mode & S_IXUSR) == 0)) {
+			fprintf(stderr,"WARNING: %s hook %s for network %.16llx is not an executable file" ZT_EOL_S,(up) ? "up" : "down",hook.c_str(),(unsigned long long)n.config.nwid);
+			return;
+		}
+		if (((st.st_uid != 0)&&(st.st_uid != geteuid()))||((st.st_mode & (S_IWGRP|S_IWOTH)) != 0)) {
+			fprintf(stderr,"WARNING: not running %s hook %s for network %.16llx: it must be owned by root or the service user and not writable by group or others" ZT_EOL_S,(up) ? "up" : "down",hook.c_str(),(unsigned long long)n.config.nwid);
+			return;
+		}
+
+		char tmp[256];
+		std::vector<std::string> env;
+		env.push_back(std::string("ZT_EVENT=") + ((up) ? "up" : "down"));
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),"ZT_NETWORK_ID=%.16llx",(unsigned long long)n.config.nwid);
+		env.push_back(tmp);
+		env.push_back(std::string("ZT_NETWORK_NAME=") + n.config.name);
+		env.push_back(std::string("ZT_INTERFACE=") + ((n.tap) ? n.tap->deviceName() : std::string()));
+		std::string ips;
+		for(unsigned int i=0;i<n.config.assignedAddressCount;++i) {
+			if (i > 0)
+				ips.push_back(' ');
+			ips.append(reinterpret_cast<const InetAddress *>(&(n.config.assignedAddresses[i]))->toString(tmp));
+		}
+		env.push_back(std::string("ZT_ASSIGNED_ADDRESSES=") + ips);
+		env.push_back("PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin");
+		std::vector<char *> envp;
+		for(std::vector<std::string>::iterator e(env.begin());e!=env.end();++e)
+			envp.push_back(const_cast<char *>(e->c_str()));
+		envp.push_back((char *)0);
+		char *const argv[2] = { const_cast<char *>(hook.c_str()),(char *)0 };
+
+		// Fork twice so the hook is reparented to init and never left as a zombie
+		const pid_t pid = fork();
+		if (pid == 0) {
+			if (fork() == 0) {
+				const int devnull = open("/dev/null",O_RDONLY);
+				if (devnull >= 0)
+					dup2(devnull,STDIN_FILENO);
+				for(int fd=3;fd<1024;++fd)
+					close(fd);
+				execve(hook.c_str(),argv,envp.data());
+			}
+			_exit(0);
+		} else if (pid > 0) {
+			int status = 0;
+			waitpid(pid,&status,0);
+		}
+#endif
+	}
+
+	inline void tapFrameHandler(NetworkState &n, uint64_t nwid, const MAC& from, const MAC& to, unsigned int etherType, unsigned int vlanId, const void* data, unsigned int len)
 	{
 		_node->processVirtualNetworkFrame((void*)0, OSUtils::now(), nwid, from.toInt(), to.toInt(), etherType, vlanId, data, len, &_nextBackgroundTaskDeadline);
+		n.txBytes += len;
+		_traceFrame(nwid,true,from.toInt(),to.toInt(),etherType,vlanId,len);
+	}
+
+	// Render node, peer, and network counters in the Prometheus text format
+	void _metricsText(std::string &out)
+	{
+		char tmp[2048];
+		const int64_t now = OSUtils::now();
+
+		ZT_NodeStatus status;
+		_node->status(&status);
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),
+			"# HELP zerotier_node_info Node address and version" ZT_EOL_S
+			"# TYPE zerotier_node_info gauge" ZT_EOL_S
+			"zerotier_node_info{address=\"%.10llx\",version=\"%d.%d.%d\"} 1" ZT_EOL_S
+			"# HELP zerotier_node_online Whether the node is online (in contact with a root)" ZT_EOL_S
+			"# TYPE zerotier_node_online gauge" ZT_EOL_S
+			"zerotier_node_online %d" ZT_EOL_S
+			"# HELP zerotier_uptime_seconds Seconds since the service started" ZT_EOL_S
+			"# TYPE zerotier_uptime_seconds gauge" ZT_EOL_S
+			"zerotier_uptime_seconds %lld" ZT_EOL_S,
+			(unsigned long long)status.address,ZEROTIER_ONE_VERSION_MAJOR,ZEROTIER_ONE_VERSION_MINOR,ZEROTIER_ONE_VERSION_REVISION,
+			status.online ? 1 : 0,
+			(long long)((now - _startTime) / 1000));
+		out.append(tmp);
+
+		unsigned long peersByRole[3] = { 0,0,0 };
+		unsigned long directPeers = 0,rootsReachable = 0;
+		ZT_PeerList *pl = _node->peers();
+		if (pl) {
+			for(unsigned long i=0;i<pl->peerCount;++i) {
+				const ZT_Peer &p = pl->peers[i];
+				if ((unsigned int)p.role < 3)
+					++peersByRole[(unsigned int)p.role];
+				bool direct = false,reachable = false;
+				for(unsigned int k=0;k<p.pathCount;++k) {
+					if (!p.paths[k].expired) {
+						direct = true;
+						if ((now - p.paths[k].lastReceive) < (ZT_PATH_HEARTBEAT_PERIOD + 5000))
+							reachable = true;
+					}
+				}
+				if (direct)
+					++directPeers;
+				if ((reachable)&&(p.role != ZT_PEER_ROLE_LEAF))
+					++rootsReachable;
+			}
+			_node->freeQueryResult((void *)pl);
+		}
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),
+			"# HELP zerotier_peers Known peers by role" ZT_EOL_S
+			"# TYPE zerotier_peers gauge" ZT_EOL_S
+			"zerotier_peers{role=\"leaf\"} %lu" ZT_EOL_S
+			"zerotier_peers{role=\"moon\"} %lu" ZT_EOL_S
+			"zerotier_peers{role=\"planet\"} %lu" ZT_EOL_S
+			"# HELP zerotier_peers_direct Peers with at least one live physical path" ZT_EOL_S
+			"# TYPE zerotier_peers_direct gauge" ZT_EOL_S
+			"zerotier_peers_direct %lu" ZT_EOL_S
+			"# HELP zerotier_roots Known planet and moon roots" ZT_EOL_S
+			"# TYPE zerotier_roots gauge" ZT_EOL_S
+			"zerotier_roots %lu" ZT_EOL_S
+			"# HELP zerotier_roots_reachable Roots heard from within the last heartbeat period" ZT_EOL_S
+			"# TYPE zerotier_roots_reachable gauge" ZT_EOL_S
+			"zerotier_roots_reachable %lu" ZT_EOL_S,
+			peersByRole[ZT_PEER_ROLE_LEAF],peersByRole[ZT_PEER_ROLE_MOON],peersByRole[ZT_PEER_ROLE_PLANET],
+			directPeers,
+			peersByRole[ZT_PEER_ROLE_MOON] + peersByRole[ZT_PEER_ROLE_PLANET],
+			rootsReachable);
+		out.append(tmp);
+
+		if (_controller)
+			_controllerMetricsText(out);
+
+		struct NetMetrics
+		{
+			uint64_t nwid;
+			unsigned int status;
+			uint64_t rx,tx;
+		};
+		std::vector<NetMetrics> nets;
+		{
+			Mutex::Lock _l(_nets_m);
+			for(std::map<uint64_t,NetworkState>::const_iterator n(_nets.begin());n!=_nets.end();++n) {
+				NetMetrics m;
+				m.nwid = n->first;
+				m.status = n->second.config.status;
+				m.rx = n->second.rxBytes;
+				m.tx = n->second.txBytes;
+				nets.push_back(m);
+			}
+		}
+		OSUtils::ztsnprintf(tmp,sizeof(tmp),
+			"# HELP zerotier_networks Joined virtual networks" ZT_EOL_S
+			"# TYPE zerotier_networks gauge" ZT_EOL_S
+			"zerotier_networks %lu" ZT_EOL_S,
+			(unsigned long)nets.size());
+		out.append(tmp);
+		if (nets.empty())
+			return;
+
+		std::string ok,rx,tx;
+		for(std::vector<NetMetrics>::const_iterator n(nets.begin());n!=nets.end();++n) {
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"zerotier_network_ok{network=\"%.16llx\"} %d" ZT_EOL_S,(unsigned long long)n->nwid,(n->status == ZT_NETWORK_STATUS_OK) ? 1 : 0);
+			ok.append(tmp);
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"zerotier_network_received_bytes_total{network=\"%.16llx\"} %llu" ZT_EOL_S,(unsigned long long)n->nwid,(unsigned long long)n->rx);
+			rx.append(tmp);
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"zerotier_network_transmitted_bytes_total{network=\"%.16llx\"} %llu" ZT_EOL_S,(unsigned long long)n->nwid,(unsigned long long)n->tx);
+			tx.append(tmp);
+		}
+		out.append("# HELP zerotier_network_ok Whether the network has a valid config from its controller" ZT_EOL_S "# TYPE zerotier_network_ok gauge" ZT_EOL_S);
+		out.append(ok);
+		out.append("# HELP zerotier_network_received_bytes_total Ethernet frame bytes received from the network" ZT_EOL_S "# TYPE zerotier_network_received_bytes_total counter" ZT_EOL_S);
+		out.append(rx);
+		out.append("# HELP zerotier_network_transmitted_bytes_total Ethernet frame bytes sent to the network" ZT_EOL_S "# TYPE zerotier_network_transmitted_bytes_total counter" ZT_EOL_S);
+		out.append(tx);
+	}
+
+	// Render the controller's per-network counters, see ControllerStats
+	void _controllerMetricsText(std::string &out)
+	{
+		static const char *const counters[4][3] = {
+			{ "configRequests","config_requests_total","Config requests answered with a config" },
+			{ "newMembers","new_members_total","Members seen for the first time" },
+			{ "authorizations","authorizations_total","Members authorized, by an admin or automatically" },
+			{ "deauthorizations","deauthorizations_total","Members deauthorized, by an admin or on expiry" }
+		};
+		char tmp[512];
+		nlohmann::json nc(_controller->networkCounters());
+		if (nc.empty())
+			return;
+		for(unsigned int c=0;c<4;++c) {
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),"# HELP zerotier_controller_%s %s" ZT_EOL_S "# TYPE zerotier_controller_%s counter" ZT_EOL_S,counters[c][1],counters[c][2],counters[c][1]);
+			out.append(tmp);
+			for(nlohmann::json::iterator n(nc.begin());n!=nc.end();++n) {
+				OSUtils::ztsnprintf(tmp,sizeof(tmp),"zerotier_controller_%s{network=\"%s\"} %llu" ZT_EOL_S,counters[c][1],n.key().c_str(),(unsigned long long)OSUtils::jsonInt(n.value()[counters[c][0]],0ULL));
+				out.append(tmp);
+			}
+		}
+		out.append("# HELP zerotier_controller_active_members Members that requested config within the window" ZT_EOL_S "# TYPE zerotier_controller_active_members gauge" ZT_EOL_S);
+		for(nlohmann::json::iterator n(nc.begin());n!=nc.end();++n) {
+			OSUtils::ztsnprintf(tmp,sizeof(tmp),
+				"zerotier_controller_active_members{network=\"%s\",window=\"5m\"} %llu" ZT_EOL_S
+				"zerotier_controller_active_members{network=\"%s\",window=\"60m\"} %llu" ZT_EOL_S,
+				n.key().c_str(),(unsigned long long)OSUtils::jsonInt(n.value()["activeMembers5m"],0ULL),
+				n.key().c_str(),(unsigned long long)OSUtils::jsonInt(n.value()["activeMembers60m"],0ULL));
+			out.append(tmp);
+		}
 	}
 
 	inline void onHttpRequestToServer(TcpConnection* tc)
 	{
-		char tmpn[4096];
 		std::string data;
 		std::string contentType("text/plain"); // default if not changed in handleRequest()
 		unsigned int scode = 404;
+		bool deferred = false;
 
 		// Note that we check allowed IP ranges when HTTP connections are first detected in
 		// phyOnTcpData(). If we made it here the source IP is okay.
 
 		try {
-			scode = handleControlPlaneHttpRequest(tc->remoteAddr, tc->parser.method, tc->url, tc->headers, tc->readq, data, contentType);
+			if (tc->metrics) {
+				if (((tc->parser.method == HTTP_GET)||(tc->parser.method == HTTP_HEAD))&&(tc->url.substr(0,tc->url.find('?')) == "/metrics")) {
+					_metricsText(data);
+					contentType = "text/plain; version=0.0.4";
+					scode = 200;
+				}
+			} else {
+				scode = handleControlPlaneHttpRequest(tc->remoteAddr, tc->parser.method, tc->url, tc->headers, tc->readq, data, contentType, tc, deferred);
+			}
 		}
 		catch (std::exception& exc) {
 			fprintf(stderr, "WARNING: unexpected exception processing control HTTP request: %s" ZT_EOL_S, exc.what());
@@ -2977,6 +4185,16 @@ public:
 			scode = 500;
 		}
 
+		// A peer try answers later, once its endpoints have had a chance to reply
+		if (deferred)
+			return;
+
+		_httpRespond(tc, scode, contentType, data);
+	}
+
+	void _httpRespond(TcpConnection* tc, const unsigned int scode, const std::string& contentType, const std::string& data)
+	{
+		char tmpn[4096];
 		const char* scodestr;
 		switch (scode) {
 		case 200: scodestr = "OK"; break;
@@ -3005,6 +4223,57 @@ public:
 		_phy.setNotifyWritable(tc->sock, true);
 	}
 
+	// Send the responses of peer tries whose endpoints have all answered or whose time is up
+	void _checkPeerTries(const int64_t now)
+	{
+		if (_peerTries.empty())
+			return;
+		ZT_PeerList *pl = _node->peers();
+		for(std::list<PeerTry>::iterator t(_peerTries.begin());t!=_peerTries.end();) {
+			const ZT_Peer *p = (const ZT_Peer *)0;
+			for(unsigned long i=0;((pl)&&(i<pl->peerCount));++i) {
+				if (pl->peers[i].address == t->address) {
+					p = &(pl->peers[i]);
+					break;
+				}
+			}
+
+			bool done = true;
+			json &results = t->response["endpoints"];
+			for(unsigned long i=0;i<results.size();++i) {
+				if (!OSUtils::jsonBool(results[i]["attempted"],false))
+					continue;
+				const InetAddress epa(OSUtils::jsonString(results[i]["endpoint"],"").c_str());
+				bool active = false;
+				for(unsigned int k=0;((p)&&(k<p->pathCount));++k) {
+					if ((*reinterpret_cast<const InetAddress *>(&(p->paths[k].address)) == epa)&&((int64_t)p->paths[k].lastReceive >= t->started)) {
+						active = true;
+						break;
+					}
+				}
+				results[i]["active"] = active;
+				if (!active)
+					done = false;
+			}
+
+			if ((done)||(now >= t->until)) {
+				for(unsigned long i=0;i<results.size();++i) {
+					if (!OSUtils::jsonBool(results[i]["attempted"],false))
+						results[i]["result"] = "not_attempted";
+					else results[i]["result"] = (OSUtils::jsonBool(results[i]["active"],false)) ? "active" : "failed";
+				}
+				t->response["waited"] = now - t->started;
+				// Wrapped as handleControlPlaneHttpRequest() would have if it had answered right away
+				if (t->jsonp.length() > 0)
+					_httpRespond(t->tc,200,"application/javascript",t->jsonp + "(" + OSUtils::jsonDump(t->response) + ");");
+				else _httpRespond(t->tc,200,"application/json",OSUtils::jsonDump(t->response));
+				_peerTries.erase(t++);
+			} else ++t;
+		}
+		if (pl)
+			_node->freeQueryResult((void *)pl);
+	}
+
 	inline void onHttpResponseFromClient(TcpConnection* tc)
 	{
 		_phy.close(tc->sock);
@@ -3080,6 +4349,31 @@ public:
 		return true;
 	}
 
+	bool _isKnownPeer(const uint64_t address)
+	{
+		// Peers with no recent traffic are dropped from memory but stay in the peer cache, which this also checks
+		char idtmp[ZT_IDENTITY_STRING_BUFFER_LENGTH];
+		return (_node->peerIdentity((void *)0,address,idtmp,sizeof(idtmp)) == ZT_RESULT_OK);
+	}
+
+	// Apply a network's saved multicast and bridging limits to the core, which does not
+	// persist them; settings loaded in the port callback can't be applied from there
+	void _applyLocalLimits(const uint64_t nwid)
+	{
+		char nlcpath[256];
+		OSUtils::ztsnprintf(nlcpath,sizeof(nlcpath),"%s" ZT_PATH_SEPARATOR_S "%.16llx.local.conf",_networksPath.c_str(),nwid);
+		std::string nlcbuf;
+		if (!OSUtils::readFile(nlcpath,nlcbuf))
+			return;
+		Dictionary<4096> nc;
+		nc.load(nlcbuf.c_str());
+		char mcl[16];
+		const unsigned int multicastLimit = (nc.get("multicastLimit",mcl,sizeof(mcl)) > 0) ? Utils::strToUInt(mcl) : 0;
+		const bool allowBridging = nc.getB("allowBridging",true);
+		if ((multicastLimit)||(!allowBridging))
+			_node->setNetworkLocalLimits((void *)0,nwid,multicastLimit,(allowBridging) ? 1 : 0);
+	}
+
 	bool _trialBind(unsigned int port)
 	{
 		struct sockaddr_in in4;
@@ -3133,7 +4427,10 @@ static int SnodePathCheckFunction(ZT_Node *node,void *uptr,void *tptr,uint64_t z
 static int SnodePathLookupFunction(ZT_Node *node,void *uptr,void *tptr,uint64_t ztaddr,int family,struct sockaddr_storage *result)
 { return reinterpret_cast<OneServiceImpl *>(uptr)->nodePathLookupFunction(ztaddr,family,result); }
 static void StapFrameHandler(void *uptr,void *tptr,uint64_t nwid,const MAC &from,const MAC &to,unsigned int etherType,unsigned int vlanId,const void *data,unsigned int len)
-{ reinterpret_cast<OneServiceImpl *>(uptr)->tapFrameHandler(nwid,from,to,etherType,vlanId,data,len); }
+{
+	OneServiceImpl::NetworkState *n = reinterpret_cast<OneServiceImpl::NetworkState *>(uptr);
+	n->service->tapFrameHandler(*n,nwid,from,to,etherType,vlanId,data,len);
+}
 
 static int ShttpOnMessageBegin(http_parser *parser)
 {
@@ -3221,6 +4518,7 @@ std::string OneService::platformDefaultHomePath()
 }
 
 OneService *OneService::newInstance(const char *hp,unsigned int port) { return new OneServiceImpl(hp,port); }
+const char *const *OneService::controlPlaneRoutes() { return OneServiceImpl::_controlPlaneRoutes(); }
 OneService::~OneService() {}
 
 } // namespace ZeroTier
@@ -58,7 +58,17 @@ public:
 		/**
 		 * Your identity has collided with another
 		 */
-		ONE_IDENTITY_COLLISION = 3
+		ONE_IDENTITY_COLLISION = 3,
+
+		/**
+		 * Identity was replaced via the API, restart to use it
+		 */
+		ONE_IDENTITY_REPLACED = 4,
+
+		/**
+		 * Planet was replaced via the API, restart to use it
+		 */
+		ONE_PLANET_REPLACED = 5
 	};
 
 	/**
@@ -91,6 +101,26 @@ public:
 		 * Allow configuration of DNS for the network
 		 */
 		bool allowDNS;
+
+		/**
+		 * Program to run when the network comes up (status OK), or empty for none
+		 */
+		std::string upHook;
+
+		/**
+		 * Program to run when the network goes down or is left, or empty for none
+		 */
+		std::string downHook;
+
+		/**
+		 * Local multicast recipient limit, or 0 for the controller's (can only lower it)
+		 */
+		unsigned int multicastLimit;
+
+		/**
+		 * Allow bridging if the controller designates this node a bridge?
+		 */
+		bool allowBridging;
 	};
 
 	/**
@@ -113,6 +143,13 @@ public:
 	 */
 	static OneService *newInstance(const char *hp,unsigned int port);
 
+	/**
+	 * @return Routes the service serves itself, as "GET /network/{networkId}" and so on with
+	 *   parameters named as in doc/openapi.json, ending with NULL; /controller routes are
+	 *   in EmbeddedNetworkController::controlPlaneRoutes()
+	 */
+	static const char *const *controlPlaneRoutes();
+
 	virtual ~OneService();
 
 	/**
@@ -100,6 +100,10 @@ restart_node:
 				}
 			}	goto restart_node;
 
+			case ZeroTier::OneService::ONE_IDENTITY_REPLACED:
+			case ZeroTier::OneService::ONE_PLANET_REPLACED:
+				goto restart_node;
+
 			default: // normal termination
 				break;
 		}
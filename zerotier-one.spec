@@ -6,6 +6,8 @@ Summary:        ZeroTier network virtualization service
 License:        ZeroTier BSL 1.1
 URL:            https://www.zerotier.com
 
+BuildRequires:  sqlite-devel
+
 %if 0%{?rhel} >= 7
 BuildRequires:  systemd
 %endif